@@ -17,12 +17,16 @@ struct EnrollmentRequest {
     architecture: String,
 }
 
+/// What the backend returns from a successful enroll. `token` is this
+/// agent's bearer token (uag_…); `token_id` names it in the host's token
+/// list, where an operator can revoke it. `host_id` is the backend's numeric
+/// ID for the host, unrelated to the agent's own UUID.
 #[derive(Debug, Deserialize)]
 struct EnrollmentResponse {
-    api_key: String,
-    host_id: String,
-    success: bool,
-    message: Option<String>,
+    token: String,
+    token_id: i64,
+    host_id: i64,
+    expires_at: String,
 }
 
 pub struct EnrollmentManager {
@@ -87,24 +91,16 @@ impl EnrollmentManager {
             .await
             .with_context(|| "Failed to parse enrollment response")?;
 
-        if !enrollment_response.success {
-            return Err(anyhow::anyhow!(
-                "Enrollment rejected: {}",
-                enrollment_response.message.unwrap_or_default()
-            ));
-        }
-
         // Save API key securely
-        self.save_api_key(&enrollment_response.api_key)
+        self.save_api_key(&enrollment_response.token)
             .with_context(|| "Failed to save API key")?;
 
-        // Update host ID if backend provided one
-        if enrollment_response.host_id != host_id {
-            self.save_host_id(&enrollment_response.host_id)
-                .with_context(|| "Failed to save host ID")?;
-        }
-
-        info!("Agent enrollment completed successfully");
+        info!(
+            "Agent enrollment completed successfully: backend host {}, agent token {} (expires {})",
+            enrollment_response.host_id,
+            enrollment_response.token_id,
+            enrollment_response.expires_at
+        );
         Ok(())
     }
 
@@ -229,6 +225,16 @@ mod tests {
         assert!(host_id_file.to_string_lossy().contains("host.id"));
     }
 
+    #[test]
+    fn test_enrollment_response_parsing() {
+        let body = r#"{"token":"uag_0123abcd","token_id":5,"host_id":42,"expires_at":"2026-01-14T12:00:00Z"}"#;
+        let resp: EnrollmentResponse = serde_json::from_str(body).unwrap();
+        assert_eq!(resp.token, "uag_0123abcd");
+        assert_eq!(resp.token_id, 5);
+        assert_eq!(resp.host_id, 42);
+        assert_eq!(resp.expires_at, "2026-01-14T12:00:00Z");
+    }
+
     #[test]
     fn test_os_version_parsing() {
         let _config = AgentConfig::default();
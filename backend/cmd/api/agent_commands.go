@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	log "github.com/sirupsen/logrus"
+
+	"ubuntu-auto-update/backend/pkg/audit"
+	"ubuntu-auto-update/backend/pkg/db"
+	"ubuntu-auto-update/backend/pkg/middleware"
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+// handleEnqueueCommand queues a shell command for the host's agent to pick
+// up on its next poll. It is the pull-model twin of execute-script, for
+// hosts the server can't reach over SSH, and applies the same size limit
+// and footgun check (bypassed with "force": true). EXECUTE_MODE=allowlist
+// turns it off, since a queued command is as free-form as a sent script.
+func (app *Application) handleEnqueueCommand(w http.ResponseWriter, r *http.Request) {
+	id, err := parseHostID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+	if app.ScriptsOnly {
+		log.Warnf("command for host %d refused: only named scripts are allowed", id)
+		writeJSONError(w, http.StatusForbidden, "Only named scripts can run on this server; use execute-script with ?script_name=")
+		return
+	}
+	var req struct {
+		Command string `json:"command"`
+		Force   bool   `json:"force"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if strings.TrimSpace(req.Command) == "" {
+		writeJSONError(w, http.StatusBadRequest, "command is required")
+		return
+	}
+	if len(req.Command) > maxScriptBytes {
+		writeJSONError(w, http.StatusBadRequest, "command exceeds "+strconv.Itoa(maxScriptBytes)+" bytes")
+		return
+	}
+	if reason := scriptFootgun(req.Command); reason != "" && !req.Force {
+		writeJSONError(w, http.StatusBadRequest, "command refused ("+reason+"); resend with force: true to queue it anyway")
+		return
+	}
+	if _, err := db.GetHost(r.Context(), app.DB, id); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "Host not found")
+			return
+		}
+		log.Errorf("Failed to get host %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to queue command")
+		return
+	}
+
+	enqueuedBy := "unknown"
+	if user := middleware.GetUserFromContext(r); user != nil {
+		enqueuedBy = user.Username
+	}
+	cmd, err := db.EnqueueCommand(r.Context(), app.DB, id, req.Command, enqueuedBy)
+	if err != nil {
+		log.Errorf("Failed to queue command for host %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to queue command")
+		return
+	}
+	app.audit(r, audit.ActionCommandEnqueue, "host", strconv.FormatInt(int64(id), 10),
+		map[string]interface{}{"command_id": cmd.ID, "command_bytes": len(req.Command), "forced": req.Force})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(cmd)
+}
+
+// handleListCommands returns the host's command queue, newest first, with
+// results for the commands its agent has reported on.
+func (app *Application) handleListCommands(w http.ResponseWriter, r *http.Request) {
+	id, err := parseHostID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+	cmds, err := db.ListCommands(r.Context(), app.DB, id)
+	if err != nil {
+		log.Errorf("Failed to list commands for host %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to list commands")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cmds)
+}
+
+// agentHost resolves the host behind an agent token by the id it was
+// issued to, so the command queue follows the host rather than whatever
+// hostname it reports under. On failure it writes the error response and
+// returns ok = false.
+func (app *Application) agentHost(w http.ResponseWriter, r *http.Request) (models.Host, bool) {
+	p := middleware.GetPrincipalFromContext(r)
+	if p == nil || !p.IsAgent() || p.HostID == 0 {
+		writeJSONError(w, http.StatusForbidden, "Only agent tokens can use this endpoint")
+		return models.Host{}, false
+	}
+	host, err := db.GetHost(r.Context(), app.DB, p.HostID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "Host not found")
+			return models.Host{}, false
+		}
+		log.Errorf("Failed to look up agent host %d: %v", p.HostID, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to look up host")
+		return models.Host{}, false
+	}
+	return host, true
+}
+
+// handleAgentCommands is the agent's poll: it returns the calling host's
+// queued commands, oldest first, and marks them dispatched so the next poll
+// doesn't hand them out again.
+func (app *Application) handleAgentCommands(w http.ResponseWriter, r *http.Request) {
+	host, ok := app.agentHost(w, r)
+	if !ok {
+		return
+	}
+	cmds, err := db.DequeueCommands(r.Context(), app.DB, host.ID, db.MaxDequeuedCommands)
+	if err != nil {
+		log.Errorf("Failed to dequeue commands for host %d: %v", host.ID, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to fetch commands")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"commands": cmds})
+}
+
+// handleAgentResult records the outcome of a command the agent ran. Only a
+// dispatched command belonging to the calling host can be completed, once.
+func (app *Application) handleAgentResult(w http.ResponseWriter, r *http.Request) {
+	host, ok := app.agentHost(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		ID       int32  `json:"id"`
+		ExitCode *int32 `json:"exit_code"`
+		Output   string `json:"output"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if req.ID <= 0 || req.ExitCode == nil {
+		writeJSONError(w, http.StatusBadRequest, "id and exit_code are required")
+		return
+	}
+	done, err := db.CompleteCommand(r.Context(), app.DB, host.ID, req.ID, *req.ExitCode, req.Output)
+	if err != nil {
+		log.Errorf("Failed to record result of command %d for host %d: %v", req.ID, host.ID, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to record result")
+		return
+	}
+	if !done {
+		writeJSONError(w, http.StatusNotFound, "No dispatched command with that ID for this host")
+		return
+	}
+	log.Infof("Host %s completed queued command %d (exit %d)", host.Hostname, req.ID, *req.ExitCode)
+	w.WriteHeader(http.StatusNoContent)
+}
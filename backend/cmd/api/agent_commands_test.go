@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pashagolub/pgxmock/v4"
+
+	"ubuntu-auto-update/backend/pkg/middleware"
+	"ubuntu-auto-update/backend/pkg/models"
+	"ubuntu-auto-update/backend/pkg/session"
+)
+
+var commandCols = []string{"id", "host_id", "command", "status", "enqueued_by", "created_at", "dispatched_at", "completed_at", "exit_code", "output"}
+
+// asAgent authenticates req as the agent token of host 1, hostname.
+func asAgent(req *http.Request, hostname string) *http.Request {
+	p := &session.Principal{AgentLabel: hostname, HostID: 1, Username: "agent:" + hostname, Role: session.RoleAgent}
+	return req.WithContext(context.WithValue(req.Context(), middleware.PrincipalContextKey, p))
+}
+
+func expectAgentHost(mock pgxmock.PgxPoolIface, hostname string) {
+	now := time.Now()
+	mock.ExpectQuery(`SELECT .+ FROM hosts WHERE id = \$1`).
+		WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), hostname, "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+}
+
+func TestHandleEnqueueCommand(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	now := time.Now()
+	mock.ExpectQuery(`SELECT .+ FROM hosts WHERE id = \$1`).
+		WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+	mock.ExpectQuery(`INSERT INTO command_queue`).
+		WithArgs(int32(1), "uptime", "unknown").
+		WillReturnRows(mock.NewRows(commandCols).
+			AddRow(int32(7), int32(1), "uptime", models.CommandStatusQueued, "unknown", now, nil, nil, nil, ""))
+	mock.ExpectExec(`INSERT INTO audit_log`).
+		WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/hosts/1/commands", strings.NewReader(`{"command":"uptime"}`))
+	req = mux.SetURLVars(req, map[string]string{"id": "1"})
+	rr := httptest.NewRecorder()
+	app.handleEnqueueCommand(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var got models.QueuedCommand
+	if err := json.NewDecoder(rr.Body).Decode(&got); err != nil || got.ID != 7 {
+		t.Errorf("got %+v, %v", got, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestHandleEnqueueCommand_Validation(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	for _, body := range []string{`{"command":"  "}`, `{"command":"rm -rf /"}`, `not json`} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/hosts/1/commands", strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"id": "1"})
+		rr := httptest.NewRecorder()
+		app.handleEnqueueCommand(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, rr.Code)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// EXECUTE_MODE=allowlist leaves no way to queue a free-form command.
+func TestHandleEnqueueCommand_Allowlist(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.ScriptsOnly = true
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/hosts/1/commands", strings.NewReader(`{"command":"uptime"}`))
+	req = mux.SetURLVars(req, map[string]string{"id": "1"})
+	rr := httptest.NewRecorder()
+	app.handleEnqueueCommand(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestHandleAgentCommands(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	now := time.Now()
+	expectAgentHost(mock, "web-1")
+	mock.ExpectQuery(`UPDATE command_queue`).
+		WithArgs(int32(1), pgxmock.AnyArg()).
+		WillReturnRows(mock.NewRows(commandCols).
+			AddRow(int32(7), int32(1), "uptime", models.CommandStatusDispatched, "alice", now, &now, nil, nil, ""))
+
+	rr := httptest.NewRecorder()
+	app.handleAgentCommands(rr, asAgent(httptest.NewRequest(http.MethodGet, "/api/v1/agent/commands", nil), "web-1"))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp struct {
+		Commands []models.QueuedCommand `json:"commands"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Commands) != 1 || resp.Commands[0].Command != "uptime" {
+		t.Errorf("got %+v", resp.Commands)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestHandleAgentCommands_RejectsUsers(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	// RequireRole(RoleAgent) lets admins through; the handler must not, as
+	// an admin session has no host to poll for.
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/agent/commands", nil)
+	req = req.WithContext(context.WithValue(req.Context(), middleware.PrincipalContextKey, &session.Principal{Username: "admin", Role: session.RoleAdmin}))
+	rr := httptest.NewRecorder()
+	app.handleAgentCommands(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rr.Code)
+	}
+}
+
+// The queue is found by the host id the agent token was issued to, not by
+// hostname, so an agent whose host is renamed still polls its own queue.
+func TestHandleAgentCommands_ByHostID(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	expectAgentHost(mock, "web-1.example.com")
+	mock.ExpectQuery(`UPDATE command_queue`).WithArgs(int32(1), pgxmock.AnyArg()).
+		WillReturnRows(mock.NewRows(commandCols))
+	rr := httptest.NewRecorder()
+	app.handleAgentCommands(rr, asAgent(httptest.NewRequest(http.MethodGet, "/api/v1/agent/commands", nil), "web-1"))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestHandleAgentResult(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	expectAgentHost(mock, "web-1")
+	mock.ExpectExec(`UPDATE command_queue`).
+		WithArgs(int32(7), int32(1), int32(0), " 10:00:00 up 3 days\n").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	body := `{"id":7,"exit_code":0,"output":" 10:00:00 up 3 days\n"}`
+	rr := httptest.NewRecorder()
+	app.handleAgentResult(rr, asAgent(httptest.NewRequest(http.MethodPost, "/api/v1/agent/result", strings.NewReader(body)), "web-1"))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// A second report for the same command (or someone else's) matches no
+	// dispatched row.
+	expectAgentHost(mock, "web-1")
+	mock.ExpectExec(`UPDATE command_queue`).
+		WithArgs(int32(7), int32(1), int32(0), "").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+	rr = httptest.NewRecorder()
+	app.handleAgentResult(rr, asAgent(httptest.NewRequest(http.MethodPost, "/api/v1/agent/result", strings.NewReader(`{"id":7,"exit_code":0}`)), "web-1"))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rr.Code)
+	}
+
+	// exit_code is required: 0 and "missing" must not look the same.
+	expectAgentHost(mock, "web-1")
+	rr = httptest.NewRecorder()
+	app.handleAgentResult(rr, asAgent(httptest.NewRequest(http.MethodPost, "/api/v1/agent/result", strings.NewReader(`{"id":7}`)), "web-1"))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rr.Code)
+	}
+
+	// A misspelled field is named, not reported as a missing exit_code.
+	expectAgentHost(mock, "web-1")
+	rr = httptest.NewRecorder()
+	app.handleAgentResult(rr, asAgent(httptest.NewRequest(http.MethodPost, "/api/v1/agent/result", strings.NewReader(`{"id":7,"exitcode":0}`)), "web-1"))
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "exitcode") {
+		t.Fatalf("expected 400 naming exitcode, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+// Agent tokens: each enroll issues one, and GET /hosts/{id}/agent-tokens
+// lists a host's tokens with when they were issued and last used. Revoking
+// one takes effect on the agent's next request, which gets a 401; the agent
+// has to enroll again to get back in.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	log "github.com/sirupsen/logrus"
+
+	"ubuntu-auto-update/backend/pkg/apitokens"
+	"ubuntu-auto-update/backend/pkg/audit"
+	"ubuntu-auto-update/backend/pkg/db"
+	"ubuntu-auto-update/backend/pkg/middleware"
+	"ubuntu-auto-update/backend/pkg/session"
+)
+
+// tokenValidator resolves the long-lived tokens SessionAuthMiddleware hands
+// it: uat_ API tokens to their role, and uag_ agent tokens to the agent of
+// the host they were issued to.
+func tokenValidator(dbx db.DBTX) middleware.APITokenValidator {
+	return func(ctx context.Context, tok string) (session.Principal, bool, error) {
+		if strings.HasPrefix(tok, db.AgentTokenPrefix) {
+			hostID, hostname, ok, err := db.ValidateAgentToken(ctx, dbx, tok)
+			if err != nil || !ok {
+				return session.Principal{}, false, err
+			}
+			return session.Principal{AgentLabel: hostname, HostID: hostID, Username: "agent:" + hostname, Role: session.RoleAgent}, true, nil
+		}
+		t, ok, err := apitokens.Validate(ctx, dbx, tok)
+		if err != nil || !ok {
+			return session.Principal{}, false, err
+		}
+		return session.Principal{Username: "token:" + t.Name, Role: t.Role}, true, nil
+	}
+}
+
+func (app *Application) handleListAgentTokens(w http.ResponseWriter, r *http.Request) {
+	id, err := parseHostID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+	if _, err := db.GetHost(r.Context(), app.DB, id); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "Host not found")
+			return
+		}
+		log.Errorf("Failed to get host %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to list agent tokens")
+		return
+	}
+
+	toks, err := db.ListAgentTokens(r.Context(), app.DB, id)
+	if err != nil {
+		log.Errorf("Failed to list agent tokens for host %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to list agent tokens")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(toks)
+}
+
+func (app *Application) handleRevokeAgentToken(w http.ResponseWriter, r *http.Request) {
+	id, err := parseHostID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+	tokenID, err := strconv.ParseInt(mux.Vars(r)["token_id"], 10, 32)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid token ID")
+		return
+	}
+
+	revokedBy := "unknown"
+	if user := middleware.GetUserFromContext(r); user != nil {
+		revokedBy = user.Username
+	}
+	tok, err := db.RevokeAgentToken(r.Context(), app.DB, id, int32(tokenID), revokedBy)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "Agent token not found or already revoked")
+			return
+		}
+		log.Errorf("Failed to revoke agent token %d for host %d: %v", tokenID, id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to revoke agent token")
+		return
+	}
+
+	app.audit(r, audit.ActionAgentTokenRevoke, "host", strconv.FormatInt(int64(id), 10),
+		map[string]interface{}{"token_id": tok.ID})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tok)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pashagolub/pgxmock/v4"
+
+	"ubuntu-auto-update/backend/pkg/db"
+	"ubuntu-auto-update/backend/pkg/enrollment"
+	"ubuntu-auto-update/backend/pkg/models"
+	"ubuntu-auto-update/backend/pkg/session"
+)
+
+func TestHandleListAgentTokens(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	used, revoked := now.Add(-time.Minute), now.Add(-time.Hour)
+	mock.ExpectQuery(`SELECT .+ FROM hosts WHERE id = \$1`).
+		WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+	mock.ExpectQuery(`SELECT .+ FROM agent_tokens\s+WHERE host_id = \$1`).
+		WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows(agentTokenCols).
+			AddRow(int32(9), int32(1), now, now.Add(agentTokenTTL), &used, "192.0.2.1", nil, "").
+			AddRow(int32(4), int32(1), now.Add(-48*time.Hour), now.Add(agentTokenTTL), nil, "192.0.2.1", &revoked, "alice"))
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/hosts/1/agent-tokens", nil), map[string]string{"id": "1"})
+	rr := httptest.NewRecorder()
+	app.handleListAgentTokens(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var got []models.AgentToken
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].ID != 9 || got[1].ID != 4 {
+		t.Fatalf("got %+v", got)
+	}
+	if !got[0].CreatedAt.Equal(now) || got[0].LastUsedAt == nil || !got[0].LastUsedAt.Equal(used) || got[0].RevokedAt != nil {
+		t.Errorf("active token = %+v", got[0])
+	}
+	if got[1].RevokedAt == nil || got[1].RevokedBy != "alice" || got[1].LastUsedAt != nil {
+		t.Errorf("revoked token = %+v", got[1])
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestHandleListAgentTokens_UnknownHost(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	mock.ExpectQuery(`SELECT .+ FROM hosts WHERE id = \$1`).
+		WithArgs(int32(8)).
+		WillReturnRows(mock.NewRows(hostCols))
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/hosts/8/agent-tokens", nil), map[string]string{"id": "8"})
+	rr := httptest.NewRecorder()
+	app.handleListAgentTokens(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+// expectAgentTokenValid mocks the middleware resolving an agent token to
+// hostname. An empty hostname finds no live token.
+func expectAgentTokenValid(mock pgxmock.PgxPoolIface, hostname string) {
+	rows := mock.NewRows([]string{"id", "hostname"})
+	if hostname != "" {
+		rows.AddRow(int32(1), hostname)
+	}
+	mock.ExpectQuery(`UPDATE agent_tokens t SET last_used_at = NOW\(\)\s+FROM hosts h\s+WHERE .+ AND h.deleted_at IS NULL`).
+		WithArgs(pgxmock.AnyArg()).
+		WillReturnRows(rows)
+}
+
+// An agent reports with its token until an operator revokes it; the very
+// next report is refused, and revoking it again finds nothing to revoke.
+// Everything goes through the real routes and handlers.
+func TestRevokeAgentToken_ReportGets401(t *testing.T) {
+	h, tokens, mock := routedAppWithDB(t)
+
+	do := func(method, path, bearer, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	agentToken := db.AgentTokenPrefix + "0123abcd"
+	report := `{"hostname": "web-1", "agent_version": "1.2.3"}`
+
+	expectAgentTokenValid(mock, "web-1")
+	now := time.Now()
+	mock.ExpectQuery(`INSERT INTO hosts`).
+		WithArgs("web-1", "root", []byte(""), []byte(""), sql.NullString{}, false, 0, 0, "", "", "1.2.3", "", false, false, nil).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "root", now.Add(-time.Hour), now, now, "", "", nil, []string{}, false, 0, 0, "", "", "1.2.3", "", nil, false, false, "all", nil, ""))
+	if code := do(http.MethodPost, "/api/v1/report", agentToken, report); code != http.StatusAccepted {
+		t.Fatalf("before revoke: expected 202, got %d", code)
+	}
+
+	mock.ExpectQuery(`UPDATE agent_tokens SET revoked_at = NOW\(\)`).WithArgs(int32(9), int32(1), "operator-user").
+		WillReturnRows(mock.NewRows(agentTokenCols).AddRow(int32(9), int32(1), now, now.Add(agentTokenTTL), &now, "", &now, "operator-user"))
+	expectAudit(mock)
+	if code := do(http.MethodDelete, "/api/v1/hosts/1/agent-tokens/9", tokens[session.RoleOperator], ""); code != http.StatusOK {
+		t.Fatalf("revoke: expected 200, got %d", code)
+	}
+
+	// The validating UPDATE skips revoked rows, so it matches nothing.
+	expectAgentTokenValid(mock, "")
+	if code := do(http.MethodPost, "/api/v1/report", agentToken, report); code != http.StatusUnauthorized {
+		t.Errorf("after revoke: expected 401, got %d", code)
+	}
+
+	mock.ExpectQuery(`UPDATE agent_tokens SET revoked_at = NOW\(\)`).WithArgs(int32(9), int32(1), "operator-user").
+		WillReturnRows(mock.NewRows(agentTokenCols))
+	if code := do(http.MethodDelete, "/api/v1/hosts/1/agent-tokens/9", tokens[session.RoleOperator], ""); code != http.StatusNotFound {
+		t.Errorf("second revoke: expected 404, got %d", code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// An agent token only reports for its own host: a report naming another
+// host is refused before anything is written, alone or in a batch.
+func TestReport_AgentBoundToItsHost(t *testing.T) {
+	h, _, mock := routedAppWithDB(t)
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+db.AgentTokenPrefix+"0123abcd")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	expectAgentTokenValid(mock, "web-1")
+	if rr := post("/api/v1/report", `{"hostname": "web-2"}`); rr.Code != http.StatusForbidden {
+		t.Errorf("report for another host: expected 403, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	expectAgentTokenValid(mock, "web-1")
+	rr := post("/api/v1/report/batch", `[{"hostname": "web-2"}, {"hostname": "db-1"}]`)
+	if want := errForeignReport.Error(); rr.Code != http.StatusOK || strings.Count(rr.Body.String(), want) != 2 {
+		t.Errorf("batch for other hosts: got %d %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// A reusable enrollment token can't enroll a host that already holds a
+// live or revoked agent token; a single-use one, minted by an admin for the
+// purpose, can.
+func TestHandleEnroll_HeldHostNeedsSingleUseToken(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	t.Setenv("ENROLLMENT_TOKEN", "shared-secret")
+
+	enroll := func(token string) int {
+		body, _ := json.Marshal(map[string]string{"enrollment_token": token, "hostname": "test-host"})
+		rr := httptest.NewRecorder()
+		app.handleEnroll(rr, httptest.NewRequest(http.MethodPost, "/api/v1/enroll", bytes.NewReader(body)))
+		return rr.Code
+	}
+
+	expectAgentTokensHeld(mock, "test-host", true)
+	if code := enroll("shared-secret"); code != http.StatusConflict {
+		t.Errorf("shared token: expected 409, got %d", code)
+	}
+
+	used := time.Now()
+	mock.ExpectQuery(`UPDATE enrollment_tokens SET last_used_at`).WithArgs(pgxmock.AnyArg()).
+		WillReturnRows(mock.NewRows(enrollmentTokenCols).AddRow(int32(3), "reenroll test-host", "alice", time.Now(), &used, nil, true))
+	expectEnrollHost(mock, "test-host", false)
+	expectAgentToken(mock, 42)
+	expectAudit(mock)
+	expectWebhookLookup(mock, "host_enrolled", 42)
+	if code := enroll(enrollment.Prefix + "once"); code != http.StatusOK {
+		t.Errorf("single-use token: expected 200, got %d", code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
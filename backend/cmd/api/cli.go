@@ -0,0 +1,203 @@
+package main
+
+// Subcommands of the backend binary (ua-backend). With no arguments it
+// serves, as it always has; the rest are one-shot admin tasks that read the
+// same configuration (config file, DATABASE_*, ENCRYPTION_KEY) as the server.
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	log "github.com/sirupsen/logrus"
+
+	"ubuntu-auto-update/backend/db/migrations"
+	"ubuntu-auto-update/backend/pkg/audit"
+	"ubuntu-auto-update/backend/pkg/config"
+	"ubuntu-auto-update/backend/pkg/crypto"
+	"ubuntu-auto-update/backend/pkg/db"
+	"ubuntu-auto-update/backend/pkg/enrollment"
+)
+
+// cliActor is the audit label for changes made from the command line.
+const cliActor = "cli"
+
+type subcommand struct {
+	summary string
+	run     func(ctx context.Context, args []string, stdout, stderr io.Writer) error
+}
+
+var subcommands = map[string]subcommand{
+	"serve": {"Run the API server (the default)", func(context.Context, []string, io.Writer, io.Writer) error {
+		runServer()
+		return nil
+	}},
+	"migrate": {"Apply pending database migrations and exit", func(ctx context.Context, args []string, stdout, _ io.Writer) error {
+		if len(args) > 0 {
+			return fmt.Errorf("unexpected arguments %q", args)
+		}
+		return withDB(ctx, func(pool *pgxpool.Pool) error {
+			// One connection, so the advisory lock covers the whole run.
+			conn, err := pool.Acquire(ctx)
+			if err != nil {
+				return err
+			}
+			defer conn.Release()
+			return runMigrate(ctx, conn, migrations.FS, stdout)
+		})
+	}},
+	"create-token": {"Mint an agent enrollment token (-name required)", func(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+		name, err := parseCreateTokenArgs(args, stderr)
+		if err != nil {
+			return err
+		}
+		return withDB(ctx, func(pool *pgxpool.Pool) error {
+			return runCreateToken(ctx, pool, name, stdout)
+		})
+	}},
+	"rotate-crypto-key": {"Re-encrypt stored secrets under the current ENCRYPTION_KEY", func(ctx context.Context, args []string, stdout, _ io.Writer) error {
+		if len(args) > 0 {
+			return fmt.Errorf("unexpected arguments %q", args)
+		}
+		return withDB(ctx, func(pool *pgxpool.Pool) error {
+			if err := crypto.Init(); err != nil {
+				return fmt.Errorf("encryption key: %w", err)
+			}
+			return runRotateCryptoKey(ctx, pool, stdout)
+		})
+	}},
+}
+
+func main() {
+	os.Exit(runCLI(context.Background(), os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// runCLI dispatches args to a subcommand and returns the exit status.
+func runCLI(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	switch name {
+	case "help", "-h", "-help", "--help":
+		usage(stdout)
+		return 0
+	}
+	cmd, ok := subcommands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n\n", name)
+		usage(stderr)
+		return 2
+	}
+	if err := cmd.run(ctx, args, stdout, stderr); err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+func usage(w io.Writer) {
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "usage: ua-backend [command] [flags]")
+	fmt.Fprintln(w)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-18s %s\n", name, subcommands[name].summary)
+	}
+}
+
+// withDB loads configuration and connects to the database the way the server
+// does, then hands the pool to fn.
+func withDB(ctx context.Context, fn func(*pgxpool.Pool) error) error {
+	if err := config.Load(); err != nil {
+		log.Warnf("Config loading: %v (continuing with env vars)", err)
+	}
+	pool, err := db.NewConnection(ctx, config.LoadDatabaseConfig())
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+	return fn(pool)
+}
+
+func runMigrate(ctx context.Context, conn db.DBTX, fsys fs.FS, stdout io.Writer) error {
+	n, err := db.MigrateConn(ctx, conn, fsys)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		fmt.Fprintln(stdout, "Schema is up to date")
+	} else {
+		fmt.Fprintf(stdout, "Applied %d migrations\n", n)
+	}
+	return nil
+}
+
+func parseCreateTokenArgs(args []string, stderr io.Writer) (string, error) {
+	fl := flag.NewFlagSet("create-token", flag.ContinueOnError)
+	fl.SetOutput(stderr)
+	name := fl.String("name", "", "what the token is for, e.g. the rack or team enrolling with it")
+	if err := fl.Parse(args); err != nil {
+		return "", err
+	}
+	if fl.NArg() > 0 {
+		return "", fmt.Errorf("unexpected arguments %q", fl.Args())
+	}
+	if strings.TrimSpace(*name) == "" {
+		return "", fmt.Errorf("-name is required")
+	}
+	return strings.TrimSpace(*name), nil
+}
+
+// runCreateToken mints an enrollment token and prints it, alone on stdout
+// so scripts can capture it. It is never shown again.
+func runCreateToken(ctx context.Context, dbx db.DBTX, name string, stdout io.Writer) error {
+	tok, raw, err := enrollment.Create(ctx, dbx, name, cliActor, enrollment.Options{})
+	if err != nil {
+		return fmt.Errorf("create enrollment token: %w", err)
+	}
+	if err := audit.Log(ctx, dbx, audit.Event{
+		ActorLabel: cliActor,
+		Action:     audit.ActionEnrollTokenCreate,
+		TargetType: "enrollment_token",
+		TargetID:   strconv.FormatInt(int64(tok.ID), 10),
+		Details:    map[string]interface{}{"name": tok.Name},
+	}); err != nil {
+		log.Errorf("audit log: %v", err)
+	}
+	fmt.Fprintln(stdout, raw)
+	return nil
+}
+
+// runRotateCryptoKey is POST /ssh-keys/re-encrypt for when the API isn't up
+// or no admin session is at hand.
+func runRotateCryptoKey(ctx context.Context, dbx db.DBTX, stdout io.Writer) error {
+	n, err := db.ReEncryptSSHKeys(ctx, dbx)
+	if err != nil {
+		return fmt.Errorf("re-encrypt ssh keys (%d done, safe to retry): %w", n, err)
+	}
+	p, err := db.ReEncryptSudoPasswords(ctx, dbx)
+	if err != nil {
+		return fmt.Errorf("re-encrypt sudo passwords (%d done, safe to retry): %w", p, err)
+	}
+	if err := audit.Log(ctx, dbx, audit.Event{
+		ActorLabel: cliActor,
+		Action:     audit.ActionKeysReEncrypt,
+		TargetType: "ssh_keys",
+		Details:    map[string]interface{}{"reencrypted": n + p},
+	}); err != nil {
+		log.Errorf("audit log: %v", err)
+	}
+	fmt.Fprintf(stdout, "Re-encrypted %d secrets\n", n+p)
+	return nil
+}
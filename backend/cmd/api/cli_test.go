@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+
+	"ubuntu-auto-update/backend/pkg/enrollment"
+)
+
+func expectAudit(mock pgxmock.PgxPoolIface) {
+	mock.ExpectExec(`INSERT INTO audit_log`).
+		WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+}
+
+func TestRunCLI_Dispatch(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := runCLI(context.Background(), []string{"help"}, &stdout, &stderr); code != 0 {
+		t.Errorf("help: exit %d", code)
+	}
+	for _, name := range []string{"serve", "migrate", "create-token", "rotate-crypto-key"} {
+		if !strings.Contains(stdout.String(), name) {
+			t.Errorf("usage doesn't list %s:\n%s", name, stdout.String())
+		}
+	}
+
+	stdout.Reset()
+	if code := runCLI(context.Background(), []string{"frobnicate"}, &stdout, &stderr); code != 2 {
+		t.Errorf("unknown command: exit %d, want 2", code)
+	}
+	if !strings.Contains(stderr.String(), `unknown command "frobnicate"`) {
+		t.Errorf("stderr = %q", stderr.String())
+	}
+
+	// Bad arguments are refused before anything connects to the database.
+	for _, args := range [][]string{{"create-token"}, {"create-token", "-name", " "}, {"migrate", "extra"}} {
+		stderr.Reset()
+		if code := runCLI(context.Background(), args, &stdout, &stderr); code != 1 {
+			t.Errorf("%v: exit %d, want 1 (%s)", args, code, stderr.String())
+		}
+	}
+}
+
+func TestRunMigrate(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+
+	mock.ExpectExec("SELECT pg_advisory_lock").WithArgs(pgxmock.AnyArg()).WillReturnResult(pgxmock.NewResult("SELECT", 1))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(pgxmock.NewResult("CREATE TABLE", 0))
+	mock.ExpectQuery("SELECT version, dirty FROM schema_migrations").WillReturnError(pgx.ErrNoRows)
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TABLE widgets").WillReturnResult(pgxmock.NewResult("OK", 0))
+	mock.ExpectExec("DELETE FROM schema_migrations").WillReturnResult(pgxmock.NewResult("DELETE", 0))
+	mock.ExpectExec("INSERT INTO schema_migrations").WithArgs(int64(1)).WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("SELECT pg_advisory_unlock").WithArgs(pgxmock.AnyArg()).WillReturnResult(pgxmock.NewResult("SELECT", 1))
+
+	var out bytes.Buffer
+	fsys := fstest.MapFS{"000001_widgets.up.sql": {Data: []byte("CREATE TABLE widgets (id INT)")}}
+	if err := runMigrate(context.Background(), mock, fsys, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "Applied 1 migrations\n" {
+		t.Errorf("output = %q", out.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunCreateToken_PrintsTokenOnce(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+
+	mock.ExpectQuery(`INSERT INTO enrollment_tokens`).WithArgs("rack-4", pgxmock.AnyArg(), "cli", (*time.Time)(nil), false).
+		WillReturnRows(mock.NewRows([]string{"id", "name", "created_by", "created_at", "last_used_at", "expires_at", "single_use"}).
+			AddRow(int32(7), "rack-4", "cli", time.Now(), nil, nil, false))
+	expectAudit(mock)
+
+	var out bytes.Buffer
+	if err := runCreateToken(context.Background(), mock, "rack-4", &out); err != nil {
+		t.Fatal(err)
+	}
+	raw := strings.TrimSuffix(out.String(), "\n")
+	if !strings.HasPrefix(raw, enrollment.Prefix) || strings.ContainsAny(raw, " \n") {
+		t.Errorf("stdout = %q, want just the token", out.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunRotateCryptoKey(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+
+	mock.ExpectQuery(`SELECT id, host_id, private_key FROM ssh_keys`).
+		WillReturnRows(mock.NewRows([]string{"id", "host_id", "private_key"}))
+	mock.ExpectQuery(`SELECT host_id, password FROM host_sudo_passwords`).
+		WillReturnRows(mock.NewRows([]string{"host_id", "password"}))
+	expectAudit(mock)
+
+	var out bytes.Buffer
+	if err := runRotateCryptoKey(context.Background(), mock, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "Re-encrypted 0 secrets\n" {
+		t.Errorf("output = %q", out.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleEnroll_StoredToken(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	t.Setenv("ENROLLMENT_TOKEN", "")
+
+	used := time.Now()
+	mock.ExpectQuery(`UPDATE enrollment_tokens SET last_used_at`).WithArgs(pgxmock.AnyArg()).
+		WillReturnRows(mock.NewRows([]string{"id", "name", "created_by", "created_at", "last_used_at", "expires_at", "single_use"}).
+			AddRow(int32(7), "rack-4", "cli", time.Now(), &used, nil, false))
+	expectAgentTokensHeld(mock, "test-host", false)
+	expectEnrollHost(mock, "test-host", false)
+	expectAgentToken(mock, 42)
+	expectAudit(mock)
+	expectWebhookLookup(mock, "host_enrolled", 42)
+
+	body, _ := json.Marshal(map[string]string{"enrollment_token": enrollment.Prefix + "abc", "hostname": "test-host"})
+	rr := httptest.NewRecorder()
+	app.handleEnroll(rr, httptest.NewRequest(http.MethodPost, "/api/v1/enroll", bytes.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+// Enrollment-token minting, admin-only. Tokens from here default to
+// single-use and short-lived, unlike the shared ENROLLMENT_TOKEN: hand one
+// to each host being provisioned and a leaked token is worth little.
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"ubuntu-auto-update/backend/pkg/audit"
+	"ubuntu-auto-update/backend/pkg/enrollment"
+	"ubuntu-auto-update/backend/pkg/middleware"
+)
+
+// defaultEnrollmentTokenTTL applies when ENROLLMENT_TOKEN_TTL isn't wired
+// (tests); maxEnrollmentTokenTTL bounds what a request may ask for.
+const (
+	defaultEnrollmentTokenTTL = 24 * time.Hour
+	maxEnrollmentTokenTTL     = 30 * 24 * time.Hour
+)
+
+func (app *Application) handleCreateEnrollmentToken(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	var req struct {
+		Name string `json:"name"`
+		// TTLSeconds overrides ENROLLMENT_TOKEN_TTL for this token.
+		TTLSeconds *int64 `json:"ttl_seconds"`
+		// SingleUse defaults to true.
+		SingleUse *bool `json:"single_use"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		writeJSONError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	opts := enrollment.Options{TTL: app.EnrollmentTokenTTL, SingleUse: true}
+	if opts.TTL <= 0 {
+		opts.TTL = defaultEnrollmentTokenTTL
+	}
+	if req.TTLSeconds != nil {
+		if *req.TTLSeconds <= 0 || *req.TTLSeconds > int64(maxEnrollmentTokenTTL/time.Second) {
+			writeJSONError(w, http.StatusBadRequest, "ttl_seconds must be between 1 and "+strconv.FormatInt(int64(maxEnrollmentTokenTTL/time.Second), 10))
+			return
+		}
+		opts.TTL = time.Duration(*req.TTLSeconds) * time.Second
+	}
+	if req.SingleUse != nil {
+		opts.SingleUse = *req.SingleUse
+	}
+
+	createdBy := "unknown"
+	if user := middleware.GetUserFromContext(r); user != nil {
+		createdBy = user.Username
+	}
+	tok, raw, err := enrollment.Create(r.Context(), app.DB, req.Name, createdBy, opts)
+	if err != nil {
+		log.Errorf("create enrollment token: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create enrollment token")
+		return
+	}
+	app.audit(r, audit.ActionEnrollTokenCreate, "enrollment_token", strconv.FormatInt(int64(tok.ID), 10),
+		map[string]interface{}{"name": tok.Name, "expires_at": tok.ExpiresAt, "single_use": tok.SingleUse})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct { // #nosec G117 -- intentional one-time secret disclosure at mint
+		enrollment.Token
+		Secret string `json:"secret"`
+	}{tok, raw})
+}
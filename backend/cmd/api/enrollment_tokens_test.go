@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock/v4"
+
+	"ubuntu-auto-update/backend/pkg/enrollment"
+	"ubuntu-auto-update/backend/pkg/middleware"
+)
+
+var enrollmentTokenCols = []string{"id", "name", "created_by", "created_at", "last_used_at", "expires_at", "single_use"}
+
+// expiresIn matches a non-nil *time.Time about d from now.
+type expiresIn struct{ d time.Duration }
+
+func (a expiresIn) Match(v interface{}) bool {
+	t, ok := v.(*time.Time)
+	return ok && t != nil && time.Until(*t).Round(time.Minute) == a.d
+}
+
+func createEnrollmentToken(app *Application, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/enrollment-tokens", strings.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), middleware.UserContextKey, &middleware.User{Username: "alice"}))
+	rr := httptest.NewRecorder()
+	app.handleCreateEnrollmentToken(rr, r)
+	return rr
+}
+
+// Without options a minted token is single-use and expires after
+// ENROLLMENT_TOKEN_TTL; the secret is returned once.
+func TestCreateEnrollmentToken_Defaults(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.EnrollmentTokenTTL = 2 * time.Hour
+
+	expires := time.Now().Add(2 * time.Hour)
+	mock.ExpectQuery(`INSERT INTO enrollment_tokens`).
+		WithArgs("rack-9", pgxmock.AnyArg(), "alice", expiresIn{2 * time.Hour}, true).
+		WillReturnRows(mock.NewRows(enrollmentTokenCols).AddRow(int32(3), "rack-9", "alice", time.Now(), nil, &expires, true))
+	expectAudit(mock)
+
+	rr := createEnrollmentToken(app, `{"name":" rack-9 "}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var got struct {
+		ID        int32      `json:"id"`
+		SingleUse bool       `json:"single_use"`
+		ExpiresAt *time.Time `json:"expires_at"`
+		Secret    string     `json:"secret"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != 3 || !got.SingleUse || got.ExpiresAt == nil || !strings.HasPrefix(got.Secret, enrollment.Prefix) {
+		t.Errorf("got %+v", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestCreateEnrollmentToken_Options(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	mock.ExpectQuery(`INSERT INTO enrollment_tokens`).
+		WithArgs("fleet", pgxmock.AnyArg(), "alice", expiresIn{10 * time.Minute}, false).
+		WillReturnRows(mock.NewRows(enrollmentTokenCols).AddRow(int32(4), "fleet", "alice", time.Now(), nil, nil, false))
+	expectAudit(mock)
+
+	rr := createEnrollmentToken(app, `{"name":"fleet","ttl_seconds":600,"single_use":false}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestCreateEnrollmentToken_Rejects(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	for _, body := range []string{
+		`{}`,
+		`{"name":"  "}`,
+		`{"name":"rack","ttl_seconds":0}`,
+		`{"name":"rack","ttl_seconds":-5}`,
+		`{"name":"rack","ttl_seconds":99999999}`,
+		`{"name":"rack","expires":"never"}`,
+	} {
+		if rr := createEnrollmentToken(app, body); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, rr.Code)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("no query expected: %v", err)
+	}
+}
+
+// A single-use token enrolls once. The second presentation finds no row
+// (the UPDATE skips consumed and expired tokens) and is refused, while the
+// shared ENROLLMENT_TOKEN keeps working alongside.
+func TestHandleEnroll_SingleUseToken(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	t.Setenv("ENROLLMENT_TOKEN", "shared-secret")
+
+	enroll := func(token string) int {
+		body, _ := json.Marshal(map[string]string{"enrollment_token": token, "hostname": "test-host"})
+		rr := httptest.NewRecorder()
+		app.handleEnroll(rr, httptest.NewRequest(http.MethodPost, "/api/v1/enroll", bytes.NewReader(body)))
+		return rr.Code
+	}
+
+	used, expires := time.Now(), time.Now().Add(time.Hour)
+	mock.ExpectQuery(`UPDATE enrollment_tokens SET last_used_at`).WithArgs(pgxmock.AnyArg()).
+		WillReturnRows(mock.NewRows(enrollmentTokenCols).AddRow(int32(3), "rack-9", "alice", time.Now(), &used, &expires, true))
+	expectEnrollHost(mock, "test-host", true)
+	expectAgentToken(mock, 42)
+	expectAudit(mock)
+	expectWebhookLookup(mock, "host_registered", 42)
+	expectWebhookLookup(mock, "host_enrolled", 42)
+	if code := enroll(enrollment.Prefix + "once"); code != http.StatusOK {
+		t.Fatalf("first use: expected 200, got %d", code)
+	}
+
+	mock.ExpectQuery(`UPDATE enrollment_tokens SET last_used_at`).WithArgs(pgxmock.AnyArg()).
+		WillReturnRows(mock.NewRows(enrollmentTokenCols))
+	if code := enroll(enrollment.Prefix + "once"); code != http.StatusUnauthorized {
+		t.Fatalf("reuse: expected 401, got %d", code)
+	}
+
+	expectAgentTokensHeld(mock, "test-host", false)
+	expectEnrollHost(mock, "test-host", false)
+	expectAgentToken(mock, 42)
+	expectAudit(mock)
+	expectWebhookLookup(mock, "host_enrolled", 42)
+	if code := enroll("shared-secret"); code != http.StatusOK {
+		t.Fatalf("shared token: expected 200, got %d", code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+// Environment guardrails. Hosts carry an optional environment label, and
+// update runs against hosts in an environment listed in REQUIRE_CONFIRM_ENV
+// are refused with 412 unless the request confirms them, so a mistyped tag
+// or a stray click can't patch production. Confirming is ?confirm=true or
+// an X-Confirm-Environment header naming the environment; the header is
+// what scripts should send, since it has to match.
+
+import (
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// environmentPattern is what an environment label may look like, mirroring
+// the hosts.environment CHECK constraint.
+var environmentPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// normalizeEnvironment lowercases and trims env and reports whether the
+// result is storable. "" is, and clears the label.
+func normalizeEnvironment(env string) (string, bool) {
+	env = strings.ToLower(strings.TrimSpace(env))
+	return env, env == "" || environmentPattern.MatchString(env)
+}
+
+// guardedEnvironment reports whether runs against env need confirmation.
+func (app *Application) guardedEnvironment(env string) bool {
+	return env != "" && slices.Contains(app.RequireConfirmEnv, env)
+}
+
+// environmentConfirmed reports whether r confirms a run against every
+// environment in guarded: ?confirm=true, or X-Confirm-Environment listing
+// each of them, comma-separated.
+func environmentConfirmed(r *http.Request, guarded []string) bool {
+	if r.URL.Query().Get("confirm") == "true" {
+		return true
+	}
+	var named []string
+	for _, env := range strings.Split(r.Header.Get("X-Confirm-Environment"), ",") {
+		named = append(named, strings.ToLower(strings.TrimSpace(env)))
+	}
+	for _, env := range guarded {
+		if !slices.Contains(named, env) {
+			return false
+		}
+	}
+	return true
+}
+
+// requireEnvironmentConfirmation writes a 412 and returns false unless r
+// confirms the guarded environments a run would touch.
+func requireEnvironmentConfirmation(w http.ResponseWriter, r *http.Request, guarded []string) bool {
+	if len(guarded) == 0 || environmentConfirmed(r, guarded) {
+		return true
+	}
+	list := strings.Join(guarded, ",")
+	writeJSONError(w, http.StatusPreconditionFailed,
+		"Run targets the guarded environment "+list+"; pass confirm=true or an X-Confirm-Environment: "+list+" header")
+	return false
+}
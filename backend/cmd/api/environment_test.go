@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+)
+
+// A real update of a prod host is refused with 412 until it is confirmed;
+// staging, and a simulate run on prod, go through without.
+func TestRunUpdate_GuardedEnvironmentNeedsConfirmation(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.RequireConfirmEnv = []string{"prod"}
+
+	now := time.Now()
+	expectHost := func(env string) {
+		mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).
+			WillReturnRows(mock.NewRows(hostCols).
+				AddRow(int32(1), "web-1", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, env))
+	}
+	expectUpdateLookups := func() {
+		mock.ExpectQuery(`SELECT password FROM host_sudo_passwords`).WithArgs(int32(1)).WillReturnError(pgx.ErrNoRows)
+		mock.ExpectQuery(`FROM host_update_hooks`).WithArgs(int32(1)).WillReturnError(pgx.ErrNoRows)
+	}
+	// Not a WebSocket request, so a run that gets past the guard stops at
+	// the upgrade with a 400.
+	runUpdate := func(query string, header http.Header) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/hosts/1/run-update?"+query, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req = mux.SetURLVars(req, map[string]string{"id": "1"})
+		rr := httptest.NewRecorder()
+		app.handleRunUpdate(rr, req)
+		return rr.Code
+	}
+
+	expectHost("prod")
+	if code := runUpdate("", nil); code != http.StatusPreconditionFailed {
+		t.Errorf("unconfirmed prod: got %d, want 412", code)
+	}
+	expectHost("prod")
+	if code := runUpdate("", http.Header{"X-Confirm-Environment": {"staging"}}); code != http.StatusPreconditionFailed {
+		t.Errorf("prod confirmed as staging: got %d, want 412", code)
+	}
+	expectHost("prod")
+	expectUpdateLookups()
+	if code := runUpdate("", http.Header{"X-Confirm-Environment": {"prod"}}); code == http.StatusPreconditionFailed {
+		t.Error("X-Confirm-Environment: prod was refused")
+	}
+	expectHost("prod")
+	expectUpdateLookups()
+	if code := runUpdate("confirm=true", nil); code == http.StatusPreconditionFailed {
+		t.Error("confirm=true was refused")
+	}
+	expectHost("prod")
+	if code := runUpdate("simulate=true", nil); code == http.StatusPreconditionFailed {
+		t.Error("simulate on prod needed confirmation")
+	}
+	expectHost("staging")
+	expectUpdateLookups()
+	if code := runUpdate("", nil); code == http.StatusPreconditionFailed {
+		t.Error("staging needed confirmation")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// A bulk update that reaches a guarded host is refused until every guarded
+// environment it reaches is confirmed.
+func TestBulkRunUpdate_GuardedEnvironmentNeedsConfirmation(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.RequireConfirmEnv = []string{"prod", "pci"}
+
+	mock.ExpectQuery(`FROM maintenance_windows`).WithArgs([]int32{1, 2}).WillReturnRows(mwCols(mock))
+	mock.ExpectQuery(`SELECT DISTINCT environment FROM hosts`).
+		WithArgs([]int32{1, 2}, []string{"prod", "pci"}).
+		WillReturnRows(mock.NewRows([]string{"environment"}).AddRow("pci").AddRow("prod"))
+
+	b, _ := json.Marshal(map[string]interface{}{"host_ids": []int{1, 2}})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/hosts/bulk/run-update", bytes.NewReader(b))
+	req.Header.Set("X-Confirm-Environment", "prod")
+	rr := httptest.NewRecorder()
+	app.handleBulkRunUpdate(rr, req)
+	if rr.Code != http.StatusPreconditionFailed || !strings.Contains(rr.Body.String(), "pci,prod") {
+		t.Errorf("prod and pci confirmed as prod only: got %d %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestEnvironmentConfirmed(t *testing.T) {
+	tests := []struct {
+		query, header string
+		guarded       []string
+		want          bool
+	}{
+		{"", "", nil, true},
+		{"", "", []string{"prod"}, false},
+		{"confirm=true", "", []string{"prod", "pci"}, true},
+		{"confirm=1", "", []string{"prod"}, false},
+		{"", "prod", []string{"prod"}, true},
+		{"", "Prod, PCI", []string{"pci", "prod"}, true},
+		{"", "prod", []string{"pci", "prod"}, false},
+		{"", "staging", []string{"prod"}, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/?"+tt.query, nil)
+		req.Header.Set("X-Confirm-Environment", tt.header)
+		if got := environmentConfirmed(req, tt.guarded); got != tt.want {
+			t.Errorf("query %q, header %q, guarded %v: got %v", tt.query, tt.header, tt.guarded, got)
+		}
+	}
+}
+
+func TestNormalizeEnvironment(t *testing.T) {
+	for in, want := range map[string]string{" Prod ": "prod", "": "", "eu-west_2": "eu-west_2"} {
+		if got, ok := normalizeEnvironment(in); !ok || got != want {
+			t.Errorf("normalizeEnvironment(%q) = %q, %v", in, got, ok)
+		}
+	}
+	for _, in := range []string{"-prod", "prod env", "prød", "a23456789012345678901234567890123"} {
+		if _, ok := normalizeEnvironment(in); ok {
+			t.Errorf("normalizeEnvironment(%q) accepted", in)
+		}
+	}
+}
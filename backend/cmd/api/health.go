@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"ubuntu-auto-update/backend/pkg/config"
+	"ubuntu-auto-update/backend/pkg/db"
+)
+
+// Health states, per component and overall.
+const (
+	healthUp       = "up"
+	healthDown     = "down"
+	healthHealthy  = "healthy"
+	healthDegraded = "degraded"
+	healthFailing  = "unhealthy"
+)
+
+// componentHealth is one entry in the /health "components" map.
+type componentHealth struct {
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+	// FreeBytes is set by the disk check.
+	FreeBytes *uint64 `json:"free_bytes,omitempty"`
+}
+
+// defaultMinFreeDiskMB is the free-space floor below which the disk check
+// reports down; known_hosts appends and logs start failing well before 0.
+const defaultMinFreeDiskMB = 100
+
+// handleLivez answers the liveness probe: if the process can serve this, it
+// is alive. It deliberately touches no dependency, so a database blip fails
+// readiness (pulling the pod out of rotation) without also failing liveness
+// and getting the pod restarted for an outage a restart can't fix.
+func (app *Application) handleLivez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "alive"})
+}
+
+// handleHealth checks every dependency and reports each one separately, so
+// monitoring can tell a database outage from a full disk. Only critical
+// components (the database) turn the response into a 503; anything else
+// yields 200 with status "degraded", which keeps load balancers routing to a
+// process that can still serve most requests.
+func (app *Application) handleHealth(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	components := map[string]componentHealth{
+		"database": app.checkDatabase(ctx),
+		"disk":     checkDisk(),
+	}
+	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+		components["redis"] = checkRedis(ctx, redisURL)
+	}
+
+	status := healthHealthy
+	for _, c := range components {
+		if c.Status == healthUp {
+			continue
+		}
+		if c.Critical {
+			status = healthFailing
+			break
+		}
+		status = healthDegraded
+	}
+
+	var queueDepth int64
+	if app.WebhookSender != nil {
+		queueDepth = app.WebhookSender.Pending()
+	}
+	database := "connected"
+	if components["database"].Status != healthUp {
+		database = "disconnected"
+	}
+
+	code := http.StatusOK
+	if status == healthFailing {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":              status,
+		"database":            database,
+		"components":          components,
+		"webhook_queue_depth": queueDepth,
+		"version":             buildInfo().Version,
+		"timestamp":           time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// checkDatabase pings the database and, until it has once seen them all,
+// checks that the required tables exist: a reachable but unmigrated database
+// would otherwise pass here and fail every real request.
+func (app *Application) checkDatabase(ctx context.Context) componentHealth {
+	c := componentHealth{Status: healthUp, Critical: true}
+	if err := app.DB.Ping(ctx); err != nil {
+		log.Errorf("Database health check failed: %v", err)
+		c.Status, c.Error = healthDown, "ping failed"
+		return c
+	}
+	if app.schemaReady.Load() {
+		return c
+	}
+	missing, err := db.MissingTables(ctx, app.DB)
+	switch {
+	case err != nil:
+		log.Errorf("Database schema check failed: %v", err)
+		c.Status, c.Error = healthDown, "schema check failed"
+	case len(missing) > 0:
+		c.Status, c.Error = healthDown, "schema missing tables: "+strings.Join(missing, ", ")
+	default:
+		app.schemaReady.Store(true)
+	}
+	return c
+}
+
+// checkDisk measures free space on the filesystem holding known_hosts, the
+// one file the server appends to at runtime.
+func checkDisk() componentHealth {
+	path := config.KnownHostsFile()
+	minMB := defaultMinFreeDiskMB
+	if v := os.Getenv("HEALTH_MIN_FREE_DISK_MB"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			minMB = n
+		}
+	}
+
+	c := componentHealth{Status: healthUp}
+	free, err := freeDiskBytes(filepath.Dir(path))
+	if errors.Is(err, errors.ErrUnsupported) {
+		return c
+	}
+	if err != nil {
+		c.Status, c.Error = healthDown, err.Error()
+		return c
+	}
+	c.FreeBytes = &free
+	if free < uint64(minMB)<<20 {
+		c.Status, c.Error = healthDown, fmt.Sprintf("less than %d MB free", minMB)
+	}
+	return c
+}
+
+// checkRedis confirms the configured Redis endpoint accepts connections.
+// REDIS_URL may be a redis:// URL or a bare host:port.
+func checkRedis(ctx context.Context, redisURL string) componentHealth {
+	c := componentHealth{Status: healthUp}
+	addr := redisURL
+	if u, err := url.Parse(redisURL); err == nil && u.Host != "" {
+		addr = u.Host
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "6379")
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(dialCtx, "tcp", addr)
+	if err != nil {
+		log.Warnf("Redis health check failed: %v", err)
+		c.Status, c.Error = healthDown, "unreachable"
+		return c
+	}
+	conn.Close()
+	return c
+}
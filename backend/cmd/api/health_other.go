@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// freeDiskBytes has no portable implementation here; checkDisk treats
+// ErrUnsupported as "not measured" rather than down.
+func freeDiskBytes(string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pashagolub/pgxmock/v4"
+
+	"ubuntu-auto-update/backend/pkg/db"
+)
+
+// healthBody runs handleHealth and decodes the response.
+func healthBody(t *testing.T, app *Application) (int, map[string]interface{}) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	app.handleHealth(rr, httptest.NewRequest(http.MethodGet, "/api/v1/health", nil))
+	var body map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return rr.Code, body
+}
+
+func componentStatus(t *testing.T, body map[string]interface{}, name string) string {
+	t.Helper()
+	comps, _ := body["components"].(map[string]interface{})
+	c, ok := comps[name].(map[string]interface{})
+	if !ok {
+		t.Fatalf("component %q missing: %v", name, body["components"])
+	}
+	return c["status"].(string)
+}
+
+// closedAddr returns a loopback address nothing is listening on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// expectSchema answers the health check's information_schema lookup as if
+// exactly tables exist.
+func expectSchema(mock pgxmock.PgxPoolIface, tables ...string) {
+	rows := mock.NewRows([]string{"table_name"})
+	for _, t := range tables {
+		rows.AddRow(t)
+	}
+	mock.ExpectQuery(`FROM information_schema.tables`).WithArgs(db.RequiredTables).WillReturnRows(rows)
+}
+
+func TestHandleHealth_Success(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	t.Setenv("KNOWN_HOSTS_FILE", filepath.Join(t.TempDir(), "known_hosts"))
+	t.Setenv("HEALTH_MIN_FREE_DISK_MB", "0")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	t.Setenv("REDIS_URL", "redis://"+ln.Addr().String()+"/0")
+
+	mock.ExpectPing()
+	expectSchema(mock, db.RequiredTables...)
+	code, body := healthBody(t, app)
+
+	if code != http.StatusOK || body["status"] != "healthy" {
+		t.Fatalf("got %d %v, want 200 healthy", code, body["status"])
+	}
+	for _, name := range []string{"database", "disk", "redis"} {
+		if got := componentStatus(t, body, name); got != "up" {
+			t.Errorf("%s = %s, want up", name, got)
+		}
+	}
+	if _, ok := body["webhook_queue_depth"]; !ok {
+		t.Error("webhook_queue_depth missing")
+	}
+}
+
+func TestHandleHealth_RedisOptional(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	t.Setenv("REDIS_URL", "")
+
+	mock.ExpectPing()
+	expectSchema(mock, db.RequiredTables...)
+	_, body := healthBody(t, app)
+	if _, ok := body["components"].(map[string]interface{})["redis"]; ok {
+		t.Error("redis reported without REDIS_URL")
+	}
+}
+
+func TestHandleHealth_Degraded(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	t.Setenv("REDIS_URL", closedAddr(t))
+
+	mock.ExpectPing()
+	expectSchema(mock, db.RequiredTables...)
+	code, body := healthBody(t, app)
+
+	if code != http.StatusOK || body["status"] != "degraded" {
+		t.Fatalf("got %d %v, want 200 degraded", code, body["status"])
+	}
+	if got := componentStatus(t, body, "redis"); got != "down" {
+		t.Errorf("redis = %s, want down", got)
+	}
+	if got := componentStatus(t, body, "database"); got != "up" {
+		t.Errorf("database = %s, want up", got)
+	}
+}
+
+func TestHandleHealth_LowDiskIsDegraded(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	t.Setenv("KNOWN_HOSTS_FILE", filepath.Join(t.TempDir(), "known_hosts"))
+	t.Setenv("HEALTH_MIN_FREE_DISK_MB", "1000000000")
+
+	mock.ExpectPing()
+	expectSchema(mock, db.RequiredTables...)
+	code, body := healthBody(t, app)
+	if code != http.StatusOK || body["status"] != "degraded" {
+		t.Fatalf("got %d %v, want 200 degraded", code, body["status"])
+	}
+	if got := componentStatus(t, body, "disk"); got != "down" {
+		t.Errorf("disk = %s, want down", got)
+	}
+}
+
+func TestHandleHealth_DBError(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	t.Setenv("REDIS_URL", closedAddr(t))
+
+	mock.ExpectPing().WillReturnError(sql.ErrConnDone)
+	code, body := healthBody(t, app)
+
+	if code != http.StatusServiceUnavailable || body["status"] != "unhealthy" {
+		t.Fatalf("got %d %v, want 503 unhealthy", code, body["status"])
+	}
+	if body["database"] != "disconnected" {
+		t.Errorf("database = %v", body["database"])
+	}
+}
+
+func TestHandleLivez_NoDependencies(t *testing.T) {
+	// DB is nil: any dependency check would panic rather than pass quietly.
+	app := testApp(t)
+
+	rr := httptest.NewRecorder()
+	app.handleLivez(rr, httptest.NewRequest(http.MethodGet, "/api/v1/livez", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+}
+
+func TestHandleReadyz_ClosedPool(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	mock.Close()
+
+	code, _ := healthBody(t, app)
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("readiness with a closed pool: got %d, want 503", code)
+	}
+	rr := httptest.NewRecorder()
+	app.handleLivez(rr, httptest.NewRequest(http.MethodGet, "/api/v1/livez", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("liveness with a closed pool: got %d, want 200", rr.Code)
+	}
+}
+
+func TestHandleHealth_SchemaMissing(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	t.Setenv("REDIS_URL", "")
+	t.Setenv("KNOWN_HOSTS_FILE", filepath.Join(t.TempDir(), "known_hosts"))
+	t.Setenv("HEALTH_MIN_FREE_DISK_MB", "0")
+
+	// Reachable database with no tables at all: 503 naming what's missing.
+	mock.ExpectPing()
+	expectSchema(mock)
+	code, body := healthBody(t, app)
+
+	if code != http.StatusServiceUnavailable || body["status"] != "unhealthy" {
+		t.Fatalf("got %d %v, want 503 unhealthy", code, body["status"])
+	}
+	comp := body["components"].(map[string]interface{})["database"].(map[string]interface{})
+	if msg, _ := comp["error"].(string); !strings.Contains(msg, "hosts") || !strings.Contains(msg, "users") {
+		t.Errorf("error should name the missing tables, got %q", msg)
+	}
+
+	// Once migrated, health recovers and stops re-checking the schema.
+	mock.ExpectPing()
+	expectSchema(mock, db.RequiredTables...)
+	if code, _ := healthBody(t, app); code != http.StatusOK {
+		t.Fatalf("after migration: got %d, want 200", code)
+	}
+	mock.ExpectPing()
+	if code, _ := healthBody(t, app); code != http.StatusOK {
+		t.Fatalf("third probe: got %d, want 200", code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+// Host export: GET /hosts/export writes the inventory as one JSON document
+// for backups and migrations. Rows are streamed as they are read, so a large
+// fleet is never held in memory.
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	log "github.com/sirupsen/logrus"
+
+	"ubuntu-auto-update/backend/pkg/audit"
+	"ubuntu-auto-update/backend/pkg/middleware"
+	"ubuntu-auto-update/backend/pkg/models"
+	"ubuntu-auto-update/backend/pkg/session"
+)
+
+// exportQuery reads what an export carries. $1 adds each host's SSH keys,
+// still encrypted, in the order they are offered; without it ssh_keys is
+// NULL. $2 includes archived hosts. Run output is left out.
+const exportQuery = `
+SELECT h.id, h.hostname, h.ssh_user, h.tags, h.environment, h.update_policy,
+       h.os_version, h.kernel_version, h.agent_version, h.architecture,
+       h.created_at, h.last_seen, h.deleted_at,
+       CASE WHEN $1 THEN ARRAY(SELECT k.private_key FROM ssh_keys k
+                               WHERE k.host_id = h.id ORDER BY k.position, k.id)
+       END AS ssh_keys
+FROM hosts h
+WHERE $2 OR h.deleted_at IS NULL
+ORDER BY h.hostname`
+
+// exportedHost is one host in an export. Hostname and Port are split from
+// the stored host:port. SSHKeys are ciphertext that only a server with the
+// same ENCRYPTION_KEY can read.
+type exportedHost struct {
+	ID            int32               `json:"id" db:"id"`
+	Hostname      string              `json:"hostname" db:"hostname"`
+	Port          int                 `json:"port" db:"-"`
+	SshUser       string              `json:"ssh_user" db:"ssh_user"`
+	Tags          []string            `json:"tags" db:"tags"`
+	Environment   string              `json:"environment" db:"environment"`
+	UpdatePolicy  models.UpdatePolicy `json:"update_policy" db:"update_policy"`
+	OsVersion     string              `json:"os_version" db:"os_version"`
+	KernelVersion string              `json:"kernel_version" db:"kernel_version"`
+	AgentVersion  string              `json:"agent_version" db:"agent_version"`
+	Architecture  string              `json:"architecture" db:"architecture"`
+	CreatedAt     time.Time           `json:"created_at" db:"created_at"`
+	LastSeen      time.Time           `json:"last_seen" db:"last_seen"`
+	DeletedAt     *time.Time          `json:"deleted_at,omitempty" db:"deleted_at"`
+	SSHKeys       []string            `json:"ssh_keys,omitempty" db:"ssh_keys"`
+}
+
+// handleExportHosts writes {"exported_at": ..., "hosts": [...]}, ordered
+// by hostname. Private keys are left out; ?include_keys=true adds each
+// host's keys as stored, encrypted, and is admin-only. Archived hosts are
+// included with ?include_deleted=true.
+//
+// The 200 is sent with the document's opening bytes, so a failure part way
+// through can only cut the document short: the client sees invalid JSON
+// rather than a partial inventory that parses.
+func (app *Application) handleExportHosts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	includeKeys := q.Get("include_keys") == "true"
+	if includeKeys {
+		if p := middleware.GetPrincipalFromContext(r); p == nil || !p.HasRole(session.RoleAdmin) {
+			writeJSONError(w, http.StatusForbidden, "include_keys requires the admin role")
+			return
+		}
+	}
+
+	includeDeleted := q.Get("include_deleted") == "true"
+
+	// Audited before anything is read: a client that drops the stream
+	// part way has still taken whatever it received, keys included.
+	app.audit(r, audit.ActionHostExport, "host", "",
+		map[string]interface{}{"include_keys": includeKeys, "include_deleted": includeDeleted})
+
+	rows, err := app.DB.Query(r.Context(), exportQuery, includeKeys, includeDeleted)
+	if err != nil {
+		log.Errorf("host export: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to export hosts")
+		return
+	}
+	defer rows.Close()
+
+	now := time.Now().UTC()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="hosts-`+now.Format("2006-01-02")+`.json"`)
+	_, _ = w.Write([]byte(`{"exported_at":"` + now.Format(time.RFC3339) + `","hosts":[`))
+
+	n := 0
+	for rows.Next() {
+		h, err := pgx.RowToStructByName[exportedHost](rows)
+		if err != nil {
+			log.Errorf("host export: %v", err)
+			return
+		}
+		h.Hostname, h.Port = splitHostPort(h.Hostname)
+		if h.Tags == nil {
+			h.Tags = []string{}
+		}
+		b, err := json.Marshal(h)
+		if err != nil {
+			log.Errorf("host export: encode host %d: %v", h.ID, err)
+			return
+		}
+		if n > 0 {
+			_, _ = w.Write([]byte{','})
+		}
+		if _, err := w.Write(b); err != nil {
+			// The client went away; nothing more to do.
+			return
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		log.Errorf("host export: %v", err)
+		return
+	}
+	_, _ = w.Write([]byte("]}\n"))
+}
+
+// splitHostPort undoes the host:port form a non-default port is stored in,
+// returning 22 when there is none. A bare IPv6 address is left whole.
+func splitHostPort(hostname string) (string, int) {
+	host, p, err := net.SplitHostPort(hostname)
+	if err != nil {
+		return hostname, 22
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return hostname, 22
+	}
+	return host, port
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"ubuntu-auto-update/backend/pkg/middleware"
+	"ubuntu-auto-update/backend/pkg/session"
+)
+
+var exportCols = []string{"id", "hostname", "ssh_user", "tags", "environment", "update_policy",
+	"os_version", "kernel_version", "agent_version", "architecture",
+	"created_at", "last_seen", "deleted_at", "ssh_keys"}
+
+func withRole(req *http.Request, role string) *http.Request {
+	p := &session.Principal{Username: role, Role: role}
+	return req.WithContext(context.WithValue(req.Context(), middleware.PrincipalContextKey, p))
+}
+
+// A default export carries every host with its port split out, and no keys.
+func TestHandleExportHosts_OmitsKeysByDefault(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	now := time.Now()
+
+	expectAudit(mock)
+	mock.ExpectQuery(`SELECT (.+) FROM hosts h`).WithArgs(false, false).
+		WillReturnRows(mock.NewRows(exportCols).
+			AddRow(int32(2), "db-1:2222", "root", []string{"db"}, "prod", "all", "Ubuntu 24.04", "", "", "", now, now, nil, nil).
+			AddRow(int32(1), "web-1", "ubuntu", nil, "", "security_only", "", "", "", "", now, now, nil, nil))
+
+	req := withRole(httptest.NewRequest(http.MethodGet, "/api/v1/hosts/export", nil), session.RoleViewer)
+	rr := httptest.NewRecorder()
+	app.handleExportHosts(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if strings.Contains(rr.Body.String(), "ssh_keys") || strings.Contains(rr.Body.String(), "private_key") {
+		t.Errorf("export carries keys: %s", rr.Body.String())
+	}
+
+	var doc struct {
+		ExportedAt time.Time      `json:"exported_at"`
+		Hosts      []exportedHost `json:"hosts"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("export is not valid JSON: %v", err)
+	}
+	if doc.ExportedAt.IsZero() || len(doc.Hosts) != 2 {
+		t.Fatalf("got %+v", doc)
+	}
+	if h := doc.Hosts[0]; h.Hostname != "db-1" || h.Port != 2222 || h.Environment != "prod" {
+		t.Errorf("hosts[0] = %+v", h)
+	}
+	if h := doc.Hosts[1]; h.Hostname != "web-1" || h.Port != 22 || h.Tags == nil {
+		t.Errorf("hosts[1] = %+v", h)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// Keys come only for an admin, and then as stored.
+func TestHandleExportHosts_IncludeKeys(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	now := time.Now()
+
+	rr := httptest.NewRecorder()
+	app.handleExportHosts(rr, withRole(httptest.NewRequest(http.MethodGet, "/api/v1/hosts/export?include_keys=true", nil), session.RoleOperator))
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("operator: expected 403, got %d", rr.Code)
+	}
+
+	expectAudit(mock)
+	mock.ExpectQuery(`SELECT (.+) FROM hosts h`).WithArgs(true, false).
+		WillReturnRows(mock.NewRows(exportCols).
+			AddRow(int32(1), "web-1", "root", []string{}, "", "all", "", "", "", "", now, now, nil, []string{"ciphertext-1", "ciphertext-2"}))
+
+	rr = httptest.NewRecorder()
+	app.handleExportHosts(rr, withRole(httptest.NewRequest(http.MethodGet, "/api/v1/hosts/export?include_keys=true", nil), session.RoleAdmin))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("admin: expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), `"ssh_keys":["ciphertext-1","ciphertext-2"]`) {
+		t.Errorf("keys missing: %s", rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// The export is audited before the first row is read, so even one that
+// fails or is cut short is on record.
+func TestHandleExportHosts_AuditsFirst(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	expectAudit(mock)
+	mock.ExpectQuery(`SELECT (.+) FROM hosts h`).WithArgs(false, true).
+		WillReturnError(errors.New("connection reset"))
+
+	rr := httptest.NewRecorder()
+	app.handleExportHosts(rr, withRole(httptest.NewRequest(http.MethodGet, "/api/v1/hosts/export?include_deleted=true", nil), session.RoleViewer))
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
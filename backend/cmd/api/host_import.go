@@ -0,0 +1,345 @@
+package main
+
+// Bulk host import: POST /hosts/import takes a CSV or JSON list of hosts and
+// upserts them by hostname in one transaction. Rows that fail validation or
+// the insert are reported and skipped; the rest still land.
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"ubuntu-auto-update/backend/pkg/audit"
+	"ubuntu-auto-update/backend/pkg/db"
+	sshpkg "ubuntu-auto-update/backend/pkg/ssh"
+)
+
+// maxImportRows caps one import so a single request can't hold the
+// transaction open for long.
+const maxImportRows = 1000
+
+// importColumns are the CSV columns, in the order a file without a header
+// row lists them. Only hostname is required.
+var importColumns = []string{"hostname", "ssh_user", "port", "tags"}
+
+// importRow is one host as it arrived. Port stays text so a CSV row with a
+// bad port is reported like any other bad row.
+type importRow struct {
+	Hostname string   `json:"hostname"`
+	SshUser  string   `json:"ssh_user"`
+	Port     string   `json:"-"`
+	Tags     []string `json:"tags"`
+}
+
+// exportOnlyFields are the fields a GET /hosts/export host carries that an
+// import does not set. They are accepted, so an export imports as is, and
+// ignored: the server derives them, and keys are added per host.
+type exportOnlyFields struct {
+	ID            json.RawMessage `json:"id"`
+	Environment   json.RawMessage `json:"environment"`
+	UpdatePolicy  json.RawMessage `json:"update_policy"`
+	OsVersion     json.RawMessage `json:"os_version"`
+	KernelVersion json.RawMessage `json:"kernel_version"`
+	AgentVersion  json.RawMessage `json:"agent_version"`
+	Architecture  json.RawMessage `json:"architecture"`
+	CreatedAt     json.RawMessage `json:"created_at"`
+	LastSeen      json.RawMessage `json:"last_seen"`
+	DeletedAt     json.RawMessage `json:"deleted_at"`
+	SSHKeys       json.RawMessage `json:"ssh_keys"`
+}
+
+// UnmarshalJSON takes port as a number, like the rest of the API.
+func (row *importRow) UnmarshalJSON(b []byte) error {
+	type plain importRow
+	var v struct {
+		plain
+		exportOnlyFields
+		Port *int `json:"port"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	*row = importRow(v.plain)
+	if v.Port != nil {
+		row.Port = strconv.Itoa(*v.Port)
+	}
+	return nil
+}
+
+// importRowResult is one row's outcome. Row is 1-based and counts data rows
+// only, so a CSV header is not row 1.
+type importRowResult struct {
+	Row      int    `json:"row"`
+	Hostname string `json:"hostname"`
+	OK       bool   `json:"ok"`
+	HostID   int32  `json:"host_id,omitempty"`
+	Created  bool   `json:"created,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// handleImportHosts upserts hosts in bulk: POST /hosts/import.
+//
+// The body is CSV or JSON, told apart by Content-Type (text/csv or
+// application/json) or, for anything else, by whether it starts with '{' or
+// '['. CSV has the columns hostname, ssh_user, port and tags, optionally
+// under a header row naming them in any order; tags are separated by ';'.
+// JSON is {"hosts": [...]} or a bare array of
+// {"hostname", "ssh_user", "port", "tags"} objects.
+//
+// A port other than 22 is stored on the hostname as host:port, bracketing
+// an IPv6 address; IP literals are stored in canonical form. An existing
+// host keeps its ssh_user and tags where the row leaves them empty. The
+// response lists every row: 200 when all were imported, 207 when some were,
+// 422 when none were.
+func (app *Application) handleImportHosts(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+
+	var rows []importRow
+	if isJSONImport(r.Header.Get("Content-Type"), body) {
+		rows, err = parseJSONImport(body)
+		if err != nil {
+			writeDecodeError(w, err)
+			return
+		}
+	} else {
+		rows, err = parseCSVImport(body)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid CSV: "+err.Error())
+			return
+		}
+	}
+	if len(rows) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "No hosts to import")
+		return
+	}
+	if len(rows) > maxImportRows {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Imports are capped at %d hosts", maxImportRows))
+		return
+	}
+
+	results := make([]importRowResult, len(rows))
+	var (
+		valid   []db.ImportHost
+		indexes []int // valid[j] is rows[indexes[j]]
+	)
+	seen := make(map[string]int, len(rows))
+	for i, row := range rows {
+		results[i] = importRowResult{Row: i + 1, Hostname: strings.TrimSpace(row.Hostname)}
+		h, err := validateImportRow(row)
+		if err == nil {
+			if first, dup := seen[h.Hostname]; dup {
+				err = fmt.Errorf("duplicate of row %d", first)
+			}
+		}
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		seen[h.Hostname] = i + 1
+		results[i].Hostname = h.Hostname
+		valid = append(valid, h)
+		indexes = append(indexes, i)
+	}
+
+	if len(valid) > 0 {
+		imported, err := db.ImportHosts(r.Context(), app.DB, valid)
+		if err != nil {
+			log.Errorf("Failed to import hosts: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to import hosts")
+			return
+		}
+		for j, res := range imported {
+			out := &results[indexes[j]]
+			if res.Err != nil {
+				log.Errorf("Failed to import host %s: %v", valid[j].Hostname, res.Err)
+				out.Error = "failed to save host"
+				continue
+			}
+			out.OK = true
+			out.HostID = res.Host.ID
+			out.Created = res.Created
+			if res.Created {
+				app.dispatchEvent("host_registered", res.Host.ID,
+					map[string]interface{}{"host_id": res.Host.ID, "hostname": res.Host.Hostname})
+			}
+		}
+	}
+
+	var created, updated, failed int
+	for _, res := range results {
+		switch {
+		case !res.OK:
+			failed++
+		case res.Created:
+			created++
+		default:
+			updated++
+		}
+	}
+	log.Infof("Host import: %d created, %d updated, %d failed", created, updated, failed)
+	app.audit(r, audit.ActionHostImport, "host", "",
+		map[string]interface{}{"created": created, "updated": updated, "failed": failed})
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case failed == 0:
+		w.WriteHeader(http.StatusOK)
+	case created+updated == 0:
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	default:
+		w.WriteHeader(http.StatusMultiStatus)
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"results":       results,
+		"created_count": created,
+		"updated_count": updated,
+		"failure_count": failed,
+	})
+}
+
+// isJSONImport decides how to parse an import body: by its Content-Type
+// when that names CSV or JSON, otherwise by its first non-space byte.
+func isJSONImport(contentType string, body []byte) bool {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	switch mt {
+	case "application/json":
+		return true
+	case "text/csv":
+		return false
+	}
+	trimmed := bytes.TrimSpace(body)
+	return len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[')
+}
+
+// parseJSONImport reads {"hosts": [...]} or a bare array of hosts. An
+// export document ({"exported_at": ..., "hosts": [...]}) reads the same way.
+func parseJSONImport(body []byte) ([]importRow, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var rows []importRow
+		err := json.Unmarshal(body, &rows)
+		return rows, err
+	}
+	var req struct {
+		ExportedAt json.RawMessage `json:"exported_at"`
+		Hosts      []importRow     `json:"hosts"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&req)
+	return req.Hosts, err
+}
+
+// parseCSVImport reads CSV rows. A first record that contains a hostname
+// column is the header; any column it names must be one of importColumns.
+// Blank lines and lines starting with '#' are skipped.
+func parseCSVImport(body []byte) ([]importRow, error) {
+	cr := csv.NewReader(bytes.NewReader(body))
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	columns := importColumns
+	for _, f := range records[0] {
+		if strings.EqualFold(strings.TrimSpace(f), "hostname") {
+			columns = make([]string, len(records[0]))
+			for i, name := range records[0] {
+				name = strings.ToLower(strings.TrimSpace(name))
+				if !slices.Contains(importColumns, name) {
+					return nil, fmt.Errorf("unknown column %q; expected %s", name, strings.Join(importColumns, ", "))
+				}
+				columns[i] = name
+			}
+			records = records[1:]
+			break
+		}
+	}
+
+	rows := make([]importRow, 0, len(records))
+	for _, rec := range records {
+		var row importRow
+		for i, f := range rec {
+			if i >= len(columns) {
+				break
+			}
+			switch columns[i] {
+			case "hostname":
+				row.Hostname = f
+			case "ssh_user":
+				row.SshUser = f
+			case "port":
+				row.Port = strings.TrimSpace(f)
+			case "tags":
+				row.Tags = strings.Split(f, ";")
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// validateImportRow checks one row and turns it into what db.ImportHosts
+// stores. The error text is safe to return to the client.
+func validateImportRow(row importRow) (db.ImportHost, error) {
+	hostname := sshpkg.NormalizeHostname(strings.TrimSpace(row.Hostname))
+	if hostname == "" {
+		return db.ImportHost{}, errors.New("hostname is required")
+	}
+	if err := sshpkg.ValidateHostname(hostname); err != nil {
+		return db.ImportHost{}, err
+	}
+	sshUser := strings.TrimSpace(row.SshUser)
+	if sshUser != "" {
+		if err := sshpkg.ValidateUsername(sshUser); err != nil {
+			return db.ImportHost{}, err
+		}
+	}
+	if row.Port != "" {
+		port, err := strconv.Atoi(row.Port)
+		if err != nil || port < 1 || port > 65535 {
+			return db.ImportHost{}, errors.New("port must be 1-65535")
+		}
+		if port != 22 {
+			hostname = net.JoinHostPort(hostname, strconv.Itoa(port))
+		}
+	}
+	tags := make([]string, 0, len(row.Tags))
+	for _, t := range row.Tags {
+		if strings.TrimSpace(t) == "" {
+			continue
+		}
+		t, ok := normalizeTag(t)
+		if !ok {
+			return db.ImportHost{}, errors.New("tags must be 1-64 characters")
+		}
+		if !slices.Contains(tags, t) {
+			tags = append(tags, t)
+		}
+	}
+	return db.ImportHost{Hostname: hostname, SshUser: sshUser, Tags: tags}, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var importCols = append(append([]string{}, hostCols...), "created")
+
+// A CSV with bad rows among good ones imports the good ones, in one
+// transaction, and reports the bad ones by row.
+func TestHandleImportHosts_MixedValidityCSV(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	now := time.Now()
+
+	csvBody := strings.Join([]string{
+		"hostname,ssh_user,port,tags",
+		"web-1,ubuntu,,web;prod",
+		"bad host!,root,,",
+		"db-1,,2222,db; db",
+		"# decommissioned",
+		"web-1,root,,",
+		"api-1,root,99999,",
+		"api-2,Root,,",
+		",root,,",
+	}, "\n")
+
+	mock.ExpectBegin()
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO hosts`).
+		WithArgs("web-1", "ubuntu", []string{"web", "prod"}).
+		WillReturnRows(mock.NewRows(importCols).
+			AddRow(int32(1), "web-1", "ubuntu", now.Add(-time.Hour), now, now, "", "", nil, []string{"web", "prod"}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, "", false))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO hosts`).
+		WithArgs("db-1:2222", "", []string{"db"}).
+		WillReturnRows(mock.NewRows(importCols).
+			AddRow(int32(2), "db-1:2222", "root", now, now, now, "", "", nil, []string{"db"}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, "", true))
+	mock.ExpectCommit()
+	mock.ExpectCommit()
+	expectWebhookLookup(mock, "host_registered", 2)
+	expectAudit(mock)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/hosts/import", strings.NewReader(csvBody))
+	req.Header.Set("Content-Type", "text/csv")
+	rr := httptest.NewRecorder()
+	app.handleImportHosts(rr, req)
+	if rr.Code != http.StatusMultiStatus {
+		t.Fatalf("expected 207, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var resp struct {
+		Results []importRowResult `json:"results"`
+		Created int               `json:"created_count"`
+		Updated int               `json:"updated_count"`
+		Failed  int               `json:"failure_count"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := []importRowResult{
+		{Row: 1, Hostname: "web-1", OK: true, HostID: 1},
+		{Row: 2, Hostname: "bad host!", Error: "hostname must be a valid RFC 1123 hostname or IP address"},
+		{Row: 3, Hostname: "db-1:2222", OK: true, HostID: 2, Created: true},
+		{Row: 4, Hostname: "web-1", Error: "duplicate of row 1"},
+		{Row: 5, Hostname: "api-1", Error: "port must be 1-65535"},
+		{Row: 6, Hostname: "api-2", Error: "ssh_user must be a valid POSIX username"},
+		{Row: 7, Hostname: "", Error: "hostname is required"},
+	}
+	if !reflect.DeepEqual(resp.Results, want) {
+		t.Errorf("results = %+v", resp.Results)
+	}
+	if resp.Created != 1 || resp.Updated != 1 || resp.Failed != 5 {
+		t.Errorf("counts = %d created, %d updated, %d failed", resp.Created, resp.Updated, resp.Failed)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// Without a Content-Type the body's first byte picks JSON, and a CSV file
+// without a header takes the columns in their documented order.
+func TestParseImport_Sniffing(t *testing.T) {
+	if !isJSONImport("", []byte(" \n[{\"hostname\":\"web-1\"}]")) {
+		t.Error("array body not taken as JSON")
+	}
+	if isJSONImport("application/octet-stream", []byte("web-1,root,22,web")) {
+		t.Error("CSV body taken as JSON")
+	}
+	if isJSONImport("text/csv; charset=utf-8", []byte("[")) {
+		t.Error("text/csv ignored")
+	}
+
+	rows, err := parseJSONImport([]byte(`{"hosts":[{"hostname":"web-1","port":2222,"tags":["web"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []importRow{{Hostname: "web-1", Port: "2222", Tags: []string{"web"}}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("JSON rows = %+v", rows)
+	}
+	if _, err := parseJSONImport([]byte(`[{"hostname":"web-1","password":"x"}]`)); err == nil {
+		t.Error("unknown field accepted")
+	}
+
+	rows, err = parseCSVImport([]byte("web-1, deploy, 22, web;prod\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []importRow{{Hostname: "web-1", SshUser: "deploy", Port: "22", Tags: []string{"web", "prod"}}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("CSV rows = %+v", rows)
+	}
+	if _, err := parseCSVImport([]byte("hostname,password\nweb-1,x\n")); err == nil {
+		t.Error("unknown CSV column accepted")
+	}
+}
+
+// Nothing is written when every row is bad.
+func TestHandleImportHosts_AllInvalid(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	expectAudit(mock)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/hosts/import",
+		strings.NewReader(`{"hosts":[{"hostname":"-bad"},{"hostname":"web-1","port":0}]}`))
+	rr := httptest.NewRecorder()
+	app.handleImportHosts(rr, req)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// IPv6 rows are stored canonical and bracketed when they carry a port, and
+// an export splits them back into the same hostname and port.
+func TestValidateImportRow_IPv6(t *testing.T) {
+	cases := []struct {
+		row          importRow
+		stored, host string
+		port         int
+	}{
+		{importRow{Hostname: "[2001:DB8::1]"}, "2001:db8::1", "2001:db8::1", 22},
+		{importRow{Hostname: "2001:db8:0::1", Port: "2222"}, "[2001:db8::1]:2222", "2001:db8::1", 2222},
+		{importRow{Hostname: "web-1", Port: "2222"}, "web-1:2222", "web-1", 2222},
+	}
+	for _, c := range cases {
+		h, err := validateImportRow(c.row)
+		if err != nil {
+			t.Errorf("%+v: %v", c.row, err)
+			continue
+		}
+		if h.Hostname != c.stored {
+			t.Errorf("%+v stored as %q, want %q", c.row, h.Hostname, c.stored)
+		}
+		if host, port := splitHostPort(h.Hostname); host != c.host || port != c.port {
+			t.Errorf("%q exports as %q, %d; want %q, %d", h.Hostname, host, port, c.host, c.port)
+		}
+	}
+}
+
+// An export document imports as is: its envelope and the fields the import
+// doesn't set are accepted and ignored.
+func TestParseImport_ExportDocument(t *testing.T) {
+	doc := `{"exported_at":"2026-10-16T12:00:00Z","hosts":[` +
+		`{"id":2,"hostname":"db-1","port":2222,"ssh_user":"root","tags":["db"],"environment":"prod","update_policy":"all",` +
+		`"os_version":"Ubuntu 24.04","kernel_version":"","agent_version":"","architecture":"",` +
+		`"created_at":"2026-01-01T00:00:00Z","last_seen":"2026-10-16T11:00:00Z","deleted_at":"2026-10-01T00:00:00Z","ssh_keys":["ciphertext-1"]}]}`
+	rows, err := parseJSONImport([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []importRow{{Hostname: "db-1", SshUser: "root", Port: "2222", Tags: []string{"db"}}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %+v", rows)
+	}
+	if _, err := parseJSONImport([]byte(`{"exported_at":"x","hosts":[],"version":1}`)); err == nil {
+		t.Error("unknown envelope field accepted")
+	}
+}
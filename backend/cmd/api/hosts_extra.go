@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
@@ -12,9 +13,11 @@ import (
 
 	"github.com/jackc/pgx/v5"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
 
 	"ubuntu-auto-update/backend/pkg/audit"
 	"ubuntu-auto-update/backend/pkg/db"
+	"ubuntu-auto-update/backend/pkg/models"
 	sshpkg "ubuntu-auto-update/backend/pkg/ssh"
 )
 
@@ -43,8 +46,8 @@ func (app *Application) handleBulkEnroll(w http.ResponseWriter, r *http.Request)
 		Concurrency int    `json:"concurrency"`
 		SudoScope   string `json:"sudo_scope"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
 		return
 	}
 	if len(req.Hosts) == 0 {
@@ -92,7 +95,7 @@ func (app *Application) handleBulkEnroll(w http.ResponseWriter, r *http.Request)
 			defer func() { <-sem }()
 			res := result{Hostname: h.Hostname}
 
-			hostname := strings.TrimSpace(h.Hostname)
+			hostname := sshpkg.NormalizeHostname(strings.TrimSpace(h.Hostname))
 			sshUser := strings.TrimSpace(h.SshUser)
 			if sshUser == "" {
 				sshUser = "root"
@@ -102,6 +105,11 @@ func (app *Application) handleBulkEnroll(w http.ResponseWriter, r *http.Request)
 				results[i] = res
 				return
 			}
+			if err := sshpkg.ValidateHostname(hostname); err != nil {
+				res.Error = err.Error()
+				results[i] = res
+				return
+			}
 
 			// Per-host budget: 90 s for the SSH dance, generous and bounded.
 			ctx, cancel := context.WithTimeout(context.Background(), 90*time.Second)
@@ -180,16 +188,41 @@ func (app *Application) handleBulkEnroll(w http.ResponseWriter, r *http.Request)
 	})
 }
 
-// handleRotateKey generates a fresh keypair on the host using the existing
-// key, stores the new private key encrypted, and revokes the old key from
-// authorized_keys. Idempotent: re-running just installs a new key.
+// handleRotateKey replaces a host's stored SSH key.
+//
+// With an empty body it generates a fresh keypair on the host using the
+// existing key, stores the new private key encrypted, and revokes the old
+// key from authorized_keys. Idempotent: re-running just installs a new key.
+//
+// With {"private_key": "..."} the operator supplies a key they have already
+// installed on the host. We dial with it first and only overwrite the stored
+// key once that succeeds, so a typo or a key missing from authorized_keys is
+// rejected with the reason instead of locking the backend out of the host.
 func (app *Application) handleRotateKey(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+
 	id, err := parseHostID(r)
 	if err != nil {
 		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
 		return
 	}
 
+	var req struct {
+		PrivateKey string `json:"private_key"`
+	}
+	if err := decodeJSON(r, &req); err != nil && !errors.Is(err, io.EOF) {
+		writeDecodeError(w, err)
+		return
+	}
+	req.PrivateKey = strings.TrimSpace(req.PrivateKey)
+	if req.PrivateKey != "" {
+		if _, parseErr := ssh.ParsePrivateKey([]byte(req.PrivateKey)); parseErr != nil {
+			log.Warnf("rotate-key: failed to parse supplied key for host %d: %v", id, parseErr)
+			writeJSONError(w, http.StatusBadRequest, "Invalid private key format")
+			return
+		}
+	}
+
 	host, err := db.GetHost(r.Context(), app.DB, id)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -204,6 +237,11 @@ func (app *Application) handleRotateKey(w http.ResponseWriter, r *http.Request)
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 
+	if req.PrivateKey != "" {
+		app.replaceKeyVerified(ctx, w, r, host, req.PrivateKey)
+		return
+	}
+
 	rotated, rotErr := app.SSHDialer.RotateKey(ctx, id)
 	// RotateKey returns a partial result + error if the new key works but old
 	// key revocation failed; persist the new key in that case so future dials
@@ -230,3 +268,182 @@ func (app *Application) handleRotateKey(w http.ResponseWriter, r *http.Request)
 	}
 	_ = json.NewEncoder(w).Encode(resp)
 }
+
+// replaceKeyVerified is the supplied-key branch of handleRotateKey. The
+// stored key is untouched unless the verification dial succeeds.
+func (app *Application) replaceKeyVerified(ctx context.Context, w http.ResponseWriter, r *http.Request, host models.Host, privateKey string) {
+	if err := app.SSHDialer.VerifyKey(ctx, host, privateKey); err != nil {
+		log.Warnf("rotate-key for %s (id=%d): supplied key rejected: %v", host.Hostname, host.ID, err)
+		writeJSONError(w, http.StatusBadRequest, "New key failed verification; existing key kept: "+err.Error())
+		return
+	}
+
+	if err := db.AddSSHKey(ctx, app.DB, host.ID, privateKey); err != nil {
+		log.Errorf("rotate-key: store key for host %d: %v", host.ID, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to store SSH key")
+		return
+	}
+
+	app.audit(r, audit.ActionHostKeyRotate, "host", strconv.FormatInt(int64(host.ID), 10),
+		map[string]interface{}{"hostname": host.Hostname, "supplied": true})
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"ok": true})
+}
+
+// handleGenerateKey creates a keypair server-side for a host that will be
+// onboarded by hand: the private key is stored encrypted and the response
+// carries only the authorized_keys line for the operator to install. The
+// private key never leaves the backend. Body: {"type": "ed25519"|"rsa"},
+// optional, default ed25519.
+//
+// The new key replaces any stored key immediately, so call this before the
+// host is reachable, or use rotate-key for hosts already being managed.
+func (app *Application) handleGenerateKey(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+
+	id, err := parseHostID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+
+	var req struct {
+		Type string `json:"type"`
+	}
+	if err := decodeJSON(r, &req); err != nil && !errors.Is(err, io.EOF) {
+		writeDecodeError(w, err)
+		return
+	}
+	keyType := strings.ToLower(strings.TrimSpace(req.Type))
+	if keyType == "" {
+		keyType = sshpkg.KeyTypeEd25519
+	}
+	if keyType != sshpkg.KeyTypeEd25519 && keyType != sshpkg.KeyTypeRSA {
+		writeJSONError(w, http.StatusBadRequest, "type must be ed25519 or rsa")
+		return
+	}
+
+	host, err := db.GetHost(r.Context(), app.DB, id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "Host not found")
+			return
+		}
+		log.Errorf("generate-key: get host %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to read host")
+		return
+	}
+
+	kp, err := sshpkg.GenerateKeyPair(keyType)
+	if err != nil {
+		log.Errorf("generate-key for host %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to generate key")
+		return
+	}
+	if err := db.AddSSHKey(r.Context(), app.DB, id, kp.PrivateKeyPEM); err != nil {
+		log.Errorf("generate-key: store key for host %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to store SSH key")
+		return
+	}
+
+	fingerprint := ssh.FingerprintSHA256(kp.PublicKey)
+	app.audit(r, audit.ActionHostKeyGenerate, "host", strconv.FormatInt(int64(id), 10),
+		map[string]interface{}{"hostname": host.Hostname, "type": keyType, "fingerprint": fingerprint})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":        keyType,
+		"public_key":  kp.AuthorizedKey,
+		"fingerprint": fingerprint,
+	})
+}
+
+// handleSetSudoPassword stores the password sudo asks the host's ssh_user
+// for. Update runs then feed it to `sudo -S` on stdin when sudo prompts,
+// instead of relying on passwordless sudo. The password is encrypted at rest, never logged or
+// audited, and no endpoint returns it.
+func (app *Application) handleSetSudoPassword(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	id, err := parseHostID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	switch {
+	case req.Password == "":
+		writeJSONError(w, http.StatusBadRequest, "password is required; DELETE the sudo password to fall back to passwordless sudo")
+		return
+	case strings.ContainsAny(req.Password, "\r\n"):
+		// sudo -S reads one line; a newline would end the password early
+		// and hand the rest to the update script's stdin.
+		writeJSONError(w, http.StatusBadRequest, "password must not contain line breaks")
+		return
+	}
+
+	if err := db.SetSudoPassword(r.Context(), app.DB, id, req.Password); err != nil {
+		if isForeignKeyViolation(err) {
+			writeJSONError(w, http.StatusNotFound, "Host not found")
+			return
+		}
+		log.Errorf("Failed to set sudo password for host %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to save sudo password")
+		return
+	}
+	app.audit(r, audit.ActionHostSudoPasswordSet, "host", strconv.FormatInt(int64(id), 10), nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *Application) handleDeleteSudoPassword(w http.ResponseWriter, r *http.Request) {
+	id, err := parseHostID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+	n, err := db.DeleteSudoPassword(r.Context(), app.DB, id)
+	if err != nil {
+		log.Errorf("Failed to delete sudo password for host %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete sudo password")
+		return
+	}
+	if n == 0 {
+		writeJSONError(w, http.StatusNotFound, "No sudo password stored for this host")
+		return
+	}
+	app.audit(r, audit.ActionHostSudoPasswordDelete, "host", strconv.FormatInt(int64(id), 10), nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleReEncryptSSHKeys re-wraps every stored SSH key under the current
+// encryption key. The rotation procedure is: set the new ENCRYPTION_KEY,
+// move the old one to ENCRYPTION_PREVIOUS_KEYS, restart, call this, then
+// drop the old key. Safe to repeat.
+func (app *Application) handleReEncryptSSHKeys(w http.ResponseWriter, r *http.Request) {
+	n, err := db.ReEncryptSSHKeys(r.Context(), app.DB)
+	if err != nil {
+		log.Errorf("re-encrypt ssh keys (%d done): %v", n, err)
+		writeJSONError(w, http.StatusInternalServerError, "Re-encryption failed; it is safe to retry")
+		return
+	}
+	// Sudo passwords are wrapped with the same key, so they rotate together.
+	p, err := db.ReEncryptSudoPasswords(r.Context(), app.DB)
+	n += p
+	if err != nil {
+		log.Errorf("re-encrypt sudo passwords (%d done): %v", p, err)
+		writeJSONError(w, http.StatusInternalServerError, "Re-encryption failed; it is safe to retry")
+		return
+	}
+
+	app.audit(r, audit.ActionKeysReEncrypt, "ssh_keys", "", map[string]interface{}{"reencrypted": n})
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"reencrypted": n})
+}
@@ -5,8 +5,11 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -15,7 +18,9 @@ import (
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/pashagolub/pgxmock/v4"
 	"ubuntu-auto-update/backend/pkg/middleware"
+	"ubuntu-auto-update/backend/pkg/models"
 	"ubuntu-auto-update/backend/pkg/session"
+	"ubuntu-auto-update/backend/pkg/updater"
 )
 
 func TestHandleListHosts(t *testing.T) {
@@ -23,10 +28,10 @@ func TestHandleListHosts(t *testing.T) {
 	defer mock.Close()
 
 	now := time.Now()
-	rows := mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "offline_since"}).
-		AddRow(int32(1), "test-host", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", nil)
+	rows := mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "architecture", "offline_since", "update_output_truncated", "upgrade_output_truncated", "update_policy", "deleted_at", "environment"}).
+		AddRow(int32(1), "test-host", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, "")
 
-	mock.ExpectQuery(`SELECT (.+) FROM hosts ORDER BY hostname`).
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE deleted_at IS NULL ORDER BY hostname`).
 		WillReturnRows(rows)
 
 	req := httptest.NewRequest(http.MethodGet, "/api/v1/hosts", nil)
@@ -38,7 +43,7 @@ func TestHandleListHosts(t *testing.T) {
 	}
 
 	// DB error
-	mock.ExpectQuery(`SELECT (.+) FROM hosts ORDER BY hostname`).
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE deleted_at IS NULL ORDER BY hostname`).
 		WillReturnError(sql.ErrConnDone)
 
 	rr = httptest.NewRecorder()
@@ -54,8 +59,8 @@ func TestHandleGetHost(t *testing.T) {
 	defer mock.Close()
 
 	now := time.Now()
-	rows := mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "offline_since"}).
-		AddRow(int32(1), "test-host", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", nil)
+	rows := mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "architecture", "offline_since", "update_output_truncated", "upgrade_output_truncated", "update_policy", "deleted_at", "environment"}).
+		AddRow(int32(1), "test-host", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, "")
 
 	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).
 		WithArgs(int32(1)).
@@ -117,8 +122,8 @@ func TestHandleCreateHost_NoEnroll(t *testing.T) {
 	})
 
 	now := time.Now()
-	rows := mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "offline_since"}).
-		AddRow(int32(1), "new-host", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", nil)
+	rows := mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "architecture", "offline_since", "update_output_truncated", "upgrade_output_truncated", "update_policy", "deleted_at", "environment"}).
+		AddRow(int32(1), "new-host", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, "")
 
 	mock.ExpectQuery(`INSERT INTO hosts`).
 		WithArgs("new-host", "root").
@@ -173,8 +178,8 @@ func TestHandleUpdateHost(t *testing.T) {
 	})
 
 	now := time.Now()
-	rows := mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "offline_since"}).
-		AddRow(int32(1), "test-host", "ubuntu", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", nil)
+	rows := mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "architecture", "offline_since", "update_output_truncated", "upgrade_output_truncated", "update_policy", "deleted_at", "environment"}).
+		AddRow(int32(1), "test-host", "ubuntu", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, "")
 
 	mock.ExpectQuery(`UPDATE hosts SET ssh_user = \$2 WHERE id = \$1`).
 		WithArgs(int32(1), "ubuntu").
@@ -253,20 +258,52 @@ func TestHandleUpdateHost(t *testing.T) {
 	}
 }
 
-func TestHandleDeleteHost(t *testing.T) {
+func TestHandleUpdateHost_UpdatePolicy(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	now := time.Now()
+	mock.ExpectQuery(`UPDATE hosts SET update_policy = \$2`).
+		WithArgs(int32(1), "security_only").
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "ubuntu", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "security_only", nil, ""))
+
+	req := httptest.NewRequest(http.MethodPatch, "/api/v1/hosts/1", strings.NewReader(`{"update_policy":"security_only"}`))
+	req = mux.SetURLVars(req, map[string]string{"id": "1"})
+	rr := httptest.NewRecorder()
+	app.handleUpdateHost(rr, req)
+
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"update_policy":"security_only"`) {
+		t.Errorf("got %d %s", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPatch, "/api/v1/hosts/1", strings.NewReader(`{"update_policy":"kernel_only"}`))
+	req = mux.SetURLVars(req, map[string]string{"id": "1"})
+	rr = httptest.NewRecorder()
+	app.handleUpdateHost(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown policy: expected 400, got %d", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestHandleDeleteHost_Purge(t *testing.T) {
 	app, mock := testAppWithDB(t)
 	defer mock.Close()
 
 	now := time.Now()
 	// Success path
-	rows := mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "offline_since"}).
-		AddRow(int32(1), "test-host", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", nil)
+	rows := mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "architecture", "offline_since", "update_output_truncated", "upgrade_output_truncated", "update_policy", "deleted_at", "environment"}).
+		AddRow(int32(1), "test-host", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, "")
 	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).WillReturnRows(rows)
 
 	mock.ExpectExec(`DELETE FROM hosts WHERE id = \$1`).WithArgs(int32(1)).WillReturnResult(pgxmock.NewResult("DELETE", 1))
 	mock.ExpectExec(`INSERT INTO audit_log`).WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).WillReturnResult(pgxmock.NewResult("INSERT", 1))
 
-	req := httptest.NewRequest(http.MethodDelete, "/api/v1/hosts/1", nil)
+	req := httptest.NewRequest(http.MethodDelete, "/api/v1/hosts/1?purge=true", nil)
 	req = mux.SetURLVars(req, map[string]string{"id": "1"})
 	req.Header.Set("X-Confirm-Hostname", "test-host")
 	req = req.WithContext(context.WithValue(req.Context(), middleware.PrincipalContextKey, &session.Principal{Username: "admin", UserID: 1}))
@@ -278,8 +315,8 @@ func TestHandleDeleteHost(t *testing.T) {
 	}
 
 	// Mismatched hostname
-	rows2 := mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "offline_since"}).
-		AddRow(int32(2), "test-host-2", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", nil)
+	rows2 := mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "architecture", "offline_since", "update_output_truncated", "upgrade_output_truncated", "update_policy", "deleted_at", "environment"}).
+		AddRow(int32(2), "test-host-2", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, "")
 	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(2)).WillReturnRows(rows2)
 
 	req = httptest.NewRequest(http.MethodDelete, "/api/v1/hosts/2", nil)
@@ -305,13 +342,13 @@ func TestHandleDeleteHost(t *testing.T) {
 	}
 
 	// DB Error on DeleteHost
-	rows4 := mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "offline_since"}).
-		AddRow(int32(4), "test-host-4", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", nil)
+	rows4 := mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "architecture", "offline_since", "update_output_truncated", "upgrade_output_truncated", "update_policy", "deleted_at", "environment"}).
+		AddRow(int32(4), "test-host-4", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, "")
 	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(4)).WillReturnRows(rows4)
 
 	mock.ExpectExec(`DELETE FROM hosts WHERE id = \$1`).WithArgs(int32(4)).WillReturnError(sql.ErrConnDone)
 
-	req = httptest.NewRequest(http.MethodDelete, "/api/v1/hosts/4", nil)
+	req = httptest.NewRequest(http.MethodDelete, "/api/v1/hosts/4?purge=true", nil)
 	req = mux.SetURLVars(req, map[string]string{"id": "4"})
 	req.Header.Set("X-Confirm-Hostname", "test-host-4")
 	req = req.WithContext(context.WithValue(req.Context(), middleware.PrincipalContextKey, &session.Principal{Username: "admin", UserID: 1}))
@@ -323,13 +360,13 @@ func TestHandleDeleteHost(t *testing.T) {
 	}
 
 	// 0 rows deleted
-	rows5 := mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "offline_since"}).
-		AddRow(int32(5), "test-host-5", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", nil)
+	rows5 := mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "architecture", "offline_since", "update_output_truncated", "upgrade_output_truncated", "update_policy", "deleted_at", "environment"}).
+		AddRow(int32(5), "test-host-5", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, "")
 	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(5)).WillReturnRows(rows5)
 
 	mock.ExpectExec(`DELETE FROM hosts WHERE id = \$1`).WithArgs(int32(5)).WillReturnResult(pgxmock.NewResult("DELETE", 0))
 
-	req = httptest.NewRequest(http.MethodDelete, "/api/v1/hosts/5", nil)
+	req = httptest.NewRequest(http.MethodDelete, "/api/v1/hosts/5?purge=true", nil)
 	req = mux.SetURLVars(req, map[string]string{"id": "5"})
 	req.Header.Set("X-Confirm-Hostname", "test-host-5")
 	req = req.WithContext(context.WithValue(req.Context(), middleware.PrincipalContextKey, &session.Principal{Username: "admin", UserID: 1}))
@@ -353,6 +390,106 @@ func TestHandleDeleteHost(t *testing.T) {
 	}
 }
 
+// Without ?purge=true a delete archives: the row is stamped, not removed.
+func TestHandleDeleteHost_Archives(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	now := time.Now()
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+	mock.ExpectQuery(`UPDATE hosts SET deleted_at = COALESCE\(deleted_at, NOW\(\)\)`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", &now, ""))
+	expectAudit(mock)
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/v1/hosts/1", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "1"})
+	req.Header.Set("X-Confirm-Hostname", "web-1")
+	rr := httptest.NewRecorder()
+	app.handleDeleteHost(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// Archived hosts drop out of the list unless include_deleted is set, and
+// GetHost still returns them with deleted_at filled in.
+func TestHandleListHosts_IncludeDeleted(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	now := time.Now()
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE deleted_at IS NULL ORDER BY hostname`).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+	rr := httptest.NewRecorder()
+	app.handleListHosts(rr, httptest.NewRequest(http.MethodGet, "/api/v1/hosts", nil))
+	if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), "deleted_at") {
+		t.Errorf("default list: %d %s", rr.Code, rr.Body.String())
+	}
+
+	mock.ExpectQuery(`SELECT (.+) FROM hosts ORDER BY hostname`).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, "").
+			AddRow(int32(2), "web-2", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", &now, ""))
+	rr = httptest.NewRecorder()
+	app.handleListHosts(rr, httptest.NewRequest(http.MethodGet, "/api/v1/hosts?include_deleted=true", nil))
+	var hosts []map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &hosts); err != nil {
+		t.Fatalf("decode: %v (%s)", err, rr.Body.String())
+	}
+	if len(hosts) != 2 || hosts[0]["deleted_at"] != nil || hosts[1]["deleted_at"] == nil {
+		t.Errorf("include_deleted list: %s", rr.Body.String())
+	}
+
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(2)).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(2), "web-2", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", &now, ""))
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/hosts/2", nil), map[string]string{"id": "2"})
+	rr = httptest.NewRecorder()
+	app.handleGetHost(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"deleted_at"`) {
+		t.Errorf("GetHost on an archived host: %d %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestHandleRestoreHost(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	now := time.Now()
+	mock.ExpectQuery(`UPDATE hosts SET deleted_at = NULL`).WithArgs(int32(2)).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(2), "web-2", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+	expectAudit(mock)
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/api/v1/hosts/2/restore", nil), map[string]string{"id": "2"})
+	rr := httptest.NewRecorder()
+	app.handleRestoreHost(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"hostname":"web-2"`) || strings.Contains(rr.Body.String(), "deleted_at") {
+		t.Errorf("restore: %d %s", rr.Code, rr.Body.String())
+	}
+
+	mock.ExpectQuery(`UPDATE hosts SET deleted_at = NULL`).WithArgs(int32(9)).WillReturnError(pgx.ErrNoRows)
+	req = mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/api/v1/hosts/9/restore", nil), map[string]string{"id": "9"})
+	rr = httptest.NewRecorder()
+	app.handleRestoreHost(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("restore of a missing host: got %d, want 404", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
 func TestHandleReport_Success(t *testing.T) {
 	app, mock := testAppWithDB(t)
 	defer mock.Close()
@@ -371,15 +508,16 @@ func TestHandleReport_Success(t *testing.T) {
 		"system_info": map[string]interface{}{
 			"os_version":     "Ubuntu 24.04",
 			"kernel_version": "6.8.0",
+			"architecture":   "x86_64",
 		},
 	})
 
 	now := time.Now()
-	rows := mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "offline_since"}).
-		AddRow(int32(1), "test-host", "root", now, now, now, "update", "", nil, []string{}, true, 4, 7, "Ubuntu 24.04", "6.8.0", "1.2.3", nil)
+	rows := mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "architecture", "offline_since", "update_output_truncated", "upgrade_output_truncated", "update_policy", "deleted_at", "environment"}).
+		AddRow(int32(1), "test-host", "root", now, now, now, "update", "", nil, []string{}, true, 4, 7, "Ubuntu 24.04", "6.8.0", "1.2.3", "", nil, false, false, "all", nil, "")
 
 	mock.ExpectQuery(`INSERT INTO hosts`).
-		WithArgs("test-host", "root", "update", "", sql.NullString{}, true, 4, 7, "Ubuntu 24.04", "6.8.0", "1.2.3").
+		WithArgs("test-host", "root", []byte("update"), []byte(""), sql.NullString{}, true, 4, 7, "Ubuntu 24.04", "6.8.0", "1.2.3", "x86_64", false, false, nil).
 		WillReturnRows(rows)
 
 	req := httptest.NewRequest(http.MethodPost, "/api/v1/report", bytes.NewReader(body))
@@ -389,6 +527,94 @@ func TestHandleReport_Success(t *testing.T) {
 	if rr.Code != http.StatusAccepted {
 		t.Errorf("expected 202, got %d", rr.Code)
 	}
+
+	// The persisted system info round-trips through GET /hosts/{id}.
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).
+		WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "architecture", "offline_since", "update_output_truncated", "upgrade_output_truncated", "update_policy", "deleted_at", "environment"}).
+			AddRow(int32(1), "test-host", "root", now, now, now, "update", "", nil, []string{}, true, 4, 7, "Ubuntu 24.04", "6.8.0", "1.2.3", "x86_64", nil, false, false, "all", nil, ""))
+	req = mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/hosts/1", nil), map[string]string{"id": "1"})
+	rr = httptest.NewRecorder()
+	app.handleGetHost(rr, req)
+	var got map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{"os_version": "Ubuntu 24.04", "kernel_version": "6.8.0", "agent_version": "1.2.3", "architecture": "x86_64"} {
+		if got[k] != want {
+			t.Errorf("%s = %v, want %q", k, got[k], want)
+		}
+	}
+}
+
+func TestHandleReport_RebootRequiredEvent(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	now := time.Now()
+
+	for _, updated := range []int{3, 0} {
+		body, _ := json.Marshal(map[string]interface{}{
+			"hostname":       "test-host",
+			"update_results": map[string]interface{}{"reboot_required": true, "packages_updated": updated},
+		})
+		mock.ExpectQuery(`INSERT INTO hosts`).
+			WithArgs("test-host", "root", []byte(""), []byte(""), sql.NullString{}, true, updated, 0, "", "", "", "", false, false, nil).
+			WillReturnRows(mock.NewRows(hostCols).
+				AddRow(int32(1), "test-host", "root", now.Add(-time.Hour), now, now, "", "", nil, []string{}, true, updated, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+		// Only the report whose upgrade caused the reboot announces it.
+		if updated > 0 {
+			expectWebhookLookup(mock, "reboot_required", 1)
+		}
+
+		rr := httptest.NewRecorder()
+		app.handleReport(rr, httptest.NewRequest(http.MethodPost, "/api/v1/report", bytes.NewReader(body)))
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("expected 202, got %d: %s", rr.Code, rr.Body.String())
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestHandleReport_ErrorOnlyKeepsOutput(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	// A failed agent run: an error and no apt output.
+	body, _ := json.Marshal(map[string]interface{}{
+		"hostname":       "test-host",
+		"update_results": map[string]interface{}{"error_message": "APT: lock held"},
+	})
+
+	now := time.Now()
+	mock.ExpectQuery(`INSERT INTO hosts .+ COALESCE\(NULLIF\(\$3, ''\), hosts\.update_output\)`).
+		WithArgs("test-host", "root", []byte(""), []byte(""), sql.NullString{String: "APT: lock held", Valid: true}, false, 0, 0, "", "", "", "", false, false, nil).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "test-host", "root", now.Add(-time.Hour), now, now, "last good output", "", "APT: lock held", []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+
+	rr := httptest.NewRecorder()
+	app.handleReport(rr, httptest.NewRequest(http.MethodPost, "/api/v1/report", bytes.NewReader(body)))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).
+		WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "test-host", "root", now.Add(-time.Hour), now, now, "last good output", "", "APT: lock held", []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+	rr = httptest.NewRecorder()
+	app.handleGetHost(rr, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/hosts/1", nil), map[string]string{"id": "1"}))
+	var got map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["update_output"] != "last good output" || got["error"] != "APT: lock held" {
+		t.Errorf("update_output = %v, error = %v", got["update_output"], got["error"])
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
 }
 
 func TestHandleReport_DBError(t *testing.T) {
@@ -403,7 +629,7 @@ func TestHandleReport_DBError(t *testing.T) {
 	})
 
 	mock.ExpectQuery(`INSERT INTO hosts`).
-		WithArgs("test-host", "root", "update", "", sql.NullString{}, false, 0, 0, "", "", "").
+		WithArgs("test-host", "root", []byte("update"), []byte(""), sql.NullString{}, false, 0, 0, "", "", "", "", false, false, nil).
 		WillReturnError(sql.ErrConnDone)
 
 	req := httptest.NewRequest(http.MethodPost, "/api/v1/report", bytes.NewReader(body))
@@ -414,3 +640,389 @@ func TestHandleReport_DBError(t *testing.T) {
 		t.Errorf("expected 500, got %d", rr.Code)
 	}
 }
+
+// Every invalid field of a report or enroll comes back in one 400, listed in
+// details.fields.
+func TestValidation_ReportsAllFieldErrors(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	fields := func(rr *httptest.ResponseRecorder) []middleware.FieldError {
+		t.Helper()
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var resp struct {
+			Message string
+			Details struct{ Fields []middleware.FieldError }
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(resp.Message, "Invalid request: ") {
+			t.Errorf("message = %q", resp.Message)
+		}
+		return resp.Details.Fields
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"hostname":       "  ",
+		"update_results": map[string]interface{}{"packages_available": -1},
+		"system_info":    map[string]interface{}{"os_version": "Ubuntu 22.04\nLTS", "kernel_version": strings.Repeat("5", 256)},
+	})
+	rr := httptest.NewRecorder()
+	app.handleReport(rr, httptest.NewRequest(http.MethodPost, "/api/v1/report", bytes.NewReader(body)))
+	want := []middleware.FieldError{
+		{Field: "hostname", Message: "cannot be empty"},
+		{Field: "update_results.packages_available", Message: "must be between 0 and 2147483647"},
+		{Field: "system_info.os_version", Message: "cannot contain control characters"},
+		{Field: "system_info.kernel_version", Message: "cannot exceed 255 characters"},
+	}
+	if got := fields(rr); !reflect.DeepEqual(got, want) {
+		t.Errorf("report fields = %+v\nwant %+v", got, want)
+	}
+
+	body, _ = json.Marshal(map[string]string{"hostname": "web 1"})
+	rr = httptest.NewRecorder()
+	app.handleEnroll(rr, httptest.NewRequest(http.MethodPost, "/api/v1/enroll", bytes.NewReader(body)))
+	want = []middleware.FieldError{
+		{Field: "hostname", Message: "must be a valid RFC 1123 hostname or IP address"},
+	}
+	if got := fields(rr); !reflect.DeepEqual(got, want) {
+		t.Errorf("enroll fields = %+v\nwant %+v", got, want)
+	}
+
+	// A missing token is still a 401, not a field error.
+	body, _ = json.Marshal(map[string]string{"hostname": "web-1"})
+	rr = httptest.NewRecorder()
+	app.handleEnroll(rr, httptest.NewRequest(http.MethodPost, "/api/v1/enroll", bytes.NewReader(body)))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("enroll without token: expected 401, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// A report that breaks the schema is refused before it is decoded, naming
+// the field, rather than half-decoding into zero values. In a batch it is
+// listed with the error like any other invalid report.
+func TestHandleReport_SchemaViolations(t *testing.T) {
+	app := testApp(t)
+
+	for _, tt := range []struct {
+		body string
+		want []middleware.FieldError
+	}{
+		{`{"hostname": "web-1", "update_results": {"packages_updated": "3"}}`,
+			[]middleware.FieldError{{Field: "update_results.packages_updated", Message: "must be an integer"}}},
+		{`{"agent_version": "1.4.0", "update_results": {"success": true}}`,
+			[]middleware.FieldError{{Field: "hostname", Message: "is required"}}},
+	} {
+		rr := httptest.NewRecorder()
+		app.handleReport(rr, httptest.NewRequest(http.MethodPost, "/api/v1/report", strings.NewReader(tt.body)))
+		var resp struct {
+			Details struct{ Fields []middleware.FieldError }
+		}
+		_ = json.Unmarshal(rr.Body.Bytes(), &resp)
+		if rr.Code != http.StatusBadRequest || !reflect.DeepEqual(resp.Details.Fields, tt.want) {
+			t.Errorf("%s: got %d %s", tt.body, rr.Code, rr.Body.String())
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	app.handleReport(rr, httptest.NewRequest(http.MethodPost, "/api/v1/report", strings.NewReader(`{"schema_version": 9, "hostname": "web-1"}`)))
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "schema_version 9") {
+		t.Errorf("unknown schema_version: got %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	app.handleReportBatch(rr, httptest.NewRequest(http.MethodPost, "/api/v1/report/batch",
+		strings.NewReader(`[{"hostname": "web-1", "system_info": {"os_version": 24.04}}]`)))
+	want := `"results":[{"hostname":"web-1","ok":false,"error":"system_info.os_version: must be a string"}]`
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), want) {
+		t.Errorf("batch: got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestHostnameValidation_RejectsMalformed(t *testing.T) {
+	app := testApp(t)
+	t.Setenv("ENROLLMENT_TOKEN", "test-enroll-token")
+
+	for _, bad := range []string{"web 1", "web;reboot", "-oProxyCommand=x", strings.Repeat("a", 254)} {
+		body, _ := json.Marshal(map[string]string{"hostname": bad, "enrollment_token": "test-enroll-token"})
+
+		rr := httptest.NewRecorder()
+		app.handleReport(rr, httptest.NewRequest(http.MethodPost, "/api/v1/report", bytes.NewReader(body)))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("report %q: expected 400, got %d", bad, rr.Code)
+		}
+
+		rr = httptest.NewRecorder()
+		app.handleEnroll(rr, httptest.NewRequest(http.MethodPost, "/api/v1/enroll", bytes.NewReader(body)))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("enroll %q: expected 400, got %d", bad, rr.Code)
+		}
+
+		rr = httptest.NewRecorder()
+		app.handleCreateHost(rr, httptest.NewRequest(http.MethodPost, "/api/v1/hosts", bytes.NewReader(body)))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("create %q: expected 400, got %d", bad, rr.Code)
+		}
+	}
+}
+
+func TestRecordUpdateOutput_SplitsColumns(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	now := time.Now()
+	runOutput := "== ubuntu-auto-update: update ==\nHit:1 http://archive.ubuntu.com jammy InRelease\n" +
+		updater.UpgradeMarker + "\nThe following packages will be upgraded:\n  curl\n1 upgraded\n"
+	mock.ExpectQuery(`SELECT .+ FROM update_runs WHERE id = \$1`).
+		WithArgs(int32(9)).
+		WillReturnRows(mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id", "kept_back"}).
+			AddRow(int32(9), int32(1), nil, "admin", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, runOutput, nil, nil, nil))
+	mock.ExpectQuery(`INSERT INTO hosts`).
+		WithArgs("web-1", "ubuntu",
+			[]byte("== ubuntu-auto-update: update ==\nHit:1 http://archive.ubuntu.com jammy InRelease\n"),
+			[]byte("The following packages will be upgraded:\n  curl\n1 upgraded\n"),
+			sql.NullString{}, true, 0, 0, "Ubuntu 22.04", "", "", "", false, false, now).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "ubuntu", now, now, now, "", "", nil, []string{}, true, 0, 0, "Ubuntu 22.04", "", "", "", nil, false, false, "all", nil, ""))
+
+	// Stale output from an earlier agent report must be replaced, not kept.
+	host := models.Host{ID: 1, Hostname: "web-1", SshUser: "ubuntu", UpdateOutput: "old", UpgradeOutput: "old",
+		RebootRequired: true, OsVersion: "Ubuntu 22.04", UpdatedAt: now}
+	app.recordUpdateOutput(context.Background(), host, 9)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// Packages the upgrade kept back are recorded on the run.
+func TestRecordUpdateOutput_KeptBack(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	now := time.Now()
+	upgradeOut := "The following packages have been kept back:\n  linux-generic linux-image-generic\n" +
+		"The following packages will be upgraded:\n  curl\n1 upgraded, 0 newly installed, 0 to remove and 2 not upgraded.\n"
+	mock.ExpectQuery(`SELECT .+ FROM update_runs WHERE id = \$1`).
+		WithArgs(int32(9)).
+		WillReturnRows(mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id", "kept_back"}).
+			AddRow(int32(9), int32(1), nil, "admin", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "hit\n"+updater.UpgradeMarker+"\n"+upgradeOut, nil, nil, nil))
+	mock.ExpectExec(`UPDATE update_runs SET kept_back = \$2 WHERE id = \$1`).
+		WithArgs(int32(9), []string{"linux-generic", "linux-image-generic"}).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectQuery(`INSERT INTO hosts`).
+		WithArgs("web-1", "ubuntu", []byte("hit\n"), []byte(upgradeOut),
+			sql.NullString{}, false, 0, 0, "", "", "", "", false, false, now).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "ubuntu", now, now, now, "hit\n", upgradeOut, nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+
+	host := models.Host{ID: 1, Hostname: "web-1", SshUser: "ubuntu", UpdatedAt: now}
+	app.recordUpdateOutput(context.Background(), host, 9)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestRecordUpdateOutput_ConcurrentReportNotLost(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	readAt := time.Now().Add(-5 * time.Minute)
+	reportedAt := time.Now()
+	mock.ExpectQuery(`SELECT .+ FROM update_runs WHERE id = \$1`).
+		WithArgs(int32(9)).
+		WillReturnRows(mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id", "kept_back"}).
+			AddRow(int32(9), int32(1), nil, "admin", models.RunKindUpdate, models.RunStatusRunning, nil, readAt, nil, "hit\n"+updater.UpgradeMarker+"\n1 upgraded\n", nil, nil, nil))
+
+	// First write: an agent report landed during the run, so updated_at no
+	// longer matches and the conflict WHERE rejects the update.
+	mock.ExpectQuery(`INSERT INTO hosts .+ WHERE \$15::timestamptz IS NULL OR hosts\.updated_at = \$15`).
+		WithArgs("web-1", "ubuntu", []byte("hit\n"), []byte("1 upgraded\n"), sql.NullString{}, false, 0, 0, "Ubuntu 22.04", "", "", "", false, false, readAt).
+		WillReturnRows(mock.NewRows(hostCols))
+	// Re-read picks up what the agent reported: a pending reboot and a new
+	// kernel.
+	mock.ExpectQuery(`SELECT .+ FROM hosts WHERE id = \$1`).
+		WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "ubuntu", readAt, reportedAt, reportedAt, "agent output", "", nil, []string{}, true, 3, 0, "Ubuntu 22.04", "6.8.0", "", "", nil, false, false, "all", nil, ""))
+	// Second write carries the agent's values, not the stale ones.
+	mock.ExpectQuery(`INSERT INTO hosts`).
+		WithArgs("web-1", "ubuntu", []byte("hit\n"), []byte("1 upgraded\n"), sql.NullString{}, true, 3, 0, "Ubuntu 22.04", "6.8.0", "", "", false, false, reportedAt).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "ubuntu", readAt, time.Now(), time.Now(), "hit\n", "1 upgraded\n", nil, []string{}, true, 3, 0, "Ubuntu 22.04", "6.8.0", "", "", nil, false, false, "all", nil, ""))
+
+	host := models.Host{ID: 1, Hostname: "web-1", SshUser: "ubuntu", OsVersion: "Ubuntu 22.04", UpdatedAt: readAt}
+	app.recordUpdateOutput(context.Background(), host, 9)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestHandlerErrors_StructuredJSON(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	cases := []struct {
+		name    string
+		handler http.HandlerFunc
+		req     *http.Request
+		code    int
+		errCode string
+		message string
+	}{
+		{"report bad body", app.handleReport,
+			httptest.NewRequest(http.MethodPost, "/api/v1/report", strings.NewReader("{")),
+			http.StatusBadRequest, "bad_request", "Invalid request body"},
+		{"get host bad id", app.handleGetHost,
+			mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/hosts/x", nil), map[string]string{"id": "x"}),
+			http.StatusBadRequest, "bad_request", "Invalid host ID"},
+		{"ssh key bad id", app.handleAddSSHKey,
+			mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/api/v1/hosts/x/ssh-key", nil), map[string]string{"id": "x"}),
+			http.StatusBadRequest, "bad_request", "Invalid host ID"},
+	}
+	for _, c := range cases {
+		rr := httptest.NewRecorder()
+		c.handler(rr, c.req)
+		if rr.Code != c.code {
+			t.Errorf("%s: status %d, want %d", c.name, rr.Code, c.code)
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: Content-Type %q", c.name, ct)
+		}
+		var body middleware.ErrorResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: body is not JSON: %v: %s", c.name, err, rr.Body.String())
+		}
+		if body.Error != c.errCode || body.Message != c.message || body.StatusCode != c.code || body.Timestamp == "" {
+			t.Errorf("%s: got %+v", c.name, body)
+		}
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	for status, want := range map[int]string{
+		http.StatusNotFound:              "not_found",
+		http.StatusRequestEntityTooLarge: "request_entity_too_large",
+		http.StatusBadGateway:            "bad_gateway",
+		http.StatusMultiStatus:           "multi_status",
+		599:                              "error",
+	} {
+		if got := errorCode(status); got != want {
+			t.Errorf("errorCode(%d) = %q, want %q", status, got, want)
+		}
+	}
+}
+
+func TestDecodeJSON_UnknownFieldRejected(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/hosts",
+		strings.NewReader(`{"hostname":"web-1","ssh_usr":"ubuntu"}`))
+	rr := httptest.NewRecorder()
+	app.handleCreateHost(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var body middleware.ErrorResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Message != `Unknown field "ssh_usr"` {
+		t.Errorf("message = %q", body.Message)
+	}
+	// Nothing reached the database.
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// A batch with an invalid report and one the database rejects still
+// commits the rest, and says which hosts failed.
+func TestHandleReportBatch_MixedValidity(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	now := time.Now()
+
+	body, _ := json.Marshal([]map[string]interface{}{
+		{"hostname": "web-1", "update_results": map[string]interface{}{"apt_output": "ok"}},
+		{"hostname": "bad host!"},
+		{"hostname": "web-2"},
+		{"hostname": " web-3 ", "system_info": map[string]interface{}{"os_version": "Ubuntu 24.04"}},
+	})
+
+	mock.ExpectBegin()
+	mock.ExpectBegin() // savepoint per report
+	mock.ExpectQuery(`INSERT INTO hosts`).
+		WithArgs("web-1", "root", []byte("ok"), []byte(""), sql.NullString{}, false, 0, 0, "", "", "", "", false, false, nil).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "root", now.Add(-time.Hour), now, now, "ok", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO hosts`).
+		WithArgs("web-2", "root", []byte(""), []byte(""), sql.NullString{}, false, 0, 0, "", "", "", "", false, false, nil).
+		WillReturnError(errors.New("deadlock detected"))
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO hosts`).
+		WithArgs("web-3", "root", []byte(""), []byte(""), sql.NullString{}, false, 0, 0, "Ubuntu 24.04", "", "", "", false, false, nil).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(3), "web-3", "root", now.Add(-time.Hour), now, now, "", "", nil, []string{}, false, 0, 0, "Ubuntu 24.04", "", "", "", nil, false, false, "all", nil, ""))
+	mock.ExpectCommit()
+	mock.ExpectCommit()
+
+	rr := httptest.NewRecorder()
+	app.handleReportBatch(rr, httptest.NewRequest(http.MethodPost, "/api/v1/report/batch", bytes.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var resp struct {
+		Accepted int                 `json:"accepted"`
+		Failed   int                 `json:"failed"`
+		Results  []reportBatchResult `json:"results"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := []reportBatchResult{
+		{Hostname: "web-1", OK: true, HostID: 1},
+		{Hostname: "bad host!", Error: resp.Results[1].Error},
+		{Hostname: "web-2", Error: "Failed to process report"},
+		{Hostname: "web-3", OK: true, HostID: 3},
+	}
+	if resp.Accepted != 2 || resp.Failed != 2 || !reflect.DeepEqual(resp.Results, want) {
+		t.Errorf("got %+v", resp)
+	}
+	if resp.Results[1].Error == "" {
+		t.Error("invalid hostname has no error")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestHandleReportBatch_Rejects(t *testing.T) {
+	app := testApp(t)
+	tooMany, _ := json.Marshal(make([]map[string]string, maxReportBatch+1))
+	for name, body := range map[string]string{
+		"empty":     `[]`,
+		"not array": `{"hostname":"web-1"}`,
+		"too many":  string(tooMany),
+	} {
+		rr := httptest.NewRecorder()
+		app.handleReportBatch(rr, httptest.NewRequest(http.MethodPost, "/api/v1/report/batch", strings.NewReader(body)))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", name, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"ubuntu-auto-update/backend/pkg/config"
+)
+
+// configureLogging applies cfg to logger. An unknown format falls back to
+// text and an unknown level to info, each with a warning, rather than
+// refusing to start over a logging typo. The same goes for a log file that
+// can't be opened, or whose directory can't be created: logging stays on
+// stderr.
+//
+// The returned func closes the log file, if any.
+func configureLogging(logger *log.Logger, cfg config.LoggingConfig) func() {
+	var warnings []string
+	switch cfg.Format {
+	case "json":
+		logger.SetFormatter(&log.JSONFormatter{})
+	case "text":
+		logger.SetFormatter(&log.TextFormatter{})
+	default:
+		logger.SetFormatter(&log.TextFormatter{})
+		warnings = append(warnings, fmt.Sprintf("LOG_FORMAT=%q is not text or json; using text", cfg.Format))
+	}
+
+	level, err := log.ParseLevel(cfg.Level)
+	if err != nil {
+		level = log.InfoLevel
+		warnings = append(warnings, fmt.Sprintf("LOG_LEVEL=%q is not a valid level; using info", cfg.Level))
+	}
+	logger.SetLevel(level)
+
+	closeFn := func() {}
+	if cfg.OutputPath != "" {
+		// lumberjack opens the file on the first write and logrus only
+		// complains to stderr when that fails, so open it once here to find
+		// out now.
+		err := os.MkdirAll(filepath.Dir(cfg.OutputPath), 0o755)
+		if err == nil {
+			var f *os.File
+			if f, err = os.OpenFile(cfg.OutputPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600); err == nil {
+				err = f.Close()
+			}
+		}
+		if err != nil {
+			warnings = append(warnings, "LOG_FILE: "+err.Error()+"; logging to stderr only")
+		} else {
+			file := &lumberjack.Logger{
+				Filename:   cfg.OutputPath,
+				MaxSize:    cfg.MaxSize,
+				MaxAge:     cfg.MaxAge,
+				MaxBackups: cfg.MaxBackups,
+				Compress:   cfg.Compress,
+			}
+			var out io.Writer = file
+			if cfg.TeeStderr {
+				out = io.MultiWriter(os.Stderr, file)
+			}
+			logger.SetOutput(out)
+			closeFn = func() {
+				if err := file.Close(); err != nil {
+					fmt.Fprintf(os.Stderr, "close log file: %v\n", err)
+				}
+			}
+		}
+	}
+
+	// Warn only once the logger is fully set up, so the warnings come out
+	// the way (and where) the rest of the log will.
+	for _, w := range warnings {
+		logger.Warn(w)
+	}
+	return closeFn
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+
+	"ubuntu-auto-update/backend/pkg/config"
+)
+
+func TestConfigureLogging(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "Debug")
+	t.Setenv("LOG_FORMAT", "json")
+	logger := log.New()
+	configureLogging(logger, config.LoadLoggingConfig())
+
+	if _, ok := logger.Formatter.(*log.JSONFormatter); !ok {
+		t.Errorf("formatter = %T, want *logrus.JSONFormatter", logger.Formatter)
+	}
+	if logger.GetLevel() != log.DebugLevel {
+		t.Errorf("level = %s, want debug", logger.GetLevel())
+	}
+
+	var buf bytes.Buffer
+	logger.SetOutput(&buf)
+	logger.Debug("hello")
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil || entry["msg"] != "hello" {
+		t.Errorf("expected a JSON line, got %q (%v)", buf.String(), err)
+	}
+}
+
+func TestConfigureLogging_Defaults(t *testing.T) {
+	t.Setenv("LOG_LEVEL", "")
+	t.Setenv("LOG_FORMAT", "")
+	t.Setenv("LOG_FILE", "")
+	logger := log.New()
+	logger.SetLevel(log.TraceLevel)
+	configureLogging(logger, config.LoadLoggingConfig())
+
+	if _, ok := logger.Formatter.(*log.TextFormatter); !ok {
+		t.Errorf("formatter = %T, want *logrus.TextFormatter", logger.Formatter)
+	}
+	if logger.GetLevel() != log.InfoLevel {
+		t.Errorf("level = %s, want info", logger.GetLevel())
+	}
+}
+
+func TestConfigureLogging_InvalidFallsBack(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&buf)
+	configureLogging(logger, config.LoggingConfig{Level: "verbose", Format: "xml"})
+
+	if _, ok := logger.Formatter.(*log.TextFormatter); !ok {
+		t.Errorf("formatter = %T, want *logrus.TextFormatter", logger.Formatter)
+	}
+	if logger.GetLevel() != log.InfoLevel {
+		t.Errorf("level = %s, want info", logger.GetLevel())
+	}
+	out := buf.String()
+	if !strings.Contains(out, "LOG_LEVEL") || !strings.Contains(out, "LOG_FORMAT") {
+		t.Errorf("expected warnings for both settings, got %q", out)
+	}
+}
+
+// A LOG_FILE that can't be opened is reported at startup, and logging
+// stays where it was.
+func TestConfigureLogging_UnopenableFile(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&buf)
+	configureLogging(logger, config.LoggingConfig{Level: "info", Format: "text", OutputPath: t.TempDir()})
+
+	logger.Info("still here")
+	out := buf.String()
+	if !strings.Contains(out, "LOG_FILE") || !strings.Contains(out, "still here") {
+		t.Errorf("expected a LOG_FILE warning and logging to continue, got %q", out)
+	}
+}
+
+// A relative LOG_FILE lands under DATA_DIR, not the working directory.
+func TestConfigureLogging_RelativeFileUnderDataDir(t *testing.T) {
+	dataDir := filepath.Join(t.TempDir(), "data")
+	t.Setenv("DATA_DIR", dataDir)
+	t.Setenv("LOG_FILE", filepath.Join("logs", "api.log"))
+	t.Setenv("ENVIRONMENT", "production")
+	t.Chdir(t.TempDir())
+
+	if _, err := config.EnsureDataDir(); err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New()
+	closeLog := configureLogging(logger, config.LoadLoggingConfig())
+	logger.Info("hello")
+	closeLog()
+
+	info, err := os.Stat(dataDir)
+	if err != nil || info.Mode().Perm() != 0o700 {
+		t.Errorf("data dir: %v, %v; want a 0700 directory", info, err)
+	}
+	b, err := os.ReadFile(filepath.Join(dataDir, "logs", "api.log"))
+	if err != nil || !strings.Contains(string(b), "hello") {
+		t.Errorf("log under DATA_DIR: %q, %v", b, err)
+	}
+	if _, err := os.Stat("logs"); !os.IsNotExist(err) {
+		t.Errorf("logs created in the working directory (stat: %v)", err)
+	}
+}
+
+func TestConfigureLogging_FileRotates(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "nested", "logs") // created on demand
+	t.Setenv("LOG_FILE", filepath.Join(dir, "api.log"))
+	t.Setenv("LOG_MAX_SIZE_MB", "1")
+	t.Setenv("ENVIRONMENT", "production") // no stderr tee
+	logger := log.New()
+	closeLog := configureLogging(logger, config.LoadLoggingConfig())
+	defer closeLog()
+
+	line := strings.Repeat("x", 1023)
+	for i := 0; i < 1200; i++ { // ~1.2 MiB, past the 1 MB limit
+		logger.Info(line)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var current, backups int
+	for _, e := range entries {
+		switch {
+		case e.Name() == "api.log":
+			current++
+		case strings.HasPrefix(e.Name(), "api-") && strings.HasSuffix(e.Name(), ".log"):
+			backups++
+		}
+	}
+	if current != 1 || backups != 1 {
+		t.Errorf("want api.log plus one rotated backup, got %v", entries)
+	}
+}
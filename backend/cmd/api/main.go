@@ -9,6 +9,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -19,8 +21,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
@@ -30,23 +35,30 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
-	"ubuntu-auto-update/backend/pkg/apitokens"
 	"ubuntu-auto-update/backend/pkg/audit"
 	"ubuntu-auto-update/backend/pkg/config"
+	"ubuntu-auto-update/backend/pkg/crypto"
 	"ubuntu-auto-update/backend/pkg/db"
+	"ubuntu-auto-update/backend/pkg/email"
+	"ubuntu-auto-update/backend/pkg/enrollment"
 	"ubuntu-auto-update/backend/pkg/events"
+	"ubuntu-auto-update/backend/pkg/maintenance"
 	"ubuntu-auto-update/backend/pkg/middleware"
 	"ubuntu-auto-update/backend/pkg/models"
+	"ubuntu-auto-update/backend/pkg/reportschema"
 	"ubuntu-auto-update/backend/pkg/scheduler"
 	"ubuntu-auto-update/backend/pkg/session"
 	sshpkg "ubuntu-auto-update/backend/pkg/ssh"
+	"ubuntu-auto-update/backend/pkg/store"
 	"ubuntu-auto-update/backend/pkg/updater"
 	"ubuntu-auto-update/backend/pkg/users"
 	"ubuntu-auto-update/backend/pkg/webhook"
 )
 
-// maxRequestBodySize limits POST request bodies to 1MB.
-const maxRequestBodySize = 1 << 20
+// maxRequestBodySize limits request bodies; MAX_REQUEST_BODY_BYTES overrides
+// the 1MB default. Both the router-wide middleware and the per-handler
+// MaxBytesReader wraps use it.
+var maxRequestBodySize int64 = 1 << 20
 
 type Application struct {
 	DB            db.DBTX
@@ -56,31 +68,150 @@ type Application struct {
 	CORS          *middleware.CORSConfig
 	IPAllowlist   *middleware.IPAllowlist
 	LoginLimiter  *middleware.LoginRateLimiter
+	Passwords     users.PasswordPolicy // rules for passwords set through the API
 	SSHDialer     *sshpkg.Dialer
+	SSHLimit      *sshpkg.Limiter // nil = unlimited (tests)
 	WebhookSender *webhook.Dispatcher
+	Mailer        *email.Notifier // nil unless EMAIL_ENABLED
 	BulkUpdater   *updater.Coordinator
 	EventBroker   *events.Broker
+
+	// WSPingInterval paces keepalive pings on the SSH WebSockets; 0 means
+	// defaultWSPingInterval.
+	WSPingInterval time.Duration
+	// WSMaxMessageSize is the read limit upgradeWS puts on each socket; 0
+	// means defaultWSMaxMessageSize.
+	WSMaxMessageSize int64
+	// UpdateCommands builds run-update's shell line; nil means
+	// updater.DefaultCommands.
+	UpdateCommands *updater.CommandTemplate
+	// EnrollmentTokenTTL is the default lifetime of tokens minted through
+	// POST /enrollment-tokens; 0 means defaultEnrollmentTokenTTL.
+	EnrollmentTokenTTL time.Duration
+	// DefaultSSHUser is who run-update logs in as when a host has no
+	// ssh_user; "" refuses such runs.
+	DefaultSSHUser string
+	// HostOutputMaxBytes caps the apt output stored on each hosts row; 0
+	// means db.DefaultMaxHostOutputBytes.
+	HostOutputMaxBytes int
+	// HostOutputCompressBytes is the size from which that output is stored
+	// gzipped; 0 means db.DefaultHostOutputCompressBytes and a negative
+	// value stores everything raw.
+	HostOutputCompressBytes int
+	// OfflineAfter is how long a host may go without reporting before it is
+	// listed as offline; 0 means models.DefaultOfflineAfter. The offline
+	// sweep uses the same threshold.
+	OfflineAfter time.Duration
+	// RequireConfirmEnv lists the environments whose update runs must be
+	// confirmed; see requireEnvironmentConfirmation.
+	RequireConfirmEnv []string
+	// Scripts are the named scripts execute-script runs by ?script_name=,
+	// from EXECUTE_SCRIPTS_DIR. ScriptsOnly (EXECUTE_MODE=allowlist)
+	// refuses every other script, queued agent commands and update hooks.
+	Scripts     map[string]string
+	ScriptsOnly bool
+
+	// runs lists the single-host runs in flight for cancel-update.
+	runs activeRuns
+
+	// schemaReady latches once /health has seen every db.RequiredTables
+	// table, so later probes skip the information_schema lookup.
+	schemaReady atomic.Bool
+}
+
+// setHostStatus fills in host's derived online/offline Status before it is
+// returned.
+func (app *Application) setHostStatus(host *models.Host) {
+	after := app.OfflineAfter
+	if after <= 0 {
+		after = models.DefaultOfflineAfter
+	}
+	host.SetStatus(time.Now(), after)
 }
 
-// dispatchWebhooks resolves subscribers for an event and queues deliveries.
-// Returns immediately; deliveries run on the dispatcher's goroutines.
+// dispatchEvent notifies everyone listening for an event on hostID: webhook
+// subscribers whose host/tag filter matches it and, for the events it cares
+// about, email. Returns
+// immediately; deliveries run on the dispatcher's and mailer's goroutines.
 //
-// Bound the lookup with a short timeout so a stalled DB doesn't pin the
-// caller (especially when invoked from the streaming run path where the
-// websocket goroutine already has timing constraints).
-func (app *Application) dispatchWebhooks(event string, payload interface{}) {
+// The event is stored and queued for each subscriber before anything is
+// sent, so one a receiver misses is retried by the outbox worker and can be
+// replayed. Bound that write with a short timeout so a stalled DB doesn't
+// pin the caller (especially when invoked from the streaming run path where
+// the websocket goroutine already has timing constraints). Nothing at all is
+// sent for an event that wasn't stored, including a repeat EmitEvent
+// dropped, so another replica finishing the same run doesn't mail again.
+func (app *Application) dispatchEvent(event string, hostID int32, payload interface{}) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		log.Errorf("Failed to encode %s event: %v", event, err)
+		return
+	}
 	lookupCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	hooks, err := db.GetWebhooks(lookupCtx, app.DB, event)
+	eventID, hooks, err := db.EmitEvent(lookupCtx, app.DB, event, hostID, eventKey(event, hostID, payload), raw, webhook.OutboxRetryAfter)
 	if err != nil {
-		log.Errorf("Failed to get webhooks for event %s: %v", event, err)
+		log.Errorf("Failed to store %s event: %v", event, err)
 		return
 	}
+	if eventID == 0 {
+		return
+	}
+	if app.Mailer != nil {
+		app.Mailer.Notify(event, payload)
+	}
 	for _, h := range hooks {
 		// Per-delivery timeout lives inside the dispatcher's HTTP client; we
 		// pass Background here so a single slow delivery doesn't tip-over
 		// every other in-flight one.
-		app.WebhookSender.Deliver(context.Background(), h.URL, payload)
+		app.WebhookSender.DeliverEvent(context.Background(), h, eventID, payload)
+	}
+}
+
+// eventKey names one occurrence of a run event for webhook deduplication:
+// event, host and run. Other events carry no run to key on and are fired
+// once by whatever caused them (a sweep only reports hosts it just flagged),
+// so a repeat of those is a real repeat; they get "". db.EmitEvent stores
+// each key once, so a repeat from another replica queues nothing.
+func eventKey(event string, hostID int32, payload interface{}) string {
+	m, ok := payload.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	var runID int64
+	switch v := m["run_id"].(type) {
+	case int32:
+		runID = int64(v)
+	case int64:
+		runID = v
+	case int:
+		runID = int64(v)
+	case json.Number:
+		n, err := v.Int64()
+		if err != nil {
+			return ""
+		}
+		runID = n
+	default:
+		return ""
+	}
+	return fmt.Sprintf("%s:host=%d:run=%d", event, hostID, runID)
+}
+
+// sweepOfflineHosts flags hosts that stopped reporting and fires host_offline
+// for each one. SweepOfflineHosts only returns hosts whose offline_since was
+// just set, so a host that stays dark is announced once, not every tick.
+func (app *Application) sweepOfflineHosts(ctx context.Context, thresholdMinutes int) {
+	newlyOffline, err := db.SweepOfflineHosts(ctx, app.DB, thresholdMinutes)
+	if err != nil {
+		log.Errorf("offline sweep: %v", err)
+		return
+	}
+	for _, h := range newlyOffline {
+		log.Warnf("host %s offline (last seen %s)", h.Hostname, h.LastSeen)
+		app.dispatchEvent("host_offline", h.ID, map[string]interface{}{
+			"host_id": h.ID, "hostname": h.Hostname, "last_seen": h.LastSeen,
+		})
 	}
 }
 
@@ -129,27 +260,79 @@ func (h spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	http.FileServer(http.Dir(h.staticPath)).ServeHTTP(w, r)
 }
 
-func main() {
+// runServer runs the HTTP API: the default subcommand, and what the bare binary
+// has always done.
+func runServer() {
 	if err := config.Load(); err != nil {
 		log.Warnf("Config loading: %v (continuing with env vars)", err)
 	}
+	// Create DATA_DIR before logging, which may open a log file inside it.
+	dataDir, dataDirErr := config.EnsureDataDir()
+	logCfg := config.LoadLoggingConfig()
+	closeLog := configureLogging(log.StandardLogger(), logCfg)
+	defer closeLog()
+	if dataDirErr != nil {
+		log.Fatalf("Data directory %s: %v", dataDir, dataDirErr)
+	}
 
-	log.Info("Starting application...")
+	log.Infof("Starting application (data directory %s)...", dataDir)
 	ctx := context.Background()
 
-	dbPool, err := db.NewConnection(ctx)
+	// Every stored SSH key goes through pkg/crypto; refuse to start rather
+	// than discover a missing or short key on the first enrollment.
+	if err := crypto.Init(); err != nil {
+		log.Fatalf("Encryption key: %v", err)
+	}
+
+	dbPool, err := db.NewConnection(ctx, config.LoadDatabaseConfig())
 	if err != nil {
 		log.Fatalf("Could not connect to database: %v", err)
 	}
 	defer dbPool.Close()
+	pc := dbPool.Config()
+	log.Infof("Database pool: max_conns=%d min_conns=%d max_conn_lifetime=%s max_conn_idle_time=%s",
+		pc.MaxConns, pc.MinConns, pc.MaxConnLifetime, pc.MaxConnIdleTime)
+
+	// Bring the schema up to date. A no-op when startup.sh's migrate CLI has
+	// already run, since both share golang-migrate's schema_migrations table.
+	if n, err := db.Migrate(ctx, dbPool); err != nil {
+		log.Fatalf("Database migrations: %v", err)
+	} else if n > 0 {
+		log.Infof("Applied %d database migrations", n)
+	}
+	// Migrations can report "up to date" against a database whose tables
+	// are gone (a restore without schema_migrations, a manual DROP). Name
+	// what's missing now rather than fail later inside some handler's query;
+	// /health stays 503 until the tables exist.
+	if missing, err := db.MissingTables(ctx, dbPool); err != nil {
+		log.Errorf("Schema check: %v", err)
+	} else if len(missing) > 0 {
+		log.Errorf("Database schema is incomplete, missing tables: %s. schema_migrations claims they exist; "+
+			"clear it (DELETE FROM schema_migrations) and restart to re-run migrations, or restore the schema",
+			strings.Join(missing, ", "))
+	}
 
 	tokenStore := middleware.GetTokenStore()
 	authConfig := middleware.NewAuthConfig()
 	middleware.StartTokenCleanup(tokenStore, 5*time.Minute)
 
 	// DB-backed session store. The legacy in-memory store remains alive
-	// only so that tests in this package can keep using it directly.
-	sessionStore := session.NewDBStore(dbPool)
+	// only so that tests in this package can keep using it directly. With
+	// REDIS_URL, sessions (and the rate-limit counters below) live in Redis
+	// instead, so replicas share them without a sessions-table query per
+	// request; sessions already in Postgres stay valid until they expire.
+	var sessionStore session.Store = session.NewDBStore(dbPool)
+	var shared store.Store
+	if redisCfg := config.LoadRedisConfig(); redisCfg.URL != "" {
+		openCtx, cancelOpen := context.WithTimeout(context.Background(), 10*time.Second)
+		shared, err = store.Open(openCtx, redisCfg.URL)
+		cancelOpen()
+		if err != nil {
+			log.Fatalf("REDIS_URL: %v", err)
+		}
+		sessionStore = session.NewKVStore(shared, dbPool, sessionStore)
+		log.Info("Sessions and rate limits are shared through Redis")
+	}
 	cleanupCtx, cancelSessionCleanup := context.WithCancel(context.Background())
 	defer cancelSessionCleanup()
 	session.StartCleanup(cleanupCtx, sessionStore, 5*time.Minute)
@@ -159,15 +342,69 @@ func main() {
 	if err != nil {
 		log.Fatalf("OPERATOR_IP_ALLOWLIST: %v", err)
 	}
-	loginLimiter := middleware.NewLoginRateLimiter()
+	securityCfg := config.LoadSecurityConfig()
+	authConfig.RefreshTokenExpiry = securityCfg.RefreshTokenExpiry
+	if securityCfg.MaxRequestBodyBytes > 0 {
+		maxRequestBodySize = securityCfg.MaxRequestBodyBytes
+	}
+	if securityCfg.TrustedProxies != "" {
+		proxies, err := middleware.ParseTrustedProxies(securityCfg.TrustedProxies)
+		if err != nil {
+			log.Fatalf("TRUSTED_PROXIES: %v", err)
+		}
+		middleware.SetTrustedProxies(proxies)
+	} else if os.Getenv("TRUST_FORWARDED_FOR") == "true" {
+		log.Warn("TRUST_FORWARDED_FOR believes X-Forwarded-For from any peer; set TRUSTED_PROXIES to your proxy CIDRs instead")
+	}
+	loginLimiter := middleware.NewLoginRateLimiter().Share(shared, "ratelimit:login:")
 	// Periodically drop idle buckets so a long-lived process doesn't accumulate
 	// one map entry per distinct source IP that ever hit /login. Idle window
 	// is generous — the bucket only matters during an active brute-force burst.
 	middleware.StartLoginLimiterCleanup(cleanupCtx, loginLimiter, 10*time.Minute, time.Hour)
 
 	dispatcher := webhook.NewDispatcher()
+	dispatcher.DB = dbPool
 	sshDialer := sshpkg.NewDialer(dbPool)
+	sshCfg := config.LoadSSHConfig()
+	sshLimit := sshpkg.NewLimiter(sshCfg.MaxConcurrent, sshCfg.BusyTimeout)
+	sshDialer.IdleTTL = sshCfg.ConnIdleTimeout
+	sshDialer.ShareLimit(sshLimit)
+	sshDialer.Keepalive = sshpkg.Keepalive{Interval: sshCfg.KeepaliveInterval, MaxMisses: sshCfg.KeepaliveMaxMisses}
+	sshDialer.TrustOnFirstUse = !sshCfg.StrictHostKey
+	if sshDialer.TrustOnFirstUse {
+		log.Warn("SSH_STRICT_HOST_KEY=false: hosts with no key on file are trusted on first connection")
+	}
+	if sshCfg.BastionHost != "" {
+		keyPEM, err := os.ReadFile(sshCfg.BastionKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to read SSH_BASTION_KEY_FILE: %v", err)
+		}
+		bastion, err := sshpkg.NewBastion(sshCfg.BastionHost, sshCfg.BastionUser, string(keyPEM), sshCfg.BastionHostKey)
+		if err != nil {
+			log.Fatalf("Invalid SSH bastion configuration: %v", err)
+		}
+		sshDialer.Bastion = bastion
+		log.Infof("SSH connections go through bastion %s@%s", bastion.User, bastion.Addr)
+	}
+	if sshCfg.DefaultUser != "" {
+		if err := sshpkg.ValidateUsername(sshCfg.DefaultUser); err != nil {
+			log.Fatalf("Invalid DEFAULT_SSH_USER: %v", err)
+		}
+	}
+	var mailer *email.Notifier
+	if config.LoadFeatureConfig().EnableEmail {
+		emailCfg := config.LoadEmailConfig()
+		if err := emailCfg.Validate(); err != nil {
+			log.Fatalf("Invalid email configuration: %v", err)
+		}
+		mailer = email.NewNotifier(emailCfg)
+		log.Infof("Email notifications go to %s via %s:%d", strings.Join(emailCfg.To, ", "), emailCfg.Host, emailCfg.Port)
+	}
 	broker := events.NewBroker()
+	passwords := users.PasswordPolicy{
+		MinLength:     securityCfg.PasswordMinLength,
+		RequireStrong: securityCfg.RequireStrongPasswords,
+	}
 	app := &Application{
 		DB:            dbPool,
 		TokenStore:    tokenStore,
@@ -176,12 +413,43 @@ func main() {
 		CORS:          corsCfg,
 		IPAllowlist:   allowlist,
 		LoginLimiter:  loginLimiter,
+		Passwords:     passwords,
 		SSHDialer:     sshDialer,
+		SSHLimit:      sshLimit,
 		WebhookSender: dispatcher,
+		Mailer:        mailer,
 		BulkUpdater:   updater.New(dbPool, sshDialer),
 		EventBroker:   broker,
 	}
 
+	app.BulkUpdater.MaxConcurrency = sshCfg.BulkMaxConcurrency
+	// Bulk hosts share the process-wide MAX_CONCURRENT_SSH budget with
+	// interactive sessions, queueing for a slot rather than failing.
+	app.BulkUpdater.SSHLimit = sshLimit
+
+	// UPDATE_CHECK_TEMPLATE / UPDATE_APPLY_TEMPLATE replace the apt-get
+	// commands for fleets on other base images or behind a wrapper script.
+	// Single-host, bulk and scheduled updates all use them.
+	updateCommands, err := updater.ParseCommandTemplate(os.Getenv("UPDATE_CHECK_TEMPLATE"), os.Getenv("UPDATE_APPLY_TEMPLATE"))
+	if err != nil {
+		log.Fatalf("Invalid update command template: %v", err)
+	}
+	app.UpdateCommands = updateCommands
+	app.EnrollmentTokenTTL = securityCfg.EnrollmentTokenTTL
+	app.DefaultSSHUser = sshCfg.DefaultUser
+	app.RequireConfirmEnv = securityCfg.RequireConfirmEnv
+	app.ScriptsOnly = securityCfg.ExecuteMode == config.ExecuteModeAllowlist
+	app.Scripts, err = loadScriptRegistry(securityCfg.ExecuteScriptsDir)
+	switch {
+	case err != nil && app.ScriptsOnly:
+		log.Fatalf("Failed to load scripts from %s: %v", securityCfg.ExecuteScriptsDir, err)
+	case err != nil:
+		log.Warnf("Named scripts unavailable; failed to load %s: %v", securityCfg.ExecuteScriptsDir, err)
+	case app.ScriptsOnly:
+		log.Infof("execute-script limited to %d named script(s) from %s", len(app.Scripts), securityCfg.ExecuteScriptsDir)
+	}
+	app.BulkUpdater.Commands = updateCommands
+
 	// Bulk + scheduled runs fire the same webhook events as single-host runs.
 	app.BulkUpdater.Notify = func(kind models.RunKind, hostID, runID int32, succeeded bool, errMsg string) {
 		failEvent, successEvent := runEvents(kind)
@@ -193,7 +461,30 @@ func main() {
 				payload["error"] = errMsg
 			}
 		}
-		app.dispatchWebhooks(event, payload)
+		app.dispatchEvent(event, hostID, payload)
+	}
+
+	// HOST_OUTPUT_MAX_BYTES caps the apt output stored on each hosts row
+	// (default 1 MiB); larger reports keep only their tail.
+	if v := os.Getenv("HOST_OUTPUT_MAX_BYTES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 1024 {
+			app.HostOutputMaxBytes = n
+		} else {
+			log.Warnf("HOST_OUTPUT_MAX_BYTES=%q must be an integer >= 1024; using %d", v, db.DefaultMaxHostOutputBytes)
+		}
+	}
+	// HOST_OUTPUT_COMPRESS_BYTES is the size from which that output is
+	// stored gzipped (default 4 KiB); 0 stores everything raw.
+	if v := os.Getenv("HOST_OUTPUT_COMPRESS_BYTES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			// The field spells "never" as negative, since 0 is the default.
+			app.HostOutputCompressBytes = n
+			if n == 0 {
+				app.HostOutputCompressBytes = -1
+			}
+		} else {
+			log.Warnf("HOST_OUTPUT_COMPRESS_BYTES=%q must be a non-negative integer; using %d", v, db.DefaultHostOutputCompressBytes)
+		}
 	}
 
 	// Offline sweep: the server-side truth behind host_offline webhooks.
@@ -204,6 +495,7 @@ func main() {
 			offlineAfter = n
 		}
 	}
+	app.OfflineAfter = time.Duration(offlineAfter) * time.Minute
 	go func() {
 		ticker := time.NewTicker(time.Minute)
 		defer ticker.Stop()
@@ -212,24 +504,14 @@ func main() {
 			case <-cleanupCtx.Done():
 				return
 			case <-ticker.C:
-				newlyOffline, err := db.SweepOfflineHosts(cleanupCtx, dbPool, offlineAfter)
-				if err != nil {
-					log.Errorf("offline sweep: %v", err)
-					continue
-				}
-				for _, h := range newlyOffline {
-					log.Warnf("host %s offline (last seen %s)", h.Hostname, h.LastSeen)
-					app.dispatchWebhooks("host_offline", map[string]interface{}{
-						"host_id": h.ID, "hostname": h.Hostname, "last_seen": h.LastSeen,
-					})
-				}
+				app.sweepOfflineHosts(cleanupCtx, offlineAfter)
 			}
 		}
 	}()
 
-	// Run-history retention: prune terminal runs older than RUN_RETENTION_DAYS
-	// (default 90; 0 disables). Runs once at startup, then daily, so frequently
-	// restarted deployments still prune.
+	// Run-history retention: prune terminal runs, and stored webhook events,
+	// older than RUN_RETENTION_DAYS (default 90; 0 disables). Runs once at
+	// startup, then daily, so frequently restarted deployments still prune.
 	retentionDays := 90
 	if v := os.Getenv("RUN_RETENTION_DAYS"); v != "" {
 		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
@@ -246,6 +528,11 @@ func main() {
 				} else if n > 0 {
 					log.Infof("run retention: pruned %d runs older than %d days", n, retentionDays)
 				}
+				if n, err := webhook.PruneEvents(cleanupCtx, dbPool, retentionDays); err != nil {
+					log.Errorf("event retention: %v", err)
+				} else if n > 0 {
+					log.Infof("event retention: pruned %d webhook events older than %d days", n, retentionDays)
+				}
 				select {
 				case <-cleanupCtx.Done():
 					return
@@ -258,6 +545,13 @@ func main() {
 	// Bootstrap an initial admin from ADMIN_USERNAME / ADMIN_PASSWORD env
 	// vars. Only takes effect when the users table is empty, so re-deploys
 	// don't quietly clobber a manually-created account.
+	// The env admin only has to clear the length floor, so a policy change
+	// can't stop an existing deployment from starting; it's flagged instead.
+	if pw := os.Getenv("ADMIN_PASSWORD"); pw != "" {
+		if err := users.ValidatePassword(app.Passwords, pw); err != nil {
+			log.Warnf("ADMIN_PASSWORD does not meet the password policy (%v); change it after logging in", err)
+		}
+	}
 	if created, err := users.EnsureBootstrapAdmin(ctx, dbPool,
 		os.Getenv("ADMIN_USERNAME"), os.Getenv("ADMIN_PASSWORD")); err != nil {
 		if errors.Is(err, users.ErrPasswordTooShort) {
@@ -278,10 +572,27 @@ func main() {
 	// Server-side schedule loop: fires due schedules as bulk update groups.
 	go scheduler.Run(listenerCtx, dbPool, app.BulkUpdater)
 
+	// Webhook outbox: retry deliveries that failed when their event fired.
+	go dispatcher.RunOutbox(listenerCtx, time.Minute)
+
+	// Env-configured fleet update (AUTO_UPDATE_*). A bad cron expression is
+	// fatal: silently never updating is worse than not starting.
+	if features := config.LoadFeatureConfig(); features.EnableAutoUpdates {
+		cron, err := scheduler.ParseCron(features.AutoUpdateSchedule)
+		if err != nil {
+			log.Fatalf("AUTO_UPDATE_SCHEDULE: %v", err)
+		}
+		go scheduler.RunAuto(listenerCtx, dbPool, app.BulkUpdater, scheduler.AutoUpdate{Cron: cron, Tag: features.AutoUpdateTag})
+		log.Infof("Automatic updates enabled: %q (UTC), next run %s",
+			features.AutoUpdateSchedule, cron.Next(time.Now()).Format(time.RFC3339))
+	}
+
 	r := mux.NewRouter()
 	r.Use(middleware.PrometheusMiddleware) // request metrics (must be first)
 	r.Use(middleware.SecurityHeaders)      // defense-in-depth HTTP headers
-	r.Use(middleware.ErrorHandler)         // panic recovery + request logging
+	// Panic recovery + request logging, successful requests sampled.
+	r.Use(middleware.SampledErrorHandler(logCfg.RequestSampleEvery))
+	r.Use(middleware.MaxBodySize(maxRequestBodySize))
 	r.Use(middleware.CORS(corsCfg))
 	if allowlist != nil {
 		r.Use(middleware.IPAllowlistMiddleware(allowlist))
@@ -289,72 +600,179 @@ func main() {
 
 	// Enrollment: rate-limit to prevent token brute-force. Shared limiter
 	// with login is fine — same 5 req/min per IP budget.
-	enrollLimiter := middleware.NewLoginRateLimiter()
+	enrollLimiter := middleware.NewLoginRateLimiter().Share(shared, "ratelimit:enroll:")
 	middleware.StartLoginLimiterCleanup(cleanupCtx, enrollLimiter, 10*time.Minute, time.Hour)
 
+	app.registerPublicRoutes(r, enrollLimiter)
+
+	// Authenticated routes (any role). The API-wide rate limit runs ahead of
+	// session auth so a flood of bad tokens is shed before it reaches the DB.
+	api := r.PathPrefix("/api/v1").Subrouter()
+	if securityCfg.EnableRateLimit {
+		apiLimiter := middleware.NewRateLimiter(securityCfg.RateLimitRequests, securityCfg.RateLimitWindow).Share(shared, "ratelimit:api:")
+		middleware.StartLoginLimiterCleanup(cleanupCtx, apiLimiter, 10*time.Minute, time.Hour)
+		api.Use(middleware.RateLimit(apiLimiter))
+		log.Infof("API rate limit: %d requests per %s per client IP", securityCfg.RateLimitRequests, securityCfg.RateLimitWindow)
+	}
+	api.Use(middleware.SessionAuthMiddleware(sessionStore, authConfig, tokenValidator(dbPool)))
+
+	// Disable CSRF with CSRF_DISABLED=true if you need to (e.g. CLI-only
+	// deployment).
+	app.registerAPIRoutes(api, os.Getenv("CSRF_DISABLED") != "true", authConfig.CookieName)
+
+	// Fallback to serving the frontend React application
+	spa := spaHandler{staticPath: "public", indexPath: "index.html"}
+	r.PathPrefix("/").Handler(spa)
+
+	serverCfg := config.LoadServerConfig()
+	if err := serverCfg.Validate(); err != nil {
+		log.Fatalf("Server config: %v", err)
+	}
+	app.WSPingInterval = serverCfg.WSPingInterval
+	app.WSMaxMessageSize = serverCfg.WSMaxMessageSize
+	srv := newHTTPServer(serverCfg, r)
+
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigChan
+		log.Infof("Received signal %v, shutting down gracefully...", sig)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Errorf("Server shutdown error: %v", err)
+		}
+		dispatcher.Wait()
+		if mailer != nil {
+			mailer.Wait()
+		}
+	}()
+
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Fatalf("listen on %s: %v", srv.Addr, err)
+	}
+	scheme := "http"
+	if serverCfg.EnableHTTPS {
+		scheme = "https"
+	}
+	log.Infof("Starting %s server on :%s (read %s, write %s, idle %s)", scheme, serverCfg.Port,
+		serverCfg.ReadTimeout, serverCfg.WriteTimeout, serverCfg.IdleTimeout)
+	if err := serve(srv, serverCfg, ln); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	log.Info("Server stopped")
+}
+
+// registerPublicRoutes mounts the unauthenticated routes on the root
+// router: metrics, probes, version, the API description, enrollment and the
+// login/refresh endpoints.
+func (app *Application) registerPublicRoutes(r *mux.Router, enrollLimiter *middleware.LoginRateLimiter) {
 	// Prometheus metrics endpoint.
 	r.Handle("/metrics", promhttp.Handler()).Methods(http.MethodGet)
+	// Probe mapping: livenessProbe -> /livez, readinessProbe -> /readyz.
+	// /health is the same check as /readyz, kept for existing monitors.
+	r.HandleFunc("/api/v1/livez", app.handleLivez).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/readyz", app.handleHealth).Methods(http.MethodGet)
 	r.HandleFunc("/api/v1/health", app.handleHealth).Methods(http.MethodGet)
-	r.Handle("/api/v1/enroll", middleware.RateLimitHandler(enrollLimiter)(http.HandlerFunc(app.handleEnroll))).Methods(http.MethodPost)
-	r.HandleFunc("/api/v1/login", app.handleLogin).Methods(http.MethodPost, http.MethodOptions)
-	r.HandleFunc("/api/v1/logout", app.handleLogout).Methods(http.MethodPost, http.MethodOptions)
-
-	// Authenticated routes (any role).
-	api := r.PathPrefix("/api/v1").Subrouter()
-	api.Use(middleware.SessionAuthMiddleware(sessionStore, authConfig,
-		func(ctx context.Context, tok string) (session.Principal, bool, error) {
-			t, ok, err := apitokens.Validate(ctx, dbPool, tok)
-			if err != nil || !ok {
-				return session.Principal{}, false, err
-			}
-			return session.Principal{Username: "token:" + t.Name, Role: t.Role}, true, nil
-		}))
+	r.HandleFunc("/api/v1/version", app.handleVersion).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/openapi.json", app.handleOpenAPI(r)).Methods(http.MethodGet)
+	r.Handle("/api/v1/enroll", middleware.RateLimitHandler(enrollLimiter)(middleware.RequireJSON(http.HandlerFunc(app.handleEnroll)))).Methods(http.MethodPost)
+	r.Handle("/api/v1/login", middleware.RequireJSON(http.HandlerFunc(app.handleLogin))).Methods(http.MethodPost, http.MethodOptions)
+	r.Handle("/api/v1/logout", middleware.RequireJSON(http.HandlerFunc(app.handleLogout))).Methods(http.MethodPost, http.MethodOptions)
+	r.Handle("/api/v1/refresh", middleware.RequireJSON(http.HandlerFunc(app.handleRefresh))).Methods(http.MethodPost, http.MethodOptions)
+}
 
+// registerAPIRoutes mounts the authenticated /api/v1 routes on api, which
+// must already carry the session auth middleware. Each route's minimum role
+// is set by the subrouter it is on; HasRole keeps agents off everything but
+// the agent routes. Request bodies must be JSON everywhere except
+// /hosts/import, which also takes CSV.
+func (app *Application) registerAPIRoutes(api *mux.Router, csrfEnabled bool, cookieName string) {
 	// /report is agent-only — we explicitly require RoleAgent rather than
 	// relying on a handler-level check. Without this any logged-in viewer
-	// could push report payloads.
+	// could push report payloads. The /agent/* pull endpoints live here too.
 	reportRouter := api.PathPrefix("").Subrouter()
-	reportRouter.Use(middleware.RequireRole(session.RoleAgent))
+	reportRouter.Use(middleware.RequireRole(session.RoleAgent), middleware.RequireJSON)
 	reportRouter.HandleFunc("/report", app.handleReport).Methods(http.MethodPost)
+	reportRouter.HandleFunc("/report/batch", app.handleReportBatch).Methods(http.MethodPost)
+	reportRouter.HandleFunc("/agent/commands", app.handleAgentCommands).Methods(http.MethodGet)
+	reportRouter.HandleFunc("/agent/result", app.handleAgentResult).Methods(http.MethodPost)
 
 	// Read-only — viewer+ can see.
 	viewer := api.PathPrefix("").Subrouter()
 	viewer.Use(middleware.RequireRole(session.RoleViewer))
 	viewer.HandleFunc("/hosts", app.handleListHosts).Methods(http.MethodGet)
 	viewer.HandleFunc("/reports/compliance", app.handleComplianceReport).Methods(http.MethodGet)
+	viewer.HandleFunc("/hosts/export", app.handleExportHosts).Methods(http.MethodGet)
 	viewer.HandleFunc("/hosts/{id}", app.handleGetHost).Methods(http.MethodGet)
 	viewer.HandleFunc("/hosts/{id}/runs", app.handleListRuns).Methods(http.MethodGet)
+	viewer.HandleFunc("/hosts/{id}/unattended-upgrades", app.handleGetUnattended).Methods(http.MethodGet)
+	viewer.HandleFunc("/hosts/{id}/commands", app.handleListCommands).Methods(http.MethodGet)
+	viewer.HandleFunc("/hosts/{id}/ssh-key", app.handleGetSSHKey).Methods(http.MethodGet)
+	viewer.HandleFunc("/hosts/{id}/ssh-keys", app.handleListSSHKeys).Methods(http.MethodGet)
+	viewer.HandleFunc("/hosts/{id}/agent-tokens", app.handleListAgentTokens).Methods(http.MethodGet)
+	viewer.HandleFunc("/hosts/{id}/history", app.handlePackageHistory).Methods(http.MethodGet)
+	viewer.HandleFunc("/hosts/{id}/update-hooks", app.handleGetUpdateHooks).Methods(http.MethodGet)
 	viewer.HandleFunc("/runs", app.handleListRunsByGroup).Methods(http.MethodGet)
+	viewer.HandleFunc("/runs/phases", app.handleListRunPhases).Methods(http.MethodGet)
 	viewer.HandleFunc("/runs/{id}", app.handleGetRun).Methods(http.MethodGet)
-	viewer.HandleFunc("/events", events.Handler(broker, app.wsUpgrader(), app.Sessions)).Methods(http.MethodGet)
+	viewer.HandleFunc("/runs/{id}/hooks", app.handleListRunHooks).Methods(http.MethodGet)
+	viewer.HandleFunc("/events", events.Handler(app.EventBroker, app.wsUpgrader(), app.Sessions)).Methods(http.MethodGet)
 	viewer.HandleFunc("/me", app.handleMe).Methods(http.MethodGet)
 	viewer.HandleFunc("/overview", app.handleOverview).Methods(http.MethodGet)
 	viewer.HandleFunc("/schedules", app.handleListSchedules).Methods(http.MethodGet)
+	viewer.HandleFunc("/maintenance-windows", app.handleListMaintenanceWindows).Methods(http.MethodGet)
 	viewer.HandleFunc("/playbooks", app.handleListPlaybooks).Methods(http.MethodGet)
 
 	// State-changing operations — operator+.
 	op := api.PathPrefix("").Subrouter()
 	op.Use(middleware.RequireRole(session.RoleOperator))
 	// CSRF defense for cookie-auth POSTs/PATCHes/DELETEs. Bearer-auth bypasses.
-	// Disable with CSRF_DISABLED=true if you need to (e.g. CLI-only deployment).
-	csrfEnabled := os.Getenv("CSRF_DISABLED") != "true"
 	if csrfEnabled {
-		op.Use(middleware.CSRFMiddleware(authConfig.CookieName))
+		op.Use(middleware.CSRFMiddleware(cookieName))
+	}
+	op.Use(middleware.RequireJSON)
+	// The import is the one body that may be CSV, or carry no Content-Type
+	// at all and be sniffed, so it sits on its own operator subrouter
+	// without RequireJSON.
+	importer := api.PathPrefix("").Subrouter()
+	importer.Use(middleware.RequireRole(session.RoleOperator))
+	if csrfEnabled {
+		importer.Use(middleware.CSRFMiddleware(cookieName))
 	}
+	importer.HandleFunc("/hosts/import", app.handleImportHosts).Methods(http.MethodPost)
 	op.HandleFunc("/hosts", app.handleCreateHost).Methods(http.MethodPost)
 	op.HandleFunc("/hosts/{id}", app.handleUpdateHost).Methods(http.MethodPatch)
 	op.HandleFunc("/hosts/{id}", app.handleDeleteHost).Methods(http.MethodDelete)
+	op.HandleFunc("/hosts/{id}/restore", app.handleRestoreHost).Methods(http.MethodPost)
+	op.HandleFunc("/hosts/{id}/tags", app.handleAddHostTag).Methods(http.MethodPost)
+	op.HandleFunc("/hosts/{id}/tags/{tag}", app.handleRemoveHostTag).Methods(http.MethodDelete)
 	op.HandleFunc("/hosts/{id}/preview-updates", app.handlePreviewUpdates).Methods(http.MethodGet)
+	op.HandleFunc("/hosts/{id}/packages", app.handleListPackages).Methods(http.MethodGet)
+	op.HandleFunc("/hosts/{id}/unattended-upgrades/check", app.handleCheckUnattended).Methods(http.MethodPost)
 	op.HandleFunc("/hosts/{id}/run-update", app.handleRunUpdate).Methods(http.MethodGet)
+	op.HandleFunc("/hosts/{id}/cancel-update", app.handleCancelUpdate).Methods(http.MethodPost)
 	op.HandleFunc("/hosts/{id}/execute-script", app.handleExecuteScript).Methods(http.MethodGet)
+	op.HandleFunc("/hosts/{id}/commands", app.handleEnqueueCommand).Methods(http.MethodPost)
 	op.HandleFunc("/hosts/{id}/ssh-key", app.handleAddSSHKey).Methods(http.MethodPost)
+	op.HandleFunc("/hosts/{id}/ssh-keys", app.handleAppendSSHKey).Methods(http.MethodPost)
+	op.HandleFunc("/hosts/{id}/ssh-keys/{key_id}", app.handleDeleteSSHKey).Methods(http.MethodDelete)
+	op.HandleFunc("/hosts/{id}/agent-tokens/{token_id}", app.handleRevokeAgentToken).Methods(http.MethodDelete)
 	op.HandleFunc("/hosts/{id}/test-connection", app.handleTestConnection).Methods(http.MethodPost)
 	op.HandleFunc("/hosts/{id}/auto-configure", app.handleAutoConfigure).Methods(http.MethodPost)
 	op.HandleFunc("/hosts/{id}/rotate-key", app.handleRotateKey).Methods(http.MethodPost)
+	op.HandleFunc("/hosts/{id}/generate-key", app.handleGenerateKey).Methods(http.MethodPost)
+	op.HandleFunc("/hosts/{id}/sudo-password", app.handleSetSudoPassword).Methods(http.MethodPut)
+	op.HandleFunc("/hosts/{id}/sudo-password", app.handleDeleteSudoPassword).Methods(http.MethodDelete)
+	op.HandleFunc("/hosts/{id}/update-hooks", app.handleSetUpdateHooks).Methods(http.MethodPut)
 	op.HandleFunc("/hosts/bulk/enroll", app.handleBulkEnroll).Methods(http.MethodPost)
 	op.HandleFunc("/hosts/bulk/run-update", app.handleBulkRunUpdate).Methods(http.MethodPost)
 	op.HandleFunc("/hosts/bulk/run-playbook", app.handleBulkRunPlaybook).Methods(http.MethodPost)
 	op.HandleFunc("/hosts/bulk/reboot", app.handleBulkReboot).Methods(http.MethodPost)
+	op.HandleFunc("/hosts/{id}/reboot", app.handleRebootHost).Methods(http.MethodPost)
 	op.HandleFunc("/hosts/{id}/run-playbook", app.handleRunPlaybook).Methods(http.MethodGet)
 	op.HandleFunc("/playbooks", app.handleCreatePlaybook).Methods(http.MethodPost)
 	op.HandleFunc("/playbooks/{id}", app.handleGetPlaybook).Methods(http.MethodGet)
@@ -363,9 +781,14 @@ func main() {
 	op.HandleFunc("/webhooks", app.handleListWebhooks).Methods(http.MethodGet)
 	op.HandleFunc("/webhooks", app.handleAddWebhook).Methods(http.MethodPost)
 	op.HandleFunc("/webhooks/{id}", app.handleDeleteWebhook).Methods(http.MethodDelete)
+	op.HandleFunc("/webhooks/{id}/deliveries", app.handleListWebhookDeliveries).Methods(http.MethodGet)
+	op.HandleFunc("/webhooks/{id}/replay", app.handleReplayWebhook).Methods(http.MethodPost)
 	op.HandleFunc("/schedules", app.handleCreateSchedule).Methods(http.MethodPost)
 	op.HandleFunc("/schedules/{id}", app.handleUpdateSchedule).Methods(http.MethodPatch)
 	op.HandleFunc("/schedules/{id}", app.handleDeleteSchedule).Methods(http.MethodDelete)
+	op.HandleFunc("/maintenance-windows", app.handleCreateMaintenanceWindow).Methods(http.MethodPost)
+	op.HandleFunc("/maintenance-windows/{id}", app.handleUpdateMaintenanceWindow).Methods(http.MethodPatch)
+	op.HandleFunc("/maintenance-windows/{id}", app.handleDeleteMaintenanceWindow).Methods(http.MethodDelete)
 
 	// Admin-only — user/audit management. CSRF mirrors the operator subrouter
 	// since these endpoints are equally state-changing (and equally cookie-
@@ -373,59 +796,56 @@ func main() {
 	admin := api.PathPrefix("").Subrouter()
 	admin.Use(middleware.RequireRole(session.RoleAdmin))
 	if csrfEnabled {
-		admin.Use(middleware.CSRFMiddleware(authConfig.CookieName))
+		admin.Use(middleware.CSRFMiddleware(cookieName))
 	}
+	admin.Use(middleware.RequireJSON)
 	admin.HandleFunc("/users", app.handleListUsers).Methods(http.MethodGet)
 	admin.HandleFunc("/users", app.handleCreateUser).Methods(http.MethodPost)
 	admin.HandleFunc("/users/{id}", app.handleUpdateUser).Methods(http.MethodPatch)
 	admin.HandleFunc("/users/{id}", app.handleDeleteUser).Methods(http.MethodDelete)
 	admin.HandleFunc("/audit", app.handleListAudit).Methods(http.MethodGet)
+	admin.HandleFunc("/ssh-keys/re-encrypt", app.handleReEncryptSSHKeys).Methods(http.MethodPost)
 	admin.HandleFunc("/tokens", app.handleListAPITokens).Methods(http.MethodGet)
 	admin.HandleFunc("/tokens", app.handleCreateAPIToken).Methods(http.MethodPost)
 	admin.HandleFunc("/tokens/{id}", app.handleDeleteAPIToken).Methods(http.MethodDelete)
+	admin.HandleFunc("/enrollment-tokens", app.handleCreateEnrollmentToken).Methods(http.MethodPost)
+}
 
-	// Fallback to serving the frontend React application
-	spa := spaHandler{staticPath: "public", indexPath: "index.html"}
-	r.PathPrefix("/").Handler(spa)
+// sessionExpiry is how long a login (or refresh) session lasts.
+const sessionExpiry = 24 * time.Hour
 
-	port := os.Getenv("API_PORT")
-	if port == "" {
-		port = "8080"
-	}
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
 
-	srv := &http.Server{
-		Addr:         ":" + port,
-		Handler:      r,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 60 * time.Second,
-		IdleTimeout:  120 * time.Second,
+// validEnrollmentToken accepts the shared ENROLLMENT_TOKEN or a token minted
+// with `ua-backend create-token` or POST /enrollment-tokens, and reports
+// whether it was single-use. A single-use token is consumed by this check.
+func (app *Application) validEnrollmentToken(ctx context.Context, presented string) (ok, singleUse bool, err error) {
+	if shared := os.Getenv("ENROLLMENT_TOKEN"); shared != "" &&
+		subtle.ConstantTimeCompare([]byte(presented), []byte(shared)) == 1 {
+		return true, false, nil
 	}
-
-	go func() {
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-		sig := <-sigChan
-		log.Infof("Received signal %v, shutting down gracefully...", sig)
-
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
-
-		if err := srv.Shutdown(shutdownCtx); err != nil {
-			log.Errorf("Server shutdown error: %v", err)
-		}
-		dispatcher.Wait()
-	}()
-
-	log.Infof("Starting server on :%s", port)
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatal(err)
+	if app.DB == nil {
+		return false, false, nil
 	}
-	log.Info("Server stopped")
+	t, ok, err := enrollment.Validate(ctx, app.DB, presented)
+	return ok, t.SingleUse, err
 }
 
-type LoginRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+// agentTokenTTL is how long an enrolled agent's token lasts. Agents
+// re-enroll on expiry; a short lifetime limits what a leaked token is worth.
+const agentTokenTTL = 90 * 24 * time.Hour
+
+// enrollResponse is what a successful enroll returns. Token is the agent's
+// bearer token, shown only here; TokenID names it in the host's token list
+// so it can be revoked.
+type enrollResponse struct {
+	Token     string    `json:"token"`
+	TokenID   int32     `json:"token_id"`
+	HostID    int32     `json:"host_id"`
+	ExpiresAt time.Time `json:"expires_at"`
 }
 
 func (app *Application) handleEnroll(w http.ResponseWriter, r *http.Request) {
@@ -436,58 +856,92 @@ func (app *Application) handleEnroll(w http.ResponseWriter, r *http.Request) {
 		Hostname        string `json:"hostname"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+		writeDecodeError(w, err)
 		return
 	}
 
-	req.Hostname = strings.TrimSpace(req.Hostname)
-	if req.Hostname == "" {
-		writeJSONError(w, http.StatusBadRequest, "Hostname cannot be empty")
+	req.Hostname = sshpkg.NormalizeHostname(strings.TrimSpace(req.Hostname))
+	var invalid middleware.ValidationErrors
+	checkHostname(&invalid, "hostname", req.Hostname)
+	if len(invalid) > 0 {
+		middleware.SendValidationErrors(w, invalid)
 		return
 	}
 
-	enrollmentToken := os.Getenv("ENROLLMENT_TOKEN")
-	if enrollmentToken == "" {
-		log.Error("ENROLLMENT_TOKEN environment variable not set")
-		writeJSONError(w, http.StatusInternalServerError, "Enrollment not configured")
+	// A missing token is a credential problem like a wrong one: 401, not a
+	// field error.
+	ok, singleUse, err := app.validEnrollmentToken(r.Context(), req.EnrollmentToken)
+	if err != nil {
+		log.Errorf("Failed to check enrollment token: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to check enrollment token")
 		return
 	}
-	if subtle.ConstantTimeCompare([]byte(req.EnrollmentToken), []byte(enrollmentToken)) != 1 {
+	if !ok {
 		writeJSONError(w, http.StatusUnauthorized, "Invalid enrollment token")
 		return
 	}
 
-	// Use the session store when available (production path); fall back to
-	// the legacy in-memory store when DB isn't wired (tests).
-	var authToken string
-	if app.Sessions != nil {
-		// Agent sessions: 90 days (was 365). Shorter lifetime limits blast
-		// radius if an agent token is compromised. Agents re-enroll on expiry.
-		t, err := app.Sessions.Create(r.Context(),
-			session.Principal{AgentLabel: req.Hostname, Username: "agent:" + req.Hostname, Role: session.RoleAgent},
-			90*24*time.Hour, middleware.ClientIP(r), r.UserAgent())
+	// A reusable enrollment token can't take over a host that is already
+	// enrolled, or whose agent was cut off: otherwise anyone holding it
+	// could enroll under that hostname and undo a revocation. An admin
+	// approves a re-enroll by minting a single-use token for it. A host
+	// whose tokens have all expired re-enrolls as usual.
+	if !singleUse {
+		held, err := db.HostHasAgentTokens(r.Context(), app.DB, req.Hostname)
 		if err != nil {
-			log.Errorf("Failed to create agent session: %v", err)
-			writeJSONError(w, http.StatusInternalServerError, "Failed to generate token")
+			log.Errorf("Failed to check agent tokens for %s: %v", req.Hostname, err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to check enrollment")
 			return
 		}
-		authToken = t
-	} else {
-		t, err := middleware.GenerateSecureToken()
-		if err != nil {
-			writeJSONError(w, http.StatusInternalServerError, "Failed to generate token")
+		if held {
+			writeJSONError(w, http.StatusConflict, "Host is already enrolled or was revoked; re-enrolling it needs a single-use enrollment token")
 			return
 		}
-		authToken = t
-		app.TokenStore.StoreTokenWithRole(authToken, "agent:"+req.Hostname, session.RoleAgent, 90*24*time.Hour)
 	}
 
-	log.Infof("Agent enrolled successfully: %s", req.Hostname)
+	// Create the host row now rather than on the first report, so an
+	// enrolled host is listed (and can have commands queued) right away. The
+	// agent token below is issued against it.
+	host, err := db.EnrollHost(r.Context(), app.DB, req.Hostname)
+	if errors.Is(err, db.ErrHostArchived) {
+		// Its agent tokens would be refused, so don't issue one; an
+		// operator decides whether the host comes back.
+		writeJSONError(w, http.StatusConflict, "Host is archived; restore it first")
+		return
+	}
+	if err != nil {
+		log.Errorf("Failed to register enrolling host %s: %v", req.Hostname, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to register host")
+		return
+	}
+
+	// Each enroll issues a fresh agent token. Earlier ones stay valid until
+	// they expire or are revoked from the host's token list, so an operator
+	// can cut off an agent whose token leaked without touching the others.
+	tok, authToken, err := db.CreateAgentToken(r.Context(), app.DB, host.ID, agentTokenTTL, middleware.ClientIP(r))
+	if err != nil {
+		log.Errorf("Failed to create agent token for %s: %v", req.Hostname, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to generate token")
+		return
+	}
+
+	log.Infof("Agent enrolled successfully: %s (host ID: %d)", req.Hostname, host.ID)
 	app.audit(r, audit.ActionAgentEnroll, "agent", req.Hostname,
-		map[string]interface{}{"hostname": req.Hostname})
+		map[string]interface{}{"hostname": req.Hostname, "host_id": host.ID, "token_id": tok.ID})
+	payload := map[string]interface{}{"host_id": host.ID, "hostname": host.Hostname}
+	if host.LastSeen.Equal(host.CreatedAt) {
+		// The first report no longer creates the row, so it can't fire this.
+		app.dispatchEvent("host_registered", host.ID, payload)
+	}
+	app.dispatchEvent("host_enrolled", host.ID, payload)
 
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(map[string]string{"token": authToken})
+	_ = json.NewEncoder(w).Encode(enrollResponse{ // #nosec G117 -- the agent's token is handed over once, at enroll
+		Token:     authToken,
+		TokenID:   tok.ID,
+		HostID:    host.ID,
+		ExpiresAt: tok.ExpiresAt,
+	})
 }
 
 func (app *Application) handleLogin(w http.ResponseWriter, r *http.Request) {
@@ -504,8 +958,8 @@ func (app *Application) handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
 		return
 	}
 
@@ -521,23 +975,26 @@ func (app *Application) handleLogin(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		tok, err := app.Sessions.Create(r.Context(),
-			session.Principal{UserID: u.ID, Username: u.Username, Role: u.Role},
-			24*time.Hour, middleware.ClientIP(r), r.UserAgent())
+		resp, err := app.startSession(w, r, u)
 		if err != nil {
 			log.Errorf("create session: %v", err)
 			writeJSONError(w, http.StatusInternalServerError, "Failed to create session")
 			return
 		}
-		middleware.SetAuthCookie(w, app.AuthConfig, tok)
-		csrf, _ := middleware.GenerateCSRFToken()
-		middleware.SetCSRFCookie(w, csrf)
+		// Without a refresh token the login still works; it just can't be
+		// renewed past the session's lifetime.
+		if refresh, err := session.IssueRefreshToken(r.Context(), app.DB, u.ID, app.AuthConfig.RefreshTokenExpiry); err != nil {
+			log.Errorf("issue refresh token: %v", err)
+		} else {
+			middleware.SetRefreshCookie(w, app.AuthConfig, refresh)
+			resp["refresh_token"] = refresh
+		}
 		app.audit(r, audit.ActionLoginSuccess, "user", strconv.FormatInt(int64(u.ID), 10),
 			map[string]interface{}{"username": u.Username})
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		_ = json.NewEncoder(w).Encode(map[string]string{"token": tok, "role": u.Role, "csrf_token": csrf})
+		_ = json.NewEncoder(w).Encode(resp)
 		return
 	}
 
@@ -569,6 +1026,114 @@ func (app *Application) handleLogin(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(map[string]string{"token": authToken})
 }
 
+// startSession opens a session for u, sets the auth and CSRF cookies, and
+// returns the login response body for the caller to extend and send.
+func (app *Application) startSession(w http.ResponseWriter, r *http.Request, u users.User) (map[string]string, error) {
+	tok, err := app.Sessions.Create(r.Context(),
+		session.Principal{UserID: u.ID, Username: u.Username, Role: u.Role},
+		sessionExpiry, middleware.ClientIP(r), r.UserAgent())
+	if err != nil {
+		return nil, err
+	}
+	middleware.SetAuthCookie(w, app.AuthConfig, tok)
+	csrf, _ := middleware.GenerateCSRFToken()
+	middleware.SetCSRFCookie(w, csrf)
+	return map[string]string{"token": tok, "role": u.Role, "csrf_token": csrf}, nil
+}
+
+// RefreshRequest is the optional body of POST /refresh. Browsers can omit it
+// and rely on the refresh cookie set at login.
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// refreshToken reads the refresh token from the JSON body, falling back to
+// the refresh cookie.
+func refreshToken(r *http.Request) (string, error) {
+	if r.ContentLength != 0 {
+		var req RefreshRequest
+		if err := decodeJSON(r, &req); err != nil {
+			return "", err
+		}
+		if req.RefreshToken != "" {
+			return req.RefreshToken, nil
+		}
+	}
+	if c, err := r.Cookie(middleware.RefreshCookieName); err == nil {
+		return c.Value, nil
+	}
+	return "", nil
+}
+
+// handleRefresh trades a refresh token for a new session and the next
+// refresh token, without credentials. The role comes from the users row, so
+// a demotion or disable takes effect at the next refresh; a user locked out
+// after failed logins can't refresh until the lock runs out.
+func (app *Application) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if app.LoginLimiter != nil {
+		if !app.LoginLimiter.Allow(middleware.ClientIP(r)) {
+			w.Header().Set("Retry-After", "60")
+			writeJSONError(w, http.StatusTooManyRequests, "Too many login attempts; try again shortly")
+			return
+		}
+	}
+	if app.DB == nil || app.Sessions == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "Database not available")
+		return
+	}
+	tok, err := refreshToken(r)
+	if err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+
+	userID, next, err := session.RotateRefreshToken(r.Context(), app.DB, tok)
+	if errors.Is(err, session.ErrRefreshReused) {
+		log.Warnf("Spent refresh token presented again from %s; revoked its login", middleware.ClientIP(r))
+		app.audit(r, audit.ActionRefreshReuse, "session", "", nil)
+	}
+	if errors.Is(err, session.ErrRefreshInvalid) || errors.Is(err, session.ErrRefreshReused) {
+		middleware.ClearRefreshCookie(w)
+		writeJSONError(w, http.StatusUnauthorized, "Invalid or expired refresh token")
+		return
+	}
+	if err != nil {
+		log.Errorf("refresh: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to refresh session")
+		return
+	}
+
+	u, err := users.Get(r.Context(), app.DB, userID)
+	if err == nil && u.DisabledAt != nil {
+		err = pgx.ErrNoRows
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		if err := session.RevokeRefreshToken(r.Context(), app.DB, next); err != nil {
+			log.Errorf("revoke refresh token of disabled user %d: %v", userID, err)
+		}
+		middleware.ClearRefreshCookie(w)
+		writeJSONError(w, http.StatusUnauthorized, "Invalid or expired refresh token")
+		return
+	}
+	if err != nil {
+		log.Errorf("refresh: get user %d: %v", userID, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to refresh session")
+		return
+	}
+
+	resp, err := app.startSession(w, r, u)
+	if err != nil {
+		log.Errorf("create session: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create session")
+		return
+	}
+	middleware.SetRefreshCookie(w, app.AuthConfig, next)
+	resp["refresh_token"] = next
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
 // handleMe returns the current principal so the UI can branch on role
 // without a separate config endpoint.
 func (app *Application) handleMe(w http.ResponseWriter, r *http.Request) {
@@ -585,10 +1150,45 @@ func (app *Application) handleMe(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// writeJSONError sends the same middleware.ErrorResponse body the auth,
+// rate-limit and panic paths use: error is a snake_case code derived from
+// the status ("not_found"), message the human-readable text.
 func writeJSONError(w http.ResponseWriter, status int, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(map[string]string{"error": message})
+	middleware.SendErrorResponse(w, status, errorCode(status), message, nil)
+}
+
+// errorCode turns a status into ErrorResponse's error code: "Bad Request"
+// becomes "bad_request".
+func errorCode(status int) string {
+	return middleware.StatusSlug(status)
+}
+
+// decodeJSON decodes a request body into v, refusing fields v doesn't
+// declare so a misspelt key fails instead of being silently dropped. The
+// agent endpoints (enroll, report, report/batch, result) decode leniently
+// instead: agents send more than the server reads, and older servers must
+// accept newer agents.
+func decodeJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// writeDecodeError reports a failed JSON body decode: 413 when the body blew
+// through MaxBytesReader, 400 naming the field for an unknown one, 400 for
+// anything else.
+func writeDecodeError(w http.ResponseWriter, err error) {
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds %d bytes", tooBig.Limit))
+		return
+	}
+	// encoding/json has no typed error for DisallowUnknownFields.
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		writeJSONError(w, http.StatusBadRequest, "Unknown field "+field)
+		return
+	}
+	writeJSONError(w, http.StatusBadRequest, "Invalid request body")
 }
 
 // handleLogout invalidates the caller's token (if present) and clears the auth cookie.
@@ -607,75 +1207,314 @@ func (app *Application) handleLogout(w http.ResponseWriter, r *http.Request) {
 		// missing.
 		app.TokenStore.RemoveToken(tok)
 	}
+	// Ending the login also ends its refresh family, so the refresh token
+	// can't quietly start a new session.
+	if refresh, _ := refreshToken(r); refresh != "" && app.DB != nil {
+		if err := session.RevokeRefreshToken(r.Context(), app.DB, refresh); err != nil {
+			log.Errorf("logout: %v", err)
+		}
+	}
+	middleware.ClearRefreshCookie(w)
 	middleware.ClearAuthCookie(w, app.AuthConfig)
 	middleware.ClearCSRFCookie(w)
 	app.audit(r, audit.ActionLogout, "session", "", nil)
-	w.WriteHeader(http.StatusOK)
+	middleware.SendSuccessResponse(w, http.StatusOK, nil, "Logged out")
 }
 
 func (app *Application) handleReport(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
 
+	raw, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeDecodeError(w, err)
+		return
+	}
 	var report models.HostReport
-	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
-		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+	var invalid middleware.ValidationErrors
+	var unsupported *reportschema.UnsupportedVersionError
+	err = decodeReport(raw, &report)
+	switch {
+	case errors.As(err, &invalid):
+		middleware.SendValidationErrors(w, invalid)
+		return
+	case errors.As(err, &unsupported):
+		writeJSONError(w, http.StatusBadRequest, "Invalid report: "+err.Error())
+		return
+	case err != nil:
+		writeDecodeError(w, err)
 		return
 	}
 
-	report.Hostname = strings.TrimSpace(report.Hostname)
-	if report.Hostname == "" {
-		writeJSONError(w, http.StatusBadRequest, "Hostname cannot be empty")
+	data, err := app.reportData(&report)
+	if errors.As(err, &invalid) {
+		middleware.SendValidationErrors(w, invalid)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !agentOwnsHostname(r, report.Hostname) {
+		writeJSONError(w, http.StatusForbidden, "Report hostname does not match the host this agent enrolled as")
 		return
 	}
 
 	log.Infof("Received report from host: %s (agent %s)", report.Hostname, report.AgentVersion)
 
-	ur := report.UpdateResults
-	errMsg := ""
-	if ur.ErrorMessage != nil {
-		errMsg = *ur.ErrorMessage
-	}
-	// The agent folds all package-manager output into apt_output. Keep it in
-	// update_output; the SSH-run path is what populates upgrade_output.
-	//
 	// ssh_user is "root" only as the seed for a first insert; UpsertHost
 	// preserves an existing ssh_user on conflict, so agent reports no longer
 	// reset a host enrolled as a non-root user.
-	host, err := db.UpsertHost(r.Context(), app.DB, report.Hostname, "root", db.ReportData{
-		UpdateOutput:      ur.AptOutput,
-		UpgradeOutput:     "",
-		Error:             errMsg,
-		RebootRequired:    ur.RebootRequired,
-		PackagesUpdated:   ur.PackagesUpdated,
-		PackagesAvailable: ur.PackagesAvailable,
-		OsVersion:         report.SystemInfo.OsVersion,
-		KernelVersion:     report.SystemInfo.KernelVersion,
-		AgentVersion:      report.AgentVersion,
-	})
+	host, err := db.UpsertHost(r.Context(), app.DB, report.Hostname, "root", data)
 	if err != nil {
 		log.Errorf("Failed to upsert host: %v", err)
 		writeJSONError(w, http.StatusInternalServerError, "Failed to process report")
 		return
 	}
+	app.announceReport(host, report.UpdateResults)
+
+	log.Infof("Upserted host: %s (ID: %d)", host.Hostname, host.ID)
+	middleware.SendSuccessResponse(w, http.StatusAccepted, host.ID, "Report accepted")
+}
+
+// errForeignReport refuses a report an agent sent for a host other than its
+// own.
+var errForeignReport = errors.New("hostname does not match the host this agent enrolled as")
+
+// agentOwnsHostname reports whether the caller may report for hostname. An
+// agent's token is bound to the host it enrolled as, so a leaked token
+// can't overwrite another host or create new ones.
+func agentOwnsHostname(r *http.Request, hostname string) bool {
+	p := middleware.GetPrincipalFromContext(r)
+	return p == nil || !p.IsAgent() || p.AgentLabel == hostname
+}
+
+// decodeReport checks raw against the report schema it declares, then
+// decodes it into report. Schema violations come back together as
+// middleware.ValidationErrors, so an agent that sends a field with the wrong
+// type hears which one instead of having it decode to zero.
+func decodeReport(raw []byte, report *models.HostReport) error {
+	violations, err := reportschema.Validate(raw)
+	if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		invalid := make(middleware.ValidationErrors, 0, len(violations))
+		for _, v := range violations {
+			invalid.Add(v.Field, v.Message)
+		}
+		return invalid
+	}
+	return json.Unmarshal(raw, report)
+}
+
+// maxReportLabel caps the short descriptive strings of a report (versions,
+// architecture). They are shown in the host list, not parsed.
+const maxReportLabel = 255
+
+// reportData validates report, normalizing its hostname in place, and maps it
+// to what UpsertHost persists under the server's output cap. An invalid
+// report returns every problem at once as middleware.ValidationErrors.
+func (app *Application) reportData(report *models.HostReport) (db.ReportData, error) {
+	report.Hostname = sshpkg.NormalizeHostname(strings.TrimSpace(report.Hostname))
+	ur := report.UpdateResults
+	var invalid middleware.ValidationErrors
+	checkHostname(&invalid, "hostname", report.Hostname)
+	checkCount(&invalid, "update_results.packages_updated", ur.PackagesUpdated)
+	checkCount(&invalid, "update_results.packages_available", ur.PackagesAvailable)
+	checkLabel(&invalid, "agent_version", report.AgentVersion)
+	checkLabel(&invalid, "system_info.os_version", report.SystemInfo.OsVersion)
+	checkLabel(&invalid, "system_info.kernel_version", report.SystemInfo.KernelVersion)
+	checkLabel(&invalid, "system_info.architecture", report.SystemInfo.Architecture)
+	if len(invalid) > 0 {
+		return db.ReportData{}, invalid
+	}
+	errMsg := ""
+	if ur.ErrorMessage != nil {
+		errMsg = *ur.ErrorMessage
+	}
+	// The agent folds all package-manager output into apt_output. Keep it in
+	// update_output; the SSH-run path is what populates upgrade_output.
+	return db.ReportData{
+		UpdateOutput:        ur.AptOutput,
+		UpgradeOutput:       "",
+		Error:               errMsg,
+		RebootRequired:      ur.RebootRequired,
+		PackagesUpdated:     ur.PackagesUpdated,
+		PackagesAvailable:   ur.PackagesAvailable,
+		OsVersion:           report.SystemInfo.OsVersion,
+		KernelVersion:       report.SystemInfo.KernelVersion,
+		AgentVersion:        report.AgentVersion,
+		Architecture:        report.SystemInfo.Architecture,
+		MaxOutputBytes:      app.HostOutputMaxBytes,
+		CompressOutputBytes: app.HostOutputCompressBytes,
+	}, nil
+}
+
+// checkHostname records why h can't be a host's name, if it can't.
+func checkHostname(v *middleware.ValidationErrors, field, h string) {
+	if h == "" {
+		v.Add(field, "cannot be empty")
+	} else if sshpkg.ValidateHostname(h) != nil {
+		v.Add(field, "must be a valid RFC 1123 hostname or IP address")
+	}
+}
+
+// checkCount records a package count the INTEGER columns can't hold.
+func checkCount(v *middleware.ValidationErrors, field string, n int) {
+	if n < 0 || n > math.MaxInt32 {
+		v.Add(field, fmt.Sprintf("must be between 0 and %d", math.MaxInt32))
+	}
+}
 
+// checkLabel records a descriptive string that is too long or carries
+// control characters (a stray newline would break the host list).
+func checkLabel(v *middleware.ValidationErrors, field, s string) {
+	if len(s) > maxReportLabel {
+		v.Add(field, fmt.Sprintf("cannot exceed %d characters", maxReportLabel))
+	} else if strings.ContainsFunc(s, unicode.IsControl) {
+		v.Add(field, "cannot contain control characters")
+	}
+}
+
+// announceReport fires the events a persisted report can trigger.
+func (app *Application) announceReport(host models.Host, ur models.UpdateResults) {
 	// A fresh insert leaves last_seen equal to created_at (same statement);
 	// any later report bumps last_seen. That equality is the zero-cost
 	// "this report created the host" signal for the registered event.
 	if host.LastSeen.Equal(host.CreatedAt) {
-		app.dispatchWebhooks("host_registered", map[string]interface{}{"host_id": host.ID, "hostname": host.Hostname})
+		app.dispatchEvent("host_registered", host.ID, map[string]interface{}{"host_id": host.ID, "hostname": host.Hostname})
+	}
+	// Announce a pending reboot when this report's own upgrade caused it,
+	// not on every report while the host waits for one.
+	if ur.RebootRequired && ur.PackagesUpdated > 0 {
+		app.dispatchEvent("reboot_required", host.ID, map[string]interface{}{
+			"host_id": host.ID, "hostname": host.Hostname, "packages_updated": ur.PackagesUpdated,
+		})
 	}
+}
 
-	log.Infof("Upserted host: %s (ID: %d)", host.Hostname, host.ID)
-	w.WriteHeader(http.StatusAccepted)
+// maxReportBatch caps one POST /report/batch. The body limit applies too,
+// so collectors forwarding large apt outputs should send smaller batches.
+const maxReportBatch = 500
+
+// reportBatchResult is one report's line in the batch response.
+type reportBatchResult struct {
+	Hostname string `json:"hostname"`
+	OK       bool   `json:"ok"`
+	HostID   int32  `json:"host_id,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// handleReportBatch is POST /report/batch: a JSON array of reports, for a
+// collector forwarding many hosts. The valid ones are written in one
+// transaction, each under its own savepoint, so an invalid or failing
+// report is listed with its error and the rest still land. Results come
+// back in request order.
+func (app *Application) handleReportBatch(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+
+	// Decoded one at a time below, so a report that breaks the schema is
+	// listed with its error like any other invalid one. Like /report, each
+	// report is decoded leniently rather than with decodeJSON.
+	var raws []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raws); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	reports := make([]models.HostReport, len(raws))
+	if len(reports) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "Batch cannot be empty")
+		return
+	}
+	if len(reports) > maxReportBatch {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Batch cannot exceed %d reports", maxReportBatch))
+		return
+	}
+
+	results := make([]reportBatchResult, len(reports))
+	var batch []db.HostReportData
+	var batchIdx []int // results index of each batch entry
+	for i := range reports {
+		if err := decodeReport(raws[i], &reports[i]); err != nil {
+			// Name the host if the report got that far.
+			var named struct {
+				Hostname string `json:"hostname"`
+			}
+			_ = json.Unmarshal(raws[i], &named)
+			results[i].Hostname = named.Hostname
+			results[i].Error = err.Error()
+			continue
+		}
+		data, err := app.reportData(&reports[i])
+		results[i].Hostname = reports[i].Hostname
+		if err == nil && !agentOwnsHostname(r, reports[i].Hostname) {
+			err = errForeignReport
+		}
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		batch = append(batch, db.HostReportData{Hostname: reports[i].Hostname, Report: data})
+		batchIdx = append(batchIdx, i)
+	}
+
+	if len(batch) > 0 {
+		upserted, err := db.UpsertHosts(r.Context(), app.DB, "root", batch)
+		if err != nil {
+			log.Errorf("Failed to record report batch: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to process report batch")
+			return
+		}
+		for j, res := range upserted {
+			i := batchIdx[j]
+			if res.Err != nil {
+				log.Errorf("Failed to upsert host %s from batch: %v", batch[j].Hostname, res.Err)
+				results[i].Error = "Failed to process report"
+				continue
+			}
+			results[i].OK = true
+			results[i].HostID = res.Host.ID
+			app.announceReport(res.Host, reports[i].UpdateResults)
+		}
+	}
+
+	accepted := 0
+	for _, res := range results {
+		if res.OK {
+			accepted++
+		}
+	}
+	log.Infof("Report batch: %d of %d accepted", accepted, len(results))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"accepted": accepted,
+		"failed":   len(results) - accepted,
+		"results":  results,
+	})
 }
 
 func (app *Application) handleListHosts(w http.ResponseWriter, r *http.Request) {
 	// Optional pagination for API/automation consumers; the dashboard omits
 	// both params and keeps getting the full list (client-side filtering
-	// needs it). limit is capped at 500 per page.
+	// needs it). limit is capped at 500 per page. ?tag= narrows to one fleet
+	// segment and returns it whole — segments are small enough not to page.
+	// Archived hosts are left out unless ?include_deleted=true.
 	var hosts []models.Host
 	var err error
-	if r.URL.Query().Get("limit") != "" || r.URL.Query().Get("offset") != "" {
+	includeDeleted := r.URL.Query().Get("include_deleted") == "true"
+	paged := r.URL.Query().Get("limit") != "" || r.URL.Query().Get("offset") != ""
+	if r.URL.Query().Has("tag") {
+		tag, ok := normalizeTag(r.URL.Query().Get("tag"))
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, "tag must be 1-64 characters")
+			return
+		}
+		if paged {
+			writeJSONError(w, http.StatusBadRequest, "tag cannot be combined with limit/offset")
+			return
+		}
+		hosts, err = db.ListHostsByTag(r.Context(), app.DB, tag, includeDeleted)
+	} else if paged {
 		limit, lerr := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 32)
 		if lerr != nil || limit < 1 || limit > 500 {
 			writeJSONError(w, http.StatusBadRequest, "limit must be 1-500")
@@ -689,9 +1528,9 @@ func (app *Application) handleListHosts(w http.ResponseWriter, r *http.Request)
 				return
 			}
 		}
-		hosts, err = db.ListHostsPage(r.Context(), app.DB, int(limit), int(offset))
+		hosts, err = db.ListHostsPage(r.Context(), app.DB, int(limit), int(offset), includeDeleted)
 	} else {
-		hosts, err = db.ListHosts(r.Context(), app.DB)
+		hosts, err = db.ListHosts(r.Context(), app.DB, includeDeleted)
 	}
 	if err != nil {
 		log.Errorf("Failed to list hosts: %v", err)
@@ -699,6 +1538,9 @@ func (app *Application) handleListHosts(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	for i := range hosts {
+		app.setHostStatus(&hosts[i])
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(hosts)
 }
@@ -733,6 +1575,7 @@ func (app *Application) handleGetHost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	app.setHostStatus(&host)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(host)
 }
@@ -756,17 +1599,21 @@ func (app *Application) handleCreateHost(w http.ResponseWriter, r *http.Request)
 		SshUser  string `json:"ssh_user"`
 		Password string `json:"password"` // optional; triggers auto-enrollment
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
 		return
 	}
 
-	req.Hostname = strings.TrimSpace(req.Hostname)
+	req.Hostname = sshpkg.NormalizeHostname(strings.TrimSpace(req.Hostname))
 	req.SshUser = strings.TrimSpace(req.SshUser)
 	if req.Hostname == "" {
 		writeJSONError(w, http.StatusBadRequest, "Hostname is required")
 		return
 	}
+	if err := sshpkg.ValidateHostname(req.Hostname); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if req.SshUser == "" {
 		req.SshUser = "root"
 	}
@@ -788,7 +1635,8 @@ func (app *Application) handleCreateHost(w http.ResponseWriter, r *http.Request)
 		log.Infof("Operator created host: %s (ID: %d)", host.Hostname, host.ID)
 		app.audit(r, audit.ActionHostCreate, "host", strconv.FormatInt(int64(host.ID), 10),
 			map[string]interface{}{"hostname": host.Hostname, "ssh_user": host.SshUser})
-		app.dispatchWebhooks("host_registered", map[string]interface{}{"host_id": host.ID, "hostname": host.Hostname})
+		app.dispatchEvent("host_registered", host.ID, map[string]interface{}{"host_id": host.ID, "hostname": host.Hostname})
+		app.setHostStatus(&host)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(host)
@@ -840,15 +1688,16 @@ func (app *Application) handleCreateHost(w http.ResponseWriter, r *http.Request)
 			"fingerprint": result.HostKeyFingerprint,
 			"sudo_scope":  result.SudoScope,
 		})
-	app.dispatchWebhooks("host_registered", map[string]interface{}{"host_id": host.ID, "hostname": host.Hostname})
+	app.dispatchEvent("host_registered", host.ID, map[string]interface{}{"host_id": host.ID, "hostname": host.Hostname})
+	app.setHostStatus(&host)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(host)
 }
 
-// handleUpdateHost applies a partial update to a host. Only ssh_user is
-// editable today; hostname is the natural key and changing it would break
-// the agent-report upsert path.
+// handleUpdateHost applies a partial update to a host: ssh_user, tags,
+// update_policy and environment. Hostname is the natural key and changing it
+// would break the agent-report upsert path.
 func (app *Application) handleUpdateHost(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
 
@@ -859,17 +1708,31 @@ func (app *Application) handleUpdateHost(w http.ResponseWriter, r *http.Request)
 	}
 
 	var req struct {
-		SshUser *string   `json:"ssh_user,omitempty"`
-		Tags    *[]string `json:"tags,omitempty"`
+		SshUser      *string              `json:"ssh_user,omitempty"`
+		Tags         *[]string            `json:"tags,omitempty"`
+		UpdatePolicy *models.UpdatePolicy `json:"update_policy,omitempty"`
+		Environment  *string              `json:"environment,omitempty"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if req.SshUser == nil && req.Tags == nil && req.UpdatePolicy == nil && req.Environment == nil {
+		writeJSONError(w, http.StatusBadRequest, "Nothing to update; ssh_user, tags, update_policy and environment are editable")
 		return
 	}
-	if req.SshUser == nil && req.Tags == nil {
-		writeJSONError(w, http.StatusBadRequest, "Nothing to update; ssh_user and tags are editable")
+	if req.UpdatePolicy != nil && !req.UpdatePolicy.Valid() {
+		writeJSONError(w, http.StatusBadRequest, "update_policy must be 'all' or 'security_only'")
 		return
 	}
+	if req.Environment != nil {
+		env, ok := normalizeEnvironment(*req.Environment)
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, "environment must be up to 32 lowercase letters, digits, '-' or '_', starting with a letter or digit")
+			return
+		}
+		req.Environment = &env
+	}
 
 	var host models.Host
 	if req.SshUser != nil {
@@ -894,11 +1757,9 @@ func (app *Application) handleUpdateHost(w http.ResponseWriter, r *http.Request)
 		// Normalise: trim, drop empties, cap length so the UI can't store junk.
 		tags := make([]string, 0, len(*req.Tags))
 		for _, t := range *req.Tags {
-			t = strings.TrimSpace(t)
-			if t == "" || len(t) > 64 {
-				continue
+			if t, ok := normalizeTag(t); ok {
+				tags = append(tags, t)
 			}
-			tags = append(tags, t)
 		}
 		var err error
 		host, err = db.UpdateHostTags(r.Context(), app.DB, id, tags)
@@ -912,14 +1773,44 @@ func (app *Application) handleUpdateHost(w http.ResponseWriter, r *http.Request)
 			return
 		}
 	}
+	if req.UpdatePolicy != nil {
+		var err error
+		host, err = db.UpdateHostPolicy(r.Context(), app.DB, id, *req.UpdatePolicy)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				writeJSONError(w, http.StatusNotFound, "Host not found")
+				return
+			}
+			log.Errorf("Failed to update host policy: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to update host")
+			return
+		}
+	}
+	if req.Environment != nil {
+		var err error
+		host, err = db.UpdateHostEnvironment(r.Context(), app.DB, id, *req.Environment)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				writeJSONError(w, http.StatusNotFound, "Host not found")
+				return
+			}
+			log.Errorf("Failed to update host environment: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to update host")
+			return
+		}
+	}
 
+	app.setHostStatus(&host)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(host)
 }
 
-// handleDeleteHost removes a host and (via ON DELETE CASCADE) its SSH key.
-// To prevent click-through accidents and replay-style CSRF on long-lived
-// sessions, the client must echo the hostname in X-Confirm-Hostname.
+// handleDeleteHost archives a host: it drops out of listings, the offline
+// sweep and scheduled runs, but its row, key and history are kept and
+// handleRestoreHost can bring it back. ?purge=true removes the row instead,
+// taking its SSH key with it via ON DELETE CASCADE. To prevent
+// click-through accidents and replay-style CSRF on long-lived sessions,
+// the client must echo the hostname in X-Confirm-Hostname either way.
 func (app *Application) handleDeleteHost(w http.ResponseWriter, r *http.Request) {
 	id, err := parseHostID(r)
 	if err != nil {
@@ -944,6 +1835,23 @@ func (app *Application) handleDeleteHost(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if r.URL.Query().Get("purge") != "true" {
+		if _, err := db.ArchiveHost(r.Context(), app.DB, id); err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				writeJSONError(w, http.StatusNotFound, "Host not found")
+				return
+			}
+			log.Errorf("Failed to archive host %d: %v", id, err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to delete host")
+			return
+		}
+		log.Infof("Archived host: %s (ID: %d)", host.Hostname, id)
+		app.audit(r, audit.ActionHostArchive, "host", strconv.FormatInt(int64(id), 10),
+			map[string]interface{}{"hostname": host.Hostname})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
 	rows, err := db.DeleteHost(r.Context(), app.DB, id)
 	if err != nil {
 		log.Errorf("Failed to delete host %d: %v", id, err)
@@ -955,40 +1863,108 @@ func (app *Application) handleDeleteHost(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	log.Infof("Deleted host: %s (ID: %d)", host.Hostname, id)
+	log.Infof("Purged host: %s (ID: %d)", host.Hostname, id)
 	app.audit(r, audit.ActionHostDelete, "host", strconv.FormatInt(int64(id), 10),
 		map[string]interface{}{"hostname": host.Hostname})
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// handleRestoreHost un-archives a host. Restoring a live host is a no-op
+// that still returns it.
+func (app *Application) handleRestoreHost(w http.ResponseWriter, r *http.Request) {
+	id, err := parseHostID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+
+	host, err := db.RestoreHost(r.Context(), app.DB, id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "Host not found")
+			return
+		}
+		log.Errorf("Failed to restore host %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to restore host")
+		return
+	}
+
+	log.Infof("Restored host: %s (ID: %d)", host.Hostname, id)
+	app.audit(r, audit.ActionHostRestore, "host", strconv.FormatInt(int64(id), 10),
+		map[string]interface{}{"hostname": host.Hostname})
+	app.setHostStatus(&host)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(host)
+}
+
 // upgrader is used for WebSocket handshakes. CheckOrigin uses the cached
 // CORSConfig captured in main, but the upgrader itself is created per request
 // because it closes over the app pointer.
 func (app *Application) wsUpgrader() websocket.Upgrader {
 	return websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			origin := r.Header.Get("Origin")
-			if origin == "" {
-				return true // non-browser clients send no Origin
-			}
-			// Same-origin is always safe and must not depend on the CORS
-			// allowlist: the unified container serves the SPA from the API's
-			// own origin, and rejecting it silently killed every live
-			// stream (events, preview, run-update, execute-script).
-			if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		CheckOrigin: func(r *http.Request) bool { return checkWSOrigin(r, app.CORS) },
+		// Echo the token-carrier protocol back; a browser that offered it
+		// fails the handshake if the server selects nothing.
+		Subprotocols: []string{middleware.WSTokenProtocol},
+	}
+}
+
+// defaultWSMaxMessageSize is used when Application.WSMaxMessageSize is
+// unset.
+const defaultWSMaxMessageSize = 1 << 20
+
+// upgradeWS upgrades a run or script request to a WebSocket whose client
+// messages are capped at WSMaxMessageSize; a bigger one fails the read and
+// closes the socket with 1009.
+func (app *Application) upgradeWS(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	upgrader := app.wsUpgrader()
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	limit := app.WSMaxMessageSize
+	if limit <= 0 {
+		limit = defaultWSMaxMessageSize
+	}
+	ws.SetReadLimit(limit)
+	return newWSConn(ws), nil
+}
+
+// checkWSOrigin guards against cross-site WebSocket hijacking: browsers
+// attach the session cookie to a WS handshake from any page, and CORS does
+// not apply to WebSockets, so the Origin header is the only defense.
+//
+// No Origin means a non-browser client (CLI, bearer token), which a malicious
+// page can't impersonate. Same-origin is always safe and must not depend on
+// the CORS allowlist: the unified container serves the SPA from the API's own
+// origin, and rejecting it silently killed every live stream. Anything else
+// must be listed explicitly; a "*" CORS entry is not honored here, because
+// for a cookie-authenticated socket it would let every site in.
+func checkWSOrigin(r *http.Request, cors *middleware.CORSConfig) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	if cors != nil {
+		for _, allowed := range cors.AllowedOrigins {
+			if allowed != "*" && strings.EqualFold(allowed, origin) {
 				return true
 			}
-			return app.CORS.IsAllowed(origin)
-		},
+		}
 	}
+	log.Warnf("Rejected WebSocket upgrade from origin %q", origin)
+	return false
 }
 
 func (app *Application) handleAddWebhook(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
 
 	var req models.Webhook
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
 		return
 	}
 
@@ -1002,15 +1978,47 @@ func (app *Application) handleAddWebhook(w http.ResponseWriter, r *http.Request)
 		writeJSONError(w, http.StatusBadRequest, "URL must start with http:// or https://")
 		return
 	}
+	req.Format = strings.TrimSpace(req.Format)
+	if !webhook.ValidFormat(req.Format) {
+		writeJSONError(w, http.StatusBadRequest, "format must be raw, slack or teams")
+		return
+	}
+	if req.Format == "" {
+		req.Format = webhook.FormatRaw
+	}
+	if req.HostID != nil && req.Tag != nil {
+		writeJSONError(w, http.StatusBadRequest, "Set host_id or tag, not both")
+		return
+	}
+	if req.Tag != nil {
+		tag, ok := normalizeTag(*req.Tag)
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("tag must be 1-%d characters", maxTagLength))
+			return
+		}
+		req.Tag = &tag
+	}
 
-	if _, err := app.DB.Exec(r.Context(), `INSERT INTO webhooks (url, event) VALUES ($1, $2)`, req.URL, req.Event); err != nil {
+	var id int32
+	if err := app.DB.QueryRow(r.Context(), `INSERT INTO webhooks (url, event, format, host_id, tag) VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		req.URL, req.Event, req.Format, req.HostID, req.Tag).Scan(&id); err != nil {
+		if isForeignKeyViolation(err) {
+			writeJSONError(w, http.StatusNotFound, "Host not found")
+			return
+		}
 		log.Errorf("Failed to add webhook: %v", err)
 		writeJSONError(w, http.StatusInternalServerError, "Failed to add webhook")
 		return
 	}
-	app.audit(r, audit.ActionWebhookCreate, "webhook", req.URL,
-		map[string]interface{}{"event": req.Event})
-	w.WriteHeader(http.StatusCreated)
+	details := map[string]interface{}{"event": req.Event, "format": req.Format}
+	if req.HostID != nil {
+		details["host_id"] = *req.HostID
+	}
+	if req.Tag != nil {
+		details["tag"] = *req.Tag
+	}
+	app.audit(r, audit.ActionWebhookCreate, "webhook", req.URL, details)
+	middleware.SendSuccessResponse(w, http.StatusCreated, id, "Webhook created")
 }
 
 // handleListWebhooks returns every webhook subscription for the Settings UI.
@@ -1038,12 +2046,103 @@ func (app *Application) handleDeleteWebhook(w http.ResponseWriter, r *http.Reque
 		writeJSONError(w, http.StatusInternalServerError, "Failed to delete webhook")
 		return
 	}
-	if rows == 0 {
-		writeJSONError(w, http.StatusNotFound, "Webhook not found")
+	if rows == 0 {
+		writeJSONError(w, http.StatusNotFound, "Webhook not found")
+		return
+	}
+	app.audit(r, audit.ActionWebhookDelete, "webhook", strconv.FormatInt(id, 10), nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleReplayWebhook queues the webhook's events since ?since= (RFC 3339,
+// required) for delivery again, including ones that already got through,
+// so a receiver that lost data can be refilled. The outbox worker sends
+// them within a minute; the response says how many were queued.
+func (app *Application) handleReplayWebhook(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+	since, err := time.Parse(time.RFC3339, r.URL.Query().Get("since"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "since must be an RFC 3339 timestamp")
+		return
+	}
+	hook, err := db.GetWebhook(r.Context(), app.DB, int32(id))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "Webhook not found")
+			return
+		}
+		log.Errorf("Failed to get webhook %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to replay webhook events")
+		return
+	}
+	queued, err := webhook.Replay(r.Context(), app.DB, hook, since)
+	if err != nil {
+		log.Errorf("Failed to replay events to webhook %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to replay webhook events")
+		return
+	}
+	app.audit(r, audit.ActionWebhookReplay, "webhook", strconv.FormatInt(id, 10),
+		map[string]interface{}{"since": since.Format(time.RFC3339), "queued": queued})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{"webhook_id": id, "queued": queued})
+}
+
+// handleListWebhookDeliveries returns a webhook's logged delivery attempts,
+// newest first. ?since= (RFC 3339) drops older ones; ?limit= defaults to
+// 100, hard cap 1000, and ?offset= pages further back.
+func (app *Application) handleListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid webhook ID")
+		return
+	}
+	q := r.URL.Query()
+	var opts webhook.DeliveryListOptions
+	if v := q.Get("since"); v != "" {
+		if opts.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "since must be an RFC 3339 timestamp")
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeJSONError(w, http.StatusBadRequest, "limit must be >= 1")
+			return
+		}
+		opts.Limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, "offset must be >= 0")
+			return
+		}
+		opts.Offset = n
+	}
+
+	if _, err := db.GetWebhook(r.Context(), app.DB, int32(id)); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "Webhook not found")
+			return
+		}
+		log.Errorf("Failed to get webhook %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to list webhook deliveries")
+		return
+	}
+	deliveries, err := webhook.ListDeliveries(r.Context(), app.DB, int32(id), opts)
+	if err != nil {
+		log.Errorf("Failed to list deliveries for webhook %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to list webhook deliveries")
 		return
 	}
-	app.audit(r, audit.ActionWebhookDelete, "webhook", strconv.FormatInt(id, 10), nil)
-	w.WriteHeader(http.StatusNoContent)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
 }
 
 // handleAutoConfigure runs the bootstrap flow against an existing host
@@ -1065,8 +2164,8 @@ func (app *Application) handleAutoConfigure(w http.ResponseWriter, r *http.Reque
 		Password string `json:"password"`
 		SshUser  string `json:"ssh_user,omitempty"` // optional override
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
 		return
 	}
 	req.Password = strings.TrimSpace(req.Password)
@@ -1131,7 +2230,9 @@ func (app *Application) handleAutoConfigure(w http.ResponseWriter, r *http.Reque
 // handleTestConnection probes a host's SSH stack and reports back. Used by the
 // UI's "Test connection" button so the operator can validate the saved key
 // (and passwordless sudo for non-root users) before triggering a real update.
-// 7 seconds is plenty for a healthy host and short enough to be UI-friendly.
+// 7 seconds is plenty for a healthy host and short enough to be UI-friendly;
+// it bounds the dial, the handshake and the probes. Failures come back as
+// 200 with reachable: false and a failure category.
 func (app *Application) handleTestConnection(w http.ResponseWriter, r *http.Request) {
 	id, err := parseHostID(r)
 	if err != nil {
@@ -1144,6 +2245,10 @@ func (app *Application) handleTestConnection(w http.ResponseWriter, r *http.Requ
 
 	result, err := app.SSHDialer.TestConnection(ctx, id)
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "Host not found or has no SSH key")
+			return
+		}
 		log.Errorf("test-connection failed for host %d: %v", id, err)
 		writeJSONError(w, http.StatusInternalServerError, "Test failed")
 		return
@@ -1166,8 +2271,8 @@ func (app *Application) handleAddSSHKey(w http.ResponseWriter, r *http.Request)
 		SshUser    string `json:"ssh_user"`
 		PrivateKey string `json:"private_key"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
 		return
 	}
 
@@ -1200,108 +2305,317 @@ func (app *Application) handleAddSSHKey(w http.ResponseWriter, r *http.Request)
 	app.audit(r, audit.ActionHostKeyInstall, "host", strconv.FormatInt(int64(id), 10),
 		map[string]interface{}{"ssh_user": req.SshUser})
 
-	w.WriteHeader(http.StatusCreated)
+	middleware.SendSuccessResponse(w, http.StatusCreated, id, "SSH key saved")
 }
 
-func (app *Application) handleExecuteScript(w http.ResponseWriter, r *http.Request) {
+// handleGetSSHKey returns the public half of the host's first stored key as
+// an authorized_keys line, for installing on new targets or checking what is
+// configured; handleListSSHKeys returns all of them. The private key never
+// leaves the server.
+func (app *Application) handleGetSSHKey(w http.ResponseWriter, r *http.Request) {
 	id, err := parseHostID(r)
 	if err != nil {
 		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
 		return
 	}
 
-	// C4: Explicitly validate the session token BEFORE upgrading to WebSocket.
-	// WebSocket upgrade is a plain GET which bypasses the CSRF middleware.
-	// Without this check, the route relies solely on the subrouter's cookie
-	// session, which is insufficient for arbitrary command execution.
-	token := r.URL.Query().Get("token")
-	if app.Sessions != nil {
-		if token == "" {
-			writeJSONError(w, http.StatusUnauthorized, "Missing token")
-			return
-		}
-		if _, valid, _ := app.Sessions.Validate(r.Context(), token); !valid {
-			writeJSONError(w, http.StatusUnauthorized, "Invalid or expired session")
-			return
-		}
-	} else {
-		// Legacy in-memory token store path (tests / no-DB mode).
-		if token == "" {
-			writeJSONError(w, http.StatusUnauthorized, "Missing token")
+	key, err := db.GetSSHKey(r.Context(), app.DB, id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "No SSH key stored for this host")
 			return
 		}
-		if _, valid := app.TokenStore.ValidateToken(token); !valid {
-			writeJSONError(w, http.StatusUnauthorized, "Invalid or expired session")
+		if errors.Is(err, db.ErrUndecryptable) {
+			log.Error(err)
+			writeJSONError(w, http.StatusConflict, "Stored SSH key cannot be decrypted; re-add the key")
 			return
 		}
+		log.Errorf("Failed to read SSH key for host %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to read SSH key")
+		return
+	}
+	line, pub, err := sshpkg.AuthorizedKeyFromPrivate(key.PrivateKey)
+	if err != nil {
+		log.Errorf("Stored SSH key for host %d is unusable: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Stored SSH key does not parse")
+		return
 	}
 
-	upgrader := app.wsUpgrader()
-	conn, err := upgrader.Upgrade(w, r, nil)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"host_id":     id,
+		"public_key":  line,
+		"fingerprint": ssh.FingerprintSHA256(pub),
+	})
+}
+
+func (app *Application) handleExecuteScript(w http.ResponseWriter, r *http.Request) {
+	id, err := parseHostID(r)
 	if err != nil {
-		log.Errorf("Failed to upgrade to websocket: %v", err)
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+
+	// C4: Explicitly require WebSocket-borne credentials BEFORE upgrading.
+	// The upgrade is a plain GET, so CSRF middleware doesn't run. The auth
+	// middleware has already validated the token (from ?token= or the
+	// subprotocol, never the cookie); re-checking here keeps arbitrary
+	// command execution fail-closed if the route is ever mounted elsewhere.
+	if middleware.GetUserFromContext(r) == nil || middleware.WebSocketToken(r) == "" {
+		writeJSONError(w, http.StatusUnauthorized, "Missing token")
+		return
+	}
+
+	// ?script_name= picks a script from the server's registry, refused
+	// with a plain 403 before the upgrade when there is no such script.
+	// Without it the client sends either its own script or, in its place,
+	// {"script_name": "..."}; EXECUTE_MODE=allowlist only takes the latter.
+	q := r.URL.Query()
+	scriptName := q.Get("script_name")
+	named, isNamed := app.Scripts[scriptName]
+	if scriptName != "" && !isNamed {
+		log.Warnf("execute-script on host %d refused: unknown script %q", id, scriptName)
+		writeJSONError(w, http.StatusForbidden, "Unknown script_name")
 		return
 	}
-	defer conn.Close()
 
-	_, script, err := conn.ReadMessage()
+	// The script arrives as one message, bounded by WSMaxMessageSize.
+	conn, err := app.upgradeWS(w, r)
 	if err != nil {
-		log.Errorf("Failed to read script from websocket: %v", err)
+		log.Errorf("Failed to upgrade to websocket: %v", err)
 		return
 	}
+	closeCode, closeReason := wsCloseServerError, "internal error"
+	defer func() { closeWS(conn, closeCode, closeReason) }()
 
-	// Audit every script execution. The script body itself can be unbounded;
-	// we cap what we record so a paste of a 10MB binary doesn't bloat the log,
-	// but we hash the full body for non-repudiation.
-	scriptStr := string(script)
+	scriptStr := named
+	if !isNamed {
+		_, script, err := conn.ReadMessage()
+		if err != nil {
+			log.Errorf("Failed to read script from websocket: %v", err)
+			return
+		}
+		scriptName, isNamed = scriptNameMessage(script)
+		switch {
+		case isNamed:
+			if scriptStr, isNamed = app.Scripts[scriptName]; !isNamed {
+				log.Warnf("execute-script on host %d refused: unknown script %q", id, scriptName)
+				_ = conn.WriteMessage(websocket.TextMessage, []byte("Error: unknown script_name"))
+				closeCode, closeReason = wsCloseRejected, "unknown script_name"
+				return
+			}
+		case app.ScriptsOnly:
+			log.Warnf("execute-script on host %d refused: only named scripts are allowed", id)
+			_ = conn.WriteMessage(websocket.TextMessage, []byte(`Error: only named scripts can run on this server; send {"script_name": "..."} or pass ?script_name=`))
+			closeCode, closeReason = wsCloseRejected, "only named scripts allowed"
+			return
+		default:
+			scriptStr = string(script)
+		}
+	}
 
-	// Add a reasonable hard limit so malicious clients can't OOM the server or
-	// the SSH session (typically limited to 256KB or so depending on sshd_config).
-	const maxScriptBytes = 128 * 1024 // 128 KB
 	if len(scriptStr) > maxScriptBytes {
 		log.Errorf("Script exceeded maximum size: %d bytes", len(scriptStr))
 		_ = conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Error: Script exceeds maximum size of %d bytes", maxScriptBytes)))
+		closeCode, closeReason = wsCloseRejected, "script too large"
 		return
 	}
 
-	preview := scriptStr
-	const maxAuditedScript = 4096
-	if len(preview) > maxAuditedScript {
-		preview = preview[:maxAuditedScript] + "…(truncated)"
+	// A named script was vetted by whoever put it on the server.
+	if reason := scriptFootgun(scriptStr); reason != "" && !isNamed && q.Get("force") != "true" {
+		log.Warnf("execute-script on host %d refused: %s", id, reason)
+		_ = conn.WriteMessage(websocket.TextMessage, []byte("Error: script refused ("+reason+"); reconnect with force=true to run it anyway"))
+		closeCode, closeReason = wsCloseRejected, "script refused: "+reason
+		return
+	}
+
+	// Dry run: show what would be executed and where, then stop. Nothing
+	// touches the host and nothing is audited as a run.
+	if q.Get("dry_run") == "true" {
+		if app.writeScriptDryRun(r.Context(), conn, id, scriptStr) {
+			closeCode, closeReason = wsCloseOK, "dry run"
+		}
+		return
 	}
 
-	hash := sha256.Sum256(script)
-	hashHex := hex.EncodeToString(hash[:])
+	release, err := app.SSHLimit.Acquire(r.Context())
+	if err != nil {
+		_ = conn.WriteMessage(websocket.TextMessage, []byte("Error: "+err.Error()))
+		closeCode, closeReason = wsCloseBusy, err.Error()
+		return
+	}
+	defer release()
+	// Keep proxies from idling the socket out while a quiet command runs.
+	stopPings := keepWSAlive(conn, app.WSPingInterval)
+	defer stopPings()
 
-	app.audit(r, audit.ActionRunScript, "host", strconv.FormatInt(int64(id), 10),
-		map[string]interface{}{
-			"script_preview": preview,
-			"script_bytes":   len(scriptStr),
-			"script_sha256":  hashHex,
-		})
+	// Record who ran what before anything runs, then how it ended on every
+	// path past this point, including a failed dial. WithoutCancel lets the
+	// second write land after the client has hung up on a long script.
+	auditID := app.auditScriptStart(r, id, scriptName, scriptStr)
+	exit, runErr := scriptExit{Type: "exit", Code: -1}, ""
+	defer func() {
+		app.auditScriptEnd(context.WithoutCancel(r.Context()), auditID, exit, runErr)
+	}()
 
-	sshClient, _, err := app.SSHDialer.ConnectToHost(r.Context(), id)
+	sshClient, _, doneSSH, err := app.SSHDialer.ConnectReusable(r.Context(), id)
 	if err != nil {
 		log.Errorf("SSH connect to host %d failed: %v", id, err)
-		_ = conn.WriteMessage(websocket.TextMessage, []byte("SSH connect failed: "+err.Error()))
+		runErr = "SSH connect failed: " + err.Error()
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(runErr))
+		closeCode, closeReason = wsCloseUnreachable, "ssh connect failed"
 		return
 	}
-	defer sshClient.Close()
+	defer doneSSH()
 
-	session, err := sshClient.NewSession()
+	exit, err = runScript(conn, sshClient, scriptStr)
+	if err != nil {
+		runErr = err.Error()
+	}
+	closeCode, closeReason = runCloseCode(exit.Code, err)
+}
+
+// scriptExit is the last message execute-script sends once the script has
+// run, so clients needn't parse "[done: exit N]" out of the text stream.
+// Code is -1 when the script produced no exit status (connection lost);
+// Signal is set, e.g. "SIGKILL", when a signal ended it, and Code is then
+// 128 plus the signal number, as a shell would report it.
+type scriptExit struct {
+	Type   string `json:"type"` // always "exit"
+	Code   int    `json:"code"`
+	Signal string `json:"signal,omitempty"`
+}
+
+// runScript runs script in a new session on client and sends conn its
+// output, then the "[done: exit N]" line and the scriptExit message. The
+// error says why the script failed, if it did.
+func runScript(conn *wsConn, client *ssh.Client, script string) (scriptExit, error) {
+	exit := scriptExit{Type: "exit", Code: -1}
+	session, err := client.NewSession()
 	if err != nil {
 		log.Errorf("Failed to create SSH session: %v", err)
 		_ = conn.WriteMessage(websocket.TextMessage, []byte("Failed to create SSH session: "+err.Error()))
-		return
+		return exit, fmt.Errorf("create ssh session: %w", err)
 	}
 	defer session.Close()
 
-	output, err := session.CombinedOutput(scriptStr)
+	output, err := session.CombinedOutput(script)
+	exit.Code, exit.Signal = scriptExitStatus(err)
+	if err != nil && sshpkg.ConnectionLost(client) {
+		err = sshpkg.ErrConnectionLost
+	}
 	if err != nil {
 		log.Errorf("Script execution failed: %v", err)
-		_ = conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Script execution failed: %s", err.Error())))
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("Script execution failed: %s\n", err.Error())))
+	}
+	if werr := writeChunked(conn, output); werr != nil {
+		log.Warnf("execute-script: output not delivered: %v", werr)
+		return exit, err
+	}
+	// Output can span many messages; these tell the client it has all of it.
+	_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	emit(conn, fmt.Sprintf("\n[done: exit %d]\n", exit.Code))
+	msg, _ := json.Marshal(exit)
+	_ = conn.WriteMessage(websocket.TextMessage, msg)
+	return exit, err
+}
+
+// runCloseCode maps how a remote command ended to the socket's close code.
+func runCloseCode(exitStatus int, err error) (int, string) {
+	switch {
+	case err == nil:
+		return wsCloseOK, "exit 0"
+	case errors.Is(err, sshpkg.ErrConnectionLost):
+		return wsCloseUnreachable, "connection lost"
+	case exitStatus > 0:
+		return wsCloseCommandFailed, fmt.Sprintf("exit %d", exitStatus)
+	}
+	return wsCloseServerError, err.Error()
+}
+
+// maxAuditedScript caps the script text kept in the audit row so a pasted
+// binary doesn't bloat the log; the SHA-256 covers the full body.
+const maxAuditedScript = 4096
+
+// auditScriptStart writes the run.script audit row for one execute-script
+// call before the script runs, so it is on record even if the run never
+// finishes. name is the registry script's name, "" for one the client
+// sent. It returns the row's id for auditScriptEnd.
+func (app *Application) auditScriptStart(r *http.Request, hostID int32, name, script string) int64 {
+	preview := script
+	if len(preview) > maxAuditedScript {
+		preview = preview[:maxAuditedScript] + "…(truncated)"
 	}
-	_ = conn.WriteMessage(websocket.TextMessage, output)
+	hash := sha256.Sum256([]byte(script))
+	details := map[string]interface{}{
+		"script_preview": preview,
+		"script_bytes":   len(script),
+		"script_sha256":  hex.EncodeToString(hash[:]),
+	}
+	if name != "" {
+		details["script_name"] = name
+	}
+	return app.auditBegin(r, audit.ActionRunScript, "host", strconv.FormatInt(int64(hostID), 10), details)
+}
+
+// auditScriptEnd adds how the script ended to its run.script row. exit.Code
+// is the remote exit code, or -1 when the script never produced one (dial
+// failure, lost connection). A row without exit_status is a run that never
+// got this far.
+func (app *Application) auditScriptEnd(ctx context.Context, auditID int64, exit scriptExit, runErr string) {
+	details := map[string]interface{}{"exit_status": exit.Code}
+	if exit.Signal != "" {
+		details["exit_signal"] = exit.Signal
+	}
+	if runErr != "" {
+		details["error"] = runErr
+	}
+	app.auditFinish(ctx, auditID, details)
+}
+
+// scriptExitStatus maps the error from session.CombinedOutput to the remote
+// exit code: 0 on success, the status from an *ssh.ExitError, else -1. A
+// script killed by a signal also gets the signal's name.
+func scriptExitStatus(err error) (code int, signal string) {
+	if err == nil {
+		return 0, ""
+	}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		if sig := exitErr.Signal(); sig != "" {
+			signal = "SIG" + sig
+		}
+		return exitErr.ExitStatus(), signal
+	}
+	return -1, ""
+}
+
+// scriptDryRun is the single message a dry-run execute-script sends back.
+type scriptDryRun struct {
+	DryRun   bool   `json:"dry_run"`
+	HostID   int32  `json:"host_id"`
+	Hostname string `json:"hostname"`
+	SshUser  string `json:"ssh_user"`
+	Command  string `json:"command"`
+}
+
+// writeScriptDryRun reports whether the dry run could be described.
+func (app *Application) writeScriptDryRun(ctx context.Context, conn *wsConn, id int32, script string) bool {
+	host, err := db.GetHost(ctx, app.DB, id)
+	if err != nil {
+		log.Errorf("execute-script dry run: get host %d: %v", id, err)
+		_ = conn.WriteMessage(websocket.TextMessage, []byte("Error: failed to look up host"))
+		return false
+	}
+	msg, _ := json.Marshal(scriptDryRun{
+		DryRun:   true,
+		HostID:   host.ID,
+		Hostname: host.Hostname,
+		SshUser:  host.SshUser,
+		Command:  script,
+	})
+	_ = conn.WriteMessage(websocket.TextMessage, msg)
+	return true
 }
 
 // previewCommands runs read-only and never escalates privileges.
@@ -1324,15 +2638,25 @@ func (app *Application) handlePreviewUpdates(w http.ResponseWriter, r *http.Requ
 
 // handleRunUpdate runs an actual `apt-get upgrade -y` over SSH. This is the
 // "single click to update" entry point — it changes system state, so the
-// frontend gates it behind a confirmation dialog.
+// frontend gates it behind a confirmation dialog. With ?simulate=true it
+// only runs `apt-get -s upgrade` and ends with the parsed plan.
 func (app *Application) handleRunUpdate(w http.ResponseWriter, r *http.Request) {
 	id, err := parseHostID(r)
 	if err != nil {
 		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
 		return
 	}
-	// Look up the host first so we know which ssh_user is configured; that
-	// controls whether the script needs `sudo -n`.
+	// ?ssh_user= runs this one update as another user without touching the
+	// stored one.
+	sshUser := strings.TrimSpace(r.URL.Query().Get("ssh_user"))
+	if sshUser != "" {
+		if err := sshpkg.ValidateUsername(sshUser); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	// Look up the host first so we know which ssh_user is configured (that
+	// controls whether the script needs `sudo -n`) and its update policy.
 	host, err := db.GetHost(r.Context(), app.DB, id)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -1343,8 +2667,61 @@ func (app *Application) handleRunUpdate(w http.ResponseWriter, r *http.Request)
 		writeJSONError(w, http.StatusInternalServerError, "Failed to retrieve host")
 		return
 	}
+	// The schema keeps ssh_user non-empty, but a host without one would
+	// otherwise fail at the SSH handshake with a confusing auth error. Fall
+	// back to DEFAULT_SSH_USER as if it were passed as ?ssh_user=.
+	if sshUser == "" && strings.TrimSpace(host.SshUser) == "" {
+		if app.DefaultSSHUser == "" {
+			writeJSONError(w, http.StatusBadRequest, "Host has no SSH user; set its ssh_user or configure DEFAULT_SSH_USER")
+			return
+		}
+		sshUser = app.DefaultSSHUser
+	}
+	// ?simulate=true is a dry run: apt-get -s shows what the upgrade would
+	// change, recorded as a 'simulate' run so it never counts as an update.
+	if v := r.URL.Query().Get("simulate"); v == "1" || v == "true" {
+		app.runHostCommandOpts(w, r, id, models.RunKindSimulate, updater.SimulateCommands, nil, "", sshUser, models.UpdateHooks{})
+		return
+	}
+	// Past simulate, which changes nothing: a real update of a host in a
+	// guarded environment has to be confirmed.
+	if app.guardedEnvironment(host.Environment) && !requireEnvironmentConfirmation(w, r, []string{host.Environment}) {
+		return
+	}
 	securityOnly := r.URL.Query().Get("security_only") == "1" || r.URL.Query().Get("security_only") == "true"
-	app.runHostCommand(w, r, id, models.RunKindUpdate, []string{updater.BuildUpdateScript(host.SshUser, securityOnly)})
+	// The stored sudo password belongs to the stored user, so a run as
+	// someone else relies on that user's passwordless sudo instead.
+	sudoPassword := ""
+	if sshUser == "" || sshUser == host.SshUser {
+		sudoPassword, err = db.GetSudoPassword(r.Context(), app.DB, id)
+		if errors.Is(err, db.ErrUndecryptable) {
+			log.Errorf("Host %d: %v", id, err)
+			writeJSONError(w, http.StatusConflict, "Stored sudo password cannot be decrypted; set it again")
+			return
+		}
+		if err != nil {
+			log.Errorf("Failed to load sudo password for host %d: %v", id, err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to load sudo password")
+			return
+		}
+	} else {
+		host.SshUser = sshUser
+	}
+	// Hooks only wrap real updates; a simulate run changes nothing for them
+	// to prepare or clean up after.
+	hooks, err := db.GetUpdateHooks(r.Context(), app.DB, id)
+	if err != nil {
+		log.Errorf("Failed to load update hooks for host %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to load update hooks")
+		return
+	}
+	// Hooks saved before EXECUTE_MODE=allowlist was turned on don't run.
+	if app.ScriptsOnly && hooks != (models.UpdateHooks{}) {
+		log.Warnf("Skipping update hooks for host %d: only named scripts are allowed", id)
+		hooks = models.UpdateHooks{}
+	}
+	cmd, stdin := app.UpdateCommands.HostCommand(host, securityOnly, sudoPassword)
+	app.runHostCommandOpts(w, r, id, models.RunKindUpdate, []string{cmd}, nil, stdin, sshUser, hooks)
 }
 
 // runHostCommand is the shared engine for preview/update WebSockets. It:
@@ -1365,26 +2742,43 @@ func runEvents(kind models.RunKind) (failEvent, successEvent string) {
 		return "reboot_failure", "reboot_success"
 	case models.RunKindUpdate:
 		return "update_failure", "update_success"
-	default: // preview
+	default: // preview and simulate, both read-only
 		return "update_failure", "preview_success"
 	}
 }
 
 func (app *Application) runHostCommand(w http.ResponseWriter, r *http.Request, hostID int32, kind models.RunKind, commands []string) {
-	app.runHostCommandOpts(w, r, hostID, kind, commands, nil)
+	app.runHostCommandOpts(w, r, hostID, kind, commands, nil, "", "", models.UpdateHooks{})
 }
 
 // runHostCommandOpts is the shared single-host streaming engine. playbookID is
 // recorded on the run row (nil for preview/update). Preview/update callers go
-// through runHostCommand with nil, so their behavior is unchanged.
-func (app *Application) runHostCommandOpts(w http.ResponseWriter, r *http.Request, hostID int32, kind models.RunKind, commands []string, playbookID *int32) {
-	upgrader := app.wsUpgrader()
-	conn, err := upgrader.Upgrade(w, r, nil)
+// through runHostCommand with nil, so their behavior is unchanged. stdin is
+// fed to each command; update runs use it for the host's sudo password.
+// sshUser overrides the host's stored user for this run only ("" keeps it).
+// hooks run before and after commands; see runUpdatePhases.
+func (app *Application) runHostCommandOpts(w http.ResponseWriter, r *http.Request, hostID int32, kind models.RunKind, commands []string, playbookID *int32, stdin, sshUser string, hooks models.UpdateHooks) {
+	conn, err := app.upgradeWS(w, r)
 	if err != nil {
 		log.Errorf("Failed to upgrade to websocket: %v", err)
 		return
 	}
-	defer conn.Close()
+	// Registered first so it runs last, after the finish line is emitted.
+	closeCode, closeReason := wsCloseServerError, "internal error"
+	defer func() { closeWS(conn, closeCode, closeReason) }()
+
+	// Take a session slot before creating the run row, so a busy server
+	// turns the client away without leaving a failed run behind.
+	release, err := app.SSHLimit.Acquire(r.Context())
+	if err != nil {
+		emit(conn, "Error: "+err.Error())
+		closeCode, closeReason = wsCloseBusy, err.Error()
+		return
+	}
+	defer release()
+	// Keep proxies from idling the socket out while a quiet command runs.
+	stopPings := keepWSAlive(conn, app.WSPingInterval)
+	defer stopPings()
 
 	failEvent, successEvent := runEvents(kind)
 
@@ -1406,7 +2800,12 @@ func (app *Application) runHostCommandOpts(w http.ResponseWriter, r *http.Reques
 		_ = conn.WriteMessage(websocket.TextMessage, []byte("Failed to create run record: "+err.Error()))
 		return
 	}
-	emit(conn, fmt.Sprintf("[run #%d started by %s]\n", run.ID, triggeredBy))
+	if sshUser != "" {
+		emit(conn, fmt.Sprintf("[run #%d started by %s as %s]\n", run.ID, triggeredBy, sshUser))
+	} else {
+		emit(conn, fmt.Sprintf("[run #%d started by %s]\n", run.ID, triggeredBy))
+	}
+	started := time.Now()
 
 	finishStatus := models.RunStatusFailed
 	finishExit := -1
@@ -1415,69 +2814,258 @@ func (app *Application) runHostCommandOpts(w http.ResponseWriter, r *http.Reques
 		if err := db.FinishRun(dbCtx, app.DB, run.ID, finishStatus, finishExit, finishErr); err != nil {
 			log.Errorf("Failed to mark run %d terminal: %v", run.ID, err)
 		}
+		if kind == models.RunKindUpdate {
+			outcome := "failure"
+			if finishStatus == models.RunStatusSucceeded {
+				outcome = "success"
+			}
+			middleware.UpdateRunsTotal.WithLabelValues(outcome).Inc()
+			middleware.UpdateRunDuration.WithLabelValues(outcome).Observe(time.Since(started).Seconds())
+		}
 		emit(conn, fmt.Sprintf("\n[run #%d finished: %s]\n", run.ID, finishStatus))
 	}()
 
-	sshClient, host, err := app.SSHDialer.ConnectToHost(r.Context(), hostID)
+	// Same whole-run budget as the bulk coordinator: a remote command hung on
+	// a prompt fails the run instead of pinning this goroutine until the
+	// websocket dies. cancel-update cancels cancelCtx with errRunCancelled.
+	cancelCtx, cancelRun := context.WithCancelCause(r.Context())
+	defer cancelRun(nil)
+	defer app.runs.add(run.ID, hostID, cancelRun)()
+	runCtx, cancelTimeout := context.WithTimeout(cancelCtx, updater.DefaultRunTimeout)
+	defer cancelTimeout()
+
+	sshClient, host, doneSSH, err := app.SSHDialer.ConnectReusableAs(runCtx, hostID, sshUser)
+	if err != nil && errors.Is(context.Cause(runCtx), errRunCancelled) {
+		finishStatus, finishErr = models.RunStatusCancelled, context.Cause(runCtx).Error()
+		emit(conn, "\n"+finishErr+"\n")
+		closeCode, closeReason = wsCloseCancelled, "cancelled"
+		return
+	}
 	if err != nil {
 		finishErr = fmt.Sprintf("ssh connect: %v", err)
 		log.Errorf("SSH connect to host %d failed: %v", hostID, err)
 		emit(conn, "SSH connect failed: "+err.Error())
 		_, _ = db.AppendRunOutput(dbCtx, app.DB, run.ID, "SSH connect failed: "+err.Error()+"\n")
-		app.dispatchWebhooks(failEvent, map[string]interface{}{"host_id": hostID, "error": err.Error()})
+		app.dispatchEvent(failEvent, hostID, map[string]interface{}{"host_id": hostID, "run_id": run.ID, "error": err.Error()})
+		closeCode, closeReason = wsCloseUnreachable, "ssh connect failed"
 		return
 	}
-	defer sshClient.Close()
-
-	// Same whole-run budget as the bulk coordinator: a remote command hung on
-	// a prompt fails the run instead of pinning this goroutine until the
-	// websocket dies.
-	runCtx, cancelRun := context.WithTimeout(r.Context(), updater.DefaultRunTimeout)
-	defer cancelRun()
+	defer doneSSH()
 
-	for _, cmd := range commands {
-		exitCode, runErr := app.streamCommand(runCtx, conn, sshClient, run.ID, cmd)
-		if runErr != nil {
-			finishErr = runErr.Error()
-			finishExit = exitCode
-			emit(conn, fmt.Sprintf("\nCommand failed (exit %d): %s\n", exitCode, runErr.Error()))
-			app.dispatchWebhooks(failEvent, map[string]interface{}{
-				"host_id": hostID, "run_id": run.ID, "command": cmd, "error": runErr.Error(),
-			})
-			return
-		}
+	cmd, exitCode, runErr := app.runUpdatePhases(runCtx, conn, sshClient, run.ID, hooks, commands, stdin)
+	if errors.Is(runErr, errRunCancelled) {
+		finishStatus, finishErr = models.RunStatusCancelled, runErr.Error()
+		emit(conn, "\n"+finishErr+"\n")
+		closeCode, closeReason = wsCloseCancelled, "cancelled"
+		return
+	}
+	if runErr != nil {
+		finishErr = runErr.Error()
+		finishExit = exitCode
+		emit(conn, fmt.Sprintf("\nCommand failed (exit %d): %s\n", exitCode, runErr.Error()))
+		app.dispatchEvent(failEvent, hostID, map[string]interface{}{
+			"host_id": hostID, "run_id": run.ID, "command": cmd, "error": runErr.Error(),
+		})
+		closeCode, closeReason = runCloseCode(exitCode, runErr)
+		return
 	}
 
 	finishStatus = models.RunStatusSucceeded
 	finishExit = 0
-	if kind == models.RunKindUpdate {
-		// Clear the host's stored error on a successful update so the badge
-		// resets. Pass the host's existing agent-reported fields back so this
-		// SSH-path write doesn't zero out data an agent may have reported.
-		_, _ = db.UpsertHost(dbCtx, app.DB, host.Hostname, host.SshUser, db.ReportData{
-			UpdateOutput:      host.UpdateOutput,
-			UpgradeOutput:     host.UpgradeOutput,
-			Error:             "",
-			RebootRequired:    host.RebootRequired,
-			PackagesUpdated:   host.PackagesUpdated,
-			PackagesAvailable: host.PackagesAvailable,
-			OsVersion:         host.OsVersion,
-			KernelVersion:     host.KernelVersion,
-			AgentVersion:      host.AgentVersion,
+	closeCode, closeReason = wsCloseOK, "exit 0"
+	switch kind {
+	case models.RunKindUpdate:
+		app.recordUpdateOutput(dbCtx, host, run.ID)
+		app.snapshotPackages(dbCtx, sshClient, run.ID)
+	case models.RunKindSimulate:
+		app.emitSimulatePlan(dbCtx, conn, run.ID)
+	}
+	app.dispatchEvent(successEvent, hostID, map[string]interface{}{"host_id": hostID, "run_id": run.ID})
+}
+
+// emitSimulatePlan parses a finished simulate run's output and sends the
+// plan as a final "[plan] {...}" line, so a client gets the planned changes
+// without parsing apt's output itself.
+func (app *Application) emitSimulatePlan(ctx context.Context, conn *wsConn, runID int32) {
+	run, err := db.GetRun(ctx, app.DB, runID)
+	if err != nil {
+		log.Errorf("Failed to read output of run %d: %v", runID, err)
+		return
+	}
+	plan, err := json.Marshal(updater.ParseSimulateOutput(run.Output))
+	if err != nil {
+		log.Errorf("Failed to encode plan for run %d: %v", runID, err)
+		return
+	}
+	emit(conn, "\n[plan] "+string(plan)+"\n")
+}
+
+// hostWriteAttempts bounds recordUpdateOutput's compare-and-set retries. A
+// conflict means an agent report (or another run) landed mid-write; losing
+// to that several times in a row is not worth more tries.
+const hostWriteAttempts = 3
+
+// recordUpdateOutput copies a successful update run onto the host row: the
+// apt-get update part of its output to update_output and the upgrade part to
+// upgrade_output, split at updater.UpgradeMarker. It also clears the host's
+// stored error so the badge resets, and records on the run any packages the
+// upgrade kept back.
+//
+// The host's agent-reported fields are passed back so this SSH-path write
+// doesn't zero them out. They were read when the run started, possibly
+// minutes ago, so the write is a compare-and-set on updated_at: if an agent
+// report or a concurrent run wrote the host meanwhile, re-read it and carry
+// the fresh values instead of silently reverting them.
+func (app *Application) recordUpdateOutput(ctx context.Context, host models.Host, runID int32) {
+	updateOut, upgradeOut := string(host.UpdateOutput), string(host.UpgradeOutput)
+	updateClipped, upgradeClipped := host.UpdateOutputTruncated, host.UpgradeOutputTruncated
+	if run, err := db.GetRun(ctx, app.DB, runID); err != nil {
+		log.Errorf("Failed to read output of run %d: %v", runID, err)
+	} else {
+		// A run clipped at MaxRunOutputBytes lost its tail, which is
+		// whichever part the split leaves last.
+		clipped := strings.HasSuffix(run.Output, db.RunOutputTruncatedMarker)
+		updateOut, upgradeOut = updater.SplitUpdateOutput(run.Output)
+		updateClipped, upgradeClipped = clipped && upgradeOut == "", clipped && upgradeOut != ""
+		if err := updater.RecordKeptBack(ctx, app.DB, runID, upgradeOut); err != nil {
+			log.Errorf("Failed to record kept-back packages: %v", err)
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		_, err := db.UpsertHost(ctx, app.DB, host.Hostname, host.SshUser, db.ReportData{
+			UpdateOutput:           updateOut,
+			UpgradeOutput:          upgradeOut,
+			UpdateOutputTruncated:  updateClipped,
+			UpgradeOutputTruncated: upgradeClipped,
+			Error:                  "",
+			RebootRequired:         host.RebootRequired,
+			PackagesUpdated:        host.PackagesUpdated,
+			PackagesAvailable:      host.PackagesAvailable,
+			OsVersion:              host.OsVersion,
+			KernelVersion:          host.KernelVersion,
+			AgentVersion:           host.AgentVersion,
+			Architecture:           host.Architecture,
+			IfUpdatedAt:            host.UpdatedAt,
+			MaxOutputBytes:         app.HostOutputMaxBytes,
+			CompressOutputBytes:    app.HostOutputCompressBytes,
 		})
+		if !errors.Is(err, db.ErrHostChanged) || attempt == hostWriteAttempts {
+			if err != nil {
+				log.Errorf("Failed to record update output on host %d: %v", host.ID, err)
+			}
+			return
+		}
+		if host, err = db.GetHost(ctx, app.DB, host.ID); err != nil {
+			log.Errorf("Failed to re-read host %d after a concurrent write: %v", host.ID, err)
+			return
+		}
+	}
+}
+
+// runUpdatePhases runs hooks.PreUpdateCommand, then commands in order, then
+// hooks.PostUpdateCommand, stopping at the first failing command. It returns
+// the command that failed with its exit code and error, or zero values.
+//
+// A failing pre-update hook aborts the run before commands start. The
+// post-update hook runs after commands even if one failed, so a hook that
+// restarts what the pre-update hook stopped still gets to, but its own
+// failure only warns: the update has already happened. It is skipped once
+// the run is cancelled or timed out, or the connection is gone.
+//
+// Hook output goes to the websocket but not the run's output, which
+// recordUpdateOutput splits into the host's update/upgrade output; it is
+// kept per hook in update_run_hooks instead.
+func (app *Application) runUpdatePhases(ctx context.Context, conn *wsConn, client *ssh.Client, runID int32, hooks models.UpdateHooks, commands []string, stdin string) (string, int, error) {
+	if cmd := hooks.PreUpdateCommand; cmd != "" {
+		exitCode, err := app.runHook(ctx, conn, client, runID, models.HookPhasePre, cmd)
+		if errors.Is(err, errRunCancelled) {
+			return cmd, exitCode, err
+		}
+		if err != nil {
+			return cmd, exitCode, fmt.Errorf("pre-update hook failed, update not run: %w", err)
+		}
+	}
+
+	failedCmd, exitCode, runErr := "", 0, error(nil)
+	for _, cmd := range commands {
+		if exitCode, runErr = app.streamCommand(ctx, conn, client, runID, cmd, stdin); runErr != nil {
+			failedCmd = cmd
+			break
+		}
+	}
+
+	if cmd := hooks.PostUpdateCommand; cmd != "" && ctx.Err() == nil && !errors.Is(runErr, sshpkg.ErrConnectionLost) {
+		if _, err := app.runHook(ctx, conn, client, runID, models.HookPhasePost, cmd); err != nil {
+			log.Warnf("Post-update hook of run %d failed: %v", runID, err)
+			emit(conn, fmt.Sprintf("\nWarning: post-update hook failed: %v\n", err))
+		}
+	}
+	return failedCmd, exitCode, runErr
+}
+
+// runHook runs one update hook and records its output in update_run_hooks.
+// Hooks get no stdin: the sudo password is for the update command only.
+func (app *Application) runHook(ctx context.Context, conn *wsConn, client *ssh.Client, runID int32, phase models.HookPhase, cmd string) (int, error) {
+	emit(conn, fmt.Sprintf("[%s-update hook]\n", phase))
+	var out hookOutput
+	exitCode, err := app.streamCommandTo(ctx, conn, client, cmd, "", out.record)
+	// Recorded even when the run was cancelled mid-hook.
+	if rerr := db.RecordRunHook(context.WithoutCancel(ctx), app.DB, runID, phase, cmd, exitCode, out.String()); rerr != nil {
+		log.Errorf("Failed to record hook output: %v", rerr)
+	}
+	return exitCode, err
+}
+
+// hookOutput collects a hook's output from both pumps, keeping the first
+// db.MaxHookOutputBytes. The cut never splits a UTF-8 sequence.
+type hookOutput struct {
+	mu   sync.Mutex
+	buf  strings.Builder
+	full bool
+}
+
+func (o *hookOutput) record(_ context.Context, chunk string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.full {
+		return
+	}
+	if room := db.MaxHookOutputBytes - o.buf.Len(); len(chunk) > room {
+		for room > 0 && !utf8.RuneStart(chunk[room]) {
+			room--
+		}
+		chunk, o.full = chunk[:room], true
 	}
-	app.dispatchWebhooks(successEvent, map[string]interface{}{"host_id": hostID, "run_id": run.ID})
+	o.buf.WriteString(chunk)
+}
+
+func (o *hookOutput) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.String()
 }
 
 // streamCommand runs one shell line on the existing SSH client, fans
 // stdout/stderr to (a) the websocket and (b) the run row's output column,
 // and returns the remote exit code (-1 if the SSH layer itself failed).
-func (app *Application) streamCommand(ctx context.Context, conn *websocket.Conn, client *ssh.Client, runID int32, cmd string) (int, error) {
+func (app *Application) streamCommand(ctx context.Context, conn *wsConn, client *ssh.Client, runID int32, cmd, stdin string) (int, error) {
+	return app.streamCommandTo(ctx, conn, client, cmd, stdin, func(dbCtx context.Context, chunk string) {
+		// AppendRunOutput is a no-op past the cap.
+		_, _ = db.AppendRunOutput(dbCtx, app.DB, runID, chunk)
+	})
+}
+
+// streamCommandTo is streamCommand with the persistent side left to record,
+// which is called with each chunk of output from either stream.
+func (app *Application) streamCommandTo(ctx context.Context, conn *wsConn, client *ssh.Client, cmd, stdin string, record func(ctx context.Context, chunk string)) (int, error) {
 	session, err := client.NewSession()
 	if err != nil {
 		return -1, fmt.Errorf("create ssh session: %w", err)
 	}
 	defer session.Close()
+	if stdin != "" {
+		session.Stdin = strings.NewReader(stdin)
+	}
 
 	stdout, err := session.StdoutPipe()
 	if err != nil {
@@ -1501,19 +3089,25 @@ func (app *Application) streamCommand(ctx context.Context, conn *websocket.Conn,
 
 	var wg sync.WaitGroup
 	wg.Add(2)
-	go func() { defer wg.Done(); pumpReader(ctx, dbCtx, conn, app.DB, runID, stdout) }()
-	go func() { defer wg.Done(); pumpReader(ctx, dbCtx, conn, app.DB, runID, stderr) }()
+	go func() { defer wg.Done(); pumpReader(ctx, dbCtx, conn, stdout, record) }()
+	go func() { defer wg.Done(); pumpReader(ctx, dbCtx, conn, stderr, record) }()
 
-	// On run-timeout (or client disconnect) close the session and client so
-	// the pumps and Wait unblock; otherwise a hung remote command leaks this
-	// goroutine.
+	// On run-timeout, cancel-update or client disconnect, signal the remote
+	// command and close the session and client so the pumps and Wait
+	// unblock; otherwise a hung remote command leaks this goroutine.
 	err, timedOut := sshpkg.WaitWithAbort(ctx,
 		func() error { wg.Wait(); return session.Wait() },
-		func() { session.Close(); client.Close() },
+		func() { _ = session.Signal(ssh.SIGTERM); session.Close(); client.Close() },
 	)
 	if timedOut {
+		if cause := context.Cause(ctx); errors.Is(cause, errRunCancelled) {
+			return -1, cause
+		}
 		return -1, errors.New("run timed out; remote command killed")
 	}
+	if err != nil && sshpkg.ConnectionLost(client) {
+		return -1, sshpkg.ErrConnectionLost
+	}
 	if err == nil {
 		return 0, nil
 	}
@@ -1524,11 +3118,11 @@ func (app *Application) streamCommand(ctx context.Context, conn *websocket.Conn,
 	return -1, err
 }
 
-// pumpReader copies a reader to the websocket and the DB row in 4 KiB chunks.
+// pumpReader copies a reader to the websocket and record in 4 KiB chunks.
 // Backpressure: the websocket write is the slow path; if a client is gone the
-// chunk is silently dropped and we keep persisting to DB so history remains
+// chunk is silently dropped and we keep recording so history remains
 // accurate.
-func pumpReader(ctx context.Context, dbCtx context.Context, conn *websocket.Conn, pool db.DBTX, runID int32, src io.Reader) {
+func pumpReader(ctx context.Context, dbCtx context.Context, conn *wsConn, src io.Reader, record func(context.Context, string)) {
 	buf := make([]byte, 4096)
 	for {
 		select {
@@ -1541,8 +3135,7 @@ func pumpReader(ctx context.Context, dbCtx context.Context, conn *websocket.Conn
 			chunk := string(buf[:n])
 			// Best-effort write to the websocket — connection might be closed.
 			_ = conn.WriteMessage(websocket.TextMessage, []byte(chunk))
-			// Persistent record. AppendRunOutput is a no-op past the cap.
-			_, _ = db.AppendRunOutput(dbCtx, pool, runID, chunk)
+			record(dbCtx, chunk)
 		}
 		if err != nil {
 			return
@@ -1550,7 +3143,7 @@ func pumpReader(ctx context.Context, dbCtx context.Context, conn *websocket.Conn
 	}
 }
 
-func emit(conn *websocket.Conn, line string) {
+func emit(conn *wsConn, line string) {
 	_ = conn.WriteMessage(websocket.TextMessage, []byte(line))
 }
 
@@ -1570,8 +3163,8 @@ func (app *Application) handleListRuns(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	// Cap to prevent memory exhaustion on malicious limit values.
-	if limit > 200 {
-		limit = 200
+	if limit > db.MaxRunsPerPage {
+		limit = db.MaxRunsPerPage
 	}
 
 	runs, err := db.ListRunsForHost(r.Context(), app.DB, id, limit)
@@ -1608,27 +3201,85 @@ func (app *Application) handleListRunsByGroup(w http.ResponseWriter, r *http.Req
 	json.NewEncoder(w).Encode(runs)
 }
 
+// handleListRunPhases returns the phases of a bulk run_group_id with each
+// one's hosts and outcome, so the UI can show where a staged rollout got to.
+func (app *Application) handleListRunPhases(w http.ResponseWriter, r *http.Request) {
+	group := r.URL.Query().Get("group_id")
+	if group == "" || !uuidPattern.MatchString(group) {
+		writeJSONError(w, http.StatusBadRequest, "group_id query parameter required (UUID format)")
+		return
+	}
+	phases, err := db.ListRunPhases(r.Context(), app.DB, group)
+	if err != nil {
+		log.Errorf("Failed to list phases for group %s: %v", group, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to retrieve run phases")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(phases)
+}
+
 // handleBulkRunUpdate fans an apt-get upgrade across many hosts. Bounded by
 // MaxConcurrency in the updater package; further constrained by an in-flight
 // "one bulk per server" cap so an over-eager operator can't pile up a hundred
-// fan-outs in parallel.
+// fan-outs in parallel. policy picks the rollout: parallel, canary (a sample
+// of canary_count hosts first, the rest only if it passed) or rolling
+// (batch_size hosts at a time); see updater.BulkRunOptions.
 func (app *Application) handleBulkRunUpdate(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
 
 	var req struct {
-		HostIDs           []int32 `json:"host_ids"`
-		Concurrency       int     `json:"concurrency,omitempty"`
-		CanaryCount       int     `json:"canary_count,omitempty"`
-		CanaryWaitSeconds int     `json:"canary_wait_seconds,omitempty"`
-		AbortOnFailurePct int     `json:"abort_on_failure_pct,omitempty"`
-		SecurityOnly      bool    `json:"security_only,omitempty"`
+		HostIDs           []int32        `json:"host_ids"`
+		Tag               string         `json:"tag,omitempty"`
+		Concurrency       int            `json:"concurrency,omitempty"`
+		Policy            updater.Policy `json:"policy,omitempty"`
+		CanaryCount       int            `json:"canary_count,omitempty"`
+		CanaryWaitSeconds int            `json:"canary_wait_seconds,omitempty"`
+		BatchSize         int            `json:"batch_size,omitempty"`
+		AbortOnFailurePct int            `json:"abort_on_failure_pct,omitempty"`
+		SecurityOnly      bool           `json:"security_only,omitempty"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if req.Policy != "" && !req.Policy.Valid() {
+		writeJSONError(w, http.StatusBadRequest, "policy must be 'parallel', 'canary' or 'rolling'")
+		return
+	}
+	if req.CanaryCount < 0 || req.BatchSize < 0 {
+		writeJSONError(w, http.StatusBadRequest, "canary_count and batch_size must be >= 0")
 		return
 	}
+	if req.Tag != "" {
+		// Target a fleet segment instead of an explicit list. The tag is
+		// resolved once, here: hosts tagged after this point aren't included.
+		if len(req.HostIDs) > 0 {
+			writeJSONError(w, http.StatusBadRequest, "Specify host_ids or tag, not both")
+			return
+		}
+		tag, ok := normalizeTag(req.Tag)
+		if !ok {
+			writeJSONError(w, http.StatusBadRequest, "tag must be 1-64 characters")
+			return
+		}
+		hosts, err := db.ListHostsByTag(r.Context(), app.DB, tag, false)
+		if err != nil {
+			log.Errorf("Failed to resolve tag %q: %v", tag, err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to resolve tag")
+			return
+		}
+		if len(hosts) == 0 {
+			writeJSONError(w, http.StatusNotFound, "No hosts carry tag "+tag)
+			return
+		}
+		for _, h := range hosts {
+			req.HostIDs = append(req.HostIDs, h.ID)
+		}
+		req.Tag = tag
+	}
 	if len(req.HostIDs) == 0 {
-		writeJSONError(w, http.StatusBadRequest, "host_ids must not be empty")
+		writeJSONError(w, http.StatusBadRequest, "host_ids or tag is required")
 		return
 	}
 	if len(req.HostIDs) > 200 {
@@ -1636,6 +3287,34 @@ func (app *Application) handleBulkRunUpdate(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// Hosts outside their maintenance window are left out and listed in the
+	// response. The single-host run-update stays ungated for emergencies.
+	requested := len(req.HostIDs)
+	hostIDs, skipped, err := maintenance.Gate(r.Context(), app.DB, req.HostIDs, time.Now())
+	if err != nil {
+		log.Errorf("bulk update maintenance windows: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to check maintenance windows")
+		return
+	}
+	if len(hostIDs) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bulkRunResponse{BulkResult: updater.BulkResult{RunIDs: []int32{}, HostIDs: []int32{}}, Skipped: skipped})
+		return
+	}
+	req.HostIDs = hostIDs
+
+	if len(app.RequireConfirmEnv) > 0 {
+		guarded, err := db.HostEnvironmentsIn(r.Context(), app.DB, req.HostIDs, app.RequireConfirmEnv)
+		if err != nil {
+			log.Errorf("bulk update environments: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to check host environments")
+			return
+		}
+		if !requireEnvironmentConfirmation(w, r, guarded) {
+			return
+		}
+	}
+
 	// Cheap rate-limit: one bulk group at a time per server. The plan called
 	// out per-user, but with single-admin auth today this is equivalent.
 	if app.BulkUpdater.InFlightCount() >= 1 {
@@ -1653,8 +3332,10 @@ func (app *Application) handleBulkRunUpdate(w http.ResponseWriter, r *http.Reque
 		HostIDs:           req.HostIDs,
 		Concurrency:       req.Concurrency,
 		TriggeredBy:       triggeredBy,
+		Policy:            req.Policy,
 		CanaryCount:       req.CanaryCount,
 		CanaryWaitSeconds: req.CanaryWaitSeconds,
+		BatchSize:         req.BatchSize,
 		AbortOnFailurePct: req.AbortOnFailurePct,
 		SecurityOnly:      req.SecurityOnly,
 	})
@@ -1668,13 +3349,24 @@ func (app *Application) handleBulkRunUpdate(w http.ResponseWriter, r *http.Reque
 	app.audit(r, audit.ActionRunBulkUpdate, "run_group", result.GroupID,
 		map[string]interface{}{
 			"host_count":           len(req.HostIDs),
+			"policy":               result.Policy,
 			"canary_count":         req.CanaryCount,
 			"canary_wait_seconds":  req.CanaryWaitSeconds,
+			"batch_size":           req.BatchSize,
 			"abort_on_failure_pct": req.AbortOnFailurePct,
+			"tag":                  req.Tag,
+			"skipped_count":        requested - len(req.HostIDs),
 		})
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
-	json.NewEncoder(w).Encode(result)
+	json.NewEncoder(w).Encode(bulkRunResponse{BulkResult: result, Skipped: skipped})
+}
+
+// bulkRunResponse is the bulk run-update reply: the started group plus any
+// hosts held back by their maintenance window.
+type bulkRunResponse struct {
+	updater.BulkResult
+	Skipped []maintenance.Skipped `json:"skipped,omitempty"`
 }
 
 // handleGetRun returns a single run by id, including its full output buffer.
@@ -1704,25 +3396,3 @@ func (app *Application) handleGetRun(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(run)
 }
-
-func (app *Application) handleHealth(w http.ResponseWriter, r *http.Request) {
-	if err := app.DB.Ping(r.Context()); err != nil {
-		log.Errorf("Database health check failed: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusServiceUnavailable)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"status":    "unhealthy",
-			"database":  "disconnected",
-			"timestamp": time.Now().UTC().Format(time.RFC3339),
-		})
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":    "healthy",
-		"database":  "connected",
-		"timestamp": time.Now().UTC().Format(time.RFC3339),
-	})
-}
@@ -5,18 +5,28 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/pashagolub/pgxmock/v4"
+	"ubuntu-auto-update/backend/pkg/config"
+	"ubuntu-auto-update/backend/pkg/db"
+	"ubuntu-auto-update/backend/pkg/email"
 	"ubuntu-auto-update/backend/pkg/middleware"
 	"ubuntu-auto-update/backend/pkg/models"
 	"ubuntu-auto-update/backend/pkg/session"
+	"ubuntu-auto-update/backend/pkg/users"
 )
 
 // testApp creates an Application for testing with a token store but no real DB.
@@ -140,12 +150,225 @@ func TestHandleLogin_InvalidJSON(t *testing.T) {
 	}
 }
 
+// A DB user logs in with their own role, even while the env admin is set.
+func TestHandleLogin_DBUserGetsRole(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.Sessions = session.NewMemoryStore()
+	t.Setenv("ADMIN_USERNAME", "carol")
+	t.Setenv("ADMIN_PASSWORD", "env-password-123")
+
+	hash, err := users.HashPassword("operator-pass-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery(`SELECT id, password_hash, role`).WithArgs("carol").
+		WillReturnRows(mock.NewRows([]string{"id", "password_hash", "role", "disabled_at", "failed_logins", "locked_until"}).
+			AddRow(int32(5), hash, "operator", nil, int32(0), nil))
+	mock.ExpectExec(`UPDATE users`).WithArgs(int32(5)).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectExec(`INSERT INTO refresh_tokens`).
+		WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), int32(5), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	expectAudit(mock)
+
+	body, _ := json.Marshal(LoginRequest{Username: "carol", Password: "operator-pass-1"})
+	rr := httptest.NewRecorder()
+	app.handleLogin(rr, httptest.NewRequest(http.MethodPost, "/api/v1/login", bytes.NewReader(body)))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp["role"] != "operator" {
+		t.Errorf("role = %q, want operator", resp["role"])
+	}
+	if resp["refresh_token"] == "" {
+		t.Error("login issued no refresh token")
+	}
+	p, ok, err := app.Sessions.Validate(context.Background(), resp["token"])
+	if err != nil || !ok {
+		t.Fatalf("session not stored: ok=%v err=%v", ok, err)
+	}
+	if p.UserID != 5 || p.Role != "operator" {
+		t.Errorf("session principal = %+v", p)
+	}
+	if p.HasRole(session.RoleAdmin) {
+		t.Error("operator session passes an admin-only check")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// With a DB, a wrong password is a 401 even if it matches ADMIN_PASSWORD:
+// the env pair only seeds the first admin.
+func TestHandleLogin_DBUserWrongPassword(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.Sessions = session.NewMemoryStore()
+	t.Setenv("ADMIN_USERNAME", "carol")
+	t.Setenv("ADMIN_PASSWORD", "env-password-123")
+
+	hash, err := users.HashPassword("operator-pass-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectQuery(`SELECT id, password_hash, role`).WithArgs("carol").
+		WillReturnRows(mock.NewRows([]string{"id", "password_hash", "role", "disabled_at", "failed_logins", "locked_until"}).
+			AddRow(int32(5), hash, "operator", nil, int32(0), nil))
+	mock.ExpectExec(`UPDATE users SET failed_logins`).WithArgs(int32(5), int32(1)).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	expectAudit(mock)
+
+	body, _ := json.Marshal(LoginRequest{Username: "carol", Password: "env-password-123"})
+	rr := httptest.NewRecorder()
+	app.handleLogin(rr, httptest.NewRequest(http.MethodPost, "/api/v1/login", bytes.NewReader(body)))
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
 // --- handleEnroll tests ---
 
+// expectEnrollHost mocks db.EnrollHost. created controls whether the row
+// looks freshly inserted (last_seen == created_at) or re-enrolled.
+func expectEnrollHost(mock pgxmock.PgxPoolIface, hostname string, created bool) {
+	createdAt := time.Now().Add(-time.Hour)
+	lastSeen := time.Now()
+	if created {
+		createdAt = lastSeen
+	}
+	mock.ExpectQuery(`INSERT INTO hosts .+ ON CONFLICT \(hostname\) DO UPDATE SET last_seen = NOW\(\)`).
+		WithArgs(hostname).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(42), hostname, "root", createdAt, createdAt, lastSeen, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+}
+
+var agentTokenCols = []string{"id", "host_id", "created_at", "expires_at", "last_used_at", "created_ip", "revoked_at", "revoked_by"}
+
+// expectAgentToken mocks db.CreateAgentToken issuing token 5 to hostID.
+func expectAgentToken(mock pgxmock.PgxPoolIface, hostID int32) {
+	now := time.Now()
+	mock.ExpectQuery(`INSERT INTO agent_tokens`).
+		WithArgs(hostID, pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnRows(mock.NewRows(agentTokenCols).
+			AddRow(int32(5), hostID, now, now.Add(agentTokenTTL), nil, "192.0.2.1", nil, ""))
+}
+
+// expectAgentTokensHeld mocks db.HostHasAgentTokens, the check a reusable
+// enrollment token goes through before enrolling hostname.
+func expectAgentTokensHeld(mock pgxmock.PgxPoolIface, hostname string, held bool) {
+	mock.ExpectQuery(`SELECT EXISTS .+ FROM agent_tokens`).
+		WithArgs(hostname).
+		WillReturnRows(mock.NewRows([]string{"exists"}).AddRow(held))
+}
+
+var webhookCols = []string{"id", "url", "event", "format", "host_id", "tag"}
+
+// expectWebhookLookup expects dispatchEvent to store event on hostID and
+// queue it for its subscribers, finding none.
+func expectWebhookLookup(mock pgxmock.PgxPoolIface, event string, hostID int32) {
+	mock.ExpectQuery(`INSERT INTO events`).
+		WithArgs(event, hostID, pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnRows(mock.NewRows(append([]string{"event_id"}, webhookCols...)).
+			AddRow(int64(1), int32(0), "", "", "", nil, nil))
+}
+
+// Run events are keyed by event, host and run; events without a run aren't
+// deduplicated.
+func TestEventKey(t *testing.T) {
+	cases := []struct {
+		event   string
+		payload interface{}
+		want    string
+	}{
+		{"update_failure", map[string]interface{}{"host_id": int32(3), "run_id": int32(17)}, "update_failure:host=3:run=17"},
+		{"update_success", map[string]interface{}{"host_id": int32(3), "run_id": int32(17)}, "update_success:host=3:run=17"},
+		{"update_failure", map[string]interface{}{"run_id": 17}, "update_failure:host=3:run=17"},
+		{"update_failure", map[string]interface{}{"run_id": int64(17)}, "update_failure:host=3:run=17"},
+		{"update_failure", map[string]interface{}{"run_id": json.Number("17")}, "update_failure:host=3:run=17"},
+		{"host_offline", map[string]interface{}{"host_id": int32(3)}, ""},
+		{"host_registered", nil, ""},
+	}
+	for _, c := range cases {
+		if got := eventKey(c.event, 3, c.payload); got != c.want {
+			t.Errorf("eventKey(%s, %v) = %q, want %q", c.event, c.payload, got, c.want)
+		}
+	}
+}
+
+// A run event another replica already stored is neither delivered nor
+// mailed again.
+func TestDispatchEvent_RepeatNotMailed(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	// The relay only counts connections; each send then fails and is logged.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var dials atomic.Int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			dials.Add(1)
+			c.Close()
+		}
+	}()
+	app.Mailer = email.NewNotifier(config.EmailConfig{
+		Host: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port, TLS: config.SMTPTLSNone,
+		From: "uau@example.com", To: []string{"ops@example.com"}, Timeout: time.Second,
+	})
+	payload := map[string]interface{}{"host_id": int32(3), "run_id": int32(17), "error": "apt failed"}
+
+	expectWebhookLookup(mock, "update_failure", 3)
+	app.dispatchEvent("update_failure", 3, payload)
+	app.Mailer.Wait()
+	if n := dials.Load(); n != 1 {
+		t.Fatalf("first event: %d mails, want 1", n)
+	}
+
+	mock.ExpectQuery(`INSERT INTO events`).
+		WithArgs("update_failure", int32(3), "update_failure:host=3:run=17", pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnRows(mock.NewRows(append([]string{"event_id"}, webhookCols...)))
+	app.dispatchEvent("update_failure", 3, payload)
+	app.Mailer.Wait()
+	if n := dials.Load(); n != 1 {
+		t.Errorf("repeat: %d mails in all, want 1", n)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
 func TestHandleEnroll_Success(t *testing.T) {
-	app := testApp(t)
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
 	t.Setenv("ENROLLMENT_TOKEN", "test-enroll-token")
 
+	expectAgentTokensHeld(mock, "test-host", false)
+	expectEnrollHost(mock, "test-host", true)
+	expectAgentToken(mock, 42)
+	mock.ExpectExec(`INSERT INTO audit_log`).
+		WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	for _, event := range []string{"host_registered", "host_enrolled"} {
+		expectWebhookLookup(mock, event, 42)
+	}
+
 	body, _ := json.Marshal(map[string]string{
 		"enrollment_token": "test-enroll-token",
 		"hostname":         "test-host",
@@ -159,12 +382,81 @@ func TestHandleEnroll_Success(t *testing.T) {
 		t.Errorf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
 	}
 
-	var resp map[string]string
+	var resp enrollResponse
 	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
 		t.Fatalf("failed to parse response: %v", err)
 	}
-	if resp["token"] == "" {
-		t.Error("expected non-empty token")
+	if !strings.HasPrefix(resp.Token, db.AgentTokenPrefix) {
+		t.Errorf("token = %q, want an agent token", resp.Token)
+	}
+	if resp.HostID != 42 || resp.TokenID != 5 || resp.ExpiresAt.IsZero() {
+		t.Errorf("response = %+v, want host 42, token 5 and an expiry", resp)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// An archived host's agent tokens are refused, so enrolling it is refused
+// too, before a token is issued or the enroll is announced.
+func TestHandleEnroll_ArchivedHost(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	t.Setenv("ENROLLMENT_TOKEN", "test-enroll-token")
+
+	expectAgentTokensHeld(mock, "test-host", false)
+	mock.ExpectQuery(`INSERT INTO hosts .+ WHERE hosts.deleted_at IS NULL`).
+		WithArgs("test-host").
+		WillReturnRows(mock.NewRows(hostCols))
+
+	body, _ := json.Marshal(map[string]string{"enrollment_token": "test-enroll-token", "hostname": "test-host"})
+	rr := httptest.NewRecorder()
+	app.handleEnroll(rr, httptest.NewRequest(http.MethodPost, "/api/v1/enroll", bytes.NewReader(body)))
+	if rr.Code != http.StatusConflict || !strings.Contains(rr.Body.String(), "restore it first") {
+		t.Errorf("expected 409 asking for a restore, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestHandleEnroll_HostListedImmediately(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	t.Setenv("ENROLLMENT_TOKEN", "test-enroll-token")
+
+	// Re-enrolling an existing host: no host_registered, only host_enrolled.
+	expectAgentTokensHeld(mock, "test-host", false)
+	expectEnrollHost(mock, "test-host", false)
+	expectAgentToken(mock, 42)
+	mock.ExpectExec(`INSERT INTO audit_log`).
+		WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	expectWebhookLookup(mock, "host_enrolled", 42)
+
+	body, _ := json.Marshal(map[string]string{"enrollment_token": "test-enroll-token", "hostname": "test-host"})
+	rr := httptest.NewRecorder()
+	app.handleEnroll(rr, httptest.NewRequest(http.MethodPost, "/api/v1/enroll", bytes.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("enroll: expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	now := time.Now()
+	mock.ExpectQuery(`SELECT .+ FROM hosts WHERE deleted_at IS NULL ORDER BY hostname`).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(42), "test-host", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+	rr = httptest.NewRecorder()
+	app.handleListHosts(rr, httptest.NewRequest(http.MethodGet, "/api/v1/hosts", nil))
+
+	var hosts []models.Host
+	if err := json.Unmarshal(rr.Body.Bytes(), &hosts); err != nil {
+		t.Fatalf("list: %v: %s", err, rr.Body.String())
+	}
+	if len(hosts) != 1 || hosts[0].ID != 42 || hosts[0].Hostname != "test-host" {
+		t.Errorf("enrolled host not listed: %+v", hosts)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
 	}
 }
 
@@ -204,9 +496,10 @@ func TestHandleEnroll_EmptyHostname(t *testing.T) {
 	}
 }
 
-func TestHandleEnroll_MissingEnrollmentConfig(t *testing.T) {
+// Without ENROLLMENT_TOKEN, only tokens minted with create-token enroll.
+func TestHandleEnroll_NoSharedTokenRejectsUnknown(t *testing.T) {
 	app := testApp(t)
-	os.Unsetenv("ENROLLMENT_TOKEN")
+	t.Setenv("ENROLLMENT_TOKEN", "")
 
 	body, _ := json.Marshal(map[string]string{
 		"enrollment_token": "any-token",
@@ -217,8 +510,8 @@ func TestHandleEnroll_MissingEnrollmentConfig(t *testing.T) {
 
 	app.handleEnroll(rr, req)
 
-	if rr.Code != http.StatusInternalServerError {
-		t.Errorf("expected status 500 when enrollment not configured, got %d", rr.Code)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", rr.Code)
 	}
 }
 
@@ -417,49 +710,54 @@ func TestCorsMiddleware_UnknownOriginNotAllowed(t *testing.T) {
 	}
 }
 
-// --- handleHealth tests (requires DB, so we test the error path) ---
-
-func TestHandleHealth_Success(t *testing.T) {
-	app, mock := testAppWithDB(t)
-	defer mock.Close()
+// --- handleReport tests ---
 
-	mock.ExpectPing()
+func TestHandleReport_InvalidJSON(t *testing.T) {
+	app := testApp(t)
 
-	req := httptest.NewRequest(http.MethodGet, "/api/v1/health", nil)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/report", bytes.NewReader([]byte("not json")))
 	rr := httptest.NewRecorder()
-	app.handleHealth(rr, req)
+	app.handleReport(rr, req)
 
-	if rr.Code != http.StatusOK {
-		t.Errorf("expected 200, got %d", rr.Code)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rr.Code)
 	}
 }
 
-func TestHandleHealth_DBError(t *testing.T) {
-	app, mock := testAppWithDB(t)
-	defer mock.Close()
+// oversizedReport is a syntactically valid report just over maxRequestBodySize.
+func oversizedReport() []byte {
+	body, _ := json.Marshal(map[string]interface{}{
+		"hostname":       "big-host",
+		"update_results": map[string]string{"apt_output": strings.Repeat("x", int(maxRequestBodySize))},
+	})
+	return body
+}
 
-	mock.ExpectPing().WillReturnError(sql.ErrConnDone)
+func TestHandleReport_TooLarge(t *testing.T) {
+	app := testApp(t)
 
-	req := httptest.NewRequest(http.MethodGet, "/api/v1/health", nil)
+	// Hide the length so the body is cut off mid-decode, as with a chunked
+	// upload that never declared its size.
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/report", io.MultiReader(bytes.NewReader(oversizedReport())))
+	req.ContentLength = -1
 	rr := httptest.NewRecorder()
-	app.handleHealth(rr, req)
+	app.handleReport(rr, req)
 
-	if rr.Code != http.StatusServiceUnavailable {
-		t.Errorf("expected 503, got %d", rr.Code)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got %d", rr.Code)
 	}
 }
 
-// --- handleReport tests ---
-
-func TestHandleReport_InvalidJSON(t *testing.T) {
+func TestMaxBodySize_RejectsDeclaredLength(t *testing.T) {
 	app := testApp(t)
+	h := middleware.MaxBodySize(maxRequestBodySize)(http.HandlerFunc(app.handleReport))
 
-	req := httptest.NewRequest(http.MethodPost, "/api/v1/report", bytes.NewReader([]byte("not json")))
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/report", bytes.NewReader(oversizedReport()))
 	rr := httptest.NewRecorder()
-	app.handleReport(rr, req)
+	h.ServeHTTP(rr, req)
 
-	if rr.Code != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", rr.Code)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got %d", rr.Code)
 	}
 }
 
@@ -520,6 +818,57 @@ func TestHandleAddWebhook_InvalidURL(t *testing.T) {
 	}
 }
 
+func TestHandleAddWebhook_InvalidFormat(t *testing.T) {
+	app := testApp(t)
+
+	body, _ := json.Marshal(map[string]string{"url": "https://hooks.slack.com/x", "event": "update_failure", "format": "discord"})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/webhooks", bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	app.handleAddWebhook(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unknown format, got %d", rr.Code)
+	}
+}
+
+func TestHandleAddWebhook_Scoped(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	hostID, tag := int32(7), "web-tier"
+	mock.ExpectQuery(`INSERT INTO webhooks`).
+		WithArgs("https://hooks.example.com/a", "update_failure", "raw", &hostID, (*string)(nil)).
+		WillReturnRows(mock.NewRows([]string{"id"}).AddRow(int32(1)))
+	expectAudit(mock)
+	mock.ExpectQuery(`INSERT INTO webhooks`).
+		WithArgs("https://hooks.example.com/b", "update_failure", "raw", (*int32)(nil), &tag).
+		WillReturnRows(mock.NewRows([]string{"id"}).AddRow(int32(2)))
+	expectAudit(mock)
+	mock.ExpectQuery(`INSERT INTO webhooks`).
+		WithArgs("https://hooks.example.com/c", "update_failure", "raw", pgxmock.AnyArg(), (*string)(nil)).
+		WillReturnError(&pgconn.PgError{Code: "23503"})
+
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`{"url": "https://hooks.example.com/a", "event": "update_failure", "host_id": 7}`, http.StatusCreated},
+		{`{"url": "https://hooks.example.com/b", "event": "update_failure", "tag": " web-tier "}`, http.StatusCreated},
+		{`{"url": "https://hooks.example.com/c", "event": "update_failure", "host_id": 999}`, http.StatusNotFound},
+		{`{"url": "https://hooks.example.com/d", "event": "update_failure", "host_id": 7, "tag": "web-tier"}`, http.StatusBadRequest},
+		{`{"url": "https://hooks.example.com/e", "event": "update_failure", "tag": "  "}`, http.StatusBadRequest},
+	} {
+		rr := httptest.NewRecorder()
+		app.handleAddWebhook(rr, httptest.NewRequest(http.MethodPost, "/api/v1/webhooks", strings.NewReader(tc.body)))
+		if rr.Code != tc.want {
+			t.Errorf("%s: expected %d, got %d: %s", tc.body, tc.want, rr.Code, rr.Body.String())
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestHandleAddWebhook_Success(t *testing.T) {
 	app, mock := testAppWithDB(t)
 	defer mock.Close()
@@ -528,9 +877,9 @@ func TestHandleAddWebhook_Success(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/api/v1/webhooks", bytes.NewReader(body))
 	req = req.WithContext(context.WithValue(req.Context(), middleware.PrincipalContextKey, &session.Principal{Username: "admin", UserID: 1}))
 
-	mock.ExpectExec(`INSERT INTO webhooks`).
-		WithArgs("http://example.com/hook", "update_success").
-		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectQuery(`INSERT INTO webhooks (.+) RETURNING id`).
+		WithArgs("http://example.com/hook", "update_success", "raw", (*int32)(nil), (*string)(nil)).
+		WillReturnRows(mock.NewRows([]string{"id"}).AddRow(int32(12)))
 
 	mock.ExpectExec(`INSERT INTO audit_log`).
 		WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
@@ -540,7 +889,147 @@ func TestHandleAddWebhook_Success(t *testing.T) {
 	app.handleAddWebhook(rr, req)
 
 	if rr.Code != http.StatusCreated {
-		t.Errorf("expected 201, got %d", rr.Code)
+		t.Fatalf("expected 201, got %d", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("body %q: %v", rr.Body.String(), err)
+	}
+	want := map[string]interface{}{"status": "created", "id": float64(12), "message": "Webhook created"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("body = %v, want %v", got, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleListWebhookDeliveries(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	since := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	at := since.Add(time.Hour)
+	status := 502
+	mock.ExpectQuery(`SELECT id, url, event, format, host_id, tag FROM webhooks WHERE id = \$1`).WithArgs(int32(4)).
+		WillReturnRows(mock.NewRows(webhookCols).AddRow(int32(4), "https://hooks.example.com/x", "update_failure", "raw", nil, nil))
+	mock.ExpectQuery(`FROM webhook_deliveries`).WithArgs(int32(4), &since, 20, 40).
+		WillReturnRows(mock.NewRows([]string{"id", "webhook_id", "url", "event", "attempt", "status_code", "response_snippet", "error", "created_at"}).
+			AddRow(int64(9), int32(4), "https://hooks.example.com/x", "update_failure", 3, &status, "bad gateway", "webhook returned status 502", at))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/webhooks/4/deliveries?since=2026-10-01T00:00:00Z&limit=20&offset=40", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "4"})
+	rr := httptest.NewRecorder()
+	app.handleListWebhookDeliveries(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var got []map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0]["status_code"] != float64(502) || got[0]["attempt"] != float64(3) {
+		t.Errorf("got %v", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// A limit over the cap is clamped to it rather than refused.
+func TestHandleListWebhookDeliveries_ClampsLimit(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	mock.ExpectQuery(`SELECT id, url, event, format, host_id, tag FROM webhooks WHERE id = \$1`).WithArgs(int32(4)).
+		WillReturnRows(mock.NewRows(webhookCols).AddRow(int32(4), "https://hooks.example.com/x", "update_failure", "raw", nil, nil))
+	mock.ExpectQuery(`FROM webhook_deliveries`).WithArgs(int32(4), (*time.Time)(nil), 1000, 0).
+		WillReturnRows(mock.NewRows([]string{"id", "webhook_id", "url", "event", "attempt", "status_code", "response_snippet", "error", "created_at"}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/webhooks/4/deliveries?limit=5000", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "4"})
+	rr := httptest.NewRecorder()
+	app.handleListWebhookDeliveries(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleListWebhookDeliveries_Errors(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	for _, tc := range []struct {
+		id, query string
+		want      int
+	}{
+		{"x", "", http.StatusBadRequest},
+		{"4", "?since=yesterday", http.StatusBadRequest},
+		{"4", "?offset=-1", http.StatusBadRequest},
+		{"4", "?offset=x", http.StatusBadRequest},
+		{"4", "?limit=0", http.StatusBadRequest},
+		{"4", "?limit=ten", http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/webhooks/"+tc.id+"/deliveries"+tc.query, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": tc.id})
+		rr := httptest.NewRecorder()
+		app.handleListWebhookDeliveries(rr, req)
+		if rr.Code != tc.want {
+			t.Errorf("%s%s: expected %d, got %d", tc.id, tc.query, tc.want, rr.Code)
+		}
+	}
+
+	mock.ExpectQuery(`SELECT id, url, event, format, host_id, tag FROM webhooks WHERE id = \$1`).WithArgs(int32(5)).
+		WillReturnRows(mock.NewRows(webhookCols))
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/webhooks/5/deliveries", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "5"})
+	rr := httptest.NewRecorder()
+	app.handleListWebhookDeliveries(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("unknown webhook: expected 404, got %d", rr.Code)
+	}
+}
+
+// A replay queues the webhook's events since the given time and says how
+// many; a missing or malformed since queues nothing.
+func TestHandleReplayWebhook(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	since := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT id, url, event, format, host_id, tag FROM webhooks WHERE id = \$1`).WithArgs(int32(4)).
+		WillReturnRows(mock.NewRows(webhookCols).AddRow(int32(4), "https://hooks.example.com/x", "update_failure", "raw", nil, nil))
+	mock.ExpectExec(`INSERT INTO webhook_outbox`).
+		WithArgs(int32(4), "update_failure", since, (*int32)(nil), (*string)(nil), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 3))
+	expectAudit(mock)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/webhooks/4/replay?since=2026-10-01T00:00:00Z", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "4"})
+	rr := httptest.NewRecorder()
+	app.handleReplayWebhook(rr, req)
+	if rr.Code != http.StatusAccepted || !strings.Contains(rr.Body.String(), `"queued":3`) {
+		t.Errorf("got %d %s, want 202 with 3 queued", rr.Code, rr.Body.String())
+	}
+
+	for _, query := range []string{"", "?since=yesterday"} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/webhooks/4/replay"+query, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": "4"})
+		rr := httptest.NewRecorder()
+		app.handleReplayWebhook(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("since %q: expected 400, got %d", query, rr.Code)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
 	}
 }
 
@@ -552,7 +1041,7 @@ func TestHandleAddWebhook_DBError(t *testing.T) {
 	req := httptest.NewRequest(http.MethodPost, "/api/v1/webhooks", bytes.NewReader(body))
 
 	mock.ExpectExec(`INSERT INTO webhooks`).
-		WithArgs("http://example.com/hook", "update_success").
+		WithArgs("http://example.com/hook", "update_success", "raw", (*int32)(nil), (*string)(nil)).
 		WillReturnError(sql.ErrConnDone)
 
 	rr := httptest.NewRecorder()
@@ -660,10 +1149,10 @@ func TestHandleListRuns_Success(t *testing.T) {
 	defer mock.Close()
 
 	now := time.Now()
-	rows := mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id"}).
-		AddRow(int32(1), int32(10), nil, "admin", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil)
+	rows := mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id", "kept_back"}).
+		AddRow(int32(1), int32(10), nil, "admin", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil, nil)
 
-	mock.ExpectQuery(`SELECT (.+) FROM update_runs WHERE host_id = \$1 ORDER BY started_at DESC LIMIT \$2`).
+	mock.ExpectQuery(`SELECT (.+) FROM update_runs WHERE host_id = \$1 ORDER BY started_at DESC, id DESC LIMIT \$2`).
 		WithArgs(int32(10), 50).
 		WillReturnRows(rows)
 
@@ -677,11 +1166,11 @@ func TestHandleListRuns_Success(t *testing.T) {
 	}
 
 	// With limit and cap
-	rows2 := mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id"}).
-		AddRow(int32(2), int32(10), nil, "admin", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil)
+	rows2 := mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id", "kept_back"}).
+		AddRow(int32(2), int32(10), nil, "admin", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil, nil)
 
-	mock.ExpectQuery(`SELECT (.+) FROM update_runs WHERE host_id = \$1 ORDER BY started_at DESC LIMIT \$2`).
-		WithArgs(int32(10), 50).
+	mock.ExpectQuery(`SELECT (.+) FROM update_runs WHERE host_id = \$1 ORDER BY started_at DESC, id DESC LIMIT \$2`).
+		WithArgs(int32(10), 100).
 		WillReturnRows(rows2)
 
 	req = httptest.NewRequest(http.MethodGet, "/api/v1/hosts/10/runs?limit=999", nil)
@@ -699,8 +1188,8 @@ func TestHandleListRunsByGroup_Success(t *testing.T) {
 	defer mock.Close()
 
 	now := time.Now()
-	rows := mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id"}).
-		AddRow(int32(1), int32(10), "12345678-1234-1234-1234-123456789012", "admin", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil)
+	rows := mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id", "kept_back"}).
+		AddRow(int32(1), int32(10), "12345678-1234-1234-1234-123456789012", "admin", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil, nil)
 
 	mock.ExpectQuery(`SELECT (.+) FROM update_runs WHERE run_group_id = \$1 ORDER BY host_id`).
 		WithArgs("12345678-1234-1234-1234-123456789012").
@@ -741,11 +1230,31 @@ func TestHandleListRunsByGroup_DBError(t *testing.T) {
 	}
 }
 
+// An unknown rollout policy or a negative batch is refused before any host
+// is looked at.
+func TestHandleBulkRunUpdate_RejectsBadPolicy(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	for _, body := range []string{
+		`{"host_ids":[1,2],"policy":"yolo"}`,
+		`{"host_ids":[1,2],"policy":"rolling","batch_size":-1}`,
+	} {
+		rr := httptest.NewRecorder()
+		app.handleBulkRunUpdate(rr, httptest.NewRequest(http.MethodPost, "/api/v1/hosts/bulk/run-update", strings.NewReader(body)))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, rr.Code)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
 func TestHandleListRuns_DBError(t *testing.T) {
 	app, mock := testAppWithDB(t)
 	defer mock.Close()
 
-	mock.ExpectQuery(`SELECT (.+) FROM update_runs WHERE host_id = \$1 ORDER BY started_at DESC LIMIT \$2`).
+	mock.ExpectQuery(`SELECT (.+) FROM update_runs WHERE host_id = \$1 ORDER BY started_at DESC, id DESC LIMIT \$2`).
 		WithArgs(int32(10), 50).
 		WillReturnError(sql.ErrConnDone)
 
@@ -776,8 +1285,8 @@ func TestHandleGetRun_Success(t *testing.T) {
 	defer mock.Close()
 
 	now := time.Now()
-	rows := mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id"}).
-		AddRow(int32(1), int32(10), nil, "admin", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil)
+	rows := mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id", "kept_back"}).
+		AddRow(int32(1), int32(10), nil, "admin", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil, nil)
 
 	mock.ExpectQuery(`SELECT (.+) FROM update_runs WHERE id = \$1`).
 		WithArgs(int32(1)).
@@ -0,0 +1,191 @@
+package main
+
+// Maintenance windows CRUD. The gating itself lives in pkg/maintenance and is
+// applied by the bulk run-update handler and the scheduler.
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	log "github.com/sirupsen/logrus"
+
+	"ubuntu-auto-update/backend/pkg/audit"
+	"ubuntu-auto-update/backend/pkg/maintenance"
+	"ubuntu-auto-update/backend/pkg/middleware"
+)
+
+type maintenanceWindowRequest struct {
+	Name        string `json:"name"`
+	HostID      *int32 `json:"host_id,omitempty"` // nil ⇒ global
+	StartMinute *int32 `json:"start_minute"`      // minutes since local midnight
+	EndMinute   *int32 `json:"end_minute"`
+	Days        int16  `json:"days,omitempty"`     // bitmask, bit 0 = Sunday; 0 ⇒ every day
+	Timezone    string `json:"timezone,omitempty"` // IANA name; "" ⇒ UTC
+}
+
+// window validates req and returns it as a Window, or a 400 message.
+func (req maintenanceWindowRequest) window() (maintenance.Window, string) {
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return maintenance.Window{}, "name is required"
+	}
+	if req.StartMinute == nil || req.EndMinute == nil {
+		return maintenance.Window{}, "start_minute and end_minute are required"
+	}
+	s, e := *req.StartMinute, *req.EndMinute
+	if s < 0 || s > 1439 || e < 0 || e > 1439 || s == e {
+		return maintenance.Window{}, "window minutes must be 0-1439 and start must differ from end"
+	}
+	days := req.Days
+	if days == 0 {
+		days = 127
+	}
+	if days < 0 || days > 127 {
+		return maintenance.Window{}, "days must be a 7-bit mask (1-127)"
+	}
+	tz := strings.TrimSpace(req.Timezone)
+	if tz == "" {
+		tz = "UTC"
+	}
+	// "Local" would mean whatever zone the server runs in — exactly the
+	// ambiguity storing an IANA name is meant to avoid.
+	if _, err := time.LoadLocation(tz); err != nil || tz == "Local" {
+		return maintenance.Window{}, "timezone must be an IANA name such as Europe/Berlin"
+	}
+	return maintenance.Window{
+		Name:        name,
+		HostID:      req.HostID,
+		StartMinute: s,
+		EndMinute:   e,
+		Days:        days,
+		Timezone:    tz,
+	}, ""
+}
+
+func (app *Application) handleListMaintenanceWindows(w http.ResponseWriter, r *http.Request) {
+	ws, err := maintenance.List(r.Context(), app.DB)
+	if err != nil {
+		log.Errorf("list maintenance windows: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to list maintenance windows")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ws)
+}
+
+func (app *Application) handleCreateMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	var req maintenanceWindowRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	win, msg := req.window()
+	if msg != "" {
+		writeJSONError(w, http.StatusBadRequest, msg)
+		return
+	}
+	win.CreatedBy = "unknown"
+	if user := middleware.GetUserFromContext(r); user != nil {
+		win.CreatedBy = user.Username
+	}
+
+	win, err := maintenance.Create(r.Context(), app.DB, win)
+	if err != nil {
+		if isForeignKeyViolation(err) {
+			writeJSONError(w, http.StatusNotFound, "Host not found")
+			return
+		}
+		log.Errorf("create maintenance window: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create maintenance window")
+		return
+	}
+	app.audit(r, audit.ActionMaintenanceWindowCreate, "maintenance_window", strconv.FormatInt(int64(win.ID), 10),
+		maintenanceWindowDetails(win))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(win)
+}
+
+func (app *Application) handleUpdateMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid maintenance window ID")
+		return
+	}
+	var req maintenanceWindowRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	win, msg := req.window()
+	if msg != "" {
+		writeJSONError(w, http.StatusBadRequest, msg)
+		return
+	}
+	win.ID = int32(id)
+
+	win, err = maintenance.Update(r.Context(), app.DB, win)
+	if err != nil {
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			writeJSONError(w, http.StatusNotFound, "Maintenance window not found")
+		case isForeignKeyViolation(err):
+			writeJSONError(w, http.StatusNotFound, "Host not found")
+		default:
+			log.Errorf("update maintenance window: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to update maintenance window")
+		}
+		return
+	}
+	app.audit(r, audit.ActionMaintenanceWindowUpdate, "maintenance_window", strconv.FormatInt(int64(win.ID), 10),
+		maintenanceWindowDetails(win))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(win)
+}
+
+func (app *Application) handleDeleteMaintenanceWindow(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid maintenance window ID")
+		return
+	}
+	rows, err := maintenance.Delete(r.Context(), app.DB, int32(id))
+	if err != nil {
+		log.Errorf("delete maintenance window: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete maintenance window")
+		return
+	}
+	if rows == 0 {
+		writeJSONError(w, http.StatusNotFound, "Maintenance window not found")
+		return
+	}
+	app.audit(r, audit.ActionMaintenanceWindowDelete, "maintenance_window", strconv.FormatInt(id, 10), nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func maintenanceWindowDetails(win maintenance.Window) map[string]interface{} {
+	return map[string]interface{}{
+		"name":         win.Name,
+		"host_id":      win.HostID,
+		"start_minute": win.StartMinute,
+		"end_minute":   win.EndMinute,
+		"days":         win.Days,
+		"timezone":     win.Timezone,
+	}
+}
+
+// isForeignKeyViolation reports a Postgres 23503, e.g. a host_id that
+// doesn't exist.
+func isForeignKeyViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23503"
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pashagolub/pgxmock/v4"
+
+	"ubuntu-auto-update/backend/pkg/maintenance"
+)
+
+func mwCols(mock pgxmock.PgxPoolIface) *pgxmock.Rows {
+	return mock.NewRows([]string{"id", "name", "host_id", "start_minute", "end_minute", "days", "timezone", "created_by", "created_at"})
+}
+
+func TestHandleCreateMaintenanceWindow_Validates(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	cases := []struct {
+		name string
+		body map[string]interface{}
+	}{
+		{"missing name", map[string]interface{}{"start_minute": 60, "end_minute": 120}},
+		{"missing end", map[string]interface{}{"name": "n", "start_minute": 60}},
+		{"start equals end", map[string]interface{}{"name": "n", "start_minute": 60, "end_minute": 60}},
+		{"minute out of range", map[string]interface{}{"name": "n", "start_minute": 60, "end_minute": 1440}},
+		{"bad days", map[string]interface{}{"name": "n", "start_minute": 60, "end_minute": 120, "days": 128}},
+		{"bad timezone", map[string]interface{}{"name": "n", "start_minute": 60, "end_minute": 120, "timezone": "CEST"}},
+		{"local timezone", map[string]interface{}{"name": "n", "start_minute": 60, "end_minute": 120, "timezone": "Local"}},
+	}
+	for _, tc := range cases {
+		b, _ := json.Marshal(tc.body)
+		rr := httptest.NewRecorder()
+		app.handleCreateMaintenanceWindow(rr, httptest.NewRequest(http.MethodPost, "/api/v1/maintenance-windows", bytes.NewReader(b)))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", tc.name, rr.Code)
+		}
+	}
+}
+
+func TestHandleCreateMaintenanceWindow(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	now := time.Now()
+	hostID := int32(4)
+	// name, host_id, start_minute, end_minute, days, timezone, created_by
+	mock.ExpectQuery(`INSERT INTO maintenance_windows`).
+		WithArgs("db nights", &hostID, int32(120), int32(240), int16(127), "Europe/Berlin", "unknown").
+		WillReturnRows(mwCols(mock).AddRow(int32(1), "db nights", &hostID, int32(120), int32(240), int16(127), "Europe/Berlin", "unknown", now))
+	mock.ExpectExec("INSERT INTO audit_log").
+		WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(),
+			pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	b, _ := json.Marshal(map[string]interface{}{
+		"name": "db nights", "host_id": 4, "start_minute": 120, "end_minute": 240, "timezone": "Europe/Berlin",
+	})
+	rr := httptest.NewRecorder()
+	app.handleCreateMaintenanceWindow(rr, httptest.NewRequest(http.MethodPost, "/api/v1/maintenance-windows", bytes.NewReader(b)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var got maintenance.Window
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Timezone != "Europe/Berlin" || got.HostID == nil || *got.HostID != 4 {
+		t.Errorf("window = %+v", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestHandleCreateMaintenanceWindow_UnknownHost(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	mock.ExpectQuery(`INSERT INTO maintenance_windows`).
+		WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnError(&pgconn.PgError{Code: "23503"})
+
+	b, _ := json.Marshal(map[string]interface{}{"name": "n", "host_id": 99, "start_minute": 0, "end_minute": 60})
+	rr := httptest.NewRecorder()
+	app.handleCreateMaintenanceWindow(rr, httptest.NewRequest(http.MethodPost, "/api/v1/maintenance-windows", bytes.NewReader(b)))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rr.Code)
+	}
+}
+
+// A bulk run whose hosts are all outside their windows starts nothing and
+// reports each host as skipped.
+func TestHandleBulkRunUpdate_SkipsOutsideMaintenanceWindow(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	now := time.Now()
+	// A global one-minute window that closed a minute ago.
+	past := int32((now.UTC().Hour()*60 + now.UTC().Minute() + 1438) % 1440)
+	mock.ExpectQuery(`FROM maintenance_windows`).
+		WithArgs([]int32{1, 2}).
+		WillReturnRows(mwCols(mock).AddRow(int32(1), "global", nil, past, (past+1)%1440, int16(127), "UTC", "admin", now))
+
+	b, _ := json.Marshal(map[string]interface{}{"host_ids": []int{1, 2}})
+	rr := httptest.NewRecorder()
+	app.handleBulkRunUpdate(rr, httptest.NewRequest(http.MethodPost, "/api/v1/hosts/bulk/run-update", bytes.NewReader(b)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp bulkRunResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.GroupID != "" || len(resp.Skipped) != 2 || resp.Skipped[0].Reason != maintenance.SkipReason {
+		t.Errorf("response = %+v", resp)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
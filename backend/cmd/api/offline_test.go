@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+// A host that stays dark across sweeps is announced once: the second sweep
+// returns no newly-flagged rows, so no webhook lookup happens.
+func TestSweepOfflineHosts_FiresOnce(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	stale := time.Now().Add(-time.Hour)
+	now := time.Now()
+	mock.ExpectExec(`UPDATE hosts SET offline_since = NULL`).WithArgs(15).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+	mock.ExpectQuery(`UPDATE hosts SET offline_since = NOW\(\)`).WithArgs(15).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(7), "gone-dark", "root", stale, stale, stale, "", "", nil, []string{}, false, 0, 0, "", "", "", "", &now, false, false, "all", nil, ""))
+	expectWebhookLookup(mock, "host_offline", 7)
+
+	mock.ExpectExec(`UPDATE hosts SET offline_since = NULL`).WithArgs(15).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+	mock.ExpectQuery(`UPDATE hosts SET offline_since = NOW\(\)`).WithArgs(15).
+		WillReturnRows(mock.NewRows(hostCols))
+
+	app.sweepOfflineHosts(context.Background(), 15)
+	app.sweepOfflineHosts(context.Background(), 15)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandleGetHost_Status(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	for _, tc := range []struct {
+		offlineAfter time.Duration
+		lastSeen     time.Time
+		want         string
+	}{
+		{0, time.Now(), "online"},
+		{0, time.Now().Add(-time.Hour), "offline"},
+		{2 * time.Hour, time.Now().Add(-time.Hour), "online"},
+	} {
+		app.OfflineAfter = tc.offlineAfter
+		mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).
+			WillReturnRows(mock.NewRows(hostCols).
+				AddRow(int32(1), "web-1", "root", tc.lastSeen, tc.lastSeen, tc.lastSeen, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/hosts/1", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": "1"})
+		rr := httptest.NewRecorder()
+		app.handleGetHost(rr, req)
+
+		var body map[string]interface{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if body["status"] != tc.want {
+			t.Errorf("last_seen %s: status = %v, want %s", tc.lastSeen, body["status"], tc.want)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
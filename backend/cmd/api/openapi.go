@@ -0,0 +1,449 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"ubuntu-auto-update/backend/pkg/apitokens"
+	"ubuntu-auto-update/backend/pkg/audit"
+	"ubuntu-auto-update/backend/pkg/inventory"
+	"ubuntu-auto-update/backend/pkg/maintenance"
+	"ubuntu-auto-update/backend/pkg/middleware"
+	"ubuntu-auto-update/backend/pkg/models"
+	"ubuntu-auto-update/backend/pkg/playbooks"
+	"ubuntu-auto-update/backend/pkg/scheduler"
+	"ubuntu-auto-update/backend/pkg/ssh"
+	"ubuntu-auto-update/backend/pkg/updater"
+	"ubuntu-auto-update/backend/pkg/users"
+	"ubuntu-auto-update/backend/pkg/webhook"
+)
+
+// apiOp documents one route for the OpenAPI document. Request and Response
+// are zero values of the JSON body types and are turned into schemas by
+// reflection; nil means no body. Handlers that decode into a local struct
+// or answer with an ad-hoc map are described as jsonObject.
+type apiOp struct {
+	Summary   string
+	Request   any
+	Response  any
+	Status    int // success status; 0 means 200
+	WebSocket bool
+}
+
+// jsonObject stands in for bodies without a named Go type.
+type jsonObject map[string]any
+
+// apiDocs is keyed by "METHOD /path/template" as the router reports it.
+// Paths and methods come from walking the router, so a route can't be
+// served without appearing in the document; TestOpenAPI_DocumentsEveryRoute
+// fails when a route has no entry here or an entry has no route.
+var apiDocs = map[string]apiOp{
+	"GET /api/v1/openapi.json": {Summary: "This document", Response: jsonObject{}},
+	"GET /api/v1/livez":        {Summary: "Liveness: 200 whenever the process is up", Response: jsonObject{}},
+	"GET /api/v1/readyz":       {Summary: "Readiness: per-component health; 503 only when the DB is down", Response: jsonObject{}},
+	"GET /api/v1/health":       {Summary: "Alias of /readyz for existing monitors", Response: jsonObject{}},
+	"GET /api/v1/version":      {Summary: "Build version, commit and date", Response: BuildInfo{}},
+	"POST /api/v1/login":       {Summary: "Log in; issues bearer and refresh tokens and sets the session cookie", Request: LoginRequest{}, Response: jsonObject{}},
+	"POST /api/v1/logout":      {Summary: "Revoke the presented session and refresh token", Response: middleware.SuccessResponse{}},
+	"POST /api/v1/refresh":     {Summary: "Trade a refresh token (body or cookie) for a new session", Request: RefreshRequest{}, Response: jsonObject{}},
+	"POST /api/v1/enroll":      {Summary: "Agent enrollment: trade an enrollment token for an agent token (uag_…) and host_id", Request: jsonObject{}, Response: enrollResponse{}},
+
+	"POST /api/v1/report":        {Summary: "Agent report", Request: models.HostReport{}, Response: middleware.SuccessResponse{}, Status: http.StatusAccepted},
+	"POST /api/v1/report/batch":  {Summary: "Upload up to 500 reports in one transaction", Request: []models.HostReport{}, Response: jsonObject{}},
+	"GET /api/v1/agent/commands": {Summary: "Agent poll for queued commands; returned commands are marked dispatched", Response: jsonObject{}},
+	"POST /api/v1/agent/result":  {Summary: "Agent result for a dispatched command", Request: jsonObject{}, Status: http.StatusNoContent},
+
+	"GET /api/v1/hosts":                          {Summary: "List hosts (?limit=&offset=, ?tag=, ?include_deleted=true)", Response: []models.Host{}},
+	"POST /api/v1/hosts":                         {Summary: "Operator-create a host", Request: jsonObject{}, Response: models.Host{}, Status: http.StatusCreated},
+	"GET /api/v1/hosts/export":                   {Summary: "All hosts as one streamed JSON document, without private keys (?include_keys=true adds them encrypted, admin only; ?include_deleted=true adds archived hosts)", Response: jsonObject{}},
+	"GET /api/v1/hosts/{id}":                     {Summary: "Host detail, archived hosts included", Response: models.Host{}},
+	"PATCH /api/v1/hosts/{id}":                   {Summary: "Edit ssh_user, tags, update_policy and/or environment", Request: jsonObject{}, Response: models.Host{}},
+	"DELETE /api/v1/hosts/{id}":                  {Summary: "Archive a host (?purge=true deletes it); requires X-Confirm-Hostname", Status: http.StatusNoContent},
+	"POST /api/v1/hosts/{id}/restore":            {Summary: "Un-archive a host", Response: models.Host{}},
+	"POST /api/v1/hosts/{id}/tags":               {Summary: "Add one tag", Request: jsonObject{}, Response: models.Host{}},
+	"DELETE /api/v1/hosts/{id}/tags/{tag}":       {Summary: "Remove one tag", Response: models.Host{}},
+	"GET /api/v1/hosts/{id}/runs":                {Summary: "Update history for a host (?limit=)", Response: []models.UpdateRun{}},
+	"GET /api/v1/hosts/{id}/unattended-upgrades": {Summary: "Last stored unattended-upgrades probe", Response: inventory.UnattendedStatus{}},
+	"POST /api/v1/hosts/{id}/unattended-upgrades/check": {
+		Summary: "Probe unattended-upgrades over SSH and store the result", Response: inventory.UnattendedStatus{},
+	},
+	"DELETE /api/v1/hosts/{id}/ssh-keys/{key_id}": {
+		Summary: "Remove one of the host's keys", Status: http.StatusNoContent,
+	},
+	"GET /api/v1/hosts/{id}/agent-tokens": {
+		Summary: "Agent tokens issued to the host, newest first, with created and last-used times", Response: []models.AgentToken{},
+	},
+	"DELETE /api/v1/hosts/{id}/agent-tokens/{token_id}": {
+		Summary: "Revoke one agent token; the agent's next request gets a 401", Response: models.AgentToken{},
+	},
+	"GET /api/v1/hosts/{id}/commands":         {Summary: "The host's agent command queue, newest first", Response: []models.QueuedCommand{}},
+	"POST /api/v1/hosts/{id}/commands":        {Summary: "Queue a command for the host's agent", Request: jsonObject{}, Response: models.QueuedCommand{}, Status: http.StatusCreated},
+	"GET /api/v1/hosts/{id}/ssh-key":          {Summary: "Public half of the first stored key and its fingerprint", Response: jsonObject{}},
+	"POST /api/v1/hosts/{id}/ssh-key":         {Summary: "Store an encrypted SSH key, replacing the host's keys", Request: jsonObject{}, Response: middleware.SuccessResponse{}, Status: http.StatusCreated},
+	"GET /api/v1/hosts/{id}/ssh-keys":         {Summary: "Public halves of the host's keys in the order they are tried", Response: []sshKeyInfo{}},
+	"POST /api/v1/hosts/{id}/ssh-keys":        {Summary: "Add a key after the host's existing ones", Request: jsonObject{}, Response: middleware.SuccessResponse{}, Status: http.StatusCreated},
+	"POST /api/v1/hosts/{id}/test-connection": {Summary: "Probe SSH and sudo", Response: ssh.TestResult{}},
+	"POST /api/v1/hosts/{id}/auto-configure":  {Summary: "Bootstrap key access with a one-time password", Request: jsonObject{}, Response: jsonObject{}},
+	"POST /api/v1/hosts/{id}/rotate-key":      {Summary: "Rotate the host's SSH key", Request: jsonObject{}, Response: jsonObject{}},
+	"POST /api/v1/hosts/{id}/generate-key":    {Summary: "Generate a keypair server-side; returns the public key", Request: jsonObject{}, Response: jsonObject{}, Status: http.StatusCreated},
+	"PUT /api/v1/hosts/{id}/sudo-password":    {Summary: "Store an encrypted sudo password", Request: jsonObject{}, Status: http.StatusNoContent},
+	"DELETE /api/v1/hosts/{id}/sudo-password": {Summary: "Forget the sudo password", Status: http.StatusNoContent},
+	"GET /api/v1/hosts/{id}/update-hooks":     {Summary: "Commands run before and after run-update", Response: models.UpdateHooks{}},
+	"PUT /api/v1/hosts/{id}/update-hooks":     {Summary: "Replace the pre/post-update commands; empty removes one", Request: models.UpdateHooks{}, Response: models.UpdateHooks{}},
+	"GET /api/v1/hosts/{id}/preview-updates":  {Summary: "Stream apt list --upgradable", WebSocket: true},
+	"GET /api/v1/hosts/{id}/packages":         {Summary: "Installed packages, paged (?limit=&offset=&q=&refresh=true)", Response: packagesResponse{}},
+	"GET /api/v1/hosts/{id}/history":          {Summary: "Packages added, removed and upgraded between two update runs (?from=&to= run IDs)", Response: packageHistoryResponse{}},
+	"GET /api/v1/hosts/{id}/run-update":       {Summary: "Stream an update run (?ssh_user= overrides the login for this run, ?simulate=true only plans it; guarded environments need ?confirm=true or X-Confirm-Environment)", WebSocket: true},
+	"POST /api/v1/hosts/{id}/reboot":          {Summary: "Reboot now or after delay_minutes without waiting for the host (?confirm=true required)", Request: jsonObject{}, Response: middleware.SuccessResponse{}, Status: http.StatusAccepted},
+	"POST /api/v1/hosts/{id}/cancel-update":   {Summary: "Cancel the runs streaming on a host; each records itself as cancelled", Response: jsonObject{}, Status: http.StatusAccepted},
+	"GET /api/v1/hosts/{id}/execute-script":   {Summary: "Run a script and stream its output", WebSocket: true},
+	"GET /api/v1/hosts/{id}/run-playbook":     {Summary: "Run a playbook and stream its output", WebSocket: true},
+	"POST /api/v1/hosts/import":               {Summary: "Upsert hosts from CSV or JSON (hostname, ssh_user, port, tags) with a result per row", Request: jsonObject{}, Response: jsonObject{}},
+	"POST /api/v1/hosts/bulk/enroll":          {Summary: "Bootstrap many hosts at once", Request: jsonObject{}, Response: jsonObject{}, Status: http.StatusCreated},
+	"POST /api/v1/hosts/bulk/run-update":      {Summary: "Fan an update out across host_ids or a tag (policy parallel, canary or rolling)", Request: jsonObject{}, Response: bulkRunResponse{}, Status: http.StatusAccepted},
+	"POST /api/v1/hosts/bulk/run-playbook":    {Summary: "Fan a playbook out across many hosts", Request: jsonObject{}, Response: updater.BulkResult{}, Status: http.StatusAccepted},
+	"POST /api/v1/hosts/bulk/reboot":          {Summary: "Reboot hosts and verify they come back", Request: jsonObject{}, Response: updater.BulkResult{}, Status: http.StatusAccepted},
+
+	"GET /api/v1/reports/compliance": {Summary: "Fleet patch-status report (?format=csv to export)", Response: []complianceRow{}},
+	"GET /api/v1/runs":               {Summary: "All runs in a bulk group (?group_id=)", Response: []models.UpdateRun{}},
+	"GET /api/v1/runs/phases":        {Summary: "Phases of a bulk run (?group_id=): hosts, status and outcome of each", Response: []models.RunPhase{}},
+	"GET /api/v1/runs/{id}":          {Summary: "Single run with its full output", Response: models.UpdateRun{}},
+	"GET /api/v1/runs/{id}/hooks":    {Summary: "Output and exit codes of the run's update hooks", Response: []models.RunHook{}},
+	"GET /api/v1/events":             {Summary: "Real-time change feed", WebSocket: true},
+	"GET /api/v1/me":                 {Summary: "The calling principal", Response: jsonObject{}},
+	"GET /api/v1/overview":           {Summary: "Fleet stats for the dashboard", Response: jsonObject{}},
+
+	"GET /api/v1/playbooks":         {Summary: "List playbooks", Response: []playbooks.Playbook{}},
+	"POST /api/v1/playbooks":        {Summary: "Create a playbook", Request: playbookRequest{}, Response: playbooks.Playbook{}, Status: http.StatusCreated},
+	"GET /api/v1/playbooks/{id}":    {Summary: "Get a playbook", Response: playbooks.Playbook{}},
+	"PATCH /api/v1/playbooks/{id}":  {Summary: "Replace a playbook", Request: playbookRequest{}, Response: playbooks.Playbook{}},
+	"DELETE /api/v1/playbooks/{id}": {Summary: "Delete a playbook", Status: http.StatusNoContent},
+	"GET /api/v1/webhooks":          {Summary: "List webhooks", Response: []models.Webhook{}},
+	"POST /api/v1/webhooks":         {Summary: "Subscribe a webhook to an event", Request: models.Webhook{}, Response: middleware.SuccessResponse{}, Status: http.StatusCreated},
+	"DELETE /api/v1/webhooks/{id}":  {Summary: "Delete a webhook", Status: http.StatusNoContent},
+	"GET /api/v1/webhooks/{id}/deliveries": {
+		Summary: "Delivery attempts, newest first (?since=&limit=&offset=)", Response: []webhook.Delivery{},
+	},
+	"POST /api/v1/webhooks/{id}/replay": {
+		Summary: "Queue the webhook's events since ?since= for delivery again", Response: jsonObject{}, Status: http.StatusAccepted,
+	},
+	"GET /api/v1/schedules":                   {Summary: "List update schedules", Response: []scheduler.Schedule{}},
+	"POST /api/v1/schedules":                  {Summary: "Create an update schedule", Request: jsonObject{}, Response: scheduler.Schedule{}, Status: http.StatusCreated},
+	"PATCH /api/v1/schedules/{id}":            {Summary: "Enable or disable a schedule", Request: jsonObject{}, Response: scheduler.Schedule{}},
+	"DELETE /api/v1/schedules/{id}":           {Summary: "Delete a schedule", Status: http.StatusNoContent},
+	"GET /api/v1/maintenance-windows":         {Summary: "List maintenance windows", Response: []maintenance.Window{}},
+	"POST /api/v1/maintenance-windows":        {Summary: "Create a maintenance window", Request: maintenanceWindowRequest{}, Response: maintenance.Window{}, Status: http.StatusCreated},
+	"PATCH /api/v1/maintenance-windows/{id}":  {Summary: "Replace a maintenance window", Request: maintenanceWindowRequest{}, Response: maintenance.Window{}},
+	"DELETE /api/v1/maintenance-windows/{id}": {Summary: "Delete a maintenance window", Status: http.StatusNoContent},
+
+	"GET /api/v1/users":                {Summary: "List users", Response: []users.User{}},
+	"POST /api/v1/users":               {Summary: "Create a user", Request: jsonObject{}, Response: users.User{}, Status: http.StatusCreated},
+	"PATCH /api/v1/users/{id}":         {Summary: "Change a user's role, password or disabled flag", Request: jsonObject{}, Status: http.StatusNoContent},
+	"DELETE /api/v1/users/{id}":        {Summary: "Delete a user", Status: http.StatusNoContent},
+	"GET /api/v1/audit":                {Summary: "Audit log, newest first (?host_id=&user=&action=&limit=&offset=)", Response: []audit.Record{}},
+	"POST /api/v1/ssh-keys/re-encrypt": {Summary: "Re-wrap stored secrets under the current ENCRYPTION_KEY", Response: jsonObject{}},
+	"GET /api/v1/tokens":               {Summary: "List API tokens", Response: []apitokens.Token{}},
+	"POST /api/v1/tokens":              {Summary: "Mint an API token; the secret is returned once", Request: jsonObject{}, Response: jsonObject{}, Status: http.StatusCreated},
+	"DELETE /api/v1/tokens/{id}":       {Summary: "Revoke an API token", Status: http.StatusNoContent},
+	"POST /api/v1/enrollment-tokens":   {Summary: "Mint an expiring, by default single-use, agent enrollment token; the secret is returned once", Request: jsonObject{}, Response: jsonObject{}, Status: http.StatusCreated},
+}
+
+// schemaExtras adds the properties a custom MarshalJSON emits that
+// reflection over the struct can't see.
+var schemaExtras = map[reflect.Type]map[string]map[string]any{
+	reflect.TypeOf(models.Host{}): {
+		"error":  {"type": "string", "nullable": true},
+		"status": {"type": "string", "enum": []string{models.HostStatusOnline, models.HostStatusOffline}},
+	},
+	reflect.TypeOf(models.UpdateRun{}): {
+		"exit_code":    {"type": "integer", "format": "int32", "nullable": true},
+		"finished_at":  {"type": "string", "format": "date-time", "nullable": true},
+		"error":        {"type": "string", "nullable": true},
+		"run_group_id": {"type": "string", "nullable": true},
+		"playbook_id":  {"type": "integer", "format": "int32", "nullable": true},
+	},
+}
+
+// handleOpenAPI serves the OpenAPI document for router. It is built on the
+// first request, once every route is registered, and cached.
+func (app *Application) handleOpenAPI(router *mux.Router) http.HandlerFunc {
+	var (
+		once sync.Once
+		body []byte
+		err  error
+	)
+	return func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() {
+			body, err = json.Marshal(openAPIDocument(router, app.AuthConfig.CookieName))
+		})
+		if err != nil {
+			log.Errorf("Failed to build OpenAPI document: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to build API description")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+// pathVar matches a mux path variable, with or without a pattern.
+var pathVar = regexp.MustCompile(`\{([^}:]+)(?::[^}]*)?\}`)
+
+// openAPIDocument walks router and describes every /api/v1 route. Routes
+// mounted directly on the root router are public; everything below a
+// subrouter sits behind session auth.
+func openAPIDocument(router *mux.Router, cookieName string) map[string]any {
+	g := &schemaGen{schemas: map[string]any{}}
+	errorResponse := map[string]any{
+		"description": "Error",
+		"content": map[string]any{
+			"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(middleware.ErrorResponse{}))},
+		},
+	}
+
+	paths := map[string]map[string]any{}
+	_ = router.Walk(func(route *mux.Route, _ *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(tmpl, "/api/v1/") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil // a subrouter's prefix, not an endpoint
+		}
+		oaPath := pathVar.ReplaceAllString(tmpl, "{$1}")
+		for _, method := range methods {
+			if method == http.MethodOptions {
+				continue
+			}
+			doc := apiDocs[method+" "+tmpl]
+			op := map[string]any{
+				"operationId": operationID(method, oaPath),
+				"summary":     doc.Summary,
+				"responses":   doc.responses(g, errorResponse),
+			}
+			if len(ancestors) == 0 {
+				op["security"] = []any{}
+			}
+			var params []any
+			for _, m := range pathVar.FindAllStringSubmatch(tmpl, -1) {
+				params = append(params, map[string]any{
+					"name": m[1], "in": "path", "required": true,
+					"schema": map[string]any{"type": "string"},
+				})
+			}
+			if params != nil {
+				op["parameters"] = params
+			}
+			if doc.Request != nil {
+				op["requestBody"] = map[string]any{
+					"required": true,
+					"content": map[string]any{
+						"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(doc.Request))},
+					},
+				}
+			}
+			if paths[oaPath] == nil {
+				paths[oaPath] = map[string]any{}
+			}
+			paths[oaPath][strings.ToLower(method)] = op
+		}
+		return nil
+	})
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "ubuntu-auto-update API",
+			"version": buildInfo().Version,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "Session token from /login, an API token (uat_…) or an agent token (uag_…) from /enroll",
+				},
+				"cookieAuth": map[string]any{"type": "apiKey", "in": "cookie", "name": cookieName},
+			},
+		},
+		"security": []any{
+			map[string]any{"bearerAuth": []string{}},
+			map[string]any{"cookieAuth": []string{}},
+		},
+	}
+}
+
+func (doc apiOp) responses(g *schemaGen, errorResponse map[string]any) map[string]any {
+	out := map[string]any{"default": errorResponse}
+	if doc.WebSocket {
+		out["101"] = map[string]any{"description": "WebSocket upgrade; output streams as text messages"}
+		return out
+	}
+	status := doc.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	resp := map[string]any{"description": http.StatusText(status)}
+	if doc.Response != nil {
+		resp["content"] = map[string]any{
+			"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(doc.Response))},
+		}
+	}
+	out[strconv.Itoa(status)] = resp
+	return out
+}
+
+// operationID turns "GET /api/v1/hosts/{id}/runs" into "getHostsByIdRuns".
+func operationID(method, oaPath string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	for _, seg := range strings.Split(strings.TrimPrefix(oaPath, "/api/v1/"), "/") {
+		if strings.HasPrefix(seg, "{") {
+			b.WriteString("By")
+			seg = strings.Trim(seg, "{}")
+		}
+		for _, word := range strings.FieldsFunc(seg, func(r rune) bool { return r == '-' || r == '_' || r == '.' }) {
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return b.String()
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	rawJSONType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaGen builds OpenAPI schemas from Go types, following encoding/json's
+// rules for field names, omitempty and embedded structs. Named structs
+// become components referenced by $ref.
+type schemaGen struct {
+	schemas map[string]any
+}
+
+func (g *schemaGen) schema(t reflect.Type) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case rawJSONType:
+		return map[string]any{}
+	case reflect.TypeOf(sql.NullString{}):
+		return map[string]any{"type": "string", "nullable": true}
+	case reflect.TypeOf(sql.NullInt32{}):
+		return map[string]any{"type": "integer", "format": "int32", "nullable": true}
+	case reflect.TypeOf(sql.NullTime{}):
+		return map[string]any{"type": "string", "format": "date-time", "nullable": true}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := g.schema(t.Elem())
+		if _, isRef := s["$ref"]; !isRef { // 3.0 ignores siblings of $ref
+			s["nullable"] = true
+		}
+		return s
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name := schemaName(t)
+		if _, done := g.schemas[name]; !done {
+			g.schemas[name] = map[string]any{} // placeholder against recursion
+			g.schemas[name] = g.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{} // interfaces: any JSON value
+}
+
+func (g *schemaGen) structSchema(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var required []string
+	g.addFields(t, props, &required)
+	for name, s := range schemaExtras[t] {
+		props[name] = s
+		required = append(required, name)
+	}
+	sort.Strings(required)
+	s := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+func (g *schemaGen) addFields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.addFields(ft, props, required)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schema(f.Type)
+		if !strings.Contains(","+opts+",", ",omitempty,") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// schemaName is the component name for t: "models.Host", or "api.X" for
+// this package's own types.
+func schemaName(t reflect.Type) string {
+	pkg := path.Base(t.PkgPath())
+	if pkg == "main" {
+		pkg = "api"
+	}
+	name := []rune(t.Name())
+	name[0] = unicode.ToUpper(name[0])
+	return pkg + "." + string(name)
+}
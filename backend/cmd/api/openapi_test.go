@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"ubuntu-auto-update/backend/pkg/middleware"
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+// openAPIRouter mounts the public and authenticated routes the way main
+// does.
+func openAPIRouter(t *testing.T) *mux.Router {
+	t.Helper()
+	app, mock := testAppWithDB(t)
+	t.Cleanup(mock.Close)
+	r := mux.NewRouter()
+	app.registerPublicRoutes(r, middleware.NewLoginRateLimiter())
+	api := r.PathPrefix("/api/v1").Subrouter()
+	app.registerAPIRoutes(api, true, app.AuthConfig.CookieName)
+	return r
+}
+
+func fetchOpenAPI(t *testing.T) map[string]any {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	openAPIRouter(t).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/openapi.json", nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("not JSON: %v", err)
+	}
+	return doc
+}
+
+// The served document has the shape OpenAPI 3.0 requires: every operation
+// has a summary, a unique operationId and responses, path parameters match
+// the template, and every $ref and security scheme resolves.
+func TestOpenAPI_ValidDocument(t *testing.T) {
+	doc := fetchOpenAPI(t)
+
+	if v, _ := doc["openapi"].(string); !strings.HasPrefix(v, "3.0.") {
+		t.Errorf("openapi = %v", doc["openapi"])
+	}
+	info, _ := doc["info"].(map[string]any)
+	if info["title"] == "" || info["version"] == "" {
+		t.Errorf("info = %v", info)
+	}
+	components, _ := doc["components"].(map[string]any)
+	schemas, _ := components["schemas"].(map[string]any)
+	schemes, _ := components["securitySchemes"].(map[string]any)
+	for _, req := range doc["security"].([]any) {
+		for name := range req.(map[string]any) {
+			if schemes[name] == nil {
+				t.Errorf("security requirement %q has no scheme", name)
+			}
+		}
+	}
+
+	paths, _ := doc["paths"].(map[string]any)
+	if len(paths) == 0 {
+		t.Fatal("no paths")
+	}
+	varRe := regexp.MustCompile(`\{([^}]+)\}`)
+	opIDs := map[string]string{}
+	for p, item := range paths {
+		var want []string
+		for _, m := range varRe.FindAllStringSubmatch(p, -1) {
+			want = append(want, m[1])
+		}
+		for method, raw := range item.(map[string]any) {
+			op := raw.(map[string]any)
+			where := strings.ToUpper(method) + " " + p
+			if s, _ := op["summary"].(string); s == "" {
+				t.Errorf("%s: no summary", where)
+			}
+			id, _ := op["operationId"].(string)
+			if prev, dup := opIDs[id]; dup || id == "" {
+				t.Errorf("%s: operationId %q (also %s)", where, id, prev)
+			}
+			opIDs[id] = where
+			if resp, _ := op["responses"].(map[string]any); len(resp) == 0 {
+				t.Errorf("%s: no responses", where)
+			}
+			var got []string
+			params, _ := op["parameters"].([]any)
+			for _, prm := range params {
+				prm := prm.(map[string]any)
+				if prm["in"] == "path" && prm["required"] == true {
+					got = append(got, prm["name"].(string))
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("%s: path parameters %v, want %v", where, got, want)
+			}
+		}
+	}
+
+	var checkRefs func(v any)
+	checkRefs = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			if ref, ok := v["$ref"].(string); ok {
+				name := strings.TrimPrefix(ref, "#/components/schemas/")
+				if name == ref || schemas[name] == nil {
+					t.Errorf("unresolved $ref %q", ref)
+				}
+			}
+			for _, child := range v {
+				checkRefs(child)
+			}
+		case []any:
+			for _, child := range v {
+				checkRefs(child)
+			}
+		}
+	}
+	checkRefs(doc)
+
+	login := paths["/api/v1/login"].(map[string]any)["post"].(map[string]any)
+	if sec, ok := login["security"].([]any); !ok || len(sec) != 0 {
+		t.Errorf("login should be public, security = %v", login["security"])
+	}
+	hosts := paths["/api/v1/hosts"].(map[string]any)["get"].(map[string]any)
+	if _, ok := hosts["security"]; ok {
+		t.Errorf("hosts should inherit the document's auth, security = %v", hosts["security"])
+	}
+	if _, ok := paths["/metrics"]; ok {
+		t.Error("non-API routes should be left out")
+	}
+}
+
+// Every served /api/v1 route has an apiDocs entry and every entry still
+// has a route.
+func TestOpenAPI_DocumentsEveryRoute(t *testing.T) {
+	routes := map[string]bool{}
+	err := openAPIRouter(t).Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(tmpl, "/api/v1/") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, m := range methods {
+			if m != http.MethodOptions {
+				routes[m+" "+tmpl] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var missing, stale []string
+	for key := range routes {
+		if _, ok := apiDocs[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	for key := range apiDocs {
+		if !routes[key] {
+			stale = append(stale, key)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(stale)
+	if len(missing) > 0 {
+		t.Errorf("routes without apiDocs entries: %v", missing)
+	}
+	if len(stale) > 0 {
+		t.Errorf("apiDocs entries without routes: %v", stale)
+	}
+}
+
+// The Host and UpdateRun schemas list every key their custom MarshalJSON
+// emits, so schemaExtras can't fall behind the models.
+func TestOpenAPI_SchemasCoverMarshaledKeys(t *testing.T) {
+	schemas := fetchOpenAPI(t)["components"].(map[string]any)["schemas"].(map[string]any)
+	for name, v := range map[string]any{
+		"models.Host":      models.Host{Tags: []string{}},
+		"models.UpdateRun": models.UpdateRun{},
+	} {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys map[string]any
+		if err := json.Unmarshal(raw, &keys); err != nil {
+			t.Fatal(err)
+		}
+		props := schemas[name].(map[string]any)["properties"].(map[string]any)
+		for k := range keys {
+			if props[k] == nil {
+				t.Errorf("%s: marshaled key %q missing from the schema", name, k)
+			}
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+
+	"ubuntu-auto-update/backend/pkg/inventory"
+	"ubuntu-auto-update/backend/pkg/models"
+	sshpkg "ubuntu-auto-update/backend/pkg/ssh"
+)
+
+const (
+	defaultPackagesPage = 500
+	maxPackagesPage     = 5000
+)
+
+type packagesResponse struct {
+	Packages  []models.Package `json:"packages"`
+	Total     int              `json:"total"`
+	Limit     int              `json:"limit"`
+	Offset    int              `json:"offset"`
+	FetchedAt time.Time        `json:"fetched_at"`
+	Cached    bool             `json:"cached"`
+}
+
+// handleListPackages returns one page of the host's installed packages, as
+// reported by dpkg-query. The full list is cached for inventory.CacheTTL so
+// walking the pages doesn't SSH once per page; ?refresh=true forces a fresh
+// read. ?q= keeps packages whose name contains it. Total counts the
+// filtered list.
+func (app *Application) handleListPackages(w http.ResponseWriter, r *http.Request) {
+	id, err := parseHostID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+	q := r.URL.Query()
+	limit := defaultPackagesPage
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPackagesPage {
+			writeJSONError(w, http.StatusBadRequest, "limit must be 1-5000")
+			return
+		}
+		limit = n
+	}
+	offset := 0
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, "offset must be >= 0")
+			return
+		}
+		offset = n
+	}
+
+	var pkgs []models.Package
+	var fetchedAt time.Time
+	cached := false
+	if q.Get("refresh") != "true" {
+		pkgs, fetchedAt, err = inventory.Cached(r.Context(), app.DB, id)
+		switch {
+		case err == nil:
+			cached = time.Since(fetchedAt) < inventory.CacheTTL
+		case !errors.Is(err, pgx.ErrNoRows):
+			// The cache is an optimization; fall through to the host.
+			log.Errorf("Failed to read cached packages for host %d: %v", id, err)
+		}
+	}
+	if !cached {
+		var ok bool
+		if pkgs, fetchedAt, ok = app.fetchPackages(w, r, id); !ok {
+			return
+		}
+	}
+
+	if needle := q.Get("q"); needle != "" {
+		filtered := make([]models.Package, 0, len(pkgs))
+		for _, p := range pkgs {
+			if strings.Contains(p.Name, needle) {
+				filtered = append(filtered, p)
+			}
+		}
+		pkgs = filtered
+	}
+	total := len(pkgs)
+	page := pkgs[min(offset, total):min(offset+limit, total)]
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(packagesResponse{
+		Packages:  page,
+		Total:     total,
+		Limit:     limit,
+		Offset:    offset,
+		FetchedAt: fetchedAt,
+		Cached:    cached,
+	})
+}
+
+type packageHistoryResponse struct {
+	FromRun        int32     `json:"from_run"`
+	ToRun          int32     `json:"to_run"`
+	FromCapturedAt time.Time `json:"from_captured_at"`
+	ToCapturedAt   time.Time `json:"to_captured_at"`
+	inventory.Diff
+}
+
+// handlePackageHistory diffs the package lists recorded after two update
+// runs of the host, ?from= and ?to= (run IDs): packages added, removed and
+// changed version in between. Only successful update runs since snapshots
+// were introduced have a list, so other runs get a 409 saying so.
+func (app *Application) handlePackageHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := parseHostID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+	var runIDs [2]int32
+	for i, param := range []string{"from", "to"} {
+		n, err := strconv.ParseInt(r.URL.Query().Get(param), 10, 32)
+		if err != nil || n < 1 {
+			writeJSONError(w, http.StatusBadRequest, param+" must be a run ID")
+			return
+		}
+		runIDs[i] = int32(n)
+	}
+	var snaps [2]inventory.Snapshot
+	for i, runID := range runIDs {
+		snap, err := inventory.GetSnapshot(r.Context(), app.DB, runID)
+		if errors.Is(err, pgx.ErrNoRows) || (err == nil && snap.HostID != id) {
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("Run %d not found on this host", runID))
+			return
+		}
+		if err != nil {
+			log.Errorf("Failed to read package snapshot of run %d: %v", runID, err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to read package snapshot")
+			return
+		}
+		if !snap.Captured {
+			writeJSONError(w, http.StatusConflict, fmt.Sprintf(
+				"Run %d has no package snapshot; only successful update runs record one, and older runs predate them", runID))
+			return
+		}
+		snaps[i] = snap
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(packageHistoryResponse{
+		FromRun:        snaps[0].RunID,
+		ToRun:          snaps[1].RunID,
+		FromCapturedAt: snaps[0].CapturedAt,
+		ToCapturedAt:   snaps[1].CapturedAt,
+		Diff:           inventory.DiffPackages(snaps[0].Packages, snaps[1].Packages),
+	})
+}
+
+// snapshotPackages records the host's package list after update run runID,
+// for handlePackageHistory. Failing only costs the run its snapshot.
+func (app *Application) snapshotPackages(ctx context.Context, client *ssh.Client, runID int32) {
+	pkgs, err := inventory.Fetch(client)
+	if err != nil {
+		log.Warnf("Package snapshot after run %d failed: %v", runID, err)
+		return
+	}
+	if err := inventory.SaveSnapshot(ctx, app.DB, runID, pkgs); err != nil {
+		log.Errorf("Failed to store package snapshot of run %d: %v", runID, err)
+	}
+}
+
+// fetchPackages reads the inventory from the host and refreshes the cache.
+// On failure it writes the error response and returns ok = false.
+func (app *Application) fetchPackages(w http.ResponseWriter, r *http.Request, id int32) ([]models.Package, time.Time, bool) {
+	client, done, ok := app.dialForQuery(w, r, id)
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	defer done()
+
+	pkgs, err := inventory.Fetch(client)
+	if err != nil && sshpkg.ConnectionLost(client) {
+		err = sshpkg.ErrConnectionLost
+	}
+	if err != nil {
+		log.Errorf("Package inventory for host %d failed: %v", id, err)
+		writeJSONError(w, http.StatusBadGateway, "Package inventory failed: "+err.Error())
+		return nil, time.Time{}, false
+	}
+
+	fetchedAt, err := inventory.Store(r.Context(), app.DB, id, pkgs)
+	if err != nil {
+		log.Errorf("Failed to cache packages for host %d: %v", id, err)
+		fetchedAt = time.Now()
+	}
+	return pkgs, fetchedAt, true
+}
+
+// dialForQuery takes an SSH slot and a (possibly reused) connection for a
+// short read-only query that answers a plain HTTP request. done releases
+// both. On failure it writes the error response and returns ok = false.
+func (app *Application) dialForQuery(w http.ResponseWriter, r *http.Request, id int32) (client *ssh.Client, done func(), ok bool) {
+	release, err := app.SSHLimit.Acquire(r.Context())
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return nil, nil, false
+	}
+	client, _, doneSSH, err := app.SSHDialer.ConnectReusable(r.Context(), id)
+	if err != nil {
+		release()
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "Host not found or has no SSH key")
+			return nil, nil, false
+		}
+		log.Errorf("SSH connect to host %d failed: %v", id, err)
+		writeJSONError(w, http.StatusBadGateway, "SSH connect failed: "+err.Error())
+		return nil, nil, false
+	}
+	return client, func() { doneSSH(); release() }, true
+}
+
+// handleGetUnattended returns the last unattended-upgrades probe stored for
+// the host. It never touches the host; POST .../check does.
+func (app *Application) handleGetUnattended(w http.ResponseWriter, r *http.Request) {
+	id, err := parseHostID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+	st, err := inventory.GetUnattended(r.Context(), app.DB, id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "unattended-upgrades has not been checked on this host yet")
+			return
+		}
+		log.Errorf("Failed to read unattended-upgrades status for host %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to read unattended-upgrades status")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// handleCheckUnattended probes unattended-upgrades over SSH, stores the
+// result and returns it. A host without the package is a normal answer
+// (installed: false), not an error.
+func (app *Application) handleCheckUnattended(w http.ResponseWriter, r *http.Request) {
+	id, err := parseHostID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+	client, done, ok := app.dialForQuery(w, r, id)
+	if !ok {
+		return
+	}
+	st, err := inventory.FetchUnattended(client)
+	if err != nil && sshpkg.ConnectionLost(client) {
+		err = sshpkg.ErrConnectionLost
+	}
+	done()
+	if err != nil {
+		log.Errorf("unattended-upgrades probe for host %d failed: %v", id, err)
+		writeJSONError(w, http.StatusBadGateway, "unattended-upgrades probe failed: "+err.Error())
+		return
+	}
+
+	st, err = inventory.StoreUnattended(r.Context(), app.DB, id, st)
+	if err != nil {
+		log.Errorf("Failed to store unattended-upgrades status for host %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to store unattended-upgrades status")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+
+	"ubuntu-auto-update/backend/pkg/inventory"
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+func packagesRequest(query string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/hosts/1/packages"+query, nil)
+	return mux.SetURLVars(req, map[string]string{"id": "1"})
+}
+
+func TestHandleListPackages_PagesFromCache(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	cached := []byte(`[{"name":"adduser","version":"3.118"},{"name":"apt","version":"2.4.12"},` +
+		`{"name":"libapt-pkg6.0","version":"2.4.12"},{"name":"zlib1g","version":"1:1.2.11"}]`)
+	mock.ExpectQuery(`SELECT packages, fetched_at FROM host_packages`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows([]string{"packages", "fetched_at"}).AddRow(cached, time.Now().Add(-time.Minute)))
+
+	rr := httptest.NewRecorder()
+	app.handleListPackages(rr, packagesRequest("?q=apt&limit=1&offset=1"))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp packagesResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Cached || resp.Total != 2 || len(resp.Packages) != 1 || resp.Packages[0].Name != "libapt-pkg6.0" {
+		t.Errorf("unexpected page: %+v", resp)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestHandleListPackages_OffsetPastEnd(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	mock.ExpectQuery(`SELECT packages, fetched_at FROM host_packages`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows([]string{"packages", "fetched_at"}).
+			AddRow([]byte(`[{"name":"apt","version":"2.4.12"}]`), time.Now()))
+
+	rr := httptest.NewRecorder()
+	app.handleListPackages(rr, packagesRequest("?offset=10"))
+
+	var resp packagesResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusOK || resp.Total != 1 || resp.Packages == nil || len(resp.Packages) != 0 {
+		t.Errorf("got %d %+v", rr.Code, resp)
+	}
+}
+
+func TestHandleListPackages_BadParams(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	for _, q := range []string{"?limit=0", "?limit=5001", "?limit=x", "?offset=-1"} {
+		rr := httptest.NewRecorder()
+		app.handleListPackages(rr, packagesRequest(q))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", q, rr.Code)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestHandleGetUnattended(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	lastRun := time.Date(2024, 3, 11, 4, 23, 11, 0, time.UTC)
+	mock.ExpectQuery(`FROM host_unattended_upgrades`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows([]string{"host_id", "installed", "enabled", "last_run", "checked_at"}).
+			AddRow(int32(1), true, true, &lastRun, time.Now()))
+	mock.ExpectQuery(`FROM host_unattended_upgrades`).WithArgs(int32(1)).
+		WillReturnError(pgx.ErrNoRows)
+
+	rr := httptest.NewRecorder()
+	app.handleGetUnattended(rr, packagesRequest(""))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"last_run":"2024-03-11T04:23:11Z"`) {
+		t.Errorf("got %d %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	app.handleGetUnattended(rr, packagesRequest(""))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("never checked: expected 404, got %d", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func historyRequest(query string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/hosts/1/history"+query, nil)
+	return mux.SetURLVars(req, map[string]string{"id": "1"})
+}
+
+func expectSnapshot(mock pgxmock.PgxPoolIface, runID, hostID int32, packages []byte, capturedAt *time.Time) {
+	mock.ExpectQuery(`FROM update_runs r LEFT JOIN run_packages`).WithArgs(runID).
+		WillReturnRows(mock.NewRows([]string{"host_id", "packages", "captured_at"}).AddRow(hostID, packages, capturedAt))
+}
+
+func TestHandlePackageHistory_DiffsSnapshots(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	before, after := time.Now().Add(-24*time.Hour), time.Now()
+	expectSnapshot(mock, 7, 1, []byte(`[{"name":"apt","version":"2.4.11"},{"name":"curl","version":"7.81.0-1ubuntu1.15"},`+
+		`{"name":"linux-image-5.15.0-91-generic","version":"5.15.0-91.101"}]`), &before)
+	expectSnapshot(mock, 9, 1, []byte(`[{"name":"apt","version":"2.4.11"},{"name":"curl","version":"7.81.0-1ubuntu1.16"},`+
+		`{"name":"linux-image-5.15.0-94-generic","version":"5.15.0-94.104"}]`), &after)
+
+	rr := httptest.NewRecorder()
+	app.handlePackageHistory(rr, historyRequest("?from=7&to=9"))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp struct {
+		FromRun  int32 `json:"from_run"`
+		ToRun    int32 `json:"to_run"`
+		Added    []models.Package
+		Removed  []models.Package
+		Upgraded []inventory.PackageChange
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.FromRun != 7 || resp.ToRun != 9 {
+		t.Errorf("runs = %d..%d", resp.FromRun, resp.ToRun)
+	}
+	if len(resp.Added) != 1 || resp.Added[0].Name != "linux-image-5.15.0-94-generic" ||
+		len(resp.Removed) != 1 || resp.Removed[0].Name != "linux-image-5.15.0-91-generic" {
+		t.Errorf("added %+v, removed %+v", resp.Added, resp.Removed)
+	}
+	want := inventory.PackageChange{Name: "curl", From: "7.81.0-1ubuntu1.15", To: "7.81.0-1ubuntu1.16"}
+	if len(resp.Upgraded) != 1 || resp.Upgraded[0] != want {
+		t.Errorf("upgraded %+v", resp.Upgraded)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// Runs from before snapshots existed are a 409, another host's run a 404.
+func TestHandlePackageHistory_MissingSnapshots(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	now := time.Now()
+	expectSnapshot(mock, 3, 1, nil, nil)
+	rr := httptest.NewRecorder()
+	app.handlePackageHistory(rr, historyRequest("?from=3&to=9"))
+	if rr.Code != http.StatusConflict || !strings.Contains(rr.Body.String(), "Run 3 has no package snapshot") {
+		t.Errorf("no snapshot: got %d %s", rr.Code, rr.Body.String())
+	}
+
+	expectSnapshot(mock, 7, 1, []byte(`[]`), &now)
+	expectSnapshot(mock, 8, 2, []byte(`[]`), &now)
+	rr = httptest.NewRecorder()
+	app.handlePackageHistory(rr, historyRequest("?from=7&to=8"))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("other host's run: got %d", rr.Code)
+	}
+
+	mock.ExpectQuery(`FROM update_runs r LEFT JOIN run_packages`).WithArgs(int32(99)).WillReturnError(pgx.ErrNoRows)
+	rr = httptest.NewRecorder()
+	app.handlePackageHistory(rr, historyRequest("?from=99&to=9"))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("unknown run: got %d", rr.Code)
+	}
+
+	for _, q := range []string{"", "?from=7", "?from=x&to=9", "?from=0&to=9"} {
+		rr := httptest.NewRecorder()
+		app.handlePackageHistory(rr, historyRequest(q))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", q, rr.Code)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
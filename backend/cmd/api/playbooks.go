@@ -100,8 +100,8 @@ type playbookRequest struct {
 func (app *Application) handleCreatePlaybook(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
 	var req playbookRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
 		return
 	}
 	name := strings.TrimSpace(req.Name)
@@ -147,8 +147,8 @@ func (app *Application) handleUpdatePlaybook(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	var req playbookRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
 		return
 	}
 	name := strings.TrimSpace(req.Name)
@@ -259,7 +259,7 @@ func (app *Application) handleRunPlaybook(w http.ResponseWriter, r *http.Request
 		map[string]interface{}{"playbook_id": pb.ID, "playbook_name": pb.Name, "step_count": len(pb.Steps)})
 
 	steps := playbooks.CompileSteps(pb.Steps, host.SshUser, pb.UseSudo)
-	app.runHostCommandOpts(w, r, id, models.RunKindPlaybook, steps, &pb.ID)
+	app.runHostCommandOpts(w, r, id, models.RunKindPlaybook, steps, &pb.ID, "", "", models.UpdateHooks{})
 }
 
 // handleBulkRunPlaybook fans a playbook across many hosts via the bulk
@@ -274,8 +274,8 @@ func (app *Application) handleBulkRunPlaybook(w http.ResponseWriter, r *http.Req
 		CanaryWaitSeconds int     `json:"canary_wait_seconds,omitempty"`
 		AbortOnFailurePct int     `json:"abort_on_failure_pct,omitempty"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
 		return
 	}
 	if len(req.HostIDs) == 0 {
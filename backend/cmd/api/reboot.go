@@ -2,29 +2,119 @@ package main
 
 // Reboot orchestration: issue a reboot over SSH and verify the host comes
 // back (boot_id change, with a went-down-and-returned fallback). One engine
-// for any host count — a single-host reboot is a bulk run of one, so it
-// shares the coordinator's concurrency, run history, and webhook dispatch.
+// for any host count — rebooting one host and watching it return is a bulk
+// run of one, so it shares the coordinator's concurrency, run history, and
+// webhook dispatch. POST /hosts/{id}/reboot is the fire-and-forget
+// alternative: it issues the reboot, optionally delayed, and returns.
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/jackc/pgx/v5"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
 
 	"ubuntu-auto-update/backend/pkg/audit"
+	"ubuntu-auto-update/backend/pkg/db"
 	"ubuntu-auto-update/backend/pkg/middleware"
 	"ubuntu-auto-update/backend/pkg/models"
 	"ubuntu-auto-update/backend/pkg/updater"
 )
 
+// maxRebootDelayMinutes bounds delay_minutes to a day; anything later is a
+// schedule, not a reboot.
+const maxRebootDelayMinutes = 24 * 60
+
+// handleRebootHost reboots one host, now or after delay_minutes, and
+// returns once the reboot is issued without waiting for the host to come
+// back. Rebooting takes the host's services down, so it needs confirm=true.
+func (app *Application) handleRebootHost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	id, err := parseHostID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+	var req struct {
+		DelayMinutes int `json:"delay_minutes"`
+	}
+	if err := decodeJSON(r, &req); err != nil && !errors.Is(err, io.EOF) {
+		writeDecodeError(w, err)
+		return
+	}
+	if req.DelayMinutes < 0 || req.DelayMinutes > maxRebootDelayMinutes {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("delay_minutes must be between 0 and %d", maxRebootDelayMinutes))
+		return
+	}
+	if r.URL.Query().Get("confirm") != "true" {
+		writeJSONError(w, http.StatusPreconditionFailed, "Rebooting a host needs confirm=true")
+		return
+	}
+
+	release, err := app.SSHLimit.Acquire(r.Context())
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	defer release()
+	// Not ConnectReusable: the client is about to die with the host, so
+	// there is nothing to park.
+	client, host, err := app.SSHDialer.ConnectToHost(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "Host not found or has no SSH key")
+			return
+		}
+		log.Errorf("SSH connect to host %d failed: %v", id, err)
+		writeJSONError(w, http.StatusBadGateway, "SSH connect failed: "+err.Error())
+		return
+	}
+	delay := time.Duration(req.DelayMinutes) * time.Minute
+	if err := app.rebootHost(r.Context(), client, host, delay); err != nil {
+		log.Errorf("Reboot of host %d failed: %v", id, err)
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	app.audit(r, audit.ActionHostReboot, "host", strconv.FormatInt(int64(id), 10),
+		map[string]interface{}{"delay_minutes": req.DelayMinutes})
+	msg := "Reboot issued"
+	if req.DelayMinutes > 0 {
+		msg = fmt.Sprintf("Reboot scheduled in %d minutes", req.DelayMinutes)
+	}
+	middleware.SendSuccessResponse(w, http.StatusAccepted, id, msg)
+}
+
+// rebootHost issues the reboot on client, closing it, and clears the host's
+// reboot_required flag. The connection dropping under the command is the
+// reboot working, not a failure.
+func (app *Application) rebootHost(ctx context.Context, client *ssh.Client, host models.Host, delay time.Duration) error {
+	if err := updater.IssueReboot(client, updater.RebootCommand(host, delay)); err != nil {
+		return err
+	}
+	// The host is going down either way, so a failed write only leaves a
+	// stale flag for the next report to correct.
+	if err := db.ClearRebootRequired(context.WithoutCancel(ctx), app.DB, host.ID); err != nil {
+		log.Warnf("Failed to clear reboot_required for host %d: %v", host.ID, err)
+	}
+	return nil
+}
+
 func (app *Application) handleBulkReboot(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
 	var req struct {
 		HostIDs     []int32 `json:"host_ids"`
 		Concurrency int     `json:"concurrency,omitempty"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
 		return
 	}
 	if len(req.HostIDs) == 0 {
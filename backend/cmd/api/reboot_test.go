@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pashagolub/pgxmock/v4"
+	"golang.org/x/crypto/ssh"
+
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+// The host going down under the reboot command drops the channel without an
+// exit status. That is the reboot working: it succeeds and clears the flag.
+func TestRebootHost_ConnectionDropIsSuccess(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	var (
+		mu  sync.Mutex
+		ran string
+	)
+	client := newTestSSHServer(t, func(ch ssh.Channel, cmd string) {
+		mu.Lock()
+		ran = cmd
+		mu.Unlock()
+		ch.Close()
+	})
+
+	mock.ExpectExec(`UPDATE hosts SET reboot_required = FALSE`).WithArgs(int32(1)).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	if err := app.rebootHost(context.Background(), client, models.Host{ID: 1, SshUser: "ubuntu"}, 0); err != nil {
+		t.Fatalf("connection drop reported as failure: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if ran != "sudo -n shutdown -r now" {
+		t.Errorf("ran %q", ran)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// A reboot command that exits non-zero is refused by the host, which stays
+// up: the error carries its output and the flag is left alone.
+func TestRebootHost_CommandFailure(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	client := newTestSSHServer(t, func(ch ssh.Channel, cmd string) {
+		_, _ = ch.Stderr().Write([]byte("sudo: a password is required\n"))
+		_, _ = ch.SendRequest("exit-status", false, []byte{0, 0, 0, 1})
+	})
+
+	err := app.rebootHost(context.Background(), client, models.Host{ID: 1, SshUser: "ubuntu"}, 0)
+	if err == nil || !strings.Contains(err.Error(), "sudo: a password is required") {
+		t.Fatalf("err = %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// A delayed reboot is scheduled with shutdown's +minutes and exits 0.
+func TestRebootHost_Delay(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	var (
+		mu  sync.Mutex
+		ran string
+	)
+	client := newTestSSHServer(t, func(ch ssh.Channel, cmd string) {
+		mu.Lock()
+		ran = cmd
+		mu.Unlock()
+		_, _ = ch.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+	})
+
+	mock.ExpectExec(`UPDATE hosts SET reboot_required = FALSE`).WithArgs(int32(1)).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	if err := app.rebootHost(context.Background(), client, models.Host{ID: 1, SshUser: "root"}, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if ran != "shutdown -r +5" {
+		t.Errorf("ran %q", ran)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// Nothing is dialled without confirm=true or with an out-of-range delay.
+func TestHandleRebootHost_Guards(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	tests := []struct {
+		query, body string
+		want        int
+	}{
+		{"", "", http.StatusPreconditionFailed},
+		{"confirm=1", `{"delay_minutes":5}`, http.StatusPreconditionFailed},
+		{"confirm=true", `{"delay_minutes":-1}`, http.StatusBadRequest},
+		{"confirm=true", `{"delay_minutes":1441}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/hosts/1/reboot?"+tt.query, strings.NewReader(tt.body))
+		req = mux.SetURLVars(req, map[string]string{"id": "1"})
+		rr := httptest.NewRecorder()
+		app.handleRebootHost(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("%s %s: got %d, want %d", tt.query, tt.body, rr.Code, tt.want)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock/v4"
+
+	"ubuntu-auto-update/backend/pkg/middleware"
+	"ubuntu-auto-update/backend/pkg/session"
+)
+
+var (
+	rotateCols  = []string{"user_id"}
+	userRowCols = []string{"id", "username", "role", "disabled_at", "created_at", "updated_at", "last_login_at", "failed_logins", "locked_until"}
+)
+
+func refreshRequest(token string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/refresh", nil)
+	req.AddCookie(&http.Cookie{Name: middleware.RefreshCookieName, Value: token})
+	return req
+}
+
+func refreshCookie(rr *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == middleware.RefreshCookieName {
+			return c
+		}
+	}
+	return nil
+}
+
+// A valid refresh cookie yields a new session with the user's current role
+// and the next refresh token.
+func TestHandleRefresh_Success(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.Sessions = session.NewMemoryStore()
+
+	now := time.Now()
+	mock.ExpectQuery(`WITH spent AS \(\s*UPDATE refresh_tokens`).WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnRows(mock.NewRows(rotateCols).AddRow(int32(5)))
+	mock.ExpectQuery(`FROM users WHERE id = \$1`).WithArgs(int32(5)).
+		WillReturnRows(mock.NewRows(userRowCols).AddRow(int32(5), "carol", "operator", nil, now, now, nil, int32(0), nil))
+
+	rr := httptest.NewRecorder()
+	app.handleRefresh(rr, refreshRequest("old-refresh"))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp["refresh_token"] == "" || resp["refresh_token"] == "old-refresh" {
+		t.Errorf("refresh_token = %q, want a new token", resp["refresh_token"])
+	}
+	if c := refreshCookie(rr); c == nil || c.Value != resp["refresh_token"] || !c.HttpOnly {
+		t.Errorf("refresh cookie = %+v", c)
+	}
+	p, ok, _ := app.Sessions.Validate(context.Background(), resp["token"])
+	if !ok || p.UserID != 5 || p.Role != "operator" {
+		t.Errorf("session = %+v (ok=%v)", p, ok)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// Presenting a token that was already rotated out revokes the login and is
+// audited.
+func TestHandleRefresh_ReuseAfterRotation(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.Sessions = session.NewMemoryStore()
+
+	mock.ExpectQuery(`WITH spent AS \(\s*UPDATE refresh_tokens`).WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnRows(mock.NewRows(rotateCols))
+	mock.ExpectExec(`DELETE FROM refresh_tokens`).WithArgs(pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("DELETE", 2))
+	expectAudit(mock)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/refresh", strings.NewReader(`{"refresh_token":"spent"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	app.handleRefresh(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if c := refreshCookie(rr); c == nil || c.MaxAge >= 0 {
+		t.Errorf("refresh cookie not cleared: %+v", c)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestHandleRefresh_Expired(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.Sessions = session.NewMemoryStore()
+
+	mock.ExpectQuery(`WITH spent AS \(\s*UPDATE refresh_tokens`).WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnRows(mock.NewRows(rotateCols))
+	mock.ExpectExec(`DELETE FROM refresh_tokens`).WithArgs(pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("DELETE", 0))
+
+	rr := httptest.NewRecorder()
+	app.handleRefresh(rr, refreshRequest("expired"))
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// A user disabled since login can't refresh, and the token just issued to
+// them is revoked again.
+func TestHandleRefresh_DisabledUser(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.Sessions = session.NewMemoryStore()
+
+	now := time.Now()
+	mock.ExpectQuery(`WITH spent AS \(\s*UPDATE refresh_tokens`).WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnRows(mock.NewRows(rotateCols).AddRow(int32(5)))
+	mock.ExpectQuery(`FROM users WHERE id = \$1`).WithArgs(int32(5)).
+		WillReturnRows(mock.NewRows(userRowCols).AddRow(int32(5), "carol", "operator", &now, now, now, nil, int32(0), nil))
+	mock.ExpectExec(`DELETE FROM refresh_tokens`).WithArgs(pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("DELETE", 2))
+
+	rr := httptest.NewRecorder()
+	app.handleRefresh(rr, refreshRequest("old-refresh"))
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// Logout revokes the refresh family along with the session.
+func TestHandleLogout_RevokesRefreshToken(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.Sessions = session.NewMemoryStore()
+
+	mock.ExpectExec(`DELETE FROM refresh_tokens`).WithArgs(pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	expectAudit(mock)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/logout", nil)
+	req.AddCookie(&http.Cookie{Name: middleware.RefreshCookieName, Value: "live"})
+	rr := httptest.NewRecorder()
+	app.handleLogout(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", rr.Code)
+	}
+	if c := refreshCookie(rr); c == nil || c.MaxAge >= 0 {
+		t.Errorf("refresh cookie not cleared: %+v", c)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -47,6 +47,7 @@ const complianceQuery = `
 		WHERE host_id = h.id AND kind = 'update' AND status <> 'running'
 		ORDER BY started_at DESC LIMIT 1
 	) att ON true
+	WHERE h.deleted_at IS NULL
 	ORDER BY h.hostname`
 
 func (app *Application) handleComplianceReport(w http.ResponseWriter, r *http.Request) {
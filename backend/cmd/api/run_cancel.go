@@ -0,0 +1,95 @@
+package main
+
+// Cancelling single-host runs. The run engine registers each run it starts
+// here; POST /hosts/{id}/cancel-update cancels that run's context with
+// errRunCancelled, and streamCommand turns that into a SIGTERM and a closed
+// session on the remote side. The engine then records the run as cancelled.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+
+	"ubuntu-auto-update/backend/pkg/audit"
+	"ubuntu-auto-update/backend/pkg/middleware"
+)
+
+// errRunCancelled is the cause a run's context carries once an operator
+// cancels it.
+var errRunCancelled = errors.New("run cancelled")
+
+// activeRuns tracks the single-host runs in flight, by run ID. The zero
+// value is ready to use.
+type activeRuns struct {
+	mu   sync.Mutex
+	runs map[int32]activeRun
+}
+
+type activeRun struct {
+	hostID int32
+	cancel context.CancelCauseFunc
+}
+
+// add registers runID on hostID until the returned remove is called.
+func (a *activeRuns) add(runID, hostID int32, cancel context.CancelCauseFunc) (remove func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.runs == nil {
+		a.runs = make(map[int32]activeRun)
+	}
+	a.runs[runID] = activeRun{hostID: hostID, cancel: cancel}
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		delete(a.runs, runID)
+	}
+}
+
+// cancelHost cancels every run in flight on hostID with cause and returns
+// their IDs, lowest first. A cancelled run stays listed until its engine
+// unwinds and removes it.
+func (a *activeRuns) cancelHost(hostID int32, cause error) []int32 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var ids []int32
+	for id, run := range a.runs {
+		if run.hostID == hostID {
+			run.cancel(cause)
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// handleCancelUpdate stops the run-update (or preview, simulate, playbook)
+// streaming on a host. It returns once the runs are signalled; each run
+// records itself as cancelled as it unwinds. Bulk runs aren't reachable
+// here.
+func (app *Application) handleCancelUpdate(w http.ResponseWriter, r *http.Request) {
+	id, err := parseHostID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+	by := "unknown"
+	if user := middleware.GetUserFromContext(r); user != nil {
+		by = user.Username
+	}
+	ids := app.runs.cancelHost(id, fmt.Errorf("%w by %s", errRunCancelled, by))
+	if len(ids) == 0 {
+		writeJSONError(w, http.StatusNotFound, "No run in progress on this host")
+		return
+	}
+	app.audit(r, audit.ActionRunCancel, "host", strconv.FormatInt(int64(id), 10),
+		map[string]interface{}{"run_ids": ids})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{"cancelled": ids})
+}
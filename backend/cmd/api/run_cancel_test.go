@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/ssh"
+
+	"ubuntu-auto-update/backend/pkg/middleware"
+)
+
+// Cancelling a long-running command sends it SIGTERM, closes its session and
+// reports errRunCancelled rather than a timeout.
+func TestStreamCommand_CancelTerminatesSession(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	started := make(chan struct{})
+	signals := make(chan string, 1)
+	ended := make(chan struct{})
+	client := newTestSSHServerReqs(t, func(_ ssh.Channel, _ string, reqs <-chan *ssh.Request) {
+		// Never exits on its own, like an apt upgrade stuck on a lock.
+		defer close(ended)
+		close(started)
+		for req := range reqs {
+			if req.Type == "signal" {
+				var p struct{ Signal string }
+				_ = ssh.Unmarshal(req.Payload, &p)
+				signals <- p.Signal
+			}
+		}
+	})
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	go func() {
+		<-started
+		cancel(fmt.Errorf("%w by alice", errRunCancelled))
+	}()
+
+	var (
+		code int
+		err  error
+	)
+	serveWS(t, func(conn *wsConn) {
+		code, err = app.streamCommand(ctx, conn, client, 1, "apt-get upgrade -y", "")
+	})
+	if !errors.Is(err, errRunCancelled) || code != -1 {
+		t.Fatalf("got exit %d, err %v; want -1, errRunCancelled", code, err)
+	}
+	if err.Error() != "run cancelled by alice" {
+		t.Errorf("err = %q", err)
+	}
+	select {
+	case sig := <-signals:
+		if sig != string(ssh.SIGTERM) {
+			t.Errorf("signal = %q, want TERM", sig)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("remote command was never signalled")
+	}
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session still open after cancel")
+	}
+}
+
+func cancelUpdate(app *Application, hostID string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/hosts/"+hostID+"/cancel-update", nil)
+	r = mux.SetURLVars(r, map[string]string{"id": hostID})
+	r = r.WithContext(context.WithValue(r.Context(), middleware.UserContextKey, &middleware.User{Username: "alice"}))
+	rr := httptest.NewRecorder()
+	app.handleCancelUpdate(rr, r)
+	return rr
+}
+
+func TestHandleCancelUpdate(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	ctx7, cancel7 := context.WithCancelCause(context.Background())
+	remove7 := app.runs.add(7, 1, cancel7)
+	ctx8, cancel8 := context.WithCancelCause(context.Background())
+	defer app.runs.add(8, 2, cancel8)()
+
+	expectAudit(mock)
+	rr := cancelUpdate(app, "1")
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if got := strings.TrimSpace(rr.Body.String()); got != `{"cancelled":[7]}` {
+		t.Errorf("body = %s", got)
+	}
+	if cause := context.Cause(ctx7); !errors.Is(cause, errRunCancelled) || cause.Error() != "run cancelled by alice" {
+		t.Errorf("run 7 cause = %v", cause)
+	}
+	if ctx8.Err() != nil {
+		t.Error("a run on another host was cancelled")
+	}
+
+	// Once the run has unwound there is nothing left to cancel.
+	remove7()
+	if rr := cancelUpdate(app, "1"); rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rr.Code)
+	}
+	if rr := cancelUpdate(app, "abc"); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"ubuntu-auto-update/backend/pkg/middleware"
+	"ubuntu-auto-update/backend/pkg/models"
+	sshpkg "ubuntu-auto-update/backend/pkg/ssh"
+)
+
+// scrapeMetric fetches /metrics and returns the value of the sample whose
+// name and labels are exactly series, or 0 if it isn't exposed yet.
+func scrapeMetric(t *testing.T, series string) float64 {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	sc := bufio.NewScanner(rr.Body)
+	for sc.Scan() {
+		name, value, ok := strings.Cut(sc.Text(), " ")
+		if ok && name == series {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("%s: %v", series, err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+// An update run that can't reach its host counts as a failure, with its
+// duration observed under the same label.
+func TestRunUpdate_FailureMetrics(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.SSHDialer = sshpkg.NewDialer(mock)
+
+	const (
+		failures  = `uau_update_runs_total{status="failure"}`
+		durations = `uau_update_run_duration_seconds_count{status="failure"}`
+		successes = `uau_update_runs_total{status="success"}`
+	)
+	beforeFail, beforeDur, beforeOK := scrapeMetric(t, failures), scrapeMetric(t, durations), scrapeMetric(t, successes)
+
+	now := time.Now()
+	hostRow := func() *pgxmock.Rows {
+		return mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, "")
+	}
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).WillReturnRows(hostRow())
+	mock.ExpectQuery(`SELECT password FROM host_sudo_passwords`).WithArgs(int32(1)).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectQuery(`FROM host_update_hooks`).WithArgs(int32(1)).WillReturnError(pgx.ErrNoRows)
+	mock.ExpectQuery(`INSERT INTO update_runs`).
+		WithArgs(int32(1), nil, "alice", models.RunKindUpdate, nil).
+		WillReturnRows(mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id", "kept_back"}).
+			AddRow(int32(7), int32(1), nil, "alice", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil, nil))
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).WillReturnRows(hostRow())
+	mock.ExpectQuery(`SELECT id, host_id, private_key FROM ssh_keys`).WithArgs(int32(1)).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectExec(`UPDATE update_runs`).WithArgs(int32(7), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	expectWebhookLookup(mock, "update_failure", 1)
+	mock.ExpectExec(`UPDATE update_runs`).WithArgs(int32(7), models.RunStatusFailed, sql.NullInt32{}, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = mux.SetURLVars(r, map[string]string{"id": "1"})
+		ctx := context.WithValue(r.Context(), middleware.UserContextKey, &middleware.User{Username: "alice"})
+		app.handleRunUpdate(w, r.WithContext(ctx))
+	}))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	out, code := readUntilClose(t, conn)
+	if code != wsCloseUnreachable {
+		t.Errorf("close code = %d, want %d", code, wsCloseUnreachable)
+	}
+	if !strings.Contains(out, "[run #7 finished: failed]") {
+		t.Fatalf("run did not finish as failed:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+
+	if got := scrapeMetric(t, failures) - beforeFail; got != 1 {
+		t.Errorf("%s moved by %v, want 1", failures, got)
+	}
+	if got := scrapeMetric(t, durations) - beforeDur; got != 1 {
+		t.Errorf("%s moved by %v, want 1", durations, got)
+	}
+	if got := scrapeMetric(t, successes) - beforeOK; got != 0 {
+		t.Errorf("%s moved by %v, want 0", successes, got)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+
+	"ubuntu-auto-update/backend/pkg/middleware"
+	"ubuntu-auto-update/backend/pkg/models"
+	sshpkg "ubuntu-auto-update/backend/pkg/ssh"
+)
+
+// A malformed ?ssh_user= is refused before the host is even looked up.
+func TestRunUpdate_RejectsInvalidSSHUser(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	for _, u := range []string{"-oProxyCommand=id", "root;id", "Bad User"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/hosts/1/run-update", nil)
+		req.URL.RawQuery = url.Values{"ssh_user": {u}}.Encode()
+		req = mux.SetURLVars(req, map[string]string{"id": "1"})
+		rr := httptest.NewRecorder()
+		app.handleRunUpdate(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("ssh_user=%q: got %d, want 400", u, rr.Code)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// An override runs as the given user: the stored user's sudo password isn't
+// loaded, the run says who it ran as, and nothing writes the user back.
+func TestRunUpdate_SSHUserOverride(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.SSHDialer = sshpkg.NewDialer(mock)
+
+	now := time.Now()
+	hostRow := func() *pgxmock.Rows {
+		return mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "ubuntu", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, "")
+	}
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).WillReturnRows(hostRow())
+	mock.ExpectQuery(`FROM host_update_hooks`).WithArgs(int32(1)).WillReturnError(pgx.ErrNoRows)
+	mock.ExpectQuery(`INSERT INTO update_runs`).
+		WithArgs(int32(1), nil, "alice", models.RunKindUpdate, nil).
+		WillReturnRows(mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id", "kept_back"}).
+			AddRow(int32(7), int32(1), nil, "alice", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil, nil))
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).WillReturnRows(hostRow())
+	mock.ExpectQuery(`SELECT id, host_id, private_key FROM ssh_keys`).WithArgs(int32(1)).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectExec(`UPDATE update_runs`).WithArgs(int32(7), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	expectWebhookLookup(mock, "update_failure", 1)
+	mock.ExpectExec(`UPDATE update_runs`).WithArgs(int32(7), models.RunStatusFailed, sql.NullInt32{}, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = mux.SetURLVars(r, map[string]string{"id": "1"})
+		ctx := context.WithValue(r.Context(), middleware.UserContextKey, &middleware.User{Username: "alice"})
+		app.handleRunUpdate(w, r.WithContext(ctx))
+	}))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"?ssh_user=deploy", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	out, _ := readUntilClose(t, conn)
+	if !strings.Contains(out, "[run #7 started by alice as deploy]") {
+		t.Errorf("run didn't report the override user:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// A host with no ssh_user runs as DEFAULT_SSH_USER, like an override: no
+// stored sudo password is loaded for it. Without a default it's a 400.
+func TestRunUpdate_EmptySSHUserUsesDefault(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.SSHDialer = sshpkg.NewDialer(mock)
+
+	now := time.Now()
+	hostRow := func() *pgxmock.Rows {
+		return mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, "")
+	}
+
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).WillReturnRows(hostRow())
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/hosts/1/run-update", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "1"})
+	rr := httptest.NewRecorder()
+	app.handleRunUpdate(rr, req)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "DEFAULT_SSH_USER") {
+		t.Fatalf("without a default: got %d %s, want 400 naming DEFAULT_SSH_USER", rr.Code, rr.Body.String())
+	}
+
+	app.DefaultSSHUser = "ubuntu"
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).WillReturnRows(hostRow())
+	mock.ExpectQuery(`FROM host_update_hooks`).WithArgs(int32(1)).WillReturnError(pgx.ErrNoRows)
+	mock.ExpectQuery(`INSERT INTO update_runs`).
+		WithArgs(int32(1), nil, "alice", models.RunKindUpdate, nil).
+		WillReturnRows(mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id", "kept_back"}).
+			AddRow(int32(7), int32(1), nil, "alice", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil, nil))
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).WillReturnRows(hostRow())
+	mock.ExpectQuery(`SELECT id, host_id, private_key FROM ssh_keys`).WithArgs(int32(1)).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectExec(`UPDATE update_runs`).WithArgs(int32(7), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	expectWebhookLookup(mock, "update_failure", 1)
+	mock.ExpectExec(`UPDATE update_runs`).WithArgs(int32(7), models.RunStatusFailed, sql.NullInt32{}, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = mux.SetURLVars(r, map[string]string{"id": "1"})
+		ctx := context.WithValue(r.Context(), middleware.UserContextKey, &middleware.User{Username: "alice"})
+		app.handleRunUpdate(w, r.WithContext(ctx))
+	}))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	out, _ := readUntilClose(t, conn)
+	if !strings.Contains(out, "[run #7 started by alice as ubuntu]") {
+		t.Errorf("run didn't use the default user:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// A stored key that no longer decrypts fails the run with a message that
+// says how to fix it and nothing about the cipher.
+func TestRunUpdate_UndecryptableKey(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY", strings.Repeat("00", 32))
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.SSHDialer = sshpkg.NewDialer(mock)
+
+	now := time.Now()
+	hostRow := func() *pgxmock.Rows {
+		return mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "ubuntu", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, "")
+	}
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).WillReturnRows(hostRow())
+	mock.ExpectQuery(`FROM host_update_hooks`).WithArgs(int32(1)).WillReturnError(pgx.ErrNoRows)
+	mock.ExpectQuery(`INSERT INTO update_runs`).
+		WithArgs(int32(1), nil, "alice", models.RunKindUpdate, nil).
+		WillReturnRows(mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id", "kept_back"}).
+			AddRow(int32(7), int32(1), nil, "alice", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil, nil))
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).WillReturnRows(hostRow())
+	mock.ExpectQuery(`SELECT id, host_id, private_key FROM ssh_keys`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows([]string{"id", "host_id", "private_key"}).AddRow(int32(11), int32(1), "v1:0123456789abcdef:deadbeef"))
+	mock.ExpectExec(`UPDATE update_runs`).WithArgs(int32(7), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	expectWebhookLookup(mock, "update_failure", 1)
+	mock.ExpectExec(`UPDATE update_runs`).WithArgs(int32(7), models.RunStatusFailed, sql.NullInt32{}, pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = mux.SetURLVars(r, map[string]string{"id": "1"})
+		ctx := context.WithValue(r.Context(), middleware.UserContextKey, &middleware.User{Username: "alice"})
+		app.handleRunUpdate(w, r.WithContext(ctx))
+	}))
+	defer ts.Close()
+
+	// Run as another user so the stored sudo password isn't read.
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"?ssh_user=deploy", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	out, _ := readUntilClose(t, conn)
+	if !strings.Contains(out, "stored SSH key cannot be decrypted; re-add the key") {
+		t.Errorf("output doesn't explain the failure:\n%s", out)
+	}
+	for _, leak := range []string{"0123456789abcdef", "ENCRYPTION", "ciphertext", "decrypt SSH key"} {
+		if strings.Contains(out, leak) {
+			t.Errorf("output leaks %q:\n%s", leak, out)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// A finished simulate run ends with its output parsed into a plan.
+func TestEmitSimulatePlan(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	output := "== ubuntu-auto-update: simulate ==\n" +
+		"1 upgraded, 0 newly installed, 0 to remove and 0 not upgraded.\n" +
+		"Inst curl [7.81.0-1ubuntu1.15] (7.81.0-1ubuntu1.16 Ubuntu:22.04/jammy-updates [amd64])\n" +
+		"Conf curl (7.81.0-1ubuntu1.16 Ubuntu:22.04/jammy-updates [amd64])\n"
+	mock.ExpectQuery(`SELECT (.+) FROM update_runs WHERE id = \$1`).WithArgs(int32(7)).
+		WillReturnRows(mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id", "kept_back"}).
+			AddRow(int32(7), int32(1), nil, "alice", models.RunKindSimulate, models.RunStatusRunning, nil, time.Now(), nil, output, nil, nil, nil))
+
+	msgs := serveWS(t, func(conn *wsConn) {
+		app.emitSimulatePlan(context.Background(), conn, 7)
+	})
+	want := `[plan] {"upgraded":1,"installed":0,"removed":0,"not_upgraded":0,` +
+		`"upgrade":[{"name":"curl","from":"7.81.0-1ubuntu1.15","to":"7.81.0-1ubuntu1.16"}],"install":[],"remove":[],"kept_back":[]}`
+	if got := strings.Join(msgs, ""); !strings.Contains(got, want) {
+		t.Errorf("got %q, want it to contain %q", got, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
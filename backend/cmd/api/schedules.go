@@ -53,8 +53,8 @@ func (app *Application) handleCreateSchedule(w http.ResponseWriter, r *http.Requ
 		WindowDays        int16  `json:"window_days,omitempty"`   // bitmask, 0 ⇒ every day
 		SecurityOnly      bool   `json:"security_only,omitempty"` // apt schedules only
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
 		return
 	}
 	req.Name = strings.TrimSpace(req.Name)
@@ -158,7 +158,7 @@ func (app *Application) handleUpdateSchedule(w http.ResponseWriter, r *http.Requ
 	var req struct {
 		Enabled *bool `json:"enabled"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+	if err := decodeJSON(r, &req); err != nil || req.Enabled == nil {
 		writeJSONError(w, http.StatusBadRequest, "Body must include enabled: true|false")
 		return
 	}
@@ -214,7 +214,7 @@ func (app *Application) handleOverview(w http.ResponseWriter, r *http.Request) {
 		       COUNT(*) FILTER (WHERE last_seen > NOW() - INTERVAL '24 hours'),
 		       COUNT(*) FILTER (WHERE error IS NOT NULL AND error <> ''),
 		       COUNT(*) FILTER (WHERE reboot_required)
-		FROM hosts`).Scan(&out.TotalHosts, &out.OnlineHosts, &out.ErrorHosts, &out.RebootHosts)
+		FROM hosts WHERE deleted_at IS NULL`).Scan(&out.TotalHosts, &out.OnlineHosts, &out.ErrorHosts, &out.RebootHosts)
 	if err != nil {
 		log.Errorf("overview hosts: %v", err)
 		writeJSONError(w, http.StatusInternalServerError, "Failed to compute overview")
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// maxScriptBytes caps a script sent to execute-script. sshd rejects exec
+// requests much beyond this anyway, and it keeps a malicious client from
+// making us buffer arbitrarily large payloads.
+const maxScriptBytes = 128 * 1024
+
+// scriptFootguns are patterns that are almost never what an operator meant to
+// run on a managed host. They're a typo guard, not a sandbox: anyone with
+// execute-script access can trivially get around them, and `force` exists
+// precisely for the rare deliberate case.
+var scriptFootguns = []struct {
+	re     *regexp.Regexp
+	reason string
+}{
+	{regexp.MustCompile(`\brm\s+(-[a-zA-Z]*[rR][a-zA-Z]*\s+|-[a-zA-Z]*f[a-zA-Z]*\s+|--[a-z-]+\s+)*/(\*)?(\s|;|&|\||$)`), "recursive delete of /"},
+	{regexp.MustCompile(`--no-preserve-root`), "rm --no-preserve-root"},
+	{regexp.MustCompile(`\bmkfs(\.\w+)?\s`), "filesystem format (mkfs)"},
+	{regexp.MustCompile(`\bdd\b[^\n]*\bof=/dev/(sd|nvme|vd|xvd|hd|mmcblk)`), "raw write to a block device (dd of=/dev/…)"},
+	{regexp.MustCompile(`:\(\)\s*\{\s*:\s*\|\s*:\s*&\s*\}\s*;\s*:`), "fork bomb"},
+}
+
+// scriptFootgun returns why script looks destructive, or "" if it doesn't.
+func scriptFootgun(script string) string {
+	for _, f := range scriptFootguns {
+		if f.re.MatchString(script) {
+			return f.reason
+		}
+	}
+	return ""
+}
+
+// scriptNameRe is what a named script may be called: it travels in a query
+// string and lands in the audit log.
+var scriptNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// scriptNameMessage returns the name in a {"script_name": "..."} message,
+// which execute-script takes in place of a script as the other way to pick
+// a named one. ok is false for anything else, so a script is a script.
+func scriptNameMessage(msg []byte) (name string, ok bool) {
+	var req struct {
+		ScriptName string `json:"script_name"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil || dec.More() || req.ScriptName == "" {
+		return "", false
+	}
+	return req.ScriptName, true
+}
+
+// loadScriptRegistry reads the named scripts execute-script can run by
+// ?script_name= or a {"script_name"} message: each regular file in dir is one, named after the file less
+// its extension, so restart-nginx.sh is "restart-nginx". Dotfiles and
+// subdirectories are skipped. A missing dir is an empty registry.
+//
+// The registry is read once at startup and only changes on disk, so what
+// can run under EXECUTE_MODE=allowlist is up to whoever runs the server,
+// not to API users.
+func loadScriptRegistry(dir string) (map[string]string, error) {
+	scripts := map[string]string{}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return scripts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") || !e.Type().IsRegular() {
+			continue
+		}
+		name := strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+		if !scriptNameRe.MatchString(name) {
+			return nil, fmt.Errorf("%s: script names are letters, digits, '.', '_' and '-', up to 64 characters", e.Name())
+		}
+		if _, dup := scripts[name]; dup {
+			return nil, fmt.Errorf("%s: another file is already named %q", e.Name(), name)
+		}
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > maxScriptBytes {
+			return nil, fmt.Errorf("%s: over the %d-byte script limit", e.Name(), maxScriptBytes)
+		}
+		if strings.TrimSpace(string(b)) == "" {
+			return nil, fmt.Errorf("%s: empty script", e.Name())
+		}
+		scripts[name] = string(b)
+	}
+	return scripts, nil
+}
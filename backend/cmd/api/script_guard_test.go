@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/pashagolub/pgxmock/v4"
+	"golang.org/x/crypto/ssh"
+
+	"ubuntu-auto-update/backend/pkg/middleware"
+	"ubuntu-auto-update/backend/pkg/session"
+)
+
+func TestScriptFootgun(t *testing.T) {
+	dangerous := []string{
+		"rm -rf /",
+		"sudo rm -rf /*",
+		"rm -fr / ",
+		"rm -r -f /; echo done",
+		"rm -rf --no-preserve-root /",
+		"mkfs.ext4 /dev/sda1",
+		"dd if=/dev/zero of=/dev/sda bs=1M",
+		":(){ :|:& };:",
+	}
+	for _, s := range dangerous {
+		if scriptFootgun(s) == "" {
+			t.Errorf("expected %q to be flagged", s)
+		}
+	}
+
+	safe := []string{
+		"rm -rf /tmp/build",
+		"rm -rf ./cache/",
+		"apt-get update && apt-get -y upgrade",
+		"dd if=/dev/zero of=/tmp/blob bs=1M count=1",
+		"ls -la /",
+	}
+	for _, s := range safe {
+		if reason := scriptFootgun(s); reason != "" {
+			t.Errorf("%q flagged as %q", s, reason)
+		}
+	}
+}
+
+// dialExecuteScript serves handleExecuteScript for host 1 as an
+// authenticated user, sends script unless it is empty (a named script), and
+// returns the first reply.
+func dialExecuteScript(t *testing.T, app *Application, query, script string) (string, int) {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = mux.SetURLVars(r, map[string]string{"id": "1"})
+		ctx := context.WithValue(r.Context(), middleware.UserContextKey, &middleware.User{Username: "alice"})
+		app.handleExecuteScript(w, r.WithContext(ctx))
+	}))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/?token=t&"+query, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if script != "" {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(script)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	_, code := readUntilClose(t, conn)
+	return string(msg), code
+}
+
+func TestExecuteScript_DryRun(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	now := time.Now()
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "deploy", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+
+	msg, code := dialExecuteScript(t, app, "dry_run=true", "uptime")
+	if code != wsCloseOK {
+		t.Errorf("close code = %d, want %d", code, wsCloseOK)
+	}
+
+	var got scriptDryRun
+	if err := json.Unmarshal([]byte(msg), &got); err != nil {
+		t.Fatalf("dry run reply is not JSON: %q", msg)
+	}
+	want := scriptDryRun{DryRun: true, HostID: 1, Hostname: "web-1", SshUser: "deploy", Command: "uptime"}
+	if got != want {
+		t.Errorf("dry run = %+v, want %+v", got, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestExecuteScript_RefusesFootgunWithoutForce(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	// No DB expectations: the refusal must happen before any lookup,
+	// audit row, or SSH dial.
+	msg, code := dialExecuteScript(t, app, "", "rm -rf /")
+	if !strings.Contains(msg, "refused") || !strings.Contains(msg, "force=true") {
+		t.Errorf("unexpected reply %q", msg)
+	}
+	if code != wsCloseRejected {
+		t.Errorf("close code = %d, want %d", code, wsCloseRejected)
+	}
+
+	// force=true gets past the guard; dry_run keeps the test off SSH.
+	now := time.Now()
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+	msg, _ = dialExecuteScript(t, app, "force=true&dry_run=true", "rm -rf /")
+	if !strings.Contains(msg, `"dry_run":true`) {
+		t.Errorf("forced script was not accepted: %q", msg)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestExecuteScript_TooLarge(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	msg, code := dialExecuteScript(t, app, "dry_run=true", strings.Repeat("x", maxScriptBytes+1))
+	if !strings.Contains(msg, "maximum size") {
+		t.Errorf("unexpected reply %q", msg)
+	}
+	if code != wsCloseRejected {
+		t.Errorf("close code = %d, want %d", code, wsCloseRejected)
+	}
+}
+
+// The run.script row is written before the script runs and completed with
+// its exit status afterwards.
+func TestAuditScript_RecordsExitStatus(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	details, outcome := &captureArg{}, &captureArg{}
+	mock.ExpectQuery(`INSERT INTO audit_log (.+) RETURNING id`).
+		WithArgs(pgxmock.AnyArg(), "alice", "run.script", "host", "1", pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), details).
+		WillReturnRows(mock.NewRows([]string{"id"}).AddRow(int64(41)))
+	mock.ExpectExec(`UPDATE audit_log SET details = details \|\| \$2::jsonb WHERE id = \$1`).
+		WithArgs(int64(41), outcome).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/hosts/1/execute-script", nil)
+	req = req.WithContext(context.WithValue(req.Context(), middleware.PrincipalContextKey, &session.Principal{Username: "alice", UserID: 3}))
+	id := app.auditScriptStart(req, 1, "", "systemctl restart nginx")
+
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(details.value.(string)), &got); err != nil {
+		t.Fatalf("details: %v", err)
+	}
+	if got["script_preview"] != "systemctl restart nginx" {
+		t.Errorf("script_preview = %v", got["script_preview"])
+	}
+	if _, ok := got["exit_status"]; ok {
+		t.Errorf("exit_status recorded before the run: %v", got)
+	}
+
+	app.auditScriptEnd(context.Background(), id, scriptExit{Type: "exit", Code: 3}, "Process exited with status 3")
+	got = nil
+	if err := json.Unmarshal([]byte(outcome.value.(string)), &got); err != nil {
+		t.Fatalf("outcome: %v", err)
+	}
+	if got["exit_status"] != float64(3) {
+		t.Errorf("exit_status = %v, want 3", got["exit_status"])
+	}
+	if got["error"] != "Process exited with status 3" {
+		t.Errorf("error = %v", got["error"])
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestScriptExitStatus(t *testing.T) {
+	if got, sig := scriptExitStatus(nil); got != 0 || sig != "" {
+		t.Errorf("nil error = %d %q, want 0", got, sig)
+	}
+	if got, sig := scriptExitStatus(errors.New("connection lost")); got != -1 || sig != "" {
+		t.Errorf("transport error = %d %q, want -1", got, sig)
+	}
+}
+
+// A script's exit status, or the signal that killed it, reaches the client
+// as the final JSON message after its output.
+func TestRunScript_ReportsExit(t *testing.T) {
+	client := newTestSSHServer(t, func(ch ssh.Channel, cmd string) {
+		_, _ = ch.Write([]byte("working\n"))
+		if cmd == "kill -9 $$" {
+			_, _ = ch.SendRequest("exit-signal", false, ssh.Marshal(struct {
+				Signal     string
+				CoreDumped bool
+				Error      string
+				Lang       string
+			}{Signal: "KILL"}))
+			return
+		}
+		_, _ = ch.SendRequest("exit-status", false, []byte{0, 0, 0, 3})
+	})
+
+	tests := []struct {
+		script string
+		want   scriptExit
+	}{
+		{"exit 3", scriptExit{Type: "exit", Code: 3}},
+		{"kill -9 $$", scriptExit{Type: "exit", Code: 137, Signal: "SIGKILL"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.script, func(t *testing.T) {
+			var exit scriptExit
+			var runErr error
+			msgs := serveWS(t, func(conn *wsConn) {
+				exit, runErr = runScript(conn, client, tt.script)
+			})
+			if exit != tt.want || runErr == nil {
+				t.Errorf("runScript = %+v, %v; want %+v and an error", exit, runErr, tt.want)
+			}
+			if len(msgs) == 0 {
+				t.Fatal("no messages")
+			}
+			var got scriptExit
+			if err := json.Unmarshal([]byte(msgs[len(msgs)-1]), &got); err != nil || got != tt.want {
+				t.Errorf("last message = %q, want %+v", msgs[len(msgs)-1], tt.want)
+			}
+			if !strings.Contains(strings.Join(msgs, ""), "working\n") {
+				t.Errorf("output missing from %q", msgs)
+			}
+		})
+	}
+}
+
+// executeScriptStatus is the HTTP status of an execute-script handshake that
+// the server refuses before upgrading.
+func executeScriptStatus(t *testing.T, app *Application, query string) int {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = mux.SetURLVars(r, map[string]string{"id": "1"})
+		ctx := context.WithValue(r.Context(), middleware.UserContextKey, &middleware.User{Username: "alice"})
+		app.handleExecuteScript(w, r.WithContext(ctx))
+	}))
+	defer ts.Close()
+
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/?token=t&"+query, nil)
+	if err == nil {
+		conn.Close()
+		t.Fatalf("%s: handshake succeeded", query)
+	}
+	return resp.StatusCode
+}
+
+func TestLoadScriptRegistry(t *testing.T) {
+	dir := t.TempDir()
+	for name, body := range map[string]string{
+		"restart-nginx.sh": "systemctl restart nginx\n",
+		"disk_usage":       "df -h",
+		".hidden.sh":       "ignored",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := loadScriptRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"restart-nginx": "systemctl restart nginx\n", "disk_usage": "df -h"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("registry = %q, want %q", got, want)
+	}
+
+	if got, err := loadScriptRegistry(filepath.Join(dir, "missing")); err != nil || len(got) != 0 {
+		t.Errorf("missing dir = %v, %v; want an empty registry", got, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "disk_usage.sh"), []byte("du -sh /"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadScriptRegistry(dir); err == nil {
+		t.Error("two files named disk_usage accepted")
+	}
+}
+
+// In allowlist mode a registered name runs that script, as the server has
+// it, and skips the footgun guard.
+func TestExecuteScript_AllowlistRunsNamedScript(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.ScriptsOnly = true
+	app.Scripts = map[string]string{"wipe-scratch": "rm -rf /"}
+
+	now := time.Now()
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+
+	msg, code := dialExecuteScript(t, app, "script_name=wipe-scratch&dry_run=true", "")
+	if code != wsCloseOK {
+		t.Errorf("close code = %d, want %d", code, wsCloseOK)
+	}
+	var got scriptDryRun
+	if err := json.Unmarshal([]byte(msg), &got); err != nil {
+		t.Fatalf("dry run reply is not JSON: %q", msg)
+	}
+	if got.Command != "rm -rf /" {
+		t.Errorf("command = %q, want the registered script", got.Command)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// In allowlist mode an unknown ?script_name= is refused with 403 before the
+// upgrade. A script sent over the socket, or an unknown name sent in its
+// place, is refused once it arrives. Nothing touches the DB.
+func TestExecuteScript_AllowlistRefusesOthers(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.ScriptsOnly = true
+	app.Scripts = map[string]string{"uptime": "uptime"}
+
+	if code := executeScriptStatus(t, app, "script_name=reboot"); code != http.StatusForbidden {
+		t.Errorf("unknown name: status = %d, want 403", code)
+	}
+	for _, c := range []struct{ query, msg string }{
+		{"", "uptime"},
+		{"dry_run=true", "df -h"},
+		{"", `{"script_name": "reboot"}`},
+		{"", `{"script_name": "uptime", "force": true}`},
+	} {
+		if _, code := dialExecuteScript(t, app, c.query, c.msg); code != wsCloseRejected {
+			t.Errorf("%q %q: close code = %d, want %d", c.query, c.msg, code, wsCloseRejected)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// A name can also come as the first message, in place of the script.
+func TestExecuteScript_AllowlistNameInMessage(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.ScriptsOnly = true
+	app.Scripts = map[string]string{"uptime": "uptime -p"}
+
+	now := time.Now()
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+
+	msg, code := dialExecuteScript(t, app, "dry_run=true", `{"script_name": "uptime"}`)
+	var got scriptDryRun
+	if err := json.Unmarshal([]byte(msg), &got); err != nil || got.Command != "uptime -p" || code != wsCloseOK {
+		t.Errorf("reply %q, close code %d; want the registered script", msg, code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// Free mode still takes a client's own script, and a named one.
+func TestExecuteScript_FreeMode(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.Scripts = map[string]string{"uptime": "uptime -p"}
+
+	now := time.Now()
+	for _, c := range []struct{ query, script, want string }{
+		{"dry_run=true", "df -h", "df -h"},
+		{"script_name=uptime&dry_run=true", "", "uptime -p"},
+	} {
+		mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).
+			WillReturnRows(mock.NewRows(hostCols).
+				AddRow(int32(1), "web-1", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+		msg, _ := dialExecuteScript(t, app, c.query, c.script)
+		var got scriptDryRun
+		if err := json.Unmarshal([]byte(msg), &got); err != nil || got.Command != c.want {
+			t.Errorf("%s: reply %q, want command %q", c.query, msg, c.want)
+		}
+	}
+	if code := executeScriptStatus(t, app, "script_name=reboot"); code != http.StatusForbidden {
+		t.Errorf("unknown name: status = %d, want 403", code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
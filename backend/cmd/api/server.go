@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"ubuntu-auto-update/backend/pkg/config"
+)
+
+// newHTTPServer builds the listener from cfg. The timeouts bound plain HTTP
+// requests only: WebSocket handshakes hijack the connection, and net/http
+// clears the read/write deadlines on Hijack, so a 60s WriteTimeout does not
+// sever an apt run that streams for longer. Handlers that need liveness
+// checks set their own per-message deadlines (see pkg/events).
+func newHTTPServer(cfg config.ServerConfig, handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Addr:         ":" + cfg.Port,
+		Handler:      handler,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+
+		MaxHeaderBytes: cfg.MaxHeaderBytes,
+	}
+	if cfg.EnableHTTPS {
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return srv
+}
+
+// serve accepts connections on ln until the server is shut down, speaking
+// TLS when cfg enables it and plain HTTP otherwise (development, or behind a
+// TLS-terminating proxy).
+func serve(srv *http.Server, cfg config.ServerConfig, ln net.Listener) error {
+	if cfg.EnableHTTPS {
+		return srv.ServeTLS(ln, cfg.TLSCertFile, cfg.TLSKeyFile)
+	}
+	return srv.Serve(ln)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"ubuntu-auto-update/backend/pkg/config"
+	"ubuntu-auto-update/backend/pkg/middleware"
+)
+
+func TestNewHTTPServer_AppliesConfig(t *testing.T) {
+	t.Setenv("API_PORT", "9191")
+	t.Setenv("SERVER_READ_TIMEOUT", "7s")
+	t.Setenv("SERVER_WRITE_TIMEOUT", "11")
+	t.Setenv("SERVER_IDLE_TIMEOUT", "2m")
+	t.Setenv("HTTP_MAX_HEADER_BYTES", "65536")
+	cfg := config.LoadServerConfig()
+
+	srv := newHTTPServer(cfg, http.NotFoundHandler())
+
+	if srv.Addr != ":9191" {
+		t.Errorf("Addr = %q, want :9191", srv.Addr)
+	}
+	if srv.ReadTimeout != 7*time.Second {
+		t.Errorf("ReadTimeout = %s, want 7s", srv.ReadTimeout)
+	}
+	if srv.WriteTimeout != 11*time.Second {
+		t.Errorf("WriteTimeout = %s, want 11s", srv.WriteTimeout)
+	}
+	if srv.IdleTimeout != 2*time.Minute {
+		t.Errorf("IdleTimeout = %s, want 2m", srv.IdleTimeout)
+	}
+	if srv.MaxHeaderBytes != 65536 {
+		t.Errorf("MaxHeaderBytes = %d, want 65536", srv.MaxHeaderBytes)
+	}
+}
+
+func TestLoadServerConfig_InvalidFallsBackToDefault(t *testing.T) {
+	t.Setenv("SERVER_WRITE_TIMEOUT", "soon")
+	t.Setenv("SERVER_IDLE_TIMEOUT", "0")
+	t.Setenv("WS_MAX_MESSAGE_SIZE", "-1")
+	t.Setenv("HTTP_MAX_HEADER_BYTES", "lots")
+	cfg := config.LoadServerConfig()
+	if cfg.WriteTimeout != 60*time.Second {
+		t.Errorf("WriteTimeout = %s, want default 60s", cfg.WriteTimeout)
+	}
+	if cfg.IdleTimeout != 120*time.Second {
+		t.Errorf("IdleTimeout = %s, want default 120s", cfg.IdleTimeout)
+	}
+	if cfg.WSMaxMessageSize != 1<<20 || cfg.MaxHeaderBytes != http.DefaultMaxHeaderBytes {
+		t.Errorf("WSMaxMessageSize = %d, MaxHeaderBytes = %d; want the 1 MiB defaults", cfg.WSMaxMessageSize, cfg.MaxHeaderBytes)
+	}
+}
+
+// WS_MAX_MESSAGE_SIZE becomes the read limit of every upgraded socket: a
+// message at the limit is read, one byte more closes the socket with 1009.
+func TestUpgradeWS_ReadLimitFromConfig(t *testing.T) {
+	t.Setenv("WS_MAX_MESSAGE_SIZE", "16")
+	app := testApp(t)
+	app.WSMaxMessageSize = config.LoadServerConfig().WSMaxMessageSize
+
+	reads := make(chan error, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := app.upgradeWS(w, r)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		defer conn.Close()
+		for {
+			_, _, err := conn.ReadMessage()
+			reads <- err
+			if err != nil {
+				return
+			}
+		}
+	}))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("a", 16)))
+	_ = conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("a", 17)))
+
+	if err := <-reads; err != nil {
+		t.Fatalf("message at the limit: %v", err)
+	}
+	if err := <-reads; err != websocket.ErrReadLimit {
+		t.Fatalf("message over the limit: err = %v, want ErrReadLimit", err)
+	}
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("client saw %v, want close 1009", err)
+	}
+}
+
+// A WebSocket stream must outlive the server's WriteTimeout. net/http clears
+// deadlines on Hijack today; this pins that behavior so a Go upgrade or a
+// custom upgrader can't silently start killing long apt runs.
+func TestWebSocket_OutlivesWriteTimeout(t *testing.T) {
+	app := testApp(t)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := app.wsUpgrader()
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		defer conn.Close()
+		time.Sleep(300 * time.Millisecond)
+		_ = conn.WriteMessage(websocket.TextMessage, []byte("still here"))
+	}))
+	ts.Config.WriteTimeout = 100 * time.Millisecond
+	ts.Start()
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read after write timeout elapsed: %v", err)
+	}
+	if string(msg) != "still here" {
+		t.Errorf("message = %q", msg)
+	}
+}
+
+// writeSelfSignedCert drops a throwaway localhost cert/key pair into dir.
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestServe_HTTPS(t *testing.T) {
+	certFile, keyFile, pool := writeSelfSignedCert(t, t.TempDir())
+	t.Setenv("ENABLE_HTTPS", "true")
+	t.Setenv("TLS_CERT_FILE", certFile)
+	t.Setenv("TLS_KEY_FILE", keyFile)
+	cfg := config.LoadServerConfig()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	srv := newHTTPServer(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = serve(srv, cfg, ln) }()
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("TLS request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.TLS == nil || resp.TLS.Version < tls.VersionTLS12 {
+		t.Fatalf("expected TLS >= 1.2, got %+v", resp.TLS)
+	}
+
+	// TLS 1.1 clients must be refused.
+	old := &tls.Config{RootCAs: pool, MaxVersion: tls.VersionTLS11}
+	if conn, err := tls.Dial("tcp", ln.Addr().String(), old); err == nil {
+		conn.Close()
+		t.Fatal("TLS 1.1 handshake unexpectedly succeeded")
+	}
+}
+
+func TestServerConfigValidate_HTTPSNeedsFiles(t *testing.T) {
+	cfg := config.ServerConfig{EnableHTTPS: true, TLSCertFile: "/nonexistent/cert.pem"}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error when key file is missing")
+	}
+	cfg.TLSKeyFile = "/nonexistent/key.pem"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error when files do not exist")
+	}
+}
+
+func TestCheckWSOrigin(t *testing.T) {
+	cors := &middleware.CORSConfig{AllowedOrigins: []string{"https://ops.example.com"}}
+	wildcard := &middleware.CORSConfig{AllowedOrigins: []string{"*"}, AllowAll: true}
+
+	tests := []struct {
+		name   string
+		origin string
+		cors   *middleware.CORSConfig
+		want   bool
+	}{
+		{"allowed origin", "https://ops.example.com", cors, true},
+		{"allowed origin, different case", "https://OPS.example.com", cors, true},
+		{"disallowed origin", "https://evil.example.net", cors, false},
+		{"missing origin (non-browser)", "", cors, true},
+		{"same origin as API", "https://api.internal:8080", cors, true},
+		{"wildcard CORS not honored", "https://evil.example.net", wildcard, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "https://api.internal:8080/api/v1/events", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := checkWSOrigin(r, tt.cors); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWSUpgrade_RejectsForeignOrigin(t *testing.T) {
+	app := testApp(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := app.wsUpgrader()
+		if conn, err := upgrader.Upgrade(w, r, nil); err == nil {
+			conn.Close()
+		}
+	}))
+	defer ts.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"https://evil.example.net"}})
+	if err == nil {
+		t.Fatal("handshake from a foreign origin succeeded")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403, got %+v", resp)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"http://localhost:5173"}})
+	if err != nil {
+		t.Fatalf("allowed origin rejected: %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,166 @@
+package main
+
+// A host's SSH keys. Every dial offers all of them in order and logs in with
+// the first the host accepts, so during a rotation window the new key can
+// be added next to the old one, installed on the host, and the old key
+// removed once it is gone from authorized_keys. POST /hosts/{id}/ssh-key
+// and the rotate and generate endpoints still replace the whole set.
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+
+	"ubuntu-auto-update/backend/pkg/audit"
+	"ubuntu-auto-update/backend/pkg/db"
+	"ubuntu-auto-update/backend/pkg/middleware"
+	sshpkg "ubuntu-auto-update/backend/pkg/ssh"
+)
+
+// sshKeyInfo is the public view of one stored key. Position is 1-based, in
+// the order the key is offered.
+type sshKeyInfo struct {
+	ID          int32  `json:"id"`
+	Position    int    `json:"position"`
+	PublicKey   string `json:"public_key"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// handleListSSHKeys returns the public halves of the host's keys in the
+// order they are offered. A host without keys gets [].
+func (app *Application) handleListSSHKeys(w http.ResponseWriter, r *http.Request) {
+	id, err := parseHostID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+	if _, err := db.GetHost(r.Context(), app.DB, id); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "Host not found")
+			return
+		}
+		log.Errorf("Failed to get host %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to read SSH keys")
+		return
+	}
+
+	keys, err := db.GetSSHKeys(r.Context(), app.DB, id)
+	if err != nil {
+		if errors.Is(err, db.ErrUndecryptable) {
+			log.Error(err)
+			writeJSONError(w, http.StatusConflict, "Stored SSH key cannot be decrypted; re-add the key")
+			return
+		}
+		log.Errorf("Failed to read SSH keys for host %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to read SSH keys")
+		return
+	}
+	out := make([]sshKeyInfo, 0, len(keys))
+	for i, k := range keys {
+		line, pub, err := sshpkg.AuthorizedKeyFromPrivate(k.PrivateKey)
+		if err != nil {
+			log.Errorf("Stored SSH key %d for host %d is unusable: %v", k.ID, id, err)
+			writeJSONError(w, http.StatusInternalServerError, "Stored SSH key does not parse")
+			return
+		}
+		out = append(out, sshKeyInfo{ID: k.ID, Position: i + 1, PublicKey: line, Fingerprint: ssh.FingerprintSHA256(pub)})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// handleAppendSSHKey adds a key after the host's existing ones: POST
+// /hosts/{id}/ssh-keys with {"private_key": "..."}. Unlike POST
+// /hosts/{id}/ssh-key it keeps the current keys and the ssh_user.
+func (app *Application) handleAppendSSHKey(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+
+	id, err := parseHostID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+	var req struct {
+		PrivateKey string `json:"private_key"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	req.PrivateKey = strings.TrimSpace(req.PrivateKey)
+	if req.PrivateKey == "" {
+		writeJSONError(w, http.StatusBadRequest, "private_key is required")
+		return
+	}
+	signer, err := ssh.ParsePrivateKey([]byte(req.PrivateKey))
+	if err != nil {
+		log.Warnf("Failed to parse private key for host %d: %v", id, err)
+		writeJSONError(w, http.StatusBadRequest, "private_key does not parse as a valid OpenSSH private key")
+		return
+	}
+
+	if _, err := db.GetHost(r.Context(), app.DB, id); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "Host not found")
+			return
+		}
+		log.Errorf("Failed to get host %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to save SSH key")
+		return
+	}
+	keyID, err := db.AppendSSHKey(r.Context(), app.DB, id, req.PrivateKey)
+	if err != nil {
+		if errors.Is(err, db.ErrTooManySSHKeys) {
+			writeJSONError(w, http.StatusConflict,
+				"Host already has "+strconv.Itoa(db.MaxSSHKeysPerHost)+" SSH keys; remove one first")
+			return
+		}
+		log.Errorf("Failed to add SSH key for host %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to save SSH key")
+		return
+	}
+
+	app.audit(r, audit.ActionHostKeyAdd, "host", strconv.FormatInt(int64(id), 10),
+		map[string]interface{}{"key_id": keyID, "fingerprint": ssh.FingerprintSHA256(signer.PublicKey())})
+
+	middleware.SendSuccessResponse(w, http.StatusCreated, keyID, "SSH key added")
+}
+
+// handleDeleteSSHKey removes one of the host's keys: DELETE
+// /hosts/{id}/ssh-keys/{key_id}. Removing the last key leaves the host
+// without one until a key is added again.
+func (app *Application) handleDeleteSSHKey(w http.ResponseWriter, r *http.Request) {
+	id, err := parseHostID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+	keyID, err := strconv.ParseInt(mux.Vars(r)["key_id"], 10, 32)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid key ID")
+		return
+	}
+
+	n, err := db.DeleteSSHKey(r.Context(), app.DB, id, int32(keyID))
+	if err != nil {
+		log.Errorf("Failed to delete SSH key %d for host %d: %v", keyID, id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to delete SSH key")
+		return
+	}
+	if n == 0 {
+		writeJSONError(w, http.StatusNotFound, "SSH key not found")
+		return
+	}
+
+	app.audit(r, audit.ActionHostKeyRemove, "host", strconv.FormatInt(int64(id), 10),
+		map[string]interface{}{"key_id": keyID})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pashagolub/pgxmock/v4"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"ubuntu-auto-update/backend/pkg/crypto"
+	"ubuntu-auto-update/backend/pkg/db"
+	sshpkg "ubuntu-auto-update/backend/pkg/ssh"
+)
+
+// newKeySSHServer starts an SSH server on 127.0.0.1 that accepts only the
+// given public key and answers every exec with exit status 0. known_hosts is
+// pointed at a temp file trusting the server, so the real Dialer can reach it.
+func newKeySSHServer(t *testing.T, authorized ssh.PublicKey) string {
+	t.Helper()
+	_, hostPriv, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return &ssh.Permissions{}, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	cfg.AddHostKey(hostSigner)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveExecOK(conn, cfg)
+		}
+	}()
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{ln.Addr().String()}, hostSigner.PublicKey())
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOST_KEY_STORE", "file")
+	t.Setenv("KNOWN_HOSTS_FILE", knownHosts)
+	return ln.Addr().String()
+}
+
+func serveExecOK(conn net.Conn, cfg *ssh.ServerConfig) {
+	sConn, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		return
+	}
+	defer sConn.Close()
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer ch.Close()
+			for req := range requests {
+				_ = req.Reply(req.Type == "exec", nil)
+				if req.Type == "exec" {
+					_, _ = ch.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+					return
+				}
+			}
+		}()
+	}
+}
+
+func newTestPrivateKey(t *testing.T) (string, ssh.PublicKey) {
+	t.Helper()
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, _ := ssh.NewPublicKey(pub)
+	return string(pem.EncodeToMemory(block)), sshPub
+}
+
+func rotateKeyRequest(t *testing.T, privateKey string) *http.Request {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"private_key": privateKey})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/hosts/1/rotate-key", bytes.NewReader(body))
+	return mux.SetURLVars(req, map[string]string{"id": "1"})
+}
+
+func TestHandleRotateKey_SuppliedKeyPersisted(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY", strings.Repeat("00", 32))
+	goodKey, goodPub := newTestPrivateKey(t)
+	addr := newKeySSHServer(t, goodPub)
+
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.SSHDialer = sshpkg.NewDialer(nil)
+
+	now := time.Now()
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), addr, "ubuntu", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+	mock.ExpectExec(`INSERT INTO ssh_keys`).WithArgs(int32(1), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectExec(`INSERT INTO audit_log`).
+		WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	rr := httptest.NewRecorder()
+	app.handleRotateKey(rr, rotateKeyRequest(t, goodKey))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestHandleRotateKey_BadKeyKeepsOldKey(t *testing.T) {
+	_, authorizedPub := newTestPrivateKey(t)
+	addr := newKeySSHServer(t, authorizedPub)
+	wrongKey, _ := newTestPrivateKey(t)
+
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.SSHDialer = sshpkg.NewDialer(nil)
+
+	now := time.Now()
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), addr, "ubuntu", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+	// No ssh_keys write is expected: pgxmock fails the test on any
+	// unexpected Exec, which is how "old key retained" is asserted.
+
+	rr := httptest.NewRecorder()
+	app.handleRotateKey(rr, rotateKeyRequest(t, wrongKey))
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), "authentication failed") {
+		t.Errorf("expected failure reason in body, got %s", rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestHandleRotateKey_UnparseableKey(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	rr := httptest.NewRecorder()
+	app.handleRotateKey(rr, rotateKeyRequest(t, "not a key"))
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// captureArg is a pgxmock argument matcher that records what it was given.
+type captureArg struct{ value interface{} }
+
+func (c *captureArg) Match(v interface{}) bool {
+	c.value = v
+	return true
+}
+
+func TestHandleGenerateKey_PublicKeyMatchesStored(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY", strings.Repeat("00", 32))
+
+	for _, keyType := range []string{"ed25519", "rsa"} {
+		t.Run(keyType, func(t *testing.T) {
+			app, mock := testAppWithDB(t)
+			defer mock.Close()
+
+			now := time.Now()
+			mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).
+				WillReturnRows(mock.NewRows(hostCols).
+					AddRow(int32(1), "web-1", "ubuntu", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+			stored := &captureArg{}
+			mock.ExpectExec(`INSERT INTO ssh_keys`).WithArgs(int32(1), stored).
+				WillReturnResult(pgxmock.NewResult("INSERT", 1))
+			mock.ExpectExec(`INSERT INTO audit_log`).
+				WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+				WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+			body, _ := json.Marshal(map[string]string{"type": keyType})
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/hosts/1/generate-key", bytes.NewReader(body))
+			req = mux.SetURLVars(req, map[string]string{"id": "1"})
+			rr := httptest.NewRecorder()
+			app.handleGenerateKey(rr, req)
+
+			if rr.Code != http.StatusCreated {
+				t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+			}
+			if strings.Contains(rr.Body.String(), "PRIVATE KEY") {
+				t.Fatal("response leaked the private key")
+			}
+			var resp struct {
+				PublicKey string `json:"public_key"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			returned, _, _, _, err := ssh.ParseAuthorizedKey([]byte(resp.PublicKey))
+			if err != nil {
+				t.Fatalf("public_key is not an authorized_keys line: %v", err)
+			}
+
+			ciphertext, _ := stored.value.(string)
+			plain, err := crypto.Decrypt(ciphertext)
+			if err != nil {
+				t.Fatalf("stored key does not decrypt: %v", err)
+			}
+			signer, err := ssh.ParsePrivateKey([]byte(plain))
+			if err != nil {
+				t.Fatalf("stored key does not parse: %v", err)
+			}
+			if !bytes.Equal(signer.PublicKey().Marshal(), returned.Marshal()) {
+				t.Error("returned public key does not match the stored private key")
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
+
+func TestHandleGenerateKey_UnknownType(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/hosts/1/generate-key", strings.NewReader(`{"type":"dsa"}`))
+	req = mux.SetURLVars(req, map[string]string{"id": "1"})
+	rr := httptest.NewRecorder()
+	app.handleGenerateKey(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rr.Code)
+	}
+}
+
+func TestHandleReEncryptSSHKeys(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	mock.ExpectQuery(`SELECT id, host_id, private_key FROM ssh_keys`).
+		WillReturnRows(mock.NewRows([]string{"id", "host_id", "private_key"}))
+	mock.ExpectQuery(`SELECT host_id, password FROM host_sudo_passwords`).
+		WillReturnRows(mock.NewRows([]string{"host_id", "password"}))
+	mock.ExpectExec(`INSERT INTO audit_log`).
+		WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	rr := httptest.NewRecorder()
+	app.handleReEncryptSSHKeys(rr, httptest.NewRequest(http.MethodPost, "/api/v1/ssh-keys/re-encrypt", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), `"reencrypted":0`) {
+		t.Errorf("unexpected body %s", rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestHandleGetSSHKey_ReturnsPublicKeyOnly(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY", strings.Repeat("00", 32))
+	privateKey, pub := newTestPrivateKey(t)
+	stored, err := crypto.Encrypt(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	mock.ExpectQuery(`SELECT id, host_id, private_key FROM ssh_keys WHERE host_id = \$1`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows([]string{"id", "host_id", "private_key"}).AddRow(int32(11), int32(1), stored))
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/hosts/1/ssh-key", nil), map[string]string{"id": "1"})
+	rr := httptest.NewRecorder()
+	app.handleGetSSHKey(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if strings.Contains(rr.Body.String(), "PRIVATE KEY") {
+		t.Fatal("private key leaked")
+	}
+	var resp struct {
+		PublicKey   string `json:"public_key"`
+		Fingerprint string `json:"fingerprint"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	got, _, _, _, err := ssh.ParseAuthorizedKey([]byte(resp.PublicKey))
+	if err != nil {
+		t.Fatalf("public_key %q is not an authorized_keys line: %v", resp.PublicKey, err)
+	}
+	if !bytes.Equal(got.Marshal(), pub.Marshal()) {
+		t.Errorf("public_key = %q, want %s", resp.PublicKey, ssh.MarshalAuthorizedKey(pub))
+	}
+	if resp.Fingerprint != ssh.FingerprintSHA256(pub) {
+		t.Errorf("fingerprint = %q", resp.Fingerprint)
+	}
+}
+
+func TestHandleGetSSHKey_NoneStored(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	mock.ExpectQuery(`SELECT id, host_id, private_key FROM ssh_keys`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows([]string{"id", "host_id", "private_key"}))
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/hosts/1/ssh-key", nil), map[string]string{"id": "1"})
+	rr := httptest.NewRecorder()
+	app.handleGetSSHKey(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// The list holds every key's public half in the order dials offer them.
+func TestHandleListSSHKeys(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY", strings.Repeat("00", 32))
+	oldKey, oldPub := newTestPrivateKey(t)
+	newKey, newPub := newTestPrivateKey(t)
+	storedOld, _ := crypto.Encrypt(oldKey)
+	storedNew, _ := crypto.Encrypt(newKey)
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	now := time.Now()
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+	mock.ExpectQuery(`SELECT id, host_id, private_key FROM ssh_keys WHERE host_id = \$1 ORDER BY position, id`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows([]string{"id", "host_id", "private_key"}).
+			AddRow(int32(3), int32(1), storedOld).
+			AddRow(int32(7), int32(1), storedNew))
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/v1/hosts/1/ssh-keys", nil), map[string]string{"id": "1"})
+	rr := httptest.NewRecorder()
+	app.handleListSSHKeys(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if strings.Contains(rr.Body.String(), "PRIVATE KEY") {
+		t.Fatal("private key leaked")
+	}
+	var got []sshKeyInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []sshKeyInfo{
+		{ID: 3, Position: 1, Fingerprint: ssh.FingerprintSHA256(oldPub)},
+		{ID: 7, Position: 2, Fingerprint: ssh.FingerprintSHA256(newPub)},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d keys, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].ID != want[i].ID || got[i].Position != want[i].Position || got[i].Fingerprint != want[i].Fingerprint {
+			t.Errorf("key %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// A key is added after the existing ones; a host already holding the
+// maximum is refused with 409.
+func TestHandleAppendSSHKey(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY", strings.Repeat("00", 32))
+	privateKey, _ := newTestPrivateKey(t)
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	now := time.Now()
+	expectAppend := func(rows *pgxmock.Rows) {
+		mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).
+			WillReturnRows(mock.NewRows(hostCols).
+				AddRow(int32(1), "web-1", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+		mock.ExpectQuery(`INSERT INTO ssh_keys`).WithArgs(int32(1), pgxmock.AnyArg(), db.MaxSSHKeysPerHost).WillReturnRows(rows)
+	}
+	expectAppend(mock.NewRows([]string{"id"}).AddRow(int32(8)))
+	expectAudit(mock)
+	expectAppend(mock.NewRows([]string{"id"}))
+
+	post := func() *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"private_key": privateKey})
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/api/v1/hosts/1/ssh-keys", bytes.NewReader(body)), map[string]string{"id": "1"})
+		rr := httptest.NewRecorder()
+		app.handleAppendSSHKey(rr, req)
+		return rr
+	}
+	if rr := post(); rr.Code != http.StatusCreated || !strings.Contains(rr.Body.String(), `"id":8`) {
+		t.Errorf("first add: got %d %s, want 201 with id 8", rr.Code, rr.Body.String())
+	}
+	if rr := post(); rr.Code != http.StatusConflict {
+		t.Errorf("full host: got %d, want 409", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
+
+	"ubuntu-auto-update/backend/pkg/middleware"
+	sshpkg "ubuntu-auto-update/backend/pkg/ssh"
+)
+
+// holdSSHSlots gives app a limiter of size n with every slot taken, released
+// when the test ends.
+func holdSSHSlots(t *testing.T, app *Application, n int) {
+	t.Helper()
+	app.SSHLimit = sshpkg.NewLimiter(n, 20*time.Millisecond)
+	for i := 0; i < n; i++ {
+		release, err := app.SSHLimit.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("slot %d: %v", i+1, err)
+		}
+		t.Cleanup(release)
+	}
+}
+
+// The N+1th concurrent script is turned away before dialing or auditing.
+func TestExecuteScript_BusyAtSSHLimit(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	holdSSHSlots(t, app, 2)
+
+	msg, code := dialExecuteScript(t, app, "", "uptime")
+	if !strings.Contains(msg, "server busy") {
+		t.Errorf("unexpected reply %q", msg)
+	}
+	if code != wsCloseBusy {
+		t.Errorf("close code = %d, want %d", code, wsCloseBusy)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// The N+1th concurrent run-update is told the server is busy and leaves no
+// run row behind.
+func TestRunUpdate_BusyAtSSHLimit(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	holdSSHSlots(t, app, 1)
+
+	now := time.Now()
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+	mock.ExpectQuery(`SELECT password FROM host_sudo_passwords`).WithArgs(int32(1)).
+		WillReturnError(pgx.ErrNoRows)
+	mock.ExpectQuery(`FROM host_update_hooks`).WithArgs(int32(1)).WillReturnError(pgx.ErrNoRows)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = mux.SetURLVars(r, map[string]string{"id": "1"})
+		ctx := context.WithValue(r.Context(), middleware.UserContextKey, &middleware.User{Username: "alice"})
+		app.handleRunUpdate(w, r.WithContext(ctx))
+	}))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !strings.Contains(string(msg), "server busy") {
+		t.Errorf("unexpected reply %q", msg)
+	}
+	if _, code := readUntilClose(t, conn); code != wsCloseBusy {
+		t.Errorf("close code = %d, want %d", code, wsCloseBusy)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/pashagolub/pgxmock/v4"
+	"golang.org/x/crypto/ssh"
+
+	"ubuntu-auto-update/backend/pkg/updater"
+)
+
+// newTestSSHServer starts an in-process SSH server that hands every exec
+// request to exec, which reports the command's exit itself over ch, and
+// returns a client connected to it.
+func newTestSSHServer(t *testing.T, exec func(ch ssh.Channel, cmd string)) *ssh.Client {
+	t.Helper()
+	return newTestSSHServerReqs(t, func(ch ssh.Channel, cmd string, _ <-chan *ssh.Request) { exec(ch, cmd) })
+}
+
+// newTestSSHServerReqs is newTestSSHServer with the channel's requests after
+// the exec (signals, window changes) handed to exec, unanswered.
+func newTestSSHServerReqs(t *testing.T, exec func(ch ssh.Channel, cmd string, reqs <-chan *ssh.Request)) *ssh.Client {
+	t.Helper()
+	_, hostPriv, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ssh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(hostSigner)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				sConn, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+				if err != nil {
+					return
+				}
+				defer sConn.Close()
+				go ssh.DiscardRequests(reqs)
+				for nc := range chans {
+					ch, requests, err := nc.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer ch.Close()
+						for req := range requests {
+							_ = req.Reply(req.Type == "exec", nil)
+							if req.Type != "exec" {
+								continue
+							}
+							var payload struct{ Command string }
+							_ = ssh.Unmarshal(req.Payload, &payload)
+							exec(ch, payload.Command, requests)
+							return
+						}
+					}()
+				}
+			}()
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", ln.Addr().String(), &ssh.ClientConfig{
+		User:            "ubuntu",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// newSudoSSHServer starts an SSH server whose exec handler behaves like
+// `sudo -S`: it reads one line from stdin and exits 0 only if that line is
+// password. It writes nothing to stdout/stderr, so streaming the command
+// never touches the run's output row.
+func newSudoSSHServer(t *testing.T, password string) *ssh.Client {
+	t.Helper()
+	return newTestSSHServer(t, func(ch ssh.Channel, _ string) {
+		line, _ := bufio.NewReader(ch).ReadString('\n')
+		status := byte(1)
+		if line == password+"\n" {
+			status = 0
+		}
+		_, _ = ch.SendRequest("exit-status", false, []byte{0, 0, 0, status})
+	})
+}
+
+// serveWS runs handle on the server end of a real WebSocket and returns
+// every message the browser would have seen.
+func serveWS(t *testing.T, handle func(conn *wsConn)) []string {
+	t.Helper()
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		upgrader := websocket.Upgrader{}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		conn := newWSConn(ws)
+		defer conn.Close()
+		handle(conn)
+	}))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	var msgs []string
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		msgs = append(msgs, string(msg))
+	}
+	<-done
+	return msgs
+}
+
+// streamOverWS runs app.streamCommand against a real WebSocket and returns
+// its exit code plus every message the browser would have seen.
+func streamOverWS(t *testing.T, app *Application, client *ssh.Client, cmd, stdin string) (int, []string) {
+	t.Helper()
+	var (
+		code int
+		err  error
+	)
+	msgs := serveWS(t, func(conn *wsConn) {
+		code, err = app.streamCommand(context.Background(), conn, client, 1, cmd, stdin)
+	})
+	if code != 0 && err == nil {
+		t.Fatalf("exit %d without an error", code)
+	}
+	return code, msgs
+}
+
+func TestStreamCommand_FeedsSudoPasswordOnStdin(t *testing.T) {
+	const password = "correct horse"
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	client := newSudoSSHServer(t, password)
+
+	cmd, stdin := updater.DefaultCommands.Command("ubuntu", false, password)
+	code, msgs := streamOverWS(t, app, client, cmd, stdin)
+	if code != 0 {
+		t.Fatalf("remote sudo rejected the password: exit %d", code)
+	}
+	for _, m := range msgs {
+		if strings.Contains(m, password) {
+			t.Errorf("password leaked to the WebSocket: %q", m)
+		}
+	}
+}
+
+func TestStreamCommand_NoSudoPasswordSendsNoStdin(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	client := newSudoSSHServer(t, "correct horse")
+
+	// Passwordless sudo: nothing is written to stdin, so a host that does
+	// want a password fails instead of hanging on the prompt.
+	cmd, stdin := updater.DefaultCommands.Command("ubuntu", false, "")
+	if code, _ := streamOverWS(t, app, client, cmd, stdin); code != 1 {
+		t.Fatalf("exit = %d, want 1", code)
+	}
+}
+
+func sudoPasswordRequest(method, body string) *http.Request {
+	req := httptest.NewRequest(method, "/api/v1/hosts/1/sudo-password", strings.NewReader(body))
+	return mux.SetURLVars(req, map[string]string{"id": "1"})
+}
+
+func TestHandleSetSudoPassword_Validation(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	for _, body := range []string{`{"password":""}`, `{"password":"a\nb"}`, `{"password":"a\rb"}`, `not json`} {
+		rr := httptest.NewRecorder()
+		app.handleSetSudoPassword(rr, sudoPasswordRequest(http.MethodPut, body))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, rr.Code)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// notPlaintext matches any non-empty string argument other than itself.
+type notPlaintext string
+
+func (p notPlaintext) Match(v interface{}) bool {
+	s, ok := v.(string)
+	return ok && s != "" && s != string(p)
+}
+
+func TestHandleSetSudoPassword_StoresEncrypted(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY", strings.Repeat("00", 32))
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	mock.ExpectExec(`INSERT INTO host_sudo_passwords`).
+		WithArgs(int32(1), notPlaintext("hunter2")).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectExec(`INSERT INTO audit_log`).
+		WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	rr := httptest.NewRecorder()
+	app.handleSetSudoPassword(rr, sudoPasswordRequest(http.MethodPut, `{"password":"hunter2"}`))
+
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if strings.Contains(rr.Body.String(), "hunter2") {
+		t.Error("password echoed back")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestHandleDeleteSudoPassword_NotStored(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	mock.ExpectExec(`DELETE FROM host_sudo_passwords`).WithArgs(int32(1)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 0))
+
+	rr := httptest.NewRecorder()
+	app.handleDeleteSudoPassword(rr, sudoPasswordRequest(http.MethodDelete, ""))
+
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
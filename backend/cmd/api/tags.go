@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	log "github.com/sirupsen/logrus"
+
+	"ubuntu-auto-update/backend/pkg/audit"
+	"ubuntu-auto-update/backend/pkg/db"
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+// maxTagLength caps a single tag so the UI can't store junk.
+const maxTagLength = 64
+
+// normalizeTag trims t and reports whether the result is a storable tag.
+func normalizeTag(t string) (string, bool) {
+	t = strings.TrimSpace(t)
+	return t, t != "" && len(t) <= maxTagLength
+}
+
+// handleAddHostTag attaches one tag to a host: POST /hosts/{id}/tags with
+// {"tag": "web-tier"}. Adding a tag the host already carries is a no-op.
+func (app *Application) handleAddHostTag(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+
+	id, err := parseHostID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+	var req struct {
+		Tag string `json:"tag"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	tag, ok := normalizeTag(req.Tag)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "tag must be 1-64 characters")
+		return
+	}
+
+	host, err := db.AddHostTag(r.Context(), app.DB, id, tag)
+	app.writeTaggedHost(w, r, host, err, "add", tag)
+}
+
+// handleRemoveHostTag detaches one tag: DELETE /hosts/{id}/tags/{tag}.
+// Removing a tag the host doesn't carry still returns the host.
+func (app *Application) handleRemoveHostTag(w http.ResponseWriter, r *http.Request) {
+	id, err := parseHostID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+	tag, ok := normalizeTag(mux.Vars(r)["tag"])
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "tag must be 1-64 characters")
+		return
+	}
+
+	host, err := db.RemoveHostTag(r.Context(), app.DB, id, tag)
+	app.writeTaggedHost(w, r, host, err, "remove", tag)
+}
+
+// writeTaggedHost is the shared tail of the tag handlers: map the DB error,
+// audit, and echo the updated host.
+func (app *Application) writeTaggedHost(w http.ResponseWriter, r *http.Request, host models.Host, err error, op, tag string) {
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "Host not found")
+			return
+		}
+		log.Errorf("Failed to %s host tag: %v", op, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to update host tags")
+		return
+	}
+	app.audit(r, audit.ActionHostUpdate, "host", strconv.FormatInt(int64(host.ID), 10),
+		map[string]interface{}{"tag_" + op: tag})
+
+	app.setHostStatus(&host)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(host)
+}
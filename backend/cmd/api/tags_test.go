@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+var hostCols = []string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "architecture", "offline_since", "update_output_truncated", "upgrade_output_truncated", "update_policy", "deleted_at", "environment"}
+
+func TestHandleAddHostTag(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	now := time.Now()
+	mock.ExpectQuery(`UPDATE hosts SET\s+tags = CASE`).
+		WithArgs(int32(1), "web-tier").
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "root", now, now, now, "", "", nil, []string{"web-tier"}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+	mock.ExpectExec(`INSERT INTO audit_log`).
+		WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	body, _ := json.Marshal(map[string]string{"tag": "  web-tier "})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/hosts/1/tags", bytes.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"id": "1"})
+	rr := httptest.NewRecorder()
+	app.handleAddHostTag(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var host models.Host
+	if err := json.Unmarshal(rr.Body.Bytes(), &host); err != nil {
+		t.Fatal(err)
+	}
+	if len(host.Tags) != 1 || host.Tags[0] != "web-tier" {
+		t.Errorf("tags = %v", host.Tags)
+	}
+
+	// Empty tag is rejected before touching the DB.
+	body, _ = json.Marshal(map[string]string{"tag": "   "})
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/hosts/1/tags", bytes.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"id": "1"})
+	rr = httptest.NewRecorder()
+	app.handleAddHostTag(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for empty tag, got %d", rr.Code)
+	}
+
+	// Unknown host.
+	mock.ExpectQuery(`UPDATE hosts SET\s+tags = CASE`).
+		WithArgs(int32(9), "web-tier").
+		WillReturnError(pgx.ErrNoRows)
+	body, _ = json.Marshal(map[string]string{"tag": "web-tier"})
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/hosts/9/tags", bytes.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"id": "9"})
+	rr = httptest.NewRecorder()
+	app.handleAddHostTag(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestHandleRemoveHostTag(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	now := time.Now()
+	mock.ExpectQuery(`UPDATE hosts SET tags = array_remove`).
+		WithArgs(int32(1), "web-tier").
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+	mock.ExpectExec(`INSERT INTO audit_log`).
+		WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/v1/hosts/1/tags/web-tier", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "1", "tag": "web-tier"})
+	rr := httptest.NewRecorder()
+	app.handleRemoveHostTag(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestHandleListHosts_TagFilter(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	now := time.Now()
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE tags @> ARRAY\[\$1::text\]`).
+		WithArgs("web-tier").
+		WillReturnRows(mock.NewRows(hostCols).
+			AddRow(int32(1), "web-1", "root", now, now, now, "", "", nil, []string{"web-tier"}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/hosts?tag=web-tier", nil)
+	rr := httptest.NewRecorder()
+	app.handleListHosts(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var hosts []models.Host
+	if err := json.Unmarshal(rr.Body.Bytes(), &hosts); err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 || hosts[0].Hostname != "web-1" {
+		t.Errorf("hosts = %+v", hosts)
+	}
+
+	// tag + pagination is rejected.
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/hosts?tag=web-tier&limit=5", nil)
+	rr = httptest.NewRecorder()
+	app.handleListHosts(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestHandleBulkRunUpdate_TagTargeting(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+
+	post := func(body map[string]interface{}) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/hosts/bulk/run-update", bytes.NewReader(b))
+		rr := httptest.NewRecorder()
+		app.handleBulkRunUpdate(rr, req)
+		return rr
+	}
+
+	if rr := post(map[string]interface{}{"tag": "web-tier", "host_ids": []int{1}}); rr.Code != http.StatusBadRequest {
+		t.Errorf("host_ids+tag: expected 400, got %d", rr.Code)
+	}
+	if rr := post(map[string]interface{}{}); rr.Code != http.StatusBadRequest {
+		t.Errorf("no target: expected 400, got %d", rr.Code)
+	}
+
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE tags @>`).
+		WithArgs("empty-tier").
+		WillReturnRows(mock.NewRows(hostCols))
+	if rr := post(map[string]interface{}{"tag": "empty-tier"}); rr.Code != http.StatusNotFound {
+		t.Errorf("unmatched tag: expected 404, got %d", rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
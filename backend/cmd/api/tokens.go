@@ -34,8 +34,8 @@ func (app *Application) handleCreateAPIToken(w http.ResponseWriter, r *http.Requ
 		Name string `json:"name"`
 		Role string `json:"role"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
 		return
 	}
 	req.Name = strings.TrimSpace(req.Name)
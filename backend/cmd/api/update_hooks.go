@@ -0,0 +1,120 @@
+package main
+
+// Per-host update hooks: a shell command run over SSH before run-update's apt
+// command and another after it, e.g. to drain a node from its load balancer
+// and put it back. runUpdatePhases runs them; this file stores them and
+// serves what they printed.
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+
+	"ubuntu-auto-update/backend/pkg/audit"
+	"ubuntu-auto-update/backend/pkg/db"
+	"ubuntu-auto-update/backend/pkg/middleware"
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+// maxHookCommand bounds each hook. Hooks are a line or two; anything longer
+// belongs in a script on the host.
+const maxHookCommand = 4096
+
+// handleGetUpdateHooks returns the host's hooks, empty strings where none is
+// set.
+func (app *Application) handleGetUpdateHooks(w http.ResponseWriter, r *http.Request) {
+	id, err := parseHostID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+	hooks, err := db.GetUpdateHooks(r.Context(), app.DB, id)
+	if err != nil {
+		log.Errorf("Failed to get update hooks for host %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to retrieve update hooks")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hooks)
+}
+
+// handleSetUpdateHooks replaces both hooks; an empty string removes one.
+// Hooks run as the host's ssh_user with the same access as the update, so
+// this is operator-only and audited with the commands. Under
+// EXECUTE_MODE=allowlist hooks can only be removed.
+func (app *Application) handleSetUpdateHooks(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	id, err := parseHostID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid host ID")
+		return
+	}
+	var hooks models.UpdateHooks
+	if err := decodeJSON(r, &hooks); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	hooks.PreUpdateCommand = strings.TrimSpace(hooks.PreUpdateCommand)
+	hooks.PostUpdateCommand = strings.TrimSpace(hooks.PostUpdateCommand)
+	var errs middleware.ValidationErrors
+	checkHook := func(field, cmd string) {
+		switch {
+		case len(cmd) > maxHookCommand:
+			errs.Add(field, "must be at most "+strconv.Itoa(maxHookCommand)+" bytes")
+		case strings.ContainsRune(cmd, 0):
+			errs.Add(field, "must not contain NUL bytes")
+		}
+	}
+	if app.ScriptsOnly && (hooks.PreUpdateCommand != "" || hooks.PostUpdateCommand != "") {
+		log.Warnf("update hooks for host %d refused: only named scripts are allowed", id)
+		writeJSONError(w, http.StatusForbidden, "Only named scripts can run on this server; update hooks can only be removed")
+		return
+	}
+	checkHook("pre_update_command", hooks.PreUpdateCommand)
+	checkHook("post_update_command", hooks.PostUpdateCommand)
+	if len(errs) > 0 {
+		middleware.SendValidationErrors(w, errs)
+		return
+	}
+
+	if err := db.SetUpdateHooks(r.Context(), app.DB, id, hooks); err != nil {
+		if isForeignKeyViolation(err) {
+			writeJSONError(w, http.StatusNotFound, "Host not found")
+			return
+		}
+		log.Errorf("Failed to set update hooks for host %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to save update hooks")
+		return
+	}
+	app.audit(r, audit.ActionHostUpdateHooksSet, "host", strconv.FormatInt(int64(id), 10), map[string]interface{}{
+		"pre_update_command":  hooks.PreUpdateCommand,
+		"post_update_command": hooks.PostUpdateCommand,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hooks)
+}
+
+// handleListRunHooks returns what the hooks of a run printed, pre first.
+// Runs without hooks, and unknown runs, give an empty list.
+func (app *Application) handleListRunHooks(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid run ID")
+		return
+	}
+	hooks, err := db.ListRunHooks(r.Context(), app.DB, int32(id))
+	if err != nil {
+		log.Errorf("Failed to list hooks of run %d: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to retrieve run hooks")
+		return
+	}
+	if hooks == nil {
+		hooks = []models.RunHook{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hooks)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pashagolub/pgxmock/v4"
+	"golang.org/x/crypto/ssh"
+
+	"ubuntu-auto-update/backend/pkg/db"
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+// newHookSSHServer starts an SSH server that records each command it runs.
+// Commands named in fail exit 1; the others exit 0. Hooks print
+// "out:<command>", the update itself nothing.
+func newHookSSHServer(t *testing.T, fail ...string) (*ssh.Client, func() []string) {
+	t.Helper()
+	var (
+		mu  sync.Mutex
+		ran []string
+	)
+	client := newTestSSHServer(t, func(ch ssh.Channel, cmd string) {
+		mu.Lock()
+		ran = append(ran, cmd)
+		mu.Unlock()
+		if strings.HasSuffix(cmd, "-hook") {
+			_, _ = ch.Write([]byte("out:" + cmd + "\n"))
+		}
+		status := byte(0)
+		for _, f := range fail {
+			if cmd == f {
+				status = 1
+			}
+		}
+		_, _ = ch.SendRequest("exit-status", false, []byte{0, 0, 0, status})
+	})
+	return client, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), ran...)
+	}
+}
+
+func expectRunHook(mock pgxmock.PgxPoolIface, phase models.HookPhase, cmd string, exit int32) {
+	mock.ExpectExec(`INSERT INTO update_run_hooks`).
+		WithArgs(int32(7), phase, cmd, &exit, "out:"+cmd+"\n").
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+}
+
+// Hook output stops at the cap without splitting a rune, and nothing is
+// added once it has been cut.
+func TestHookOutput_CapsOnRuneBoundary(t *testing.T) {
+	var out hookOutput
+	out.record(context.Background(), strings.Repeat("a", db.MaxHookOutputBytes-1))
+	out.record(context.Background(), "é")
+	out.record(context.Background(), "b")
+	if got := out.String(); len(got) != db.MaxHookOutputBytes-1 || !utf8.ValidString(got) {
+		t.Errorf("got %d bytes, valid UTF-8 %v", len(got), utf8.ValidString(got))
+	}
+}
+
+// The pre hook runs before the update and the post hook after it, each with
+// its output recorded apart from the run's. A failing post hook only warns.
+func TestRunUpdatePhases_Order(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	client, ran := newHookSSHServer(t, "post-hook")
+
+	expectRunHook(mock, models.HookPhasePre, "pre-hook", 0)
+	expectRunHook(mock, models.HookPhasePost, "post-hook", 1)
+
+	hooks := models.UpdateHooks{PreUpdateCommand: "pre-hook", PostUpdateCommand: "post-hook"}
+	var err error
+	msgs := serveWS(t, func(conn *wsConn) {
+		_, _, err = app.runUpdatePhases(context.Background(), conn, client, 7, hooks, []string{"apt-get upgrade -y"}, "")
+	})
+	if err != nil {
+		t.Fatalf("post hook failure failed the run: %v", err)
+	}
+	if got := strings.Join(ran(), ", "); got != "pre-hook, apt-get upgrade -y, post-hook" {
+		t.Errorf("ran %s", got)
+	}
+	out := strings.Join(msgs, "")
+	if !strings.Contains(out, "[pre-update hook]") || !strings.Contains(out, "Warning: post-update hook failed") {
+		t.Errorf("output:\n%s", out)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// A failing pre hook aborts the run: neither the update nor the post hook
+// runs.
+func TestRunUpdatePhases_PreHookFailureAborts(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	client, ran := newHookSSHServer(t, "pre-hook")
+
+	expectRunHook(mock, models.HookPhasePre, "pre-hook", 1)
+
+	hooks := models.UpdateHooks{PreUpdateCommand: "pre-hook", PostUpdateCommand: "post-hook"}
+	var (
+		cmd  string
+		code int
+		err  error
+	)
+	serveWS(t, func(conn *wsConn) {
+		cmd, code, err = app.runUpdatePhases(context.Background(), conn, client, 7, hooks, []string{"apt-get upgrade -y"}, "")
+	})
+	if err == nil || !strings.Contains(err.Error(), "pre-update hook failed, update not run") {
+		t.Fatalf("err = %v", err)
+	}
+	if cmd != "pre-hook" || code != 1 {
+		t.Errorf("failed command %q exit %d, want pre-hook exit 1", cmd, code)
+	}
+	if got := strings.Join(ran(), ", "); got != "pre-hook" {
+		t.Errorf("ran %s", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+func TestHandleSetUpdateHooks(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	put := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/api/v1/hosts/1/update-hooks", strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"id": "1"})
+		rr := httptest.NewRecorder()
+		app.handleSetUpdateHooks(rr, req)
+		return rr
+	}
+
+	rr := put(`{"pre_update_command":"a\u0000b","post_update_command":"` + strings.Repeat("x", maxHookCommand+1) + `"}`)
+	if rr.Code != http.StatusBadRequest ||
+		!strings.Contains(rr.Body.String(), "pre_update_command") || !strings.Contains(rr.Body.String(), "post_update_command") {
+		t.Errorf("invalid hooks: got %d %s", rr.Code, rr.Body.String())
+	}
+
+	mock.ExpectExec(`INSERT INTO host_update_hooks`).WithArgs(int32(1), "systemctl stop app", "").
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	expectAudit(mock)
+	rr = put(`{"pre_update_command":"  systemctl stop app\n"}`)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"pre_update_command":"systemctl stop app"`) {
+		t.Errorf("set: got %d %s", rr.Code, rr.Body.String())
+	}
+
+	mock.ExpectExec(`DELETE FROM host_update_hooks`).WithArgs(int32(1)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	expectAudit(mock)
+	if rr := put(`{}`); rr.Code != http.StatusOK {
+		t.Errorf("clear: got %d %s", rr.Code, rr.Body.String())
+	}
+
+	mock.ExpectExec(`INSERT INTO host_update_hooks`).WithArgs(int32(1), "true", "").
+		WillReturnError(&pgconn.PgError{Code: "23503"})
+	if rr := put(`{"pre_update_command":"true"}`); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown host: got %d", rr.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// Under EXECUTE_MODE=allowlist hooks can be removed but not set.
+func TestHandleSetUpdateHooks_Allowlist(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.ScriptsOnly = true
+	put := func(body string) int {
+		req := httptest.NewRequest(http.MethodPut, "/api/v1/hosts/1/update-hooks", strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"id": "1"})
+		rr := httptest.NewRecorder()
+		app.handleSetUpdateHooks(rr, req)
+		return rr.Code
+	}
+
+	if code := put(`{"post_update_command":"systemctl start app"}`); code != http.StatusForbidden {
+		t.Errorf("set: expected 403, got %d", code)
+	}
+	mock.ExpectExec(`DELETE FROM host_update_hooks`).WithArgs(int32(1)).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+	expectAudit(mock)
+	if code := put(`{}`); code != http.StatusOK {
+		t.Errorf("clear: expected 200, got %d", code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
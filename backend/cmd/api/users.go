@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
@@ -41,8 +42,8 @@ func (app *Application) handleCreateUser(w http.ResponseWriter, r *http.Request)
 		Password string `json:"password"`
 		Role     string `json:"role"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
 		return
 	}
 	if req.Username == "" || req.Password == "" {
@@ -56,6 +57,10 @@ func (app *Application) handleCreateUser(w http.ResponseWriter, r *http.Request)
 		writeJSONError(w, http.StatusBadRequest, "role must be viewer, operator, or admin")
 		return
 	}
+	if err := users.ValidatePassword(app.Passwords, req.Password); err != nil {
+		writePasswordError(w, err)
+		return
+	}
 
 	u, err := users.Create(r.Context(), app.DB, req.Username, req.Password, req.Role)
 	if err != nil {
@@ -94,11 +99,20 @@ func (app *Application) handleUpdateUser(w http.ResponseWriter, r *http.Request)
 		Disabled *bool   `json:"disabled,omitempty"`
 		Password *string `json:"password,omitempty"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
 		return
 	}
 
+	// Checked before anything is written so a weak password doesn't leave
+	// the other fields half-applied.
+	if req.Password != nil {
+		if err := users.ValidatePassword(app.Passwords, *req.Password); err != nil {
+			writePasswordError(w, err)
+			return
+		}
+	}
+
 	if req.Role != nil {
 		if err := users.SetRole(r.Context(), app.DB, id, *req.Role); err != nil {
 			respondUserUpdateError(w, err)
@@ -165,6 +179,17 @@ func respondUserUpdateError(w http.ResponseWriter, err error) {
 	}
 }
 
+// writePasswordError is a 400 whose details list the failed password rules.
+func writePasswordError(w http.ResponseWriter, err error) {
+	var pe *users.PasswordError
+	if !errors.As(err, &pe) {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	middleware.SendErrorResponse(w, http.StatusBadRequest, errorCode(http.StatusBadRequest),
+		"Password is too weak: "+pe.Error(), map[string]interface{}{"failed_rules": pe.Failed})
+}
+
 func parseUserID(r *http.Request) (int32, error) {
 	idStr, ok := mux.Vars(r)["id"]
 	if !ok {
@@ -181,6 +206,40 @@ func parseUserID(r *http.Request) (int32, error) {
 // context so handlers don't have to reassemble it. Best effort: a failed
 // audit write logs but does not fail the original operation.
 func (app *Application) audit(r *http.Request, action, targetType, targetID string, details map[string]interface{}) {
+	if app.DB == nil {
+		// Non-fatal — likely a unit test path.
+		return
+	}
+	if err := audit.Log(r.Context(), app.DB, auditEvent(r, action, targetType, targetID, details)); err != nil {
+		log.Errorf("audit log: %v", err)
+	}
+}
+
+// auditBegin is audit for an action still to run: it returns the row's id
+// for auditFinish, or 0 when nothing was written.
+func (app *Application) auditBegin(r *http.Request, action, targetType, targetID string, details map[string]interface{}) int64 {
+	if app.DB == nil {
+		return 0
+	}
+	id, err := audit.Begin(r.Context(), app.DB, auditEvent(r, action, targetType, targetID, details))
+	if err != nil {
+		log.Errorf("audit log: %v", err)
+		return 0
+	}
+	return id
+}
+
+// auditFinish adds details to the row auditBegin wrote. A 0 id is a no-op.
+func (app *Application) auditFinish(ctx context.Context, id int64, details map[string]interface{}) {
+	if id == 0 || app.DB == nil {
+		return
+	}
+	if err := audit.Finish(ctx, app.DB, id, details); err != nil {
+		log.Errorf("audit log %d: %v", id, err)
+	}
+}
+
+func auditEvent(r *http.Request, action, targetType, targetID string, details map[string]interface{}) audit.Event {
 	p := middleware.GetPrincipalFromContext(r)
 	ev := audit.Event{
 		Action:     action,
@@ -197,13 +256,7 @@ func (app *Application) audit(r *http.Request, action, targetType, targetID stri
 		}
 		ev.ActorLabel = p.Username
 	}
-	if app.DB == nil {
-		// Non-fatal — likely a unit test path.
-		return
-	}
-	if err := audit.Log(r.Context(), app.DB, ev); err != nil {
-		log.Errorf("audit log: %v", err)
-	}
+	return ev
 }
 
 // handleListAudit returns the most recent audit records, newest first.
@@ -217,12 +270,32 @@ func (app *Application) handleListAudit(w http.ResponseWriter, r *http.Request)
 			limit = n
 		}
 	}
-	out, err := audit.List(r.Context(), app.DB, audit.ListOptions{
+	offset := 0
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeJSONError(w, http.StatusBadRequest, "offset must be >= 0")
+			return
+		}
+		offset = n
+	}
+	opts := audit.ListOptions{
 		Limit:      limit,
+		Offset:     offset,
 		Action:     q.Get("action"),
+		Actor:      q.Get("user"),
 		TargetType: q.Get("target_type"),
 		TargetID:   q.Get("target_id"),
-	})
+	}
+	// host_id is shorthand for target_type=host&target_id=N.
+	if v := q.Get("host_id"); v != "" {
+		if _, err := strconv.ParseInt(v, 10, 32); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid host_id")
+			return
+		}
+		opts.TargetType, opts.TargetID = "host", v
+	}
+	out, err := audit.List(r.Context(), app.DB, opts)
 	if err != nil {
 		log.Errorf("audit list: %v", err)
 		writeJSONError(w, http.StatusInternalServerError, "Failed to read audit log")
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -15,6 +16,7 @@ import (
 	"github.com/pashagolub/pgxmock/v4"
 	"ubuntu-auto-update/backend/pkg/middleware"
 	"ubuntu-auto-update/backend/pkg/session"
+	"ubuntu-auto-update/backend/pkg/users"
 )
 
 func TestHandleListUsers(t *testing.T) {
@@ -148,6 +150,53 @@ func TestHandleCreateUser(t *testing.T) {
 	}
 }
 
+// Under REQUIRE_STRONG_PASSWORDS a weak password is refused with the failed
+// rules listed, before anything reaches the DB.
+func TestHandleCreateUser_PasswordPolicy(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.Passwords = users.PasswordPolicy{MinLength: 14, RequireStrong: true}
+
+	body, _ := json.Marshal(map[string]string{"username": "dave", "password": "password1234"})
+	rr := httptest.NewRecorder()
+	app.handleCreateUser(rr, httptest.NewRequest(http.MethodPost, "/api/v1/users", bytes.NewReader(body)))
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp middleware.ErrorResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(resp.Details["failed_rules"])
+	if want := `["at least 14 characters","an uppercase letter","a symbol"]`; string(got) != want {
+		t.Errorf("failed_rules = %s, want %s", got, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unexpected DB use: %v", err)
+	}
+}
+
+// A weak password in a PATCH rejects the whole update, role change included.
+func TestHandleUpdateUser_PasswordPolicy(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	app.Passwords = users.PasswordPolicy{RequireStrong: true}
+
+	req := httptest.NewRequest(http.MethodPatch, "/api/v1/users/2",
+		strings.NewReader(`{"role":"admin","password":"alllowercase-only"}`))
+	req = mux.SetURLVars(req, map[string]string{"id": "2"})
+	rr := httptest.NewRecorder()
+	app.handleUpdateUser(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unexpected DB use: %v", err)
+	}
+}
+
 func TestHandleUpdateUser(t *testing.T) {
 	app, mock := testAppWithDB(t)
 	defer mock.Close()
@@ -315,7 +364,7 @@ func TestHandleListAudit(t *testing.T) {
 	rows := mock.NewRows([]string{"id", "occurred_at", "actor_user_id", "actor_label", "action", "target_type", "target_id", "request_id", "ip", "user_agent", "details"}).
 		AddRow(int64(1), now, nil, "system", "test.action", "", "", "", "", "", []byte("{}"))
 
-	mock.ExpectQuery(`SELECT (.+) FROM audit_log`).WithArgs(100).WillReturnRows(rows)
+	mock.ExpectQuery(`SELECT (.+) FROM audit_log`).WithArgs(100, 0).WillReturnRows(rows)
 
 	req := httptest.NewRequest(http.MethodGet, "/api/v1/audit", nil)
 	rr := httptest.NewRecorder()
@@ -326,8 +375,8 @@ func TestHandleListAudit(t *testing.T) {
 	}
 
 	// Query params
-	mock.ExpectQuery(`SELECT (.+) FROM audit_log WHERE 1=1 AND action = \$1 AND target_type = \$2 AND target_id = \$3 ORDER BY occurred_at DESC LIMIT \$4`).
-		WithArgs("login", "user", "2", 10).
+	mock.ExpectQuery(`SELECT (.+) FROM audit_log WHERE 1=1 AND action = \$1 AND target_type = \$2 AND target_id = \$3 ORDER BY occurred_at DESC, id DESC LIMIT \$4 OFFSET \$5`).
+		WithArgs("login", "user", "2", 10, 0).
 		WillReturnRows(mock.NewRows([]string{"id", "occurred_at", "actor_user_id", "actor_label", "action", "target_type", "target_id", "request_id", "ip", "user_agent", "details"}))
 
 	req = httptest.NewRequest(http.MethodGet, "/api/v1/audit?limit=10&action=login&target_type=user&target_id=2", nil)
@@ -338,8 +387,29 @@ func TestHandleListAudit(t *testing.T) {
 		t.Errorf("expected 200 with query params, got %d", rr.Code)
 	}
 
+	// host_id + user filters with an offset page
+	mock.ExpectQuery(`SELECT (.+) FROM audit_log WHERE 1=1 AND actor_label = \$1 AND target_type = \$2 AND target_id = \$3 ORDER BY occurred_at DESC, id DESC LIMIT \$4 OFFSET \$5`).
+		WithArgs("alice", "host", "7", 100, 50).
+		WillReturnRows(mock.NewRows([]string{"id", "occurred_at", "actor_user_id", "actor_label", "action", "target_type", "target_id", "request_id", "ip", "user_agent", "details"}))
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/audit?host_id=7&user=alice&offset=50", nil)
+	rr = httptest.NewRecorder()
+	app.handleListAudit(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected 200 with host_id/user, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/audit?host_id=web-1", nil)
+	rr = httptest.NewRecorder()
+	app.handleListAudit(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for non-numeric host_id, got %d", rr.Code)
+	}
+
 	// DB error
-	mock.ExpectQuery(`SELECT (.+) FROM audit_log`).WithArgs(100).WillReturnError(errors.New("db error"))
+	mock.ExpectQuery(`SELECT (.+) FROM audit_log`).WithArgs(100, 0).WillReturnError(errors.New("db error"))
 
 	req = httptest.NewRequest(http.MethodGet, "/api/v1/audit", nil)
 	rr = httptest.NewRecorder()
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"ubuntu-auto-update/backend/pkg/db"
+)
+
+func TestHandleVersion_Defaults(t *testing.T) {
+	app := testApp(t)
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/version", nil)
+	rr := httptest.NewRecorder()
+	app.handleVersion(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var got BuildInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	// Test binaries aren't built with -ldflags or VCS stamping.
+	if got.Version != "dev" || got.Commit != "unknown" || got.BuildDate != "unknown" {
+		t.Errorf("unexpected defaults: %+v", got)
+	}
+	if got.GoVersion == "" {
+		t.Error("go_version missing")
+	}
+}
+
+func TestHandleVersion_LinkerVars(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "1.4.0", "abc123", "2026-10-01T00:00:00Z"
+
+	rr := httptest.NewRecorder()
+	testApp(t).handleVersion(rr, httptest.NewRequest(http.MethodGet, "/api/v1/version", nil))
+
+	var got BuildInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got.Version != "1.4.0" || got.Commit != "abc123" || got.BuildDate != "2026-10-01T00:00:00Z" {
+		t.Errorf("linker vars not reported: %+v", got)
+	}
+}
+
+func TestHandleHealth_ReportsVersion(t *testing.T) {
+	app, mock := testAppWithDB(t)
+	defer mock.Close()
+	mock.ExpectPing()
+	expectSchema(mock, db.RequiredTables...)
+
+	rr := httptest.NewRecorder()
+	app.handleHealth(rr, httptest.NewRequest(http.MethodGet, "/api/v1/health", nil))
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if body["version"] != buildInfo().Version {
+		t.Errorf("version = %v, want %q", body["version"], buildInfo().Version)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsConn is a *websocket.Conn that is safe for concurrent writers.
+// gorilla/websocket allows one writer at a time, but a run's stdout and
+// stderr pumps, its keepalive pings and the final close frame all write to
+// the same socket, and interleaved writes corrupt frames. Every write, and
+// the write deadline it depends on, goes through mu.
+//
+// Reads are left to the embedded Conn; keepWSAlive's reader is the only one.
+type wsConn struct {
+	*websocket.Conn
+	mu sync.Mutex
+}
+
+func newWSConn(conn *websocket.Conn) *wsConn {
+	return &wsConn{Conn: conn}
+}
+
+func (c *wsConn) WriteMessage(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+// writeMessageWithin is WriteMessage bounded by wait. The deadline is set
+// under the same lock, so another writer can't move it mid-write.
+func (c *wsConn) writeMessageWithin(messageType int, data []byte, wait time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(wait)); err != nil {
+		return err
+	}
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+func (c *wsConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.WriteControl(messageType, data, deadline)
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Close waits for an in-flight write to finish, so it never cuts a frame
+// in half.
+func (c *wsConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.Close()
+}
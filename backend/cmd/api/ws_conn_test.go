@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Many goroutines writing messages, pings and deadlines through one wsConn
+// deliver every message whole. Run with -race: an unguarded write is
+// reported as a data race inside gorilla/websocket.
+func TestWSConn_ConcurrentWriters(t *testing.T) {
+	const writers, perWriter = 8, 50
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		conn := newWSConn(ws)
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < perWriter; j++ {
+					msg := []byte(fmt.Sprintf("writer %d message %d %s", i, j, strings.Repeat("x", 512)))
+					var err error
+					switch j % 3 {
+					case 0:
+						err = conn.WriteMessage(websocket.TextMessage, msg)
+					case 1:
+						err = conn.writeMessageWithin(websocket.TextMessage, msg, wsWriteWait)
+					default:
+						err = writeChunked(conn, msg)
+					}
+					if err != nil {
+						t.Errorf("writer %d: %v", i, err)
+						return
+					}
+					_ = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+					_ = conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				}
+			}(i)
+		}
+		wg.Wait()
+		closeWS(conn, wsCloseOK, "done")
+	}))
+	defer ts.Close()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	// Don't answer pings: the server closes as soon as it's done, and a pong
+	// written to the closed socket would end the read loop early.
+	client.SetPingHandler(func(string) error { return nil })
+	var msgs []string
+	for {
+		_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, msg, err := client.ReadMessage()
+		if err != nil {
+			break
+		}
+		msgs = append(msgs, string(msg))
+	}
+
+	if len(msgs) != writers*perWriter {
+		t.Fatalf("got %d messages, want %d", len(msgs), writers*perWriter)
+	}
+	seen := map[string]bool{}
+	for _, m := range msgs {
+		var i, j int
+		if _, err := fmt.Sscanf(m, "writer %d message %d", &i, &j); err != nil || !strings.HasSuffix(m, strings.Repeat("x", 512)) {
+			t.Fatalf("corrupted message %q", m)
+		}
+		seen[m] = true
+	}
+	if len(seen) != writers*perWriter {
+		t.Errorf("got %d distinct messages, want %d", len(seen), writers*perWriter)
+	}
+}
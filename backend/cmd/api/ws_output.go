@@ -0,0 +1,127 @@
+package main
+
+import (
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsChunkBytes bounds one WebSocket message of command output. A script can
+// print megabytes; sent as one frame that trips proxy and browser message
+// limits and holds the whole thing in one write.
+const wsChunkBytes = 32 * 1024
+
+// wsWriteWait bounds each chunk's write, so a client that stops reading
+// fails the stream instead of parking the handler.
+const wsWriteWait = 10 * time.Second
+
+// writeChunked sends out as consecutive text messages of at most
+// wsChunkBytes, never splitting a UTF-8 sequence, so the concatenated
+// messages are exactly out. It stops at the first failed write.
+func writeChunked(conn *wsConn, out []byte) error {
+	for len(out) > 0 {
+		n := min(len(out), wsChunkBytes)
+		if n < len(out) {
+			for i := n; i > 0 && i > n-utf8.UTFMax; i-- {
+				if utf8.RuneStart(out[i]) {
+					n = i
+					break
+				}
+			}
+		}
+		if err := conn.writeMessageWithin(websocket.TextMessage, out[:n], wsWriteWait); err != nil {
+			return err
+		}
+		out = out[n:]
+	}
+	return nil
+}
+
+// Close codes the SSH WebSocket handlers (execute-script and the run engine
+// behind preview, run-update and run-playbook) end with, so a client can
+// tell how a run went without parsing the text frames. The 4000 range is
+// RFC 6455's private-use block.
+const (
+	wsCloseOK            = websocket.CloseNormalClosure     // 1000: ran and exited 0
+	wsCloseServerError   = websocket.CloseInternalServerErr // 1011: the backend failed
+	wsCloseCommandFailed = 4000                             // the remote command exited non-zero
+	wsCloseUnreachable   = 4001                             // SSH connect failed or the connection dropped
+	wsCloseRejected      = 4002                             // the request was refused before running
+	wsCloseBusy          = 4003                             // every SSH slot is taken; retry later
+	wsCloseCancelled     = 4004                             // an operator cancelled the run
+)
+
+// maxCloseReason is what fits in a close frame after the 2-byte code.
+const maxCloseReason = 123
+
+// closeWS ends conn with a close frame carrying code and reason, then
+// closes the socket. The reason is cut to fit the frame on a rune boundary.
+func closeWS(conn *wsConn, code int, reason string) {
+	if len(reason) > maxCloseReason {
+		n := maxCloseReason
+		for n > 0 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+		reason = reason[:n]
+	}
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteWait))
+	_ = conn.Close()
+}
+
+// defaultWSPingInterval is used when Application.WSPingInterval is unset.
+const defaultWSPingInterval = 30 * time.Second
+
+// keepWSAlive pings conn every interval so a proxy in front of the API
+// doesn't reap the socket while a long command (apt upgrade unpacking a
+// kernel) prints nothing. It also reads conn in the background, which is
+// what processes the client's pongs and close frame; each pong pushes the
+// read deadline out, so a client that misses two pings in a row is given
+// up on and pinging stops. Call the returned stop before closing conn.
+func keepWSAlive(conn *wsConn, interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		interval = defaultWSPingInterval
+	}
+	pongWait := 2 * interval
+	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-gone:
+				return
+			case <-ticker.C:
+				// Serialized with the handler's own writes by wsConn.
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
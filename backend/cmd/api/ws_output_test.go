@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWriteChunked_LargeOutput(t *testing.T) {
+	// ~3 MiB with multi-byte runes straddling every chunk boundary.
+	out := []byte(strings.Repeat("apt: ünpacking linux-firmware… ok\n", 90000))
+
+	app := testApp(t)
+	errc := make(chan error, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := app.wsUpgrader()
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.Close()
+		errc <- writeChunked(newWSConn(conn), out)
+	}))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	var got bytes.Buffer
+	msgs := 0
+	for got.Len() < len(out) {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("after %d messages (%d bytes): %v", msgs, got.Len(), err)
+		}
+		if len(msg) > wsChunkBytes {
+			t.Fatalf("message %d is %d bytes, over the %d cap", msgs, len(msg), wsChunkBytes)
+		}
+		if !utf8.Valid(msg) {
+			t.Fatalf("message %d splits a UTF-8 sequence", msgs)
+		}
+		got.Write(msg)
+		msgs++
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("writeChunked: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), out) {
+		t.Fatal("reassembled output differs from what was sent")
+	}
+	if msgs < len(out)/wsChunkBytes {
+		t.Errorf("got %d messages for %d bytes", msgs, len(out))
+	}
+}
+
+// readUntilClose drains conn and returns everything it carried plus the
+// close code the server sent, or -1 if the socket ended without one.
+func readUntilClose(t *testing.T, conn *websocket.Conn) (string, int) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var out strings.Builder
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) {
+				return out.String(), ce.Code
+			}
+			return out.String(), -1
+		}
+		out.Write(msg)
+	}
+}
+
+// A long reason is cut to fit the close frame without splitting a rune.
+func TestCloseWS_TruncatesReason(t *testing.T) {
+	reason := strings.Repeat("é", 100) // 200 bytes
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		closeWS(newWSConn(conn), wsCloseCommandFailed, reason)
+	}))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn.ReadMessage()
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) {
+		t.Fatalf("read: %v, want a close frame", err)
+	}
+	if ce.Code != wsCloseCommandFailed {
+		t.Errorf("code = %d, want %d", ce.Code, wsCloseCommandFailed)
+	}
+	if len(ce.Text) > maxCloseReason || !utf8.ValidString(ce.Text) || !strings.HasPrefix(reason, ce.Text) {
+		t.Errorf("reason %q (%d bytes) is not a clean prefix", ce.Text, len(ce.Text))
+	}
+}
+
+// A command that prints nothing for a while still gets its socket pinged,
+// and stopping the keepalive ends the pings before the close frame.
+func TestKeepWSAlive_PingsDuringQuietCommand(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	app := testApp(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := app.wsUpgrader()
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn := newWSConn(ws)
+		stop := keepWSAlive(conn, interval)
+		time.Sleep(10 * interval) // the long, silent apt upgrade
+		stop()
+		time.Sleep(5 * interval)
+		closeWS(conn, wsCloseOK, "exit 0")
+	}))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	var pings int
+	var lastPing time.Time
+	conn.SetPingHandler(func(data string) error {
+		pings++
+		lastPing = time.Now()
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+
+	if _, code := readUntilClose(t, conn); code != wsCloseOK {
+		t.Errorf("close code = %d, want %d", code, wsCloseOK)
+	}
+	quiet := time.Since(lastPing)
+	if pings < 3 {
+		t.Errorf("got %d pings over %s, want at least 3", pings, 10*interval)
+	}
+	if quiet < 2*interval {
+		t.Errorf("last ping came %s before the close, want pings to stop at stop()", quiet)
+	}
+}
@@ -0,0 +1,3 @@
+-- GIN index so GET /hosts?tag= and tag-targeted bulk runs (tags @> ARRAY[..])
+-- don't seq-scan the fleet.
+CREATE INDEX IF NOT EXISTS idx_hosts_tags ON hosts USING GIN (tags);
@@ -0,0 +1,3 @@
+-- The agent has always sent system_info.architecture; migration 000016
+-- persisted os/kernel/agent version but not this one.
+ALTER TABLE hosts ADD COLUMN IF NOT EXISTS architecture TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,4 @@
+-- UpsertHost now keeps only the tail of oversized apt output; these flags
+-- record that the stored text is not the whole log.
+ALTER TABLE hosts ADD COLUMN IF NOT EXISTS update_output_truncated BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE hosts ADD COLUMN IF NOT EXISTS upgrade_output_truncated BOOLEAN NOT NULL DEFAULT false;
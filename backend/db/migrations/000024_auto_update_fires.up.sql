@@ -0,0 +1,7 @@
+-- One row per AUTO_UPDATE_SCHEDULE firing. Replicas race to insert the slot;
+-- only the one that wins starts the run, so a fleet-wide update never fires
+-- twice for the same minute.
+CREATE TABLE IF NOT EXISTS auto_update_fires (
+    fire_at  TIMESTAMPTZ PRIMARY KEY,
+    fired_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
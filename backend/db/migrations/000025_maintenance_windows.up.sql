@@ -0,0 +1,21 @@
+-- Maintenance windows gate automatic and bulk updates. host_id NULL makes a
+-- window global; a host with windows of its own ignores the global ones. A
+-- host with no applicable window at all is never gated.
+--
+-- Times are minutes since local midnight in timezone (an IANA name), so a
+-- 02:00 window stays at 02:00 across DST changes. A window that wraps
+-- midnight (start > end) belongs to its start day, as with schedules.
+CREATE TABLE IF NOT EXISTS maintenance_windows (
+    id           SERIAL PRIMARY KEY,
+    name         TEXT NOT NULL,
+    host_id      INTEGER REFERENCES hosts(id) ON DELETE CASCADE,
+    start_minute INTEGER NOT NULL CHECK (start_minute BETWEEN 0 AND 1439),
+    end_minute   INTEGER NOT NULL CHECK (end_minute BETWEEN 0 AND 1439),
+    days         SMALLINT NOT NULL DEFAULT 127 CHECK (days BETWEEN 1 AND 127),
+    timezone     TEXT NOT NULL DEFAULT 'UTC',
+    created_by   TEXT NOT NULL DEFAULT '',
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CHECK (start_minute <> end_minute)
+);
+
+CREATE INDEX IF NOT EXISTS idx_maintenance_windows_host ON maintenance_windows(host_id);
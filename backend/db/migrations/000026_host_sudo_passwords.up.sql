@@ -0,0 +1,8 @@
+-- Optional sudo password per host, for ssh users whose sudo rule requires
+-- one. Encrypted like ssh_keys.private_key; kept out of the hosts table so
+-- no host query can return it by accident.
+CREATE TABLE IF NOT EXISTS host_sudo_passwords (
+    host_id    INTEGER PRIMARY KEY REFERENCES hosts(id) ON DELETE CASCADE,
+    password   TEXT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
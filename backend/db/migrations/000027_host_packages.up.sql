@@ -0,0 +1,8 @@
+-- Last installed-package inventory read from each host (dpkg-query), kept
+-- so repeated page requests don't re-SSH. One JSON array per host; the API
+-- refetches once fetched_at is older than its cache TTL.
+CREATE TABLE IF NOT EXISTS host_packages (
+    host_id    INTEGER PRIMARY KEY REFERENCES hosts(id) ON DELETE CASCADE,
+    packages   JSONB NOT NULL,
+    fetched_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,10 @@
+-- Last unattended-upgrades probe per host. installed = false means the
+-- package is absent (enabled is then false too); last_run is NULL when the
+-- log is missing, unreadable or has no run in it yet.
+CREATE TABLE IF NOT EXISTS host_unattended_upgrades (
+    host_id    INTEGER PRIMARY KEY REFERENCES hosts(id) ON DELETE CASCADE,
+    installed  BOOLEAN NOT NULL,
+    enabled    BOOLEAN NOT NULL,
+    last_run   TIMESTAMPTZ,
+    checked_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,5 @@
+-- Per-host update policy. 'security_only' hosts only ever get
+-- unattended-upgrade with the security origins, whatever the run asks for;
+-- 'all' keeps the full apt-get upgrade (and honors a per-run security_only).
+ALTER TABLE hosts ADD COLUMN IF NOT EXISTS update_policy TEXT NOT NULL DEFAULT 'all'
+    CHECK (update_policy IN ('all', 'security_only'));
@@ -0,0 +1,21 @@
+-- Commands queued for agents to pull. Firewalled hosts can't take inbound
+-- SSH, so their agent polls GET /agent/commands instead. Delivery is at most
+-- once: a poll flips queued -> dispatched and the agent's result flips
+-- dispatched -> completed; a command the agent never reports on stays
+-- dispatched rather than being run twice.
+CREATE TABLE IF NOT EXISTS command_queue (
+    id            SERIAL PRIMARY KEY,
+    host_id       INTEGER NOT NULL REFERENCES hosts(id) ON DELETE CASCADE,
+    command       TEXT NOT NULL,
+    status        TEXT NOT NULL DEFAULT 'queued'
+                  CHECK (status IN ('queued', 'dispatched', 'completed')),
+    enqueued_by   TEXT NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    dispatched_at TIMESTAMPTZ,
+    completed_at  TIMESTAMPTZ,
+    exit_code     INTEGER,
+    output        TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_command_queue_pending
+    ON command_queue (host_id, id) WHERE status = 'queued';
@@ -0,0 +1,11 @@
+-- Agent enrollment tokens minted with `ua-backend create-token`. Hash-only
+-- at rest, like api_tokens; the raw token (uae_…) is printed once.
+-- ENROLLMENT_TOKEN from the environment keeps working alongside these.
+CREATE TABLE IF NOT EXISTS enrollment_tokens (
+    id           SERIAL PRIMARY KEY,
+    name         TEXT NOT NULL,
+    token_hash   TEXT NOT NULL UNIQUE,
+    created_by   TEXT NOT NULL DEFAULT '',
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMPTZ
+);
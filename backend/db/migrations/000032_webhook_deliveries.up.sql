@@ -0,0 +1,17 @@
+-- One row per webhook delivery attempt, so an operator can see why a
+-- receiver stopped getting events. Response bodies are capped at 1 KiB by
+-- the writer; status_code is NULL when the request never got a response.
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id               BIGSERIAL PRIMARY KEY,
+    webhook_id       INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    url              TEXT NOT NULL,
+    event            TEXT NOT NULL,
+    attempt          INTEGER NOT NULL,
+    status_code      INTEGER,
+    response_snippet TEXT NOT NULL DEFAULT '',
+    error            TEXT,
+    created_at       TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_created
+    ON webhook_deliveries (webhook_id, created_at DESC);
@@ -0,0 +1,7 @@
+-- Payload format per subscription: 'raw' posts the event map as before,
+-- 'slack' and 'teams' post a message their incoming webhooks can render.
+ALTER TABLE webhooks ADD COLUMN IF NOT EXISTS format TEXT NOT NULL DEFAULT 'raw';
+
+ALTER TABLE webhooks DROP CONSTRAINT IF EXISTS check_webhook_format_valid;
+ALTER TABLE webhooks ADD CONSTRAINT check_webhook_format_valid
+    CHECK (format IN ('raw', 'slack', 'teams'));
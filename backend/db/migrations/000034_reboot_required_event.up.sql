@@ -0,0 +1,9 @@
+-- Agent reports whose upgrade left the host needing a reboot fire
+-- reboot_required (to webhooks and, when enabled, email).
+ALTER TABLE webhooks DROP CONSTRAINT IF EXISTS check_webhook_event_valid;
+ALTER TABLE webhooks ADD CONSTRAINT check_webhook_event_valid
+    CHECK (event IN ('update_success', 'update_failure', 'host_registered',
+                     'host_offline', 'preview_success',
+                     'playbook_success', 'playbook_failure',
+                     'reboot_success', 'reboot_failure',
+                     'reboot_required'));
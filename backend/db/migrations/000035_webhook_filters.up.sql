@@ -0,0 +1,9 @@
+-- Optional per-webhook scope: a single host, or every host carrying a tag.
+-- Neither set keeps the old fire-for-every-host behavior. Deleting the host
+-- deletes webhooks scoped to it rather than widening them to the fleet.
+ALTER TABLE webhooks ADD COLUMN IF NOT EXISTS host_id INTEGER REFERENCES hosts(id) ON DELETE CASCADE;
+ALTER TABLE webhooks ADD COLUMN IF NOT EXISTS tag TEXT;
+
+ALTER TABLE webhooks DROP CONSTRAINT IF EXISTS check_webhook_single_filter;
+ALTER TABLE webhooks ADD CONSTRAINT check_webhook_single_filter
+    CHECK (host_id IS NULL OR tag IS NULL);
@@ -0,0 +1,16 @@
+-- Refresh tokens let a logged-in user get a new session without re-entering
+-- credentials. Stored as SHA-256 hashes like sessions. Every refresh marks the
+-- presented token used and issues the next one in the same family; a used
+-- token coming back means it leaked, so the whole family is revoked.
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id          SERIAL PRIMARY KEY,
+    token_hash  TEXT NOT NULL UNIQUE,
+    family      TEXT NOT NULL,
+    user_id     INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expires_at  TIMESTAMPTZ NOT NULL,
+    used_at     TIMESTAMPTZ,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family ON refresh_tokens (family);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_expires_at ON refresh_tokens (expires_at);
@@ -0,0 +1,4 @@
+-- Deleting a host archives it: deleted_at is stamped and the row is hidden
+-- from listings, the offline sweep and scheduled runs, but kept (with its
+-- key and run history) until an explicit purge. NULL = live.
+ALTER TABLE hosts ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
@@ -0,0 +1,5 @@
+-- UpsertHost now gzips large apt output, which TEXT can't hold. Existing
+-- rows become their UTF-8 bytes, which read back unchanged as uncompressed
+-- output.
+ALTER TABLE hosts ALTER COLUMN update_output TYPE BYTEA USING convert_to(update_output, 'UTF8');
+ALTER TABLE hosts ALTER COLUMN upgrade_output TYPE BYTEA USING convert_to(upgrade_output, 'UTF8');
@@ -0,0 +1,4 @@
+-- Simulated update runs (?simulate=true) are kept apart from real ones.
+ALTER TABLE update_runs DROP CONSTRAINT IF EXISTS update_runs_kind_check;
+ALTER TABLE update_runs ADD CONSTRAINT update_runs_kind_check
+    CHECK (kind IN ('preview', 'update', 'playbook', 'reboot', 'simulate'));
@@ -0,0 +1,5 @@
+-- Enrollment tokens minted through POST /api/v1/enrollment-tokens expire and
+-- are usually single-use. Existing (CLI) tokens keep working: no expiry,
+-- reusable.
+ALTER TABLE enrollment_tokens ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+ALTER TABLE enrollment_tokens ADD COLUMN IF NOT EXISTS single_use BOOLEAN NOT NULL DEFAULT false;
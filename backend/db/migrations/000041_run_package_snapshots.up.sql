@@ -0,0 +1,8 @@
+-- The dpkg package list read from a host right after each successful update
+-- run, so GET /hosts/{id}/history can diff what changed between two runs.
+-- Runs from before this migration have no row. Pruned with their run.
+CREATE TABLE IF NOT EXISTS run_packages (
+    run_id      INTEGER PRIMARY KEY REFERENCES update_runs(id) ON DELETE CASCADE,
+    packages    JSONB NOT NULL,
+    captured_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
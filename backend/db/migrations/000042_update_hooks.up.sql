@@ -0,0 +1,23 @@
+-- Optional per-host shell commands run over SSH around run-update: the pre
+-- hook before apt (a failure aborts the update), the post hook after it (a
+-- failure only warns). Stored in plain text like playbook steps, so they
+-- shouldn't embed secrets. Kept out of hosts so host queries don't change.
+CREATE TABLE IF NOT EXISTS host_update_hooks (
+    host_id             INTEGER PRIMARY KEY REFERENCES hosts(id) ON DELETE CASCADE,
+    pre_update_command  TEXT NOT NULL DEFAULT '',
+    post_update_command TEXT NOT NULL DEFAULT '',
+    updated_at          TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- What each hook printed during a run, kept apart from update_runs.output so
+-- the apt output (and the parsing done on it) is unchanged. exit_code is
+-- NULL when the hook never exited (connection lost, run cancelled).
+CREATE TABLE IF NOT EXISTS update_run_hooks (
+    run_id      INTEGER NOT NULL REFERENCES update_runs(id) ON DELETE CASCADE,
+    phase       TEXT NOT NULL CHECK (phase IN ('pre', 'post')),
+    command     TEXT NOT NULL,
+    exit_code   INTEGER,
+    output      TEXT NOT NULL DEFAULT '',
+    finished_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (run_id, phase)
+);
@@ -0,0 +1,5 @@
+-- Optional environment label (prod, staging, ...). Runs against hosts in an
+-- environment listed in REQUIRE_CONFIRM_ENV need explicit confirmation.
+-- '' means unlabelled.
+ALTER TABLE hosts ADD COLUMN IF NOT EXISTS environment TEXT NOT NULL DEFAULT ''
+    CHECK (environment ~ '^([a-z0-9][a-z0-9_-]{0,31})?$');
@@ -0,0 +1,33 @@
+-- Webhook outbox. Every event is stored when it is emitted, with one
+-- webhook_outbox row per subscribed webhook until a delivery gets through,
+-- so a receiver that is down for a while gets its events late instead of
+-- never, and past events can be replayed to it.
+--
+-- dedup_key names one occurrence of a run event ("update_failure:host=3:
+-- run=17"); a second replica emitting the same occurrence conflicts on it
+-- and queues nothing. Events without a key leave it NULL. host_id has no
+-- foreign key so a purged host's events stay replayable.
+CREATE TABLE IF NOT EXISTS events (
+    id         BIGSERIAL PRIMARY KEY,
+    event      TEXT NOT NULL,
+    host_id    INTEGER,
+    dedup_key  TEXT UNIQUE,
+    payload    JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_events_event_created ON events (event, created_at);
+
+-- attempts counts the retry worker's tries, not the immediate ones made at
+-- emit time; next_attempt_at doubles as the worker's lease on a row.
+CREATE TABLE IF NOT EXISTS webhook_outbox (
+    event_id        BIGINT NOT NULL REFERENCES events(id) ON DELETE CASCADE,
+    webhook_id      INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    attempts        INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    delivered_at    TIMESTAMPTZ,
+    PRIMARY KEY (event_id, webhook_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_outbox_due
+    ON webhook_outbox (next_attempt_at) WHERE delivered_at IS NULL;
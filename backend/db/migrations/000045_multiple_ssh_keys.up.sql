@@ -0,0 +1,9 @@
+-- A host can hold several SSH keys, tried in position order on every dial,
+-- so the old and new key both work through a rotation window. Existing keys
+-- become position 0 of their host.
+ALTER TABLE ssh_keys ADD COLUMN IF NOT EXISTS id SERIAL;
+ALTER TABLE ssh_keys ADD COLUMN IF NOT EXISTS position INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE ssh_keys DROP CONSTRAINT IF EXISTS ssh_keys_pkey;
+ALTER TABLE ssh_keys ADD PRIMARY KEY (id);
+
+CREATE INDEX IF NOT EXISTS idx_ssh_keys_host_position ON ssh_keys (host_id, position, id);
@@ -0,0 +1,19 @@
+-- A bulk run rolls out in phases: one for a parallel run, the canary sample
+-- and the remainder for a canary run, one per batch for a rolling run. Each
+-- phase's hosts and outcome are kept so the UI can show where a rollout
+-- stopped and why. Rows are created up front as pending; phases after a
+-- halt end up skipped.
+CREATE TABLE IF NOT EXISTS run_group_phases (
+    run_group_id UUID NOT NULL,
+    phase        INTEGER NOT NULL,
+    name         TEXT NOT NULL,
+    host_ids     INTEGER[] NOT NULL,
+    status       TEXT NOT NULL DEFAULT 'pending'
+                 CHECK (status IN ('pending', 'running', 'completed', 'halted', 'skipped')),
+    succeeded    INTEGER NOT NULL DEFAULT 0,
+    failed       INTEGER NOT NULL DEFAULT 0,
+    note         TEXT NOT NULL DEFAULT '',
+    started_at   TIMESTAMPTZ,
+    finished_at  TIMESTAMPTZ,
+    PRIMARY KEY (run_group_id, phase)
+);
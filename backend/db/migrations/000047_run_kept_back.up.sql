@@ -0,0 +1,5 @@
+-- Packages an update run's apt-get upgrade reported as kept back, parsed
+-- from its output, so a host stuck behind a held kernel shows up without
+-- reading the log. Empty for runs with nothing kept back and for runs that
+-- predate this column.
+ALTER TABLE update_runs ADD COLUMN IF NOT EXISTS kept_back TEXT[] NOT NULL DEFAULT '{}';
@@ -0,0 +1,41 @@
+-- Put dispatched events on the /api/v1/events feed. Every event fired for
+-- webhooks and email (update_success, host_offline, reboot_required, ...)
+-- is stored in the events table first, so a trigger there reaches the UI
+-- from whichever replica fired it, and an occurrence another replica
+-- already stored (ON CONFLICT DO NOTHING) inserts no row and isn't sent
+-- twice.
+--
+-- Payload schema, extending 000012's:
+--   { "table": "events", "op": "INSERT", "id": <int>, "event": <name>, "host_id": <int|null> }
+-- update_runs notifications gain "host_id" as well, so a run starting on a
+-- host (its INSERT) can be told apart without a fetch. Row contents, the
+-- event payload included, still stay out of the channel.
+
+CREATE OR REPLACE FUNCTION uau_notify_event() RETURNS TRIGGER AS $$
+DECLARE
+    rec     RECORD;
+    payload JSONB;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        rec := OLD;
+    ELSE
+        rec := NEW;
+    END IF;
+
+    payload := jsonb_build_object('table', TG_TABLE_NAME, 'op', TG_OP, 'id', rec.id);
+    -- Fields are resolved when the branch runs, so naming columns that only
+    -- one of the tables has is fine.
+    IF TG_TABLE_NAME = 'update_runs' THEN
+        payload := payload || jsonb_build_object('host_id', rec.host_id);
+    ELSIF TG_TABLE_NAME = 'events' THEN
+        payload := payload || jsonb_build_object('event', rec.event, 'host_id', rec.host_id);
+    END IF;
+
+    PERFORM pg_notify('uau_events', payload::text);
+    RETURN NULL;
+END $$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS events_notify_event ON events;
+CREATE TRIGGER events_notify_event
+    AFTER INSERT ON events
+    FOR EACH ROW EXECUTE FUNCTION uau_notify_event();
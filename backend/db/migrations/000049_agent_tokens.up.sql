@@ -0,0 +1,17 @@
+-- Agent tokens are issued at enrollment, one per enroll, and presented by
+-- the agent on /report and the command endpoints. Only the SHA-256 of the
+-- token is kept. A revoked row stays so the host's token history shows when
+-- and by whom an agent was cut off; rows go with their host on purge.
+CREATE TABLE IF NOT EXISTS agent_tokens (
+    id           SERIAL PRIMARY KEY,
+    host_id      INTEGER NOT NULL REFERENCES hosts(id) ON DELETE CASCADE,
+    token_hash   TEXT NOT NULL UNIQUE,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at   TIMESTAMPTZ NOT NULL,
+    last_used_at TIMESTAMPTZ,
+    created_ip   TEXT NOT NULL DEFAULT '',
+    revoked_at   TIMESTAMPTZ,
+    revoked_by   TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_agent_tokens_host ON agent_tokens (host_id, created_at DESC);
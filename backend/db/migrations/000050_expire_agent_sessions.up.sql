@@ -0,0 +1,5 @@
+-- Agents authenticate with agent tokens (000049), bound to their host's id.
+-- The sessions enroll used to hand out carry only a hostname, so they are
+-- dropped here and the agents holding them enroll again. The auth
+-- middleware refuses any that a session store outside this table still has.
+DELETE FROM sessions WHERE agent_label IS NOT NULL;
@@ -0,0 +1,9 @@
+-- Each enroll fires host_enrolled, which webhooks could not subscribe to
+-- until it joined the list here.
+ALTER TABLE webhooks DROP CONSTRAINT IF EXISTS check_webhook_event_valid;
+ALTER TABLE webhooks ADD CONSTRAINT check_webhook_event_valid
+    CHECK (event IN ('update_success', 'update_failure', 'host_registered',
+                     'host_offline', 'preview_success',
+                     'playbook_success', 'playbook_failure',
+                     'reboot_success', 'reboot_failure',
+                     'reboot_required', 'host_enrolled'));
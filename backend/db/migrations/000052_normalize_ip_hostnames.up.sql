@@ -0,0 +1,54 @@
+-- Hostnames are now stored through ssh.NormalizeHostname, so an IPv6
+-- literal is kept in Go's canonical form ("2001:db8::1", IPv4-mapped
+-- addresses as plain IPv4). A row written before that as "2001:DB8:0::1"
+-- would no longer match the next enroll or report for the same address,
+-- which would create a second host. Rename such rows to the canonical form,
+-- along with the host keys recorded under the old name.
+--
+-- Postgres prints inet the way Go does except for the two embedded-IPv4
+-- forms, which are spelled out by hand below. Only values with a ':' are
+-- touched: IPv4 literals were already canonical, since Go refuses the
+-- leading zeros Postgres would accept.
+--
+-- Where the canonical name already belongs to another host, neither row is
+-- renamed; which host's history to keep is for an operator to decide.
+DO $$
+DECLARE
+    r     RECORD;
+    ip    INET;
+    n     BIGINT;
+    canon TEXT;
+BEGIN
+    FOR r IN SELECT id, hostname FROM hosts WHERE hostname LIKE '%:%' ORDER BY id LOOP
+        BEGIN
+            ip := btrim(r.hostname, '[]')::inet;
+        EXCEPTION WHEN invalid_text_representation THEN
+            CONTINUE;
+        END;
+        IF masklen(ip) <> 128 THEN
+            CONTINUE;
+        END IF;
+
+        IF ip << '::ffff:0:0/96'::inet THEN
+            canon := host('0.0.0.0'::inet + (ip - '::ffff:0.0.0.0'::inet));
+        ELSIF ip << '::/96'::inet AND ip - '::'::inet >= 65536 THEN
+            n := ip - '::'::inet;
+            canon := '::' || to_hex(n >> 16) || ':' || to_hex(n & 65535);
+        ELSE
+            canon := host(ip);
+        END IF;
+
+        CONTINUE WHEN canon = r.hostname;
+        IF EXISTS (SELECT 1 FROM hosts WHERE hostname = canon) THEN
+            RAISE NOTICE 'host % (%) left as is: % is already another host', r.id, r.hostname, canon;
+            CONTINUE;
+        END IF;
+
+        UPDATE hosts SET hostname = canon WHERE id = r.id;
+        INSERT INTO host_keys (hostname, key_line, fingerprint_sha256, created_at)
+            SELECT canon, key_line, fingerprint_sha256, created_at
+            FROM host_keys WHERE hostname = r.hostname
+            ON CONFLICT (hostname, fingerprint_sha256) DO NOTHING;
+        DELETE FROM host_keys WHERE hostname = r.hostname;
+    END LOOP;
+END $$;
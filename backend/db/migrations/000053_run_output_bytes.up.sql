@@ -0,0 +1,26 @@
+-- AppendRunOutput caps a run's output at MaxRunOutputBytes bytes rather
+-- than characters, so apt output in a multibyte locale can't store several
+-- times the cap. Clipping by bytes has to stop at a character boundary,
+-- which uau_utf8_prefix does: it returns the longest prefix of s that is at
+-- most max_bytes bytes of UTF-8.
+CREATE OR REPLACE FUNCTION uau_utf8_prefix(s TEXT, max_bytes INT) RETURNS TEXT AS $$
+DECLARE
+    b BYTEA := convert_to(s, 'UTF8');
+    n INT := greatest(max_bytes, 0);
+BEGIN
+    IF octet_length(b) <= n THEN
+        RETURN s;
+    END IF;
+    -- Byte n (0-based) is the first one cut. While it continues a character
+    -- (10xxxxxx), back the cut up to that character's first byte.
+    WHILE n > 0 AND get_byte(b, n) & 192 = 128 LOOP
+        n := n - 1;
+    END LOOP;
+    RETURN convert_from(substring(b FROM 1 FOR n), 'UTF8');
+END $$ LANGUAGE plpgsql IMMUTABLE STRICT;
+
+-- A clipped output can end a few bytes short of the cap, so its length no
+-- longer says whether it was clipped. The flag does, and stops later writes.
+ALTER TABLE update_runs ADD COLUMN IF NOT EXISTS output_truncated BOOLEAN NOT NULL DEFAULT false;
+UPDATE update_runs SET output_truncated = true
+WHERE status = 'running' AND output LIKE '%' || E'\n[output truncated]\n';
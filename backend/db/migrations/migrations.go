@@ -0,0 +1,12 @@
+// Package migrations embeds the golang-migrate SQL files so the API binary
+// can apply them itself (see db.Migrate) without a migrations directory on
+// disk.
+package migrations
+
+import "embed"
+
+// FS holds every *.sql file in this directory. Only *.up.sql files are
+// applied; down files are kept for the golang-migrate CLI.
+//
+//go:embed *.sql
+var FS embed.FS
@@ -18,6 +18,7 @@ const (
 	ActionLoginSuccess = "login.success"
 	ActionLoginFailure = "login.failure"
 	ActionLogout       = "logout"
+	ActionRefreshReuse = "login.refresh_reuse"
 
 	ActionUserCreate   = "user.create"
 	ActionUserUpdate   = "user.update"
@@ -26,13 +27,25 @@ const (
 	ActionUserDisable  = "user.disable"
 	ActionUserEnable   = "user.enable"
 
-	ActionHostCreate     = "host.create"
-	ActionHostUpdate     = "host.update"
-	ActionHostDelete     = "host.delete"
-	ActionHostBootstrap  = "host.bootstrap"
-	ActionHostKeyRotate  = "host.key_rotate"
-	ActionHostKeyInstall = "host.key_install"
-	ActionHostTestConn   = "host.test_connection"
+	ActionHostCreate      = "host.create"
+	ActionHostImport      = "host.import"
+	ActionHostExport      = "host.export"
+	ActionHostUpdate      = "host.update"
+	ActionHostDelete      = "host.delete"
+	ActionHostArchive     = "host.archive"
+	ActionHostRestore     = "host.restore"
+	ActionHostBootstrap   = "host.bootstrap"
+	ActionHostKeyRotate   = "host.key_rotate"
+	ActionHostKeyInstall  = "host.key_install"
+	ActionHostKeyGenerate = "host.key_generate"
+	ActionHostKeyAdd      = "host.key_add"
+	ActionHostKeyRemove   = "host.key_remove"
+	ActionHostTestConn    = "host.test_connection"
+	ActionHostReboot      = "host.reboot"
+
+	ActionHostSudoPasswordSet    = "host.sudo_password_set"
+	ActionHostSudoPasswordDelete = "host.sudo_password_delete"
+	ActionHostUpdateHooksSet     = "host.update_hooks_set"
 
 	ActionRunPreview      = "run.preview"
 	ActionRunUpdate       = "run.update"
@@ -41,6 +54,7 @@ const (
 	ActionRunPlaybook     = "run.playbook"
 	ActionRunBulkPlaybook = "run.bulk_playbook"
 	ActionRunBulkReboot   = "run.bulk_reboot"
+	ActionRunCancel       = "run.cancel"
 	ActionTokenCreate     = "token.create"
 	ActionTokenDelete     = "token.delete"
 
@@ -48,9 +62,19 @@ const (
 	ActionPlaybookUpdate = "playbook.update"
 	ActionPlaybookDelete = "playbook.delete"
 
-	ActionWebhookCreate = "webhook.create"
-	ActionWebhookDelete = "webhook.delete"
-	ActionAgentEnroll   = "agent.enroll"
+	ActionWebhookCreate     = "webhook.create"
+	ActionWebhookDelete     = "webhook.delete"
+	ActionWebhookReplay     = "webhook.replay"
+	ActionAgentEnroll       = "agent.enroll"
+	ActionAgentTokenRevoke  = "agent.token_revoke"
+	ActionEnrollTokenCreate = "enrollment_token.create"
+	ActionCommandEnqueue    = "command.enqueue"
+
+	ActionKeysReEncrypt = "ssh_keys.reencrypt"
+
+	ActionMaintenanceWindowCreate = "maintenance_window.create"
+	ActionMaintenanceWindowUpdate = "maintenance_window.update"
+	ActionMaintenanceWindowDelete = "maintenance_window.delete"
 )
 
 // Event is what callers hand to Log. Keep it small — JSON details are for
@@ -70,28 +94,60 @@ type Event struct {
 // Log inserts a single audit record. Best-effort — callers should not fail
 // the user-facing operation on audit-write errors, but they should log them.
 func Log(ctx context.Context, db db.DBTX, e Event) error {
+	args, err := insertArgs(e)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(ctx, insertSQL, args...)
+	return err
+}
+
+// Begin inserts e like Log and returns the new row's id, for an action
+// whose outcome is only known once it has run: the row is on record before
+// the action starts, even if the process dies part way, and Finish adds how
+// it ended.
+func Begin(ctx context.Context, db db.DBTX, e Event) (int64, error) {
+	args, err := insertArgs(e)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = db.QueryRow(ctx, insertSQL+` RETURNING id`, args...).Scan(&id)
+	return id, err
+}
+
+// Finish merges details into the details of the row Begin returned id for.
+func Finish(ctx context.Context, db db.DBTX, id int64, details map[string]interface{}) error {
+	b, err := json.Marshal(details)
+	if err != nil {
+		return fmt.Errorf("audit: marshal details: %w", err)
+	}
+	_, err = db.Exec(ctx, `UPDATE audit_log SET details = details || $2::jsonb WHERE id = $1`, id, string(b))
+	return err
+}
+
+const insertSQL = `
+		INSERT INTO audit_log
+		    (actor_user_id, actor_label, action, target_type, target_id,
+		     request_id, ip, user_agent, details)
+		VALUES ($1, NULLIF($2, ''), $3, NULLIF($4, ''), NULLIF($5, ''),
+		        NULLIF($6, ''), NULLIF($7, ''), NULLIF($8, ''), $9::jsonb)`
+
+func insertArgs(e Event) ([]any, error) {
 	if e.Action == "" {
-		return fmt.Errorf("audit: action is required")
+		return nil, fmt.Errorf("audit: action is required")
 	}
 	details := []byte("{}")
 	if len(e.Details) > 0 {
 		b, err := json.Marshal(e.Details)
 		if err != nil {
-			return fmt.Errorf("audit: marshal details: %w", err)
+			return nil, fmt.Errorf("audit: marshal details: %w", err)
 		}
 		details = b
 	}
-	_, err := db.Exec(ctx, `
-		INSERT INTO audit_log
-		    (actor_user_id, actor_label, action, target_type, target_id,
-		     request_id, ip, user_agent, details)
-		VALUES ($1, NULLIF($2, ''), $3, NULLIF($4, ''), NULLIF($5, ''),
-		        NULLIF($6, ''), NULLIF($7, ''), NULLIF($8, ''), $9::jsonb)`,
-		e.ActorUserID, e.ActorLabel, e.Action,
+	return []any{e.ActorUserID, e.ActorLabel, e.Action,
 		e.TargetType, e.TargetID,
-		e.RequestID, e.IP, e.UserAgent, string(details),
-	)
-	return err
+		e.RequestID, e.IP, e.UserAgent, string(details)}, nil
 }
 
 // Record is the row returned by List/queries. JSON details are decoded for
@@ -113,7 +169,9 @@ type Record struct {
 // ListOptions controls pagination and filtering for List.
 type ListOptions struct {
 	Limit      int
+	Offset     int
 	Action     string // exact match if non-empty
+	Actor      string // exact match on actor_label if non-empty
 	TargetType string // exact match if non-empty
 	TargetID   string // exact match if non-empty (and TargetType set)
 }
@@ -133,6 +191,10 @@ func List(ctx context.Context, db db.DBTX, opts ListOptions) ([]Record, error) {
 		args = append(args, opts.Action)
 		where += fmt.Sprintf(" AND action = $%d", len(args))
 	}
+	if opts.Actor != "" {
+		args = append(args, opts.Actor)
+		where += fmt.Sprintf(" AND actor_label = $%d", len(args))
+	}
 	if opts.TargetType != "" {
 		args = append(args, opts.TargetType)
 		where += fmt.Sprintf(" AND target_type = $%d", len(args))
@@ -141,7 +203,11 @@ func List(ctx context.Context, db db.DBTX, opts ListOptions) ([]Record, error) {
 			where += fmt.Sprintf(" AND target_id = $%d", len(args))
 		}
 	}
-	args = append(args, limit)
+	offset := opts.Offset
+	if offset < 0 {
+		offset = 0
+	}
+	args = append(args, limit, offset)
 
 	q := fmt.Sprintf(`
 		SELECT id, occurred_at, actor_user_id, COALESCE(actor_label, ''), action,
@@ -150,8 +216,8 @@ func List(ctx context.Context, db db.DBTX, opts ListOptions) ([]Record, error) {
 		       details
 		FROM audit_log
 		WHERE 1=1%s
-		ORDER BY occurred_at DESC
-		LIMIT $%d`, where, len(args))
+		ORDER BY occurred_at DESC, id DESC
+		LIMIT $%d OFFSET $%d`, where, len(args)-1, len(args))
 
 	rows, err := db.Query(ctx, q, args...)
 	if err != nil {
@@ -9,7 +9,8 @@ import (
 
 func Load() error {
 	v := viper.New()
-	v.SetConfigFile("./config.conf")
+	path := DataPath("config.conf")
+	v.SetConfigFile(path)
 	v.SetConfigType("properties")
 
 	if err := v.ReadInConfig(); err != nil {
@@ -20,7 +21,7 @@ func Load() error {
 			return nil
 		}
 		if os.IsNotExist(err) {
-			log.Warn("Config file ./config.conf not found, using environment variables only")
+			log.Warnf("Config file %s not found, using environment variables only", path)
 			return nil
 		}
 		return err
@@ -30,6 +31,6 @@ func Load() error {
 		os.Setenv(key, v.GetString(key))
 	}
 
-	log.Info("Configuration loaded from ./config.conf")
+	log.Infof("Configuration loaded from %s", path)
 	return nil
 }
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DatabaseConfig holds the Postgres DSN and pgxpool sizing. Zero values mean
+// "not configured": pgx's defaults (or pool_* parameters in the DSN) apply.
+type DatabaseConfig struct {
+	URL             string
+	MaxConns        int32
+	MinConns        int32
+	MaxConnLifetime time.Duration
+	MaxConnIdleTime time.Duration
+
+	// ConnectAttempts is how many times startup pings the database before
+	// giving up; the wait between attempts starts at ConnectRetryInterval
+	// and doubles each time, capped at 30s.
+	ConnectAttempts      int
+	ConnectRetryInterval time.Duration
+}
+
+// LoadDatabaseConfig reads the pool settings from the environment:
+//
+//	DATABASE_URL               required
+//	DB_MAX_CONNS               pgx default: max(4, NumCPU)
+//	DB_MIN_CONNS               pgx default: 0
+//	DB_MAX_CONN_LIFETIME       pgx default: 1h
+//	DB_MAX_CONN_IDLE_TIME      pgx default: 30m
+//	DB_CONNECT_ATTEMPTS        default 10
+//	DB_CONNECT_RETRY_INTERVAL  default 1s
+func LoadDatabaseConfig() DatabaseConfig {
+	attempts := int(envInt32("DB_CONNECT_ATTEMPTS"))
+	if attempts == 0 {
+		attempts = 10
+	}
+	return DatabaseConfig{
+		URL:                  os.Getenv("DATABASE_URL"),
+		MaxConns:             envInt32("DB_MAX_CONNS"),
+		MinConns:             envInt32("DB_MIN_CONNS"),
+		MaxConnLifetime:      envDuration("DB_MAX_CONN_LIFETIME", 0),
+		MaxConnIdleTime:      envDuration("DB_MAX_CONN_IDLE_TIME", 0),
+		ConnectAttempts:      attempts,
+		ConnectRetryInterval: envDuration("DB_CONNECT_RETRY_INTERVAL", time.Second),
+	}
+}
+
+// envInt32 parses a positive integer, returning 0 (unset) for empty or
+// invalid values.
+func envInt32(key string) int32 {
+	v := os.Getenv(key)
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.ParseInt(v, 10, 32)
+	if err != nil || n <= 0 {
+		log.Warnf("%s=%q must be a positive integer; ignoring", key, v)
+		return 0
+	}
+	return int32(n)
+}
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMTP transport security modes.
+const (
+	SMTPTLSStartTLS = "starttls" // plain connect, then STARTTLS (required)
+	SMTPTLSImplicit = "tls"      // TLS from the first byte, usually port 465
+	SMTPTLSNone     = "none"     // no encryption; auth only to localhost
+)
+
+// EmailConfig is the SMTP relay and recipient list for email notifications.
+type EmailConfig struct {
+	Host     string
+	Port     int
+	Username string // empty = no AUTH
+	Password string
+	TLS      string
+	From     string
+	To       []string
+	Timeout  time.Duration
+}
+
+// LoadEmailConfig reads:
+//
+//	SMTP_HOST      relay hostname (required when EMAIL_ENABLED=true)
+//	SMTP_PORT      default 587, or 465 with SMTP_TLS=tls
+//	SMTP_USERNAME  optional; enables AUTH PLAIN
+//	SMTP_PASSWORD
+//	SMTP_TLS       starttls (default), tls or none
+//	SMTP_TIMEOUT   default 30s, covers the whole conversation
+//	EMAIL_FROM     sender address (required)
+//	EMAIL_TO       comma-separated recipients (required)
+func LoadEmailConfig() EmailConfig {
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv("SMTP_TLS")))
+	if mode == "" {
+		mode = SMTPTLSStartTLS
+	}
+	port := 587
+	if mode == SMTPTLSImplicit {
+		port = 465
+	}
+	if v := os.Getenv("SMTP_PORT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			port = n
+		}
+	}
+	var to []string
+	for _, addr := range strings.Split(os.Getenv("EMAIL_TO"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			to = append(to, addr)
+		}
+	}
+	return EmailConfig{
+		Host:     strings.TrimSpace(os.Getenv("SMTP_HOST")),
+		Port:     port,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		TLS:      mode,
+		From:     strings.TrimSpace(os.Getenv("EMAIL_FROM")),
+		To:       to,
+		Timeout:  envDuration("SMTP_TIMEOUT", 30*time.Second),
+	}
+}
+
+// Validate checks the settings email notifications can't work without, so
+// a missing relay fails at startup rather than on the first failed update.
+func (c EmailConfig) Validate() error {
+	if c.Host == "" || c.From == "" || len(c.To) == 0 {
+		return errors.New("EMAIL_ENABLED requires SMTP_HOST, EMAIL_FROM and EMAIL_TO")
+	}
+	if c.Port <= 0 || c.Port > 65535 {
+		return fmt.Errorf("SMTP_PORT %d is out of range", c.Port)
+	}
+	switch c.TLS {
+	case SMTPTLSStartTLS, SMTPTLSImplicit, SMTPTLSNone:
+	default:
+		return fmt.Errorf("SMTP_TLS must be starttls, tls or none, not %q", c.TLS)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"os"
+	"strings"
+)
+
+// FeatureConfig toggles optional background behavior.
+type FeatureConfig struct {
+	// EnableAutoUpdates runs a fleet-wide apt update on AutoUpdateSchedule,
+	// independent of any schedules created through the API.
+	EnableAutoUpdates bool
+	// AutoUpdateSchedule is a five-field cron expression in UTC.
+	AutoUpdateSchedule string
+	// AutoUpdateTag limits the automatic run to hosts carrying this tag;
+	// empty means every host.
+	AutoUpdateTag string
+	// EnableEmail mails update failures and pending reboots to the
+	// recipients in EmailConfig, alongside any webhooks.
+	EnableEmail bool
+}
+
+// LoadFeatureConfig reads:
+//
+//	AUTO_UPDATE_ENABLED   "true" to turn automatic updates on (default off)
+//	AUTO_UPDATE_SCHEDULE  cron expression, UTC; default "0 3 * * *"
+//	AUTO_UPDATE_TAG       only update hosts with this tag
+//	EMAIL_ENABLED         "true" to send email notifications (see LoadEmailConfig)
+func LoadFeatureConfig() FeatureConfig {
+	schedule := strings.TrimSpace(os.Getenv("AUTO_UPDATE_SCHEDULE"))
+	if schedule == "" {
+		schedule = "0 3 * * *"
+	}
+	return FeatureConfig{
+		EnableAutoUpdates:  os.Getenv("AUTO_UPDATE_ENABLED") == "true",
+		AutoUpdateSchedule: schedule,
+		AutoUpdateTag:      strings.TrimSpace(os.Getenv("AUTO_UPDATE_TAG")),
+		EnableEmail:        os.Getenv("EMAIL_ENABLED") == "true",
+	}
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"os"
+	"strings"
+)
+
+// LoggingConfig selects logrus's level, output format and destination.
+type LoggingConfig struct {
+	// Level is a logrus level name: panic, fatal, error, warn, info, debug
+	// or trace.
+	Level string
+	// Format is "text" (logrus's default, readable in a terminal) or "json"
+	// (one object per line, for log shippers).
+	Format string
+
+	// OutputPath, when set, sends logs to this absolute file path, rotated
+	// by size. Empty keeps logging to stderr only.
+	OutputPath string
+	// MaxSize is the size in megabytes at which the file is rotated.
+	MaxSize int
+	// MaxAge (days) and MaxBackups bound how many rotated files are kept.
+	MaxAge     int
+	MaxBackups int
+	// Compress gzips rotated files.
+	Compress bool
+	// TeeStderr also writes to stderr while logging to a file, so
+	// `docker logs` and a dev terminal keep working.
+	TeeStderr bool
+
+	// RequestSampleEvery logs one in this many successful requests;
+	// failures are always logged. 1 logs every request.
+	RequestSampleEvery int
+}
+
+// LoadLoggingConfig reads:
+//
+//	LOG_LEVEL          default info
+//	LOG_FORMAT         text (default) or json
+//	LOG_FILE           log file path, relative to DATA_DIR; unset logs to
+//	                   stderr only
+//	LOG_MAX_SIZE_MB    rotate at this size, default 100
+//	LOG_MAX_AGE_DAYS   delete rotated files older than this, default 30
+//	LOG_MAX_BACKUPS    keep at most this many rotated files, default 7
+//	LOG_COMPRESS       "true" to gzip rotated files
+//	LOG_REQUEST_SAMPLE log one in N 2xx requests, default 1 (all of them)
+//
+// With LOG_FILE set, logs are also teed to stderr unless ENVIRONMENT is
+// "production". Level and format are only normalized here; the caller
+// validates them when applying, so a typo is reported through the logger it
+// configures.
+func LoadLoggingConfig() LoggingConfig {
+	cfg := LoggingConfig{
+		Level:      strings.ToLower(strings.TrimSpace(os.Getenv("LOG_LEVEL"))),
+		Format:     strings.ToLower(strings.TrimSpace(os.Getenv("LOG_FORMAT"))),
+		OutputPath: strings.TrimSpace(os.Getenv("LOG_FILE")),
+		MaxSize:    int(envInt32("LOG_MAX_SIZE_MB")),
+		MaxAge:     int(envInt32("LOG_MAX_AGE_DAYS")),
+		MaxBackups: int(envInt32("LOG_MAX_BACKUPS")),
+		Compress:   os.Getenv("LOG_COMPRESS") == "true",
+		TeeStderr:  os.Getenv("ENVIRONMENT") != "production",
+
+		RequestSampleEvery: int(envInt32("LOG_REQUEST_SAMPLE")),
+	}
+	if cfg.Level == "" {
+		cfg.Level = "info"
+	}
+	if cfg.Format == "" {
+		cfg.Format = "text"
+	}
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = 100
+	}
+	if cfg.MaxAge == 0 {
+		cfg.MaxAge = 30
+	}
+	if cfg.MaxBackups == 0 {
+		cfg.MaxBackups = 7
+	}
+	if cfg.RequestSampleEvery == 0 {
+		cfg.RequestSampleEvery = 1
+	}
+	if cfg.OutputPath != "" {
+		cfg.OutputPath = DataPath(cfg.OutputPath)
+	}
+	return cfg
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DataDir is the directory the server's own files live under: config.conf,
+// the known_hosts file (HOST_KEY_STORE=file) and a relative LOG_FILE. It is
+// DATA_DIR, or the working directory when that is unset, made absolute so
+// nothing depends on the working directory later. Under systemd the working
+// directory is /, so services should set DATA_DIR.
+func DataDir() string {
+	dir := strings.TrimSpace(os.Getenv("DATA_DIR"))
+	if dir == "" {
+		dir = "."
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		// Only possible when the working directory is gone.
+		return filepath.Clean(dir)
+	}
+	return abs
+}
+
+// DataPath resolves path against DataDir. An absolute path is returned
+// unchanged.
+func DataPath(path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(DataDir(), path)
+}
+
+// KnownHostsFile is KNOWN_HOSTS_FILE resolved by DataPath; unset, it is
+// known_hosts in DataDir.
+func KnownHostsFile() string {
+	path := strings.TrimSpace(os.Getenv("KNOWN_HOSTS_FILE"))
+	if path == "" {
+		path = "known_hosts"
+	}
+	return DataPath(path)
+}
+
+// EnsureDataDir creates DataDir, and any missing parents, readable by the
+// server's user only, and returns it. An existing directory is left as is.
+func EnsureDataDir() (string, error) {
+	dir := DataDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return dir, err
+	}
+	return dir, nil
+}
@@ -0,0 +1,20 @@
+package config
+
+import (
+	"os"
+	"strings"
+)
+
+// RedisConfig points the API at a Redis shared by every replica.
+type RedisConfig struct {
+	// URL is a redis:// or rediss:// URL. Empty keeps sessions in Postgres
+	// and rate-limit counters in each process.
+	URL string
+}
+
+// LoadRedisConfig reads:
+//
+//	REDIS_URL  e.g. redis://redis:6379/0; sessions and rate limits move there
+func LoadRedisConfig() RedisConfig {
+	return RedisConfig{URL: strings.TrimSpace(os.Getenv("REDIS_URL"))}
+}
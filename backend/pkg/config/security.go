@@ -0,0 +1,142 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SecurityConfig holds request-level abuse controls.
+type SecurityConfig struct {
+	// EnableRateLimit turns on the per-client-IP limit for the /api/v1
+	// routes. Login and enrollment keep their own tighter limiters either way.
+	EnableRateLimit   bool
+	RateLimitRequests int
+	RateLimitWindow   time.Duration
+
+	// TrustedProxies is the raw comma-separated CIDR list of reverse proxies
+	// whose X-Forwarded-For / X-Real-IP headers are believed.
+	TrustedProxies string
+
+	// MaxRequestBodyBytes bounds every request body; 0 keeps the built-in
+	// default.
+	MaxRequestBodyBytes int64
+
+	// RefreshTokenExpiry is how long a login can be renewed through
+	// POST /api/v1/refresh before the user must sign in again.
+	RefreshTokenExpiry time.Duration
+
+	// EnrollmentTokenTTL is how long a token minted through
+	// POST /api/v1/enrollment-tokens lasts when the request doesn't say.
+	EnrollmentTokenTTL time.Duration
+
+	// PasswordMinLength and RequireStrongPasswords are the password policy
+	// for users created or re-passworded through the API.
+	PasswordMinLength      int
+	RequireStrongPasswords bool
+
+	// RequireConfirmEnv lists the host environments whose update runs must
+	// be confirmed, lowercased.
+	RequireConfirmEnv []string
+
+	// ExecuteMode is what execute-script runs: ExecuteModeFree takes any
+	// script the client sends, ExecuteModeAllowlist only the named scripts
+	// in ExecuteScriptsDir.
+	ExecuteMode string
+	// ExecuteScriptsDir holds the named scripts, one file each.
+	ExecuteScriptsDir string
+}
+
+// Execute modes for EXECUTE_MODE.
+const (
+	ExecuteModeFree      = "free"
+	ExecuteModeAllowlist = "allowlist"
+)
+
+// LoadSecurityConfig reads:
+//
+//	RATE_LIMIT_ENABLED   "true" to enforce the API rate limit (default off)
+//	RATE_LIMIT_REQUESTS  requests allowed per window per client IP, default 300
+//	RATE_LIMIT_WINDOW    default 1m (Go duration or seconds)
+//	TRUSTED_PROXIES      CIDRs/IPs of proxies allowed to set X-Forwarded-For
+//	MAX_REQUEST_BODY_BYTES  request body cap in bytes (default 1 MiB)
+//	REFRESH_TOKEN_EXPIRY lifetime of a login's refresh tokens, default 168h
+//	ENROLLMENT_TOKEN_TTL default lifetime of API-minted enrollment tokens, default 24h
+//	PASSWORD_MIN_LENGTH  minimum user password length, default and floor 12
+//	REQUIRE_STRONG_PASSWORDS "true" to also require lower, upper, digit, symbol
+//	REQUIRE_CONFIRM_ENV  comma-separated environments (e.g. "prod") whose
+//	                     update runs need ?confirm=true or X-Confirm-Environment
+//	EXECUTE_MODE         "free" (default) or "allowlist"; anything else is
+//	                     taken as "allowlist", so a typo doesn't open it up;
+//	                     "allowlist" also refuses agent commands and update hooks
+//	EXECUTE_SCRIPTS_DIR  named scripts for execute-script, default scripts
+//	                     under DATA_DIR
+//
+// The rate limit is off by default because behind a proxy that isn't listed
+// in TRUSTED_PROXIES every client shares the proxy's address and one bucket.
+func LoadSecurityConfig() SecurityConfig {
+	requests := 300
+	if v := os.Getenv("RATE_LIMIT_REQUESTS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			requests = n
+		} else {
+			log.Warnf("RATE_LIMIT_REQUESTS=%q must be a positive integer; using %d", v, requests)
+		}
+	}
+	minPassword := 12
+	if v := os.Getenv("PASSWORD_MIN_LENGTH"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= minPassword {
+			minPassword = n
+		} else {
+			log.Warnf("PASSWORD_MIN_LENGTH=%q must be an integer of at least %d; using %d", v, minPassword, minPassword)
+		}
+	}
+	var maxBody int64
+	if v := os.Getenv("MAX_REQUEST_BODY_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			maxBody = n
+		} else {
+			log.Warnf("MAX_REQUEST_BODY_BYTES=%q must be a positive integer; using the default", v)
+		}
+	}
+	var confirmEnv []string
+	for _, env := range strings.Split(os.Getenv("REQUIRE_CONFIRM_ENV"), ",") {
+		if env = strings.ToLower(strings.TrimSpace(env)); env != "" {
+			confirmEnv = append(confirmEnv, env)
+		}
+	}
+	executeMode := strings.ToLower(strings.TrimSpace(os.Getenv("EXECUTE_MODE")))
+	switch executeMode {
+	case "":
+		executeMode = ExecuteModeFree
+	case ExecuteModeFree, ExecuteModeAllowlist:
+	default:
+		log.Warnf("EXECUTE_MODE=%q must be %q or %q; using %q", executeMode, ExecuteModeFree, ExecuteModeAllowlist, ExecuteModeAllowlist)
+		executeMode = ExecuteModeAllowlist
+	}
+	scriptsDir := strings.TrimSpace(os.Getenv("EXECUTE_SCRIPTS_DIR"))
+	if scriptsDir == "" {
+		scriptsDir = "scripts"
+	}
+	return SecurityConfig{
+		EnableRateLimit:   os.Getenv("RATE_LIMIT_ENABLED") == "true",
+		RateLimitRequests: requests,
+		RateLimitWindow:   envDuration("RATE_LIMIT_WINDOW", time.Minute),
+		TrustedProxies:    os.Getenv("TRUSTED_PROXIES"),
+
+		MaxRequestBodyBytes: maxBody,
+		RefreshTokenExpiry:  envDuration("REFRESH_TOKEN_EXPIRY", 7*24*time.Hour),
+		EnrollmentTokenTTL:  envDuration("ENROLLMENT_TOKEN_TTL", 24*time.Hour),
+
+		PasswordMinLength:      minPassword,
+		RequireStrongPasswords: os.Getenv("REQUIRE_STRONG_PASSWORDS") == "true",
+
+		RequireConfirmEnv: confirmEnv,
+
+		ExecuteMode:       executeMode,
+		ExecuteScriptsDir: DataPath(scriptsDir),
+	}
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ServerConfig holds the HTTP listener tunables. Timeouts bound how long a
+// single client may hold a connection open, so a slow-loris client can't pin
+// server goroutines indefinitely.
+type ServerConfig struct {
+	Port         string
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// WSPingInterval paces the pings that keep SSH run WebSockets alive
+	// through proxies with idle timeouts shorter than a quiet apt upgrade.
+	WSPingInterval time.Duration
+
+	// WSMaxMessageSize caps one message a client sends on a WebSocket (a
+	// script for execute-script), bounding what a connection can make the
+	// server buffer. MaxHeaderBytes does the same for request headers.
+	WSMaxMessageSize int64
+	MaxHeaderBytes   int
+
+	// EnableHTTPS serves TLS directly from the API process. Leave it off when
+	// a reverse proxy terminates TLS, and in local development.
+	EnableHTTPS bool
+	TLSCertFile string
+	TLSKeyFile  string
+}
+
+// LoadServerConfig reads the listener settings from the environment:
+//
+//	API_PORT              default 8080
+//	SERVER_READ_TIMEOUT   default 30s
+//	SERVER_WRITE_TIMEOUT  default 60s
+//	SERVER_IDLE_TIMEOUT   default 120s
+//	WS_PING_INTERVAL      WebSocket keepalive ping interval, default 30s
+//	WS_MAX_MESSAGE_SIZE   largest client WebSocket message in bytes, default 1 MiB
+//	HTTP_MAX_HEADER_BYTES request header limit in bytes, default 1 MiB
+//	ENABLE_HTTPS          "true" to serve TLS (needs TLS_CERT_FILE, TLS_KEY_FILE)
+//
+// Timeouts accept Go duration strings ("45s", "2m") or a bare number of
+// seconds; sizes are a positive number of bytes. Invalid values log a
+// warning and fall back to the default.
+func LoadServerConfig() ServerConfig {
+	port := os.Getenv("API_PORT")
+	if port == "" {
+		port = "8080"
+	}
+	return ServerConfig{
+		Port:         port,
+		ReadTimeout:  envDuration("SERVER_READ_TIMEOUT", 30*time.Second),
+		WriteTimeout: envDuration("SERVER_WRITE_TIMEOUT", 60*time.Second),
+		IdleTimeout:  envDuration("SERVER_IDLE_TIMEOUT", 120*time.Second),
+		EnableHTTPS:  os.Getenv("ENABLE_HTTPS") == "true",
+		TLSCertFile:  os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:   os.Getenv("TLS_KEY_FILE"),
+
+		WSPingInterval:   envDuration("WS_PING_INTERVAL", 30*time.Second),
+		WSMaxMessageSize: envBytes("WS_MAX_MESSAGE_SIZE", 1<<20),
+		MaxHeaderBytes:   int(envBytes("HTTP_MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes)),
+	}
+}
+
+// Validate checks that an HTTPS-enabled config points at readable cert and
+// key files, so a typo fails at startup rather than on the first handshake.
+func (c ServerConfig) Validate() error {
+	if !c.EnableHTTPS {
+		return nil
+	}
+	if c.TLSCertFile == "" || c.TLSKeyFile == "" {
+		return errors.New("ENABLE_HTTPS requires TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	for _, f := range []string{c.TLSCertFile, c.TLSKeyFile} {
+		if _, err := os.Stat(f); err != nil {
+			return fmt.Errorf("TLS file: %w", err)
+		}
+	}
+	return nil
+}
+
+// envDuration parses key as a duration, accepting either a Go duration string
+// or an integer number of seconds. Zero and negative values are rejected:
+// they'd silently disable the timeout, which is never what an operator meant.
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		n, convErr := strconv.Atoi(v)
+		if convErr != nil {
+			log.Warnf("%s=%q is not a valid duration; using %s", key, v, def)
+			return def
+		}
+		d = time.Duration(n) * time.Second
+	}
+	if d <= 0 {
+		log.Warnf("%s=%q must be positive; using %s", key, v, def)
+		return def
+	}
+	return d
+}
+
+// envBytes parses key as a positive byte count, capped at 1 GiB so it fits
+// an int everywhere. Anything else logs a warning and returns def.
+func envBytes(key string, def int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 || n > 1<<30 {
+		log.Warnf("%s=%q must be a positive number of bytes up to 1 GiB; using %d", key, v, def)
+		return def
+	}
+	return n
+}
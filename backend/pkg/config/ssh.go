@@ -0,0 +1,86 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// SSHConfig bounds the backend's outbound SSH sessions.
+type SSHConfig struct {
+	// MaxConcurrent caps SSH sessions across interactive runs, scripts and
+	// bulk fan-outs combined.
+	MaxConcurrent int
+	// BulkMaxConcurrency caps the parallel sessions of one bulk run,
+	// replacing the updater's default ceiling. Zero keeps that default.
+	BulkMaxConcurrency int
+	// BusyTimeout is how long an interactive session waits for a free slot
+	// before the client is told the server is busy. Bulk runs queue instead.
+	BusyTimeout time.Duration
+	// ConnIdleTimeout is how long a finished run's connection is kept open
+	// for the next run on the same host. Zero turns reuse off.
+	ConnIdleTimeout time.Duration
+	// A connection is declared lost after KeepaliveMaxMisses consecutive
+	// keepalives, sent every KeepaliveInterval, go unanswered.
+	KeepaliveInterval  time.Duration
+	KeepaliveMaxMisses int
+	// BastionHost, when set, is the jump host every connection is
+	// tunnelled through, logged in to as BastionUser with the key in
+	// BastionKeyFile. BastionHostKey optionally pins its host key.
+	BastionHost    string
+	BastionUser    string
+	BastionKeyFile string
+	BastionHostKey string
+	// StrictHostKey refuses hosts with no key on file. When false the first
+	// key a host presents is recorded and trusted (TOFU).
+	StrictHostKey bool
+	// DefaultUser is who run-update logs in as on a host with no ssh_user.
+	// Empty means such a run is refused.
+	DefaultUser string
+}
+
+// LoadSSHConfig reads:
+//
+//	MAX_CONCURRENT_SSH        default 50; connections idling for reuse count too
+//	BULK_MAX_CONCURRENCY      default 20; ceiling on one bulk run's parallel
+//	                          sessions. A request asking for more is clamped
+//	                          to it, and its hosts still queue for slots
+//	                          under MAX_CONCURRENT_SSH
+//	SSH_BUSY_TIMEOUT          default 10s
+//	SSH_CONN_IDLE_TIMEOUT     default 60s; "0" disables connection reuse
+//	SSH_KEEPALIVE_INTERVAL    default 30s
+//	SSH_KEEPALIVE_MAX_MISSES  default 3
+//	SSH_BASTION_HOST          unset; host[:port] of a jump host
+//	SSH_BASTION_USER          required with SSH_BASTION_HOST
+//	SSH_BASTION_KEY_FILE      required with SSH_BASTION_HOST
+//	SSH_BASTION_HOST_KEY      optional authorized_keys-format host key
+//	SSH_STRICT_HOST_KEY       default true; "false" trusts a new host's first key
+//	DEFAULT_SSH_USER          unset; user for hosts with no ssh_user
+func LoadSSHConfig() SSHConfig {
+	maxConcurrent := int(envInt32("MAX_CONCURRENT_SSH"))
+	if maxConcurrent == 0 {
+		maxConcurrent = 50
+	}
+	keepaliveMisses := int(envInt32("SSH_KEEPALIVE_MAX_MISSES"))
+	if keepaliveMisses == 0 {
+		keepaliveMisses = 3
+	}
+	idle := time.Duration(0)
+	if os.Getenv("SSH_CONN_IDLE_TIMEOUT") != "0" {
+		idle = envDuration("SSH_CONN_IDLE_TIMEOUT", 60*time.Second)
+	}
+	return SSHConfig{
+		MaxConcurrent:      maxConcurrent,
+		BulkMaxConcurrency: int(envInt32("BULK_MAX_CONCURRENCY")),
+		BusyTimeout:        envDuration("SSH_BUSY_TIMEOUT", 10*time.Second),
+		ConnIdleTimeout:    idle,
+		KeepaliveInterval:  envDuration("SSH_KEEPALIVE_INTERVAL", 30*time.Second),
+		KeepaliveMaxMisses: keepaliveMisses,
+		BastionHost:        os.Getenv("SSH_BASTION_HOST"),
+		BastionUser:        os.Getenv("SSH_BASTION_USER"),
+		BastionKeyFile:     os.Getenv("SSH_BASTION_KEY_FILE"),
+		BastionHostKey:     os.Getenv("SSH_BASTION_HOST_KEY"),
+		StrictHostKey:      os.Getenv("SSH_STRICT_HOST_KEY") != "false",
+		DefaultUser:        strings.TrimSpace(os.Getenv("DEFAULT_SSH_USER")),
+	}
+}
@@ -4,10 +4,13 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"sync"
 )
 
@@ -20,28 +23,108 @@ import (
 //     Default for local dev / docker-volume deployments.
 //  3. encryption.key     — process working-directory fallback for old configs.
 //
-// Once a key is loaded it is cached for the life of the process; rotating
-// the key requires a restart. That trade is fine because rotating means
-// re-encrypting every stored ciphertext — there's no online path today.
+// Retired keys stay readable through ENCRYPTION_PREVIOUS_KEYS (comma-separated
+// hex) and ENCRYPTION_PREVIOUS_KEY_FILES (comma-separated paths). New
+// ciphertext is always written under the current key and tagged with its key
+// ID, so Decrypt knows which key to use; ReEncrypt moves old values across.
+//
+// The keyring is loaded once and cached for the life of the process, so
+// changing keys requires a restart.
 var (
 	keyOnce sync.Once
-	keyVal  []byte
+	keys    keyring
 	keyErr  error
 )
 
+// keyring is the current key plus any retired keys still needed to read
+// values written before a rotation.
+type keyring struct {
+	current  []byte
+	previous [][]byte
+}
+
+// find returns the configured key whose keyID is id.
+func (k keyring) find(id string) ([]byte, bool) {
+	if keyID(k.current) == id {
+		return k.current, true
+	}
+	for _, p := range k.previous {
+		if keyID(p) == id {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// versionPrefix marks ciphertext written with an embedded key ID:
+// "v1:<keyID>:<hex nonce+ciphertext>". Values without it predate key
+// versioning and are tried against every configured key.
+const versionPrefix = "v1:"
+
+// keyID names a key without revealing it: the first 4 bytes of its SHA-256,
+// hex-encoded.
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
 // resetKeyCacheForTest is exposed only inside the package for tests that need
 // to override the cached key between calls. Production code never calls it.
 func resetKeyCacheForTest() {
 	keyOnce = sync.Once{}
-	keyVal = nil
+	keys = keyring{}
 	keyErr = nil
 }
 
-func getEncryptionKey() ([]byte, error) {
+func getKeyring() (keyring, error) {
 	keyOnce.Do(func() {
-		keyVal, keyErr = loadKey()
+		keys, keyErr = loadKeyring()
 	})
-	return keyVal, keyErr
+	return keys, keyErr
+}
+
+func getEncryptionKey() ([]byte, error) {
+	k, err := getKeyring()
+	return k.current, err
+}
+
+func loadKeyring() (keyring, error) {
+	current, err := loadKey()
+	if err != nil {
+		return keyring{}, err
+	}
+	k := keyring{current: current}
+	for _, h := range splitList(os.Getenv("ENCRYPTION_PREVIOUS_KEYS")) {
+		decoded, err := hex.DecodeString(h)
+		if err != nil {
+			return keyring{}, fmt.Errorf("ENCRYPTION_PREVIOUS_KEYS must be hex-encoded: %w", err)
+		}
+		if err := validateKeyLength(decoded); err != nil {
+			return keyring{}, fmt.Errorf("ENCRYPTION_PREVIOUS_KEYS: %w", err)
+		}
+		k.previous = append(k.previous, decoded)
+	}
+	for _, path := range splitList(os.Getenv("ENCRYPTION_PREVIOUS_KEY_FILES")) {
+		key, err := os.ReadFile(path) // #nosec G304 -- path from server env config, not request input
+		if err != nil {
+			return keyring{}, fmt.Errorf("read previous encryption key from %s: %w", path, err)
+		}
+		if err := validateKeyLength(key); err != nil {
+			return keyring{}, fmt.Errorf("previous encryption key %s: %w", path, err)
+		}
+		k.previous = append(k.previous, key)
+	}
+	return k, nil
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
 }
 
 func loadKey() ([]byte, error) {
@@ -83,21 +166,51 @@ func validateKeyLength(key []byte) error {
 	}
 }
 
-// Encrypt encrypts a string using AES-GCM and returns the hex-encoded ciphertext.
-func Encrypt(stringToEncrypt string) (string, error) {
+// RequiredKeySize is the key length Init insists on (AES-256). Encrypt and
+// Decrypt still accept 16/24-byte keys so tests and one-off tools can use
+// them, but the server refuses to start with anything shorter.
+const RequiredKeySize = 32
+
+// selfTestPlaintext is round-tripped by Init. Its content is irrelevant.
+const selfTestPlaintext = "ubuntu-auto-update crypto self-test"
+
+// Init loads the encryption key, checks it is RequiredKeySize bytes, and
+// encrypts+decrypts a sample. Call it once at startup so a missing or weak
+// key fails the boot with a clear message instead of surfacing on the first
+// SSH-key write, or worse, being used to store keys under AES-128.
+func Init() error {
 	key, err := getEncryptionKey()
 	if err != nil {
-		return "", err
+		return fmt.Errorf("load encryption key: %w", err)
+	}
+	if len(key) != RequiredKeySize {
+		return fmt.Errorf("encryption key is %d bytes; %d are required (generate one with `head -c %d /dev/urandom > encryption.key`, or `openssl rand -hex %d` for ENCRYPTION_KEY)",
+			len(key), RequiredKeySize, RequiredKeySize, RequiredKeySize)
+	}
+	enc, err := Encrypt(selfTestPlaintext)
+	if err != nil {
+		return fmt.Errorf("encryption self-test: %w", err)
 	}
-	plaintext := []byte(stringToEncrypt)
+	dec, err := Decrypt(enc)
+	if err != nil {
+		return fmt.Errorf("encryption self-test: %w", err)
+	}
+	if dec != selfTestPlaintext {
+		return errors.New("encryption self-test: round-trip returned different plaintext")
+	}
+	return nil
+}
 
-	block, err := aes.NewCipher(key)
+// Encrypt encrypts a string using AES-GCM under the current key and returns
+// "v1:<keyID>:<hex nonce+ciphertext>".
+func Encrypt(stringToEncrypt string) (string, error) {
+	key, err := getEncryptionKey()
 	if err != nil {
-		return "", fmt.Errorf("failed to create AES cipher: %w", err)
+		return "", err
 	}
-	aesGCM, err := cipher.NewGCM(block)
+	aesGCM, err := newGCM(key)
 	if err != nil {
-		return "", fmt.Errorf("failed to create GCM: %w", err)
+		return "", err
 	}
 
 	nonce := make([]byte, aesGCM.NonceSize())
@@ -105,27 +218,85 @@ func Encrypt(stringToEncrypt string) (string, error) {
 		return "", fmt.Errorf("failed to generate nonce: %w", err)
 	}
 
-	ciphertext := aesGCM.Seal(nonce, nonce, plaintext, nil)
-	return fmt.Sprintf("%x", ciphertext), nil
+	ciphertext := aesGCM.Seal(nonce, nonce, []byte(stringToEncrypt), nil)
+	return fmt.Sprintf("%s%s:%x", versionPrefix, keyID(key), ciphertext), nil
 }
 
-// Decrypt decrypts a hex-encoded AES-GCM ciphertext and returns the plaintext.
+// Decrypt reverses Encrypt. Versioned values are opened with the key their
+// ID names; legacy unversioned hex is tried against the current key and then
+// each previous key, which is safe because GCM rejects the wrong key.
 func Decrypt(encryptedString string) (string, error) {
-	key, err := getEncryptionKey()
+	k, err := getKeyring()
 	if err != nil {
 		return "", err
 	}
-	enc, err := hex.DecodeString(encryptedString)
+
+	if rest, ok := strings.CutPrefix(encryptedString, versionPrefix); ok {
+		id, data, ok := strings.Cut(rest, ":")
+		if !ok {
+			return "", errors.New("malformed versioned ciphertext")
+		}
+		key, found := k.find(id)
+		if !found {
+			return "", fmt.Errorf("ciphertext was written under key %s, which is not configured (add it to ENCRYPTION_PREVIOUS_KEYS)", id)
+		}
+		return decryptWith(key, data)
+	}
+
+	plaintext, err := decryptWith(k.current, encryptedString)
+	if err == nil {
+		return plaintext, nil
+	}
+	for _, prev := range k.previous {
+		if p, prevErr := decryptWith(prev, encryptedString); prevErr == nil {
+			return p, nil
+		}
+	}
+	return "", err
+}
+
+// ReEncrypt re-wraps a stored value under the current key. It returns the
+// input unchanged and false when the value already uses the current key, so
+// a migration can skip the write.
+func ReEncrypt(encryptedString string) (string, bool, error) {
+	key, err := getEncryptionKey()
 	if err != nil {
-		return "", fmt.Errorf("failed to decode hex ciphertext: %w", err)
+		return "", false, err
+	}
+	if strings.HasPrefix(encryptedString, versionPrefix+keyID(key)+":") {
+		return encryptedString, false, nil
 	}
+	plaintext, err := Decrypt(encryptedString)
+	if err != nil {
+		return "", false, err
+	}
+	out, err := Encrypt(plaintext)
+	if err != nil {
+		return "", false, err
+	}
+	return out, true, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return "", fmt.Errorf("failed to create AES cipher: %w", err)
+		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
 	}
 	aesGCM, err := cipher.NewGCM(block)
 	if err != nil {
-		return "", fmt.Errorf("failed to create GCM: %w", err)
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return aesGCM, nil
+}
+
+func decryptWith(key []byte, hexCiphertext string) (string, error) {
+	enc, err := hex.DecodeString(hexCiphertext)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode hex ciphertext: %w", err)
+	}
+	aesGCM, err := newGCM(key)
+	if err != nil {
+		return "", err
 	}
 	nonceSize := aesGCM.NonceSize()
 	if len(enc) < nonceSize {
@@ -3,6 +3,7 @@ package crypto
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -156,3 +157,121 @@ func TestEncrypt_RandomNonce(t *testing.T) {
 		t.Error("same plaintext should produce different ciphertexts")
 	}
 }
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     []byte // nil means no key file at all
+		wantErr string
+	}{
+		{"missing", nil, "load encryption key"},
+		{"short", []byte("0123456789abcdef"), "16 bytes; 32 are required"},
+		{"valid", []byte("0123456789abcdef0123456789abcdef"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kf := filepath.Join(t.TempDir(), "encryption.key")
+			if tt.key != nil {
+				if err := os.WriteFile(kf, tt.key, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Setenv("ENCRYPTION_KEY", "")
+			t.Setenv("ENCRYPTION_KEY_FILE", kf)
+			resetKeyCacheForTest()
+			defer resetKeyCacheForTest()
+
+			err := Init()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Init: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Init error = %v, want it to mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// useKeys installs current as ENCRYPTION_KEY and previous as
+// ENCRYPTION_PREVIOUS_KEYS, all hex-encoded, and resets the cache.
+func useKeys(t *testing.T, current string, previous ...string) {
+	t.Helper()
+	t.Setenv("ENCRYPTION_KEY", current)
+	t.Setenv("ENCRYPTION_PREVIOUS_KEYS", strings.Join(previous, ","))
+	resetKeyCacheForTest()
+	t.Cleanup(resetKeyCacheForTest)
+}
+
+const (
+	oldHexKey = "1111111111111111111111111111111111111111111111111111111111111111"
+	newHexKey = "2222222222222222222222222222222222222222222222222222222222222222"
+)
+
+func TestDecrypt_AfterRotation(t *testing.T) {
+	useKeys(t, oldHexKey)
+	enc, err := Encrypt("written before rotation")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	useKeys(t, newHexKey, oldHexKey)
+	dec, err := Decrypt(enc)
+	if err != nil {
+		t.Fatalf("Decrypt after rotation: %v", err)
+	}
+	if dec != "written before rotation" {
+		t.Errorf("got %q", dec)
+	}
+
+	// Dropping the old key from the ring makes the value unreadable, with
+	// an error that says which key is missing.
+	useKeys(t, newHexKey)
+	if _, err := Decrypt(enc); err == nil || !strings.Contains(err.Error(), "not configured") {
+		t.Errorf("expected missing-key error, got %v", err)
+	}
+}
+
+func TestDecrypt_LegacyUnversionedUnderPreviousKey(t *testing.T) {
+	useKeys(t, oldHexKey)
+	enc, err := Encrypt("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Strip the version tag to get the pre-versioning on-disk format.
+	legacy := enc[strings.LastIndex(enc, ":")+1:]
+
+	useKeys(t, newHexKey, oldHexKey)
+	dec, err := Decrypt(legacy)
+	if err != nil {
+		t.Fatalf("Decrypt legacy value: %v", err)
+	}
+	if dec != "legacy" {
+		t.Errorf("got %q", dec)
+	}
+}
+
+func TestReEncrypt(t *testing.T) {
+	useKeys(t, oldHexKey)
+	enc, _ := Encrypt("rewrap me")
+
+	useKeys(t, newHexKey, oldHexKey)
+	rewrapped, changed, err := ReEncrypt(enc)
+	if err != nil {
+		t.Fatalf("ReEncrypt: %v", err)
+	}
+	if !changed || rewrapped == enc {
+		t.Fatal("expected value to be rewritten under the new key")
+	}
+
+	// Once rewrapped, the old key is no longer needed.
+	useKeys(t, newHexKey)
+	if dec, err := Decrypt(rewrapped); err != nil || dec != "rewrap me" {
+		t.Fatalf("Decrypt rewrapped = %q, %v", dec, err)
+	}
+	if again, changed, err := ReEncrypt(rewrapped); err != nil || changed || again != rewrapped {
+		t.Errorf("second ReEncrypt should be a no-op, got changed=%v err=%v", changed, err)
+	}
+}
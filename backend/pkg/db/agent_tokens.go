@@ -0,0 +1,124 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+// AgentTokenPrefix marks a token issued at enrollment, so the auth
+// middleware can tell it from session and API tokens without a lookup.
+const AgentTokenPrefix = "uag_"
+
+const agentTokenColumns = `id, host_id, created_at, expires_at, last_used_at, created_ip, revoked_at, revoked_by`
+
+func hashAgentToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAgentToken issues a token for hostID that is valid for ttl. The
+// raw token is returned alongside the row and is not recoverable later.
+func CreateAgentToken(ctx context.Context, db DBTX, hostID int32, ttl time.Duration, ip string) (models.AgentToken, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return models.AgentToken{}, "", err
+	}
+	raw := AgentTokenPrefix + hex.EncodeToString(buf)
+	rows, err := db.Query(ctx, `
+		INSERT INTO agent_tokens (host_id, token_hash, expires_at, created_ip)
+		VALUES ($1, $2, $3, $4)
+		RETURNING `+agentTokenColumns,
+		hostID, hashAgentToken(raw), time.Now().Add(ttl), ip)
+	if err != nil {
+		return models.AgentToken{}, "", fmt.Errorf("create agent token: %w", err)
+	}
+	t, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[models.AgentToken])
+	if err != nil {
+		return models.AgentToken{}, "", err
+	}
+	return t, raw, nil
+}
+
+// ListAgentTokens returns every token issued to hostID, newest first,
+// revoked and expired ones included.
+func ListAgentTokens(ctx context.Context, db DBTX, hostID int32) ([]models.AgentToken, error) {
+	rows, err := db.Query(ctx, `
+		SELECT `+agentTokenColumns+`
+		FROM agent_tokens
+		WHERE host_id = $1
+		ORDER BY created_at DESC, id DESC
+	`, hostID)
+	if err != nil {
+		return nil, err
+	}
+	toks, err := pgx.CollectRows(rows, pgx.RowToStructByName[models.AgentToken])
+	if err != nil {
+		return nil, err
+	}
+	if toks == nil {
+		toks = []models.AgentToken{}
+	}
+	return toks, nil
+}
+
+// RevokeAgentToken revokes one of hostID's tokens on behalf of by. It
+// returns pgx.ErrNoRows when the host has no such token or it is already
+// revoked. The next request made with the token is refused.
+func RevokeAgentToken(ctx context.Context, db DBTX, hostID, tokenID int32, by string) (models.AgentToken, error) {
+	rows, err := db.Query(ctx, `
+		UPDATE agent_tokens SET revoked_at = NOW(), revoked_by = $3
+		WHERE id = $1 AND host_id = $2 AND revoked_at IS NULL
+		RETURNING `+agentTokenColumns,
+		tokenID, hostID, by)
+	if err != nil {
+		return models.AgentToken{}, fmt.Errorf("revoke agent token: %w", err)
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[models.AgentToken])
+}
+
+// ValidateAgentToken resolves a presented agent token to the host it was
+// issued to, returning ok=false for an unknown, expired or revoked token and
+// for a token whose host is archived. It bumps last_used_at in the same
+// statement, so the check costs one round trip and the token list shows
+// when each agent last called in.
+func ValidateAgentToken(ctx context.Context, db DBTX, raw string) (hostID int32, hostname string, ok bool, err error) {
+	if !strings.HasPrefix(raw, AgentTokenPrefix) {
+		return 0, "", false, nil
+	}
+	err = db.QueryRow(ctx, `
+		UPDATE agent_tokens t SET last_used_at = NOW()
+		FROM hosts h
+		WHERE t.token_hash = $1 AND t.revoked_at IS NULL AND t.expires_at > NOW()
+		  AND h.id = t.host_id AND h.deleted_at IS NULL
+		RETURNING h.id, h.hostname
+	`, hashAgentToken(raw)).Scan(&hostID, &hostname)
+	if err == pgx.ErrNoRows {
+		return 0, "", false, nil
+	}
+	if err != nil {
+		return 0, "", false, err
+	}
+	return hostID, hostname, true, nil
+}
+
+// HostHasAgentTokens reports whether the host named hostname holds a live
+// agent token or has had one revoked. Either way it is not re-enrolled with
+// a reusable enrollment token.
+func HostHasAgentTokens(ctx context.Context, db DBTX, hostname string) (bool, error) {
+	var held bool
+	err := db.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM agent_tokens t JOIN hosts h ON h.id = t.host_id
+			WHERE h.hostname = $1 AND (t.revoked_at IS NOT NULL OR t.expires_at > NOW())
+		)
+	`, hostname).Scan(&held)
+	return held, err
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/jackc/pgx/v5"
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+const commandColumns = `id, host_id, command, status, enqueued_by, created_at, dispatched_at, completed_at, exit_code, output`
+
+// MaxDequeuedCommands caps how many commands one agent poll takes.
+const MaxDequeuedCommands = 20
+
+// EnqueueCommand queues command for hostID's agent.
+func EnqueueCommand(ctx context.Context, db DBTX, hostID int32, command, enqueuedBy string) (models.QueuedCommand, error) {
+	rows, err := db.Query(ctx, `
+		INSERT INTO command_queue (host_id, command, enqueued_by)
+		VALUES ($1, $2, $3)
+		RETURNING `+commandColumns,
+		hostID, command, enqueuedBy)
+	if err != nil {
+		return models.QueuedCommand{}, fmt.Errorf("enqueue command: %w", err)
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[models.QueuedCommand])
+}
+
+// DequeueCommands hands hostID's oldest queued commands to its agent, at
+// most limit of them (<= 0 or above MaxDequeuedCommands means the cap), and
+// marks them dispatched in the same statement. SKIP LOCKED keeps two
+// overlapping polls from both taking a command.
+func DequeueCommands(ctx context.Context, db DBTX, hostID int32, limit int) ([]models.QueuedCommand, error) {
+	if limit <= 0 || limit > MaxDequeuedCommands {
+		limit = MaxDequeuedCommands
+	}
+	rows, err := db.Query(ctx, `
+		UPDATE command_queue
+		SET status = 'dispatched', dispatched_at = NOW()
+		WHERE id IN (
+			SELECT id FROM command_queue
+			WHERE host_id = $1 AND status = 'queued'
+			ORDER BY id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+commandColumns,
+		hostID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("dequeue commands: %w", err)
+	}
+	cmds, err := pgx.CollectRows(rows, pgx.RowToStructByName[models.QueuedCommand])
+	if err != nil {
+		return nil, err
+	}
+	// RETURNING comes back in update order, not id order.
+	slices.SortFunc(cmds, func(a, b models.QueuedCommand) int { return cmp.Compare(a.ID, b.ID) })
+	if cmds == nil {
+		cmds = []models.QueuedCommand{}
+	}
+	return cmds, nil
+}
+
+// CompleteCommand records the agent's result for a dispatched command.
+// Output is clipped like host output. It returns false if hostID has no
+// dispatched command with that id, including one already completed.
+func CompleteCommand(ctx context.Context, db DBTX, hostID, id, exitCode int32, output string) (bool, error) {
+	output, _ = TruncateOutput(output, MaxRunOutputBytes)
+	tag, err := db.Exec(ctx, `
+		UPDATE command_queue
+		SET status = 'completed', completed_at = NOW(), exit_code = $3, output = $4
+		WHERE id = $1 AND host_id = $2 AND status = 'dispatched'
+	`, id, hostID, exitCode, output)
+	if err != nil {
+		return false, fmt.Errorf("complete command: %w", err)
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// ListCommands returns hostID's queue newest-first, at most MaxRunsPerPage.
+func ListCommands(ctx context.Context, db DBTX, hostID int32) ([]models.QueuedCommand, error) {
+	rows, err := db.Query(ctx, `
+		SELECT `+commandColumns+`
+		FROM command_queue
+		WHERE host_id = $1
+		ORDER BY id DESC
+		LIMIT $2
+	`, hostID, MaxRunsPerPage)
+	if err != nil {
+		return nil, err
+	}
+	cmds, err := pgx.CollectRows(rows, pgx.RowToStructByName[models.QueuedCommand])
+	if err != nil {
+		return nil, err
+	}
+	if cmds == nil {
+		cmds = []models.QueuedCommand{}
+	}
+	return cmds, nil
+}
@@ -0,0 +1,110 @@
+package db_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock/v4"
+	"ubuntu-auto-update/backend/pkg/db"
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+var commandCols = []string{"id", "host_id", "command", "status", "enqueued_by", "created_at", "dispatched_at", "completed_at", "exit_code", "output"}
+
+func TestEnqueueCommand(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer mock.Close()
+
+	now := time.Now()
+	mock.ExpectQuery(`INSERT INTO command_queue`).
+		WithArgs(int32(3), "uptime", "alice").
+		WillReturnRows(mock.NewRows(commandCols).
+			AddRow(int32(1), int32(3), "uptime", models.CommandStatusQueued, "alice", now, nil, nil, nil, ""))
+
+	cmd, err := db.EnqueueCommand(context.Background(), mock, 3, "uptime", "alice")
+	if err != nil {
+		t.Fatalf("EnqueueCommand: %v", err)
+	}
+	if cmd.ID != 1 || cmd.Status != models.CommandStatusQueued {
+		t.Errorf("got %+v", cmd)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestDequeueCommands(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer mock.Close()
+
+	now := time.Now()
+	mock.ExpectQuery(`UPDATE command_queue\s+SET status = 'dispatched'.*FOR UPDATE SKIP LOCKED`).
+		WithArgs(int32(3), db.MaxDequeuedCommands).
+		WillReturnRows(mock.NewRows(commandCols).
+			AddRow(int32(5), int32(3), "df -h", models.CommandStatusDispatched, "alice", now, &now, nil, nil, "").
+			AddRow(int32(4), int32(3), "uptime", models.CommandStatusDispatched, "alice", now, &now, nil, nil, ""))
+
+	cmds, err := db.DequeueCommands(context.Background(), mock, 3, 0)
+	if err != nil {
+		t.Fatalf("DequeueCommands: %v", err)
+	}
+	if len(cmds) != 2 || cmds[0].ID != 4 || cmds[1].ID != 5 {
+		t.Errorf("want ids [4 5] in queue order, got %+v", cmds)
+	}
+
+	// Nothing queued: an empty slice, not nil, so it encodes as [].
+	mock.ExpectQuery(`UPDATE command_queue`).
+		WithArgs(int32(3), 1).
+		WillReturnRows(mock.NewRows(commandCols))
+	cmds, err = db.DequeueCommands(context.Background(), mock, 3, 1)
+	if err != nil || cmds == nil || len(cmds) != 0 {
+		t.Errorf("empty queue: got %v, %v", cmds, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// maxLen matches a string argument no longer than itself.
+type maxLen int
+
+func (m maxLen) Match(v interface{}) bool {
+	s, ok := v.(string)
+	return ok && len(s) <= int(m)
+}
+
+func TestCompleteCommand(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer mock.Close()
+
+	mock.ExpectExec(`UPDATE command_queue\s+SET status = 'completed'.*status = 'dispatched'`).
+		WithArgs(int32(4), int32(3), int32(0), "ok\n").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	done, err := db.CompleteCommand(context.Background(), mock, 3, 4, 0, "ok\n")
+	if err != nil || !done {
+		t.Fatalf("CompleteCommand = %v, %v; want true", done, err)
+	}
+
+	// Oversized output is clipped before it reaches the DB.
+	mock.ExpectExec(`UPDATE command_queue`).
+		WithArgs(int32(4), int32(3), int32(1), maxLen(db.MaxRunOutputBytes)).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 0))
+	done, err = db.CompleteCommand(context.Background(), mock, 3, 4, 1, strings.Repeat("x", db.MaxRunOutputBytes+10))
+	if err != nil || done {
+		t.Fatalf("already completed: got %v, %v; want false", done, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
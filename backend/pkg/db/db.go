@@ -5,11 +5,15 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
+	log "github.com/sirupsen/logrus"
+	"ubuntu-auto-update/backend/pkg/config"
 	"ubuntu-auto-update/backend/pkg/crypto"
 	"ubuntu-auto-update/backend/pkg/models"
 )
@@ -27,71 +31,294 @@ type DBTX interface {
 	Ping(ctx context.Context) error
 }
 
-const hostColumns = `id, hostname, ssh_user, created_at, updated_at, last_seen, update_output, upgrade_output, error, tags, reboot_required, packages_updated, packages_available, os_version, kernel_version, agent_version, offline_since`
+const hostColumns = `id, hostname, ssh_user, created_at, updated_at, last_seen, update_output, upgrade_output, error, tags, reboot_required, packages_updated, packages_available, os_version, kernel_version, agent_version, architecture, offline_since, update_output_truncated, upgrade_output_truncated, update_policy, deleted_at, environment`
 
-func NewConnection(ctx context.Context) (*pgxpool.Pool, error) {
-	dbUrl := os.Getenv("DATABASE_URL")
-	if dbUrl == "" {
+// PoolConfig parses cfg.URL and overlays the configured pool sizing. Unset
+// (zero) fields keep whatever pgx derived from the DSN.
+func PoolConfig(cfg config.DatabaseConfig) (*pgxpool.Config, error) {
+	if cfg.URL == "" {
 		return nil, fmt.Errorf("DATABASE_URL environment variable not set")
 	}
-	pool, err := pgxpool.New(ctx, dbUrl)
+	pc, err := pgxpool.ParseConfig(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parse DATABASE_URL: %w", err)
+	}
+	if cfg.MaxConns > 0 {
+		pc.MaxConns = cfg.MaxConns
+	}
+	if cfg.MinConns > 0 {
+		pc.MinConns = cfg.MinConns
+	}
+	if pc.MinConns > pc.MaxConns {
+		return nil, fmt.Errorf("DB_MIN_CONNS (%d) exceeds DB_MAX_CONNS (%d)", pc.MinConns, pc.MaxConns)
+	}
+	if cfg.MaxConnLifetime > 0 {
+		pc.MaxConnLifetime = cfg.MaxConnLifetime
+	}
+	if cfg.MaxConnIdleTime > 0 {
+		pc.MaxConnIdleTime = cfg.MaxConnIdleTime
+	}
+	return pc, nil
+}
+
+// maxConnectBackoff caps the doubling wait between startup ping attempts.
+const maxConnectBackoff = 30 * time.Second
+
+// NewConnection builds the pool and waits for the database to answer a
+// ping. pgxpool connects lazily, so without the ping a database that is
+// still starting (compose brings both up together) would only surface as a
+// failure in the first migration. It tries cfg.ConnectAttempts times, at
+// least once, backing off from cfg.ConnectRetryInterval.
+func NewConnection(ctx context.Context, cfg config.DatabaseConfig) (*pgxpool.Pool, error) {
+	pc, err := PoolConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := pgxpool.NewWithConfig(ctx, pc)
 	if err != nil {
 		return nil, fmt.Errorf("unable to connect to database: %w", err)
 	}
-	return pool, nil
+
+	attempts := max(cfg.ConnectAttempts, 1)
+	wait := cfg.ConnectRetryInterval
+	if wait <= 0 {
+		wait = time.Second
+	}
+	for attempt := 1; ; attempt++ {
+		pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		err = pool.Ping(pingCtx)
+		cancel()
+		if err == nil {
+			return pool, nil
+		}
+		if attempt == attempts {
+			break
+		}
+		log.Warnf("Database not reachable (attempt %d/%d): %v; retrying in %s", attempt, attempts, err, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			pool.Close()
+			return nil, ctx.Err()
+		}
+		wait = min(wait*2, maxConnectBackoff)
+	}
+	pool.Close()
+	return nil, fmt.Errorf("unable to connect to database after %d attempts: %w", attempts, err)
+}
+
+// DefaultMaxHostOutputBytes caps update_output/upgrade_output on the hosts
+// row when ReportData.MaxOutputBytes is unset; apt logs can run to megabytes
+// and every host listing reads them.
+const DefaultMaxHostOutputBytes = 1 << 20 // 1 MiB
+
+// DefaultHostOutputCompressBytes is the size from which UpsertHost stores
+// update_output/upgrade_output gzip-compressed when
+// ReportData.CompressOutputBytes is unset. Smaller output is stored raw,
+// where compression saves little; reads handle either form regardless.
+const DefaultHostOutputCompressBytes = 4 << 10 // 4 KiB
+
+// HostOutputTruncatedMarker starts output that TruncateOutput clipped.
+const HostOutputTruncatedMarker = "...[truncated]\n"
+
+// TruncateOutput returns s unchanged if it fits in max bytes. Otherwise it
+// keeps the tail, where apt prints its summary and errors, behind
+// HostOutputTruncatedMarker, and reports true. The cut never splits a UTF-8
+// sequence, so the result may be a few bytes under max.
+func TruncateOutput(s string, max int) (string, bool) {
+	if max <= 0 || len(s) <= max {
+		return s, false
+	}
+	keep := max - len(HostOutputTruncatedMarker)
+	if keep < 0 {
+		keep = 0
+	}
+	tail := s[len(s)-keep:]
+	for len(tail) > 0 && !utf8.RuneStart(tail[0]) {
+		tail = tail[1:]
+	}
+	return HostOutputTruncatedMarker + tail, true
+}
+
+// pgText makes s storable in a text column, which rejects NUL bytes and
+// invalid UTF-8: command output can carry both, and a split rune at a cap
+// is the latter. Both are dropped.
+func pgText(s string) string {
+	return strings.ToValidUTF8(strings.ReplaceAll(s, "\x00", ""), "")
 }
 
 // ReportData carries the persistable fields of an agent report into UpsertHost.
 type ReportData struct {
-	UpdateOutput      string
-	UpgradeOutput     string
-	Error             string
-	RebootRequired    bool
-	PackagesUpdated   int
-	PackagesAvailable int
-	OsVersion         string
-	KernelVersion     string
-	AgentVersion      string
+	UpdateOutput  string
+	UpgradeOutput string
+	// The *Truncated flags mark output that was already clipped before it
+	// got here (e.g. a stored value written back), so the flag survives.
+	UpdateOutputTruncated  bool
+	UpgradeOutputTruncated bool
+	Error                  string
+	RebootRequired         bool
+	PackagesUpdated        int
+	PackagesAvailable      int
+	OsVersion              string
+	KernelVersion          string
+	AgentVersion           string
+	Architecture           string
+	// IfUpdatedAt, when set, makes the write a compare-and-set: an existing
+	// row is only updated if its updated_at still equals this value, and
+	// UpsertHost returns ErrHostChanged otherwise. Callers that write back
+	// fields they read earlier set it to the updated_at they read; agent
+	// reports, which carry the host's current state, leave it zero.
+	IfUpdatedAt time.Time
+	// MaxOutputBytes caps each of the outputs as stored; longer output keeps
+	// its tail. 0 means DefaultMaxHostOutputBytes.
+	MaxOutputBytes int
+	// CompressOutputBytes is the size from which an output is stored
+	// gzipped. 0 means DefaultHostOutputCompressBytes; a negative value
+	// stores everything raw.
+	CompressOutputBytes int
 }
 
+// ErrHostChanged is returned by UpsertHost when ReportData.IfUpdatedAt no
+// longer matches the row: someone else wrote the host since the caller read
+// it. Re-read the host and retry.
+var ErrHostChanged = errors.New("host was modified concurrently")
+
 // UpsertHost records an agent report. On INSERT it seeds ssh_user; on CONFLICT
 // it deliberately does NOT touch ssh_user — a report used to clobber it back to
 // "root", breaking SSH for hosts enrolled as a non-root user. sshUser is only
 // consulted for the initial insert.
 func UpsertHost(ctx context.Context, db DBTX, hostname, sshUser string, r ReportData) (models.Host, error) {
+	return upsertHost(ctx, db, hostname, sshUser, r)
+}
+
+// querier is the part of DBTX UpsertHost needs, which a pgx.Tx (lacking
+// Ping) also satisfies, so UpsertHosts can run it inside a savepoint.
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+func upsertHost(ctx context.Context, db querier, hostname, sshUser string, r ReportData) (models.Host, error) {
 	var hostError sql.NullString
 	if r.Error != "" {
 		hostError = sql.NullString{String: r.Error, Valid: true}
 	}
 
+	maxOut := r.MaxOutputBytes
+	if maxOut <= 0 {
+		maxOut = DefaultMaxHostOutputBytes
+	}
+	compressFrom := r.CompressOutputBytes
+	if compressFrom == 0 {
+		compressFrom = DefaultHostOutputCompressBytes
+	}
+	updateOut, updateClipped := TruncateOutput(r.UpdateOutput, maxOut)
+	upgradeOut, upgradeClipped := TruncateOutput(r.UpgradeOutput, maxOut)
+	var ifUpdatedAt interface{}
+	if !r.IfUpdatedAt.IsZero() {
+		ifUpdatedAt = r.IfUpdatedAt
+	}
+
+	// System-info fields are optional on the wire: older agents omit some of
+	// them, and an empty value keeps what an earlier report stored rather
+	// than blanking it. Outputs work the same way (with their truncated
+	// flags), so an error-only report leaves the last good output visible.
+	// error is the exception: it is the host's current state, and a report
+	// without one means the problem is gone.
 	rows, err := db.Query(ctx, `
 		INSERT INTO hosts (hostname, ssh_user, last_seen, update_output, upgrade_output, error,
 		                   reboot_required, packages_updated, packages_available,
-		                   os_version, kernel_version, agent_version)
-		VALUES ($1, $2, NOW(), $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		                   os_version, kernel_version, agent_version, architecture,
+		                   update_output_truncated, upgrade_output_truncated)
+		VALUES ($1, $2, NOW(), $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
 		ON CONFLICT (hostname) DO UPDATE
 		SET last_seen = NOW(),
-		    update_output = $3,
-		    upgrade_output = $4,
+		    update_output = COALESCE(NULLIF($3, ''), hosts.update_output),
+		    upgrade_output = COALESCE(NULLIF($4, ''), hosts.upgrade_output),
+		    update_output_truncated = CASE WHEN $3 = '' THEN hosts.update_output_truncated ELSE $13 END,
+		    upgrade_output_truncated = CASE WHEN $4 = '' THEN hosts.upgrade_output_truncated ELSE $14 END,
 		    error = $5,
 		    reboot_required = $6,
 		    packages_updated = $7,
 		    packages_available = $8,
-		    os_version = $9,
-		    kernel_version = $10,
-		    agent_version = $11
+		    os_version = COALESCE(NULLIF($9, ''), hosts.os_version),
+		    kernel_version = COALESCE(NULLIF($10, ''), hosts.kernel_version),
+		    agent_version = COALESCE(NULLIF($11, ''), hosts.agent_version),
+		    architecture = COALESCE(NULLIF($12, ''), hosts.architecture)
+		WHERE $15::timestamptz IS NULL OR hosts.updated_at = $15
 		RETURNING `+hostColumns,
-		hostname, sshUser, r.UpdateOutput, r.UpgradeOutput, hostError,
+		hostname, sshUser,
+		models.EncodeOutput(updateOut, compressFrom),
+		models.EncodeOutput(upgradeOut, compressFrom),
+		hostError,
 		r.RebootRequired, r.PackagesUpdated, r.PackagesAvailable,
-		r.OsVersion, r.KernelVersion, r.AgentVersion)
+		r.OsVersion, r.KernelVersion, r.AgentVersion, r.Architecture,
+		updateClipped || r.UpdateOutputTruncated, upgradeClipped || r.UpgradeOutputTruncated,
+		ifUpdatedAt)
 	if err != nil {
 		return models.Host{}, err
 	}
-	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[models.Host])
+	host, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[models.Host])
+	if errors.Is(err, pgx.ErrNoRows) {
+		// The conflict WHERE rejected the update, so nothing was returned.
+		return models.Host{}, ErrHostChanged
+	}
+	return host, err
+}
+
+// HostReportData is one host's report in an UpsertHosts batch.
+type HostReportData struct {
+	Hostname string
+	Report   ReportData
 }
 
-func ListHosts(ctx context.Context, db DBTX) ([]models.Host, error) {
-	rows, err := db.Query(ctx, `SELECT `+hostColumns+` FROM hosts ORDER BY hostname`)
+// UpsertResult is one batch entry's outcome: the upserted host, or the
+// error that kept it out.
+type UpsertResult struct {
+	Host models.Host
+	Err  error
+}
+
+// UpsertHosts is UpsertHost for many reports in one transaction. Each report
+// runs under its own savepoint, so a failing one is rolled back alone and
+// the rest still commit. Results are in input order. The returned error is
+// for the transaction itself (begin or commit); when it is set nothing was
+// written, whatever the results say.
+func UpsertHosts(ctx context.Context, db DBTX, sshUser string, reports []HostReportData) ([]UpsertResult, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	results := make([]UpsertResult, len(reports))
+	for i, rep := range reports {
+		results[i].Err = func() error {
+			sp, err := tx.Begin(ctx) // a savepoint inside tx
+			if err != nil {
+				return err
+			}
+			defer func() { _ = sp.Rollback(ctx) }()
+			host, err := upsertHost(ctx, sp, rep.Hostname, sshUser, rep.Report)
+			if err != nil {
+				return err
+			}
+			if err := sp.Commit(ctx); err != nil {
+				return err
+			}
+			results[i].Host = host
+			return nil
+		}()
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+	return results, nil
+}
+
+// ListHosts returns every host ordered by hostname. Archived hosts are left
+// out unless includeDeleted is set.
+func ListHosts(ctx context.Context, db DBTX, includeDeleted bool) ([]models.Host, error) {
+	rows, err := db.Query(ctx, `SELECT `+hostColumns+` FROM hosts `+liveHostsWhere(includeDeleted)+`ORDER BY hostname`)
 	if err != nil {
 		return nil, err
 	}
@@ -118,7 +345,8 @@ func SweepOfflineHosts(ctx context.Context, db DBTX, thresholdMinutes int) ([]mo
 	}
 	rows, err := db.Query(ctx, `
 		UPDATE hosts SET offline_since = NOW()
-		WHERE offline_since IS NULL AND last_seen < NOW() - make_interval(mins => $1)
+		WHERE offline_since IS NULL AND deleted_at IS NULL
+		  AND last_seen < NOW() - make_interval(mins => $1)
 		RETURNING `+hostColumns,
 		thresholdMinutes)
 	if err != nil {
@@ -128,9 +356,9 @@ func SweepOfflineHosts(ctx context.Context, db DBTX, thresholdMinutes int) ([]mo
 }
 
 // ListHostsPage is the paginated variant for API/automation consumers.
-func ListHostsPage(ctx context.Context, db DBTX, limit, offset int) ([]models.Host, error) {
+func ListHostsPage(ctx context.Context, db DBTX, limit, offset int, includeDeleted bool) ([]models.Host, error) {
 	rows, err := db.Query(ctx,
-		`SELECT `+hostColumns+` FROM hosts ORDER BY hostname LIMIT $1 OFFSET $2`,
+		`SELECT `+hostColumns+` FROM hosts `+liveHostsWhere(includeDeleted)+`ORDER BY hostname LIMIT $1 OFFSET $2`,
 		limit, offset)
 	if err != nil {
 		return nil, err
@@ -167,6 +395,110 @@ func CreateHost(ctx context.Context, db DBTX, hostname, sshUser string) (models.
 	return host, nil
 }
 
+// ErrHostArchived is returned by EnrollHost when the hostname belongs to an
+// archived host. It has to be restored before an agent can enroll for it.
+var ErrHostArchived = errors.New("host is archived")
+
+// EnrollHost makes sure an enrolling agent's host has a row, so it is listed
+// before its first report. A new row is seeded like CreateHost; an existing
+// one only has last_seen bumped, so re-enrolling keeps ssh_user, tags and
+// history. An archived row is left untouched and ErrHostArchived returned:
+// agent tokens for an archived host are refused, so enrolling it would hand
+// out a token that can't be used. As with UpsertHost, a fresh insert is the
+// row whose last_seen equals created_at.
+func EnrollHost(ctx context.Context, db DBTX, hostname string) (models.Host, error) {
+	rows, err := db.Query(ctx, `
+		INSERT INTO hosts (hostname, ssh_user, last_seen, update_output, upgrade_output)
+		VALUES ($1, 'root', NOW(), '', '')
+		ON CONFLICT (hostname) DO UPDATE SET last_seen = NOW()
+		WHERE hosts.deleted_at IS NULL
+		RETURNING `+hostColumns,
+		hostname)
+	if err != nil {
+		return models.Host{}, err
+	}
+	host, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[models.Host])
+	if errors.Is(err, pgx.ErrNoRows) {
+		// The conflict's WHERE skipped the row, which only happens when
+		// it is archived.
+		return models.Host{}, ErrHostArchived
+	}
+	return host, err
+}
+
+// ImportHost is one row of a host import. An empty SshUser or Tags keeps
+// what an existing host has; a new host gets root and no tags.
+type ImportHost struct {
+	Hostname string
+	SshUser  string
+	Tags     []string
+}
+
+// ImportResult is one import row's outcome: the host and whether the row
+// created it, or the error that kept it out.
+type ImportResult struct {
+	Host    models.Host
+	Created bool
+	Err     error
+}
+
+// ImportHosts upserts hosts by hostname in one transaction, each under its
+// own savepoint like UpsertHosts, so a failing row is rolled back alone.
+// Results are in input order; the returned error is for the transaction
+// itself, and when it is set nothing was written. Nothing but ssh_user and
+// tags is touched on an existing host, so an archived host stays archived.
+func ImportHosts(ctx context.Context, db DBTX, hosts []ImportHost) ([]ImportResult, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	results := make([]ImportResult, len(hosts))
+	for i, h := range hosts {
+		results[i].Err = func() error {
+			sp, err := tx.Begin(ctx)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = sp.Rollback(ctx) }()
+			tags := h.Tags
+			if tags == nil {
+				tags = []string{}
+			}
+			// xmax is zero only on a row this statement inserted.
+			rows, err := sp.Query(ctx, `
+				INSERT INTO hosts (hostname, ssh_user, tags, last_seen, update_output, upgrade_output)
+				VALUES ($1, COALESCE(NULLIF($2, ''), 'root'), $3, NOW(), '', '')
+				ON CONFLICT (hostname) DO UPDATE
+				SET ssh_user = COALESCE(NULLIF($2, ''), hosts.ssh_user),
+				    tags = CASE WHEN cardinality($3::text[]) = 0 THEN hosts.tags ELSE $3 END,
+				    updated_at = NOW()
+				RETURNING `+hostColumns+`, (xmax = 0) AS created`,
+				h.Hostname, h.SshUser, tags)
+			if err != nil {
+				return err
+			}
+			row, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[struct {
+				models.Host
+				Created bool `db:"created"`
+			}])
+			if err != nil {
+				return err
+			}
+			if err := sp.Commit(ctx); err != nil {
+				return err
+			}
+			results[i].Host, results[i].Created = row.Host, row.Created
+			return nil
+		}()
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("commit: %w", err)
+	}
+	return results, nil
+}
+
 func mapInsertHostError(err error) error {
 	var pgErr *pgconn.PgError
 	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
@@ -188,6 +520,53 @@ func UpdateHostSSHUser(ctx context.Context, db DBTX, id int32, sshUser string) (
 	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[models.Host])
 }
 
+// UpdateHostPolicy sets the host's update policy. Returns pgx.ErrNoRows if
+// no row matches.
+func UpdateHostPolicy(ctx context.Context, db DBTX, id int32, policy models.UpdatePolicy) (models.Host, error) {
+	rows, err := db.Query(ctx, `
+		UPDATE hosts SET update_policy = $2, updated_at = NOW() WHERE id = $1
+		RETURNING `+hostColumns,
+		id, string(policy))
+	if err != nil {
+		return models.Host{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[models.Host])
+}
+
+// UpdateHostEnvironment sets the host's environment label, "" to clear it.
+// Returns pgx.ErrNoRows if no row matches.
+func UpdateHostEnvironment(ctx context.Context, db DBTX, id int32, env string) (models.Host, error) {
+	rows, err := db.Query(ctx, `
+		UPDATE hosts SET environment = $2, updated_at = NOW() WHERE id = $1
+		RETURNING `+hostColumns,
+		id, env)
+	if err != nil {
+		return models.Host{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[models.Host])
+}
+
+// ClearRebootRequired clears the host's reboot flag once a reboot has been
+// issued; the agent sets it again if the host still needs one.
+func ClearRebootRequired(ctx context.Context, db DBTX, id int32) error {
+	_, err := db.Exec(ctx, `UPDATE hosts SET reboot_required = FALSE, updated_at = NOW() WHERE id = $1`, id)
+	return err
+}
+
+// HostEnvironmentsIn returns which of envs the hosts in ids are labelled
+// with, sorted and without duplicates.
+func HostEnvironmentsIn(ctx context.Context, db DBTX, ids []int32, envs []string) ([]string, error) {
+	rows, err := db.Query(ctx, `
+		SELECT DISTINCT environment FROM hosts
+		WHERE id = ANY($1) AND environment = ANY($2)
+		ORDER BY environment`,
+		ids, envs)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
 // UpdateHostTags replaces the host's tag list. Returns pgx.ErrNoRows if no
 // row matches.
 func UpdateHostTags(ctx context.Context, db DBTX, id int32, tags []string) (models.Host, error) {
@@ -204,8 +583,96 @@ func UpdateHostTags(ctx context.Context, db DBTX, id int32, tags []string) (mode
 	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[models.Host])
 }
 
+// AddHostTag appends tag to the host's tags unless already present, so
+// repeated calls are idempotent. Returns pgx.ErrNoRows for an unknown host.
+func AddHostTag(ctx context.Context, db DBTX, id int32, tag string) (models.Host, error) {
+	rows, err := db.Query(ctx, `
+		UPDATE hosts SET
+			tags = CASE WHEN tags @> ARRAY[$2::text] THEN tags ELSE array_append(tags, $2::text) END,
+			updated_at = NOW()
+		WHERE id = $1
+		RETURNING `+hostColumns,
+		id, tag)
+	if err != nil {
+		return models.Host{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[models.Host])
+}
+
+// RemoveHostTag drops tag from the host's tags. Removing a tag the host
+// doesn't carry is not an error. Returns pgx.ErrNoRows for an unknown host.
+func RemoveHostTag(ctx context.Context, db DBTX, id int32, tag string) (models.Host, error) {
+	rows, err := db.Query(ctx, `
+		UPDATE hosts SET tags = array_remove(tags, $2::text), updated_at = NOW()
+		WHERE id = $1
+		RETURNING `+hostColumns,
+		id, tag)
+	if err != nil {
+		return models.Host{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[models.Host])
+}
+
+// ListHostsByTag returns every host carrying tag, ordered like ListHosts.
+func ListHostsByTag(ctx context.Context, db DBTX, tag string, includeDeleted bool) ([]models.Host, error) {
+	live := ""
+	if !includeDeleted {
+		live = ` AND deleted_at IS NULL`
+	}
+	rows, err := db.Query(ctx,
+		`SELECT `+hostColumns+` FROM hosts WHERE tags @> ARRAY[$1::text]`+live+` ORDER BY hostname`, tag)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := pgx.CollectRows(rows, pgx.RowToStructByName[models.Host])
+	if err != nil {
+		return nil, err
+	}
+	if hosts == nil {
+		hosts = []models.Host{}
+	}
+	return hosts, nil
+}
+
+// liveHostsWhere is the WHERE clause (with a trailing space) that hides
+// archived hosts from a listing, or "" when they should be included.
+func liveHostsWhere(includeDeleted bool) string {
+	if includeDeleted {
+		return ""
+	}
+	return `WHERE deleted_at IS NULL `
+}
+
+// ArchiveHost soft-deletes a host by stamping deleted_at. The row, its key
+// and its run history stay put so GetHost and the audit trail still resolve
+// it. Archiving an already-archived host keeps the original timestamp.
+// Returns pgx.ErrNoRows if no host has that id.
+func ArchiveHost(ctx context.Context, db DBTX, id int32) (models.Host, error) {
+	rows, err := db.Query(ctx, `
+		UPDATE hosts SET deleted_at = COALESCE(deleted_at, NOW())
+		WHERE id = $1
+		RETURNING `+hostColumns, id)
+	if err != nil {
+		return models.Host{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[models.Host])
+}
+
+// RestoreHost clears deleted_at, putting an archived host back into
+// listings and scheduled runs. Returns pgx.ErrNoRows if no host has that id.
+func RestoreHost(ctx context.Context, db DBTX, id int32) (models.Host, error) {
+	rows, err := db.Query(ctx, `
+		UPDATE hosts SET deleted_at = NULL
+		WHERE id = $1
+		RETURNING `+hostColumns, id)
+	if err != nil {
+		return models.Host{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[models.Host])
+}
+
 // DeleteHost removes the host row. ssh_keys is set to ON DELETE CASCADE in
-// the schema, so the encrypted key disappears with it. Returns the number
+// the schema, so the encrypted keys disappear with it. Returns the number
 // of rows affected so the handler can distinguish 404 from success.
 func DeleteHost(ctx context.Context, db DBTX, id int32) (int64, error) {
 	tag, err := db.Exec(ctx, `DELETE FROM hosts WHERE id = $1`, id)
@@ -215,6 +682,8 @@ func DeleteHost(ctx context.Context, db DBTX, id int32) (int64, error) {
 	return tag.RowsAffected(), nil
 }
 
+// GetHost returns the host whether or not it is archived, so audit entries
+// and run history that point at an archived host still resolve.
 func GetHost(ctx context.Context, db DBTX, id int32) (models.Host, error) {
 	rows, err := db.Query(ctx, `SELECT `+hostColumns+` FROM hosts WHERE id = $1`, id)
 	if err != nil {
@@ -223,41 +692,226 @@ func GetHost(ctx context.Context, db DBTX, id int32) (models.Host, error) {
 	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[models.Host])
 }
 
-func GetSSHKey(ctx context.Context, db DBTX, hostID int32) (models.SSHKey, error) {
-	rows, err := db.Query(ctx, `SELECT host_id, private_key FROM ssh_keys WHERE host_id = $1`, hostID)
+// GetHostByHostname looks a host up by its unique hostname, which is how an
+// agent session identifies its host. Returns pgx.ErrNoRows if none matches.
+func GetHostByHostname(ctx context.Context, db DBTX, hostname string) (models.Host, error) {
+	rows, err := db.Query(ctx, `SELECT `+hostColumns+` FROM hosts WHERE hostname = $1`, hostname)
 	if err != nil {
-		return models.SSHKey{}, err
+		return models.Host{}, err
 	}
-	key, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[models.SSHKey])
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[models.Host])
+}
+
+// ErrUndecryptable marks a stored secret that is present but can't be
+// decrypted, typically because ENCRYPTION_KEY changed without the old key
+// being kept in ENCRYPTION_PREVIOUS_KEYS. The wrapped error says why.
+var ErrUndecryptable = errors.New("stored secret cannot be decrypted")
+
+// MaxSSHKeysPerHost caps how many keys a host can hold. Every key is
+// offered on each dial and OpenSSH's default MaxAuthTries is 6, so more
+// than this could lock the backend out before the working key is reached.
+const MaxSSHKeysPerHost = 5
+
+// ErrTooManySSHKeys is returned by AppendSSHKey for a host that already has
+// MaxSSHKeysPerHost keys.
+var ErrTooManySSHKeys = errors.New("host already has the maximum number of SSH keys")
+
+// GetSSHKey returns the host's first key, the one the UI shows as its key.
+// Returns pgx.ErrNoRows if it has none.
+func GetSSHKey(ctx context.Context, db DBTX, hostID int32) (models.SSHKey, error) {
+	keys, err := GetSSHKeys(ctx, db, hostID)
 	if err != nil {
 		return models.SSHKey{}, err
 	}
+	if len(keys) == 0 {
+		return models.SSHKey{}, pgx.ErrNoRows
+	}
+	return keys[0], nil
+}
 
-	decrypted, err := crypto.Decrypt(key.PrivateKey)
+// GetSSHKeys returns the host's keys, decrypted, in the order they are
+// offered when dialling it. A host without keys gets an empty slice.
+func GetSSHKeys(ctx context.Context, db DBTX, hostID int32) ([]models.SSHKey, error) {
+	rows, err := db.Query(ctx, `SELECT id, host_id, private_key FROM ssh_keys WHERE host_id = $1 ORDER BY position, id`, hostID)
 	if err != nil {
-		return models.SSHKey{}, fmt.Errorf("failed to decrypt SSH key for host %d: %w", hostID, err)
+		return nil, err
 	}
-	key.PrivateKey = decrypted
-	return key, nil
+	keys, err := pgx.CollectRows(rows, pgx.RowToStructByName[models.SSHKey])
+	if err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		decrypted, err := crypto.Decrypt(keys[i].PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt SSH key %d for host %d: %w: %w", keys[i].ID, hostID, ErrUndecryptable, err)
+		}
+		keys[i].PrivateKey = decrypted
+	}
+	return keys, nil
 }
 
+// AddSSHKey stores privateKey as the host's only key, replacing any it has.
+// Enrollment and rotation use it; AppendSSHKey adds a key alongside.
 func AddSSHKey(ctx context.Context, db DBTX, hostID int32, privateKey string) error {
 	encryptedKey, err := crypto.Encrypt(privateKey)
 	if err != nil {
 		return fmt.Errorf("failed to encrypt SSH key: %w", err)
 	}
+	_, err = db.Exec(ctx, replaceSSHKeys, hostID, encryptedKey)
+	return err
+}
+
+// replaceSSHKeys swaps all of host $1's keys for the encrypted key $2 in one
+// statement, so a failure leaves the old keys in place.
+const replaceSSHKeys = `
+		WITH cleared AS (DELETE FROM ssh_keys WHERE host_id = $1)
+		INSERT INTO ssh_keys (host_id, private_key, position)
+		VALUES ($1, $2, 0)`
+
+// AppendSSHKey adds privateKey after the host's existing keys and returns
+// its ID. It returns ErrTooManySSHKeys if the host already has
+// MaxSSHKeysPerHost keys.
+func AppendSSHKey(ctx context.Context, db DBTX, hostID int32, privateKey string) (int32, error) {
+	encryptedKey, err := crypto.Encrypt(privateKey)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encrypt SSH key: %w", err)
+	}
+	var id int32
+	err = db.QueryRow(ctx, `
+		INSERT INTO ssh_keys (host_id, private_key, position)
+		SELECT $1, $2, COALESCE(MAX(position) + 1, 0) FROM ssh_keys WHERE host_id = $1
+		HAVING COUNT(*) < $3
+		RETURNING id`, hostID, encryptedKey, MaxSSHKeysPerHost).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrTooManySSHKeys
+	}
+	return id, err
+}
+
+// DeleteSSHKey removes one of the host's keys, returning rows affected so
+// the handler can distinguish 404 from success.
+func DeleteSSHKey(ctx context.Context, db DBTX, hostID, keyID int32) (int64, error) {
+	tag, err := db.Exec(ctx, `DELETE FROM ssh_keys WHERE id = $1 AND host_id = $2`, keyID, hostID)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// ReEncryptSSHKeys rewrites every stored SSH key that isn't already under
+// the current encryption key and returns how many rows changed. Run it after
+// rotating ENCRYPTION_KEY (with the old key in ENCRYPTION_PREVIOUS_KEYS) so
+// the old key can then be retired. It is idempotent; the UPDATE matches on
+// the old ciphertext so a key rotated concurrently is left alone.
+func ReEncryptSSHKeys(ctx context.Context, db DBTX) (int, error) {
+	rows, err := db.Query(ctx, `SELECT id, host_id, private_key FROM ssh_keys ORDER BY id`)
+	if err != nil {
+		return 0, err
+	}
+	keys, err := pgx.CollectRows(rows, pgx.RowToStructByName[models.SSHKey])
+	if err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, k := range keys {
+		rewrapped, changed, err := crypto.ReEncrypt(k.PrivateKey)
+		if err != nil {
+			return updated, fmt.Errorf("re-encrypt SSH key for host %d: %w", k.HostID, err)
+		}
+		if !changed {
+			continue
+		}
+		tag, err := db.Exec(ctx, `UPDATE ssh_keys SET private_key = $1 WHERE id = $2 AND private_key = $3`,
+			rewrapped, k.ID, k.PrivateKey)
+		if err != nil {
+			return updated, fmt.Errorf("store re-encrypted SSH key for host %d: %w", k.HostID, err)
+		}
+		updated += int(tag.RowsAffected())
+	}
+	return updated, nil
+}
+
+// SetSudoPassword stores (or replaces) the encrypted sudo password for a
+// host.
+func SetSudoPassword(ctx context.Context, db DBTX, hostID int32, password string) error {
+	encrypted, err := crypto.Encrypt(password)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt sudo password: %w", err)
+	}
 	_, err = db.Exec(ctx, `
-		INSERT INTO ssh_keys (host_id, private_key)
+		INSERT INTO host_sudo_passwords (host_id, password)
 		VALUES ($1, $2)
 		ON CONFLICT (host_id) DO UPDATE
-		SET private_key = $2
-	`, hostID, encryptedKey)
+		SET password = $2, updated_at = NOW()
+	`, hostID, encrypted)
 	return err
 }
 
-// SetSSHKeyAndUser stores the SSH key and updates the host's ssh_user in a
-// single transaction. The previous two-step path could leave the new key
-// paired with the old ssh_user if the second statement failed.
+func DeleteSudoPassword(ctx context.Context, db DBTX, hostID int32) (int64, error) {
+	tag, err := db.Exec(ctx, `DELETE FROM host_sudo_passwords WHERE host_id = $1`, hostID)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// GetSudoPassword returns the host's decrypted sudo password, or "" when
+// none is stored (passwordless sudo).
+func GetSudoPassword(ctx context.Context, db DBTX, hostID int32) (string, error) {
+	var encrypted string
+	err := db.QueryRow(ctx, `SELECT password FROM host_sudo_passwords WHERE host_id = $1`, hostID).Scan(&encrypted)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	password, err := crypto.Decrypt(encrypted)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt sudo password: %w: %w", ErrUndecryptable, err)
+	}
+	return password, nil
+}
+
+// ReEncryptSudoPasswords is ReEncryptSSHKeys for host_sudo_passwords.
+func ReEncryptSudoPasswords(ctx context.Context, db DBTX) (int, error) {
+	rows, err := db.Query(ctx, `SELECT host_id, password FROM host_sudo_passwords ORDER BY host_id`)
+	if err != nil {
+		return 0, err
+	}
+	type stored struct {
+		HostID   int32  `db:"host_id"`
+		Password string `db:"password"`
+	}
+	all, err := pgx.CollectRows(rows, pgx.RowToStructByName[stored])
+	if err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, p := range all {
+		rewrapped, changed, err := crypto.ReEncrypt(p.Password)
+		if err != nil {
+			return updated, fmt.Errorf("re-encrypt sudo password for host %d: %w", p.HostID, err)
+		}
+		if !changed {
+			continue
+		}
+		tag, err := db.Exec(ctx, `UPDATE host_sudo_passwords SET password = $1 WHERE host_id = $2 AND password = $3`,
+			rewrapped, p.HostID, p.Password)
+		if err != nil {
+			return updated, fmt.Errorf("store re-encrypted sudo password for host %d: %w", p.HostID, err)
+		}
+		updated += int(tag.RowsAffected())
+	}
+	return updated, nil
+}
+
+// SetSSHKeyAndUser stores the SSH key as the host's only key and updates
+// its ssh_user in a single transaction. The previous two-step path could
+// leave the new key paired with the old ssh_user if the second statement
+// failed.
 func SetSSHKeyAndUser(ctx context.Context, db DBTX, hostID int32, sshUser, privateKey string) error {
 	encryptedKey, err := crypto.Encrypt(privateKey)
 	if err != nil {
@@ -271,12 +925,7 @@ func SetSSHKeyAndUser(ctx context.Context, db DBTX, hostID int32, sshUser, priva
 	// Rollback is a no-op after a successful Commit, so we always defer it.
 	defer func() { _ = tx.Rollback(ctx) }()
 
-	if _, err := tx.Exec(ctx, `
-		INSERT INTO ssh_keys (host_id, private_key)
-		VALUES ($1, $2)
-		ON CONFLICT (host_id) DO UPDATE
-		SET private_key = $2
-	`, hostID, encryptedKey); err != nil {
+	if _, err := tx.Exec(ctx, replaceSSHKeys, hostID, encryptedKey); err != nil {
 		return fmt.Errorf("upsert ssh_key: %w", err)
 	}
 
@@ -293,7 +942,7 @@ func SetSSHKeyAndUser(ctx context.Context, db DBTX, hostID int32, sshUser, priva
 
 // ListAllWebhooks returns every webhook subscription, for the Settings UI.
 func ListAllWebhooks(ctx context.Context, db DBTX) ([]models.Webhook, error) {
-	rows, err := db.Query(ctx, `SELECT id, url, event FROM webhooks ORDER BY id`)
+	rows, err := db.Query(ctx, `SELECT id, url, event, format, host_id, tag FROM webhooks ORDER BY id`)
 	if err != nil {
 		return nil, err
 	}
@@ -317,8 +966,29 @@ func DeleteWebhook(ctx context.Context, db DBTX, id int32) (int64, error) {
 	return tag.RowsAffected(), nil
 }
 
-func GetWebhooks(ctx context.Context, db DBTX, event string) ([]models.Webhook, error) {
-	rows, err := db.Query(ctx, `SELECT id, url, event FROM webhooks WHERE event = $1`, event)
+// GetWebhook returns one subscription by id, or pgx.ErrNoRows.
+func GetWebhook(ctx context.Context, db DBTX, id int32) (models.Webhook, error) {
+	rows, err := db.Query(ctx, `SELECT id, url, event, format, host_id, tag FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		return models.Webhook{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[models.Webhook])
+}
+
+// webhookMatch selects the webhooks w subscribed to event $1 whose filter
+// matches host $2.
+const webhookMatch = `w.event = $1
+		  AND (w.host_id IS NULL OR w.host_id = $2)
+		  AND (w.tag IS NULL OR EXISTS (SELECT 1 FROM hosts h WHERE h.id = $2 AND w.tag = ANY(h.tags)))`
+
+// GetWebhooks returns the subscribers to event whose filter matches hostID:
+// unfiltered ones, ones scoped to hostID, and ones scoped to a tag the host
+// carries. hostID 0 (no host) matches only unfiltered webhooks.
+func GetWebhooks(ctx context.Context, db DBTX, event string, hostID int32) ([]models.Webhook, error) {
+	rows, err := db.Query(ctx, `
+		SELECT w.id, w.url, w.event, w.format, w.host_id, w.tag
+		FROM webhooks w
+		WHERE `+webhookMatch, event, hostID)
 	if err != nil {
 		return nil, err
 	}
@@ -331,3 +1001,50 @@ func GetWebhooks(ctx context.Context, db DBTX, event string) ([]models.Webhook,
 	}
 	return hooks, nil
 }
+
+// EmitEvent stores an occurrence of event on hostID (0 for none) and queues
+// it in webhook_outbox for each webhook GetWebhooks would return, first due
+// for the retry worker after retryAfter. It returns the event's ID and those
+// webhooks. A non-empty key names the occurrence: one already stored, say by
+// a second replica finishing the same run, is a repeat, and nothing is
+// stored, queued or returned for it; the ID is then 0.
+func EmitEvent(ctx context.Context, db DBTX, event string, hostID int32, key string, payload []byte, retryAfter time.Duration) (int64, []models.Webhook, error) {
+	rows, err := db.Query(ctx, `
+		WITH e AS (
+		    INSERT INTO events (event, host_id, dedup_key, payload)
+		    VALUES ($1, NULLIF($2, 0), NULLIF($3, ''), $4)
+		    ON CONFLICT (dedup_key) DO NOTHING
+		    RETURNING id
+		), matched AS (
+		    SELECT w.id, w.url, w.event, w.format, w.host_id, w.tag
+		    FROM webhooks w
+		    WHERE `+webhookMatch+`
+		), queued AS (
+		    INSERT INTO webhook_outbox (event_id, webhook_id, next_attempt_at)
+		    SELECT e.id, matched.id, NOW() + make_interval(secs => $5) FROM e, matched
+		)
+		-- The outer join keeps a row for a stored event no webhook matched,
+		-- which tells it from a repeat; its webhook columns are zero.
+		SELECT e.id, COALESCE(matched.id, 0), COALESCE(matched.url, ''), COALESCE(matched.event, ''),
+		       COALESCE(matched.format, ''), matched.host_id, matched.tag
+		FROM e LEFT JOIN matched ON TRUE`,
+		event, hostID, key, payload, retryAfter.Seconds())
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+	var (
+		eventID int64
+		hooks   []models.Webhook
+	)
+	for rows.Next() {
+		var h models.Webhook
+		if err := rows.Scan(&eventID, &h.ID, &h.URL, &h.Event, &h.Format, &h.HostID, &h.Tag); err != nil {
+			return 0, nil, err
+		}
+		if h.ID != 0 {
+			hooks = append(hooks, h)
+		}
+	}
+	return eventID, hooks, rows.Err()
+}
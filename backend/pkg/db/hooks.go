@@ -0,0 +1,75 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+// MaxHookOutputBytes caps the output kept per hook run. Hooks stop or start
+// a few services; anything longer is noise.
+const MaxHookOutputBytes = 64 << 10
+
+// GetUpdateHooks returns the host's update hooks, both empty when none are
+// set.
+func GetUpdateHooks(ctx context.Context, db DBTX, hostID int32) (models.UpdateHooks, error) {
+	var h models.UpdateHooks
+	err := db.QueryRow(ctx, `
+		SELECT pre_update_command, post_update_command FROM host_update_hooks WHERE host_id = $1
+	`, hostID).Scan(&h.PreUpdateCommand, &h.PostUpdateCommand)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.UpdateHooks{}, nil
+	}
+	return h, err
+}
+
+// SetUpdateHooks replaces the host's update hooks. Two empty commands
+// remove the row.
+func SetUpdateHooks(ctx context.Context, db DBTX, hostID int32, h models.UpdateHooks) error {
+	if h == (models.UpdateHooks{}) {
+		_, err := db.Exec(ctx, `DELETE FROM host_update_hooks WHERE host_id = $1`, hostID)
+		return err
+	}
+	_, err := db.Exec(ctx, `
+		INSERT INTO host_update_hooks (host_id, pre_update_command, post_update_command)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (host_id) DO UPDATE
+		SET pre_update_command = $2, post_update_command = $3, updated_at = NOW()
+	`, hostID, h.PreUpdateCommand, h.PostUpdateCommand)
+	return err
+}
+
+// RecordRunHook stores what a hook printed during run runID, less any NUL
+// bytes and invalid UTF-8. exitCode < 0 records that it never exited.
+func RecordRunHook(ctx context.Context, db DBTX, runID int32, phase models.HookPhase, command string, exitCode int, output string) error {
+	var exit *int32
+	if exitCode >= 0 {
+		code := int32(exitCode) // #nosec G115 -- SSH exit codes are 0-255
+		exit = &code
+	}
+	_, err := db.Exec(ctx, `
+		INSERT INTO update_run_hooks (run_id, phase, command, exit_code, output)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (run_id, phase) DO UPDATE
+		SET command = $3, exit_code = $4, output = $5, finished_at = NOW()
+	`, runID, phase, command, exit, pgText(output))
+	if err != nil {
+		return fmt.Errorf("record %s hook of run %d: %w", phase, runID, err)
+	}
+	return nil
+}
+
+// ListRunHooks returns the hooks run during runID, pre first.
+func ListRunHooks(ctx context.Context, db DBTX, runID int32) ([]models.RunHook, error) {
+	rows, err := db.Query(ctx, `
+		SELECT run_id, phase, command, exit_code, output, finished_at
+		FROM update_run_hooks WHERE run_id = $1 ORDER BY phase DESC
+	`, runID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByName[models.RunHook])
+}
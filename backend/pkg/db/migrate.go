@@ -0,0 +1,155 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	log "github.com/sirupsen/logrus"
+
+	"ubuntu-auto-update/backend/db/migrations"
+)
+
+// migrationLockID is the pg_advisory_lock key held while migrating, so
+// replicas starting together apply each file exactly once.
+const migrationLockID int64 = 0x75617531 // "uau1"
+
+// Migration is one numbered *.up.sql file.
+type Migration struct {
+	Version int64
+	Name    string
+	SQL     string
+}
+
+// LoadMigrations returns the *.up.sql files in fsys ordered by version. File
+// names follow the golang-migrate convention: NNNNNN_description.up.sql.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("read migrations: %w", err)
+	}
+	var out []Migration
+	seen := make(map[int64]string)
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".up.sql") {
+			continue
+		}
+		prefix, _, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: missing version prefix", name)
+		}
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: bad version: %w", name, err)
+		}
+		if prev, dup := seen[version]; dup {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", prev, name, version)
+		}
+		seen[version] = name
+		body, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", name, err)
+		}
+		out = append(out, Migration{Version: version, Name: name, SQL: string(body)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// Migrate applies every embedded migration newer than the recorded schema
+// version. It runs on one pooled connection so the session advisory lock
+// covers the whole run.
+func Migrate(ctx context.Context, pool *pgxpool.Pool) (int, error) {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+	return MigrateConn(ctx, conn, migrations.FS)
+}
+
+// MigrateConn applies the migrations in fsys over conn and returns how many
+// were applied. It is idempotent and safe to call concurrently from several
+// processes.
+//
+// Bookkeeping uses golang-migrate's schema_migrations layout (a single row of
+// version + dirty), so the CLI in startup.sh and this runner see the same
+// state and either can run first. Each migration and its version bump commit
+// in one transaction; a dirty flag left by a failed CLI run is refused rather
+// than guessed around.
+func MigrateConn(ctx context.Context, conn DBTX, fsys fs.FS) (int, error) {
+	all, err := LoadMigrations(fsys)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return 0, fmt.Errorf("acquire migration lock: %w", err)
+	}
+	defer func() {
+		// Background: an already-cancelled ctx must not leave the lock held
+		// on a connection that goes back to the pool.
+		if _, err := conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockID); err != nil {
+			log.Errorf("release migration lock: %v", err)
+		}
+	}()
+
+	if _, err := conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version BIGINT NOT NULL PRIMARY KEY,
+		dirty   BOOLEAN NOT NULL
+	)`); err != nil {
+		return 0, fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	var current int64
+	var dirty bool
+	err = conn.QueryRow(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&current, &dirty)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return 0, fmt.Errorf("read schema version: %w", err)
+	}
+	if dirty {
+		return 0, fmt.Errorf("schema_migrations is dirty at version %d; fix the schema by hand and clear the flag", current)
+	}
+
+	applied := 0
+	for _, m := range all {
+		if m.Version <= current {
+			continue
+		}
+		if err := applyMigration(ctx, conn, m); err != nil {
+			return applied, err
+		}
+		log.Infof("applied migration %s", m.Name)
+		applied++
+	}
+	return applied, nil
+}
+
+func applyMigration(ctx context.Context, conn DBTX, m Migration) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("migration %s: begin: %w", m.Name, err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if _, err := tx.Exec(ctx, m.SQL); err != nil {
+		return fmt.Errorf("migration %s: %w", m.Name, err)
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM schema_migrations`); err != nil {
+		return fmt.Errorf("migration %s: record version: %w", m.Name, err)
+	}
+	if _, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)`, m.Version); err != nil {
+		return fmt.Errorf("migration %s: record version: %w", m.Name, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("migration %s: commit: %w", m.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package db_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+	"ubuntu-auto-update/backend/db/migrations"
+	"ubuntu-auto-update/backend/pkg/db"
+)
+
+var testMigrations = fstest.MapFS{
+	"000001_create_widgets.up.sql":   {Data: []byte("CREATE TABLE widgets (id INT)")},
+	"000001_create_widgets.down.sql": {Data: []byte("DROP TABLE widgets")},
+	"000002_add_widget_name.up.sql":  {Data: []byte("ALTER TABLE widgets ADD COLUMN name TEXT")},
+}
+
+func expectMigrationPreamble(mock pgxmock.PgxPoolIface) {
+	mock.ExpectExec("SELECT pg_advisory_lock").WithArgs(pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("SELECT", 1))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").
+		WillReturnResult(pgxmock.NewResult("CREATE TABLE", 0))
+}
+
+func expectApply(mock pgxmock.PgxPoolIface, stmt string, version int64) {
+	mock.ExpectBegin()
+	mock.ExpectExec(stmt).WillReturnResult(pgxmock.NewResult("OK", 0))
+	mock.ExpectExec("DELETE FROM schema_migrations").WillReturnResult(pgxmock.NewResult("DELETE", 0))
+	mock.ExpectExec("INSERT INTO schema_migrations").WithArgs(version).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectCommit()
+}
+
+func expectUnlock(mock pgxmock.PgxPoolIface) {
+	mock.ExpectExec("SELECT pg_advisory_unlock").WithArgs(pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("SELECT", 1))
+}
+
+// Running against an empty database applies everything in order; running a
+// second time, with schema_migrations now at the latest version, is a no-op.
+func TestMigrateConn_Idempotent(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer mock.Close()
+	ctx := context.Background()
+
+	expectMigrationPreamble(mock)
+	mock.ExpectQuery("SELECT version, dirty FROM schema_migrations").WillReturnError(pgx.ErrNoRows)
+	expectApply(mock, "CREATE TABLE widgets", 1)
+	expectApply(mock, "ALTER TABLE widgets", 2)
+	expectUnlock(mock)
+
+	n, err := db.MigrateConn(ctx, mock, testMigrations)
+	if err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("first run applied %d, want 2", n)
+	}
+
+	expectMigrationPreamble(mock)
+	mock.ExpectQuery("SELECT version, dirty FROM schema_migrations").
+		WillReturnRows(pgxmock.NewRows([]string{"version", "dirty"}).AddRow(int64(2), false))
+	expectUnlock(mock)
+
+	n, err = db.MigrateConn(ctx, mock, testMigrations)
+	if err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if n != 0 {
+		t.Errorf("second run applied %d, want 0", n)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+func TestMigrateConn_RefusesDirtySchema(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("error creating mock: %v", err)
+	}
+	defer mock.Close()
+
+	expectMigrationPreamble(mock)
+	mock.ExpectQuery("SELECT version, dirty FROM schema_migrations").
+		WillReturnRows(pgxmock.NewRows([]string{"version", "dirty"}).AddRow(int64(1), true))
+	expectUnlock(mock)
+
+	_, err = db.MigrateConn(context.Background(), mock, testMigrations)
+	if err == nil || !strings.Contains(err.Error(), "dirty") {
+		t.Fatalf("expected dirty error, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unmet expectations: %v", err)
+	}
+}
+
+// The shipped migrations must be contiguous from 1 — a gap usually means a
+// file was renamed or dropped by mistake.
+func TestLoadMigrations_EmbeddedAreContiguous(t *testing.T) {
+	all, err := db.LoadMigrations(migrations.FS)
+	if err != nil {
+		t.Fatalf("LoadMigrations: %v", err)
+	}
+	if len(all) == 0 {
+		t.Fatal("no embedded migrations")
+	}
+	for i, m := range all {
+		if m.Version != int64(i+1) {
+			t.Fatalf("migration %d is %s; expected version %d", i, m.Name, i+1)
+		}
+		if strings.HasSuffix(m.Name, ".down.sql") {
+			t.Fatalf("down migration %s loaded", m.Name)
+		}
+	}
+}
@@ -9,13 +9,17 @@ import (
 	"ubuntu-auto-update/backend/pkg/models"
 )
 
-const runColumns = `id, host_id, run_group_id, triggered_by, kind, status, exit_code, started_at, finished_at, output, error, playbook_id`
+const runColumns = `id, host_id, run_group_id, triggered_by, kind, status, exit_code, started_at, finished_at, output, error, playbook_id, kept_back`
 
 // MaxRunOutputBytes caps the size of stored output. Long apt logs blow up
 // the browser and the DB row otherwise; once the cap is reached we append
 // a single truncation marker and stop persisting further writes.
 const MaxRunOutputBytes = 1 << 20 // 1 MiB
 
+// RunOutputTruncatedMarker ends an output buffer that hit MaxRunOutputBytes,
+// so a reader can tell a clipped log from one that simply stopped.
+const RunOutputTruncatedMarker = "\n[output truncated]\n"
+
 // CreateRunFull inserts a new update_runs row in 'running' state. groupID ""
 // and playbookID nil are stored as NULL.
 func CreateRunFull(ctx context.Context, db DBTX, hostID int32, triggeredBy string, kind models.RunKind, groupID string, playbookID *int32) (models.UpdateRun, error) {
@@ -61,18 +65,25 @@ func ListRunsForGroup(ctx context.Context, db DBTX, groupID string) ([]models.Up
 }
 
 // AppendRunOutput appends a chunk of output to an existing run, capped at
-// MaxRunOutputBytes. Returns true iff this write fit fully within the cap;
-// callers can use that to decide whether to keep buffering.
+// MaxRunOutputBytes. Returns false once the run is already at the cap;
+// callers can use that to stop buffering.
 func AppendRunOutput(ctx context.Context, db DBTX, runID int32, chunk string) (bool, error) {
 	if chunk == "" {
 		return true, nil
 	}
+	// The write that crosses the cap is clipped, at a character boundary, to
+	// leave room for the marker, and sets output_truncated to stop later
+	// writes. Lengths are in bytes: length() would count characters.
 	tag, err := db.Exec(ctx, `
 		UPDATE update_runs
-		SET output = LEFT(output || $2, $3)
+		SET output = CASE
+			WHEN octet_length(output) + octet_length($2) <= $3 THEN output || $2
+			ELSE uau_utf8_prefix(output || $2, $3 - octet_length($4)) || $4
+		END,
+		output_truncated = octet_length(output) + octet_length($2) > $3
 		WHERE id = $1
-		  AND length(output) < $3
-	`, runID, chunk, MaxRunOutputBytes)
+		  AND NOT output_truncated
+	`, runID, chunk, MaxRunOutputBytes, RunOutputTruncatedMarker)
 	if err != nil {
 		return false, fmt.Errorf("append run output: %w", err)
 	}
@@ -104,17 +115,32 @@ func FinishRun(ctx context.Context, db DBTX, runID int32, status models.RunStatu
 	return nil
 }
 
-// ListRunsForHost returns runs for a host newest-first. limit is hard-capped
-// at 100 to keep the response bounded.
+// SetRunKeptBack records the packages a run's upgrade kept back.
+func SetRunKeptBack(ctx context.Context, db DBTX, runID int32, pkgs []string) error {
+	if _, err := db.Exec(ctx, `UPDATE update_runs SET kept_back = $2 WHERE id = $1`, runID, pkgs); err != nil {
+		return fmt.Errorf("set kept back: %w", err)
+	}
+	return nil
+}
+
+// MaxRunsPerPage caps ListRunsForHost so the response stays bounded.
+const MaxRunsPerPage = 100
+
+// ListRunsForHost returns runs for a host newest-first (id breaks ties, so
+// runs started in the same instant keep a stable order). limit <= 0 means
+// 50; larger values are clamped to MaxRunsPerPage.
 func ListRunsForHost(ctx context.Context, db DBTX, hostID int32, limit int) ([]models.UpdateRun, error) {
-	if limit <= 0 || limit > 100 {
+	if limit <= 0 {
 		limit = 50
 	}
+	if limit > MaxRunsPerPage {
+		limit = MaxRunsPerPage
+	}
 	rows, err := db.Query(ctx, `
 		SELECT `+runColumns+`
 		FROM update_runs
 		WHERE host_id = $1
-		ORDER BY started_at DESC
+		ORDER BY started_at DESC, id DESC
 		LIMIT $2
 	`, hostID, limit)
 	if err != nil {
@@ -153,3 +179,57 @@ func PruneRuns(ctx context.Context, db DBTX, retentionDays int) (int64, error) {
 	}
 	return tag.RowsAffected(), nil
 }
+
+// CreateRunPhases stores a bulk run's planned phases as pending.
+func CreateRunPhases(ctx context.Context, db DBTX, phases []models.RunPhase) error {
+	for _, p := range phases {
+		if _, err := db.Exec(ctx, `
+			INSERT INTO run_group_phases (run_group_id, phase, name, host_ids)
+			VALUES ($1, $2, $3, $4)
+		`, p.RunGroupID, p.Phase, p.Name, p.HostIDs); err != nil {
+			return fmt.Errorf("create run phase %d: %w", p.Phase, err)
+		}
+	}
+	return nil
+}
+
+// UpdateRunPhase records a phase's progress. Moving to running stamps
+// started_at; any later status stamps finished_at.
+func UpdateRunPhase(ctx context.Context, db DBTX, groupID string, phase int, status models.RunPhaseStatus, succeeded, failed int, note string) error {
+	_, err := db.Exec(ctx, `
+		UPDATE run_group_phases
+		SET status = $3,
+		    succeeded = $4,
+		    failed = $5,
+		    note = $6,
+		    started_at = CASE WHEN $3 = 'running' THEN NOW() ELSE started_at END,
+		    finished_at = CASE WHEN $3 IN ('completed', 'halted', 'skipped') THEN NOW() END
+		WHERE run_group_id = $1 AND phase = $2
+	`, groupID, phase, status, succeeded, failed, note)
+	if err != nil {
+		return fmt.Errorf("update run phase: %w", err)
+	}
+	return nil
+}
+
+// ListRunPhases returns a bulk run's phases in order. A group without
+// phases (older runs) gets an empty slice.
+func ListRunPhases(ctx context.Context, db DBTX, groupID string) ([]models.RunPhase, error) {
+	rows, err := db.Query(ctx, `
+		SELECT run_group_id::text AS run_group_id, phase, name, host_ids, status, succeeded, failed, note, started_at, finished_at
+		FROM run_group_phases
+		WHERE run_group_id = $1
+		ORDER BY phase
+	`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	phases, err := pgx.CollectRows(rows, pgx.RowToStructByName[models.RunPhase])
+	if err != nil {
+		return nil, err
+	}
+	if phases == nil {
+		phases = []models.RunPhase{}
+	}
+	return phases, nil
+}
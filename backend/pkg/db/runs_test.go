@@ -21,8 +21,8 @@ func TestCreateRun(t *testing.T) {
 	defer mock.Close()
 
 	now := time.Now()
-	rows := mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id"}).
-		AddRow(int32(1), int32(10), nil, "admin", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil)
+	rows := mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id", "kept_back"}).
+		AddRow(int32(1), int32(10), nil, "admin", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil, nil)
 
 	mock.ExpectQuery(`INSERT INTO update_runs`).
 		WithArgs(int32(10), nil, "admin", models.RunKindUpdate, nil).
@@ -52,8 +52,8 @@ func TestCreateRunWithGroup(t *testing.T) {
 	defer mock.Close()
 
 	now := time.Now()
-	rows := mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id"}).
-		AddRow(int32(1), int32(10), "group-123", "admin", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil)
+	rows := mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id", "kept_back"}).
+		AddRow(int32(1), int32(10), "group-123", "admin", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil, nil)
 
 	mock.ExpectQuery(`INSERT INTO update_runs`).
 		WithArgs(int32(10), "group-123", "admin", models.RunKindUpdate, nil).
@@ -87,8 +87,8 @@ func TestListRunsForGroup(t *testing.T) {
 	defer mock.Close()
 
 	now := time.Now()
-	rows := mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id"}).
-		AddRow(int32(1), int32(10), "group-123", "admin", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil)
+	rows := mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id", "kept_back"}).
+		AddRow(int32(1), int32(10), "group-123", "admin", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil, nil)
 
 	mock.ExpectQuery(`SELECT (.+) FROM update_runs WHERE run_group_id = \$1`).
 		WithArgs("group-123").
@@ -106,7 +106,7 @@ func TestListRunsForGroup(t *testing.T) {
 	// Nil results
 	mock.ExpectQuery(`SELECT (.+) FROM update_runs WHERE run_group_id = \$1`).
 		WithArgs("group-456").
-		WillReturnRows(mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id"}))
+		WillReturnRows(mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id", "kept_back"}))
 
 	runs, err = db.ListRunsForGroup(context.Background(), mock, "group-456")
 	if err != nil {
@@ -144,8 +144,10 @@ func TestAppendRunOutput(t *testing.T) {
 	}
 	defer mock.Close()
 
-	mock.ExpectExec(`UPDATE update_runs SET output = LEFT\(output \|\| \$2, \$3\)`).
-		WithArgs(int32(1), "new output", int(1<<20)).
+	// The cap is in bytes, and a write that crossed it stops later ones
+	// through the flag rather than the output's length.
+	mock.ExpectExec(`UPDATE update_runs SET output = CASE WHEN octet_length\(output\) \+ octet_length\(\$2\) <= \$3 .+ uau_utf8_prefix\(.+ output_truncated = .+ AND NOT output_truncated`).
+		WithArgs(int32(1), "new output", int(1<<20), db.RunOutputTruncatedMarker).
 		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
 
 	ok, err := db.AppendRunOutput(context.Background(), mock, 1, "new output")
@@ -167,8 +169,8 @@ func TestAppendRunOutput(t *testing.T) {
 	}
 
 	// Truncated (RowsAffected == 0)
-	mock.ExpectExec(`UPDATE update_runs SET output = LEFT\(output \|\| \$2, \$3\)`).
-		WithArgs(int32(2), "new output", int(1<<20)).
+	mock.ExpectExec(`UPDATE update_runs SET output = CASE`).
+		WithArgs(int32(2), "new output", int(1<<20), db.RunOutputTruncatedMarker).
 		WillReturnResult(pgxmock.NewResult("UPDATE", 0))
 
 	ok, err = db.AppendRunOutput(context.Background(), mock, 2, "new output")
@@ -180,8 +182,8 @@ func TestAppendRunOutput(t *testing.T) {
 	}
 
 	// Error path
-	mock.ExpectExec(`UPDATE update_runs SET output = LEFT\(output \|\| \$2, \$3\)`).
-		WithArgs(int32(3), "new output", int(1<<20)).
+	mock.ExpectExec(`UPDATE update_runs SET output = CASE`).
+		WithArgs(int32(3), "new output", int(1<<20), db.RunOutputTruncatedMarker).
 		WillReturnError(errors.New("db error"))
 
 	_, err = db.AppendRunOutput(context.Background(), mock, 3, "new output")
@@ -225,10 +227,10 @@ func TestListRunsForHost(t *testing.T) {
 	defer mock.Close()
 
 	now := time.Now()
-	rows := mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id"}).
-		AddRow(int32(1), int32(10), nil, "admin", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil)
+	rows := mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id", "kept_back"}).
+		AddRow(int32(1), int32(10), nil, "admin", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil, nil)
 
-	mock.ExpectQuery(`SELECT (.+) FROM update_runs WHERE host_id = \$1 ORDER BY started_at DESC LIMIT \$2`).
+	mock.ExpectQuery(`SELECT (.+) FROM update_runs WHERE host_id = \$1 ORDER BY started_at DESC, id DESC LIMIT \$2`).
 		WithArgs(int32(10), 10).
 		WillReturnRows(rows)
 
@@ -241,10 +243,10 @@ func TestListRunsForHost(t *testing.T) {
 		t.Errorf("expected 1 run, got %d", len(runs))
 	}
 
-	// Test limit defaults (<= 0 or > 100) -> 50
-	mock.ExpectQuery(`SELECT (.+) FROM update_runs WHERE host_id = \$1 ORDER BY started_at DESC LIMIT \$2`).
+	// limit <= 0 defaults to 50
+	mock.ExpectQuery(`SELECT (.+) FROM update_runs WHERE host_id = \$1 ORDER BY started_at DESC, id DESC LIMIT \$2`).
 		WithArgs(int32(10), 50).
-		WillReturnRows(mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id"}))
+		WillReturnRows(mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id", "kept_back"}))
 
 	_, err = db.ListRunsForHost(context.Background(), mock, 10, 0)
 	if err != nil {
@@ -252,17 +254,18 @@ func TestListRunsForHost(t *testing.T) {
 	}
 
 	// Error path
-	mock.ExpectQuery(`SELECT (.+) FROM update_runs WHERE host_id = \$1 ORDER BY started_at DESC LIMIT \$2`).
-		WithArgs(int32(20), 50).
+	mock.ExpectQuery(`SELECT (.+) FROM update_runs WHERE host_id = \$1 ORDER BY started_at DESC, id DESC LIMIT \$2`).
+		WithArgs(int32(20), 100).
 		WillReturnError(errors.New("db error"))
 
+	// limit > 100 is clamped to the max, not reset to the default
 	_, err = db.ListRunsForHost(context.Background(), mock, 20, 200)
 	if err == nil {
 		t.Error("expected error")
 	}
 
 	// CollectRows error path
-	mock.ExpectQuery(`SELECT (.+) FROM update_runs WHERE host_id = \$1 ORDER BY started_at DESC LIMIT \$2`).
+	mock.ExpectQuery(`SELECT (.+) FROM update_runs WHERE host_id = \$1 ORDER BY started_at DESC, id DESC LIMIT \$2`).
 		WithArgs(int32(30), 50).
 		WillReturnRows(mock.NewRows([]string{"id"}).AddRow("not-an-int"))
 
@@ -280,8 +283,8 @@ func TestGetRun(t *testing.T) {
 	defer mock.Close()
 
 	now := time.Now()
-	rows := mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id"}).
-		AddRow(int32(1), int32(10), nil, "admin", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil)
+	rows := mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id", "kept_back"}).
+		AddRow(int32(1), int32(10), nil, "admin", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil, nil)
 
 	mock.ExpectQuery(`SELECT (.+) FROM update_runs WHERE id = \$1`).
 		WithArgs(int32(1)).
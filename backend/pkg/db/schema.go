@@ -0,0 +1,48 @@
+package db
+
+import (
+	"context"
+	"fmt"
+)
+
+// RequiredTables are the tables the API reads or writes on its hot paths.
+// A database missing any of them was never migrated, or was migrated and
+// then emptied behind schema_migrations' back.
+var RequiredTables = []string{
+	"agent_tokens", "api_tokens", "audit_log", "events", "host_keys", "hosts", "playbooks",
+	"refresh_tokens", "schedules", "sessions", "ssh_keys", "update_runs",
+	"users", "webhook_outbox", "webhooks",
+}
+
+// MissingTables returns the RequiredTables absent from the current schema,
+// in RequiredTables order. It reads information_schema, so it works on an
+// empty database where querying the tables themselves would fail with
+// "relation does not exist".
+func MissingTables(ctx context.Context, db DBTX) ([]string, error) {
+	rows, err := db.Query(ctx, `
+		SELECT table_name FROM information_schema.tables
+		WHERE table_schema = current_schema() AND table_name = ANY($1)
+	`, RequiredTables)
+	if err != nil {
+		return nil, fmt.Errorf("list tables: %w", err)
+	}
+	defer rows.Close()
+	present := make(map[string]bool, len(RequiredTables))
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		present[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, t := range RequiredTables {
+		if !present[t] {
+			missing = append(missing, t)
+		}
+	}
+	return missing, nil
+}
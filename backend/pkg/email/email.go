@@ -0,0 +1,170 @@
+// Package email sends event notifications over SMTP, for teams without a
+// webhook receiver. It hangs off the same event dispatch as webhooks, so
+// both fire from the same places.
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"ubuntu-auto-update/backend/pkg/config"
+	"ubuntu-auto-update/backend/pkg/webhook"
+)
+
+// Events are the events worth an email. Everything else stays on webhooks.
+var Events = map[string]bool{
+	"update_failure":  true,
+	"reboot_required": true,
+}
+
+// Notifier mails Events to the configured recipients. Sends run in the
+// background so the triggering request never waits on the relay.
+type Notifier struct {
+	cfg config.EmailConfig
+	wg  sync.WaitGroup
+
+	// tlsConfig is overridden by tests talking to a self-signed relay.
+	tlsConfig *tls.Config
+}
+
+func NewNotifier(cfg config.EmailConfig) *Notifier {
+	return &Notifier{cfg: cfg}
+}
+
+// Notify queues an email for event if it is one of Events. Failures are
+// logged, like a webhook's final failure.
+func (n *Notifier) Notify(event string, payload interface{}) {
+	if !Events[event] {
+		return
+	}
+	subject, body := Compose(event, payload)
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), n.cfg.Timeout)
+		defer cancel()
+		if err := n.Send(ctx, subject, body); err != nil {
+			log.WithError(err).Errorf("email notification %q to %s failed", event, strings.Join(n.cfg.To, ", "))
+		}
+	}()
+}
+
+// Wait blocks until queued emails are sent (or have failed). Use during
+// graceful shutdown.
+func (n *Notifier) Wait() {
+	n.wg.Wait()
+}
+
+// Compose renders the subject and plain-text body for an event.
+func Compose(event string, payload interface{}) (subject, body string) {
+	title, facts := webhook.Summarize(event, payload)
+	var b strings.Builder
+	b.WriteString(title + "\n\n")
+	for _, f := range facts {
+		fmt.Fprintf(&b, "%s: %s\n", f.Name, f.Value)
+	}
+	return "[ubuntu-auto-update] " + title, b.String()
+}
+
+// Send delivers one message to every recipient in a single SMTP session.
+func (n *Notifier) Send(ctx context.Context, subject, body string) error {
+	c, err := n.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if n.cfg.Username != "" {
+		// PlainAuth itself refuses to send the password over an
+		// unencrypted connection to anything but localhost.
+		if err := c.Auth(smtp.PlainAuth("", n.cfg.Username, n.cfg.Password, n.cfg.Host)); err != nil {
+			return fmt.Errorf("smtp auth: %w", err)
+		}
+	}
+	if err := c.Mail(n.cfg.From); err != nil {
+		return fmt.Errorf("smtp MAIL FROM: %w", err)
+	}
+	for _, rcpt := range n.cfg.To {
+		if err := c.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("smtp RCPT TO %s: %w", rcpt, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("smtp DATA: %w", err)
+	}
+	if _, err := w.Write(n.message(subject, body)); err != nil {
+		return fmt.Errorf("smtp DATA: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp DATA: %w", err)
+	}
+	return c.Quit()
+}
+
+// dial connects to the relay and secures the connection per cfg.TLS. The
+// context's deadline bounds the whole conversation, not just the connect.
+func (n *Notifier) dial(ctx context.Context) (*smtp.Client, error) {
+	addr := net.JoinHostPort(n.cfg.Host, strconv.Itoa(n.cfg.Port))
+	tlsCfg := n.tlsConfig
+	if tlsCfg == nil {
+		tlsCfg = &tls.Config{ServerName: n.cfg.Host, MinVersion: tls.VersionTLS12}
+	}
+
+	var conn net.Conn
+	var err error
+	if n.cfg.TLS == config.SMTPTLSImplicit {
+		conn, err = (&tls.Dialer{Config: tlsCfg}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("smtp connect %s: %w", addr, err)
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	}
+	c, err := smtp.NewClient(conn, n.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("smtp greeting from %s: %w", addr, err)
+	}
+	if n.cfg.TLS == config.SMTPTLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			return nil, errors.New("smtp relay does not offer STARTTLS (set SMTP_TLS=none to send in the clear)")
+		}
+		if err := c.StartTLS(tlsCfg); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("smtp STARTTLS: %w", err)
+		}
+	}
+	return c, nil
+}
+
+func (n *Notifier) message(subject, body string) []byte {
+	// Header values come from config and event payloads; a stray newline
+	// must not be able to start a new header.
+	oneLine := strings.NewReplacer("\r", " ", "\n", " ")
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", oneLine.Replace(n.cfg.From))
+	fmt.Fprintf(&b, "To: %s\r\n", oneLine.Replace(strings.Join(n.cfg.To, ", ")))
+	fmt.Fprintf(&b, "Subject: %s\r\n", oneLine.Replace(subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes()
+}
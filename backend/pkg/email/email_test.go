@@ -0,0 +1,218 @@
+package email
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ubuntu-auto-update/backend/pkg/config"
+)
+
+// mockSMTP is just enough of an SMTP relay for net/smtp: EHLO, optional
+// STARTTLS and AUTH PLAIN, one transaction, QUIT.
+type mockSMTP struct {
+	ln  net.Listener
+	tls *tls.Config // non-nil: offer STARTTLS
+
+	mu       sync.Mutex
+	auth     string // decoded AUTH PLAIN response
+	from     string
+	rcpts    []string
+	data     string
+	startTLS bool
+	done     chan struct{}
+}
+
+func newMockSMTP(t *testing.T, tlsCfg *tls.Config) *mockSMTP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &mockSMTP{ln: ln, tls: tlsCfg, done: make(chan struct{})}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer close(s.done)
+		s.serve(conn)
+	}()
+	return s
+}
+
+func (s *mockSMTP) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *mockSMTP) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	r, w := bufio.NewReader(conn), conn
+	reply := func(line string) { _, _ = w.Write([]byte(line + "\r\n")) }
+	reply("220 mock ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		s.mu.Lock()
+		switch {
+		case verb == "EHLO":
+			reply("250-mock")
+			if s.tls != nil && !s.startTLS {
+				reply("250-STARTTLS")
+			}
+			reply("250 AUTH PLAIN")
+		case verb == "STARTTLS":
+			reply("220 go ahead")
+			tc := tls.Server(conn, s.tls)
+			if err := tc.Handshake(); err != nil {
+				s.mu.Unlock()
+				return
+			}
+			conn, s.startTLS = tc, true
+			r, w = bufio.NewReader(tc), tc
+		case verb == "AUTH":
+			parts := strings.Fields(line)
+			raw, _ := base64.StdEncoding.DecodeString(parts[len(parts)-1])
+			s.auth = string(raw)
+			reply("235 ok")
+		case strings.HasPrefix(line, "MAIL FROM:"):
+			s.from = strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<>")
+			reply("250 ok")
+		case strings.HasPrefix(line, "RCPT TO:"):
+			s.rcpts = append(s.rcpts, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>"))
+			reply("250 ok")
+		case verb == "DATA":
+			reply("354 end with .")
+			var b strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil || l == ".\r\n" {
+					break
+				}
+				b.WriteString(l)
+			}
+			s.data = b.String()
+			reply("250 queued")
+		case verb == "QUIT":
+			reply("221 bye")
+			s.mu.Unlock()
+			return
+		default:
+			reply("502 unsupported")
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *mockSMTP) wait(t *testing.T) {
+	t.Helper()
+	select {
+	case <-s.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("mock SMTP server never finished a session")
+	}
+}
+
+func testConfig(port int) config.EmailConfig {
+	return config.EmailConfig{
+		Host:    "127.0.0.1",
+		Port:    port,
+		TLS:     config.SMTPTLSNone,
+		From:    "uau@example.com",
+		To:      []string{"ops@example.com", "oncall@example.com"},
+		Timeout: 5 * time.Second,
+	}
+}
+
+func TestNotify_SendsOnUpdateFailure(t *testing.T) {
+	srv := newMockSMTP(t, nil)
+	cfg := testConfig(srv.port())
+	cfg.Username, cfg.Password = "uau", "s3cret"
+
+	n := NewNotifier(cfg)
+	n.Notify("update_failure", map[string]interface{}{"host_id": 12, "hostname": "web-1", "error": "apt-get exited 100"})
+	n.Wait()
+	srv.wait(t)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.auth != "\x00uau\x00s3cret" {
+		t.Errorf("AUTH PLAIN = %q", srv.auth)
+	}
+	if srv.from != "uau@example.com" || strings.Join(srv.rcpts, ",") != "ops@example.com,oncall@example.com" {
+		t.Errorf("envelope from %q to %v", srv.from, srv.rcpts)
+	}
+	for _, want := range []string{
+		"Subject: [ubuntu-auto-update] Update failed on web-1\r\n",
+		"To: ops@example.com, oncall@example.com\r\n",
+		"error: apt-get exited 100\r\n",
+	} {
+		if !strings.Contains(srv.data, want) {
+			t.Errorf("message is missing %q:\n%s", want, srv.data)
+		}
+	}
+}
+
+func TestNotify_IgnoresOtherEvents(t *testing.T) {
+	n := NewNotifier(testConfig(1))
+	n.Notify("update_success", map[string]interface{}{"host_id": 1})
+	n.Wait() // nothing was queued, so nothing dialled port 1
+}
+
+func TestSend_StartTLS(t *testing.T) {
+	// httptest's certificate is valid for example.com and 127.0.0.1.
+	https := httptest.NewTLSServer(nil)
+	defer https.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(https.Certificate())
+
+	srv := newMockSMTP(t, &tls.Config{Certificates: https.TLS.Certificates})
+	cfg := testConfig(srv.port())
+	cfg.TLS = config.SMTPTLSStartTLS
+	n := NewNotifier(cfg)
+	n.tlsConfig = &tls.Config{RootCAs: roots, ServerName: "example.com"}
+
+	subject, body := Compose("reboot_required", map[string]interface{}{"host_id": 4})
+	if err := n.Send(t.Context(), subject, body); err != nil {
+		t.Fatal(err)
+	}
+	srv.wait(t)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !srv.startTLS || !strings.Contains(srv.data, "Subject: [ubuntu-auto-update] Reboot required on host 4") {
+		t.Errorf("startTLS=%v data=%q", srv.startTLS, srv.data)
+	}
+}
+
+func TestSend_StartTLSRequired(t *testing.T) {
+	srv := newMockSMTP(t, nil) // doesn't offer STARTTLS
+	cfg := testConfig(srv.port())
+	cfg.TLS = config.SMTPTLSStartTLS
+	err := NewNotifier(cfg).Send(t.Context(), "s", "b")
+	if err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("err = %v, want a refusal to send in the clear", err)
+	}
+}
+
+func TestMessage_HeaderInjection(t *testing.T) {
+	n := NewNotifier(testConfig(25))
+	msg := string(n.message("hi\r\nBcc: evil@example.com", "body"))
+	if strings.Contains(msg, "\r\nBcc:") {
+		t.Errorf("subject newline started a header:\n%s", msg)
+	}
+	if !strings.HasSuffix(msg, "\r\n\r\nbody") {
+		t.Errorf("message = %q", msg)
+	}
+}
@@ -0,0 +1,111 @@
+// Package enrollment stores agent enrollment tokens: the shared secret an
+// agent presents to POST /enroll to get its session. Tokens are minted from
+// the command line or POST /enrollment-tokens, stored as SHA-256 hashes, and
+// the raw token (uae_…) is shown exactly once. A token may expire and may be
+// single-use. The ENROLLMENT_TOKEN environment variable is the other
+// accepted source.
+package enrollment
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"ubuntu-auto-update/backend/pkg/db"
+)
+
+// Prefix marks a stored enrollment token, so the enroll handler only looks
+// one up when it could possibly match.
+const Prefix = "uae_"
+
+type Token struct {
+	ID         int32      `json:"id" db:"id"`
+	Name       string     `json:"name" db:"name"`
+	CreatedBy  string     `json:"created_by" db:"created_by"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at" db:"last_used_at"`
+
+	// ExpiresAt is when the token stops working; nil never expires.
+	ExpiresAt *time.Time `json:"expires_at" db:"expires_at"`
+	// SingleUse tokens stop working after their first enrollment.
+	SingleUse bool `json:"single_use" db:"single_use"`
+}
+
+const cols = `id, name, created_by, created_at, last_used_at, expires_at, single_use`
+
+// Options shape a new token. The zero value is a reusable token that never
+// expires, as the CLI mints.
+type Options struct {
+	// TTL, when positive, makes the token expire that long after creation.
+	TTL       time.Duration
+	SingleUse bool
+}
+
+func hash(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create mints a token and returns the row plus the raw secret — the only
+// time it is ever available.
+func Create(ctx context.Context, dbx db.DBTX, name, createdBy string, opts Options) (Token, string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return Token{}, "", err
+	}
+	raw := Prefix + hex.EncodeToString(buf)
+	var expiresAt *time.Time
+	if opts.TTL > 0 {
+		t := time.Now().Add(opts.TTL)
+		expiresAt = &t
+	}
+	rows, err := dbx.Query(ctx, `
+		INSERT INTO enrollment_tokens (name, token_hash, created_by, expires_at, single_use)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+cols,
+		name, hash(raw), createdBy, expiresAt, opts.SingleUse)
+	if err != nil {
+		return Token{}, "", err
+	}
+	t, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[Token])
+	if err != nil {
+		return Token{}, "", err
+	}
+	return t, raw, nil
+}
+
+// Validate reports whether raw is a live stored enrollment token, bumping
+// its last_used_at when it is. An expired token, or a single-use one that
+// has been used, is refused as if unknown. Checking and stamping happen in
+// one UPDATE, so two agents racing with the same single-use token can't
+// both get in: the loser's row no longer matches once the winner's update
+// commits.
+func Validate(ctx context.Context, dbx db.DBTX, raw string) (Token, bool, error) {
+	if !strings.HasPrefix(raw, Prefix) {
+		return Token{}, false, nil
+	}
+	rows, err := dbx.Query(ctx, `
+		UPDATE enrollment_tokens SET last_used_at = NOW()
+		WHERE token_hash = $1
+		  AND (expires_at IS NULL OR expires_at > NOW())
+		  AND NOT (single_use AND last_used_at IS NOT NULL)
+		RETURNING `+cols,
+		hash(raw))
+	if err != nil {
+		return Token{}, false, err
+	}
+	t, err := pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[Token])
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Token{}, false, nil
+		}
+		return Token{}, false, err
+	}
+	return t, true, nil
+}
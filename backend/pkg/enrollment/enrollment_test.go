@@ -0,0 +1,131 @@
+package enrollment_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock/v4"
+
+	"ubuntu-auto-update/backend/pkg/enrollment"
+)
+
+// sameArg matches any string the first time and then only that string.
+type sameArg struct{ v *string }
+
+func (a sameArg) Match(v interface{}) bool {
+	s, ok := v.(string)
+	if !ok {
+		return false
+	}
+	if *a.v == "" {
+		*a.v = s
+	}
+	return s == *a.v
+}
+
+func rows(mock pgxmock.PgxPoolIface) *pgxmock.Rows {
+	return mock.NewRows([]string{"id", "name", "created_by", "created_at", "last_used_at", "expires_at", "single_use"})
+}
+
+func TestCreateThenValidate(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	ctx := context.Background()
+
+	var stored string
+	mock.ExpectQuery(`INSERT INTO enrollment_tokens`).
+		WithArgs("rack-4", sameArg{&stored}, "cli", (*time.Time)(nil), false).
+		WillReturnRows(rows(mock).AddRow(int32(1), "rack-4", "cli", time.Now(), nil, nil, false))
+	tok, raw, err := enrollment.Create(ctx, mock, "rack-4", "cli", enrollment.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.ID != 1 || !strings.HasPrefix(raw, enrollment.Prefix) {
+		t.Fatalf("got %+v / %q", tok, raw)
+	}
+	if strings.Contains(stored, raw) {
+		t.Fatal("raw token stored in the clear")
+	}
+
+	// Validating the raw token looks up the hash Create stored.
+	used := time.Now()
+	mock.ExpectQuery(`UPDATE enrollment_tokens SET last_used_at = NOW\(\)`).
+		WithArgs(sameArg{&stored}).
+		WillReturnRows(rows(mock).AddRow(int32(1), "rack-4", "cli", time.Now(), &used, nil, false))
+	if _, ok, err := enrollment.Validate(ctx, mock, raw); err != nil || !ok {
+		t.Fatalf("validate: ok=%v err=%v", ok, err)
+	}
+
+	// Unknown token: no row, not an error.
+	mock.ExpectQuery(`UPDATE enrollment_tokens`).WithArgs(pgxmock.AnyArg()).WillReturnRows(rows(mock))
+	if _, ok, err := enrollment.Validate(ctx, mock, enrollment.Prefix+"nope"); err != nil || ok {
+		t.Fatalf("unknown token: ok=%v err=%v", ok, err)
+	}
+	// Without the prefix the database isn't consulted.
+	if _, ok, _ := enrollment.Validate(ctx, mock, "shared-secret"); ok {
+		t.Error("unprefixed token validated")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// expiresNear matches a *time.Time within a minute of want.
+type expiresNear struct{ want time.Time }
+
+func (a expiresNear) Match(v interface{}) bool {
+	t, ok := v.(*time.Time)
+	return ok && t != nil && t.Sub(a.want).Abs() < time.Minute
+}
+
+func TestCreate_ExpiringSingleUse(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+
+	expires := time.Now().Add(time.Hour)
+	mock.ExpectQuery(`INSERT INTO enrollment_tokens`).
+		WithArgs("rack-5", pgxmock.AnyArg(), "alice", expiresNear{expires}, true).
+		WillReturnRows(rows(mock).AddRow(int32(2), "rack-5", "alice", time.Now(), nil, &expires, true))
+	tok, _, err := enrollment.Create(context.Background(), mock, "rack-5", "alice",
+		enrollment.Options{TTL: time.Hour, SingleUse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tok.SingleUse || tok.ExpiresAt == nil {
+		t.Errorf("got %+v", tok)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Expired and already-consumed single-use tokens are filtered out by the
+// same UPDATE that marks a token used, so the database answers no row and
+// Validate reports them as unknown.
+func TestValidate_RejectsExpiredAndConsumed(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+
+	mock.ExpectQuery(`UPDATE enrollment_tokens SET last_used_at = NOW\(\) ` +
+		`WHERE token_hash = \$1 AND \(expires_at IS NULL OR expires_at > NOW\(\)\) ` +
+		`AND NOT \(single_use AND last_used_at IS NOT NULL\)`).
+		WithArgs(pgxmock.AnyArg()).
+		WillReturnRows(rows(mock))
+	if _, ok, err := enrollment.Validate(context.Background(), mock, enrollment.Prefix+"spent"); err != nil || ok {
+		t.Fatalf("ok=%v err=%v", ok, err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
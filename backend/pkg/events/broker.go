@@ -4,7 +4,8 @@
 // for concurrent use.
 //
 // The schema is intentionally tiny: the publisher trigger pushes only
-// {table, op, id}, the subscriber re-fetches via REST. That keeps the
+// {table, op, id} (plus the event name and host for a dispatched event,
+// and the host for a run), the subscriber re-fetches via REST. That keeps the
 // channel small (under the 8 KB pg_notify limit by a wide margin) and
 // avoids races around in-flight transactions.
 package events
@@ -17,10 +18,17 @@ import (
 // Event is the payload pushed onto every subscriber channel. JSON-encoded
 // directly when forwarded over WebSockets, so field tags are part of the
 // public contract — don't rename without updating useEvents.ts.
+//
+// A row inserted into the events table is a dispatched event, the same one
+// webhooks get: Event names it (update_success, host_offline, ...) and
+// HostID is the host it concerns, if any. update_runs events carry HostID
+// too.
 type Event struct {
-	Table string `json:"table"`
-	Op    string `json:"op"` // INSERT, UPDATE, DELETE, or "snapshot" on reconnect
-	ID    int64  `json:"id"`
+	Table  string `json:"table"`
+	Op     string `json:"op"` // INSERT, UPDATE, DELETE, or "snapshot" on reconnect
+	ID     int64  `json:"id"`
+	Event  string `json:"event,omitempty"`
+	HostID int64  `json:"host_id,omitempty"`
 }
 
 // SubscriberBufferSize is the per-subscriber channel depth. Bursts of agent
@@ -8,6 +8,7 @@ import (
 
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
+	"ubuntu-auto-update/backend/pkg/middleware"
 	"ubuntu-auto-update/backend/pkg/session"
 )
 
@@ -18,11 +19,19 @@ const (
 	pingPeriod = 30 * time.Second
 	pongWait   = 60 * time.Second
 	writeWait  = 10 * time.Second
+
+	// maxClientMessage bounds what a client may send. The stream is
+	// server→client only; anything bigger than a control frame is abuse.
+	maxClientMessage = 512
 )
 
 // Handler returns an http.HandlerFunc that upgrades to a WebSocket and
 // streams broker events as JSON. Used as GET /api/v1/events.
 //
+// Besides row changes on hosts and update_runs, the stream carries every
+// dispatched event (table "events"): updates finishing, hosts going offline
+// or needing a reboot. A run starting is its update_runs INSERT.
+//
 // One connection per session is the design — the frontend uses a singleton
 // WS shared via a React context. Each connection forwards every event the
 // broker emits; client-side filtering decides what each component cares
@@ -36,6 +45,7 @@ func Handler(broker *Broker, upgrader websocket.Upgrader, store session.Store) h
 			return
 		}
 		defer conn.Close()
+		conn.SetReadLimit(maxClientMessage)
 
 		ctx, cancel := context.WithCancel(r.Context())
 		defer cancel()
@@ -72,7 +82,7 @@ func Handler(broker *Broker, upgrader websocket.Upgrader, store session.Store) h
 		ticker := time.NewTicker(pingPeriod)
 		defer ticker.Stop()
 
-		token := r.URL.Query().Get("token")
+		token := middleware.WebSocketToken(r)
 
 		for {
 			select {
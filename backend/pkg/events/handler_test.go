@@ -0,0 +1,79 @@
+package events
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func readEvent(t *testing.T, conn *websocket.Conn) Event {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	var ev Event
+	if err := json.Unmarshal(data, &ev); err != nil {
+		t.Fatalf("decode %q: %v", data, err)
+	}
+	return ev
+}
+
+// A connected client gets the snapshot hint, then each dispatched event the
+// trigger publishes, with its name and host.
+func TestHandler_StreamsDispatchedEvents(t *testing.T) {
+	b := NewBroker()
+	ts := httptest.NewServer(Handler(b, websocket.Upgrader{}, nil))
+	defer ts.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	if ev := readEvent(t, conn); ev.Op != "snapshot" {
+		t.Fatalf("first message = %+v, want the snapshot hint", ev)
+	}
+
+	// The host going offline, as the events trigger reports it.
+	ev, err := decodePayload(`{"table": "events", "op": "INSERT", "id": 812, "event": "host_offline", "host_id": 3}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Publish(ev)
+
+	want := Event{Table: "events", Op: "INSERT", ID: 812, Event: "host_offline", HostID: 3}
+	if got := readEvent(t, conn); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodePayload(t *testing.T) {
+	cases := []struct {
+		payload string
+		want    Event
+	}{
+		{`{"table": "hosts", "op": "UPDATE", "id": 4}`, Event{Table: "hosts", Op: "UPDATE", ID: 4}},
+		{`{"table": "update_runs", "op": "INSERT", "id": "17", "host_id": 4}`, Event{Table: "update_runs", Op: "INSERT", ID: 17, HostID: 4}},
+		{`{"table": "events", "op": "INSERT", "id": 9, "event": "host_registered", "host_id": null}`, Event{Table: "events", Op: "INSERT", ID: 9, Event: "host_registered"}},
+	}
+	for _, c := range cases {
+		got, err := decodePayload(c.payload)
+		if err != nil {
+			t.Errorf("%s: %v", c.payload, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.payload, got, c.want)
+		}
+	}
+	if _, err := decodePayload(`{"table": "hosts", "id": "x"}`); err == nil {
+		t.Error("non-numeric id accepted")
+	}
+}
@@ -112,7 +112,8 @@ func (l *Listener) runOnce(ctx context.Context) error {
 }
 
 // decodePayload parses one pg_notify payload. The trigger emits a JSON
-// object with table, op, id; we tolerate stringified ids in case future
+// object with table, op, id and, for some tables, event and host_id (null
+// for an event about no host); we tolerate stringified ids in case future
 // triggers send larger keys.
 func decodePayload(payload string) (Event, error) {
 	if payload == "" {
@@ -120,15 +121,17 @@ func decodePayload(payload string) (Event, error) {
 	}
 
 	var raw struct {
-		Table string          `json:"table"`
-		Op    string          `json:"op"`
-		ID    json.RawMessage `json:"id"`
+		Table  string          `json:"table"`
+		Op     string          `json:"op"`
+		ID     json.RawMessage `json:"id"`
+		Event  string          `json:"event"`
+		HostID int64           `json:"host_id"`
 	}
 	if err := json.Unmarshal([]byte(payload), &raw); err != nil {
 		return Event{}, fmt.Errorf("decode json: %w", err)
 	}
 
-	ev := Event{Table: raw.Table, Op: raw.Op}
+	ev := Event{Table: raw.Table, Op: raw.Op, Event: raw.Event, HostID: raw.HostID}
 	if len(raw.ID) > 0 && string(raw.ID) != "null" {
 		// ID may be a JSON number or a quoted string; try both.
 		if err := json.Unmarshal(raw.ID, &ev.ID); err != nil {
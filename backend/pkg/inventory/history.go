@@ -0,0 +1,110 @@
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"ubuntu-auto-update/backend/pkg/db"
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+// Snapshot is the package list recorded for one update run. Captured is
+// false for a run with no list on file: one from before snapshots were
+// taken, or one that didn't succeed.
+type Snapshot struct {
+	RunID      int32
+	HostID     int32
+	Captured   bool
+	CapturedAt time.Time
+	Packages   []models.Package
+}
+
+// SaveSnapshot records pkgs as the package list after run runID.
+func SaveSnapshot(ctx context.Context, dbx db.DBTX, runID int32, pkgs []models.Package) error {
+	raw, err := json.Marshal(pkgs)
+	if err != nil {
+		return err
+	}
+	_, err = dbx.Exec(ctx, `
+		INSERT INTO run_packages (run_id, packages) VALUES ($1, $2)
+		ON CONFLICT (run_id) DO UPDATE SET packages = EXCLUDED.packages, captured_at = NOW()
+	`, runID, raw)
+	return err
+}
+
+// GetSnapshot returns run runID's snapshot, or pgx.ErrNoRows if there is no
+// such run.
+func GetSnapshot(ctx context.Context, dbx db.DBTX, runID int32) (Snapshot, error) {
+	s := Snapshot{RunID: runID}
+	var raw []byte
+	var capturedAt *time.Time
+	err := dbx.QueryRow(ctx, `
+		SELECT r.host_id, p.packages, p.captured_at
+		FROM update_runs r LEFT JOIN run_packages p ON p.run_id = r.id
+		WHERE r.id = $1
+	`, runID).Scan(&s.HostID, &raw, &capturedAt)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if capturedAt == nil {
+		return s, nil
+	}
+	if err := json.Unmarshal(raw, &s.Packages); err != nil {
+		return Snapshot{}, fmt.Errorf("decode packages of run %d: %w", runID, err)
+	}
+	s.Captured, s.CapturedAt = true, *capturedAt
+	return s, nil
+}
+
+// PackageChange is a package whose version differs between two snapshots.
+type PackageChange struct {
+	Name string `json:"name"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Diff is what changed from one package list to another, each part sorted
+// by name.
+type Diff struct {
+	Added   []models.Package `json:"added"`
+	Removed []models.Package `json:"removed"`
+	// Upgraded lists every version change. Versions aren't compared, so a
+	// downgrade shows up here too.
+	Upgraded []PackageChange `json:"upgraded"`
+}
+
+// DiffPackages compares two package lists by name. Multiarch copies of a
+// package share a name and, in practice, a version, so they count once.
+func DiffPackages(from, to []models.Package) Diff {
+	before := make(map[string]string, len(from))
+	for _, p := range from {
+		before[p.Name] = p.Version
+	}
+	after := make(map[string]string, len(to))
+	for _, p := range to {
+		after[p.Name] = p.Version
+	}
+
+	d := Diff{Added: []models.Package{}, Removed: []models.Package{}, Upgraded: []PackageChange{}}
+	for name, v := range after {
+		old, ok := before[name]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, models.Package{Name: name, Version: v})
+		case old != v:
+			d.Upgraded = append(d.Upgraded, PackageChange{Name: name, From: old, To: v})
+		}
+	}
+	for name, v := range before {
+		if _, ok := after[name]; !ok {
+			d.Removed = append(d.Removed, models.Package{Name: name, Version: v})
+		}
+	}
+	sort.Slice(d.Added, func(i, j int) bool { return d.Added[i].Name < d.Added[j].Name })
+	sort.Slice(d.Removed, func(i, j int) bool { return d.Removed[i].Name < d.Removed[j].Name })
+	sort.Slice(d.Upgraded, func(i, j int) bool { return d.Upgraded[i].Name < d.Upgraded[j].Name })
+	return d
+}
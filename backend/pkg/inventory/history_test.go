@@ -0,0 +1,43 @@
+package inventory
+
+import (
+	"reflect"
+	"testing"
+
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+func TestDiffPackages(t *testing.T) {
+	from := []models.Package{
+		{Name: "apt", Version: "2.4.11"},
+		{Name: "libc6", Version: "2.35-0ubuntu3.7"},
+		{Name: "libc6", Version: "2.35-0ubuntu3.7"},
+		{Name: "linux-image-5.15.0-91-generic", Version: "5.15.0-91.101"},
+		{Name: "tzdata", Version: "2024a-0ubuntu0.22.04"},
+	}
+	to := []models.Package{
+		{Name: "apt", Version: "2.4.12"},
+		{Name: "libc6", Version: "2.35-0ubuntu3.8"},
+		{Name: "libc6", Version: "2.35-0ubuntu3.8"},
+		{Name: "linux-image-5.15.0-94-generic", Version: "5.15.0-94.104"},
+		{Name: "tzdata", Version: "2024a-0ubuntu0.22.04"},
+	}
+
+	got := DiffPackages(from, to)
+	want := Diff{
+		Added:   []models.Package{{Name: "linux-image-5.15.0-94-generic", Version: "5.15.0-94.104"}},
+		Removed: []models.Package{{Name: "linux-image-5.15.0-91-generic", Version: "5.15.0-91.101"}},
+		Upgraded: []PackageChange{
+			{Name: "apt", From: "2.4.11", To: "2.4.12"},
+			{Name: "libc6", From: "2.35-0ubuntu3.7", To: "2.35-0ubuntu3.8"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+
+	same := DiffPackages(from, from)
+	if same.Added == nil || len(same.Added)+len(same.Removed)+len(same.Upgraded) != 0 {
+		t.Errorf("identical lists: %+v", same)
+	}
+}
@@ -0,0 +1,109 @@
+// Package inventory reads what is installed on a host over SSH: the dpkg
+// package list, cached in host_packages so paging through a few thousand
+// entries costs one SSH round trip rather than one per page, and the state
+// of unattended-upgrades.
+package inventory
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"ubuntu-auto-update/backend/pkg/db"
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+// Command lists every package dpkg knows about, one "name<TAB>version" line
+// each. dpkg-query expands the \t and \n itself. It needs no root.
+const Command = `dpkg-query -W -f='${Package}\t${Version}\n'`
+
+// CacheTTL is how long a stored inventory is served before the next request
+// refetches it. ponytail: fixed; ?refresh=true covers "I just installed
+// something".
+const CacheTTL = 15 * time.Minute
+
+// Parse reads dpkg-query output in Command's format. A line with an empty
+// version (dpkg knows the package but has no version of it, e.g. purged) is
+// skipped; nothing else is filtered, so a removed package whose config files
+// remain is listed, and a multiarch package appears once per architecture.
+// Blank lines and trailing CRs are ignored. A line without a tab or a name is
+// an error.
+func Parse(r io.Reader) ([]models.Package, error) {
+	pkgs := []models.Package{}
+	sc := bufio.NewScanner(r)
+	line := 0
+	for sc.Scan() {
+		line++
+		text := strings.TrimRight(sc.Text(), "\r")
+		if text == "" {
+			continue
+		}
+		name, version, ok := strings.Cut(text, "\t")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("dpkg-query line %d: want name<TAB>version, got %q", line, text)
+		}
+		if version == "" {
+			continue
+		}
+		pkgs = append(pkgs, models.Package{Name: name, Version: version})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read dpkg-query output: %w", err)
+	}
+	return pkgs, nil
+}
+
+// Fetch runs Command on client and parses its output.
+func Fetch(client *gossh.Client) ([]models.Package, error) {
+	sess, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("create ssh session: %w", err)
+	}
+	defer sess.Close()
+	out, err := sess.Output(Command)
+	if err != nil {
+		return nil, fmt.Errorf("dpkg-query: %w", err)
+	}
+	return Parse(bytes.NewReader(out))
+}
+
+// Cached returns the stored inventory for a host and when it was read, or
+// pgx.ErrNoRows if the host has never been inventoried.
+func Cached(ctx context.Context, dbx db.DBTX, hostID int32) ([]models.Package, time.Time, error) {
+	var raw []byte
+	var fetchedAt time.Time
+	err := dbx.QueryRow(ctx, `SELECT packages, fetched_at FROM host_packages WHERE host_id = $1`, hostID).
+		Scan(&raw, &fetchedAt)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var pkgs []models.Package
+	if err := json.Unmarshal(raw, &pkgs); err != nil {
+		return nil, time.Time{}, fmt.Errorf("decode cached packages for host %d: %w", hostID, err)
+	}
+	return pkgs, fetchedAt, nil
+}
+
+// Store replaces the cached inventory for a host and returns its timestamp.
+func Store(ctx context.Context, dbx db.DBTX, hostID int32, pkgs []models.Package) (time.Time, error) {
+	raw, err := json.Marshal(pkgs)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var fetchedAt time.Time
+	err = dbx.QueryRow(ctx, `
+		INSERT INTO host_packages (host_id, packages, fetched_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (host_id) DO UPDATE
+		SET packages = EXCLUDED.packages, fetched_at = EXCLUDED.fetched_at
+		RETURNING fetched_at
+	`, hostID, raw).Scan(&fetchedAt)
+	return fetchedAt, err
+}
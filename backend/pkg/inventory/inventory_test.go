@@ -0,0 +1,55 @@
+package inventory
+
+import (
+	"strings"
+	"testing"
+
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+func TestParse(t *testing.T) {
+	// Trimmed from a real Ubuntu 22.04 host: epochs, tildes, multiarch
+	// duplicates and a package dpkg knows of but has no version for.
+	out := "adduser\t3.118ubuntu5\n" +
+		"apt\t2.4.12\n" +
+		"libc6\t2.35-0ubuntu3.8\n" +
+		"libc6\t2.35-0ubuntu3.8\n" +
+		"linux-image-5.15.0-91-generic\t\n" +
+		"openssh-server\t1:8.9p1-3ubuntu0.10\n" +
+		"\n" +
+		"tzdata\t2024a-0ubuntu0.22.04~1\r\n"
+
+	got, err := Parse(strings.NewReader(out))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	want := []models.Package{
+		{Name: "adduser", Version: "3.118ubuntu5"},
+		{Name: "apt", Version: "2.4.12"},
+		{Name: "libc6", Version: "2.35-0ubuntu3.8"},
+		{Name: "libc6", Version: "2.35-0ubuntu3.8"},
+		{Name: "openssh-server", Version: "1:8.9p1-3ubuntu0.10"},
+		{Name: "tzdata", Version: "2024a-0ubuntu0.22.04~1"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d packages, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("package %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParse_Empty(t *testing.T) {
+	got, err := Parse(strings.NewReader(""))
+	if err != nil || got == nil || len(got) != 0 {
+		t.Fatalf("Parse(\"\") = %v, %v; want empty non-nil slice", got, err)
+	}
+}
+
+func TestParse_Malformed(t *testing.T) {
+	if _, err := Parse(strings.NewReader("apt\t2.4.12\ndpkg-query: no packages found\n")); err == nil {
+		t.Fatal("expected an error for a line without a tab")
+	}
+}
@@ -0,0 +1,128 @@
+package inventory
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"ubuntu-auto-update/backend/pkg/db"
+)
+
+// UnattendedCommand reports whether unattended-upgrades is installed and
+// enabled, the host's UTC offset, and the tail of its log (the rotated file
+// too, so a run just before logrotate isn't lost). It exits 0 either way and
+// needs no root: the log is world-readable on stock Ubuntu.
+const UnattendedCommand = `if ! dpkg-query -W -f='${Status}' unattended-upgrades 2>/dev/null | grep -q ' installed$'; then echo installed=0; exit 0; fi
+echo installed=1
+echo "tz=$(date +%z)"
+apt-config shell UU APT::Periodic::Unattended-Upgrade
+echo '--- log'
+cat /var/log/unattended-upgrades/unattended-upgrades.log.1 /var/log/unattended-upgrades/unattended-upgrades.log 2>/dev/null | tail -n 500
+exit 0`
+
+// uuRunStart is the line unattended-upgrade logs at the start of every run.
+const uuRunStart = "Starting unattended upgrades script"
+
+// UnattendedStatus is what the last probe found on a host.
+type UnattendedStatus struct {
+	HostID    int32      `json:"host_id" db:"host_id"`
+	Installed bool       `json:"installed" db:"installed"`
+	Enabled   bool       `json:"enabled" db:"enabled"`
+	LastRun   *time.Time `json:"last_run" db:"last_run"`
+	CheckedAt time.Time  `json:"checked_at" db:"checked_at"`
+}
+
+// ParseUnattended reads UnattendedCommand's output. Enabled follows
+// APT::Periodic::Unattended-Upgrade: any value other than unset or "0" turns
+// the daily run on. LastRun is the newest "Starting unattended upgrades
+// script" line, read in the host's zone; nil if the log has none.
+func ParseUnattended(out string) (UnattendedStatus, error) {
+	var st UnattendedStatus
+	loc := time.UTC
+	sawInstalled, inLog := false, false
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if inLog {
+			if !strings.Contains(line, uuRunStart) || len(line) < len("2006-01-02 15:04:05") {
+				continue
+			}
+			if t, err := time.ParseInLocation("2006-01-02 15:04:05", line[:19], loc); err == nil {
+				t = t.UTC()
+				st.LastRun = &t
+			}
+			continue
+		}
+		switch {
+		case line == "installed=0", line == "installed=1":
+			st.Installed = line == "installed=1"
+			sawInstalled = true
+		case strings.HasPrefix(line, "tz="):
+			if z, err := time.Parse("-0700", strings.TrimPrefix(line, "tz=")); err == nil {
+				_, offset := z.Zone()
+				loc = time.FixedZone("", offset)
+			}
+		case strings.HasPrefix(line, "UU="):
+			v := strings.Trim(strings.TrimPrefix(line, "UU="), "'")
+			st.Enabled = v != "" && v != "0"
+		case line == "--- log":
+			inLog = true
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return UnattendedStatus{}, err
+	}
+	if !sawInstalled {
+		return UnattendedStatus{}, fmt.Errorf("unexpected unattended-upgrades probe output %q", firstLine(out))
+	}
+	return st, nil
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
+
+// FetchUnattended runs UnattendedCommand on client and parses the result.
+func FetchUnattended(client *gossh.Client) (UnattendedStatus, error) {
+	sess, err := client.NewSession()
+	if err != nil {
+		return UnattendedStatus{}, fmt.Errorf("create ssh session: %w", err)
+	}
+	defer sess.Close()
+	out, err := sess.Output(UnattendedCommand)
+	if err != nil {
+		return UnattendedStatus{}, fmt.Errorf("probe unattended-upgrades: %w", err)
+	}
+	return ParseUnattended(string(out))
+}
+
+// GetUnattended returns the stored status, or pgx.ErrNoRows if the host
+// has never been probed.
+func GetUnattended(ctx context.Context, dbx db.DBTX, hostID int32) (UnattendedStatus, error) {
+	var st UnattendedStatus
+	err := dbx.QueryRow(ctx, `
+		SELECT host_id, installed, enabled, last_run, checked_at
+		FROM host_unattended_upgrades WHERE host_id = $1
+	`, hostID).Scan(&st.HostID, &st.Installed, &st.Enabled, &st.LastRun, &st.CheckedAt)
+	return st, err
+}
+
+// StoreUnattended records a probe result for hostID and returns the stored
+// row.
+func StoreUnattended(ctx context.Context, dbx db.DBTX, hostID int32, st UnattendedStatus) (UnattendedStatus, error) {
+	out := UnattendedStatus{HostID: hostID}
+	err := dbx.QueryRow(ctx, `
+		INSERT INTO host_unattended_upgrades (host_id, installed, enabled, last_run, checked_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (host_id) DO UPDATE
+		SET installed = EXCLUDED.installed, enabled = EXCLUDED.enabled,
+		    last_run = EXCLUDED.last_run, checked_at = EXCLUDED.checked_at
+		RETURNING installed, enabled, last_run, checked_at
+	`, hostID, st.Installed, st.Enabled, st.LastRun).Scan(&out.Installed, &out.Enabled, &out.LastRun, &out.CheckedAt)
+	return out, err
+}
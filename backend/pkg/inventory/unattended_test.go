@@ -0,0 +1,68 @@
+package inventory
+
+import (
+	"testing"
+	"time"
+)
+
+// A stock 22.04 host with UTC+2 local time. The rotated log holds an older
+// run; the current log's newest run is the one that counts.
+const sampleUnattended = `installed=1
+tz=+0200
+UU='1'
+--- log
+2024-03-10 06:41:07,118 INFO Starting unattended upgrades script
+2024-03-10 06:41:07,119 INFO Allowed origins are: o=Ubuntu,a=jammy, o=Ubuntu,a=jammy-security, o=UbuntuESMApps,a=jammy-apps-security, o=UbuntuESM,a=jammy-infra-security
+2024-03-10 06:41:11,950 INFO No packages found that can be upgraded unattended and no pending auto-removals
+2024-03-11 06:23:11,592 INFO Starting unattended upgrades script
+2024-03-11 06:23:11,593 INFO Allowed origins are: o=Ubuntu,a=jammy, o=Ubuntu,a=jammy-security
+2024-03-11 06:23:11,593 INFO Initial blacklist:
+2024-03-11 06:23:11,593 INFO Initial whitelist (not strict):
+2024-03-11 06:23:19,302 INFO Packages that will be upgraded: libssl3 openssl
+2024-03-11 06:23:19,302 INFO Writing dpkg log to /var/log/unattended-upgrades/unattended-upgrades-dpkg.log
+2024-03-11 06:23:31,774 INFO All upgrades installed
+`
+
+func TestParseUnattended(t *testing.T) {
+	st, err := ParseUnattended(sampleUnattended)
+	if err != nil {
+		t.Fatalf("ParseUnattended: %v", err)
+	}
+	if !st.Installed || !st.Enabled {
+		t.Errorf("installed=%v enabled=%v, want both true", st.Installed, st.Enabled)
+	}
+	want := time.Date(2024, 3, 11, 4, 23, 11, 0, time.UTC)
+	if st.LastRun == nil || !st.LastRun.Equal(want) {
+		t.Errorf("LastRun = %v, want %v", st.LastRun, want)
+	}
+}
+
+func TestParseUnattended_Variants(t *testing.T) {
+	cases := []struct {
+		name               string
+		out                string
+		installed, enabled bool
+		noLastRun          bool
+	}{
+		{"not installed", "installed=0\n", false, false, true},
+		{"disabled", "installed=1\ntz=+0000\nUU='0'\n--- log\n", true, false, true},
+		{"periodic key unset", "installed=1\ntz=+0000\n--- log\n", true, false, true},
+		{"enabled, never ran", "installed=1\ntz=-0500\nUU='1'\n--- log\n", true, true, true},
+	}
+	for _, c := range cases {
+		st, err := ParseUnattended(c.out)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if st.Installed != c.installed || st.Enabled != c.enabled || (st.LastRun == nil) != c.noLastRun {
+			t.Errorf("%s: got %+v", c.name, st)
+		}
+	}
+}
+
+func TestParseUnattended_Garbage(t *testing.T) {
+	if _, err := ParseUnattended("bash: dpkg-query: command not found\n"); err == nil {
+		t.Fatal("expected an error for output without installed=")
+	}
+}
@@ -0,0 +1,168 @@
+// Package maintenance stores maintenance windows and decides which hosts may
+// be updated right now. Automatic runs (API schedules, AUTO_UPDATE_SCHEDULE)
+// and the bulk endpoint consult Gate; a single-host run-update does not, so
+// an operator can still patch one box out of hours.
+package maintenance
+
+import (
+	"context"
+	"time"
+	_ "time/tzdata" // the runtime image has no zoneinfo; windows name IANA zones
+
+	"github.com/jackc/pgx/v5"
+
+	"ubuntu-auto-update/backend/pkg/db"
+)
+
+// SkipReason is reported for hosts Gate holds back.
+const SkipReason = "skipped: outside maintenance window"
+
+// Window is one recurring maintenance window. HostID nil means global.
+type Window struct {
+	ID          int32     `json:"id" db:"id"`
+	Name        string    `json:"name" db:"name"`
+	HostID      *int32    `json:"host_id" db:"host_id"`
+	StartMinute int32     `json:"start_minute" db:"start_minute"`
+	EndMinute   int32     `json:"end_minute" db:"end_minute"`
+	Days        int16     `json:"days" db:"days"` // bit 0 = Sunday … bit 6 = Saturday
+	Timezone    string    `json:"timezone" db:"timezone"`
+	CreatedBy   string    `json:"created_by" db:"created_by"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+}
+
+const cols = `id, name, host_id, start_minute, end_minute, days, timezone, created_by, created_at`
+
+// Contains reports whether t falls inside the window in its own timezone.
+// An unknown timezone never matches, which holds updates back rather than
+// running them at a time nobody intended.
+func (w Window) Contains(t time.Time) bool {
+	loc, err := time.LoadLocation(w.Timezone)
+	if err != nil {
+		return false
+	}
+	return InDailyWindow(int(w.StartMinute), int(w.EndMinute), w.Days, t.In(loc))
+}
+
+// InDailyWindow reports whether t (already in the window's zone) lies in the
+// daily window [start, end) minutes since midnight on a day selected by the
+// days bitmask. A window that wraps midnight (start > end) belongs to its
+// start day: with days = Sat only and 22:00–02:00, Sunday 01:00 is IN.
+func InDailyWindow(start, end int, days int16, t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	dayOK := func(d time.Weekday) bool { return days&(1<<uint(d)) != 0 }
+	if start <= end {
+		return dayOK(t.Weekday()) && minute >= start && minute < end
+	}
+	if minute >= start {
+		return dayOK(t.Weekday())
+	}
+	if minute < end {
+		return dayOK(t.AddDate(0, 0, -1).Weekday())
+	}
+	return false
+}
+
+func List(ctx context.Context, dbx db.DBTX) ([]Window, error) {
+	rows, err := dbx.Query(ctx, `SELECT `+cols+` FROM maintenance_windows ORDER BY host_id NULLS FIRST, id`)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := pgx.CollectRows(rows, pgx.RowToStructByName[Window])
+	if err != nil {
+		return nil, err
+	}
+	if ws == nil {
+		ws = []Window{}
+	}
+	return ws, nil
+}
+
+// Create inserts w; ID and CreatedAt are assigned by the database.
+func Create(ctx context.Context, dbx db.DBTX, w Window) (Window, error) {
+	rows, err := dbx.Query(ctx, `
+		INSERT INTO maintenance_windows (name, host_id, start_minute, end_minute, days, timezone, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING `+cols,
+		w.Name, w.HostID, w.StartMinute, w.EndMinute, w.Days, w.Timezone, w.CreatedBy)
+	if err != nil {
+		return Window{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[Window])
+}
+
+// Update replaces the editable fields of window w.ID, or returns
+// pgx.ErrNoRows when it doesn't exist.
+func Update(ctx context.Context, dbx db.DBTX, w Window) (Window, error) {
+	rows, err := dbx.Query(ctx, `
+		UPDATE maintenance_windows
+		SET name = $2, host_id = $3, start_minute = $4, end_minute = $5, days = $6, timezone = $7
+		WHERE id = $1
+		RETURNING `+cols,
+		w.ID, w.Name, w.HostID, w.StartMinute, w.EndMinute, w.Days, w.Timezone)
+	if err != nil {
+		return Window{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByName[Window])
+}
+
+func Delete(ctx context.Context, dbx db.DBTX, id int32) (int64, error) {
+	tag, err := dbx.Exec(ctx, `DELETE FROM maintenance_windows WHERE id = $1`, id)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// Skipped names a host Gate held back.
+type Skipped struct {
+	HostID int32  `json:"host_id"`
+	Reason string `json:"reason"`
+}
+
+// Gate splits hostIDs into those allowed to update at now and those outside
+// their maintenance window. A host's own windows override the global ones;
+// a host with neither is always allowed. Order of hostIDs is preserved.
+func Gate(ctx context.Context, dbx db.DBTX, hostIDs []int32, now time.Time) ([]int32, []Skipped, error) {
+	rows, err := dbx.Query(ctx, `SELECT `+cols+` FROM maintenance_windows WHERE host_id IS NULL OR host_id = ANY($1)`, hostIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	windows, err := pgx.CollectRows(rows, pgx.RowToStructByName[Window])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var global []Window
+	perHost := map[int32][]Window{}
+	for _, w := range windows {
+		if w.HostID == nil {
+			global = append(global, w)
+		} else {
+			perHost[*w.HostID] = append(perHost[*w.HostID], w)
+		}
+	}
+
+	allowed := make([]int32, 0, len(hostIDs))
+	var skipped []Skipped
+	for _, id := range hostIDs {
+		applicable := perHost[id]
+		if len(applicable) == 0 {
+			applicable = global
+		}
+		if len(applicable) == 0 || anyContains(applicable, now) {
+			allowed = append(allowed, id)
+		} else {
+			skipped = append(skipped, Skipped{HostID: id, Reason: SkipReason})
+		}
+	}
+	return allowed, skipped, nil
+}
+
+func anyContains(ws []Window, now time.Time) bool {
+	for _, w := range ws {
+		if w.Contains(now) {
+			return true
+		}
+	}
+	return false
+}
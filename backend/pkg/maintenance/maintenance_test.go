@@ -0,0 +1,89 @@
+package maintenance_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock/v4"
+
+	"ubuntu-auto-update/backend/pkg/maintenance"
+)
+
+func windowRows(mock pgxmock.PgxPoolIface) *pgxmock.Rows {
+	return mock.NewRows([]string{"id", "name", "host_id", "start_minute", "end_minute", "days", "timezone", "created_by", "created_at"})
+}
+
+func TestWindowContains(t *testing.T) {
+	// Tuesday 2026-07-07 01:00 UTC is 03:00 in Berlin (CEST) and Monday
+	// 21:00 in New York (EDT).
+	tue0100 := time.Date(2026, 7, 7, 1, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		w    maintenance.Window
+		want bool
+	}{
+		{"utc inside", maintenance.Window{StartMinute: 0, EndMinute: 120, Days: 127, Timezone: "UTC"}, true},
+		{"utc outside", maintenance.Window{StartMinute: 180, EndMinute: 300, Days: 127, Timezone: "UTC"}, false},
+		{"berlin 02-04 inside", maintenance.Window{StartMinute: 120, EndMinute: 240, Days: 127, Timezone: "Europe/Berlin"}, true},
+		{"berlin 00-02 outside", maintenance.Window{StartMinute: 0, EndMinute: 120, Days: 127, Timezone: "Europe/Berlin"}, false},
+		{"new york monday evening", maintenance.Window{StartMinute: 1200, EndMinute: 1380, Days: 1 << 1, Timezone: "America/New_York"}, true},
+		{"new york tuesday only", maintenance.Window{StartMinute: 1200, EndMinute: 1380, Days: 1 << 2, Timezone: "America/New_York"}, false},
+		{"wraps from monday", maintenance.Window{StartMinute: 1320, EndMinute: 120, Days: 1 << 1, Timezone: "UTC"}, true},
+		{"unknown timezone", maintenance.Window{StartMinute: 0, EndMinute: 120, Days: 127, Timezone: "Mars/Olympus"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.w.Contains(tue0100); got != tt.want {
+			t.Errorf("%s: Contains = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGate(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+
+	tue0100 := time.Date(2026, 7, 7, 1, 0, 0, 0, time.UTC)
+	host2, host3 := int32(2), int32(3)
+	// Global window 00:00–02:00 UTC (open); host 2 overrides it with
+	// 03:00–05:00 (closed); host 3 has its own open window.
+	mock.ExpectQuery(`FROM maintenance_windows WHERE host_id IS NULL OR host_id = ANY\(\$1\)`).
+		WithArgs([]int32{1, 2, 3}).
+		WillReturnRows(windowRows(mock).
+			AddRow(int32(1), "global", nil, int32(0), int32(120), int16(127), "UTC", "admin", tue0100).
+			AddRow(int32(2), "db", &host2, int32(180), int32(300), int16(127), "UTC", "admin", tue0100).
+			AddRow(int32(3), "web", &host3, int32(60), int32(90), int16(127), "UTC", "admin", tue0100))
+
+	allowed, skipped, err := maintenance.Gate(context.Background(), mock, []int32{1, 2, 3}, tue0100)
+	if err != nil {
+		t.Fatalf("Gate: %v", err)
+	}
+	if len(allowed) != 2 || allowed[0] != 1 || allowed[1] != 3 {
+		t.Errorf("allowed = %v, want [1 3]", allowed)
+	}
+	if len(skipped) != 1 || skipped[0].HostID != 2 || skipped[0].Reason != maintenance.SkipReason {
+		t.Errorf("skipped = %+v, want host 2", skipped)
+	}
+}
+
+func TestGate_NoWindowsAllowsAll(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+
+	mock.ExpectQuery(`FROM maintenance_windows`).WithArgs([]int32{4, 5}).WillReturnRows(windowRows(mock))
+
+	allowed, skipped, err := maintenance.Gate(context.Background(), mock, []int32{4, 5}, time.Now())
+	if err != nil {
+		t.Fatalf("Gate: %v", err)
+	}
+	if len(allowed) != 2 || len(skipped) != 0 {
+		t.Errorf("allowed = %v, skipped = %v", allowed, skipped)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net/http"
-	"os"
 	"strings"
 	"sync"
 	"time"
@@ -33,10 +32,14 @@ type User struct {
 type AuthConfig struct {
 	CookieName   string
 	RequiredRole string
+
+	// RefreshTokenExpiry bounds how long a login can be renewed without
+	// credentials. main sets it from REFRESH_TOKEN_EXPIRY.
+	RefreshTokenExpiry time.Duration
 }
 
 func NewAuthConfig() *AuthConfig {
-	return &AuthConfig{CookieName: "auth_token"}
+	return &AuthConfig{CookieName: "auth_token", RefreshTokenExpiry: session.DefaultRefreshExpiry}
 }
 
 // ---------------------------------------------------------------------------
@@ -120,28 +123,56 @@ func GenerateSecureToken() (string, error) {
 // ---------------------------------------------------------------------------
 
 func SetAuthCookie(w http.ResponseWriter, config *AuthConfig, tokenString string) {
-	isProduction := os.Getenv("ENVIRONMENT") == "production"
-	// #nosec G124 -- Secure intentionally tracks ENVIRONMENT; dev runs over plain http.
+	// #nosec G124 -- Secure intentionally tracks ENVIRONMENT/ENABLE_HTTPS; dev runs over plain http.
 	http.SetCookie(w, &http.Cookie{
 		Name:     config.CookieName,
 		Value:    tokenString,
 		Path:     "/",
 		HttpOnly: true,
-		Secure:   isProduction,
+		Secure:   secureCookies(),
 		SameSite: http.SameSiteLaxMode,
 		MaxAge:   86400,
 	})
 }
 
+// RefreshCookieName carries the refresh token for browser clients. It is
+// only sent to /api/v1 (refresh and logout need it) and never cross-site.
+const RefreshCookieName = "refresh_token"
+
+func SetRefreshCookie(w http.ResponseWriter, config *AuthConfig, token string) {
+	// #nosec G124 -- Secure intentionally tracks ENVIRONMENT/ENABLE_HTTPS; dev runs over plain http.
+	http.SetCookie(w, &http.Cookie{
+		Name:     RefreshCookieName,
+		Value:    token,
+		Path:     "/api/v1",
+		HttpOnly: true,
+		Secure:   secureCookies(),
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(config.RefreshTokenExpiry.Seconds()),
+	})
+}
+
+func ClearRefreshCookie(w http.ResponseWriter) {
+	// #nosec G124 -- Secure intentionally tracks ENVIRONMENT/ENABLE_HTTPS; dev runs over plain http.
+	http.SetCookie(w, &http.Cookie{
+		Name:     RefreshCookieName,
+		Value:    "",
+		Path:     "/api/v1",
+		HttpOnly: true,
+		Secure:   secureCookies(),
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   -1,
+	})
+}
+
 func ClearAuthCookie(w http.ResponseWriter, config *AuthConfig) {
-	isProduction := os.Getenv("ENVIRONMENT") == "production"
-	// #nosec G124 -- Secure intentionally tracks ENVIRONMENT; dev runs over plain http.
+	// #nosec G124 -- Secure intentionally tracks ENVIRONMENT/ENABLE_HTTPS; dev runs over plain http.
 	http.SetCookie(w, &http.Cookie{
 		Name:     config.CookieName,
 		Value:    "",
 		Path:     "/",
 		HttpOnly: true,
-		Secure:   isProduction,
+		Secure:   secureCookies(),
 		SameSite: http.SameSiteLaxMode,
 		MaxAge:   -1,
 	})
@@ -193,12 +224,12 @@ func extractToken(r *http.Request, cookieName string) string {
 	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
 		return strings.TrimPrefix(h, "Bearer ")
 	}
-	// CSWSH defense: WebSockets ignore cookies and require the token in the query
-	// string. The browser's WebSocket API doesn't allow setting custom headers,
-	// but an attacker exploiting a crafted page can't guess the token to put it
-	// in the URL.
-	if strings.ToLower(r.Header.Get("Upgrade")) == "websocket" {
-		return r.URL.Query().Get("token")
+	// CSWSH defense: WebSockets ignore cookies and require the token in the
+	// handshake itself. The browser's WebSocket API doesn't allow setting
+	// custom headers, but an attacker exploiting a crafted page can't guess
+	// the token to put it there.
+	if IsWebSocketUpgrade(r) {
+		return WebSocketToken(r)
 	}
 	if cookie, err := r.Cookie(cookieName); err == nil && cookie.Value != "" {
 		return cookie.Value
@@ -206,6 +237,38 @@ func extractToken(r *http.Request, cookieName string) string {
 	return ""
 }
 
+// WSTokenProtocol marks a bearer token carried in Sec-WebSocket-Protocol:
+// the client offers [WSTokenProtocol, <token>] and the server selects
+// WSTokenProtocol. Unlike ?token=, this keeps the credential out of URLs and
+// therefore out of proxy and access logs.
+const WSTokenProtocol = "uau.bearer"
+
+// IsWebSocketUpgrade reports whether r is a WebSocket handshake.
+func IsWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// WebSocketToken returns the credential a WebSocket handshake carries, from
+// the ?token= query parameter or the WSTokenProtocol subprotocol pair.
+// Cookies are never consulted.
+func WebSocketToken(r *http.Request) string {
+	if tok := r.URL.Query().Get("token"); tok != "" {
+		return tok
+	}
+	var offered []string
+	for _, h := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(h, ",") {
+			offered = append(offered, strings.TrimSpace(p))
+		}
+	}
+	for i := 0; i+1 < len(offered); i++ {
+		if offered[i] == WSTokenProtocol {
+			return offered[i+1]
+		}
+	}
+	return ""
+}
+
 // TokenAuthMiddleware validates against the legacy TokenStore. Preserved for
 // tests and dev. New deployments should use SessionAuthMiddleware.
 func TokenAuthMiddleware(store *TokenStore, config *AuthConfig) func(http.Handler) http.Handler {
@@ -242,15 +305,17 @@ func TokenAuthMiddleware(store *TokenStore, config *AuthConfig) func(http.Handle
 	}
 }
 
-// APITokenValidator resolves a presented long-lived API token (uat_… prefix)
-// to a principal. Implemented in cmd/api over pkg/apitokens; optional so
-// tests and legacy setups run without it.
+// APITokenValidator resolves a presented long-lived token to a principal:
+// an API token (uat_… prefix) or an agent token issued at enrollment
+// (uag_…). Implemented in cmd/api over pkg/apitokens and pkg/db; optional
+// so tests and legacy setups run without it.
 type APITokenValidator func(ctx context.Context, token string) (session.Principal, bool, error)
 
 // SessionAuthMiddleware validates against a pkg/session.Store. This is the
 // production path: it gives us shared state across replicas, agent vs. user
 // distinction, and richer principal data (role, user id, session id).
-// An optional APITokenValidator handles uat_-prefixed API tokens.
+// An optional APITokenValidator handles uat_ API tokens and uag_ agent
+// tokens.
 func SessionAuthMiddleware(store session.Store, config *AuthConfig, pats ...APITokenValidator) func(http.Handler) http.Handler {
 	var pat APITokenValidator
 	if len(pats) > 0 {
@@ -263,7 +328,8 @@ func SessionAuthMiddleware(store session.Store, config *AuthConfig, pats ...APIT
 				SendAuthError(w, "No authentication token provided")
 				return
 			}
-			if pat != nil && strings.HasPrefix(tok, "uat_") {
+			agent := strings.HasPrefix(tok, "uag_")
+			if pat != nil && (agent || strings.HasPrefix(tok, "uat_")) {
 				p, ok, err := pat(r.Context(), tok)
 				if err != nil {
 					log.Errorf("api token validate: %v", err)
@@ -271,7 +337,11 @@ func SessionAuthMiddleware(store session.Store, config *AuthConfig, pats ...APIT
 					return
 				}
 				if !ok {
-					SendAuthError(w, "Invalid API token")
+					if agent {
+						SendAuthError(w, "Invalid, expired or revoked agent token")
+					} else {
+						SendAuthError(w, "Invalid API token")
+					}
 					return
 				}
 				ctx := context.WithValue(r.Context(), PrincipalContextKey, &p)
@@ -289,6 +359,16 @@ func SessionAuthMiddleware(store session.Store, config *AuthConfig, pats ...APIT
 				SendAuthError(w, "Invalid or expired authentication token")
 				return
 			}
+			// Agents used to get a session at enroll, naming their host only
+			// by hostname. They now hold agent tokens; a session left over
+			// from before is dropped and the agent has to enroll again.
+			if p.IsAgent() {
+				if err := store.Revoke(r.Context(), tok); err != nil {
+					log.Warnf("revoke legacy agent session: %v", err)
+				}
+				SendAuthError(w, "Agent session expired; enroll again for an agent token")
+				return
+			}
 
 			ctx := context.WithValue(r.Context(), PrincipalContextKey, &p)
 			// Legacy compatibility for handlers still reading User.
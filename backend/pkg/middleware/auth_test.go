@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"ubuntu-auto-update/backend/pkg/session"
+)
+
+// wsAuthServer serves a WebSocket endpoint behind SessionAuthMiddleware and
+// returns a valid session token for it.
+func wsAuthServer(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+	store := session.NewMemoryStore()
+	tok, err := store.Create(context.Background(), session.Principal{Username: "alice", Role: session.RoleOperator}, time.Hour, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upgrader := websocket.Upgrader{Subprotocols: []string{WSTokenProtocol}}
+	h := SessionAuthMiddleware(store, NewAuthConfig())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if GetUserFromContext(r) == nil {
+			t.Error("handler reached without a principal")
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	return ts, tok
+}
+
+func TestSessionAuth_WebSocketHandshake(t *testing.T) {
+	ts, tok := wsAuthServer(t)
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	t.Run("query token", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?token="+tok, nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		conn.Close()
+	})
+
+	t.Run("subprotocol token", func(t *testing.T) {
+		d := websocket.Dialer{Subprotocols: []string{WSTokenProtocol, tok}}
+		conn, _, err := d.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		if conn.Subprotocol() != WSTokenProtocol {
+			t.Errorf("selected subprotocol = %q, want %q", conn.Subprotocol(), WSTokenProtocol)
+		}
+	})
+
+	for name, hdr := range map[string]http.Header{
+		"no credentials": nil,
+		// Cookies ride along on cross-site handshakes, so they never count.
+		"cookie only": {"Cookie": {"auth_token=" + tok}},
+		"bad token":   {"Sec-WebSocket-Protocol": {WSTokenProtocol + ", not-a-session"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, resp, err := websocket.DefaultDialer.Dial(wsURL, hdr)
+			if err == nil {
+				t.Fatal("unauthenticated handshake was upgraded")
+			}
+			if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("expected 401 before upgrade, got %+v", resp)
+			}
+		})
+	}
+}
+
+// A session an agent got at enroll, before agent tokens, is refused and
+// dropped from the store.
+func TestSessionAuth_DropsLegacyAgentSession(t *testing.T) {
+	store := session.NewMemoryStore()
+	tok, err := store.Create(context.Background(), session.Principal{AgentLabel: "web-1", Username: "agent:web-1", Role: session.RoleAgent}, time.Hour, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := SessionAuthMiddleware(store, NewAuthConfig())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler reached with a legacy agent session")
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/report", nil)
+	req.Header.Set("Authorization", "Bearer "+tok)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", rr.Code)
+	}
+	if _, ok, _ := store.Validate(context.Background(), tok); ok {
+		t.Error("legacy agent session still in the store")
+	}
+}
+
+func TestWebSocketToken(t *testing.T) {
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.Header.Set("Sec-WebSocket-Protocol", "chat, "+WSTokenProtocol+", abc123")
+	if got := WebSocketToken(r); got != "abc123" {
+		t.Errorf("subprotocol token = %q", got)
+	}
+	r.Header.Set("Sec-WebSocket-Protocol", WSTokenProtocol)
+	if got := WebSocketToken(r); got != "" {
+		t.Errorf("marker without a token should yield nothing, got %q", got)
+	}
+}
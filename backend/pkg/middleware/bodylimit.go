@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// MaxBodySize caps every request body at limit bytes. A declared
+// Content-Length over the limit is refused with 413 before the handler runs;
+// chunked or understated bodies are cut off by http.MaxBytesReader, whose
+// *http.MaxBytesError handlers map to 413 themselves.
+//
+// WebSocket frames are not request bodies; handlers that read them set
+// conn.SetReadLimit instead.
+func MaxBodySize(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				SendErrorResponse(w, http.StatusRequestEntityTooLarge, "payload_too_large",
+					fmt.Sprintf("Request body exceeds %d bytes", limit), nil)
+				return
+			}
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = http.MaxBytesReader(w, r.Body, limit)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"mime"
+	"net/http"
+)
+
+// RequireJSON refuses POST, PUT and PATCH requests whose body is not
+// declared as application/json with 415. Requests without a body (action
+// endpoints such as test-connection) pass through whatever their header
+// says, so callers don't have to invent one.
+func RequireJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength == 0 || r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mt != "application/json" {
+			SendErrorResponse(w, http.StatusUnsupportedMediaType, "unsupported_media_type",
+				"Content-Type must be application/json", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
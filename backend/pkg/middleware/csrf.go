@@ -36,16 +36,16 @@ func GenerateCSRFToken() (string, error) {
 }
 
 // SetCSRFCookie writes the CSRF token cookie. NOT HttpOnly: the browser JS
-// reads this and echoes it as a header. Secure follows ENVIRONMENT=production
-// to match the auth cookie's policy.
+// reads this and echoes it as a header. Secure follows secureCookies to match
+// the auth cookie's policy.
 func SetCSRFCookie(w http.ResponseWriter, token string) {
-	// #nosec G124 -- HttpOnly=false is required (JS echoes the token); Secure tracks ENVIRONMENT.
+	// #nosec G124 -- HttpOnly=false is required (JS echoes the token); Secure tracks ENVIRONMENT/ENABLE_HTTPS.
 	http.SetCookie(w, &http.Cookie{
 		Name:     CSRFCookieName,
 		Value:    token,
 		Path:     "/",
 		HttpOnly: false,
-		Secure:   isProduction(),
+		Secure:   secureCookies(),
 		SameSite: http.SameSiteStrictMode,
 		MaxAge:   86400,
 	})
@@ -53,13 +53,13 @@ func SetCSRFCookie(w http.ResponseWriter, token string) {
 
 // ClearCSRFCookie wipes the cookie on logout.
 func ClearCSRFCookie(w http.ResponseWriter) {
-	// #nosec G124 -- HttpOnly=false is required (JS echoes the token); Secure tracks ENVIRONMENT.
+	// #nosec G124 -- HttpOnly=false is required (JS echoes the token); Secure tracks ENVIRONMENT/ENABLE_HTTPS.
 	http.SetCookie(w, &http.Cookie{
 		Name:     CSRFCookieName,
 		Value:    "",
 		Path:     "/",
 		HttpOnly: false,
-		Secure:   isProduction(),
+		Secure:   secureCookies(),
 		SameSite: http.SameSiteLaxMode,
 		MaxAge:   -1,
 	})
@@ -69,6 +69,13 @@ func isProduction() bool {
 	return os.Getenv("ENVIRONMENT") == "production"
 }
 
+// secureCookies reports whether cookies should carry the Secure flag: always
+// in production (TLS may be terminated upstream), and whenever the API serves
+// HTTPS itself.
+func secureCookies() bool {
+	return isProduction() || os.Getenv("ENABLE_HTTPS") == "true"
+}
+
 // CSRFMiddleware enforces the double-submit pattern for state-changing
 // cookie-authenticated requests. Bearer-auth requests pass through unchecked.
 func CSRFMiddleware(authCookieName string) func(http.Handler) http.Handler {
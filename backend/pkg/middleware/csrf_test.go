@@ -75,3 +75,14 @@ func TestGenerateCSRFTokenUnique(t *testing.T) {
 		t.Errorf("bad CSRF tokens %s %s", a, b)
 	}
 }
+
+func TestSetCSRFCookie_SecureWhenHTTPSEnabled(t *testing.T) {
+	t.Setenv("ENVIRONMENT", "development")
+	t.Setenv("ENABLE_HTTPS", "true")
+	rr := httptest.NewRecorder()
+	SetCSRFCookie(rr, "tok")
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].Secure {
+		t.Fatalf("expected a Secure csrf cookie, got %+v", cookies)
+	}
+}
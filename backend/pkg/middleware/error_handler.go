@@ -7,6 +7,8 @@ import (
 	"net"
 	"net/http"
 	"runtime/debug"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -23,36 +25,56 @@ type ErrorResponse struct {
 
 // ErrorHandler middleware for centralized error handling
 func ErrorHandler(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			if err := recover(); err != nil {
-				// Log the panic with stack trace
-				log.WithFields(log.Fields{
-					"panic":  err,
-					"stack":  string(debug.Stack()),
-					"method": r.Method,
-					"path":   r.URL.Path,
-					"remote": r.RemoteAddr,
-				}).Error("HTTP handler panic recovered")
-
-				// Return internal server error
-				SendErrorResponse(w, http.StatusInternalServerError, "Internal server error", "A server error occurred", nil)
-			}
-		}()
-
-		// Create a custom ResponseWriter to capture status codes
-		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-		next.ServeHTTP(rw, r)
+	return SampledErrorHandler(1)(next)
+}
 
-		// Log request details for monitoring
-		log.WithFields(log.Fields{
-			"method":      r.Method,
-			"path":        r.URL.Path,
-			"status_code": rw.statusCode,
-			"remote":      r.RemoteAddr,
-			"user_agent":  r.UserAgent(),
-		}).Info("HTTP request completed")
-	})
+// SampledErrorHandler is ErrorHandler logging only one out of every `every`
+// successful (2xx) requests, starting with the first. Every other status is
+// always logged, as are panics. every <= 1 logs them all. On a busy server most
+// lines are 2xx polls and reports, and logrus writes each one under a lock
+// on the request path, so sampling them cuts both the volume and the cost.
+func SampledErrorHandler(every int) func(http.Handler) http.Handler {
+	var completed atomic.Uint64
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				if err := recover(); err != nil {
+					// Log the panic with stack trace
+					log.WithFields(log.Fields{
+						"panic":  err,
+						"stack":  string(debug.Stack()),
+						"method": r.Method,
+						"path":   r.URL.Path,
+						"remote": ClientIP(r),
+					}).Error("HTTP handler panic recovered")
+
+					// Return internal server error
+					SendErrorResponse(w, http.StatusInternalServerError, "Internal server error", "A server error occurred", nil)
+				}
+			}()
+
+			// Create a custom ResponseWriter to capture status codes
+			rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+			next.ServeHTTP(rw, r)
+
+			fields := log.Fields{
+				"method":      r.Method,
+				"path":        r.URL.Path,
+				"status_code": rw.statusCode,
+				"remote":      ClientIP(r),
+				"user_agent":  r.UserAgent(),
+			}
+			if every > 1 && rw.statusCode >= 200 && rw.statusCode < 300 {
+				if (completed.Add(1)-1)%uint64(every) != 0 {
+					return
+				}
+				// Lets whoever counts these lines scale them back up.
+				fields["sampled_1_in"] = every
+			}
+			// Log request details for monitoring
+			log.WithFields(fields).Info("HTTP request completed")
+		})
+	}
 }
 
 // responseWriter wraps http.ResponseWriter to capture status code
@@ -96,6 +118,35 @@ func SendErrorResponse(w http.ResponseWriter, statusCode int, error string, mess
 	}
 }
 
+// SuccessResponse is the body of a create or update that has no resource of
+// its own to return. ID is the created or changed resource's, when it has
+// one.
+type SuccessResponse struct {
+	Status  string      `json:"status"`
+	ID      interface{} `json:"id,omitempty"`
+	Message string      `json:"message"`
+}
+
+// SendSuccessResponse sends a SuccessResponse whose status is the snake_case
+// status text ("created", "accepted").
+func SendSuccessResponse(w http.ResponseWriter, statusCode int, id interface{}, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(SuccessResponse{Status: StatusSlug(statusCode), ID: id, Message: message}); err != nil {
+		log.WithError(err).Error("Failed to encode success response")
+	}
+}
+
+// StatusSlug turns a status into snake_case text: "Bad Request" becomes
+// "bad_request", "Created" "created".
+func StatusSlug(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.ReplaceAll(strings.ToLower(strings.ReplaceAll(text, "-", " ")), " ", "_")
+}
+
 // SendAuthError sends an authentication error response
 func SendAuthError(w http.ResponseWriter, message string) {
 	SendErrorResponse(w, http.StatusUnauthorized, "authentication_error", message, nil)
@@ -106,6 +157,39 @@ func SendForbiddenError(w http.ResponseWriter, message string) {
 	SendErrorResponse(w, http.StatusForbidden, "forbidden", message, nil)
 }
 
+// FieldError is one invalid field of a request body. Field is its JSON path,
+// e.g. "system_info.os_version".
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors collects every invalid field of a request so the client
+// can fix them all in one round trip. Handlers Add as they check and send it
+// with SendValidationErrors when it is non-empty.
+type ValidationErrors []FieldError
+
+// Add records that field is invalid.
+func (v *ValidationErrors) Add(field, message string) {
+	*v = append(*v, FieldError{Field: field, Message: message})
+}
+
+func (v ValidationErrors) Error() string {
+	parts := make([]string, len(v))
+	for i, fe := range v {
+		parts[i] = fe.Field + ": " + fe.Message
+	}
+	return strings.Join(parts, "; ")
+}
+
+// SendValidationErrors sends a 400 whose details.fields lists errs as
+// {field, message} objects; the message joins them for clients that only
+// show that.
+func SendValidationErrors(w http.ResponseWriter, errs ValidationErrors) {
+	SendErrorResponse(w, http.StatusBadRequest, "bad_request", "Invalid request: "+errs.Error(),
+		map[string]interface{}{"fields": errs})
+}
+
 func getCurrentTimestamp() string {
 	return time.Now().UTC().Format(time.RFC3339)
 }
@@ -80,6 +80,29 @@ var (
 		},
 	)
 
+	// UpdateRunsTotal and UpdateRunDuration cover interactive update runs
+	// (GET /hosts/{id}/run-update). They are labelled by outcome only;
+	// per-host labels would grow with the fleet.
+	UpdateRunsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "uau",
+			Name:      "update_runs_total",
+			Help:      "Finished update runs, partitioned by status (success or failure).",
+		},
+		[]string{"status"},
+	)
+
+	UpdateRunDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "uau",
+			Name:      "update_run_duration_seconds",
+			Help:      "Histogram of update run durations in seconds, from run start to finish.",
+			// 5s to ~43min: apt runs take minutes, not milliseconds.
+			Buckets: prometheus.ExponentialBuckets(5, 2, 10),
+		},
+		[]string{"status"},
+	)
+
 	DBPoolMax = promauto.NewGauge(
 		prometheus.GaugeOpts{
 			Namespace: "uau",
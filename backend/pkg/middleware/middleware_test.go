@@ -2,10 +2,15 @@ package middleware
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	logtest "github.com/sirupsen/logrus/hooks/test"
 )
 
 func TestSendErrorResponse_JSON(t *testing.T) {
@@ -61,6 +66,35 @@ func TestErrorHandler_PanicRecovery(t *testing.T) {
 	}
 }
 
+// A burst of 2xx requests logs one line in every ten; every failure is
+// logged.
+func TestSampledErrorHandler(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	handler := SampledErrorHandler(10)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	for i := 0; i < 100; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/ok", nil))
+	}
+	for i := 0; i < 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/fail", nil))
+	}
+
+	logged := map[string]int{}
+	for _, e := range hook.AllEntries() {
+		if e.Message == "HTTP request completed" {
+			logged[e.Data["path"].(string)]++
+		}
+	}
+	if logged["/ok"] != 10 || logged["/fail"] != 3 {
+		t.Errorf("logged %d of 100 successes and %d of 3 failures, want 10 and 3", logged["/ok"], logged["/fail"])
+	}
+}
+
 func TestGetCurrentTimestamp(t *testing.T) {
 	ts := getCurrentTimestamp()
 	if ts == "now" {
@@ -135,3 +169,72 @@ func TestGenerateSecureToken(t *testing.T) {
 		t.Errorf("token length %d, want 64", len(t1))
 	}
 }
+
+func TestMaxBodySize(t *testing.T) {
+	var readErr error
+	h := MaxBodySize(16)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = io.ReadAll(r.Body)
+	}))
+
+	// Declared too large: refused before the handler runs.
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(strings.Repeat("a", 17)))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("declared oversize: got %d, want 413", rr.Code)
+	}
+
+	// Undeclared length: the handler's read fails with MaxBytesError.
+	req = httptest.NewRequest(http.MethodPost, "/", io.MultiReader(strings.NewReader(strings.Repeat("a", 17))))
+	req.ContentLength = -1
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	var tooBig *http.MaxBytesError
+	if !errors.As(readErr, &tooBig) {
+		t.Errorf("undeclared oversize: read err = %v, want MaxBytesError", readErr)
+	}
+
+	// Within the limit passes through untouched.
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader("small"))
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || readErr != nil {
+		t.Errorf("small body: got %d, err %v", rr.Code, readErr)
+	}
+}
+
+func TestRequireJSON(t *testing.T) {
+	h := RequireJSON(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	cases := []struct {
+		method, contentType, body string
+		want                      int
+	}{
+		{http.MethodPost, "application/json", `{}`, http.StatusNoContent},
+		{http.MethodPut, "application/json; charset=utf-8", `{}`, http.StatusNoContent},
+		{http.MethodPost, "text/plain", `{}`, http.StatusUnsupportedMediaType},
+		{http.MethodPatch, "application/x-www-form-urlencoded", `a=b`, http.StatusUnsupportedMediaType},
+		{http.MethodPost, "", `{}`, http.StatusUnsupportedMediaType},
+		// No body: nothing to decode, so no header is required.
+		{http.MethodPost, "", "", http.StatusNoContent},
+		{http.MethodDelete, "text/plain", `x`, http.StatusNoContent},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "/", strings.NewReader(c.body))
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != c.want {
+			t.Errorf("%s %q: got %d, want %d", c.method, c.contentType, rr.Code, c.want)
+		}
+		if c.want == http.StatusUnsupportedMediaType {
+			var resp ErrorResponse
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.Error != "unsupported_media_type" {
+				t.Errorf("%s %q: body %q", c.method, c.contentType, rr.Body.String())
+			}
+		}
+	}
+}
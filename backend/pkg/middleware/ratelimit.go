@@ -2,22 +2,37 @@ package middleware
 
 import (
 	"context"
+	"math"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"ubuntu-auto-update/backend/pkg/store"
 )
 
-// LoginRateLimiter is a small token-bucket per IP, sized for the login
-// endpoint specifically. Generous enough to not block humans (5 attempts
-// per minute) and tight enough to make automated guessing painful.
+// LoginRateLimiter is a small token-bucket per key (normally the client IP).
+// NewLoginRateLimiter sizes it for the login endpoint specifically: generous
+// enough to not block humans (5 attempts per minute) and tight enough to make
+// automated guessing painful. NewRateLimiter builds the API-wide variant.
 type LoginRateLimiter struct {
 	mu       sync.Mutex
 	buckets  map[string]*bucket
 	rate     float64 // tokens per second
 	capacity float64
+	now      func() time.Time
+
+	// Set by Share: counts live in shared under prefix+key, in fixed
+	// windows of window.
+	shared store.Store
+	prefix string
+	window time.Duration
 }
 
 type bucket struct {
@@ -27,20 +42,66 @@ type bucket struct {
 
 // NewLoginRateLimiter returns a limiter sized for human login traffic.
 func NewLoginRateLimiter() *LoginRateLimiter {
+	return NewRateLimiter(5, time.Minute)
+}
+
+// NewRateLimiter allows bursts of up to requests per key, refilling at
+// requests per window.
+func NewRateLimiter(requests int, window time.Duration) *LoginRateLimiter {
 	return &LoginRateLimiter{
 		buckets:  make(map[string]*bucket),
-		rate:     5.0 / 60.0, // 5 per minute
-		capacity: 5,
+		rate:     float64(requests) / window.Seconds(),
+		capacity: float64(requests),
+		now:      time.Now,
 	}
 }
 
+// sharedTimeout bounds one shared-store round trip on the request path.
+const sharedTimeout = time.Second
+
+// Share moves the limiter's counts to kv under prefix, so every replica
+// sharing kv (Redis) draws on one allowance per key instead of each
+// granting its own. Shared counts are fixed windows of capacity requests
+// per refill period rather than a refilling bucket. While kv is failing,
+// requests are counted by the local bucket instead. A nil kv leaves the
+// limiter local. Returns l.
+func (l *LoginRateLimiter) Share(kv store.Store, prefix string) *LoginRateLimiter {
+	if kv == nil {
+		return l
+	}
+	l.shared = kv
+	l.prefix = prefix
+	l.window = time.Duration(l.capacity / l.rate * float64(time.Second))
+	return l
+}
+
 // Allow returns true iff the request from `key` should be processed.
 // Increments the bucket as a side-effect.
 func (l *LoginRateLimiter) Allow(key string) bool {
+	ok, _ := l.take(key)
+	return ok
+}
+
+// take spends one token from key's bucket. When the bucket is empty it
+// reports how long until the next token, for Retry-After.
+func (l *LoginRateLimiter) take(key string) (bool, time.Duration) {
+	if l.shared != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), sharedTimeout)
+		n, resetIn, err := l.shared.Incr(ctx, l.prefix+key, l.window)
+		cancel()
+		if err == nil {
+			if float64(n) > l.capacity {
+				return false, resetIn
+			}
+			return true, 0
+		}
+		log.Warnf("rate limit %s: shared store failed, counting locally: %v", l.prefix, err)
+	}
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	now := time.Now()
+	now := l.now()
 	b, ok := l.buckets[key]
 	if !ok {
 		b = &bucket{tokens: l.capacity, last: now}
@@ -54,10 +115,11 @@ func (l *LoginRateLimiter) Allow(key string) bool {
 	b.last = now
 
 	if b.tokens < 1 {
-		return false
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
 	}
 	b.tokens--
-	return true
+	return true, 0
 }
 
 // CleanIdle drops buckets that haven't been touched in `older` so the map
@@ -65,7 +127,7 @@ func (l *LoginRateLimiter) Allow(key string) bool {
 func (l *LoginRateLimiter) CleanIdle(older time.Duration) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	cutoff := time.Now().Add(-older)
+	cutoff := l.now().Add(-older)
 	for k, b := range l.buckets {
 		if b.last.Before(cutoff) {
 			delete(l.buckets, k)
@@ -104,11 +166,17 @@ type IPAllowlist struct {
 
 // NewIPAllowlist parses comma-separated CIDRs (also accepts bare IPs).
 func NewIPAllowlist(commaSeparated string) (*IPAllowlist, error) {
-	commaSeparated = strings.TrimSpace(commaSeparated)
-	if commaSeparated == "" {
-		return &IPAllowlist{enabled: false}, nil
+	nets, err := parseCIDRList(commaSeparated)
+	if err != nil {
+		return nil, err
 	}
-	a := &IPAllowlist{enabled: true}
+	return &IPAllowlist{nets: nets, enabled: len(nets) > 0}, nil
+}
+
+// parseCIDRList parses comma-separated CIDRs, promoting bare IPs to /32 or
+// /128. Blank entries are skipped.
+func parseCIDRList(commaSeparated string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
 	for _, raw := range strings.Split(commaSeparated, ",") {
 		raw = strings.TrimSpace(raw)
 		if raw == "" {
@@ -130,9 +198,9 @@ func NewIPAllowlist(commaSeparated string) (*IPAllowlist, error) {
 		if err != nil {
 			return nil, err
 		}
-		a.nets = append(a.nets, n)
+		nets = append(nets, n)
 	}
-	return a, nil
+	return nets, nil
 }
 
 // Allow returns true if the given remote IP matches a registered CIDR. When
@@ -159,8 +227,8 @@ func (a *IPAllowlist) Allow(remoteAddr string) bool {
 
 // IPAllowlistMiddleware blocks requests whose remote IP isn't on the list.
 // Disabled lists pass everything through. Uses ClientIP so X-Forwarded-For
-// is honored when TRUST_FORWARDED_FOR is set — required behind any load
-// balancer or reverse proxy.
+// is honored from trusted proxies — required behind any load balancer or
+// reverse proxy.
 func IPAllowlistMiddleware(a *IPAllowlist) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -173,22 +241,97 @@ func IPAllowlistMiddleware(a *IPAllowlist) func(http.Handler) http.Handler {
 	}
 }
 
-// ClientIP returns the best-guess origin IP for a request. Trusts the first
-// X-Forwarded-For entry only when TRUST_FORWARDED_FOR is enabled (opt-in,
-// because anyone can set the header).
+// TrustedProxies is the set of peers allowed to tell us the client's address
+// via X-Forwarded-For / X-Real-IP.
+type TrustedProxies struct {
+	nets []*net.IPNet
+	all  bool
+}
+
+// ParseTrustedProxies parses comma-separated CIDRs or bare IPs. An empty
+// string yields a list that trusts nobody.
+func ParseTrustedProxies(commaSeparated string) (*TrustedProxies, error) {
+	nets, err := parseCIDRList(commaSeparated)
+	if err != nil {
+		return nil, err
+	}
+	return &TrustedProxies{nets: nets}, nil
+}
+
+// Contains reports whether ip (no port) is a trusted proxy.
+func (t *TrustedProxies) Contains(ip string) bool {
+	if t == nil {
+		return false
+	}
+	if t.all {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range t.nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustAllProxies reproduces the legacy TRUST_FORWARDED_FOR=true behavior:
+// every peer is believed, so the left-most X-Forwarded-For entry wins.
+var trustAllProxies = &TrustedProxies{all: true}
+
+var trustedProxies atomic.Pointer[TrustedProxies]
+
+// SetTrustedProxies installs the process-wide list ClientIP consults. Until
+// it is called, ClientIP falls back to the TRUST_FORWARDED_FOR switch.
+func SetTrustedProxies(t *TrustedProxies) {
+	trustedProxies.Store(t)
+}
+
+// ClientIP returns the best-guess origin IP for a request using the list
+// installed by SetTrustedProxies.
 func ClientIP(r *http.Request) string {
-	if envIsTrue("TRUST_FORWARDED_FOR") {
-		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-			parts := strings.Split(xff, ",")
-			if len(parts) > 0 {
-				return strings.TrimSpace(parts[0])
+	t := trustedProxies.Load()
+	if t == nil && envIsTrue("TRUST_FORWARDED_FOR") {
+		t = trustAllProxies
+	}
+	return ClientIPFrom(r, t)
+}
+
+// ClientIPFrom derives the client address. Forwarding headers are read only
+// when the immediate peer (RemoteAddr) is a trusted proxy, since anyone can
+// set them. X-Forwarded-For is walked right to left, skipping further trusted
+// hops, so a client can't spoof its way in by prepending entries: the result
+// is the first address a trusted proxy actually saw. X-Real-IP is used when
+// X-Forwarded-For is absent.
+func ClientIPFrom(r *http.Request, trusted *TrustedProxies) string {
+	peer := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		peer = h
+	}
+	if !trusted.Contains(peer) {
+		return peer
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				// Garbage in the chain: stop at the last hop we could vouch for.
+				break
+			}
+			if i == 0 || !trusted.Contains(hop) {
+				return hop
 			}
 		}
+		return peer
 	}
-	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
-		return h
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+		return real
 	}
-	return r.RemoteAddr
+	return peer
 }
 
 func envIsTrue(env string) bool {
@@ -196,14 +339,14 @@ func envIsTrue(env string) bool {
 	return v == "1" || v == "true" || v == "yes"
 }
 
-// RateLimitHandler wraps a handler with per-IP rate limiting using the given
-// LoginRateLimiter. Useful for inline use on specific routes (e.g. /enroll)
-// without a full subrouter.
-func RateLimitHandler(limiter *LoginRateLimiter) func(http.Handler) http.Handler {
+// RateLimit rejects requests once the client IP's bucket is empty, answering
+// 429 with a Retry-After (whole seconds, rounded up) of when the next token
+// is due.
+func RateLimit(limiter *LoginRateLimiter) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if !limiter.Allow(ClientIP(r)) {
-				w.Header().Set("Retry-After", "60")
+			if ok, wait := limiter.take(ClientIP(r)); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
 				SendErrorResponse(w, http.StatusTooManyRequests, "rate_limit", "Too many requests; try again shortly", nil)
 				return
 			}
@@ -211,3 +354,10 @@ func RateLimitHandler(limiter *LoginRateLimiter) func(http.Handler) http.Handler
 		})
 	}
 }
+
+// RateLimitHandler wraps a handler with per-IP rate limiting using the given
+// LoginRateLimiter. Useful for inline use on specific routes (e.g. /enroll)
+// without a full subrouter.
+func RateLimitHandler(limiter *LoginRateLimiter) func(http.Handler) http.Handler {
+	return RateLimit(limiter)
+}
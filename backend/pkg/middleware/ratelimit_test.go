@@ -5,6 +5,11 @@ import (
 	"net/http/httptest"
 	"testing"
 	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"ubuntu-auto-update/backend/pkg/store"
 )
 
 func TestLoginRateLimiter_AllowsBurst(t *testing.T) {
@@ -162,3 +167,168 @@ func TestClientIP_TrustsXFFOnlyWhenEnabled(t *testing.T) {
 		t.Errorf("with TRUST_FORWARDED_FOR=true want 9.9.9.9, got %s", ip)
 	}
 }
+
+func TestRateLimit_ExhaustsAndRefills(t *testing.T) {
+	l := NewRateLimiter(2, time.Minute)
+	clock := time.Unix(1_700_000_000, 0)
+	l.now = func() time.Time { return clock }
+
+	h := RateLimit(l)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	do := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/v1/hosts", nil)
+		r.RemoteAddr = "10.0.0.1:5555"
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, r)
+		return rw
+	}
+
+	for i := 0; i < 2; i++ {
+		if rw := do(); rw.Code != http.StatusOK {
+			t.Fatalf("request %d: got %d, want 200", i, rw.Code)
+		}
+	}
+	rw := do()
+	if rw.Code != http.StatusTooManyRequests {
+		t.Fatalf("exhausted bucket: got %d, want 429", rw.Code)
+	}
+	// 2 per minute refills one token every 30s.
+	if got := rw.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, want 30", got)
+	}
+
+	clock = clock.Add(30 * time.Second)
+	if rw := do(); rw.Code != http.StatusOK {
+		t.Fatalf("after refill: got %d, want 200", rw.Code)
+	}
+	if rw := do(); rw.Code != http.StatusTooManyRequests {
+		t.Fatalf("refill should grant exactly one token, got %d", rw.Code)
+	}
+}
+
+// Limiters on two replicas sharing a Redis spend one allowance per client,
+// and fall back to their own buckets when Redis goes away.
+func TestRateLimit_SharedAcrossReplicas(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+	kv := store.NewRedis(client)
+	a := NewRateLimiter(3, time.Minute).Share(kv, "ratelimit:api:")
+	b := NewRateLimiter(3, time.Minute).Share(kv, "ratelimit:api:")
+
+	for i, l := range []*LoginRateLimiter{a, b, a} {
+		if !l.Allow("10.0.0.1") {
+			t.Fatalf("request %d refused", i)
+		}
+	}
+	ok, wait := b.take("10.0.0.1")
+	if ok || wait <= 0 || wait > time.Minute {
+		t.Fatalf("4th request across replicas: ok=%v wait=%s", ok, wait)
+	}
+	if !a.Allow("10.0.0.2") {
+		t.Error("another client shares the exhausted allowance")
+	}
+	mr.FastForward(time.Minute)
+	if !b.Allow("10.0.0.1") {
+		t.Error("allowance not restored after the window")
+	}
+
+	mr.Close()
+	if !a.Allow("10.0.0.1") {
+		t.Error("Redis outage should fall back to the local bucket, not refuse")
+	}
+}
+
+func TestRateLimit_PerClientIP(t *testing.T) {
+	l := NewRateLimiter(1, time.Minute)
+	h := RateLimit(l)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tc := range []struct {
+		addr string
+		want int
+	}{
+		{"10.0.0.1:1", http.StatusOK},
+		{"10.0.0.1:2", http.StatusTooManyRequests},
+		{"10.0.0.2:1", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.addr
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, r)
+		if rw.Code != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.addr, rw.Code, tc.want)
+		}
+	}
+}
+
+func TestClientIPFrom_TrustedProxies(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		remote string
+		xff    string
+		realIP string
+		want   string
+	}{
+		{"direct client ignores headers", "203.0.113.9:4000", "1.1.1.1", "2.2.2.2", "203.0.113.9"},
+		{"untrusted peer cannot spoof XFF", "198.51.100.7:1", "10.0.0.1", "", "198.51.100.7"},
+		{"trusted proxy, single hop", "10.1.2.3:1", "203.0.113.9", "", "203.0.113.9"},
+		{"spoofed left-most entry ignored", "10.1.2.3:1", "6.6.6.6, 203.0.113.9", "", "203.0.113.9"},
+		{"chained trusted proxies skipped", "10.1.2.3:1", "203.0.113.9, 192.168.1.5, 10.9.9.9", "", "203.0.113.9"},
+		{"X-Real-IP when no XFF", "192.168.1.5:1", "", "203.0.113.9", "203.0.113.9"},
+		{"garbage XFF falls back to peer", "10.1.2.3:1", "not-an-ip", "", "10.1.2.3"},
+		{"no headers from trusted proxy", "10.1.2.3:1", "", "", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if got := ClientIPFrom(r, trusted); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClientIP_UsesInstalledTrustedProxies(t *testing.T) {
+	trusted, _ := ParseTrustedProxies("10.0.0.0/8")
+	SetTrustedProxies(trusted)
+	t.Cleanup(func() { SetTrustedProxies(nil) })
+	// TRUST_FORWARDED_FOR no longer matters once a list is installed.
+	t.Setenv("TRUST_FORWARDED_FOR", "true")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "198.51.100.7:1"
+	r.Header.Set("X-Forwarded-For", "9.9.9.9")
+	if ip := ClientIP(r); ip != "198.51.100.7" {
+		t.Errorf("untrusted peer: got %s", ip)
+	}
+
+	// The rate limiter keys on the forwarded client, not the proxy.
+	l := NewRateLimiter(1, time.Minute)
+	h := RateLimit(l)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, client := range []string{"203.0.113.1", "203.0.113.2"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.2:1"
+		r.Header.Set("X-Forwarded-For", client)
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, r)
+		if rw.Code != http.StatusOK {
+			t.Errorf("client %s behind shared proxy: got %d", client, rw.Code)
+		}
+	}
+}
+
+func TestParseTrustedProxies_BadInput(t *testing.T) {
+	if _, err := ParseTrustedProxies("10.0.0.0/8,nope"); err == nil {
+		t.Error("expected error for invalid entry")
+	}
+}
@@ -37,8 +37,9 @@ func SecurityHeaders(next http.Handler) http.Handler {
 		w.Header().Set("Permissions-Policy",
 			"camera=(), microphone=(), geolocation=(), payment=()")
 
-		// HSTS: only set in production where TLS is terminated.
-		if isProduction() {
+		// HSTS: only set in production where TLS is terminated, or when this
+		// request actually arrived over TLS.
+		if isProduction() || r.TLS != nil {
 			w.Header().Set("Strict-Transport-Security",
 				"max-age=63072000; includeSubDomains; preload")
 		}
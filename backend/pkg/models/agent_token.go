@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// AgentToken is one token issued to a host's agent at enrollment. The
+// token itself is never stored, only its hash, so it is not part of this
+// view. A token is usable until it expires or is revoked.
+type AgentToken struct {
+	ID         int32      `json:"id" db:"id"`
+	HostID     int32      `json:"host_id" db:"host_id"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at" db:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at" db:"last_used_at"`
+	CreatedIP  string     `json:"created_ip" db:"created_ip"`
+	RevokedAt  *time.Time `json:"revoked_at" db:"revoked_at"`
+	RevokedBy  string     `json:"revoked_by" db:"revoked_by"`
+}
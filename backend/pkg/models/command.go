@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// CommandStatus tracks a queued agent command. CHECK constraint in the
+// schema enforces the allowed values.
+type CommandStatus string
+
+const (
+	CommandStatusQueued     CommandStatus = "queued"
+	CommandStatusDispatched CommandStatus = "dispatched"
+	CommandStatusCompleted  CommandStatus = "completed"
+)
+
+// QueuedCommand is a shell command waiting for (or already picked up by) a
+// host's agent. ExitCode and Output are set once the agent reports back.
+type QueuedCommand struct {
+	ID           int32         `json:"id"            db:"id"`
+	HostID       int32         `json:"host_id"       db:"host_id"`
+	Command      string        `json:"command"       db:"command"`
+	Status       CommandStatus `json:"status"        db:"status"`
+	EnqueuedBy   string        `json:"enqueued_by"   db:"enqueued_by"`
+	CreatedAt    time.Time     `json:"created_at"    db:"created_at"`
+	DispatchedAt *time.Time    `json:"dispatched_at" db:"dispatched_at"`
+	CompletedAt  *time.Time    `json:"completed_at"  db:"completed_at"`
+	ExitCode     *int32        `json:"exit_code"     db:"exit_code"`
+	Output       string        `json:"output"        db:"output"`
+}
@@ -7,16 +7,20 @@ import (
 )
 
 type Host struct {
-	ID            int32          `json:"id" db:"id"`
-	Hostname      string         `json:"hostname" db:"hostname"`
-	SshUser       string         `json:"ssh_user" db:"ssh_user"`
-	CreatedAt     time.Time      `json:"created_at" db:"created_at"`
-	UpdatedAt     time.Time      `json:"updated_at" db:"updated_at"`
-	LastSeen      time.Time      `json:"last_seen" db:"last_seen"`
-	UpdateOutput  string         `json:"update_output" db:"update_output"`
-	UpgradeOutput string         `json:"upgrade_output" db:"upgrade_output"`
-	Error         sql.NullString `json:"-" db:"error"`
-	Tags          []string       `json:"tags" db:"tags"`
+	ID            int32      `json:"id" db:"id"`
+	Hostname      string     `json:"hostname" db:"hostname"`
+	SshUser       string     `json:"ssh_user" db:"ssh_user"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at" db:"updated_at"`
+	LastSeen      time.Time  `json:"last_seen" db:"last_seen"`
+	UpdateOutput  HostOutput `json:"update_output" db:"update_output"`
+	UpgradeOutput HostOutput `json:"upgrade_output" db:"upgrade_output"`
+	// The *Truncated flags mean the stored output is only the tail of a log
+	// that exceeded the size cap.
+	UpdateOutputTruncated  bool           `json:"update_output_truncated" db:"update_output_truncated"`
+	UpgradeOutputTruncated bool           `json:"upgrade_output_truncated" db:"upgrade_output_truncated"`
+	Error                  sql.NullString `json:"-" db:"error"`
+	Tags                   []string       `json:"tags" db:"tags"`
 
 	// Agent-reported fields (populated by /api/v1/report). Zero-valued for
 	// SSH-only hosts that never run the agent.
@@ -26,14 +30,66 @@ type Host struct {
 	OsVersion         string `json:"os_version" db:"os_version"`
 	KernelVersion     string `json:"kernel_version" db:"kernel_version"`
 	AgentVersion      string `json:"agent_version" db:"agent_version"`
+	Architecture      string `json:"architecture" db:"architecture"`
 
 	// OfflineSince is set by the server-side offline sweep when last_seen
 	// crosses the threshold; nil = online (or not yet evaluated).
 	OfflineSince *time.Time `json:"offline_since" db:"offline_since"`
+
+	UpdatePolicy UpdatePolicy `json:"update_policy" db:"update_policy"`
+
+	// Environment labels the host (prod, staging, ...); "" is unlabelled.
+	// Update runs against an environment in REQUIRE_CONFIRM_ENV must be
+	// confirmed.
+	Environment string `json:"environment" db:"environment"`
+
+	// DeletedAt is set when the host has been archived (soft-deleted). An
+	// archived host is left out of listings, sweeps and scheduled runs but
+	// keeps its row, and its history, until it is purged.
+	DeletedAt *time.Time `json:"deleted_at,omitempty" db:"deleted_at"`
+
+	// Status is HostStatusOnline or HostStatusOffline, derived by SetStatus
+	// before the host is returned; it is not stored. MarshalJSON emits it.
+	Status string `json:"-" db:"-"`
+}
+
+// UpdatePolicy limits what an update run may install on a host.
+type UpdatePolicy string
+
+const (
+	UpdatePolicyAll          UpdatePolicy = "all"
+	UpdatePolicySecurityOnly UpdatePolicy = "security_only"
+)
+
+// Valid reports whether p is one of the policies the schema allows.
+func (p UpdatePolicy) Valid() bool {
+	return p == UpdatePolicyAll || p == UpdatePolicySecurityOnly
+}
+
+// Derived host states returned in the "status" JSON field.
+const (
+	HostStatusOnline  = "online"
+	HostStatusOffline = "offline"
+)
+
+// DefaultOfflineAfter is how long a host may go without reporting before it
+// is offline, when OFFLINE_AFTER_MINUTES is unset.
+const DefaultOfflineAfter = 15 * time.Minute
+
+// SetStatus derives Status from LastSeen alone: offline once the host has
+// gone offlineAfter without reporting. OfflineSince is only the sweep's
+// record of which transitions have been announced, and it lags a fresh
+// report by up to a sweep interval, so it is deliberately not consulted.
+func (h *Host) SetStatus(now time.Time, offlineAfter time.Duration) {
+	h.Status = HostStatusOnline
+	if now.Sub(h.LastSeen) > offlineAfter {
+		h.Status = HostStatusOffline
+	}
 }
 
 // MarshalJSON renders Error as a plain string-or-null instead of the default
-// sql.NullString shape ({"String":"","Valid":false}).
+// sql.NullString shape ({"String":"","Valid":false}) and adds the derived
+// Status.
 func (h Host) MarshalJSON() ([]byte, error) {
 	type Alias Host
 
@@ -46,9 +102,11 @@ func (h Host) MarshalJSON() ([]byte, error) {
 
 	return json.Marshal(&struct {
 		Alias
-		Error interface{} `json:"error"`
+		Error  interface{} `json:"error"`
+		Status string      `json:"status"`
 	}{
-		Alias: Alias(h),
-		Error: errorValue,
+		Alias:  Alias(h),
+		Error:  errorValue,
+		Status: h.Status,
 	})
 }
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestHostSetStatus(t *testing.T) {
+	now := time.Now()
+	since := now.Add(-time.Hour)
+	tests := []struct {
+		name string
+		host Host
+		want string
+	}{
+		{"fresh report", Host{LastSeen: now.Add(-time.Minute)}, HostStatusOnline},
+		{"at threshold", Host{LastSeen: now.Add(-10 * time.Minute)}, HostStatusOnline},
+		{"past threshold", Host{LastSeen: now.Add(-11 * time.Minute)}, HostStatusOffline},
+		{"never reported", Host{}, HostStatusOffline},
+		// Reported since the last sweep: offline_since is stale until the
+		// next tick clears it, but the host is already back.
+		{"stale offline_since", Host{LastSeen: now, OfflineSince: &since}, HostStatusOnline},
+	}
+	for _, tt := range tests {
+		tt.host.SetStatus(now, 10*time.Minute)
+		if tt.host.Status != tt.want {
+			t.Errorf("%s: Status = %q, want %q", tt.name, tt.host.Status, tt.want)
+		}
+	}
+}
+
+func TestHostMarshalJSON_Status(t *testing.T) {
+	h := Host{LastSeen: time.Now().Add(-2 * DefaultOfflineAfter)}
+	h.SetStatus(time.Now(), DefaultOfflineAfter)
+	b, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["status"] != HostStatusOffline {
+		t.Errorf("status = %v, want offline", got["status"])
+	}
+	if got["error"] != nil {
+		t.Errorf("error = %v, want null", got["error"])
+	}
+}
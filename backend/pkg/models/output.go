@@ -0,0 +1,70 @@
+package models
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// outputGzipMarker starts a stored output that is gzip-compressed. Apt
+// output is text and never starts with a NUL byte, so anything else is
+// stored as-is.
+const outputGzipMarker = "\x00gz"
+
+// HostOutput is apt output as stored in the hosts table's bytea columns.
+// Scan undoes EncodeOutput, so callers only ever see the text.
+type HostOutput string
+
+// EncodeOutput returns s as it should be stored: gzip-compressed behind
+// outputGzipMarker when it is at least threshold bytes and compressing
+// actually saves space, raw otherwise. A threshold <= 0 disables
+// compression. The result is never nil, so "" is stored as an empty value
+// rather than NULL.
+func EncodeOutput(s string, threshold int) []byte {
+	// Raw text that happens to start with the marker must be compressed,
+	// or it would be read back as a compressed value.
+	startsWithMarker := len(s) >= len(outputGzipMarker) && s[:len(outputGzipMarker)] == outputGzipMarker
+	if !startsWithMarker && (threshold <= 0 || len(s) < threshold) {
+		return []byte(s)
+	}
+	var buf bytes.Buffer
+	buf.WriteString(outputGzipMarker)
+	zw := gzip.NewWriter(&buf)
+	_, _ = zw.Write([]byte(s)) // writes to a bytes.Buffer don't fail
+	_ = zw.Close()
+	if !startsWithMarker && buf.Len() >= len(s) {
+		return []byte(s)
+	}
+	return buf.Bytes()
+}
+
+// Scan implements sql.Scanner. NULL reads as "".
+func (o *HostOutput) Scan(src any) error {
+	var b []byte
+	switch v := src.(type) {
+	case nil:
+		*o = ""
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("host output: cannot scan %T", src)
+	}
+	if !bytes.HasPrefix(b, []byte(outputGzipMarker)) {
+		*o = HostOutput(b)
+		return nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b[len(outputGzipMarker):]))
+	if err != nil {
+		return fmt.Errorf("host output: %w", err)
+	}
+	text, err := io.ReadAll(zr)
+	if err != nil {
+		return fmt.Errorf("host output: %w", err)
+	}
+	*o = HostOutput(text)
+	return nil
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHostOutput_RoundTrip(t *testing.T) {
+	large := strings.Repeat("Setting up curl (7.81.0-1ubuntu1.16) ...\n", 500)
+	cases := []struct {
+		name           string
+		text           string
+		threshold      int
+		wantCompressed bool
+	}{
+		{"empty", "", 1024, false},
+		{"under threshold", "Hit:1 jammy InRelease\n", 1024, false},
+		{"over threshold", large, 1024, true},
+		{"compression disabled", large, 0, false},
+		{"incompressible", "abc", 1, false},
+		{"raw text that looks compressed", outputGzipMarker + "not gzip", 1024, true},
+		{"utf-8", strings.Repeat("Paket wird aktualisiert – ✓\n", 200), 1024, true},
+	}
+	for _, c := range cases {
+		stored := EncodeOutput(c.text, c.threshold)
+		if stored == nil {
+			t.Errorf("%s: encoded to nil, which would store NULL", c.name)
+		}
+		if compressed := strings.HasPrefix(string(stored), outputGzipMarker); compressed != c.wantCompressed {
+			t.Errorf("%s: compressed = %v, want %v", c.name, compressed, c.wantCompressed)
+		}
+		var got HostOutput
+		if err := got.Scan(stored); err != nil {
+			t.Fatalf("%s: Scan: %v", c.name, err)
+		}
+		if string(got) != c.text {
+			t.Errorf("%s: round trip changed the text", c.name)
+		}
+	}
+	if len(EncodeOutput(large, 1024)) >= len(large)/4 {
+		t.Error("repetitive apt output barely compressed")
+	}
+}
+
+func TestHostOutput_Scan(t *testing.T) {
+	o := HostOutput("stale")
+	if err := o.Scan(nil); err != nil || o != "" {
+		t.Errorf("NULL: %q, %v", o, err)
+	}
+	if err := o.Scan("plain"); err != nil || o != "plain" {
+		t.Errorf("string: %q, %v", o, err)
+	}
+	if err := o.Scan([]byte(outputGzipMarker + "corrupt")); err == nil {
+		t.Error("corrupt compressed value scanned without error")
+	}
+	if err := o.Scan(42); err == nil {
+		t.Error("int scanned without error")
+	}
+}
@@ -0,0 +1,7 @@
+package models
+
+// Package is one installed dpkg package on a host.
+type Package struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
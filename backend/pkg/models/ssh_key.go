@@ -1,6 +1,9 @@
 package models
 
+// SSHKey is one of a host's stored private keys. A host's keys are offered
+// in position order when dialling it.
 type SSHKey struct {
+	ID         int32  `json:"id" db:"id"`
 	HostID     int32  `json:"host_id" db:"host_id"`
 	PrivateKey string `json:"private_key" db:"private_key"`
 }
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// UpdateHooks are a host's optional shell commands run over SSH, as its
+// ssh_user, around run-update: PreUpdateCommand before apt (a failure aborts
+// the update) and PostUpdateCommand after it (a failure only warns). Empty
+// means no hook.
+type UpdateHooks struct {
+	PreUpdateCommand  string `json:"pre_update_command"  db:"pre_update_command"`
+	PostUpdateCommand string `json:"post_update_command" db:"post_update_command"`
+}
+
+// HookPhase says which hook a RunHook ran. Persisted as a CHECK-constrained
+// text column.
+type HookPhase string
+
+const (
+	HookPhasePre  HookPhase = "pre"
+	HookPhasePost HookPhase = "post"
+)
+
+// RunHook is a hook's captured output from one run. ExitCode is nil when the
+// hook never exited.
+type RunHook struct {
+	RunID      int32     `json:"run_id"      db:"run_id"`
+	Phase      HookPhase `json:"phase"       db:"phase"`
+	Command    string    `json:"command"     db:"command"`
+	ExitCode   *int32    `json:"exit_code"   db:"exit_code"`
+	Output     string    `json:"output"      db:"output"`
+	FinishedAt time.Time `json:"finished_at" db:"finished_at"`
+}
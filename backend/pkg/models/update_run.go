@@ -6,9 +6,9 @@ import (
 	"time"
 )
 
-// RunKind separates read-only previews ("apt list --upgradable") from real
-// upgrades ("apt-get upgrade -y"). Persisted as a CHECK-constrained text
-// column.
+// RunKind separates read-only previews ("apt list --upgradable") and
+// simulations ("apt-get -s upgrade") from real upgrades ("apt-get upgrade
+// -y"). Persisted as a CHECK-constrained text column.
 type RunKind string
 
 const (
@@ -16,6 +16,7 @@ const (
 	RunKindUpdate   RunKind = "update"
 	RunKindPlaybook RunKind = "playbook"
 	RunKindReboot   RunKind = "reboot"
+	RunKindSimulate RunKind = "simulate"
 )
 
 // RunStatus tracks lifecycle. CHECK constraint in the schema enforces the
@@ -42,6 +43,7 @@ type UpdateRun struct {
 	Output      string         `json:"output"       db:"output"`
 	Error       sql.NullString `json:"-"           db:"error"`
 	PlaybookID  sql.NullInt32  `json:"-"           db:"playbook_id"`
+	KeptBack    []string       `json:"kept_back"    db:"kept_back"`
 }
 
 // MarshalJSON renders nullable columns as plain JSON null instead of the
@@ -88,3 +90,31 @@ func (r UpdateRun) MarshalJSON() ([]byte, error) {
 		PlaybookID: pb,
 	})
 }
+
+// RunPhaseStatus tracks one phase of a bulk rollout. CHECK constraint in the
+// schema enforces the allowed values.
+type RunPhaseStatus string
+
+const (
+	RunPhasePending   RunPhaseStatus = "pending"
+	RunPhaseRunning   RunPhaseStatus = "running"
+	RunPhaseCompleted RunPhaseStatus = "completed"
+	RunPhaseHalted    RunPhaseStatus = "halted"
+	RunPhaseSkipped   RunPhaseStatus = "skipped"
+)
+
+// RunPhase is one phase of a bulk run: its hosts, in the order they ran,
+// and how many succeeded. Phase is 1-based. A halted phase is the one whose
+// failures stopped the rollout; Note says why.
+type RunPhase struct {
+	RunGroupID string         `json:"run_group_id" db:"run_group_id"`
+	Phase      int            `json:"phase"        db:"phase"`
+	Name       string         `json:"name"         db:"name"`
+	HostIDs    []int32        `json:"host_ids"     db:"host_ids"`
+	Status     RunPhaseStatus `json:"status"       db:"status"`
+	Succeeded  int            `json:"succeeded"    db:"succeeded"`
+	Failed     int            `json:"failed"       db:"failed"`
+	Note       string         `json:"note"         db:"note"`
+	StartedAt  *time.Time     `json:"started_at"   db:"started_at"`
+	FinishedAt *time.Time     `json:"finished_at"  db:"finished_at"`
+}
@@ -4,4 +4,10 @@ type Webhook struct {
 	ID    int32  `json:"id" db:"id"`
 	URL   string `json:"url" db:"url"`
 	Event string `json:"event" db:"event"`
+	// Format is the payload shape: raw (default), slack or teams.
+	Format string `json:"format" db:"format"`
+	// HostID or Tag, when set, limit the webhook to that host or to hosts
+	// carrying that tag. At most one is set; neither means every host.
+	HostID *int32  `json:"host_id,omitempty" db:"host_id"`
+	Tag    *string `json:"tag,omitempty" db:"tag"`
 }
@@ -0,0 +1,221 @@
+// Package reportschema checks the types of an agent report's fields before
+// it is decoded, so a report from an agent that serialises a field
+// differently is refused with the field named instead of half-decoding into
+// zero values.
+//
+// Only the fields models.HostReport reads are checked, each against the one
+// JSON type the agent sends for it; value rules (hostname syntax, count
+// ranges, label lengths) stay with the handler, which reports them all at
+// once. Fields not listed are accepted and ignored, so newer agents can add
+// them before the server knows about them.
+//
+// A report picks its version with "schema_version" and gets version 1
+// without one. Fields can be added to the current version as long as they
+// stay optional; a change that would refuse reports the current version
+// accepts needs a new version.
+package reportschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Current is the newest schema version this server knows.
+const Current = 1
+
+// kind is the JSON type a report field must have.
+type kind int
+
+const (
+	kindString kind = iota
+	kindNullableString
+	kindInteger
+	kindNumber
+	kindBoolean
+	kindDateTime
+	kindObject
+	kindNumberList
+)
+
+// schema maps the dotted path of each checked field to its kind, and lists
+// the fields a report must carry.
+type schema struct {
+	required []string
+	fields   map[string]kind
+}
+
+var schemas = map[int]schema{
+	1: {
+		required: []string{"hostname"},
+		fields: map[string]kind{
+			"schema_version":                     kindInteger,
+			"hostname":                           kindString,
+			"agent_version":                      kindString,
+			"timestamp":                          kindDateTime,
+			"update_results":                     kindObject,
+			"update_results.success":             kindBoolean,
+			"update_results.duration_seconds":    kindNumber,
+			"update_results.packages_updated":    kindInteger,
+			"update_results.packages_available":  kindInteger,
+			"update_results.bytes_downloaded":    kindInteger,
+			"update_results.reboot_required":     kindBoolean,
+			"update_results.error_message":       kindNullableString,
+			"update_results.apt_output":          kindString,
+			"update_results.snap_output":         kindNullableString,
+			"update_results.flatpak_output":      kindNullableString,
+			"system_info":                        kindObject,
+			"system_info.os_version":             kindString,
+			"system_info.kernel_version":         kindString,
+			"system_info.architecture":           kindString,
+			"system_info.uptime_seconds":         kindInteger,
+			"system_info.load_average":           kindNumberList,
+			"system_info.memory_total_bytes":     kindInteger,
+			"system_info.memory_available_bytes": kindInteger,
+			"system_info.disk_usage_percent":     kindNumber,
+		},
+	},
+}
+
+// Violation is one way a report breaks its schema. Field is the JSON path,
+// e.g. "update_results.packages_updated" or "system_info.load_average[1]".
+type Violation struct {
+	Field   string
+	Message string
+}
+
+// UnsupportedVersionError is returned for a schema_version this server
+// doesn't know, typically from an agent newer than the server.
+type UnsupportedVersionError struct {
+	Version string
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("unsupported schema_version %s; this server knows 1 to %d", e.Version, Current)
+}
+
+// Validate checks the JSON document raw against the schema version it
+// declares. It returns the violations found, missing required fields first
+// and then the others by path, or an error if raw isn't JSON or names an
+// unknown version.
+func Validate(raw []byte) ([]Violation, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	obj, ok := doc.(map[string]any)
+	if !ok {
+		return []Violation{{"body", "must be an object"}}, nil
+	}
+	s := schemas[1]
+	if v, ok := obj["schema_version"].(json.Number); ok {
+		n, err := strconv.Atoi(v.String())
+		if _, known := schemas[n]; err != nil || !known {
+			return nil, &UnsupportedVersionError{Version: v.String()}
+		}
+		s = schemas[n]
+	}
+
+	var out []Violation
+	for _, name := range s.required {
+		if _, ok := obj[name]; !ok {
+			out = append(out, Violation{name, "is required"})
+		}
+	}
+	paths := make([]string, 0, len(s.fields))
+	for path := range s.fields {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	for _, path := range paths {
+		// A field under a section that is absent or not an object isn't
+		// looked at; the section itself is reported.
+		if v, ok := lookup(obj, path); ok {
+			out = append(out, s.fields[path].check(path, v)...)
+		}
+	}
+	return out, nil
+}
+
+// lookup finds the value at the dotted path in obj.
+func lookup(obj map[string]any, path string) (any, bool) {
+	parts := strings.Split(path, ".")
+	for _, p := range parts[:len(parts)-1] {
+		next, ok := obj[p].(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		obj = next
+	}
+	v, ok := obj[parts[len(parts)-1]]
+	return v, ok
+}
+
+func (k kind) check(path string, v any) []Violation {
+	bad := func(msg string) []Violation { return []Violation{{path, msg}} }
+	switch k {
+	case kindString:
+		if _, ok := v.(string); !ok {
+			return bad("must be a string")
+		}
+	case kindNullableString:
+		if _, ok := v.(string); !ok && v != nil {
+			return bad("must be a string or null")
+		}
+	case kindInteger:
+		if !isInteger(v) {
+			return bad("must be an integer")
+		}
+	case kindNumber:
+		if _, ok := v.(json.Number); !ok {
+			return bad("must be a number")
+		}
+	case kindBoolean:
+		if _, ok := v.(bool); !ok {
+			return bad("must be a boolean")
+		}
+	case kindDateTime:
+		s, ok := v.(string)
+		if !ok {
+			return bad("must be a string")
+		}
+		if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+			return bad("must be an RFC 3339 date-time")
+		}
+	case kindObject:
+		if _, ok := v.(map[string]any); !ok {
+			return bad("must be an object")
+		}
+	case kindNumberList:
+		list, ok := v.([]any)
+		if !ok {
+			return bad("must be an array")
+		}
+		var out []Violation
+		for i, item := range list {
+			if _, ok := item.(json.Number); !ok {
+				out = append(out, Violation{fmt.Sprintf("%s[%d]", path, i), "must be a number"})
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// isInteger reports whether v, decoded with UseNumber, is a number without
+// a fraction or exponent that fits in 64 bits, which is what the Go decode
+// of the report accepts.
+func isInteger(v any) bool {
+	n, ok := v.(json.Number)
+	if !ok {
+		return false
+	}
+	_, err := strconv.ParseInt(n.String(), 10, 64)
+	return err == nil
+}
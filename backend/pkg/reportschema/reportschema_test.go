@@ -0,0 +1,77 @@
+package reportschema
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// What agent/src/main.rs sends.
+const validReport = `{
+	"hostname": "web-1",
+	"agent_version": "1.4.0",
+	"timestamp": "2026-03-01T02:00:00.123456Z",
+	"update_results": {
+		"success": true, "duration_seconds": 41.5, "packages_updated": 3,
+		"packages_available": 0, "bytes_downloaded": 1048576, "reboot_required": false,
+		"error_message": null, "apt_output": "...", "snap_output": null, "flatpak_output": null
+	},
+	"system_info": {
+		"os_version": "Ubuntu 24.04", "kernel_version": "6.8.0", "architecture": "x86_64",
+		"uptime_seconds": 3600, "load_average": [0.1, 0.2, 0.3],
+		"memory_total_bytes": 8000000000, "memory_available_bytes": 4000000000, "disk_usage_percent": 42.5
+	},
+	"metrics": {"anything": ["goes"]}
+}`
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want []Violation
+	}{
+		{"agent report", validReport, nil},
+		{"hostname only", `{"hostname": "web-1"}`, nil},
+		{"unknown fields", `{"hostname": "web-1", "update_output": "legacy", "update_results": {"new_field": 1}}`, nil},
+		{"schema_version 1", `{"schema_version": 1, "hostname": "web-1"}`, nil},
+		{"missing hostname", `{"agent_version": "1.4.0"}`, []Violation{{"hostname", "is required"}}},
+		{"wrong types", `{
+			"hostname": 7,
+			"timestamp": "yesterday",
+			"update_results": {"packages_updated": "3", "bytes_downloaded": 1.5, "error_message": false},
+			"system_info": {"load_average": [0.1, "high"]}
+		}`, []Violation{
+			{"hostname", "must be a string"},
+			{"system_info.load_average[1]", "must be a number"},
+			{"timestamp", "must be an RFC 3339 date-time"},
+			{"update_results.bytes_downloaded", "must be an integer"},
+			{"update_results.error_message", "must be a string or null"},
+			{"update_results.packages_updated", "must be an integer"},
+		}},
+		{"not an object", `["web-1"]`, []Violation{{"body", "must be an object"}}},
+		{"null section", `{"hostname": "web-1", "system_info": null}`, []Violation{{"system_info", "must be an object"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Validate([]byte(tt.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate_Errors(t *testing.T) {
+	for _, raw := range []string{`{"schema_version": 2, "hostname": "web-1"}`, `{"schema_version": 0}`} {
+		var unsupported *UnsupportedVersionError
+		if _, err := Validate([]byte(raw)); !errors.As(err, &unsupported) {
+			t.Errorf("%s: err = %v, want UnsupportedVersionError", raw, err)
+		}
+	}
+	if _, err := Validate([]byte(`{"hostname":`)); err == nil {
+		t.Error("truncated JSON accepted")
+	}
+}
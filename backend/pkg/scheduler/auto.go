@@ -0,0 +1,99 @@
+package scheduler
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	log "github.com/sirupsen/logrus"
+
+	"ubuntu-auto-update/backend/pkg/db"
+	"ubuntu-auto-update/backend/pkg/updater"
+)
+
+// AutoUpdate is the env-configured fleet update (AUTO_UPDATE_SCHEDULE). It
+// goes through the same bulk coordinator as API schedules, so runs, host
+// state and webhooks are recorded identically; it just picks its hosts at
+// fire time instead of from a stored host_ids snapshot.
+type AutoUpdate struct {
+	Cron Timetable
+	Tag  string // empty = every host
+}
+
+// Timetable says when an AutoUpdate next fires after a given time; a zero
+// time means never. Cron is the one main uses. An interface so tests can
+// fire faster than cron's one-minute resolution.
+type Timetable interface {
+	Next(t time.Time) time.Time
+}
+
+// RunAuto sleeps until each cron firing time and fires it, until ctx is
+// cancelled. Call as a goroutine from main.
+func RunAuto(ctx context.Context, dbx db.DBTX, coord Starter, a AutoUpdate) {
+	for {
+		next := a.Cron.Next(time.Now())
+		if next.IsZero() {
+			log.Errorf("auto-update: schedule never fires; automatic updates disabled")
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		FireAuto(ctx, dbx, coord, a, next)
+	}
+}
+
+// FireAuto claims the firing slot fireAt and, if this replica won it, starts
+// a bulk update over the matching hosts. It reports whether a run started.
+func FireAuto(ctx context.Context, dbx db.DBTX, coord Starter, a AutoUpdate, fireAt time.Time) bool {
+	tag, err := dbx.Exec(ctx, `INSERT INTO auto_update_fires (fire_at) VALUES ($1) ON CONFLICT DO NOTHING`, fireAt)
+	if err != nil {
+		log.Errorf("auto-update: claim %s: %v", fireAt.Format(time.RFC3339), err)
+		return false
+	}
+	if tag.RowsAffected() == 0 {
+		return false // another replica has it
+	}
+
+	ids, err := autoUpdateHostIDs(ctx, dbx, a.Tag)
+	if err != nil {
+		log.Errorf("auto-update: list hosts: %v", err)
+		return false
+	}
+	if len(ids) == 0 {
+		log.Infof("auto-update: no hosts to update")
+		return false
+	}
+	ids, ok := gateHosts(ctx, dbx, "auto-update", ids, time.Now())
+	if !ok {
+		return false
+	}
+	res, err := coord.Start(ctx, updater.BulkRunOptions{
+		HostIDs:     ids,
+		TriggeredBy: "auto-update",
+	})
+	if err != nil {
+		log.Errorf("auto-update: start: %v", err)
+		return false
+	}
+	log.Infof("auto-update: fired as group %s (%d hosts)", res.GroupID, len(ids))
+	return true
+}
+
+func autoUpdateHostIDs(ctx context.Context, dbx db.DBTX, tag string) ([]int32, error) {
+	var rows pgx.Rows
+	var err error
+	if tag == "" {
+		rows, err = dbx.Query(ctx, `SELECT id FROM hosts WHERE deleted_at IS NULL ORDER BY id`)
+	} else {
+		rows, err = dbx.Query(ctx, `SELECT id FROM hosts WHERE $1 = ANY(tags) AND deleted_at IS NULL ORDER BY id`, tag)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[int32])
+}
@@ -0,0 +1,54 @@
+package scheduler_test
+
+import (
+	"testing"
+	"time"
+
+	"ubuntu-auto-update/backend/pkg/scheduler"
+)
+
+func TestCronNext(t *testing.T) {
+	base := time.Date(2026, 3, 4, 10, 17, 30, 0, time.UTC) // Wednesday
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, 3, 4, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 3, 4, 10, 30, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2026, 3, 5, 3, 0, 0, 0, time.UTC)},
+		{"30 2 * * 0", time.Date(2026, 3, 8, 2, 30, 0, 0, time.UTC)},   // next Sunday
+		{"0 22 * * 1-5", time.Date(2026, 3, 4, 22, 0, 0, 0, time.UTC)}, // weekdays
+		{"0 0 1 * *", time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 4 * * 7", time.Date(2026, 3, 8, 4, 0, 0, 0, time.UTC)}, // 7 = Sunday
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Both day fields restricted: either may match (1st of month OR Friday).
+		{"0 12 1 * 5", time.Date(2026, 3, 6, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		c, err := scheduler.ParseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseCron(%q): %v", tt.expr, err)
+		}
+		if got := c.Next(base); !got.Equal(tt.want) {
+			t.Errorf("%q: Next = %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseCron_Invalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "@daily", "0 3 * * MON"} {
+		if _, err := scheduler.ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) succeeded", expr)
+		}
+	}
+}
+
+func TestCronNext_Impossible(t *testing.T) {
+	c, err := scheduler.ParseCron("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Next(time.Now()); !got.IsZero() {
+		t.Errorf("Feb 31 should never fire, got %s", got)
+	}
+}
@@ -16,6 +16,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"ubuntu-auto-update/backend/pkg/db"
+	"ubuntu-auto-update/backend/pkg/maintenance"
 	"ubuntu-auto-update/backend/pkg/models"
 	"ubuntu-auto-update/backend/pkg/playbooks"
 	"ubuntu-auto-update/backend/pkg/updater"
@@ -128,20 +129,7 @@ func (s Schedule) InWindow(now time.Time) bool {
 	if s.WindowStartMinute == nil || s.WindowEndMinute == nil {
 		return true
 	}
-	start, end := int(*s.WindowStartMinute), int(*s.WindowEndMinute)
-	now = now.UTC()
-	minute := now.Hour()*60 + now.Minute()
-	dayOK := func(d time.Weekday) bool { return s.WindowDays&(1<<uint(d)) != 0 }
-	if start <= end {
-		return dayOK(now.Weekday()) && minute >= start && minute < end
-	}
-	if minute >= start {
-		return dayOK(now.Weekday())
-	}
-	if minute < end {
-		return dayOK(now.Add(-24 * time.Hour).Weekday())
-	}
-	return false
+	return maintenance.InDailyWindow(int(*s.WindowStartMinute), int(*s.WindowEndMinute), s.WindowDays, now.UTC())
 }
 
 // NextWindowStart returns the next moment the window opens after now.
@@ -248,8 +236,12 @@ func Tick(ctx context.Context, dbx db.DBTX, coord Starter) {
 			}
 			continue
 		}
+		hostIDs, ok := gateHosts(ctx, dbx, "scheduler: "+s.Name, s.HostIDs, now)
+		if !ok {
+			continue
+		}
 		opts := updater.BulkRunOptions{
-			HostIDs:           s.HostIDs,
+			HostIDs:           hostIDs,
 			TriggeredBy:       "schedule:" + s.Name,
 			Concurrency:       int(s.Concurrency),
 			CanaryCount:       int(s.CanaryCount),
@@ -277,6 +269,22 @@ func Tick(ctx context.Context, dbx db.DBTX, coord Starter) {
 			log.Errorf("scheduler: fire %q: %v", s.Name, err)
 			continue
 		}
-		log.Infof("scheduler: fired %q as group %s (%d hosts)", s.Name, res.GroupID, len(s.HostIDs))
+		log.Infof("scheduler: fired %q as group %s (%d hosts)", s.Name, res.GroupID, len(hostIDs))
+	}
+}
+
+// gateHosts drops hosts that are outside their maintenance window at now and
+// logs them. ok is false when nothing is left to run, or when the windows
+// couldn't be read: updating a host at the wrong time is worse than waiting
+// for the next firing.
+func gateHosts(ctx context.Context, dbx db.DBTX, label string, hostIDs []int32, now time.Time) ([]int32, bool) {
+	allowed, skipped, err := maintenance.Gate(ctx, dbx, hostIDs, now)
+	if err != nil {
+		log.Errorf("%s: load maintenance windows: %v", label, err)
+		return nil, false
+	}
+	for _, sk := range skipped {
+		log.Infof("%s: host %d %s", label, sk.HostID, sk.Reason)
 	}
+	return allowed, len(allowed) > 0
 }
@@ -2,14 +2,29 @@ package scheduler_test
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/pem"
 	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/pashagolub/pgxmock/v4"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 
+	"ubuntu-auto-update/backend/pkg/crypto"
+	"ubuntu-auto-update/backend/pkg/db"
 	"ubuntu-auto-update/backend/pkg/models"
 	"ubuntu-auto-update/backend/pkg/scheduler"
+	sshpkg "ubuntu-auto-update/backend/pkg/ssh"
 	"ubuntu-auto-update/backend/pkg/updater"
 )
 
@@ -32,6 +47,16 @@ func schedRows(mock pgxmock.PgxPoolIface) *pgxmock.Rows {
 		"concurrency", "canary_count", "canary_wait_seconds", "abort_on_failure_pct", "window_start_minute", "window_end_minute", "window_days", "security_only"})
 }
 
+func mwRows(mock pgxmock.PgxPoolIface) *pgxmock.Rows {
+	return mock.NewRows([]string{"id", "name", "host_id", "start_minute", "end_minute", "days", "timezone", "created_by", "created_at"})
+}
+
+// expectNoWindows answers one maintenance-window lookup with no windows, so
+// every host is allowed.
+func expectNoWindows(mock pgxmock.PgxPoolIface) {
+	mock.ExpectQuery(`FROM maintenance_windows`).WithArgs(pgxmock.AnyArg()).WillReturnRows(mwRows(mock))
+}
+
 func TestTickFiresDueSchedules(t *testing.T) {
 	mock, err := pgxmock.NewPool()
 	if err != nil {
@@ -44,6 +69,7 @@ func TestTickFiresDueSchedules(t *testing.T) {
 		WillReturnRows(schedRows(mock).
 			AddRow(int32(1), "nightly", []int32{1, 2}, int32(1440), now, true, "admin", now, nil, int32(0), int32(0), int32(0), int32(0), nil, nil, int16(127), false).
 			AddRow(int32(2), "empty", []int32{}, int32(60), now, true, "admin", now, nil, int32(0), int32(0), int32(0), int32(0), nil, nil, int16(127), false))
+	expectNoWindows(mock)
 
 	st := &fakeStarter{}
 	scheduler.Tick(context.Background(), mock, st)
@@ -71,6 +97,8 @@ func TestTickSurvivesStarterError(t *testing.T) {
 		WillReturnRows(schedRows(mock).
 			AddRow(int32(1), "a", []int32{1}, int32(60), now, true, "admin", now, nil, int32(0), int32(0), int32(0), int32(0), nil, nil, int16(127), false).
 			AddRow(int32(2), "b", []int32{2}, int32(60), now, true, "admin", now, nil, int32(0), int32(0), int32(0), int32(0), nil, nil, int16(127), false))
+	expectNoWindows(mock)
+	expectNoWindows(mock)
 
 	st := &fakeStarter{err: errors.New("host gone")}
 	scheduler.Tick(context.Background(), mock, st)
@@ -93,6 +121,7 @@ func TestTickPlaybookSchedule(t *testing.T) {
 	mock.ExpectQuery(`UPDATE schedules`).
 		WillReturnRows(schedRows(mock).
 			AddRow(int32(1), "pb-sched", []int32{5}, int32(60), now, true, "admin", now, &pbID, int32(0), int32(0), int32(0), int32(0), nil, nil, int16(127), false))
+	expectNoWindows(mock)
 	mock.ExpectQuery(`SELECT (.+) FROM playbooks WHERE id = \$1`).
 		WithArgs(pbID).
 		WillReturnRows(pbRows(mock).AddRow(pbID, "harden", "", []string{"echo hi"}, true, "admin", now, now))
@@ -128,6 +157,7 @@ func TestTickAptScheduleZeroValued(t *testing.T) {
 	mock.ExpectQuery(`UPDATE schedules`).
 		WillReturnRows(schedRows(mock).
 			AddRow(int32(1), "apt", []int32{5}, int32(60), now, true, "admin", now, nil, int32(0), int32(0), int32(0), int32(0), nil, nil, int16(127), false))
+	expectNoWindows(mock)
 
 	st := &fakeStarter{}
 	scheduler.Tick(context.Background(), mock, st)
@@ -234,6 +264,37 @@ func TestTickDefersOutsideWindow(t *testing.T) {
 	}
 }
 
+// Hosts outside their own maintenance window are dropped from the run; the
+// rest still fire.
+func TestTickSkipsHostsOutsideMaintenanceWindow(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+
+	now := time.Now()
+	// Host 2's only window closed a minute ago.
+	past := int32((now.UTC().Hour()*60 + now.UTC().Minute() + 1438) % 1440)
+	end := (past + 1) % 1440
+	host2 := int32(2)
+	mock.ExpectQuery(`UPDATE schedules`).
+		WillReturnRows(schedRows(mock).
+			AddRow(int32(1), "nightly", []int32{1, 2}, int32(60), now, true, "admin", now, nil, int32(0), int32(0), int32(0), int32(0), nil, nil, int16(127), false))
+	mock.ExpectQuery(`FROM maintenance_windows`).WithArgs([]int32{1, 2}).
+		WillReturnRows(mwRows(mock).AddRow(int32(1), "db", &host2, past, end, int16(127), "UTC", "admin", now))
+
+	st := &fakeStarter{}
+	scheduler.Tick(context.Background(), mock, st)
+
+	if len(st.calls) != 1 {
+		t.Fatalf("expected 1 fire, got %d", len(st.calls))
+	}
+	if got := st.calls[0].HostIDs; len(got) != 1 || got[0] != 1 {
+		t.Errorf("HostIDs = %v, want [1]", got)
+	}
+}
+
 // Rollout knobs stored on the schedule reach the coordinator options.
 func TestTickPassesRolloutKnobs(t *testing.T) {
 	mock, err := pgxmock.NewPool()
@@ -246,6 +307,7 @@ func TestTickPassesRolloutKnobs(t *testing.T) {
 	mock.ExpectQuery(`UPDATE schedules`).
 		WillReturnRows(schedRows(mock).
 			AddRow(int32(1), "staged", []int32{1, 2, 3}, int32(60), now, true, "admin", now, nil, int32(3), int32(1), int32(120), int32(50), nil, nil, int16(127), false))
+	expectNoWindows(mock)
 
 	st := &fakeStarter{}
 	scheduler.Tick(context.Background(), mock, st)
@@ -258,3 +320,217 @@ func TestTickPassesRolloutKnobs(t *testing.T) {
 		t.Errorf("knobs not passed through: %+v", o)
 	}
 }
+
+func TestFireAuto(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+
+	c, _ := scheduler.ParseCron("*/5 * * * *")
+	auto := scheduler.AutoUpdate{Cron: c, Tag: "prod"}
+	fireAt := c.Next(time.Now())
+
+	mock.ExpectExec(`INSERT INTO auto_update_fires`).WithArgs(fireAt).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectQuery(`SELECT id FROM hosts WHERE \$1 = ANY\(tags\)`).WithArgs("prod").
+		WillReturnRows(mock.NewRows([]string{"id"}).AddRow(int32(3)).AddRow(int32(5)))
+	expectNoWindows(mock)
+
+	st := &fakeStarter{}
+	if !scheduler.FireAuto(context.Background(), mock, st, auto, fireAt) {
+		t.Fatal("expected the run to fire")
+	}
+	if len(st.calls) != 1 {
+		t.Fatalf("expected 1 Start, got %d", len(st.calls))
+	}
+	if got := st.calls[0]; got.TriggeredBy != "auto-update" || len(got.HostIDs) != 2 || got.HostIDs[0] != 3 {
+		t.Errorf("unexpected options %+v", got)
+	}
+
+	// A second replica loses the claim for the same slot and does nothing.
+	mock.ExpectExec(`INSERT INTO auto_update_fires`).WithArgs(fireAt).
+		WillReturnResult(pgxmock.NewResult("INSERT", 0))
+	if scheduler.FireAuto(context.Background(), mock, st, auto, fireAt) {
+		t.Error("lost claim must not fire")
+	}
+	if len(st.calls) != 1 {
+		t.Errorf("Start called again after lost claim")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// onceTimetable fires once, after, and never again.
+type onceTimetable struct {
+	after time.Duration
+	fired bool
+}
+
+func (o *onceTimetable) Next(t time.Time) time.Time {
+	if o.fired {
+		return time.Time{}
+	}
+	o.fired = true
+	return t.Add(o.after)
+}
+
+// newExecServer starts an SSH server on 127.0.0.1 that accepts any key,
+// answers each exec with output and exit 0, and sends the command it ran on
+// the returned channel. The caller trusts hostKey.
+func newExecServer(t *testing.T, output string) (addr string, hostKey gossh.PublicKey, cmds <-chan string) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &gossh.ServerConfig{
+		PublicKeyCallback: func(gossh.ConnMetadata, gossh.PublicKey) (*gossh.Permissions, error) {
+			return &gossh.Permissions{}, nil
+		},
+	}
+	cfg.AddHostKey(signer)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	ran := make(chan string, 8)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := gossh.NewServerConn(conn, cfg)
+				if err != nil {
+					return
+				}
+				go gossh.DiscardRequests(reqs)
+				for nc := range chans {
+					ch, chReqs, err := nc.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer ch.Close()
+						for req := range chReqs {
+							var payload struct{ Command string }
+							if req.Type != "exec" || gossh.Unmarshal(req.Payload, &payload) != nil {
+								_ = req.Reply(false, nil)
+								continue
+							}
+							_ = req.Reply(true, nil)
+							ran <- payload.Command
+							_, _ = io.WriteString(ch, output)
+							_, _ = ch.SendRequest("exit-status", false, binary.BigEndian.AppendUint32(nil, 0))
+							return
+						}
+					}()
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), signer.PublicKey(), ran
+}
+
+// End to end: when the auto-update schedule comes round, RunAuto starts a
+// bulk update through the real coordinator, which updates the host over
+// SSH and records the run.
+func TestRunAuto_UpdatesHostOverSSH(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY", strings.Repeat("00", 32))
+	const output = "Reading package lists... Done\n"
+	addr, hostKey, ran := newExecServer(t, output)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{addr}, hostKey)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOST_KEY_STORE", "file")
+	t.Setenv("KNOWN_HOSTS_FILE", knownHosts)
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := gossh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encKey, err := crypto.Encrypt(string(pem.EncodeToMemory(block)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+
+	cmd, _ := updater.DefaultCommands.Command("root", false, "")
+	now := time.Now()
+	mock.ExpectExec(`INSERT INTO auto_update_fires`).WithArgs(pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectQuery(`SELECT id FROM hosts WHERE deleted_at IS NULL`).
+		WillReturnRows(mock.NewRows([]string{"id"}).AddRow(int32(1)))
+	expectNoWindows(mock)
+	mock.ExpectQuery(`INSERT INTO update_runs`).
+		WithArgs(int32(1), pgxmock.AnyArg(), "auto-update", models.RunKindUpdate, nil).
+		WillReturnRows(mock.NewRows([]string{"id", "host_id", "run_group_id", "triggered_by", "kind", "status", "exit_code", "started_at", "finished_at", "output", "error", "playbook_id", "kept_back"}).
+			AddRow(int32(11), int32(1), nil, "auto-update", models.RunKindUpdate, models.RunStatusRunning, nil, now, nil, "", nil, nil, nil))
+	mock.ExpectExec(`INSERT INTO run_group_phases`).WithArgs(pgxmock.AnyArg(), 1, "all", []int32{1}).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectExec(`UPDATE run_group_phases`).
+		WithArgs(pgxmock.AnyArg(), 1, models.RunPhaseRunning, 0, 0, "").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectQuery(`SELECT .+ FROM hosts WHERE id = \$1`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "architecture", "offline_since", "update_output_truncated", "upgrade_output_truncated", "update_policy", "deleted_at", "environment"}).
+			AddRow(int32(1), addr, "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+	mock.ExpectQuery(`SELECT id, host_id, private_key FROM ssh_keys`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows([]string{"id", "host_id", "private_key"}).AddRow(int32(1), int32(1), encKey))
+	mock.ExpectQuery(`SELECT password FROM host_sudo_passwords`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows([]string{"password"}))
+	for _, chunk := range []string{"$ " + cmd + "\n", output} {
+		mock.ExpectExec(`UPDATE update_runs\s+SET output`).
+			WithArgs(int32(11), chunk, db.MaxRunOutputBytes, db.RunOutputTruncatedMarker).
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	}
+	mock.ExpectExec(`UPDATE update_runs\s+SET status`).
+		WithArgs(int32(11), models.RunStatusSucceeded, sql.NullInt32{Int32: 0, Valid: true}, sql.NullString{}).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectExec(`UPDATE run_group_phases`).
+		WithArgs(pgxmock.AnyArg(), 1, models.RunPhaseCompleted, 1, 0, "").
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	coord := updater.New(mock, sshpkg.NewDialer(mock))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// The timetable fires once, 20ms in, then never, so RunAuto returns.
+	scheduler.RunAuto(ctx, mock, coord, scheduler.AutoUpdate{Cron: &onceTimetable{after: 20 * time.Millisecond}})
+
+	select {
+	case got := <-ran:
+		if got != cmd {
+			t.Errorf("host ran %q, want the update command %q", got, cmd)
+		}
+	case <-ctx.Done():
+		t.Fatal("the scheduled update never reached the host")
+	}
+	for coord.InFlightCount() > 0 {
+		if ctx.Err() != nil {
+			t.Fatal("the scheduled update never finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"ubuntu-auto-update/backend/pkg/db"
+	"ubuntu-auto-update/backend/pkg/store"
+)
+
+// ---------------------------------------------------------------------------
+// KV store: sessions in a pkg/store (Redis when REDIS_URL is set), shared
+// across backend replicas without a sessions-table round trip per request.
+// ---------------------------------------------------------------------------
+
+type kvStore struct {
+	kv     store.Store
+	users  db.DBTX
+	legacy Store
+}
+
+// kvSession is what a session key holds. Username and Role are refreshed
+// from users on Validate when the store has a DB.
+type kvSession struct {
+	UserID   int32  `json:"user_id,omitempty"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// errAgentSession refuses to store an agent principal: agents authenticate
+// with agent tokens, not sessions.
+var errAgentSession = errors.New("agents use agent tokens, not sessions")
+
+// NewKVStore returns a session store on kv for user sessions. Keys expire
+// with their sessions, so CleanExpired only has legacy's leftovers to
+// clean. With a non-nil users, a session reads the user's current name and
+// role on each Validate and is dropped once the user is disabled or
+// deleted, as with NewDBStore.
+//
+// legacy, if non-nil, is the store sessions lived in before: tokens kv
+// doesn't know are validated and revoked there, so switching stores
+// doesn't log everyone out, and an agent session left there still reaches
+// the middleware that drops it. New sessions only go to kv.
+func NewKVStore(kv store.Store, users db.DBTX, legacy Store) Store {
+	return &kvStore{kv: kv, users: users, legacy: legacy}
+}
+
+func kvKey(token string) string { return "session:" + hashToken(token) }
+
+func (s *kvStore) Create(ctx context.Context, p Principal, expiry time.Duration, _, _ string) (string, error) {
+	if expiry <= 0 {
+		return "", errors.New("expiry must be positive")
+	}
+	if p.IsAgent() || p.Role == RoleAgent {
+		return "", errAgentSession
+	}
+	tok, err := GenerateToken()
+	if err != nil {
+		return "", err
+	}
+	raw, err := json.Marshal(kvSession{UserID: p.UserID, Username: p.Username, Role: p.Role})
+	if err != nil {
+		return "", err
+	}
+	if err := s.kv.Set(ctx, kvKey(tok), raw, expiry); err != nil {
+		return "", fmt.Errorf("store session: %w", err)
+	}
+	return tok, nil
+}
+
+func (s *kvStore) Validate(ctx context.Context, token string) (Principal, bool, error) {
+	if token == "" {
+		return Principal{}, false, nil
+	}
+	raw, ok, err := s.kv.Get(ctx, kvKey(token))
+	if err != nil {
+		return Principal{}, false, fmt.Errorf("lookup session: %w", err)
+	}
+	if !ok {
+		if s.legacy != nil {
+			return s.legacy.Validate(ctx, token)
+		}
+		return Principal{}, false, nil
+	}
+	var sess kvSession
+	if err := json.Unmarshal(raw, &sess); err != nil {
+		return Principal{}, false, fmt.Errorf("decode session: %w", err)
+	}
+	if sess.Role == RoleAgent {
+		// An agent session stored before agent tokens. Without its host it
+		// would pass for a principal that isn't an agent, so drop it; the
+		// agent enrolls again.
+		_ = s.kv.Delete(ctx, kvKey(token))
+		return Principal{}, false, nil
+	}
+
+	p := Principal{UserID: sess.UserID, Username: sess.Username, Role: sess.Role}
+	if s.users == nil || sess.UserID == 0 {
+		return p, true, nil
+	}
+	var disabledAt *time.Time
+	err = s.users.QueryRow(ctx, `SELECT username, role, disabled_at FROM users WHERE id = $1`, sess.UserID).
+		Scan(&p.Username, &p.Role, &disabledAt)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && disabledAt != nil) {
+		// Same as the DB store: drop it so a re-enable starts clean.
+		_ = s.kv.Delete(ctx, kvKey(token))
+		return Principal{}, false, nil
+	}
+	if err != nil {
+		return Principal{}, false, fmt.Errorf("lookup session user: %w", err)
+	}
+	return p, true, nil
+}
+
+func (s *kvStore) Revoke(ctx context.Context, token string) error {
+	if token == "" {
+		return nil
+	}
+	if err := s.kv.Delete(ctx, kvKey(token)); err != nil {
+		return err
+	}
+	if s.legacy != nil {
+		return s.legacy.Revoke(ctx, token)
+	}
+	return nil
+}
+
+func (s *kvStore) CleanExpired(ctx context.Context) error {
+	if s.legacy != nil {
+		return s.legacy.CleanExpired(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/jackc/pgx/v5"
+	"github.com/pashagolub/pgxmock/v4"
+	"github.com/redis/go-redis/v9"
+
+	"ubuntu-auto-update/backend/pkg/store"
+)
+
+func newRedisKV(t *testing.T) (store.Store, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return store.NewRedis(client), mr
+}
+
+// A session stored through one replica's store validates through another's
+// sharing the same Redis, and is gone for both once revoked or expired.
+func TestKVStore_SessionAcrossReplicas(t *testing.T) {
+	kv, mr := newRedisKV(t)
+	a, b := NewKVStore(kv, nil, nil), NewKVStore(kv, nil, nil)
+	ctx := context.Background()
+
+	tok, err := a.Create(ctx, Principal{UserID: 3, Username: "alice", Role: RoleOperator}, time.Hour, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("session:" + tok) {
+		t.Error("raw token used as the key")
+	}
+	p, ok, err := b.Validate(ctx, tok)
+	if err != nil || !ok {
+		t.Fatalf("Validate: ok=%v err=%v", ok, err)
+	}
+	if p.UserID != 3 || p.Username != "alice" || p.Role != RoleOperator {
+		t.Errorf("got %+v", p)
+	}
+
+	if err := b.Revoke(ctx, tok); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := a.Validate(ctx, tok); ok {
+		t.Error("revoked token still valid")
+	}
+
+	tok, _ = a.Create(ctx, Principal{UserID: 3, Username: "alice", Role: RoleOperator}, time.Minute, "", "")
+	mr.FastForward(2 * time.Minute)
+	if _, ok, _ := b.Validate(ctx, tok); ok {
+		t.Error("expired token still valid")
+	}
+	if _, ok, _ := b.Validate(ctx, "nope"); ok {
+		t.Error("unknown token valid")
+	}
+}
+
+// Agents hold agent tokens, so the store takes no agent sessions, and one
+// written before agent tokens is dropped rather than passed off as a
+// principal that isn't an agent.
+func TestKVStore_NoAgentSessions(t *testing.T) {
+	kv, mr := newRedisKV(t)
+	s := NewKVStore(kv, nil, nil)
+	ctx := context.Background()
+
+	if _, err := s.Create(ctx, Principal{AgentLabel: "web-1", Username: "agent:web-1", Role: RoleAgent}, time.Hour, "", ""); err == nil {
+		t.Error("agent session stored")
+	}
+
+	tok, _ := GenerateToken()
+	if err := kv.Set(ctx, kvKey(tok), []byte(`{"username":"agent:web-1","role":"agent","agent_label":"web-1"}`), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if p, ok, err := s.Validate(ctx, tok); err != nil || ok {
+		t.Errorf("old agent session: %+v ok=%v err=%v", p, ok, err)
+	}
+	if len(mr.Keys()) != 0 {
+		t.Errorf("old agent session kept: %v", mr.Keys())
+	}
+}
+
+// A user session picks up the user's current role and dies with the user,
+// as in the DB store.
+func TestKVStore_UserSessionTracksUsersRow(t *testing.T) {
+	kv, mr := newRedisKV(t)
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	s := NewKVStore(kv, mock, nil)
+	ctx := context.Background()
+
+	tok, err := s.Create(ctx, Principal{UserID: 3, Username: "alice", Role: RoleAdmin}, time.Hour, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery(`SELECT username, role, disabled_at FROM users WHERE id = \$1`).WithArgs(int32(3)).
+		WillReturnRows(mock.NewRows([]string{"username", "role", "disabled_at"}).AddRow("alice", RoleViewer, nil))
+	p, ok, err := s.Validate(ctx, tok)
+	if err != nil || !ok || p.UserID != 3 || p.Role != RoleViewer {
+		t.Fatalf("got %+v ok=%v err=%v", p, ok, err)
+	}
+
+	disabled := time.Now()
+	mock.ExpectQuery(`FROM users`).WithArgs(int32(3)).
+		WillReturnRows(mock.NewRows([]string{"username", "role", "disabled_at"}).AddRow("alice", RoleViewer, &disabled))
+	if _, ok, _ := s.Validate(ctx, tok); ok {
+		t.Error("disabled user's session still valid")
+	}
+	if len(mr.Keys()) != 0 {
+		t.Errorf("disabled user's session kept: %v", mr.Keys())
+	}
+
+	tok, _ = s.Create(ctx, Principal{UserID: 4, Username: "bob", Role: RoleViewer}, time.Hour, "", "")
+	mock.ExpectQuery(`FROM users`).WithArgs(int32(4)).WillReturnError(pgx.ErrNoRows)
+	if _, ok, _ := s.Validate(ctx, tok); ok {
+		t.Error("deleted user's session still valid")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// Sessions created before the switch keep working through the legacy store.
+func TestKVStore_FallsBackToLegacy(t *testing.T) {
+	kv, _ := newRedisKV(t)
+	legacy := NewMemoryStore()
+	s := NewKVStore(kv, nil, legacy)
+	ctx := context.Background()
+
+	old, _ := legacy.Create(ctx, Principal{AgentLabel: "db-1", Role: RoleAgent}, time.Hour, "", "")
+	if p, ok, err := s.Validate(ctx, old); err != nil || !ok || p.AgentLabel != "db-1" {
+		t.Fatalf("legacy token: %+v ok=%v err=%v", p, ok, err)
+	}
+	if err := s.Revoke(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := legacy.Validate(ctx, old); ok {
+		t.Error("revoke didn't reach the legacy store")
+	}
+
+	tok, _ := s.Create(ctx, Principal{UserID: 5, Username: "carol", Role: RoleViewer}, time.Hour, "", "")
+	if _, ok, _ := legacy.Validate(ctx, tok); ok {
+		t.Error("new session written to the legacy store")
+	}
+}
@@ -0,0 +1,127 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"ubuntu-auto-update/backend/pkg/db"
+)
+
+// Refresh tokens live in the refresh_tokens table (migration 000036) and are
+// always DB-backed: only DB users can refresh, so there is no memory variant.
+// A login starts a family; each refresh spends the presented token and
+// issues the next one in that family, which keeps the family's expiry. The
+// user therefore has to log in again once it runs out, however often they
+// refresh.
+
+// DefaultRefreshExpiry is how long a refresh family lasts when
+// REFRESH_TOKEN_EXPIRY is unset.
+const DefaultRefreshExpiry = 7 * 24 * time.Hour
+
+var (
+	// ErrRefreshInvalid covers unknown and expired refresh tokens.
+	ErrRefreshInvalid = errors.New("invalid refresh token")
+	// ErrRefreshReused means an already-spent token came back: someone
+	// else holds a copy, so its whole family has been revoked.
+	ErrRefreshReused = errors.New("refresh token reused")
+)
+
+// IssueRefreshToken starts a new refresh family for userID and returns its
+// first token.
+func IssueRefreshToken(ctx context.Context, dbx db.DBTX, userID int32, expiry time.Duration) (string, error) {
+	if expiry <= 0 {
+		return "", errors.New("expiry must be positive")
+	}
+	family, err := GenerateToken()
+	if err != nil {
+		return "", err
+	}
+	return insertRefreshToken(ctx, dbx, userID, family, time.Now().Add(expiry))
+}
+
+func insertRefreshToken(ctx context.Context, dbx db.DBTX, userID int32, family string, expiresAt time.Time) (string, error) {
+	tok, err := GenerateToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = dbx.Exec(ctx, `
+		INSERT INTO refresh_tokens (token_hash, family, user_id, expires_at)
+		VALUES ($1, $2, $3, $4)`,
+		hashToken(tok), family, userID, expiresAt)
+	if err != nil {
+		return "", fmt.Errorf("insert refresh token: %w", err)
+	}
+	return tok, nil
+}
+
+// RotateRefreshToken spends token and returns its user plus the next token
+// in the family. Spending the token and issuing the next one are a single
+// statement, so two concurrent refreshes with the same token can't both
+// succeed and a failed insert can't leave the family with no live token.
+// A token whose user is locked out after failed logins can't be spent until
+// the lock runs out; it is refused as invalid.
+func RotateRefreshToken(ctx context.Context, dbx db.DBTX, token string) (userID int32, next string, err error) {
+	if token == "" {
+		return 0, "", ErrRefreshInvalid
+	}
+	next, err = GenerateToken()
+	if err != nil {
+		return 0, "", err
+	}
+	hashed := hashToken(token)
+	err = dbx.QueryRow(ctx, `
+		WITH spent AS (
+			UPDATE refresh_tokens t SET used_at = NOW()
+			FROM users u
+			WHERE t.token_hash = $1 AND t.used_at IS NULL AND t.expires_at > NOW()
+			  AND u.id = t.user_id AND (u.locked_until IS NULL OR u.locked_until <= NOW())
+			RETURNING t.user_id, t.family, t.expires_at
+		)
+		INSERT INTO refresh_tokens (token_hash, family, user_id, expires_at)
+		SELECT $2, family, user_id, expires_at FROM spent
+		RETURNING user_id`, hashed, hashToken(next),
+	).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, "", refreshRejected(ctx, dbx, hashed)
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("rotate refresh token: %w", err)
+	}
+	return userID, next, nil
+}
+
+// refreshRejected works out why a token couldn't be spent. A token that was
+// already used revokes its family; anything else is simply invalid.
+func refreshRejected(ctx context.Context, dbx db.DBTX, hashed string) error {
+	tag, err := dbx.Exec(ctx, `
+		DELETE FROM refresh_tokens
+		WHERE family = (SELECT family FROM refresh_tokens
+		                WHERE token_hash = $1 AND used_at IS NOT NULL)`, hashed)
+	if err != nil {
+		return fmt.Errorf("revoke reused refresh family: %w", err)
+	}
+	if tag.RowsAffected() > 0 {
+		return ErrRefreshReused
+	}
+	return ErrRefreshInvalid
+}
+
+// RevokeRefreshToken deletes the family token belongs to. Idempotent —
+// unknown tokens are not errors.
+func RevokeRefreshToken(ctx context.Context, dbx db.DBTX, token string) error {
+	if token == "" {
+		return nil
+	}
+	_, err := dbx.Exec(ctx, `
+		DELETE FROM refresh_tokens
+		WHERE family = (SELECT family FROM refresh_tokens WHERE token_hash = $1)`,
+		hashToken(token))
+	if err != nil {
+		return fmt.Errorf("revoke refresh token: %w", err)
+	}
+	return nil
+}
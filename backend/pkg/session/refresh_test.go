@@ -0,0 +1,92 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock/v4"
+)
+
+func newRefreshMock(t *testing.T) pgxmock.PgxPoolIface {
+	t.Helper()
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unfulfilled expectations: %v", err)
+		}
+		mock.Close()
+	})
+	return mock
+}
+
+const rotateSQL = `WITH spent AS \(\s*UPDATE refresh_tokens t SET used_at = NOW\(\)` +
+	`.+u\.locked_until IS NULL OR u\.locked_until <= NOW\(\)` +
+	`.+INSERT INTO refresh_tokens .+ FROM spent`
+
+func TestIssueRefreshToken(t *testing.T) {
+	mock := newRefreshMock(t)
+	mock.ExpectExec(`INSERT INTO refresh_tokens`).
+		WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), int32(5), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	tok, err := IssueRefreshToken(context.Background(), mock, 5, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tok) != 64 {
+		t.Errorf("token %q is not 32 hex-encoded bytes", tok)
+	}
+}
+
+// Spending the token and issuing the next one in its family is one
+// statement.
+func TestRotateRefreshToken(t *testing.T) {
+	mock := newRefreshMock(t)
+	mock.ExpectQuery(rotateSQL).WithArgs(hashToken("old"), pgxmock.AnyArg()).
+		WillReturnRows(mock.NewRows([]string{"user_id"}).AddRow(int32(5)))
+
+	userID, next, err := RotateRefreshToken(context.Background(), mock, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != 5 || next == "" || next == "old" {
+		t.Errorf("got user %d, next %q", userID, next)
+	}
+}
+
+// A spent token coming back revokes its whole family.
+func TestRotateRefreshToken_Reused(t *testing.T) {
+	mock := newRefreshMock(t)
+	mock.ExpectQuery(rotateSQL).WithArgs(hashToken("old"), pgxmock.AnyArg()).
+		WillReturnRows(mock.NewRows([]string{"user_id"}))
+	mock.ExpectExec(`DELETE FROM refresh_tokens\s+WHERE family = .+used_at IS NOT NULL`).WithArgs(hashToken("old")).
+		WillReturnResult(pgxmock.NewResult("DELETE", 2))
+
+	_, _, err := RotateRefreshToken(context.Background(), mock, "old")
+	if !errors.Is(err, ErrRefreshReused) {
+		t.Errorf("err = %v, want ErrRefreshReused", err)
+	}
+}
+
+// Expired and unknown tokens, and those of a locked-out user, can't be spent and don't touch any family.
+func TestRotateRefreshToken_ExpiredOrUnknown(t *testing.T) {
+	mock := newRefreshMock(t)
+	mock.ExpectQuery(rotateSQL).WithArgs(hashToken("stale"), pgxmock.AnyArg()).
+		WillReturnRows(mock.NewRows([]string{"user_id"}))
+	mock.ExpectExec(`DELETE FROM refresh_tokens`).WithArgs(hashToken("stale")).
+		WillReturnResult(pgxmock.NewResult("DELETE", 0))
+
+	_, _, err := RotateRefreshToken(context.Background(), mock, "stale")
+	if !errors.Is(err, ErrRefreshInvalid) {
+		t.Errorf("err = %v, want ErrRefreshInvalid", err)
+	}
+
+	if _, _, err := RotateRefreshToken(context.Background(), mock, ""); !errors.Is(err, ErrRefreshInvalid) {
+		t.Errorf("empty token: err = %v, want ErrRefreshInvalid", err)
+	}
+}
@@ -2,6 +2,11 @@
 // in-memory store (legacy + tests) or a Postgres-backed one (production with
 // >1 backend). Tokens are hex-encoded random strings; the store sees only
 // SHA-256 hashes so a database leak does not yield live session tokens.
+//
+// Agents don't hold sessions: they authenticate with agent tokens kept in
+// Postgres, which can be listed and revoked per host. The stores here only
+// still know agent sessions from before those tokens, so the auth
+// middleware can recognise and drop them.
 package session
 
 import (
@@ -27,6 +32,7 @@ type Principal struct {
 	Role       string // 'viewer' | 'operator' | 'admin' for users; 'agent' for agents
 	SessionID  int32  // DB row id for the session, 0 for memory store
 	AgentLabel string // hostname for agents, empty otherwise
+	HostID     int32  // host an agent token was issued to, 0 otherwise
 }
 
 // IsAgent reports whether the principal is an agent enrollment token rather
@@ -273,8 +279,13 @@ func (s *dbStore) Revoke(ctx context.Context, token string) error {
 	return err
 }
 
+// CleanExpired also drops expired refresh tokens, which live alongside the
+// sessions they renew.
 func (s *dbStore) CleanExpired(ctx context.Context) error {
-	_, err := s.pool.Exec(ctx, `DELETE FROM sessions WHERE expires_at < NOW()`)
+	if _, err := s.pool.Exec(ctx, `DELETE FROM sessions WHERE expires_at < NOW()`); err != nil {
+		return err
+	}
+	_, err := s.pool.Exec(ctx, `DELETE FROM refresh_tokens WHERE expires_at < NOW()`)
 	return err
 }
 
@@ -0,0 +1,110 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Bastion is a jump host every outbound SSH connection is tunnelled
+// through. The target's host key is still checked end to end; the tunnel
+// only carries the bytes.
+type Bastion struct {
+	Addr   string // host or host:port
+	User   string
+	Signer gossh.Signer
+	// HostKey pins the bastion's own host key. Nil checks it against the
+	// same store (host_keys or known_hosts) as the targets.
+	HostKey gossh.PublicKey
+}
+
+// NewBastion parses the bastion settings main reads from the environment.
+// hostKey is an optional authorized_keys-format public key.
+func NewBastion(addr, user, privateKeyPEM, hostKey string) (*Bastion, error) {
+	addr, user = strings.TrimSpace(addr), strings.TrimSpace(user)
+	if addr == "" || user == "" {
+		return nil, errors.New("bastion host and user are both required")
+	}
+	if err := ValidateHostname(NormalizeHostname(stripPort(addr))); err != nil {
+		return nil, fmt.Errorf("bastion host: %w", err)
+	}
+	signer, err := gossh.ParsePrivateKey([]byte(privateKeyPEM))
+	if err != nil {
+		return nil, fmt.Errorf("bastion key: %w", err)
+	}
+	b := &Bastion{Addr: addr, User: user, Signer: signer}
+	if strings.TrimSpace(hostKey) != "" {
+		if b.HostKey, _, _, _, err = gossh.ParseAuthorizedKey([]byte(hostKey)); err != nil {
+			return nil, fmt.Errorf("bastion host key: %w", err)
+		}
+	}
+	return b, nil
+}
+
+// dial opens an SSH client to addr, through d.Bastion when one is set.
+// Every target dial goes through here so Bootstrap, key verification and
+// runs all take the same route.
+func (d *Dialer) dial(ctx context.Context, addr string, cfg *gossh.ClientConfig) (*gossh.Client, error) {
+	b := d.Bastion
+	if b == nil {
+		return dialContext(ctx, addr, cfg)
+	}
+
+	hostKeyCB := gossh.FixedHostKey(b.HostKey)
+	if b.HostKey == nil {
+		var err error
+		if hostKeyCB, err = d.hostKeyCallback(); err != nil {
+			return nil, fmt.Errorf("load known_hosts: %w", err)
+		}
+	}
+	jump, err := dialContext(ctx, sshAddr(b.Addr), &gossh.ClientConfig{
+		User:            b.User,
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(b.Signer)},
+		HostKeyCallback: hostKeyCB,
+		Timeout:         cfg.Timeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("bastion %s: %w", b.Addr, err)
+	}
+	conn, err := jump.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		jump.Close()
+		return nil, fmt.Errorf("dial %s via bastion %s: %w", addr, b.Addr, err)
+	}
+	client, err := handshake(ctx, conn, addr, cfg)
+	if err != nil {
+		jump.Close()
+		return nil, err
+	}
+	// The bastion connection lives exactly as long as the target's.
+	go func() {
+		_ = client.Wait()
+		jump.Close()
+	}()
+	return client, nil
+}
+
+// handshake runs the SSH client handshake over conn, giving up when ctx
+// ends. It closes conn on failure.
+func handshake(ctx context.Context, conn net.Conn, addr string, cfg *gossh.ClientConfig) (*gossh.Client, error) {
+	// A host that accepts TCP and then says nothing would otherwise hold the
+	// dial forever. Closing conn is the only interrupt that works for both
+	// a TCP socket and a channel through a bastion.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	c, chans, reqs, err := gossh.NewClientConn(conn, addr, cfg)
+	if !stop() {
+		if err == nil {
+			c.Close()
+		}
+		return nil, fmt.Errorf("ssh handshake with %s: %w", addr, ctx.Err())
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return gossh.NewClient(c, chans, reqs), nil
+}
@@ -0,0 +1,175 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+// newBastionServer starts an SSH server that only forwards direct-tcpip
+// channels, as `ssh -J` uses. It counts the forwards it opened.
+func newBastionServer(t *testing.T) (addr string, hostKey gossh.PublicKey, forwards *atomic.Int32) {
+	t.Helper()
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer := mustSigner(t, priv)
+	cfg := &gossh.ServerConfig{
+		PublicKeyCallback: func(gossh.ConnMetadata, gossh.PublicKey) (*gossh.Permissions, error) {
+			return &gossh.Permissions{}, nil
+		},
+	}
+	cfg.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	forwards = &atomic.Int32{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				sConn, chans, reqs, err := gossh.NewServerConn(conn, cfg)
+				if err != nil {
+					return
+				}
+				defer sConn.Close()
+				go gossh.DiscardRequests(reqs)
+				for nc := range chans {
+					if nc.ChannelType() != "direct-tcpip" {
+						_ = nc.Reject(gossh.UnknownChannelType, "forwarding only")
+						continue
+					}
+					var dest struct {
+						Host     string
+						Port     uint32
+						OrigHost string
+						OrigPort uint32
+					}
+					if err := gossh.Unmarshal(nc.ExtraData(), &dest); err != nil {
+						_ = nc.Reject(gossh.ConnectionFailed, err.Error())
+						continue
+					}
+					target, err := net.Dial("tcp", net.JoinHostPort(dest.Host, strconv.Itoa(int(dest.Port))))
+					if err != nil {
+						_ = nc.Reject(gossh.ConnectionFailed, err.Error())
+						continue
+					}
+					ch, creqs, err := nc.Accept()
+					if err != nil {
+						target.Close()
+						continue
+					}
+					forwards.Add(1)
+					go gossh.DiscardRequests(creqs)
+					go func() {
+						defer ch.Close()
+						defer target.Close()
+						go func() { _, _ = io.Copy(target, ch) }()
+						_, _ = io.Copy(ch, target)
+					}()
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), signer.PublicKey(), forwards
+}
+
+func testBastion(t *testing.T, addr string, hostKey gossh.PublicKey) *Bastion {
+	t.Helper()
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	return &Bastion{Addr: addr, User: "jump", Signer: mustSigner(t, priv), HostKey: hostKey}
+}
+
+func TestDial_ThroughBastion(t *testing.T) {
+	target := newMockSSHServer(t)
+	target.addHandler("echo ubuntu-auto-update-ok", "ubuntu-auto-update-ok\n", 0)
+	trustHostKey(t, target.addr(), target.hostKey.PublicKey())
+	bastionAddr, bastionKey, forwards := newBastionServer(t)
+
+	d := NewDialer(nil)
+	d.Bastion = testBastion(t, bastionAddr, bastionKey)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res := d.testConnection(ctx, models.Host{Hostname: target.addr(), SshUser: "root"}, []string{testKeyPEM(t)})
+
+	if !res.Reachable {
+		t.Fatalf("got %+v, want reachable through the bastion", res)
+	}
+	if n := forwards.Load(); n != 1 {
+		t.Errorf("bastion forwarded %d connections, want 1", n)
+	}
+}
+
+func TestDial_BastionHostKeysVerified(t *testing.T) {
+	target := newMockSSHServer(t)
+	bastionAddr, bastionKey, forwards := newBastionServer(t)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	wrongKey := mustSigner(t, other).PublicKey()
+	host := models.Host{Hostname: target.addr(), SshUser: "root"}
+
+	// Bastion presents a key other than the pinned one: nothing is forwarded.
+	trustHostKey(t, target.addr(), target.hostKey.PublicKey())
+	d := NewDialer(nil)
+	d.Bastion = testBastion(t, bastionAddr, wrongKey)
+	res := d.testConnection(context.Background(), host, []string{testKeyPEM(t)})
+	if res.Failure != FailureHostKey || !strings.Contains(res.Error, "bastion") {
+		t.Errorf("wrong bastion key: got %+v", res)
+	}
+	if n := forwards.Load(); n != 0 {
+		t.Errorf("bastion forwarded %d connections after a host key mismatch", n)
+	}
+
+	// Trusted bastion, untrusted target: the target's key is still checked
+	// end to end through the tunnel.
+	trustHostKey(t, target.addr(), wrongKey)
+	d = NewDialer(nil)
+	d.Bastion = testBastion(t, bastionAddr, bastionKey)
+	res = d.testConnection(context.Background(), host, []string{testKeyPEM(t)})
+	if res.Failure != FailureHostKey {
+		t.Errorf("wrong target key: got %+v", res)
+	}
+}
+
+func TestNewBastion(t *testing.T) {
+	keyPEM := testKeyPEM(t)
+	hostKey := string(gossh.MarshalAuthorizedKey(mustSigner(t, ed25519.NewKeyFromSeed(make([]byte, 32))).PublicKey()))
+
+	b, err := NewBastion(" jump.example.com:2222 ", "jump", keyPEM, hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Addr != "jump.example.com:2222" || b.HostKey == nil {
+		t.Errorf("got %+v", b)
+	}
+	// An IPv6 bastion, bare or bracketed, with or without a port.
+	for _, addr := range []string{"2001:db8::7", "[2001:db8::7]", "[2001:db8::7]:2222"} {
+		if _, err := NewBastion(addr, "jump", keyPEM, ""); err != nil {
+			t.Errorf("%s: %v", addr, err)
+		}
+	}
+	for name, args := range map[string][4]string{
+		"no user":      {"jump.example.com", "", keyPEM, ""},
+		"bad key":      {"jump.example.com", "jump", "not a key", ""},
+		"bad host key": {"jump.example.com", "jump", keyPEM, "ssh-ed25519 !!!"},
+		"bad host":     {"-oProxyCommand=x", "jump", keyPEM, ""},
+	} {
+		if _, err := NewBastion(args[0], args[1], args[2], args[3]); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
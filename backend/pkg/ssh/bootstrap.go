@@ -2,9 +2,7 @@ package ssh
 
 import (
 	"context"
-	"crypto/ed25519"
-	"crypto/rand"
-	"encoding/pem"
+	"crypto"
 	"errors"
 	"fmt"
 	"io"
@@ -16,6 +14,8 @@ import (
 
 	gossh "golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/knownhosts"
+
+	"ubuntu-auto-update/backend/pkg/config"
 )
 
 // BootstrapResult is everything Bootstrap discovered or generated. The
@@ -65,6 +65,25 @@ func formatAuthorizedKey(pub gossh.PublicKey) string {
 	return line + " " + authorizedKeyMarker
 }
 
+// AuthorizedKeyFromPrivate derives the public half of a PEM private key and
+// renders it the way formatAuthorizedKey does, so it matches the line
+// Bootstrap installs.
+func AuthorizedKeyFromPrivate(privateKey string) (string, gossh.PublicKey, error) {
+	raw, err := gossh.ParseRawPrivateKey([]byte(privateKey))
+	if err != nil {
+		return "", nil, fmt.Errorf("parse private key: %w", err)
+	}
+	signer, ok := raw.(crypto.Signer)
+	if !ok {
+		return "", nil, fmt.Errorf("unsupported private key type %T", raw)
+	}
+	pub, err := gossh.NewPublicKey(signer.Public())
+	if err != nil {
+		return "", nil, fmt.Errorf("derive public key: %w", err)
+	}
+	return formatAuthorizedKey(pub), pub, nil
+}
+
 // scopedSudoersBody returns the body of the sudoers drop-in for `user` and
 // `scope`. Scope "apt" pins the rule to apt / apt-get / unattended-upgrade;
 // "full" matches the original behaviour (NOPASSWD: ALL).
@@ -111,6 +130,9 @@ func (d *Dialer) BootstrapOpts(ctx context.Context, hostname, sshUser, password
 	if hostname == "" || sshUser == "" || password == "" {
 		return BootstrapResult{}, errors.New("hostname, ssh_user, and password are all required")
 	}
+	if err := ValidateHostname(stripPort(hostname)); err != nil {
+		return BootstrapResult{}, err
+	}
 	scope := opts.SudoScope
 	if scope == "" {
 		scope = "apt"
@@ -119,28 +141,15 @@ func (d *Dialer) BootstrapOpts(ctx context.Context, hostname, sshUser, password
 		return BootstrapResult{}, fmt.Errorf("invalid sudo scope %q: want \"apt\" or \"full\"", scope)
 	}
 
-	addr := hostname
-	if !strings.Contains(hostname, ":") {
-		addr = hostname + ":22"
-	}
+	addr := sshAddr(hostname)
 
 	// 1) Generate the new keypair up-front so we can install it during the
 	//    one and only password-auth session.
-	pubBytes, privKey, err := ed25519.GenerateKey(rand.Reader)
+	kp, err := GenerateKeyPair(KeyTypeEd25519)
 	if err != nil {
-		return BootstrapResult{}, fmt.Errorf("generate keypair: %w", err)
+		return BootstrapResult{}, err
 	}
-	sshPub, err := gossh.NewPublicKey(pubBytes)
-	if err != nil {
-		return BootstrapResult{}, fmt.Errorf("derive ssh public key: %w", err)
-	}
-	authorizedKey := formatAuthorizedKey(sshPub)
-
-	pemBlock, err := gossh.MarshalPrivateKey(privKey, authorizedKeyMarker)
-	if err != nil {
-		return BootstrapResult{}, fmt.Errorf("marshal private key: %w", err)
-	}
-	privPEM := string(pem.EncodeToMemory(pemBlock))
+	authorizedKey, privPEM := kp.AuthorizedKey, kp.PrivateKeyPEM
 
 	// 2) Password-auth dial with TOFU host-key capture.
 	var capturedKey gossh.PublicKey
@@ -156,7 +165,7 @@ func (d *Dialer) BootstrapOpts(ctx context.Context, hostname, sshUser, password
 
 	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
 	defer cancel()
-	client, err := dialContext(dialCtx, addr, cfg)
+	client, err := d.dial(dialCtx, addr, cfg)
 	if err != nil {
 		return BootstrapResult{}, fmt.Errorf("password ssh dial: %w", classifyAuthErr(err))
 	}
@@ -222,7 +231,7 @@ chmod 600 "$HOME/.ssh/authorized_keys"
 	}
 	verifyCtx, verifyCancel := context.WithTimeout(ctx, dialTimeout)
 	defer verifyCancel()
-	verifyClient, err := dialContext(verifyCtx, addr, verifyCfg)
+	verifyClient, err := d.dial(verifyCtx, addr, verifyCfg)
 	if err != nil {
 		return BootstrapResult{}, fmt.Errorf("verify key auth: %w", err)
 	}
@@ -268,21 +277,11 @@ func (d *Dialer) RotateKey(ctx context.Context, hostID int32) (BootstrapResult,
 	defer client.Close()
 
 	// Generate new keypair.
-	pubBytes, privKey, err := ed25519.GenerateKey(rand.Reader)
-	if err != nil {
-		return BootstrapResult{}, fmt.Errorf("generate keypair: %w", err)
-	}
-	sshPub, err := gossh.NewPublicKey(pubBytes)
-	if err != nil {
-		return BootstrapResult{}, fmt.Errorf("derive ssh public key: %w", err)
-	}
-	newAuthorizedKey := formatAuthorizedKey(sshPub)
-
-	pemBlock, err := gossh.MarshalPrivateKey(privKey, authorizedKeyMarker)
+	kp, err := GenerateKeyPair(KeyTypeEd25519)
 	if err != nil {
-		return BootstrapResult{}, fmt.Errorf("marshal private key: %w", err)
+		return BootstrapResult{}, err
 	}
-	privPEM := string(pem.EncodeToMemory(pemBlock))
+	newAuthorizedKey, privPEM := kp.AuthorizedKey, kp.PrivateKeyPEM
 
 	// Append new key, then verify a fresh dial works with it. Only after the
 	// verify dial succeeds do we strip *previous* uau-managed keys.
@@ -305,10 +304,7 @@ chmod 600 "$HOME/.ssh/authorized_keys"
 	if err != nil {
 		return BootstrapResult{}, fmt.Errorf("parse new key: %w", err)
 	}
-	addr := host.Hostname
-	if !strings.Contains(addr, ":") {
-		addr += ":22"
-	}
+	addr := sshAddr(host.Hostname)
 	hostKeyCB, err := d.hostKeyCallback()
 	if err != nil {
 		return BootstrapResult{}, fmt.Errorf("known_hosts: %w", err)
@@ -321,7 +317,7 @@ chmod 600 "$HOME/.ssh/authorized_keys"
 	}
 	verifyCtx, verifyCancel := context.WithTimeout(ctx, dialTimeout)
 	defer verifyCancel()
-	verifyClient, err := dialContext(verifyCtx, addr, verifyCfg)
+	verifyClient, err := d.dial(verifyCtx, addr, verifyCfg)
 	if err != nil {
 		return BootstrapResult{}, fmt.Errorf("verify new key: %w", err)
 	}
@@ -385,10 +381,7 @@ func (d *Dialer) AppendKnownHost(hostname string, key gossh.PublicKey) error {
 			return err
 		}
 	case "file":
-		path := os.Getenv("KNOWN_HOSTS_FILE")
-		if path == "" {
-			path = "known_hosts"
-		}
+		path := config.KnownHostsFile()
 		line := knownhosts.Line([]string{hostname}, key)
 		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600) // #nosec G304 G703 -- path from server env config
 		if err != nil {
@@ -406,22 +399,16 @@ func (d *Dialer) AppendKnownHost(hostname string, key gossh.PublicKey) error {
 	return nil
 }
 
-// dialContext threads ctx through gossh.Dial. The stdlib SSH client doesn't
-// take a ctx directly (it predates the convention), so we rely on the
-// dialer's Timeout for the handshake and use ctx only to wrap a generic
-// network dial. This is enough to avoid hung connects on bad IPs.
+// dialContext opens a direct SSH client to addr. gossh.Dial takes no ctx,
+// so the TCP dial and the handshake are bounded here instead: ctx cancels
+// both, and cfg.Timeout caps the TCP connect.
 func dialContext(ctx context.Context, addr string, cfg *gossh.ClientConfig) (*gossh.Client, error) {
 	d := net.Dialer{Timeout: cfg.Timeout}
 	conn, err := d.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, err
 	}
-	c, chans, reqs, err := gossh.NewClientConn(conn, addr, cfg)
-	if err != nil {
-		conn.Close()
-		return nil, err
-	}
-	return gossh.NewClient(c, chans, reqs), nil
+	return handshake(ctx, conn, addr, cfg)
 }
 
 // runCommand executes one shell command on the existing client and returns
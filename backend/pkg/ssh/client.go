@@ -4,26 +4,25 @@ package ssh
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5"
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/knownhosts"
+	"ubuntu-auto-update/backend/pkg/config"
 	"ubuntu-auto-update/backend/pkg/db"
 	"ubuntu-auto-update/backend/pkg/models"
 )
 
 const dialTimeout = 30 * time.Second
 
-// keepaliveInterval paces protocol-level pings on long-lived run connections.
-// Without them a half-open TCP connection (host rebooted mid-run, NAT expiry)
-// leaves session reads blocked forever; a failed ping closes the client so
-// everything blocked on it unwinds with an error instead.
-const keepaliveInterval = 30 * time.Second
-
 // sudoProbeCmd checks passwordless sudo with a command every sudo scope
 // grants ("apt" and "full" both allow apt-get). `sudo -n true` is wrong
 // here: under the apt scope, true isn't in the NOPASSWD list, so the probe
@@ -35,17 +34,46 @@ const sudoProbeCmd = "sudo -n apt-get --version >/dev/null"
 // callback genuinely is a one-time load; for the DB-backed source the
 // "cache" is just the closure pointer.
 type Dialer struct {
-	pool       *pgxpool.Pool
+	pool       db.DBTX
 	hostKeyMu  sync.RWMutex
 	hostKeyCB  ssh.HostKeyCallback
 	hostKeyErr error
 	hostKeyOK  bool
+
+	// IdleTTL, when positive, lets ConnectReusable park a finished client
+	// for this long so the next run on the same host skips the handshake.
+	// main sets it from SSH_CONN_IDLE_TIMEOUT.
+	IdleTTL time.Duration
+	conns   connCache
+
+	// Keepalive paces liveness pings on every client this Dialer opens;
+	// zero fields take the defaults. main sets it from SSH_KEEPALIVE_*.
+	Keepalive Keepalive
+
+	// Bastion, when set, is the jump host every connection goes through.
+	// main sets it from SSH_BASTION_*.
+	Bastion *Bastion
+
+	// TrustOnFirstUse makes the DB host-key store record and accept the key
+	// of a host that has none on file, instead of refusing it. A changed
+	// key is refused either way. main sets it from SSH_STRICT_HOST_KEY.
+	TrustOnFirstUse bool
 }
 
-func NewDialer(pool *pgxpool.Pool) *Dialer {
+func NewDialer(pool db.DBTX) *Dialer {
 	return &Dialer{pool: pool}
 }
 
+// ShareLimit counts the clients the Dialer parks for reuse against l, the
+// limit its callers acquire sessions from, so idle connections can't push
+// the process past it. A client is parked only while l has a slot free,
+// and a session that finds l full closes a parked client to take its
+// slot. Call it before the Dialer is used.
+func (d *Dialer) ShareLimit(l *Limiter) {
+	d.conns.limit = l
+	l.reclaim = d.conns.reclaim
+}
+
 // hostKeyCallback returns the configured host-key callback.
 //
 // HOST_KEY_STORE selects the source:
@@ -53,7 +81,7 @@ func NewDialer(pool *pgxpool.Pool) *Dialer {
 //     uses the host_keys table from migration 000013, so all backend
 //     replicas share the same view of fingerprints.
 //   - "file" reads the on-disk known_hosts file at KNOWN_HOSTS_FILE
-//     (default ./known_hosts) — kept as an escape hatch for legacy
+//     (default known_hosts in DATA_DIR) — kept as an escape hatch for legacy
 //     deployments and for offline testing.
 //
 // Concurrency: a mutex guards the cached callback rather than sync.Once
@@ -88,11 +116,10 @@ func (d *Dialer) hostKeyCallback() (ssh.HostKeyCallback, error) {
 	case "db":
 		d.hostKeyCB = d.dbHostKeyCallback()
 	case "file":
-		path := os.Getenv("KNOWN_HOSTS_FILE")
-		if path == "" {
-			path = "known_hosts"
+		d.hostKeyCB, d.hostKeyErr = knownhosts.New(config.KnownHostsFile())
+		if d.TrustOnFirstUse {
+			log.Warn("SSH_STRICT_HOST_KEY=false has no effect with HOST_KEY_STORE=file; unknown hosts are refused")
 		}
-		d.hostKeyCB, d.hostKeyErr = knownhosts.New(path)
 	default:
 		d.hostKeyErr = fmt.Errorf("unknown HOST_KEY_STORE %q (want \"db\" or \"file\")", mode)
 	}
@@ -110,117 +137,263 @@ func (d *Dialer) invalidateHostKeyCache() {
 	d.hostKeyErr = nil
 	d.hostKeyOK = false
 	d.hostKeyMu.Unlock()
+	// Parked clients were verified against the old keys; don't hand them out.
+	d.conns.flush()
 }
 
 // TestResult summarizes a quick health probe: did SSH dial succeed, how long
 // did the round trip take, and is passwordless sudo available (relevant for
-// non-root ssh users since apt-get upgrade needs it).
+// non-root ssh users since apt-get upgrade needs it). When Reachable is
+// false, Failure says which way it failed and Error says why.
 type TestResult struct {
 	OK        bool   `json:"ok"`
+	Reachable bool   `json:"reachable"`
 	LatencyMs int64  `json:"latency_ms"`
 	SudoState string `json:"sudo_state"` // "root", "available", "unavailable", "n/a"
 	Greeting  string `json:"greeting"`
+	Failure   string `json:"failure,omitempty"`
 	Error     string `json:"error,omitempty"`
 }
 
-// TestConnection dials the host, runs a fast no-op (and `sudo -n true` for
+// TestResult.Failure values.
+const (
+	FailureAuth        = "auth_failed"       // the host refused the stored key
+	FailureUnreachable = "host_unreachable"  // no answer, refused, or timed out
+	FailureHostKey     = "host_key_mismatch" // host key absent from or different to the trusted set
+	FailureOther       = "ssh_error"         // anything else (bad stored key, session refused, ...)
+)
+
+// TestConnection dials the host, runs a fast no-op (and sudoProbeCmd for
 // non-root users), and returns timing. Exists primarily so the operator UI
-// can verify a host is reachable before triggering a real update.
+// can verify a host is reachable before triggering a real update. The dial,
+// handshake and probes all stop when ctx does.
+//
+// A host or key that doesn't exist is returned as an error wrapping
+// pgx.ErrNoRows; every other failure is reported in the result.
 func (d *Dialer) TestConnection(ctx context.Context, hostID int32) (TestResult, error) {
+	host, keyPEMs, err := d.loadTarget(ctx, hostID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return TestResult{}, err
+		}
+		return TestResult{Failure: FailureOther, Error: err.Error()}, nil
+	}
+	return d.testConnection(ctx, host, keyPEMs), nil
+}
+
+func (d *Dialer) testConnection(ctx context.Context, host models.Host, keyPEMs []string) TestResult {
 	start := time.Now()
-	client, host, err := d.ConnectToHost(ctx, hostID)
+	client, err := d.dialHost(ctx, host, keyPEMs)
 	if err != nil {
-		return TestResult{OK: false, Error: err.Error()}, nil
+		return TestResult{Failure: classifyDialErr(err), Error: err.Error()}
 	}
 	defer client.Close()
 
-	session, err := client.NewSession()
-	if err != nil {
-		return TestResult{OK: false, Error: "open session: " + err.Error()}, nil
+	// run executes one probe, closing the client if ctx runs out first so a
+	// host that logs us in and then goes silent can't hold the request.
+	run := func(cmd string) ([]byte, error, bool) {
+		var out []byte
+		err, timedOut := WaitWithAbort(ctx, func() error {
+			session, err := client.NewSession()
+			if err != nil {
+				return fmt.Errorf("open session: %w", err)
+			}
+			defer session.Close()
+			if out, err = session.CombinedOutput(cmd); err != nil {
+				return fmt.Errorf("exec probe: %w", err)
+			}
+			return nil
+		}, func() { client.Close() })
+		return out, err, timedOut
 	}
-	defer session.Close()
 
-	greeting, err := session.CombinedOutput("echo ubuntu-auto-update-ok && uname -sr")
+	greeting, err, timedOut := run("echo ubuntu-auto-update-ok && uname -sr")
+	if timedOut {
+		return TestResult{Failure: FailureUnreachable, Error: "host stopped responding: " + ctx.Err().Error()}
+	}
 	if err != nil {
-		return TestResult{OK: false, Error: "exec probe: " + err.Error()}, nil
+		return TestResult{Failure: FailureOther, Error: err.Error()}
 	}
 
 	res := TestResult{
 		OK:        true,
+		Reachable: true,
 		LatencyMs: time.Since(start).Milliseconds(),
 		Greeting:  string(greeting),
 		SudoState: "root",
 	}
 
 	if host.SshUser != "" && host.SshUser != "root" {
-		// Probe sudo on a fresh session; the previous one is closed already.
-		s2, err := client.NewSession()
-		if err != nil {
-			res.SudoState = "unavailable"
-			return res, nil
-		}
-		defer s2.Close()
-		if err := s2.Run(sudoProbeCmd); err != nil {
+		if _, err, _ := run(sudoProbeCmd); err != nil {
 			res.SudoState = "unavailable"
 		} else {
 			res.SudoState = "available"
 		}
 	}
 
-	return res, nil
+	return res
 }
 
-// ConnectToHost looks up the host + decrypted SSH key by ID and opens a client.
-// Caller is responsible for closing the returned client.
+// classifyDialErr sorts a dialHost error into a TestResult.Failure value.
+func classifyDialErr(err error) string {
+	var keyErr *knownhosts.KeyError
+	var netErr net.Error
+	var chanErr *ssh.OpenChannelError // the bastion couldn't reach the target
+	msg := err.Error()
+	switch {
+	case errors.As(err, &keyErr), errors.Is(err, errHostKeyRejected),
+		strings.Contains(msg, "host key mismatch"): // gossh.FixedHostKey (a pinned bastion key)
+		return FailureHostKey
+	case strings.Contains(msg, "unable to authenticate"),
+		strings.Contains(msg, "no supported methods remain"):
+		return FailureAuth
+	case errors.As(err, &netErr), errors.As(err, &chanErr),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, context.Canceled):
+		return FailureUnreachable
+	default:
+		return FailureOther
+	}
+}
+
+// ConnectToHost looks up the host + decrypted SSH keys by ID and opens a
+// client. Caller is responsible for closing the returned client.
 func (d *Dialer) ConnectToHost(ctx context.Context, hostID int32) (*ssh.Client, models.Host, error) {
+	host, keyPEMs, err := d.loadTarget(ctx, hostID)
+	if err != nil {
+		return nil, host, err
+	}
+	client, err := d.dialHost(ctx, host, keyPEMs)
+	return client, host, err
+}
+
+// ErrKeyUndecryptable is what loadTarget returns, in place of the crypto
+// error, when one of the host's stored keys can't be decrypted. Its text is meant
+// for operators and names the fix; the cause is logged instead, so key IDs
+// and cipher errors never reach a client.
+var ErrKeyUndecryptable = errors.New("stored SSH key cannot be decrypted; re-add the key")
+
+// loadTarget reads the host row and its decrypted private keys, in the
+// order they are offered. A host without keys is an error wrapping
+// pgx.ErrNoRows.
+func (d *Dialer) loadTarget(ctx context.Context, hostID int32) (models.Host, []string, error) {
 	host, err := db.GetHost(ctx, d.pool, hostID)
 	if err != nil {
-		return nil, models.Host{}, fmt.Errorf("get host: %w", err)
+		return models.Host{}, nil, fmt.Errorf("get host: %w", err)
+	}
+	// Rows written before API-side validation existed are re-checked here so
+	// a hostname that parses as a flag or carries shell metacharacters never
+	// reaches the dialer, logs, or known_hosts.
+	if err := ValidateHostname(stripPort(host.Hostname)); err != nil {
+		return host, nil, fmt.Errorf("host %d: %w", hostID, err)
 	}
 
-	key, err := db.GetSSHKey(ctx, d.pool, hostID)
+	keys, err := db.GetSSHKeys(ctx, d.pool, hostID)
+	if errors.Is(err, db.ErrUndecryptable) {
+		log.Error(err)
+		return host, nil, ErrKeyUndecryptable
+	}
 	if err != nil {
-		return nil, host, fmt.Errorf("get ssh key: %w", err)
+		return host, nil, fmt.Errorf("get ssh key: %w", err)
+	}
+	if len(keys) == 0 {
+		return host, nil, fmt.Errorf("get ssh key: %w", pgx.ErrNoRows)
+	}
+	keyPEMs := make([]string, len(keys))
+	for i, k := range keys {
+		keyPEMs[i] = k.PrivateKey
 	}
+	return host, keyPEMs, nil
+}
 
-	signer, err := ssh.ParsePrivateKey([]byte(key.PrivateKey))
+// dialHost opens a client to host, offering each of keyPEMs in order until
+// one is accepted. The TCP dial and the SSH handshake both give up at
+// dialTimeout or when ctx ends, whichever is first.
+//
+// The keys go into a single ssh.PublicKeys: the client tries each auth
+// method name once, so a second PublicKeys method would never be reached
+// after the first was refused, while one method with several signers offers
+// them all within the same handshake.
+func (d *Dialer) dialHost(ctx context.Context, host models.Host, keyPEMs []string) (*ssh.Client, error) {
+	signers := make([]ssh.Signer, len(keyPEMs))
+	for i, keyPEM := range keyPEMs {
+		signer, err := ssh.ParsePrivateKey([]byte(keyPEM))
+		if err != nil {
+			return nil, fmt.Errorf("parse private key %d: %w", i+1, err)
+		}
+		signers[i] = signer
+	}
+
+	hostKeyCB, err := d.hostKeyCallback()
+	if err != nil {
+		return nil, fmt.Errorf("load known_hosts: %w", err)
+	}
+
+	cfg := &ssh.ClientConfig{
+		User:            host.SshUser,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: hostKeyCB,
+		Timeout:         dialTimeout,
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	client, err := d.dial(dialCtx, sshAddr(host.Hostname), cfg)
 	if err != nil {
-		return nil, host, fmt.Errorf("parse private key: %w", err)
+		return nil, fmt.Errorf("dial ssh: %w", err)
 	}
+	d.Keepalive.start(client)
+	return client, nil
+}
 
+// VerifyKey proves that privateKeyPEM logs in to host before anything is
+// persisted: it dials with that key alone (the stored key is never consulted)
+// and runs a no-op. The returned error is operator-facing, so the common
+// "host doesn't know this key" case gets a plain-language message.
+func (d *Dialer) VerifyKey(ctx context.Context, host models.Host, privateKeyPEM string) error {
+	if err := ValidateHostname(stripPort(host.Hostname)); err != nil {
+		return err
+	}
+	signer, err := ssh.ParsePrivateKey([]byte(privateKeyPEM))
+	if err != nil {
+		return fmt.Errorf("parse private key: %w", err)
+	}
 	hostKeyCB, err := d.hostKeyCallback()
 	if err != nil {
-		return nil, host, fmt.Errorf("load known_hosts: %w", err)
+		return fmt.Errorf("load known_hosts: %w", err)
 	}
 
+	addr := sshAddr(host.Hostname)
 	cfg := &ssh.ClientConfig{
 		User:            host.SshUser,
 		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
 		HostKeyCallback: hostKeyCB,
 		Timeout:         dialTimeout,
 	}
-	client, err := ssh.Dial("tcp", host.Hostname+":22", cfg)
+	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	client, err := d.dial(dialCtx, addr, cfg)
 	if err != nil {
-		return nil, host, fmt.Errorf("dial ssh: %w", err)
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			return fmt.Errorf("authentication failed — %s@%s does not accept this key", host.SshUser, host.Hostname)
+		}
+		return fmt.Errorf("dial ssh: %w", err)
+	}
+	defer client.Close()
+
+	if out, err := runCommand(client, "true", nil); err != nil {
+		return fmt.Errorf("exec probe: %w (output: %s)", err, trimTo(out, 400))
 	}
-	startKeepalive(client)
-	return client, host, nil
+	return nil
 }
 
-// startKeepalive pings the server every keepaliveInterval. On ping failure —
-// including after the caller has closed the client — it closes the client and
-// exits, so the goroutine never outlives the connection by more than one tick.
-func startKeepalive(client *ssh.Client) {
-	go func() {
-		ticker := time.NewTicker(keepaliveInterval)
-		defer ticker.Stop()
-		for range ticker.C {
-			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
-				client.Close()
-				return
-			}
-		}
-	}()
+// sshAddr is the dial address for a stored hostname: host:port as stored,
+// or the host on port 22. An IPv6 address is bracketed, so both a bare
+// "2001:db8::1" and "[2001:db8::1]" dial [2001:db8::1]:22.
+func sshAddr(hostname string) string {
+	if _, _, err := net.SplitHostPort(hostname); err == nil {
+		return hostname
+	}
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(hostname, "["), "]"), "22")
 }
 
 // WaitWithAbort runs wait() in a goroutine and returns its error, unless ctx
@@ -0,0 +1,196 @@
+package ssh
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+// connCache parks at most one idle client per host between runs. A parked
+// client is owned by the cache; take hands it to exactly one caller, so a
+// client is never shared by two runs at once. With limit set each parked
+// client holds one of its slots, and a client is only parked when a slot
+// is free.
+type connCache struct {
+	mu    sync.Mutex
+	idle  map[int32]*idleConn
+	limit *Limiter
+}
+
+type idleConn struct {
+	client *ssh.Client
+	// target fingerprints what the client was dialed with (address, user,
+	// key), so an edited host or a rotated key never reuses a stale login.
+	target string
+	timer  *time.Timer
+}
+
+func (c *connCache) take(hostID int32, target string) *ssh.Client {
+	c.mu.Lock()
+	ic := c.idle[hostID]
+	delete(c.idle, hostID)
+	c.mu.Unlock()
+	if ic == nil {
+		return nil
+	}
+	ic.timer.Stop()
+	// The caller holds its own slot for the session.
+	c.limit.unhold()
+	if ic.target != target {
+		ic.client.Close()
+		return nil
+	}
+	return ic.client
+}
+
+// put parks client for ttl, replacing (and closing) any client already
+// parked for the host. With no slot free it closes client instead.
+func (c *connCache) put(hostID int32, target string, client *ssh.Client, ttl time.Duration) {
+	ic := &idleConn{client: client, target: target}
+	c.mu.Lock()
+	if c.idle == nil {
+		c.idle = map[int32]*idleConn{}
+	}
+	prev := c.idle[hostID]
+	// A replaced client hands its slot over.
+	if prev == nil && !c.limit.tryHold() {
+		c.mu.Unlock()
+		client.Close()
+		return
+	}
+	c.idle[hostID] = ic
+	ic.timer = time.AfterFunc(ttl, func() { c.evict(hostID, ic) })
+	c.mu.Unlock()
+	if prev != nil {
+		prev.timer.Stop()
+		prev.client.Close()
+	}
+}
+
+func (c *connCache) evict(hostID int32, ic *idleConn) {
+	c.mu.Lock()
+	if c.idle[hostID] != ic {
+		c.mu.Unlock()
+		return // taken or replaced since the timer was armed
+	}
+	delete(c.idle, hostID)
+	c.mu.Unlock()
+	ic.client.Close()
+	c.limit.unhold()
+}
+
+// reclaim closes one parked client, any one, and reports whether there
+// was one to close. The Limiter calls it when a session needs the slot.
+func (c *connCache) reclaim() bool {
+	c.mu.Lock()
+	var ic *idleConn
+	for hostID, v := range c.idle {
+		ic = v
+		delete(c.idle, hostID)
+		break
+	}
+	c.mu.Unlock()
+	if ic == nil {
+		return false
+	}
+	ic.timer.Stop()
+	ic.client.Close()
+	c.limit.unhold()
+	return true
+}
+
+func (c *connCache) flush() {
+	c.mu.Lock()
+	idle := c.idle
+	c.idle = nil
+	c.mu.Unlock()
+	for _, ic := range idle {
+		ic.timer.Stop()
+		ic.client.Close()
+		c.limit.unhold()
+	}
+}
+
+// alive reports whether client still answers a keepalive within a few
+// seconds. A client the caller closed (for example to abort a hung command)
+// fails immediately.
+func alive(client *ssh.Client) bool {
+	return ping(client, aliveTimeout, nil)
+}
+
+const aliveTimeout = 5 * time.Second
+
+func targetFingerprint(host models.Host, keyPEMs []string) string {
+	sum := sha256.Sum256([]byte(host.Hostname + "\x00" + host.SshUser + "\x00" + strings.Join(keyPEMs, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// ConnectReusable is ConnectToHost for callers that run several commands or
+// runs in quick succession. It reuses a client parked by an earlier run on
+// the same host when one is idle and still alive, and otherwise dials. The
+// caller must call done (instead of Close) when finished: the client is
+// parked for IdleTTL if it's still healthy and closed if not, so a caller
+// that closed it to abort a command needn't do anything special.
+//
+// With IdleTTL unset this behaves exactly like ConnectToHost.
+func (d *Dialer) ConnectReusable(ctx context.Context, hostID int32) (client *ssh.Client, host models.Host, done func(), err error) {
+	return d.ConnectReusableAs(ctx, hostID, "")
+}
+
+// ConnectReusableAs is ConnectReusable logging in as sshUser instead of the
+// host's stored user; "" means the stored user. The override only applies to
+// this connection: the returned host still carries the stored SshUser, so a
+// caller that writes it back never persists the one-off user. The user is
+// part of the target fingerprint, so a client parked for one user is never
+// handed to a run as another.
+func (d *Dialer) ConnectReusableAs(ctx context.Context, hostID int32, sshUser string) (client *ssh.Client, host models.Host, done func(), err error) {
+	host, keyPEMs, err := d.loadTarget(ctx, hostID)
+	if err != nil {
+		return nil, host, nil, err
+	}
+	target := host
+	if sshUser != "" {
+		target.SshUser = sshUser
+	}
+	client, done, err = d.reuseOrDial(hostID, targetFingerprint(target, keyPEMs), func() (*ssh.Client, error) {
+		return d.dialHost(ctx, target, keyPEMs)
+	})
+	return client, host, done, err
+}
+
+func (d *Dialer) reuseOrDial(hostID int32, target string, dial func() (*ssh.Client, error)) (*ssh.Client, func(), error) {
+	ttl := d.IdleTTL
+	if ttl <= 0 {
+		client, err := dial()
+		if err != nil {
+			return nil, nil, err
+		}
+		return client, func() { client.Close() }, nil
+	}
+
+	client := d.conns.take(hostID, target)
+	if client != nil && !alive(client) {
+		client.Close()
+		client = nil
+	}
+	if client == nil {
+		var err error
+		if client, err = dial(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return client, func() {
+		if alive(client) {
+			d.conns.put(hostID, target, client, ttl)
+		} else {
+			client.Close()
+		}
+	}, nil
+}
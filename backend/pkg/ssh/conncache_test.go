@@ -0,0 +1,243 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock/v4"
+	gossh "golang.org/x/crypto/ssh"
+
+	"ubuntu-auto-update/backend/pkg/crypto"
+)
+
+// countingDial dials srv and counts handshakes.
+func countingDial(t *testing.T, srv *mockSSHServer, dials *int) func() (*gossh.Client, error) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	auth := gossh.PublicKeys(mustSigner(t, priv))
+	return func() (*gossh.Client, error) {
+		*dials++
+		return gossh.Dial("tcp", srv.addr(), &gossh.ClientConfig{
+			User:            "testuser",
+			Auth:            []gossh.AuthMethod{auth},
+			HostKeyCallback: gossh.FixedHostKey(srv.hostKey.PublicKey()),
+			Timeout:         5 * time.Second,
+		})
+	}
+}
+
+func TestReuseOrDial_SecondRunReusesClient(t *testing.T) {
+	srv := newMockSSHServer(t)
+	d := NewDialer(nil)
+	d.IdleTTL = time.Minute
+	t.Cleanup(d.conns.flush)
+	var dials int
+	dial := countingDial(t, srv, &dials)
+
+	first, done, err := d.reuseOrDial(1, "target", dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runCommand(first, "uptime", nil); err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+	done()
+
+	second, done, err := d.reuseOrDial(1, "target", dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != first || dials != 1 {
+		t.Fatalf("second run dialed again (dials = %d)", dials)
+	}
+	if _, err := runCommand(second, "uptime", nil); err != nil {
+		t.Fatalf("second run on reused client: %v", err)
+	}
+	done()
+
+	// Another host never gets this host's client.
+	other, doneOther, err := d.reuseOrDial(2, "target", dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == first || dials != 2 {
+		t.Errorf("host 2 reused host 1's client")
+	}
+	doneOther()
+}
+
+func TestReuseOrDial_DiscardsStaleClients(t *testing.T) {
+	srv := newMockSSHServer(t)
+	d := NewDialer(nil)
+	d.IdleTTL = time.Minute
+	t.Cleanup(d.conns.flush)
+	var dials int
+	dial := countingDial(t, srv, &dials)
+
+	// A client the caller closed (e.g. to abort a hung command) isn't parked.
+	c, done, _ := d.reuseOrDial(1, "target", dial)
+	c.Close()
+	done()
+	if c2, done, _ := d.reuseOrDial(1, "target", dial); c2 == c || dials != 2 {
+		t.Errorf("closed client was reused")
+	} else {
+		done()
+	}
+
+	// A changed target (edited host, rotated key) forces a fresh dial.
+	if _, done, _ := d.reuseOrDial(1, "rotated", dial); dials != 3 {
+		t.Errorf("client reused across a target change (dials = %d)", dials)
+	} else {
+		done()
+	}
+
+	// Host-key cache invalidation drops parked clients.
+	d.invalidateHostKeyCache()
+	if _, done, _ := d.reuseOrDial(1, "rotated", dial); dials != 4 {
+		t.Errorf("client reused after host-key invalidation (dials = %d)", dials)
+	} else {
+		done()
+	}
+}
+
+func TestReuseOrDial_IdleEviction(t *testing.T) {
+	srv := newMockSSHServer(t)
+	d := NewDialer(nil)
+	d.IdleTTL = 20 * time.Millisecond
+	var dials int
+	dial := countingDial(t, srv, &dials)
+
+	c, done, _ := d.reuseOrDial(1, "target", dial)
+	done()
+	time.Sleep(100 * time.Millisecond)
+
+	if alive(c) {
+		t.Error("idle client was not closed after IdleTTL")
+	}
+	c2, done, _ := d.reuseOrDial(1, "target", dial)
+	defer done()
+	if c2 == c || dials != 2 {
+		t.Errorf("evicted client was reused")
+	}
+}
+
+func TestReuseOrDial_DisabledWithoutTTL(t *testing.T) {
+	srv := newMockSSHServer(t)
+	d := NewDialer(nil)
+	var dials int
+	dial := countingDial(t, srv, &dials)
+
+	c, done, _ := d.reuseOrDial(1, "target", dial)
+	done()
+	if alive(c) {
+		t.Error("client must be closed when reuse is off")
+	}
+	_, done, _ = d.reuseOrDial(1, "target", dial)
+	done()
+	if dials != 2 {
+		t.Errorf("dials = %d, want 2", dials)
+	}
+}
+
+// A one-off user logs in as that user, while the host handed back (and so
+// anything the caller writes from it) keeps the stored one.
+func TestConnectReusableAs_OverridesUserForThisDialOnly(t *testing.T) {
+	srv := newMockSSHServer(t)
+	trustHostKey(t, srv.addr(), srv.hostKey.PublicKey())
+	t.Setenv("ENCRYPTION_KEY", strings.Repeat("00", 32))
+	encKey, err := crypto.Encrypt(testKeyPEM(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	now := time.Now()
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "architecture", "offline_since", "update_output_truncated", "upgrade_output_truncated", "update_policy", "deleted_at", "environment"}).
+			AddRow(int32(1), srv.addr(), "ubuntu", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+	mock.ExpectQuery(`SELECT id, host_id, private_key FROM ssh_keys`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows([]string{"id", "host_id", "private_key"}).AddRow(int32(11), int32(1), encKey))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, host, done, err := NewDialer(mock).ConnectReusableAs(ctx, 1, "deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	if got := client.User(); got != "deploy" {
+		t.Errorf("ClientConfig.User = %q, want deploy", got)
+	}
+	if got, _ := srv.lastUser.Load().(string); got != "deploy" {
+		t.Errorf("server saw user %q, want deploy", got)
+	}
+	if host.SshUser != "ubuntu" {
+		t.Errorf("returned host.SshUser = %q, want the stored ubuntu", host.SshUser)
+	}
+	// No write was expected, so the stored user can't have changed.
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
+
+// A parked client holds a MAX_CONCURRENT_SSH slot: it is only parked while
+// one is free, and a session that needs the last slot closes it.
+func TestReuseOrDial_ParkedClientsCountAgainstLimit(t *testing.T) {
+	srv := newMockSSHServer(t)
+	d := NewDialer(nil)
+	d.IdleTTL = time.Minute
+	l := NewLimiter(2, 20*time.Millisecond)
+	d.ShareLimit(l)
+	t.Cleanup(d.conns.flush)
+	var dials int
+	dial := countingDial(t, srv, &dials)
+	ctx := context.Background()
+
+	// Run on host 1 and park its client: one slot held.
+	release, err := l.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parked, done, err := d.reuseOrDial(1, "target", dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+	release()
+
+	// Two sessions still fit; the second closes the parked client for it.
+	r1, err := l.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := l.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("second session with a client parked: %v", err)
+	}
+	if alive(parked) {
+		t.Error("parked client still open after its slot was taken")
+	}
+
+	// With every slot in use a finished client is closed, not parked.
+	c, done, err := d.reuseOrDial(2, "target", dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+	if alive(c) {
+		t.Error("client parked with no slot free")
+	}
+	r1()
+	r2()
+	if _, err := l.Acquire(ctx); err != nil {
+		t.Errorf("slots leaked: %v", err)
+	}
+}
@@ -5,27 +5,31 @@
 //
 // Bootstrap still TOFU-captures the first key it sees, but it now goes to
 // the DB instead of a local file — so a different backend replica can verify
-// the same fingerprint immediately.
+// the same fingerprint immediately. With Dialer.TrustOnFirstUse any dial
+// does the same for a host that has no key on file yet.
 
 package ssh
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"time"
 
-	"github.com/jackc/pgx/v5/pgxpool"
+	log "github.com/sirupsen/logrus"
 	gossh "golang.org/x/crypto/ssh"
+
+	"ubuntu-auto-update/backend/pkg/db"
 )
 
 // SaveHostKey upserts a (hostname, fingerprint) pair. Idempotent — repeated
 // calls with the same fingerprint do not produce duplicates thanks to the
 // UNIQUE (hostname, fingerprint_sha256) constraint.
-func SaveHostKey(ctx context.Context, pool *pgxpool.Pool, hostname string, key gossh.PublicKey) error {
+func SaveHostKey(ctx context.Context, dbx db.DBTX, hostname string, key gossh.PublicKey) error {
 	keyLine := string(gossh.MarshalAuthorizedKey(key))
 	fingerprint := gossh.FingerprintSHA256(key)
-	_, err := pool.Exec(ctx, `
+	_, err := dbx.Exec(ctx, `
 		INSERT INTO host_keys (hostname, key_line, fingerprint_sha256)
 		VALUES ($1, $2, $3)
 		ON CONFLICT (hostname, fingerprint_sha256) DO NOTHING`,
@@ -37,30 +41,53 @@ func SaveHostKey(ctx context.Context, pool *pgxpool.Pool, hostname string, key g
 	return nil
 }
 
+var (
+	// errHostKeyRejected marks a dial refused because host_keys has no
+	// matching fingerprint for the host.
+	errHostKeyRejected = errors.New("untrusted host key")
+	// ErrHostKeyChanged means the host presented a key other than the one(s)
+	// on file: a reinstalled host or a man in the middle. It wraps
+	// errHostKeyRejected and is refused whatever TrustOnFirstUse says.
+	ErrHostKeyChanged = fmt.Errorf("%w: host key changed", errHostKeyRejected)
+)
+
 // dbHostKeyCallback returns a callback that accepts any key whose SHA-256
-// fingerprint is registered for the dialled hostname. Empty result set =
-// host has no recorded key, which we treat as a hard failure.
+// fingerprint is registered for the dialled hostname. A host with other keys
+// on file but not this one has changed its key, which always fails. A host
+// with no key on file fails too, unless TrustOnFirstUse is set: then the
+// presented key is recorded and trusted from here on.
 func (d *Dialer) dbHostKeyCallback() gossh.HostKeyCallback {
 	return func(hostname string, _ net.Addr, key gossh.PublicKey) error {
 		// gossh strips the port and brackets. We store hostnames in the same
 		// shape (the human-typed value), so this matches.
-		expected := gossh.FingerprintSHA256(key)
+		hostname = stripPort(hostname)
+		presented := gossh.FingerprintSHA256(key)
 
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
-		var count int
+		var known, matched int
 		err := d.pool.QueryRow(ctx, `
-			SELECT COUNT(*) FROM host_keys
-			WHERE hostname = $1 AND fingerprint_sha256 = $2`,
-			stripPort(hostname), expected,
-		).Scan(&count)
+			SELECT COUNT(*), COUNT(*) FILTER (WHERE fingerprint_sha256 = $2)
+			FROM host_keys WHERE hostname = $1`,
+			hostname, presented,
+		).Scan(&known, &matched)
 		if err != nil {
 			return fmt.Errorf("host_keys lookup: %w", err)
 		}
-		if count == 0 {
-			return fmt.Errorf("host key for %s (%s) is not in host_keys; refusing connection", hostname, expected)
+		switch {
+		case matched > 0:
+			return nil
+		case known > 0:
+			log.Errorf("SSH host key for %s has CHANGED: presented %s matches none of the %d key(s) on file; refusing connection. If the host was reinstalled, delete its host_keys rows and reconnect.", hostname, presented, known)
+			return fmt.Errorf("%w: %s presented %s, which is not on file", ErrHostKeyChanged, hostname, presented)
+		case !d.TrustOnFirstUse:
+			return fmt.Errorf("%w: host key for %s (%s) is not in host_keys; refusing connection", errHostKeyRejected, hostname, presented)
+		}
+		if err := SaveHostKey(ctx, d.pool, hostname, key); err != nil {
+			return err
 		}
+		log.Warnf("SSH host key for %s trusted on first use: %s (SSH_STRICT_HOST_KEY=false)", hostname, presented)
 		return nil
 	}
 }
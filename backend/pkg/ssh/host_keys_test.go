@@ -0,0 +1,81 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/pashagolub/pgxmock/v4"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func newTestHostKey(t *testing.T) gossh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// expectKeyLookup answers the callback's host_keys query with how many keys
+// the host has on file and how many of them match the presented one.
+func expectKeyLookup(mock pgxmock.PgxPoolIface, key gossh.PublicKey, known, matched int) {
+	mock.ExpectQuery(`FROM host_keys WHERE hostname = \$1`).
+		WithArgs("web-1", gossh.FingerprintSHA256(key)).
+		WillReturnRows(mock.NewRows([]string{"known", "matched"}).AddRow(known, matched))
+}
+
+func TestDBHostKeyCallback(t *testing.T) {
+	key := newTestHostKey(t)
+	cases := []struct {
+		name           string
+		tofu           bool
+		known, matched int
+		wantSave       bool
+		wantErr        error
+	}{
+		{"known key", false, 2, 1, false, nil},
+		{"strict refuses an unknown host", false, 0, 0, false, errHostKeyRejected},
+		{"first use is recorded", true, 0, 0, true, nil},
+		{"changed key, strict", false, 1, 0, false, ErrHostKeyChanged},
+		{"changed key, trust on first use", true, 1, 0, false, ErrHostKeyChanged},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer mock.Close()
+			d := NewDialer(mock)
+			d.TrustOnFirstUse = c.tofu
+
+			expectKeyLookup(mock, key, c.known, c.matched)
+			if c.wantSave {
+				mock.ExpectExec(`INSERT INTO host_keys`).
+					WithArgs("web-1", string(gossh.MarshalAuthorizedKey(key)), gossh.FingerprintSHA256(key)).
+					WillReturnResult(pgxmock.NewResult("INSERT", 1))
+			}
+
+			err = d.dbHostKeyCallback()("web-1:22", nil, key)
+			if c.wantErr == nil && err != nil {
+				t.Errorf("refused: %v", err)
+			}
+			if c.wantErr != nil && !errors.Is(err, c.wantErr) {
+				t.Errorf("err = %v, want %v", err, c.wantErr)
+			}
+			if err != nil && classifyDialErr(err) != FailureHostKey {
+				t.Errorf("classified as %q, want %q", classifyDialErr(err), FailureHostKey)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("unfulfilled expectations: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// ErrInvalidHostname is returned by ValidateHostname. Callers surface it as a
+// 400; the message is safe to echo back to the client.
+var ErrInvalidHostname = errors.New("hostname must be a valid RFC 1123 hostname or IP address")
+
+// ValidateHostname accepts an IPv4/IPv6 literal or an RFC 1123 hostname:
+// at most 253 characters of dot-separated labels, each 1-63 characters of
+// letters, digits and hyphens, never starting or ending with a hyphen.
+//
+// Hostnames end up in SSH dial addresses, known_hosts entries and log lines,
+// so anything outside that alphabet (spaces, ';', leading '-' that a CLI
+// would read as a flag) is rejected at the API boundary.
+func ValidateHostname(h string) error {
+	if net.ParseIP(h) != nil {
+		return nil
+	}
+	if h == "" || len(h) > 253 {
+		return ErrInvalidHostname
+	}
+	for _, label := range strings.Split(h, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return ErrInvalidHostname
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return ErrInvalidHostname
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return ErrInvalidHostname
+			}
+		}
+	}
+	return nil
+}
+
+// NormalizeHostname puts an IP literal in its canonical form, dropping the
+// brackets an IPv6 address is often typed with, so "[2001:DB8::1]" and
+// "2001:db8:0::1" are stored as the same host. Anything else is returned
+// unchanged. Callers normalize before ValidateHostname.
+func NormalizeHostname(h string) string {
+	if ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(h, "["), "]")); ip != nil {
+		return ip.String()
+	}
+	return h
+}
+
+// ErrInvalidUsername is returned by ValidateUsername. Like
+// ErrInvalidHostname it's safe to echo back to the client.
+var ErrInvalidUsername = errors.New("ssh_user must be a valid POSIX username")
+
+// ValidateUsername accepts the portable login-name set useradd enforces by
+// default: at most 32 characters, starting with a lowercase letter or '_',
+// then lowercase letters, digits, '_' and '-', with an optional trailing '$'.
+func ValidateUsername(u string) error {
+	if u == "" || len(u) > 32 {
+		return ErrInvalidUsername
+	}
+	u = strings.TrimSuffix(u, "$")
+	if u == "" || u[0] == '-' || u[0] >= '0' && u[0] <= '9' {
+		return ErrInvalidUsername
+	}
+	for i := 0; i < len(u); i++ {
+		c := u[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return ErrInvalidUsername
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateHostname(t *testing.T) {
+	valid := []string{
+		"web-1",
+		"db01.internal.example.com",
+		"a",
+		"10.0.0.5",
+		"2001:db8::1",
+		strings.Repeat("a", 63) + ".example.com",
+	}
+	for _, h := range valid {
+		if err := ValidateHostname(h); err != nil {
+			t.Errorf("ValidateHostname(%q) = %v, want nil", h, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"web 1",
+		"web;rm -rf /",
+		"host$(id)",
+		"-oProxyCommand=evil",
+		"web-",
+		"web..example.com",
+		".example.com",
+		"under_score",
+		strings.Repeat("a", 64) + ".example.com",
+		strings.Repeat("abcdefghi.", 26), // 260 chars
+	}
+	for _, h := range invalid {
+		if err := ValidateHostname(h); err == nil {
+			t.Errorf("ValidateHostname(%q) = nil, want error", h)
+		}
+	}
+}
+
+func TestNormalizeHostname(t *testing.T) {
+	cases := map[string]string{
+		"[2001:db8::1]": "2001:db8::1",
+		"2001:DB8:0::1": "2001:db8::1",
+		"[::1]":         "::1",
+		"10.0.0.5":      "10.0.0.5",
+		"web-1":         "web-1",
+		"Web-1":         "Web-1",
+		"[web-1]":       "[web-1]",
+		"db-1:2222":     "db-1:2222",
+		"[::1]:2222":    "[::1]:2222",
+		"fe80::1%eth0":  "fe80::1%eth0",
+		"":              "",
+	}
+	for in, want := range cases {
+		got := NormalizeHostname(in)
+		if got != want {
+			t.Errorf("NormalizeHostname(%q) = %q, want %q", in, got, want)
+		}
+		if ValidateHostname(got) != nil && ValidateHostname(in) == nil {
+			t.Errorf("NormalizeHostname(%q) = %q no longer validates", in, got)
+		}
+	}
+	if err := ValidateHostname(NormalizeHostname("[2001:db8::1]")); err != nil {
+		t.Errorf("bracketed IPv6 rejected after normalizing: %v", err)
+	}
+}
+
+func TestValidateUsername(t *testing.T) {
+	for _, u := range []string{"root", "ubuntu", "deploy-bot", "_svc", "ci_runner2", "machine$", strings.Repeat("a", 32)} {
+		if err := ValidateUsername(u); err != nil {
+			t.Errorf("ValidateUsername(%q) = %v, want nil", u, err)
+		}
+	}
+	for _, u := range []string{"", "Root", "1user", "-oProxyCommand", "de ploy", "a;id", "a$b", "$", "user@host", strings.Repeat("a", 33)} {
+		if err := ValidateUsername(u); err == nil {
+			t.Errorf("ValidateUsername(%q) = nil, want error", u)
+		}
+	}
+}
+
+// A hostname that would read as a CLI flag must be refused before any
+// network or DB work happens.
+func TestBootstrap_RejectsFlagLikeHostname(t *testing.T) {
+	d := NewDialer(nil)
+	_, err := d.Bootstrap(context.Background(), "-oProxyCommand=touch /tmp/pwned", "root", "pw")
+	if !errors.Is(err, ErrInvalidHostname) {
+		t.Fatalf("expected ErrInvalidHostname, got %v", err)
+	}
+}
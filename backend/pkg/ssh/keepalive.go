@@ -0,0 +1,102 @@
+package ssh
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultKeepaliveInterval  = 30 * time.Second
+	defaultKeepaliveMaxMisses = 3
+)
+
+// ErrConnectionLost is what a run reports when its connection was closed
+// because the host stopped answering keepalives.
+var ErrConnectionLost = errors.New("connection lost: host stopped answering SSH keepalives")
+
+// Keepalive sends keepalive@openssh.com pings on long-lived run connections.
+// Without them a half-open TCP connection (host rebooted mid-run, NAT or
+// firewall idle expiry) leaves session reads blocked forever. After
+// MaxMisses consecutive pings go unanswered within Interval the client is
+// closed, so everything blocked on it unwinds with an error, and
+// ConnectionLost reports why.
+type Keepalive struct {
+	Interval  time.Duration // default 30s
+	MaxMisses int           // default 3
+}
+
+// lostClients remembers clients closed by a failed keepalive until the
+// caller has had time to ask ConnectionLost about them.
+var lostClients sync.Map // *ssh.Client → struct{}
+
+// ConnectionLost reports whether client was closed because the host stopped
+// answering keepalives, as opposed to finishing or being closed by us.
+func ConnectionLost(client *ssh.Client) bool {
+	_, lost := lostClients.Load(client)
+	return lost
+}
+
+func (k Keepalive) start(client *ssh.Client) {
+	interval, maxMisses := k.Interval, k.MaxMisses
+	if interval <= 0 {
+		interval = defaultKeepaliveInterval
+	}
+	if maxMisses <= 0 {
+		maxMisses = defaultKeepaliveMaxMisses
+	}
+
+	closed := make(chan struct{})
+	go func() { _ = client.Wait(); close(closed) }()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		misses := 0
+		for {
+			select {
+			case <-closed:
+				return
+			case <-ticker.C:
+			}
+			if ping(client, interval, closed) {
+				misses = 0
+				continue
+			}
+			select {
+			case <-closed:
+				return // closed by its owner, not lost
+			default:
+			}
+			if misses++; misses >= maxMisses {
+				lostClients.Store(client, struct{}{})
+				time.AfterFunc(10*time.Minute, func() { lostClients.Delete(client) })
+				client.Close()
+				return
+			}
+		}
+	}()
+}
+
+// ping sends one keepalive and waits up to timeout for the reply. A dead
+// peer never replies, so the request can't be awaited inline; the stray
+// goroutine exits once the client is closed.
+func ping(client *ssh.Client, timeout time.Duration, closed <-chan struct{}) bool {
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		done <- err
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err == nil
+	case <-closed:
+		return false
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,125 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// freezableProxy forwards TCP to target until freeze is called, after which
+// it silently stops relaying in both directions without closing anything —
+// what a NAT box that dropped its mapping looks like from the client.
+type freezableProxy struct {
+	ln     net.Listener
+	frozen chan struct{}
+	once   sync.Once
+}
+
+func newFreezableProxy(t *testing.T, target string) *freezableProxy {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &freezableProxy{ln: ln, frozen: make(chan struct{})}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			up, err := net.Dial("tcp", target)
+			if err != nil {
+				c.Close()
+				continue
+			}
+			t.Cleanup(func() { c.Close(); up.Close() })
+			go p.relay(up, c)
+			go p.relay(c, up)
+		}
+	}()
+	return p
+}
+
+func (p *freezableProxy) freeze() { p.once.Do(func() { close(p.frozen) }) }
+
+func (p *freezableProxy) relay(dst io.Writer, src io.Reader) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := src.Read(buf)
+		select {
+		case <-p.frozen:
+			return // drop everything from here on
+		default:
+		}
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func dialVia(t *testing.T, srv *mockSSHServer, addr string) *gossh.Client {
+	t.Helper()
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	client, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+		User:            "testuser",
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(mustSigner(t, priv))},
+		HostKeyCallback: gossh.FixedHostKey(srv.hostKey.PublicKey()),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestKeepalive_DetectsDroppedConnection(t *testing.T) {
+	srv := newMockSSHServer(t)
+	proxy := newFreezableProxy(t, srv.addr())
+	client := dialVia(t, srv, proxy.ln.Addr().String())
+
+	Keepalive{Interval: 20 * time.Millisecond, MaxMisses: 2}.start(client)
+
+	// Healthy for a few intervals.
+	time.Sleep(100 * time.Millisecond)
+	if ConnectionLost(client) {
+		t.Fatal("healthy connection reported lost")
+	}
+
+	proxy.freeze()
+	waited := make(chan error, 1)
+	go func() { waited <- client.Wait() }()
+	select {
+	case <-waited:
+	case <-time.After(2 * time.Second):
+		t.Fatal("dropped connection was not detected")
+	}
+	if !ConnectionLost(client) {
+		t.Error("ConnectionLost = false after keepalives failed")
+	}
+}
+
+func TestKeepalive_OwnerCloseIsNotLost(t *testing.T) {
+	srv := newMockSSHServer(t)
+	client := dialVia(t, srv, srv.addr())
+
+	Keepalive{Interval: 10 * time.Millisecond, MaxMisses: 1}.start(client)
+	client.Close()
+	time.Sleep(50 * time.Millisecond)
+	if ConnectionLost(client) {
+		t.Error("a client closed by its owner must not count as lost")
+	}
+}
@@ -0,0 +1,66 @@
+package ssh
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"fmt"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Key types accepted by GenerateKeyPair.
+const (
+	KeyTypeEd25519 = "ed25519"
+	KeyTypeRSA     = "rsa"
+)
+
+// rsaKeyBits is the modulus size for generated RSA keys. ed25519 is the
+// default; RSA exists for targets with sshd builds that predate it.
+const rsaKeyBits = 4096
+
+// KeyPair is a freshly generated SSH key. PrivateKeyPEM is OpenSSH-format
+// and must only ever be stored encrypted; AuthorizedKey is the line to
+// install in ~/.ssh/authorized_keys (see formatAuthorizedKey).
+type KeyPair struct {
+	PrivateKeyPEM string
+	AuthorizedKey string
+	PublicKey     gossh.PublicKey
+}
+
+// GenerateKeyPair creates a new keypair of keyType ("" means ed25519).
+func GenerateKeyPair(keyType string) (KeyPair, error) {
+	var priv crypto.PrivateKey
+	switch keyType {
+	case "", KeyTypeEd25519:
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return KeyPair{}, fmt.Errorf("generate keypair: %w", err)
+		}
+		priv = k
+	case KeyTypeRSA:
+		k, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+		if err != nil {
+			return KeyPair{}, fmt.Errorf("generate keypair: %w", err)
+		}
+		priv = k
+	default:
+		return KeyPair{}, fmt.Errorf("unsupported key type %q (want %s or %s)", keyType, KeyTypeEd25519, KeyTypeRSA)
+	}
+
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		return KeyPair{}, fmt.Errorf("derive ssh public key: %w", err)
+	}
+	pemBlock, err := gossh.MarshalPrivateKey(priv, authorizedKeyMarker)
+	if err != nil {
+		return KeyPair{}, fmt.Errorf("marshal private key: %w", err)
+	}
+	return KeyPair{
+		PrivateKeyPEM: string(pem.EncodeToMemory(pemBlock)),
+		AuthorizedKey: formatAuthorizedKey(signer.PublicKey()),
+		PublicKey:     signer.PublicKey(),
+	}, nil
+}
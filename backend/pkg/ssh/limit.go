@@ -0,0 +1,94 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// ErrBusy is returned by Limiter.Acquire when no session slot frees up within
+// the wait.
+var ErrBusy = errors.New("server busy: too many concurrent SSH sessions, try again shortly")
+
+// Limiter caps SSH sessions across the whole process (interactive WebSockets
+// and bulk runs alike), so a fleet-wide trigger can't open hundreds of
+// connections and run the backend out of file descriptors. A nil *Limiter
+// imposes no limit.
+//
+// Idle clients a Dialer parks for reuse hold a slot too (see
+// Dialer.ShareLimit); a session that finds every slot taken closes one of
+// those before it waits.
+type Limiter struct {
+	sem  *semaphore.Weighted
+	wait time.Duration
+	// reclaim closes one parked client, freeing its slot, and reports
+	// whether there was one.
+	reclaim func() bool
+}
+
+// NewLimiter allows max concurrent sessions. Acquire gives up after wait;
+// wait <= 0 queues until the caller's context ends.
+func NewLimiter(max int, wait time.Duration) *Limiter {
+	return &Limiter{sem: semaphore.NewWeighted(int64(max)), wait: wait}
+}
+
+// Acquire takes one session slot and returns the func that gives it back. It
+// fails with ErrBusy once the limiter's wait elapses, or with ctx.Err() if
+// ctx ends first.
+func (l *Limiter) Acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	acqCtx := ctx
+	if l.wait > 0 {
+		var cancel context.CancelFunc
+		acqCtx, cancel = context.WithTimeout(ctx, l.wait)
+		defer cancel()
+	}
+	if err := l.acquire(acqCtx); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, ErrBusy
+	}
+	return func() { l.sem.Release(1) }, nil
+}
+
+// Queue is Acquire without the limiter's wait: it blocks until a slot frees
+// up or ctx ends. Bulk runs use it, since their hosts are meant to wait
+// their turn rather than fail.
+func (l *Limiter) Queue(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	if err := l.acquire(ctx); err != nil {
+		return nil, err
+	}
+	return func() { l.sem.Release(1) }, nil
+}
+
+// acquire takes a slot, closing parked clients to free one before it
+// blocks.
+func (l *Limiter) acquire(ctx context.Context) error {
+	for !l.sem.TryAcquire(1) {
+		if l.reclaim == nil || !l.reclaim() {
+			return l.sem.Acquire(ctx, 1)
+		}
+	}
+	return nil
+}
+
+// tryHold takes a slot for a parked client if one is free. A nil *Limiter
+// always has room.
+func (l *Limiter) tryHold() bool {
+	return l == nil || l.sem.TryAcquire(1)
+}
+
+// unhold gives back a slot taken by tryHold.
+func (l *Limiter) unhold() {
+	if l != nil {
+		l.sem.Release(1)
+	}
+}
@@ -0,0 +1,83 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiter_RejectsBeyondMax(t *testing.T) {
+	l := NewLimiter(2, 20*time.Millisecond)
+	ctx := context.Background()
+
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, err := l.Acquire(ctx)
+		if err != nil {
+			t.Fatalf("session %d: %v", i+1, err)
+		}
+		releases = append(releases, release)
+	}
+
+	if _, err := l.Acquire(ctx); !errors.Is(err, ErrBusy) {
+		t.Fatalf("third session: err = %v, want ErrBusy", err)
+	}
+
+	// Freeing a slot lets the next session in.
+	releases[0]()
+	release, err := l.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("after release: %v", err)
+	}
+	release()
+	releases[1]()
+}
+
+func TestLimiter_QueueWaitsForSlot(t *testing.T) {
+	l := NewLimiter(1, time.Millisecond)
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan error, 1)
+	go func() {
+		r, err := l.Queue(context.Background())
+		if err == nil {
+			r()
+		}
+		got <- err
+	}()
+
+	select {
+	case err := <-got:
+		t.Fatalf("Queue returned %v while the slot was held", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	if err := <-got; err != nil {
+		t.Fatalf("Queue: %v", err)
+	}
+}
+
+func TestLimiter_CancelledContext(t *testing.T) {
+	l := NewLimiter(1, time.Minute)
+	release, _ := l.Acquire(context.Background())
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.Acquire(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestLimiter_NilIsUnlimited(t *testing.T) {
+	var l *Limiter
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
@@ -1,17 +1,26 @@
 package ssh
 
 import (
+	"bytes"
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/pem"
 	"io"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/pashagolub/pgxmock/v4"
 	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"ubuntu-auto-update/backend/pkg/crypto"
+	"ubuntu-auto-update/backend/pkg/models"
 )
 
 // ----------------------------------------------------------------------------
@@ -26,6 +35,14 @@ type mockSSHServer struct {
 	listener net.Listener
 	hostKey  gossh.Signer
 	handlers map[string]mockHandler
+	// rejectKeys makes public-key auth fail, as for a key the host doesn't
+	// have in authorized_keys.
+	rejectKeys atomic.Bool
+	// onlyKey, when set to a gossh.PublicKey, is the one client key the
+	// server accepts; others are refused.
+	onlyKey atomic.Value
+	// lastUser is the user named by the most recent public-key login.
+	lastUser atomic.Value
 }
 
 type mockHandler struct {
@@ -70,6 +87,13 @@ func (s *mockSSHServer) serve() {
 	cfg := &gossh.ServerConfig{
 		// Accept any public-key for testing convenience.
 		PublicKeyCallback: func(conn gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+			if s.rejectKeys.Load() {
+				return nil, os.ErrPermission
+			}
+			if only, ok := s.onlyKey.Load().(gossh.PublicKey); ok && !bytes.Equal(only.Marshal(), key.Marshal()) {
+				return nil, os.ErrPermission
+			}
+			s.lastUser.Store(conn.User())
 			return &gossh.Permissions{}, nil
 		},
 		// Also accept password auth so Bootstrap tests work.
@@ -201,6 +225,38 @@ func TestTrimTo(t *testing.T) {
 	}
 }
 
+// Every stored hostname shape dials a valid host:port, with IPv6 addresses
+// bracketed.
+func TestSSHAddr(t *testing.T) {
+	cases := []struct {
+		hostname, want, host, port string
+	}{
+		{"web-1", "web-1:22", "web-1", "22"},
+		{"db-1:2222", "db-1:2222", "db-1", "2222"},
+		{"10.0.0.5", "10.0.0.5:22", "10.0.0.5", "22"},
+		{"2001:db8::1", "[2001:db8::1]:22", "2001:db8::1", "22"},
+		{"[2001:db8::1]", "[2001:db8::1]:22", "2001:db8::1", "22"},
+		{"[2001:db8::1]:2222", "[2001:db8::1]:2222", "2001:db8::1", "2222"},
+		{"::1", "[::1]:22", "::1", "22"},
+	}
+	for _, c := range cases {
+		got := sshAddr(c.hostname)
+		if got != c.want {
+			t.Errorf("sshAddr(%q) = %q, want %q", c.hostname, got, c.want)
+			continue
+		}
+		host, port, err := net.SplitHostPort(got)
+		if err != nil || host != c.host || port != c.port {
+			t.Errorf("sshAddr(%q) = %q splits to %q, %q, %v", c.hostname, got, host, port, err)
+		}
+		if net.ParseIP(host) != nil {
+			if _, err := net.ResolveTCPAddr("tcp", got); err != nil {
+				t.Errorf("sshAddr(%q) = %q is not a TCP address: %v", c.hostname, got, err)
+			}
+		}
+	}
+}
+
 func TestBootstrapOpts_ValidationErrors(t *testing.T) {
 	d := NewDialer(nil)
 	ctx := context.Background()
@@ -376,3 +432,204 @@ func TestAppendKnownHost_FileMode(t *testing.T) {
 		t.Error("expected hostKeyOK to be false after AppendKnownHost")
 	}
 }
+
+// Without KNOWN_HOSTS_FILE the file lives in DATA_DIR, wherever the process
+// was started, and the dialer reads back what was appended there.
+func TestAppendKnownHost_DefaultsToDataDir(t *testing.T) {
+	dataDir := t.TempDir()
+	t.Setenv("DATA_DIR", dataDir)
+	t.Setenv("HOST_KEY_STORE", "file")
+	t.Setenv("KNOWN_HOSTS_FILE", "")
+	t.Chdir(t.TempDir())
+
+	d := NewDialer(nil)
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	sshPub, _ := gossh.NewPublicKey(priv.Public().(ed25519.PublicKey))
+	if err := d.AppendKnownHost("testhost.example.com", sshPub); err != nil {
+		t.Fatalf("AppendKnownHost: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "known_hosts")); err != nil {
+		t.Fatalf("known_hosts not created in DATA_DIR: %v", err)
+	}
+	if _, err := os.Stat("known_hosts"); !os.IsNotExist(err) {
+		t.Errorf("known_hosts created in the working directory (stat: %v)", err)
+	}
+	cb, err := d.hostKeyCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cb("testhost.example.com:22", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}, sshPub); err != nil {
+		t.Errorf("appended key not trusted: %v", err)
+	}
+}
+
+func TestGenerateKeyPair(t *testing.T) {
+	for _, keyType := range []string{"", KeyTypeEd25519, KeyTypeRSA} {
+		kp, err := GenerateKeyPair(keyType)
+		if err != nil {
+			t.Fatalf("%q: %v", keyType, err)
+		}
+		signer, err := gossh.ParsePrivateKey([]byte(kp.PrivateKeyPEM))
+		if err != nil {
+			t.Fatalf("%q: private key does not parse: %v", keyType, err)
+		}
+		if !strings.HasSuffix(kp.AuthorizedKey, " "+authorizedKeyMarker) {
+			t.Errorf("%q: authorized key missing marker: %s", keyType, kp.AuthorizedKey)
+		}
+		if string(signer.PublicKey().Marshal()) != string(kp.PublicKey.Marshal()) {
+			t.Errorf("%q: public key does not match private key", keyType)
+		}
+	}
+	if _, err := GenerateKeyPair("dsa"); err == nil {
+		t.Error("expected error for unsupported key type")
+	}
+}
+
+// trustHostKey points the file host-key store at a known_hosts trusting key
+// for addr.
+func trustHostKey(t *testing.T, addr string, key gossh.PublicKey) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(path, []byte(knownhosts.Line([]string{addr}, key)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOST_KEY_STORE", "file")
+	t.Setenv("KNOWN_HOSTS_FILE", path)
+}
+
+func testKeyPEM(t *testing.T) string {
+	t.Helper()
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := gossh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(block))
+}
+
+func TestTestConnection_Reachable(t *testing.T) {
+	srv := newMockSSHServer(t)
+	srv.addHandler("echo ubuntu-auto-update-ok", "ubuntu-auto-update-ok\nLinux 6.8.0\n", 0)
+	trustHostKey(t, srv.addr(), srv.hostKey.PublicKey())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res := NewDialer(nil).testConnection(ctx, models.Host{Hostname: srv.addr(), SshUser: "root"}, []string{testKeyPEM(t)})
+	if !res.Reachable || !res.OK || res.Failure != "" {
+		t.Fatalf("got %+v, want reachable", res)
+	}
+	if !strings.Contains(res.Greeting, "ubuntu-auto-update-ok") {
+		t.Errorf("greeting = %q", res.Greeting)
+	}
+}
+
+func TestTestConnection_FailureCategories(t *testing.T) {
+	authSrv := newMockSSHServer(t)
+	authSrv.rejectKeys.Store(true)
+
+	keySrv := newMockSSHServer(t)
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+
+	// Accepts TCP and never speaks SSH: only the handshake deadline ends it.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { silent.Close() })
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	cases := []struct {
+		name, addr string
+		trusted    gossh.PublicKey
+		want       string
+	}{
+		{"auth", authSrv.addr(), authSrv.hostKey.PublicKey(), FailureAuth},
+		{"host key", keySrv.addr(), mustSigner(t, otherPriv).PublicKey(), FailureHostKey},
+		{"silent", silent.Addr().String(), keySrv.hostKey.PublicKey(), FailureUnreachable},
+		{"refused", "127.0.0.1:1", keySrv.hostKey.PublicKey(), FailureUnreachable},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			trustHostKey(t, c.addr, c.trusted)
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			res := NewDialer(nil).testConnection(ctx, models.Host{Hostname: c.addr, SshUser: "root"}, []string{testKeyPEM(t)})
+			if res.Reachable || res.OK {
+				t.Fatalf("got %+v, want a failure", res)
+			}
+			if res.Failure != c.want {
+				t.Errorf("failure = %q, want %q (error: %s)", res.Failure, c.want, res.Error)
+			}
+			if res.Error == "" {
+				t.Error("no error message")
+			}
+			if d := time.Since(start); d > 2*time.Second {
+				t.Errorf("took %s; the context deadline should have cut it off", d)
+			}
+		})
+	}
+}
+
+// A host mid-rotation has the old key first and the new one second. When
+// the target only accepts the new key, the first is refused and the dial
+// falls through to the second.
+func TestConnectToHost_FallsBackToNextKey(t *testing.T) {
+	srv := newMockSSHServer(t)
+	trustHostKey(t, srv.addr(), srv.hostKey.PublicKey())
+	t.Setenv("ENCRYPTION_KEY", strings.Repeat("00", 32))
+
+	oldPEM, newPEM := testKeyPEM(t), testKeyPEM(t)
+	newSigner, err := gossh.ParsePrivateKey([]byte(newPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.onlyKey.Store(newSigner.PublicKey())
+	encOld, err := crypto.Encrypt(oldPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encNew, err := crypto.Encrypt(newPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	now := time.Now()
+	mock.ExpectQuery(`SELECT (.+) FROM hosts WHERE id = \$1`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows([]string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "architecture", "offline_since", "update_output_truncated", "upgrade_output_truncated", "update_policy", "deleted_at", "environment"}).
+			AddRow(int32(1), srv.addr(), "ubuntu", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+	mock.ExpectQuery(`SELECT id, host_id, private_key FROM ssh_keys WHERE host_id = \$1 ORDER BY position, id`).WithArgs(int32(1)).
+		WillReturnRows(mock.NewRows([]string{"id", "host_id", "private_key"}).
+			AddRow(int32(3), int32(1), encOld).
+			AddRow(int32(4), int32(1), encNew))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, _, err := NewDialer(mock).ConnectToHost(ctx, 1)
+	if err != nil {
+		t.Fatalf("dial with the second key failed: %v", err)
+	}
+	client.Close()
+
+	// With only the old key the same host refuses the login.
+	res := NewDialer(nil).testConnection(ctx, models.Host{Hostname: srv.addr(), SshUser: "ubuntu"}, []string{oldPEM})
+	if res.Failure != FailureAuth {
+		t.Errorf("old key alone: failure = %q, want %q", res.Failure, FailureAuth)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+// Package store is a small key/value store with expiry for state that API
+// replicas behind a load balancer have to agree on: sessions and rate-limit
+// counters. Redis backs it when REDIS_URL is set; otherwise it lives in
+// process memory, which is right for a single replica and for tests.
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Store is the storage interface. Implementations must be safe for
+// concurrent use. A ttl or window must be > 0.
+type Store interface {
+	// Set stores value under key until ttl elapses, replacing any value.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+
+	// Get returns key's value, ok=false if it is missing or expired. Errors
+	// only surface on infrastructure failure.
+	Get(ctx context.Context, key string) (value []byte, ok bool, err error)
+
+	// Delete removes key. Idempotent — missing keys are not errors.
+	Delete(ctx context.Context, key string) error
+
+	// Incr adds one to the counter at key and returns the new count and how
+	// long until the counter resets. A missing key starts at 1 with window
+	// to run; later increments don't extend it.
+	Incr(ctx context.Context, key string, window time.Duration) (count int64, resetIn time.Duration, err error)
+}
+
+var errNonPositiveTTL = errors.New("ttl must be positive")
+
+// Open returns a Redis store for redisURL (a redis:// or rediss:// URL),
+// checking that it answers, or a memory store when redisURL is empty.
+func Open(ctx context.Context, redisURL string) (Store, error) {
+	if redisURL == "" {
+		return NewMemory(), nil
+	}
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse redis url: %w", err)
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("ping redis: %w", err)
+	}
+	return NewRedis(client), nil
+}
+
+// ---------------------------------------------------------------------------
+// Memory store: one process only.
+// ---------------------------------------------------------------------------
+
+type memoryEntry struct {
+	value     []byte
+	count     int64
+	expiresAt time.Time
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	writes  int
+	now     func() time.Time
+}
+
+// NewMemory returns a process-local store. Expired keys are dropped when
+// next read and by a sweep every sweepEvery writes.
+func NewMemory() Store {
+	return &memoryStore{entries: make(map[string]memoryEntry), now: time.Now}
+}
+
+// sweepEvery paces the expired-key sweep, so keys that are never read again
+// (a login attempt from a one-off IP) don't pile up.
+const sweepEvery = 1024
+
+func (s *memoryStore) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errNonPositiveTTL
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(key, memoryEntry{value: bytes.Clone(value), expiresAt: s.now().Add(ttl)})
+	return nil
+}
+
+func (s *memoryStore) Get(_ context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.live(key)
+	if !ok || e.value == nil {
+		return nil, false, nil
+	}
+	return bytes.Clone(e.value), true, nil
+}
+
+func (s *memoryStore) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	delete(s.entries, key)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) Incr(_ context.Context, key string, window time.Duration) (int64, time.Duration, error) {
+	if window <= 0 {
+		return 0, 0, errNonPositiveTTL
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.live(key)
+	if !ok {
+		e = memoryEntry{expiresAt: s.now().Add(window)}
+	}
+	e.count++
+	s.put(key, e)
+	return e.count, e.expiresAt.Sub(s.now()), nil
+}
+
+// live returns key's entry unless it has expired, dropping it if so.
+// Callers hold s.mu.
+func (s *memoryStore) live(key string) (memoryEntry, bool) {
+	e, ok := s.entries[key]
+	if ok && !s.now().Before(e.expiresAt) {
+		delete(s.entries, key)
+		return memoryEntry{}, false
+	}
+	return e, ok
+}
+
+// put stores e, sweeping expired keys every sweepEvery writes. Callers
+// hold s.mu.
+func (s *memoryStore) put(key string, e memoryEntry) {
+	if s.writes++; s.writes%sweepEvery == 0 {
+		now := s.now()
+		for k, v := range s.entries {
+			if !now.Before(v.expiresAt) {
+				delete(s.entries, k)
+			}
+		}
+	}
+	s.entries[key] = e
+}
+
+// ---------------------------------------------------------------------------
+// Redis store: shared across replicas.
+// ---------------------------------------------------------------------------
+
+type redisStore struct {
+	client redis.UniversalClient
+}
+
+// NewRedis returns a store on client. Expiry is Redis's own.
+func NewRedis(client redis.UniversalClient) Store {
+	return &redisStore{client: client}
+}
+
+func (s *redisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errNonPositiveTTL
+	}
+	if err := s.client.Set(ctx, key, value, ttl).Err(); err != nil {
+		return fmt.Errorf("redis set: %w", err)
+	}
+	return nil
+}
+
+func (s *redisStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	v, err := s.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("redis get: %w", err)
+	}
+	return v, true, nil
+}
+
+func (s *redisStore) Delete(ctx context.Context, key string) error {
+	if err := s.client.Del(ctx, key).Err(); err != nil {
+		return fmt.Errorf("redis del: %w", err)
+	}
+	return nil
+}
+
+// incrScript increments and, for a new counter, starts its window in the
+// same round trip, so a crash between the two can't leave a counter that
+// never expires.
+var incrScript = redis.NewScript(`
+local n = redis.call('INCR', KEYS[1])
+if n == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return {n, redis.call('PTTL', KEYS[1])}
+`)
+
+func (s *redisStore) Incr(ctx context.Context, key string, window time.Duration) (int64, time.Duration, error) {
+	if window <= 0 {
+		return 0, 0, errNonPositiveTTL
+	}
+	res, err := incrScript.Run(ctx, s.client, []string{key}, window.Milliseconds()).Int64Slice()
+	if err != nil {
+		return 0, 0, fmt.Errorf("redis incr: %w", err)
+	}
+	return res[0], time.Duration(res[1]) * time.Millisecond, nil
+}
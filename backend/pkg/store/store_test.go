@@ -0,0 +1,93 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// backends returns each implementation plus a way to move its clock.
+func backends(t *testing.T) map[string]struct {
+	s       Store
+	advance func(time.Duration)
+} {
+	t.Helper()
+	mem := NewMemory().(*memoryStore)
+	now := time.Now()
+	mem.now = func() time.Time { return now }
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return map[string]struct {
+		s       Store
+		advance func(time.Duration)
+	}{
+		"memory": {mem, func(d time.Duration) { now = now.Add(d) }},
+		"redis":  {NewRedis(client), mr.FastForward},
+	}
+}
+
+func TestStore_SetGetDelete(t *testing.T) {
+	ctx := context.Background()
+	for name, b := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := b.s.Set(ctx, "session:abc", []byte(`{"role":"agent"}`), time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			v, ok, err := b.s.Get(ctx, "session:abc")
+			if err != nil || !ok || string(v) != `{"role":"agent"}` {
+				t.Fatalf("Get = %q, %v, %v", v, ok, err)
+			}
+			if _, ok, _ := b.s.Get(ctx, "session:other"); ok {
+				t.Error("unknown key found")
+			}
+
+			b.advance(2 * time.Minute)
+			if _, ok, _ := b.s.Get(ctx, "session:abc"); ok {
+				t.Error("expired key still found")
+			}
+
+			_ = b.s.Set(ctx, "session:abc", []byte("x"), time.Minute)
+			if err := b.s.Delete(ctx, "session:abc"); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.s.Delete(ctx, "session:abc"); err != nil {
+				t.Errorf("second delete: %v", err)
+			}
+			if _, ok, _ := b.s.Get(ctx, "session:abc"); ok {
+				t.Error("deleted key still found")
+			}
+			if err := b.s.Set(ctx, "k", []byte("x"), 0); err == nil {
+				t.Error("zero ttl accepted")
+			}
+		})
+	}
+}
+
+func TestStore_IncrWindow(t *testing.T) {
+	ctx := context.Background()
+	for name, b := range backends(t) {
+		t.Run(name, func(t *testing.T) {
+			for want := int64(1); want <= 3; want++ {
+				n, resetIn, err := b.s.Incr(ctx, "ratelimit:1.2.3.4", time.Minute)
+				if err != nil || n != want {
+					t.Fatalf("Incr = %d, %v; want %d", n, err, want)
+				}
+				if resetIn <= 0 || resetIn > time.Minute {
+					t.Errorf("resetIn = %s", resetIn)
+				}
+				b.advance(10 * time.Second)
+			}
+			// Later increments don't push the window out.
+			b.advance(31 * time.Second)
+			if n, _, _ := b.s.Incr(ctx, "ratelimit:1.2.3.4", time.Minute); n != 1 {
+				t.Errorf("after the window: count %d, want 1", n)
+			}
+		})
+	}
+}
@@ -15,7 +15,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/jackc/pgx/v5/pgxpool"
 	log "github.com/sirupsen/logrus"
 	gossh "golang.org/x/crypto/ssh"
 	"golang.org/x/sync/semaphore"
@@ -41,30 +40,60 @@ const (
 	DefaultRunTimeout = 30 * time.Minute
 )
 
+// Policy decides how a bulk run's hosts are split into phases.
+type Policy string
+
+const (
+	// PolicyParallel runs every host in one phase.
+	PolicyParallel Policy = "parallel"
+	// PolicyCanary runs a sample first and the rest only if it passed.
+	PolicyCanary Policy = "canary"
+	// PolicyRolling runs fixed-size batches one after another.
+	PolicyRolling Policy = "rolling"
+)
+
+// Valid reports whether p is a policy a request may name.
+func (p Policy) Valid() bool {
+	return p == PolicyParallel || p == PolicyCanary || p == PolicyRolling
+}
+
 // BulkRunOptions controls a fan-out update.
 //
 // Concurrency <= 0 means default; values above MaxConcurrency are clamped.
 //
 // Staged-rollout knobs:
-//   - CanaryCount = 0 disables canarying; the whole fleet runs immediately
-//     under the regular concurrency limit.
-//   - CanaryCount > 0 reserves the first N hosts for an initial wave. After
-//     the wave finishes, the coordinator sleeps CanaryWaitSeconds, then
-//     either continues with the rest of the fleet (if no canary failed) or
-//     aborts the remainder.
-//   - AbortOnFailurePct: if a non-zero fraction of *completed* hosts has
-//     failed, mark every remaining host failed without dialing it. 0 disables.
+//   - Policy PolicyParallel runs the whole fleet at once under the regular
+//     concurrency limit.
+//   - PolicyCanary runs the first CanaryCount hosts (1 when unset) as a
+//     sample. After it the coordinator sleeps CanaryWaitSeconds and checks
+//     each canary still answers over SSH, then either continues with the
+//     rest of the fleet or, if a canary failed, aborts the remainder. With
+//     AbortOnFailurePct set, the canary failure rate must reach it instead.
+//   - PolicyRolling runs BatchSize hosts at a time (the concurrency when
+//     unset), each batch once the one before has finished.
+//   - Policy "" is PolicyCanary when CanaryCount > 0, else PolicyParallel.
+//     Schedules and playbook runs pick their rollout this way.
+//   - AbortOnFailurePct: between phases, if this share of the hosts
+//     *completed* so far has failed, mark every remaining host failed
+//     without dialing it. PolicyParallel has a single phase, so there it
+//     is checked before each host starts instead; hosts already running
+//     finish. That only bites once the fleet is bigger than the
+//     concurrency. 0 disables.
+//
+// Each phase's hosts and outcome are recorded in run_group_phases.
 type BulkRunOptions struct {
 	HostIDs           []int32
 	Concurrency       int
 	TriggeredBy       string
+	Policy            Policy
 	CanaryCount       int
 	CanaryWaitSeconds int
+	BatchSize         int
 	AbortOnFailurePct int
 
 	// Playbook fan-out. Zero values keep the apt-update path byte-identical:
 	//   - Kind == "" is treated as RunKindUpdate.
-	//   - Steps == nil/empty runs the single buildUpdateScript command.
+	//   - Steps == nil/empty runs the single Commands.HostCommand line.
 	// Steps are RAW (uncompiled): the sudo prefix depends on each host's
 	// ssh_user, known only inside runOne after ConnectToHost.
 	Kind       models.RunKind
@@ -90,26 +119,45 @@ type BulkResult struct {
 	GroupID string  `json:"group_id"`
 	RunIDs  []int32 `json:"run_ids"`
 	HostIDs []int32 `json:"host_ids"`
+	Policy  Policy  `json:"policy,omitempty"`
+	Phases  int     `json:"phases,omitempty"`
 }
 
 // Coordinator owns the dependencies the fan-out needs. Built once at app
 // boot; safe for concurrent use.
 type Coordinator struct {
-	Pool   *pgxpool.Pool
+	DB     db.DBTX
 	Dialer *sshpkg.Dialer
 	// Notify, when set, is called once per host as its run reaches a terminal
 	// state. The API layer wires this to webhook dispatch so bulk and
 	// scheduled runs fire the same events as single-host runs.
 	Notify func(kind models.RunKind, hostID, runID int32, succeeded bool, errMsg string)
+	// MaxConcurrency, when positive, lowers (or raises) the per-request
+	// ceiling from the package default. main sets it from
+	// config.SSHConfig.BulkMaxConcurrency so small networks can be
+	// protected fleet-wide.
+	MaxConcurrency int
+	// SSHLimit, when set, is the process-wide session budget shared with
+	// interactive runs. Each host queues for a slot after passing the
+	// per-group cap.
+	SSHLimit *sshpkg.Limiter
+	// Commands builds the apt path's update line; nil means
+	// DefaultCommands. main sets it from UPDATE_CHECK_TEMPLATE and
+	// UPDATE_APPLY_TEMPLATE.
+	Commands *CommandTemplate
+	// runHost and checkHost, when set, stand in for runOne and the SSH
+	// health check so tests can drive a rollout without hosts.
+	runHost   func(ctx context.Context, opts BulkRunOptions, hostID, runID int32) bool
+	checkHost func(ctx context.Context, hostID int32) error
 	// inFlightGroups remembers which UUIDs are currently active so the API
 	// layer can rate-limit "one group per user" without a DB round trip.
 	mu             sync.Mutex
 	inFlightGroups map[string]struct{}
 }
 
-func New(pool *pgxpool.Pool, dialer *sshpkg.Dialer) *Coordinator {
+func New(pool db.DBTX, dialer *sshpkg.Dialer) *Coordinator {
 	return &Coordinator{
-		Pool:           pool,
+		DB:             pool,
 		Dialer:         dialer,
 		inFlightGroups: make(map[string]struct{}),
 	}
@@ -130,13 +178,7 @@ func (c *Coordinator) Start(ctx context.Context, opts BulkRunOptions) (BulkResul
 	if len(opts.HostIDs) == 0 {
 		return BulkResult{}, fmt.Errorf("no hosts selected")
 	}
-	conc := opts.Concurrency
-	if conc <= 0 {
-		conc = DefaultConcurrency
-	}
-	if conc > MaxConcurrency {
-		conc = MaxConcurrency
-	}
+	conc := c.concurrency(opts.Concurrency)
 
 	groupID, err := newUUID()
 	if err != nil {
@@ -151,29 +193,129 @@ func (c *Coordinator) Start(ctx context.Context, opts BulkRunOptions) (BulkResul
 	}
 	runIDs := make([]int32, len(opts.HostIDs))
 	for i, hid := range opts.HostIDs {
-		run, err := db.CreateRunFull(ctx, c.Pool, hid, opts.TriggeredBy, opts.Kind, groupID, opts.PlaybookID)
+		run, err := db.CreateRunFull(ctx, c.DB, hid, opts.TriggeredBy, opts.Kind, groupID, opts.PlaybookID)
 		if err != nil {
 			return BulkResult{}, fmt.Errorf("create run for host %d: %w", hid, err)
 		}
 		runIDs[i] = run.ID
 	}
 
+	policy := resolvePolicy(opts)
+	phases := planPhases(policy, len(opts.HostIDs), opts.CanaryCount, batchSize(opts.BatchSize, conc))
+	if err := db.CreateRunPhases(ctx, c.DB, runPhases(groupID, opts.HostIDs, phases)); err != nil {
+		// The runs exist already; better to roll out without the phase
+		// record than to strand them.
+		log.Errorf("bulk %s: %v", groupID, err)
+	}
+
 	c.mu.Lock()
 	c.inFlightGroups[groupID] = struct{}{}
 	c.mu.Unlock()
 
 	// Detach: the HTTP request is done as far as the caller is concerned.
-	go c.run(opts, groupID, runIDs, conc) // #nosec G118 -- bulk run intentionally outlives the request
+	go c.run(opts, groupID, runIDs, conc, phases) // #nosec G118 -- bulk run intentionally outlives the request
+
+	return BulkResult{GroupID: groupID, RunIDs: runIDs, HostIDs: opts.HostIDs, Policy: policy, Phases: len(phases)}, nil
+}
+
+// Phase names, as stored in run_group_phases.name.
+const (
+	phaseAll       = "all"
+	phaseCanary    = "canary"
+	phaseRemainder = "remainder"
+	phaseBatch     = "batch"
+)
 
-	return BulkResult{GroupID: groupID, RunIDs: runIDs, HostIDs: opts.HostIDs}, nil
+// phaseSpan is one phase: the hosts HostIDs[start:end].
+type phaseSpan struct {
+	name       string
+	start, end int
 }
 
-// run is the long-lived goroutine that actually performs the fan-out. It
-// uses a weighted semaphore to keep concurrent SSH sessions bounded. When
-// CanaryCount > 0 the host list is split into two waves with a configurable
-// pause between them; an abort threshold can short-circuit the rest of the
-// fleet.
-func (c *Coordinator) run(opts BulkRunOptions, groupID string, runIDs []int32, conc int) {
+// resolvePolicy fills in the policy a request left empty.
+func resolvePolicy(opts BulkRunOptions) Policy {
+	if opts.Policy != "" {
+		return opts.Policy
+	}
+	if opts.CanaryCount > 0 {
+		return PolicyCanary
+	}
+	return PolicyParallel
+}
+
+// batchSize is a rolling run's batch size: requested, or conc when unset.
+func batchSize(requested, conc int) int {
+	if requested > 0 {
+		return requested
+	}
+	return conc
+}
+
+// planPhases splits n hosts into policy's phases.
+func planPhases(policy Policy, n, canaryCount, batch int) []phaseSpan {
+	switch policy {
+	case PolicyCanary:
+		k := canaryCount
+		if k <= 0 {
+			k = 1
+		}
+		if k > n {
+			k = n
+		}
+		phases := []phaseSpan{{phaseCanary, 0, k}}
+		if k < n {
+			phases = append(phases, phaseSpan{phaseRemainder, k, n})
+		}
+		return phases
+	case PolicyRolling:
+		var phases []phaseSpan
+		for start := 0; start < n; start += batch {
+			phases = append(phases, phaseSpan{phaseBatch, start, min(start+batch, n)})
+		}
+		return phases
+	default:
+		return []phaseSpan{{phaseAll, 0, n}}
+	}
+}
+
+// runPhases turns a plan into the pending rows CreateRunPhases stores.
+func runPhases(groupID string, hostIDs []int32, phases []phaseSpan) []models.RunPhase {
+	out := make([]models.RunPhase, len(phases))
+	for i, ph := range phases {
+		out[i] = models.RunPhase{
+			RunGroupID: groupID,
+			Phase:      i + 1,
+			Name:       ph.name,
+			HostIDs:    hostIDs[ph.start:ph.end],
+			Status:     models.RunPhasePending,
+		}
+	}
+	return out
+}
+
+// concurrency resolves a requested worker count against the default and the
+// coordinator's ceiling.
+func (c *Coordinator) concurrency(requested int) int {
+	ceiling := MaxConcurrency
+	if c.MaxConcurrency > 0 {
+		ceiling = c.MaxConcurrency
+	}
+	conc := requested
+	if conc <= 0 {
+		conc = DefaultConcurrency
+	}
+	if conc > ceiling {
+		conc = ceiling
+	}
+	return conc
+}
+
+// run is the long-lived goroutine that actually performs the fan-out, one
+// phase after another. Each phase runs under a weighted semaphore to keep
+// concurrent SSH sessions bounded. Between phases the canary gate and the
+// abort threshold can stop the rollout; the hosts not yet reached are then
+// marked failed without being dialled.
+func (c *Coordinator) run(opts BulkRunOptions, groupID string, runIDs []int32, conc int, phases []phaseSpan) {
 	defer func() {
 		c.mu.Lock()
 		delete(c.inFlightGroups, groupID)
@@ -189,72 +331,173 @@ func (c *Coordinator) run(opts BulkRunOptions, groupID string, runIDs []int32, c
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	canary := opts.CanaryCount
-	if canary < 0 {
-		canary = 0
-	}
-	if canary > len(opts.HostIDs) {
-		canary = len(opts.HostIDs)
-	}
+	var completed, failed int
+	for i, ph := range phases {
+		hostIDs, ids := opts.HostIDs[ph.start:ph.end], runIDs[ph.start:ph.end]
+		last := i == len(phases)-1
+		c.recordPhase(groupID, i+1, models.RunPhaseRunning, 0, 0, "")
+
+		// A parallel run is one phase, so its threshold can only be checked
+		// while the wave runs.
+		wavePct := 0
+		if ph.name == phaseAll {
+			wavePct = opts.AbortOnFailurePct
+		}
+		ok, halt := c.runWave(ctx, opts, hostIDs, ids, conc, wavePct)
+		fails := countFailed(ok)
+		var notes []string
+		if halt == "" && ph.name == phaseCanary && !last {
+			if halt = canaryHalt(opts, fails, len(ok)); halt == "" {
+				if !c.canaryPause(ctx, groupID, opts.CanaryWaitSeconds) {
+					halt = "run timed out before the remainder started"
+				} else {
+					// The canaries must still answer after the pause; a host
+					// the update left unreachable fails the gate.
+					for j, hostID := range hostIDs[:len(ok)] {
+						if !ok[j] {
+							continue
+						}
+						if err := c.healthCheck(ctx, hostID); err != nil {
+							ok[j] = false
+							notes = append(notes, fmt.Sprintf("host %d failed its health check: %v", hostID, err))
+						}
+					}
+					fails = countFailed(ok)
+					halt = canaryHalt(opts, fails, len(ok))
+				}
+			}
+		}
+		completed += len(ok)
+		failed += fails
+		if halt == "" && !last && shouldAbort(opts.AbortOnFailurePct, percent(failed, completed)) {
+			halt = fmt.Sprintf("failure rate %d%% exceeded threshold %d%%", percent(failed, completed), opts.AbortOnFailurePct)
+		}
 
-	// Wave 1: canary (or everything when CanaryCount == 0).
-	end := canary
-	if end == 0 {
-		end = len(opts.HostIDs)
+		if halt == "" {
+			c.recordPhase(groupID, i+1, models.RunPhaseCompleted, len(ok)-fails, fails, strings.Join(notes, "; "))
+			continue
+		}
+		c.recordPhase(groupID, i+1, models.RunPhaseHalted, len(ok)-fails, fails, strings.Join(append(notes, halt), "; "))
+		log.Warnf("bulk %s: %s phase %d/%d halted (%s) — aborting remainder", groupID, ph.name, i+1, len(phases), halt)
+		// A wave that halted itself leaves its own unstarted hosts too.
+		next := ph.start + len(ok)
+		c.skipRemaining(opts.HostIDs[next:], runIDs[next:], halt)
+		for k := i + 1; k < len(phases); k++ {
+			c.recordPhase(groupID, k+1, models.RunPhaseSkipped, 0, 0, "skipped: "+halt)
+		}
+		return
 	}
-	canaryFailures := c.runWave(ctx, opts, opts.HostIDs[:end], runIDs[:end], conc)
+}
 
-	// Stop early if the canary tripped the abort threshold.
-	if canary > 0 {
-		failPct := percent(canaryFailures, end)
-		if shouldAbort(opts.AbortOnFailurePct, failPct) {
-			log.Warnf("bulk %s: canary failed (%d/%d, %d%%) — aborting remainder",
-				groupID, canaryFailures, end, failPct)
-			c.skipRemaining(opts.HostIDs[end:], runIDs[end:],
-				fmt.Sprintf("canary failure rate %d%% exceeded threshold %d%%", failPct, opts.AbortOnFailurePct))
-			return
+// canaryHalt says why a canary phase with fails failures out of n stops the
+// rollout, or "" when it doesn't. Any failure does, unless AbortOnFailurePct
+// is set, in which case the failure rate has to reach it.
+func canaryHalt(opts BulkRunOptions, fails, n int) string {
+	if fails == 0 {
+		return ""
+	}
+	if opts.AbortOnFailurePct > 0 {
+		if pct := percent(fails, n); shouldAbort(opts.AbortOnFailurePct, pct) {
+			return fmt.Sprintf("canary failure rate %d%% exceeded threshold %d%%", pct, opts.AbortOnFailurePct)
 		}
+		return ""
+	}
+	return fmt.Sprintf("%d of %d canary hosts failed", fails, n)
+}
 
-		// Wait between waves. clamp to a reasonable ceiling so a typo can't
-		// pin a goroutine for hours.
-		if opts.CanaryWaitSeconds > 0 && end < len(opts.HostIDs) {
-			wait := time.Duration(opts.CanaryWaitSeconds) * time.Second
-			if wait > 10*time.Minute {
-				wait = 10 * time.Minute
-			}
-			log.Infof("bulk %s: canary OK, sleeping %s before remainder", groupID, wait)
-			select {
-			case <-ctx.Done():
-				return
-			case <-time.After(wait):
-			}
-		}
+// canaryPause waits waitSeconds, clamped so a typo can't pin a goroutine
+// for hours, and reports false if ctx ended first.
+func (c *Coordinator) canaryPause(ctx context.Context, groupID string, waitSeconds int) bool {
+	if waitSeconds <= 0 {
+		return ctx.Err() == nil
+	}
+	wait := time.Duration(waitSeconds) * time.Second
+	if wait > 10*time.Minute {
+		wait = 10 * time.Minute
 	}
+	log.Infof("bulk %s: canary OK, sleeping %s before remainder", groupID, wait)
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(wait):
+		return true
+	}
+}
 
-	// Wave 2: the rest, only when canary > 0 and there's something left.
-	if canary > 0 && end < len(opts.HostIDs) {
-		_ = c.runWave(ctx, opts, opts.HostIDs[end:], runIDs[end:], conc)
+// healthCheck dials hostID and runs a no-op, to tell that a canary still
+// answers after its update.
+func (c *Coordinator) healthCheck(ctx context.Context, hostID int32) error {
+	if c.checkHost != nil {
+		return c.checkHost(ctx, hostID)
+	}
+	release, err := c.SSHLimit.Queue(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	client, _, err := c.Dialer.ConnectToHost(ctx, hostID)
+	if err != nil {
+		return err
 	}
+	defer client.Close()
+	_, err = quickOutput(client, "true")
+	return err
 }
 
-// runWave executes one slice of hosts under the concurrency cap and returns
-// the number of failed runs. The cap is applied within the wave so each wave
-// is independently bounded.
-func (c *Coordinator) runWave(ctx context.Context, opts BulkRunOptions, hostIDs, runIDs []int32, conc int) int {
+// recordPhase stores a phase's progress on its own short deadline, like
+// markFailed. A failed write is logged; the rollout goes on regardless.
+func (c *Coordinator) recordPhase(groupID string, phase int, status models.RunPhaseStatus, succeeded, failed int, note string) {
+	dbCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := db.UpdateRunPhase(dbCtx, c.DB, groupID, phase, status, succeeded, failed, note); err != nil {
+		log.Errorf("bulk %s: record phase %d: %v", groupID, phase, err)
+	}
+}
+
+// runWave executes one slice of hosts under the concurrency cap and reports
+// which runs succeeded, parallel to hostIDs. The cap is applied within the
+// wave so each wave is independently bounded.
+//
+// With abortPct set, each host waits for its slot and then starts only if
+// the failure rate of the hosts finished so far is under abortPct. Once it
+// isn't, runWave starts no more hosts and returns why; ok then covers just
+// the hosts it started, which are always a prefix of hostIDs.
+func (c *Coordinator) runWave(ctx context.Context, opts BulkRunOptions, hostIDs, runIDs []int32, conc, abortPct int) (ok []bool, halt string) {
 	sem := semaphore.NewWeighted(int64(conc))
 	var wg sync.WaitGroup
-	var failures int64
-	var mu sync.Mutex
+	results := make([]bool, len(hostIDs))
+	started := len(hostIDs)
+	runHost := c.runOne
+	if c.runHost != nil {
+		runHost = c.runHost
+	}
+	var (
+		mu             sync.Mutex
+		done, failures int
+	)
 
 	for i, hostID := range hostIDs {
-		hostID := hostID
+		i, hostID := i, hostID
 		runID := runIDs[i]
 
 		if err := sem.Acquire(ctx, 1); err != nil {
 			c.markFailed(runID, "bulk cancelled before start: "+err.Error())
-			mu.Lock()
-			failures++
-			mu.Unlock()
+			continue
+		}
+		mu.Lock()
+		pct := percent(failures, done)
+		mu.Unlock()
+		if shouldAbort(abortPct, pct) {
+			sem.Release(1)
+			halt = fmt.Sprintf("failure rate %d%% exceeded threshold %d%%", pct, abortPct)
+			started = i
+			break
+		}
+
+		release, err := c.SSHLimit.Queue(ctx)
+		if err != nil {
+			sem.Release(1)
+			c.markFailed(runID, "bulk cancelled before start: "+err.Error())
 			continue
 		}
 
@@ -262,19 +505,33 @@ func (c *Coordinator) runWave(ctx context.Context, opts BulkRunOptions, hostIDs,
 		go func() {
 			defer wg.Done()
 			defer sem.Release(1)
-			if !c.runOne(ctx, opts, hostID, runID) {
-				mu.Lock()
+			defer release()
+			succeeded := runHost(ctx, opts, hostID, runID)
+			results[i] = succeeded
+			mu.Lock()
+			done++
+			if !succeeded {
 				failures++
-				mu.Unlock()
 			}
+			mu.Unlock()
 		}()
 	}
 	wg.Wait()
-	return int(failures)
+	return results[:started], halt
+}
+
+func countFailed(ok []bool) int {
+	n := 0
+	for _, v := range ok {
+		if !v {
+			n++
+		}
+	}
+	return n
 }
 
 // skipRemaining marks every still-pending host failed without dialing it.
-// Used when the canary trips the abort threshold.
+// Used when a phase halts the rollout.
 func (c *Coordinator) skipRemaining(hostIDs, runIDs []int32, reason string) {
 	for i := range hostIDs {
 		c.markFailed(runIDs[i], "skipped: "+reason)
@@ -296,7 +553,7 @@ func shouldAbort(thresholdPct, observedPct int) bool {
 }
 
 // runOne performs a single host's run. For the update path (opts.Steps empty)
-// it runs the one buildUpdateScript command — byte-identical to before. For a
+// it runs the one Commands.HostCommand line — byte-identical to before. For a
 // playbook it compiles the raw steps for this host's ssh_user and runs them
 // one SSH session per step, stopping at the first failure (mirrors
 // runHostCommand). Output is captured to the pre-existing update_runs row.
@@ -311,7 +568,7 @@ func (c *Coordinator) runOne(ctx context.Context, opts BulkRunOptions, hostID, r
 		// parent ctx is cancelled.
 		dbCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
-		if err := db.FinishRun(dbCtx, c.Pool, runID, finishStatus, finishExit, finishErr); err != nil {
+		if err := db.FinishRun(dbCtx, c.DB, runID, finishStatus, finishExit, finishErr); err != nil {
 			log.Errorf("bulk: finish run %d: %v", runID, err)
 		}
 		if c.Notify != nil {
@@ -319,13 +576,13 @@ func (c *Coordinator) runOne(ctx context.Context, opts BulkRunOptions, hostID, r
 		}
 	}()
 
-	client, host, err := c.Dialer.ConnectToHost(ctx, hostID)
+	client, host, doneSSH, err := c.Dialer.ConnectReusable(ctx, hostID)
 	if err != nil {
 		finishErr = "ssh connect: " + err.Error()
-		_, _ = db.AppendRunOutput(ctx, c.Pool, runID, finishErr+"\n")
+		_, _ = db.AppendRunOutput(ctx, c.DB, runID, finishErr+"\n")
 		return false
 	}
-	defer client.Close()
+	defer doneSSH()
 
 	if opts.Reboot {
 		if err := c.rebootAndWait(ctx, client, host, hostID, runID); err != nil {
@@ -337,19 +594,44 @@ func (c *Coordinator) runOne(ctx context.Context, opts BulkRunOptions, hostID, r
 		return true
 	}
 
-	cmds := []string{BuildUpdateScript(host.SshUser, opts.SecurityOnly)}
+	var cmds []string
+	stdin := ""
+	// The update path keeps a copy of what it streams to the run row, to
+	// find the packages the upgrade kept back without reading the row back.
+	var stdoutCopy *headBuffer
 	if len(opts.Steps) > 0 {
 		cmds = playbooks.CompileSteps(opts.Steps, host.SshUser, opts.UseSudo)
+	} else {
+		sudoPassword, err := db.GetSudoPassword(ctx, c.DB, hostID)
+		if errors.Is(err, db.ErrUndecryptable) {
+			log.Errorf("Host %d: %v", hostID, err)
+			finishErr = "stored sudo password cannot be decrypted; set it again"
+			return false
+		}
+		if err != nil {
+			finishErr = "load sudo password: " + err.Error()
+			return false
+		}
+		var cmd string
+		cmd, stdin = c.Commands.HostCommand(host, opts.SecurityOnly, sudoPassword)
+		cmds = []string{cmd}
+		stdoutCopy = &headBuffer{max: db.MaxRunOutputBytes}
 	}
 
 	for _, cmd := range cmds {
-		exit, cmdErr := c.runOneCommand(ctx, client, runID, cmd)
+		exit, cmdErr := c.runOneCommand(ctx, client, runID, cmd, stdin, stdoutCopy)
 		if cmdErr != nil {
 			finishExit = exit
 			finishErr = cmdErr.Error()
 			return false // stop-on-failure
 		}
 	}
+	if stdoutCopy != nil {
+		_, upgradeOut := SplitUpdateOutput(string(stdoutCopy.buf))
+		if err := RecordKeptBack(ctx, c.DB, runID, upgradeOut); err != nil {
+			log.Errorf("bulk: %v", err)
+		}
+	}
 
 	finishStatus = models.RunStatusSucceeded
 	finishExit = 0
@@ -358,13 +640,19 @@ func (c *Coordinator) runOne(ctx context.Context, opts BulkRunOptions, hostID, r
 
 // runOneCommand runs a single shell line on an existing SSH client, tees its
 // output to the run row, and returns the remote exit code (-1 on SSH-layer
-// failure). Extracted from runOne so a playbook can loop it per step.
-func (c *Coordinator) runOneCommand(ctx context.Context, client *gossh.Client, runID int32, cmd string) (int, error) {
+// failure). Extracted from runOne so a playbook can loop it per step. stdin,
+// when non-empty, is written to the command's standard input (the sudo
+// password); it never reaches the run row. stdoutCopy, when non-nil, also
+// gets everything the command writes to stdout.
+func (c *Coordinator) runOneCommand(ctx context.Context, client *gossh.Client, runID int32, cmd, stdin string, stdoutCopy *headBuffer) (int, error) {
 	session, err := client.NewSession()
 	if err != nil {
 		return -1, fmt.Errorf("ssh session: %w", err)
 	}
 	defer session.Close()
+	if stdin != "" {
+		session.Stdin = strings.NewReader(stdin)
+	}
 
 	stdout, err := session.StdoutPipe()
 	if err != nil {
@@ -375,15 +663,19 @@ func (c *Coordinator) runOneCommand(ctx context.Context, client *gossh.Client, r
 		return -1, fmt.Errorf("stderr pipe: %w", err)
 	}
 
-	_, _ = db.AppendRunOutput(ctx, c.Pool, runID, "$ "+cmd+"\n")
+	_, _ = db.AppendRunOutput(ctx, c.DB, runID, "$ "+cmd+"\n")
 	if err := session.Start(cmd); err != nil {
 		return -1, fmt.Errorf("start command: %w", err)
 	}
 
 	var pumpWG sync.WaitGroup
 	pumpWG.Add(2)
-	go func() { defer pumpWG.Done(); pumpToRun(c.Pool, runID, stdout) }()
-	go func() { defer pumpWG.Done(); pumpToRun(c.Pool, runID, stderr) }()
+	var stdoutSrc io.Reader = stdout
+	if stdoutCopy != nil {
+		stdoutSrc = io.TeeReader(stdout, stdoutCopy)
+	}
+	go func() { defer pumpWG.Done(); pumpToRun(c.DB, runID, stdoutSrc) }()
+	go func() { defer pumpWG.Done(); pumpToRun(c.DB, runID, stderr) }()
 
 	// The pumps block on session reads; a hung remote command would pin this
 	// goroutine forever. On run-timeout, closing the session (and client)
@@ -395,6 +687,9 @@ func (c *Coordinator) runOneCommand(ctx context.Context, client *gossh.Client, r
 	if timedOut {
 		return -1, errors.New("run timed out; remote command killed")
 	}
+	if err != nil && sshpkg.ConnectionLost(client) {
+		return -1, sshpkg.ErrConnectionLost
+	}
 	if err == nil {
 		return 0, nil
 	}
@@ -407,15 +702,29 @@ func (c *Coordinator) runOneCommand(ctx context.Context, client *gossh.Client, r
 func (c *Coordinator) markFailed(runID int32, msg string) {
 	dbCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	_, _ = db.AppendRunOutput(dbCtx, c.Pool, runID, msg+"\n")
-	if err := db.FinishRun(dbCtx, c.Pool, runID, models.RunStatusFailed, -1, msg); err != nil {
+	_, _ = db.AppendRunOutput(dbCtx, c.DB, runID, msg+"\n")
+	if err := db.FinishRun(dbCtx, c.DB, runID, models.RunStatusFailed, -1, msg); err != nil {
 		log.Errorf("bulk: mark run %d failed: %v", runID, err)
 	}
 }
 
+// headBuffer keeps the first max bytes written to it and drops the rest,
+// as the run row does past MaxRunOutputBytes.
+type headBuffer struct {
+	buf []byte
+	max int
+}
+
+func (h *headBuffer) Write(p []byte) (int, error) {
+	if room := h.max - len(h.buf); room > 0 {
+		h.buf = append(h.buf, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
+
 // pumpToRun copies an SSH reader straight to the run row. Bulk callers don't
 // have a websocket; the row is the only audience.
-func pumpToRun(pool *pgxpool.Pool, runID int32, src io.Reader) {
+func pumpToRun(pool db.DBTX, runID int32, src io.Reader) {
 	buf := make([]byte, 4096)
 	for {
 		n, err := src.Read(buf)
@@ -430,32 +739,36 @@ func pumpToRun(pool *pgxpool.Pool, runID int32, src io.Reader) {
 	}
 }
 
-// aptNoninteractive neutralizes the most common dpkg prompts during upgrades.
-const aptNoninteractive = `DEBIAN_FRONTEND=noninteractive ` +
-	`apt-get -o Dpkg::Options::="--force-confdef" -o Dpkg::Options::="--force-confold" -y `
+// UpgradeMarker is the line CommandTemplate.Script prints between the check
+// step and the apply step, so one run's output can be split back into the
+// two.
+const UpgradeMarker = "== ubuntu-auto-update: upgrade =="
+
+// SplitUpdateOutput divides an update run's output at UpgradeMarker into the
+// apt-get update part and the upgrade part (the marker line itself is
+// dropped). Output without the marker, because the update step failed or the
+// run predates it, is all update.
+func SplitUpdateOutput(out string) (update, upgrade string) {
+	before, after, found := strings.Cut(out, UpgradeMarker+"\n")
+	if !found {
+		return out, ""
+	}
+	return before, after
+}
 
-// BuildUpdateScript returns the shell line for an update run — the single
-// source shared by the bulk coordinator and the single-host engine in
-// cmd/api. securityOnly swaps the blanket `apt-get upgrade` for
-// `unattended-upgrade -v`, which applies only packages from its allowed
-// origins (Ubuntu's security pocket by default; the package ships installed
-// on Ubuntu). Non-root users get `sudo -n` so a missing passwordless sudo
-// fails fast instead of hanging on a password prompt.
-func BuildUpdateScript(sshUser string, securityOnly bool) string {
-	prefix := ""
-	if sshUser != "" && sshUser != "root" {
-		prefix = "sudo -n "
+// RecordKeptBack stores the packages an update run's upgrade step kept back
+// on the run. Shared by the bulk coordinator and the single-host engine in
+// cmd/api. A run with nothing kept back is left as it is.
+func RecordKeptBack(ctx context.Context, pool db.DBTX, runID int32, upgradeOutput string) error {
+	pkgs := ParseKeptBack(upgradeOutput)
+	if len(pkgs) == 0 {
+		return nil
 	}
-	if securityOnly {
-		return "set -o pipefail; " +
-			"echo '== ubuntu-auto-update: security-only update =='; " +
-			prefix + aptNoninteractive + "update && " +
-			prefix + "unattended-upgrade -v"
+	log.Infof("Run %d kept back %d package(s): %s", runID, len(pkgs), strings.Join(pkgs, " "))
+	if err := db.SetRunKeptBack(ctx, pool, runID, pkgs); err != nil {
+		return fmt.Errorf("run %d: %w", runID, err)
 	}
-	return "set -o pipefail; " +
-		"echo '== ubuntu-auto-update: update =='; " +
-		prefix + aptNoninteractive + "update && " +
-		prefix + aptNoninteractive + "upgrade"
+	return nil
 }
 
 // newUUID returns a v4-style UUID string. Avoids a hard dep on
@@ -488,32 +801,36 @@ func quickOutput(client *gossh.Client, cmd string) (string, error) {
 	return strings.TrimSpace(string(out)), err
 }
 
-// rebootAndWait issues a reboot and waits for the host to come back.
-// "Came back" means the kernel boot_id changed — airtight on real hosts. As
-// a fallback (containers and other environments share the host kernel's
-// boot_id), a host that was observed down and then reachable again also
-// counts.
-func (c *Coordinator) rebootAndWait(ctx context.Context, client *gossh.Client, host models.Host, hostID, runID int32) error {
+// RebootCommand is the command that reboots host after delay, rounded up
+// to whole minutes since that is what shutdown takes; 0 reboots now.
+// Non-root users go through sudo -n so a missing sudo rule fails instead
+// of prompting.
+func RebootCommand(host models.Host, delay time.Duration) string {
 	prefix := ""
 	if host.SshUser != "" && host.SshUser != "root" {
 		prefix = "sudo -n "
 	}
-
-	bootID, err := quickOutput(client, "cat /proc/sys/kernel/random/boot_id")
-	if err != nil {
-		return fmt.Errorf("read boot_id: %w", err)
+	when := "now"
+	if delay > 0 {
+		when = fmt.Sprintf("+%d", int((delay+time.Minute-1)/time.Minute))
 	}
+	return prefix + "shutdown -r " + when
+}
 
-	cmd := prefix + "shutdown -r now"
-	_, _ = db.AppendRunOutput(ctx, c.Pool, runID, "$ "+cmd+"\n")
+// IssueReboot runs cmd, a RebootCommand, on client and then closes client,
+// which a reboot is about to kill anyway.
+func IssueReboot(client *gossh.Client, cmd string) error {
+	defer client.Close()
 	sess, err := client.NewSession()
 	if err != nil {
 		return fmt.Errorf("ssh session: %w", err)
 	}
+	defer sess.Close()
 	// Two legitimate outcomes: the connection dies mid-command (reboot is
-	// happening — proceed to poll) or the command returns quickly with a
-	// clean failure (no sudo rights, no shutdown binary — fail fast instead
-	// of burning the whole reboot wait on a host that never went down).
+	// happening) or the command returns quickly with a clean failure (no
+	// sudo rights, no shutdown binary — fail fast instead of burning the
+	// whole reboot wait on a host that never went down). A delayed reboot
+	// is scheduled and exits 0, which is success too.
 	out, runErr := func() ([]byte, error) {
 		type result struct {
 			out []byte
@@ -531,8 +848,6 @@ func (c *Coordinator) rebootAndWait(ctx context.Context, client *gossh.Client, h
 			return nil, nil // still running/connection dropping — reboot in progress
 		}
 	}()
-	sess.Close()
-	client.Close()
 	// A clean non-zero exit means the command itself failed (no sudo rights,
 	// no shutdown binary) — fail fast. Other errors (EOF, closed connection)
 	// are the reboot tearing the session down, which is the point.
@@ -543,7 +858,26 @@ func (c *Coordinator) rebootAndWait(ctx context.Context, client *gossh.Client, h
 		}
 		return fmt.Errorf("reboot command failed: %s", msg)
 	}
-	_, _ = db.AppendRunOutput(ctx, c.Pool, runID, "reboot issued; waiting for the host to come back...\n")
+	return nil
+}
+
+// rebootAndWait issues a reboot and waits for the host to come back.
+// "Came back" means the kernel boot_id changed — airtight on real hosts. As
+// a fallback (containers and other environments share the host kernel's
+// boot_id), a host that was observed down and then reachable again also
+// counts.
+func (c *Coordinator) rebootAndWait(ctx context.Context, client *gossh.Client, host models.Host, hostID, runID int32) error {
+	bootID, err := quickOutput(client, "cat /proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return fmt.Errorf("read boot_id: %w", err)
+	}
+
+	cmd := RebootCommand(host, 0)
+	_, _ = db.AppendRunOutput(ctx, c.DB, runID, "$ "+cmd+"\n")
+	if err := IssueReboot(client, cmd); err != nil {
+		return err
+	}
+	_, _ = db.AppendRunOutput(ctx, c.DB, runID, "reboot issued; waiting for the host to come back...\n")
 
 	pollCtx, cancel := context.WithTimeout(ctx, rebootWait)
 	defer cancel()
@@ -565,13 +899,13 @@ func (c *Coordinator) rebootAndWait(ctx context.Context, client *gossh.Client, h
 		newID, idErr := quickOutput(probe, "cat /proc/sys/kernel/random/boot_id")
 		probe.Close()
 		if idErr == nil && newID != "" && newID != bootID {
-			_, _ = db.AppendRunOutput(ctx, c.Pool, runID, "host is back (new boot_id "+newID+")\n")
+			_, _ = db.AppendRunOutput(ctx, c.DB, runID, "host is back (new boot_id "+newID+")\n")
 			return nil
 		}
 		if wentDown {
 			// ponytail: containers share the host kernel's boot_id — going
 			// down and returning is the best signal available there.
-			_, _ = db.AppendRunOutput(ctx, c.Pool, runID, "host is back (went down and returned; boot_id unchanged)\n")
+			_, _ = db.AppendRunOutput(ctx, c.DB, runID, "host is back (went down and returned; boot_id unchanged)\n")
 			return nil
 		}
 		// Reachable with the same boot_id and never seen down: the reboot
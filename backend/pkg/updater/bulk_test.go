@@ -2,8 +2,31 @@ package updater
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock/v4"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"ubuntu-auto-update/backend/pkg/crypto"
+	"ubuntu-auto-update/backend/pkg/db"
+	"ubuntu-auto-update/backend/pkg/models"
+	sshpkg "ubuntu-auto-update/backend/pkg/ssh"
 )
 
 func TestNewUUID(t *testing.T) {
@@ -101,13 +124,30 @@ func TestConcurrencyClamp(t *testing.T) {
 	}
 }
 
+func TestCoordinator_ConcurrencyCeiling(t *testing.T) {
+	c := &Coordinator{}
+	if got := c.concurrency(0); got != DefaultConcurrency {
+		t.Errorf("concurrency(0) = %d, want %d", got, DefaultConcurrency)
+	}
+	if got := c.concurrency(1000); got != MaxConcurrency {
+		t.Errorf("concurrency(1000) = %d, want %d", got, MaxConcurrency)
+	}
+	c.MaxConcurrency = 2
+	if got := c.concurrency(0); got != 2 {
+		t.Errorf("with ceiling 2, concurrency(0) = %d, want 2", got)
+	}
+	if got := c.concurrency(1); got != 1 {
+		t.Errorf("with ceiling 2, concurrency(1) = %d, want 1", got)
+	}
+}
+
 func TestSkipRemaining_EmptySlice(t *testing.T) {
 	c := &Coordinator{inFlightGroups: make(map[string]struct{})}
 	// Should not panic
 	c.skipRemaining([]int32{}, []int32{}, "test reason")
 }
 
-func TestBuildUpdateScript(t *testing.T) {
+func TestCommandTemplate_DefaultScript(t *testing.T) {
 	cases := []struct {
 		user     string
 		security bool
@@ -121,16 +161,435 @@ func TestBuildUpdateScript(t *testing.T) {
 		{"", false, []string{"apt-get", "pipefail"}, []string{"sudo"}},
 	}
 	for _, c := range cases {
-		got := BuildUpdateScript(c.user, c.security)
+		got := DefaultCommands.Script(c.user, c.security)
 		for _, w := range c.want {
 			if !strings.Contains(got, w) {
-				t.Errorf("BuildUpdateScript(%q, %v) missing %q:\n%s", c.user, c.security, w, got)
+				t.Errorf("Script(%q, %v) missing %q:\n%s", c.user, c.security, w, got)
 			}
 		}
 		for _, a := range c.absent {
 			if strings.Contains(got, a) {
-				t.Errorf("BuildUpdateScript(%q, %v) must not contain %q:\n%s", c.user, c.security, a, got)
+				t.Errorf("Script(%q, %v) must not contain %q:\n%s", c.user, c.security, a, got)
 			}
 		}
 	}
 }
+
+func TestSplitUpdateOutput(t *testing.T) {
+	for _, security := range []bool{false, true} {
+		if got := DefaultCommands.Script("root", security); !strings.Contains(got, "update && echo '"+UpgradeMarker+"' && ") {
+			t.Errorf("security=%v: marker must sit between the steps:\n%s", security, got)
+		}
+	}
+
+	out := "== ubuntu-auto-update: update ==\nHit:1 http://archive.ubuntu.com jammy InRelease\n" +
+		UpgradeMarker + "\n0 upgraded, 0 newly installed\n"
+	update, upgrade := SplitUpdateOutput(out)
+	if update != "== ubuntu-auto-update: update ==\nHit:1 http://archive.ubuntu.com jammy InRelease\n" {
+		t.Errorf("update = %q", update)
+	}
+	if upgrade != "0 upgraded, 0 newly installed\n" {
+		t.Errorf("upgrade = %q", upgrade)
+	}
+
+	// apt-get update failed, so the upgrade step never ran.
+	update, upgrade = SplitUpdateOutput("E: Could not get lock\n")
+	if update != "E: Could not get lock\n" || upgrade != "" {
+		t.Errorf("no marker: got %q / %q", update, upgrade)
+	}
+}
+
+func TestCommandTemplate_SudoPassword(t *testing.T) {
+	cmd, stdin := DefaultCommands.Command("ubuntu", false, "")
+	if stdin != "" || !strings.Contains(cmd, "sudo -n") {
+		t.Errorf("no password: want passwordless sudo, got stdin %q cmd:\n%s", stdin, cmd)
+	}
+	cmd, stdin = DefaultCommands.Command("root", false, "hunter2")
+	if stdin != "" || strings.Contains(cmd, "sudo") {
+		t.Errorf("root: password must be ignored, got stdin %q cmd:\n%s", stdin, cmd)
+	}
+
+	cmd, stdin = DefaultCommands.Command("ubuntu", true, "it's secret")
+	if stdin != "it's secret\n" {
+		t.Errorf("stdin = %q, want password plus newline", stdin)
+	}
+	if !strings.Contains(cmd, "else sudo -S -p '' bash -c ") {
+		t.Errorf("cmd should run the script under sudo -S when sudo prompts:\n%s", cmd)
+	}
+	if strings.Contains(cmd, "secret") {
+		t.Errorf("password leaked into the command line:\n%s", cmd)
+	}
+	if strings.Contains(cmd, "sudo -n apt") {
+		t.Errorf("inner script should run as root without sudo -n:\n%s", cmd)
+	}
+}
+
+func TestCommandTemplate_HostPolicy(t *testing.T) {
+	cases := []struct {
+		policy       models.UpdatePolicy
+		securityOnly bool
+		wantSecurity bool
+	}{
+		{models.UpdatePolicyAll, false, false},
+		{models.UpdatePolicyAll, true, true},
+		{models.UpdatePolicySecurityOnly, false, true},
+		{models.UpdatePolicySecurityOnly, true, true},
+		{"", false, false}, // rows read before the column existed
+	}
+	for _, c := range cases {
+		host := models.Host{SshUser: "ubuntu", UpdatePolicy: c.policy}
+		cmd, _ := DefaultCommands.HostCommand(host, c.securityOnly, "")
+		gotSecurity := strings.Contains(cmd, "unattended-upgrade -v")
+		gotFull := strings.Contains(cmd, "-y upgrade")
+		if gotSecurity != c.wantSecurity || gotFull == c.wantSecurity {
+			t.Errorf("policy %q, security_only=%v: got\n%s", c.policy, c.securityOnly, cmd)
+		}
+	}
+}
+
+func TestPlanPhases(t *testing.T) {
+	cases := []struct {
+		policy        Policy
+		n, canary, bs int
+		want          []phaseSpan
+	}{
+		{PolicyParallel, 4, 0, 5, []phaseSpan{{phaseAll, 0, 4}}},
+		{PolicyCanary, 4, 0, 5, []phaseSpan{{phaseCanary, 0, 1}, {phaseRemainder, 1, 4}}},
+		{PolicyCanary, 4, 2, 5, []phaseSpan{{phaseCanary, 0, 2}, {phaseRemainder, 2, 4}}},
+		{PolicyCanary, 2, 5, 5, []phaseSpan{{phaseCanary, 0, 2}}},
+		{PolicyRolling, 5, 0, 2, []phaseSpan{{phaseBatch, 0, 2}, {phaseBatch, 2, 4}, {phaseBatch, 4, 5}}},
+	}
+	for _, c := range cases {
+		if got := planPhases(c.policy, c.n, c.canary, c.bs); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("planPhases(%s, %d, %d, %d) = %+v, want %+v", c.policy, c.n, c.canary, c.bs, got, c.want)
+		}
+	}
+	if got := resolvePolicy(BulkRunOptions{CanaryCount: 1}); got != PolicyCanary {
+		t.Errorf("canary_count without a policy resolved to %q", got)
+	}
+}
+
+// expectPhase expects recordPhase's write for one phase.
+func expectPhase(mock pgxmock.PgxPoolIface, phase int, status models.RunPhaseStatus, succeeded, failed int, note string) {
+	mock.ExpectExec(`UPDATE run_group_phases`).
+		WithArgs("g", phase, status, succeeded, failed, note).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+}
+
+// expectSkipped expects markFailed for a run the rollout never reached.
+func expectSkipped(mock pgxmock.PgxPoolIface, runID int32, reason string) {
+	mock.ExpectExec(`UPDATE update_runs\s+SET output`).
+		WithArgs(runID, "skipped: "+reason+"\n", db.MaxRunOutputBytes, db.RunOutputTruncatedMarker).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectExec(`UPDATE update_runs\s+SET status`).
+		WithArgs(runID, models.RunStatusFailed, pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+}
+
+// runStub records which hosts a rollout ran and fails the ones in fail.
+func runStub(fail ...int32) (func(context.Context, BulkRunOptions, int32, int32) bool, func() []int32) {
+	var (
+		mu  sync.Mutex
+		ran []int32
+	)
+	run := func(_ context.Context, _ BulkRunOptions, hostID, _ int32) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, hostID)
+		return !slices.Contains(fail, hostID)
+	}
+	return run, func() []int32 {
+		mu.Lock()
+		defer mu.Unlock()
+		slices.Sort(ran)
+		return ran
+	}
+}
+
+// A canary failure stops the rollout after the sample: the rest are marked
+// failed without being run, and the phases say why.
+func TestRun_CanaryFailureStopsAfterSample(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	run, ran := runStub(2)
+	c := &Coordinator{DB: mock, inFlightGroups: map[string]struct{}{"g": {}}, runHost: run,
+		checkHost: func(context.Context, int32) error {
+			t.Error("health check run after a failed canary")
+			return nil
+		}}
+	opts := BulkRunOptions{HostIDs: []int32{1, 2, 3, 4}, Policy: PolicyCanary, CanaryCount: 2, CanaryWaitSeconds: 60}
+
+	reason := "1 of 2 canary hosts failed"
+	expectPhase(mock, 1, models.RunPhaseRunning, 0, 0, "")
+	expectPhase(mock, 1, models.RunPhaseHalted, 1, 1, reason)
+	expectSkipped(mock, 13, reason)
+	expectSkipped(mock, 14, reason)
+	expectPhase(mock, 2, models.RunPhaseSkipped, 0, 0, "skipped: "+reason)
+
+	c.run(opts, "g", []int32{11, 12, 13, 14}, 2, planPhases(PolicyCanary, 4, 2, 2))
+	if got := ran(); !reflect.DeepEqual(got, []int32{1, 2}) {
+		t.Errorf("ran hosts %v, want only the canaries [1 2]", got)
+	}
+	if c.InFlightCount() != 0 {
+		t.Error("group still in flight")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// A canary whose update succeeded but that no longer answers fails the gate
+// too.
+func TestRun_CanaryHealthCheckGatesRemainder(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	run, ran := runStub()
+	c := &Coordinator{DB: mock, inFlightGroups: map[string]struct{}{}, runHost: run,
+		checkHost: func(context.Context, int32) error { return errors.New("connection refused") }}
+	opts := BulkRunOptions{HostIDs: []int32{1, 2, 3}, Policy: PolicyCanary}
+
+	reason := "1 of 1 canary hosts failed"
+	expectPhase(mock, 1, models.RunPhaseRunning, 0, 0, "")
+	expectPhase(mock, 1, models.RunPhaseHalted, 0, 1, "host 1 failed its health check: connection refused; "+reason)
+	expectSkipped(mock, 12, reason)
+	expectSkipped(mock, 13, reason)
+	expectPhase(mock, 2, models.RunPhaseSkipped, 0, 0, "skipped: "+reason)
+
+	c.run(opts, "g", []int32{11, 12, 13}, 2, planPhases(PolicyCanary, 3, 0, 2))
+	if got := ran(); !reflect.DeepEqual(got, []int32{1}) {
+		t.Errorf("ran hosts %v, want [1]", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// A rolling run goes batch by batch and stops between batches once the
+// failure rate reaches the threshold.
+func TestRun_RollingStopsAtThreshold(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	run, ran := runStub(3, 4)
+	c := &Coordinator{DB: mock, inFlightGroups: map[string]struct{}{}, runHost: run}
+	opts := BulkRunOptions{HostIDs: []int32{1, 2, 3, 4, 5, 6}, Policy: PolicyRolling, BatchSize: 2, AbortOnFailurePct: 50}
+
+	reason := "failure rate 50% exceeded threshold 50%"
+	expectPhase(mock, 1, models.RunPhaseRunning, 0, 0, "")
+	expectPhase(mock, 1, models.RunPhaseCompleted, 2, 0, "")
+	expectPhase(mock, 2, models.RunPhaseRunning, 0, 0, "")
+	expectPhase(mock, 2, models.RunPhaseHalted, 0, 2, reason)
+	expectSkipped(mock, 15, reason)
+	expectSkipped(mock, 16, reason)
+	expectPhase(mock, 3, models.RunPhaseSkipped, 0, 0, "skipped: "+reason)
+
+	c.run(opts, "g", []int32{11, 12, 13, 14, 15, 16}, 2, planPhases(PolicyRolling, 6, 0, 2))
+	if got := ran(); !reflect.DeepEqual(got, []int32{1, 2, 3, 4}) {
+		t.Errorf("ran hosts %v, want [1 2 3 4]", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// A parallel run is a single phase, so its threshold is checked before
+// each host starts: once the hosts finished so far reach it, no more start.
+func TestRun_ParallelStopsAtThreshold(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	run, ran := runStub(2)
+	c := &Coordinator{DB: mock, inFlightGroups: map[string]struct{}{}, runHost: run}
+	opts := BulkRunOptions{HostIDs: []int32{1, 2, 3, 4}, AbortOnFailurePct: 50}
+
+	reason := "failure rate 50% exceeded threshold 50%"
+	expectPhase(mock, 1, models.RunPhaseRunning, 0, 0, "")
+	expectPhase(mock, 1, models.RunPhaseHalted, 1, 1, reason)
+	expectSkipped(mock, 13, reason)
+	expectSkipped(mock, 14, reason)
+
+	// One at a time, so host 2 has finished before host 3 would start.
+	c.run(opts, "g", []int32{11, 12, 13, 14}, 1, planPhases(PolicyParallel, 4, 0, 1))
+	if got := ran(); !reflect.DeepEqual(got, []int32{1, 2}) {
+		t.Errorf("ran hosts %v, want [1 2]", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// updateServer is an SSH server on 127.0.0.1 that accepts any key, answers
+// every exec with output and exit 0, and records the commands it ran.
+type updateServer struct {
+	addr    string
+	hostKey gossh.PublicKey
+	mu      sync.Mutex
+	cmds    []string
+}
+
+func newUpdateServer(t *testing.T, output string) *updateServer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &gossh.ServerConfig{
+		PublicKeyCallback: func(gossh.ConnMetadata, gossh.PublicKey) (*gossh.Permissions, error) {
+			return &gossh.Permissions{}, nil
+		},
+	}
+	cfg.AddHostKey(signer)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &updateServer{addr: ln.Addr().String(), hostKey: signer.PublicKey()}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := gossh.NewServerConn(conn, cfg)
+				if err != nil {
+					return
+				}
+				go gossh.DiscardRequests(reqs)
+				for nc := range chans {
+					ch, chReqs, err := nc.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer ch.Close()
+						for req := range chReqs {
+							if req.Type != "exec" {
+								_ = req.Reply(false, nil)
+								continue
+							}
+							var payload struct{ Command string }
+							if err := gossh.Unmarshal(req.Payload, &payload); err != nil {
+								_ = req.Reply(false, nil)
+								return
+							}
+							_ = req.Reply(true, nil)
+							s.mu.Lock()
+							s.cmds = append(s.cmds, payload.Command)
+							s.mu.Unlock()
+							_, _ = io.WriteString(ch, output)
+							_, _ = ch.SendRequest("exit-status", false, binary.BigEndian.AppendUint32(nil, 0))
+							return
+						}
+					}()
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *updateServer) commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.cmds)
+}
+
+var hostCols = []string{"id", "hostname", "ssh_user", "created_at", "updated_at", "last_seen", "update_output", "upgrade_output", "error", "tags", "reboot_required", "packages_updated", "packages_available", "os_version", "kernel_version", "agent_version", "architecture", "offline_since", "update_output_truncated", "upgrade_output_truncated", "update_policy", "deleted_at", "environment"}
+
+// A bulk update fans out to every selected host over SSH: two mock servers
+// each get the update command, and both runs finish succeeded with the
+// server's output on them and the packages it kept back, parsed from the
+// output as it streamed.
+func TestRun_UpdatesEveryHostOverSSH(t *testing.T) {
+	t.Setenv("ENCRYPTION_KEY", strings.Repeat("00", 32))
+	const output = "Reading package lists... Done\n" + UpgradeMarker + "\n" +
+		"The following packages have been kept back:\n  linux-generic\n0 upgraded, 0 newly installed\n"
+	servers := []*updateServer{newUpdateServer(t, output), newUpdateServer(t, output)}
+
+	var known []string
+	for _, srv := range servers {
+		known = append(known, knownhosts.Line([]string{srv.addr}, srv.hostKey))
+	}
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(knownHosts, []byte(strings.Join(known, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOST_KEY_STORE", "file")
+	t.Setenv("KNOWN_HOSTS_FILE", knownHosts)
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := gossh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encKey, err := crypto.Encrypt(string(pem.EncodeToMemory(block)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	// The hosts run concurrently, so their queries interleave.
+	mock.MatchExpectationsInOrder(false)
+
+	cmd, _ := DefaultCommands.Command("root", false, "")
+	now := time.Now()
+	expectPhase(mock, 1, models.RunPhaseRunning, 0, 0, "")
+	for i, srv := range servers {
+		hostID, runID := int32(i+1), int32(i+11)
+		mock.ExpectQuery(`SELECT .+ FROM hosts WHERE id = \$1`).WithArgs(hostID).
+			WillReturnRows(mock.NewRows(hostCols).
+				AddRow(hostID, srv.addr, "root", now, now, now, "", "", nil, []string{}, false, 0, 0, "", "", "", "", nil, false, false, "all", nil, ""))
+		mock.ExpectQuery(`SELECT id, host_id, private_key FROM ssh_keys`).WithArgs(hostID).
+			WillReturnRows(mock.NewRows([]string{"id", "host_id", "private_key"}).AddRow(hostID, hostID, encKey))
+		mock.ExpectQuery(`SELECT password FROM host_sudo_passwords`).WithArgs(hostID).
+			WillReturnRows(mock.NewRows([]string{"password"}))
+		for _, chunk := range []string{"$ " + cmd + "\n", output} {
+			mock.ExpectExec(`UPDATE update_runs\s+SET output`).
+				WithArgs(runID, chunk, db.MaxRunOutputBytes, db.RunOutputTruncatedMarker).
+				WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		}
+		mock.ExpectExec(`UPDATE update_runs SET kept_back`).WithArgs(runID, []string{"linux-generic"}).
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+		mock.ExpectExec(`UPDATE update_runs\s+SET status`).
+			WithArgs(runID, models.RunStatusSucceeded, sql.NullInt32{Int32: 0, Valid: true}, sql.NullString{}).
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	}
+	expectPhase(mock, 1, models.RunPhaseCompleted, 2, 0, "")
+
+	c := New(mock, sshpkg.NewDialer(mock))
+	opts := BulkRunOptions{HostIDs: []int32{1, 2}, Kind: models.RunKindUpdate, TriggeredBy: "alice"}
+	c.run(opts, "g", []int32{11, 12}, 2, planPhases(PolicyParallel, 2, 0, 2))
+
+	for i, srv := range servers {
+		if got := srv.commands(); len(got) != 1 || got[0] != cmd {
+			t.Errorf("server %d ran %q, want the update command once", i+1, got)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
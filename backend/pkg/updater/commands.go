@@ -0,0 +1,186 @@
+package updater
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+// Default command templates: Ubuntu's apt-get with the dpkg prompts
+// neutralized, and unattended-upgrade for security-only runs.
+const (
+	DefaultCheckTemplate = `{{.SudoPrefix}}` + aptNoninteractive + `update`
+	DefaultApplyTemplate = `{{if .SecurityOnly}}{{.SudoPrefix}}unattended-upgrade -v` +
+		`{{else}}{{.SudoPrefix}}` + aptNoninteractive + `upgrade{{end}}`
+)
+
+// aptNoninteractive neutralizes the most common dpkg prompts during upgrades.
+const aptNoninteractive = `DEBIAN_FRONTEND=noninteractive ` +
+	`apt-get -o Dpkg::Options::="--force-confdef" -o Dpkg::Options::="--force-confold" -y `
+
+// CommandVars is what a command template can reference. It deliberately
+// carries nothing taken from the host row, so no API-supplied value ever
+// lands in the shell line.
+type CommandVars struct {
+	// SudoPrefix is "sudo -n " when the run's SSH user isn't root, else "".
+	SudoPrefix string
+	// SecurityOnly is set when the run asked for, or the host's update
+	// policy is, security updates only.
+	SecurityOnly bool
+}
+
+// CommandTemplate is the pair of shell commands an update run is built
+// from: check refreshes the package lists, apply installs the upgrades. The
+// run chains them with && around UpgradeMarker, so a failed check skips the
+// apply and the output can be split back into the two.
+//
+// The only inputs are the two CommandVars fields, so ParseCommandTemplate
+// renders every combination up front; a template that parses is known to
+// render cleanly for any host.
+type CommandTemplate struct {
+	check, apply [2][2]string // [sudo][securityOnly]
+}
+
+// DefaultCommands is the template used when none is configured; nil
+// *CommandTemplate receivers fall back to it.
+var DefaultCommands = mustParseCommandTemplate(DefaultCheckTemplate, DefaultApplyTemplate)
+
+func mustParseCommandTemplate(check, apply string) *CommandTemplate {
+	t, err := ParseCommandTemplate(check, apply)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// ParseCommandTemplate parses check and apply as text/template strings
+// over CommandVars; an empty string keeps that phase's default. Every
+// rendering must pass validateCommand.
+func ParseCommandTemplate(check, apply string) (*CommandTemplate, error) {
+	if check == "" {
+		check = DefaultCheckTemplate
+	}
+	if apply == "" {
+		apply = DefaultApplyTemplate
+	}
+	t := &CommandTemplate{}
+	for _, phase := range []struct {
+		name string
+		src  string
+		out  *[2][2]string
+	}{
+		{"check", check, &t.check},
+		{"apply", apply, &t.apply},
+	} {
+		tmpl, err := template.New(phase.name).Option("missingkey=error").Parse(phase.src)
+		if err != nil {
+			return nil, fmt.Errorf("%s template: %w", phase.name, err)
+		}
+		for sudo, prefix := range []string{"", "sudo -n "} {
+			for sec, securityOnly := range []bool{false, true} {
+				var buf bytes.Buffer
+				if err := tmpl.Execute(&buf, CommandVars{SudoPrefix: prefix, SecurityOnly: securityOnly}); err != nil {
+					return nil, fmt.Errorf("%s template: %w", phase.name, err)
+				}
+				cmd := strings.TrimSpace(buf.String())
+				if err := validateCommand(cmd); err != nil {
+					return nil, fmt.Errorf("%s template (sudo=%v, security_only=%v): %w", phase.name, sudo == 1, securityOnly, err)
+				}
+				phase.out[sudo][sec] = cmd
+			}
+		}
+	}
+	return t, nil
+}
+
+// validateCommand rejects renderings that would change how the run chains
+// its steps rather than just what a step runs: a second line or a `;`, `||`
+// or `#` would let a failed check fall through to the apply (or hide the
+// apply entirely), a lone `&` backgrounds the step so its result is lost,
+// and command substitution runs something the template doesn't spell out.
+// `&&` and pipes are fine; the script runs under pipefail.
+func validateCommand(cmd string) error {
+	if cmd == "" {
+		return errors.New("renders to an empty command")
+	}
+	for _, r := range cmd {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("contains control character %U", r)
+		}
+	}
+	for _, bad := range []string{";", "||", "#", "`", "$("} {
+		if strings.Contains(cmd, bad) {
+			return fmt.Errorf("contains %q", bad)
+		}
+	}
+	if strings.Contains(strings.ReplaceAll(cmd, "&&", ""), "&") {
+		return errors.New(`contains a lone "&"`)
+	}
+	return nil
+}
+
+// Steps returns the check and apply commands for sshUser.
+func (t *CommandTemplate) Steps(sshUser string, securityOnly bool) (check, apply string) {
+	if t == nil {
+		t = DefaultCommands
+	}
+	sudo, sec := 0, 0
+	if sshUser != "" && sshUser != "root" {
+		sudo = 1
+	}
+	if securityOnly {
+		sec = 1
+	}
+	return t.check[sudo][sec], t.apply[sudo][sec]
+}
+
+// Script returns the shell line for an update run — the single source
+// shared by the bulk coordinator and the single-host engine in cmd/api.
+// Non-root users get `sudo -n` through SudoPrefix, so with the default
+// template a missing passwordless sudo fails fast instead of hanging on a
+// password prompt.
+func (t *CommandTemplate) Script(sshUser string, securityOnly bool) string {
+	check, apply := t.Steps(sshUser, securityOnly)
+	banner := "update"
+	if securityOnly {
+		banner = "security-only update"
+	}
+	return "set -o pipefail; " +
+		"echo '== ubuntu-auto-update: " + banner + " =='; " +
+		check + " && " +
+		"echo '" + UpgradeMarker + "' && " +
+		apply
+}
+
+// Command is Script for a host that may need a sudo password. Without one
+// (or as root) it returns Script's line and no stdin. With one, the root
+// version of the script runs under a single `sudo -S` that reads the
+// password from stdin — once, so the check and apply steps don't each need
+// it, and never on the command line where ps or the run log would show it.
+//
+// sudo only reads the password when it prompts. When `sudo -n true` shows
+// it won't (NOPASSWD, or credentials cached from an earlier run), the
+// script runs under `sudo -n` with stdin from /dev/null instead, so the
+// unread password can't reach whatever in the script reads stdin.
+func (t *CommandTemplate) Command(sshUser string, securityOnly bool, sudoPassword string) (cmd, stdin string) {
+	if sudoPassword == "" || sshUser == "" || sshUser == "root" {
+		return t.Script(sshUser, securityOnly), ""
+	}
+	script := "'" + strings.ReplaceAll(t.Script("root", securityOnly), "'", `'\''`) + "'"
+	return "if sudo -n true 2>/dev/null; then sudo -n bash -c " + script + " </dev/null; " +
+		"else sudo -S -p '' bash -c " + script + "; fi", sudoPassword + "\n"
+}
+
+// HostCommand is Command with the host's update policy applied: a
+// security_only host gets the security-only script even when the run asked
+// for everything. securityOnly can narrow an "all" host, never widen a
+// security_only one.
+func (t *CommandTemplate) HostCommand(host models.Host, securityOnly bool, sudoPassword string) (cmd, stdin string) {
+	securityOnly = securityOnly || host.UpdatePolicy == models.UpdatePolicySecurityOnly
+	return t.Command(host.SshUser, securityOnly, sudoPassword)
+}
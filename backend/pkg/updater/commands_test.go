@@ -0,0 +1,133 @@
+package updater
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCommandTemplate_Renders(t *testing.T) {
+	tmpl, err := ParseCommandTemplate(
+		"{{.SudoPrefix}}apt update",
+		"{{.SudoPrefix}}{{if .SecurityOnly}}/usr/local/bin/patch --security{{else}}apt full-upgrade -y{{end}}",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		user         string
+		securityOnly bool
+		check, apply string
+	}{
+		{"root", false, "apt update", "apt full-upgrade -y"},
+		{"root", true, "apt update", "/usr/local/bin/patch --security"},
+		{"ubuntu", false, "sudo -n apt update", "sudo -n apt full-upgrade -y"},
+		{"ubuntu", true, "sudo -n apt update", "sudo -n /usr/local/bin/patch --security"},
+		{"", false, "apt update", "apt full-upgrade -y"},
+	}
+	for _, c := range cases {
+		check, apply := tmpl.Steps(c.user, c.securityOnly)
+		if check != c.check || apply != c.apply {
+			t.Errorf("Steps(%q, %v) = %q, %q; want %q, %q", c.user, c.securityOnly, check, apply, c.check, c.apply)
+		}
+	}
+
+	want := "set -o pipefail; echo '== ubuntu-auto-update: update =='; " +
+		"sudo -n apt update && echo '" + UpgradeMarker + "' && sudo -n apt full-upgrade -y"
+	if got := tmpl.Script("ubuntu", false); got != want {
+		t.Errorf("Script:\n got %s\nwant %s", got, want)
+	}
+	cmd, stdin := tmpl.Command("ubuntu", false, "pw")
+	if stdin != "pw\n" || !strings.Contains(cmd, "apt update && ") || strings.Contains(cmd, "sudo -n apt") {
+		t.Errorf("with sudo password: stdin %q cmd:\n%s", stdin, cmd)
+	}
+}
+
+// fakeSudo stands in for sudo: -n fails unless FAKE_NOPASSWD=1, and -S
+// reads a password line first unless FAKE_NOPASSWD=1, as the real one does.
+const fakeSudo = `#!/bin/sh
+case "$1" in
+-n) [ "$FAKE_NOPASSWD" = 1 ] || exit 1; shift; exec "$@" ;;
+-S) [ "$FAKE_NOPASSWD" = 1 ] || { read -r pw; [ "$pw" = pw ] || exit 1; }; shift 3; exec "$@" ;;
+esac
+exit 1
+`
+
+// The password goes to sudo only when sudo would prompt for it. With
+// NOPASSWD it stays unread, and must not reach a step that reads stdin.
+func TestCommand_PasswordOnlyWhenSudoPrompts(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "sudo"), []byte(fakeSudo), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := ParseCommandTemplate("true", "cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, stdin := tmpl.Command("ubuntu", false, "pw")
+
+	for _, nopasswd := range []string{"1", "0"} {
+		c := exec.Command("bash", "-c", cmd)
+		c.Env = append(os.Environ(), "PATH="+dir+":"+os.Getenv("PATH"), "FAKE_NOPASSWD="+nopasswd)
+		c.Stdin = strings.NewReader(stdin)
+		out, err := c.CombinedOutput()
+		if err != nil {
+			t.Fatalf("FAKE_NOPASSWD=%s: %v\n%s", nopasswd, err, out)
+		}
+		if !strings.Contains(string(out), UpgradeMarker) {
+			t.Errorf("FAKE_NOPASSWD=%s: script didn't run:\n%s", nopasswd, out)
+		}
+		if strings.Contains(string(out), "pw") {
+			t.Errorf("FAKE_NOPASSWD=%s: password reached the script:\n%s", nopasswd, out)
+		}
+	}
+}
+
+// An empty phase keeps its default; a nil template is the default.
+func TestParseCommandTemplate_Defaults(t *testing.T) {
+	tmpl, err := ParseCommandTemplate("", "/opt/upgrade.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check, apply := tmpl.Steps("root", false)
+	defCheck, _ := DefaultCommands.Steps("root", false)
+	if check != defCheck || apply != "/opt/upgrade.sh" {
+		t.Errorf("got %q, %q", check, apply)
+	}
+
+	var none *CommandTemplate
+	if got, want := none.Script("ubuntu", true), DefaultCommands.Script("ubuntu", true); got != want {
+		t.Errorf("nil template:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestParseCommandTemplate_Rejects(t *testing.T) {
+	cases := []struct {
+		name, check, apply string
+	}{
+		{"bad syntax", "{{.SudoPrefix", ""},
+		{"unknown variable", "{{.Hostname}} apt update", ""},
+		{"empty rendering", "{{if .SecurityOnly}}apt update{{end}}", ""},
+		{"semicolon", "apt update; true", ""},
+		{"or", "apt update || true", ""},
+		{"newline", "apt update\napt upgrade -y", ""},
+		{"comment", "apt update # refresh", ""},
+		{"background", "", "apt upgrade -y &"},
+		{"backticks", "", "apt install `cat list`"},
+		{"command substitution", "", "apt install $(cat list)"},
+	}
+	for _, c := range cases {
+		if _, err := ParseCommandTemplate(c.check, c.apply); err == nil {
+			t.Errorf("%s: accepted %q / %q", c.name, c.check, c.apply)
+		}
+	}
+
+	if _, err := ParseCommandTemplate("apt-get update && apt-get autoremove -y", "apt-get upgrade -y | tee /var/log/uau.log"); err != nil {
+		t.Errorf("&& and pipes should be allowed: %v", err)
+	}
+}
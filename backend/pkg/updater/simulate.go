@@ -0,0 +1,145 @@
+package updater
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// SimulateMarker opens the output of a simulated update run.
+const SimulateMarker = "== ubuntu-auto-update: simulate =="
+
+// SimulateCommands is what a simulated update run executes: apt-get's
+// simulate mode, which needs no root and changes nothing on the host. It
+// works from the package lists as they are, since refreshing them would
+// need root. LC_ALL=C pins the English output ParseSimulateOutput reads.
+var SimulateCommands = []string{
+	"echo '" + SimulateMarker + "'",
+	"LC_ALL=C apt-get -s upgrade",
+}
+
+// PlannedPackage is one package a simulated upgrade would touch. From is
+// empty for a new install and To for a removal.
+type PlannedPackage struct {
+	Name string `json:"name"`
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// SimulatePlan is what `apt-get -s upgrade` says a real run would do.
+type SimulatePlan struct {
+	Upgraded    int              `json:"upgraded"`
+	Installed   int              `json:"installed"`
+	Removed     int              `json:"removed"`
+	NotUpgraded int              `json:"not_upgraded"`
+	Upgrade     []PlannedPackage `json:"upgrade"`
+	Install     []PlannedPackage `json:"install"`
+	Remove      []PlannedPackage `json:"remove"`
+	KeptBack    []string         `json:"kept_back"`
+}
+
+// aptSummaryRe matches apt's "N upgraded, N newly installed, N to remove
+// and N not upgraded." line.
+var aptSummaryRe = regexp.MustCompile(`^(\d+) upgraded, (\d+) newly installed, (\d+) to remove and (\d+) not upgraded`)
+
+// ParseSimulateOutput builds a plan from `apt-get -s` output. Each change
+// comes from its action line:
+//
+//	Inst curl [7.81.0-1ubuntu1.15] (7.81.0-1ubuntu1.16 Ubuntu:22.04/jammy-updates [amd64])
+//	Inst libnew1 (1.2-1 Ubuntu:22.04/jammy [amd64])
+//	Remv oldpkg [0.9-3]
+//
+// An Inst with a current version in brackets is an upgrade, one without is
+// a new install. Conf lines repeat the Inst ones and are skipped. The
+// counts are those lines' totals; NotUpgraded (packages kept back) only
+// appears in apt's summary line, and KeptBack names them.
+func ParseSimulateOutput(out string) SimulatePlan {
+	plan := SimulatePlan{Upgrade: []PlannedPackage{}, Install: []PlannedPackage{}, Remove: []PlannedPackage{}}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if m := aptSummaryRe.FindStringSubmatch(line); m != nil {
+			plan.NotUpgraded, _ = strconv.Atoi(m[4])
+			continue
+		}
+		action, rest, ok := strings.Cut(line, " ")
+		if !ok || (action != "Inst" && action != "Remv") {
+			continue
+		}
+		name, rest, _ := strings.Cut(rest, " ")
+		if name == "" {
+			continue
+		}
+		pkg := PlannedPackage{Name: name}
+		if cur, after, ok := bracketed(rest, '[', ']'); ok {
+			pkg.From, rest = cur, after
+		}
+		if action == "Remv" {
+			plan.Remove = append(plan.Remove, pkg)
+			continue
+		}
+		if cand, _, ok := bracketed(rest, '(', ')'); ok {
+			pkg.To, _, _ = strings.Cut(cand, " ")
+		}
+		if pkg.From != "" {
+			plan.Upgrade = append(plan.Upgrade, pkg)
+		} else {
+			plan.Install = append(plan.Install, pkg)
+		}
+	}
+	plan.Upgraded, plan.Installed, plan.Removed = len(plan.Upgrade), len(plan.Install), len(plan.Remove)
+	plan.KeptBack = ParseKeptBack(out)
+	return plan
+}
+
+// keptBackHeader opens apt's list of packages an upgrade left alone, usually
+// because upgrading them would install or remove other packages.
+const keptBackHeader = "The following packages have been kept back:"
+
+// ParseKeptBack returns the packages apt-get upgrade (real or simulated)
+// reports as kept back, in apt's order, from the indented lines under
+// keptBackHeader:
+//
+//	The following packages have been kept back:
+//	  linux-generic linux-headers-generic
+//	  linux-image-generic
+//
+// The list ends at the first line that isn't indented. The result is empty,
+// never nil, when there is no such section.
+func ParseKeptBack(out string) []string {
+	pkgs := []string{}
+	in := false
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == keptBackHeader {
+			in = true
+			continue
+		}
+		if !in {
+			continue
+		}
+		if line == "" || (line[0] != ' ' && line[0] != '\t') {
+			in = false
+			continue
+		}
+		for _, name := range strings.Fields(line) {
+			if !slices.Contains(pkgs, name) {
+				pkgs = append(pkgs, name)
+			}
+		}
+	}
+	return pkgs
+}
+
+// bracketed returns the text inside s's leading open…close pair and what
+// follows it.
+func bracketed(s string, open, close byte) (inside, after string, ok bool) {
+	if len(s) == 0 || s[0] != open {
+		return "", s, false
+	}
+	end := strings.IndexByte(s, close)
+	if end < 0 {
+		return "", s, false
+	}
+	return s[1:end], strings.TrimSpace(s[end+1:]), true
+}
@@ -0,0 +1,87 @@
+package updater
+
+import (
+	"reflect"
+	"testing"
+)
+
+const aptSimulateOutput = `== ubuntu-auto-update: simulate ==
+NOTE: This is only a simulation!
+      apt-get needs root privileges for real execution.
+      Keep also in mind that locking is deactivated,
+      so don't depend on the relevance to the real current situation!
+Reading package lists...
+Building dependency tree...
+Reading state information...
+Calculating upgrade...
+The following packages were automatically installed and are no longer required:
+  libfoo0
+The following packages will be REMOVED:
+  python3-oldlib
+The following NEW packages will be installed:
+  linux-image-6.8.0-49-generic
+The following packages have been kept back:
+  linux-generic linux-headers-generic
+The following packages will be upgraded:
+  curl libcurl4
+2 upgraded, 1 newly installed, 1 to remove and 2 not upgraded.
+Remv python3-oldlib [2.1-1]
+Inst libcurl4 [7.81.0-1ubuntu1.15] (7.81.0-1ubuntu1.16 Ubuntu:22.04/jammy-updates [amd64]) []
+Inst curl [7.81.0-1ubuntu1.15] (7.81.0-1ubuntu1.16 Ubuntu:22.04/jammy-updates [amd64])
+Inst linux-image-6.8.0-49-generic (6.8.0-49.49~22.04.1 Ubuntu:22.04/jammy-updates [amd64])
+Conf libcurl4 (7.81.0-1ubuntu1.16 Ubuntu:22.04/jammy-updates [amd64])
+Conf curl (7.81.0-1ubuntu1.16 Ubuntu:22.04/jammy-updates [amd64])
+Conf linux-image-6.8.0-49-generic (6.8.0-49.49~22.04.1 Ubuntu:22.04/jammy-updates [amd64])
+`
+
+func TestParseSimulateOutput(t *testing.T) {
+	got := ParseSimulateOutput(aptSimulateOutput)
+	want := SimulatePlan{
+		Upgraded: 2, Installed: 1, Removed: 1, NotUpgraded: 2,
+		Upgrade: []PlannedPackage{
+			{Name: "libcurl4", From: "7.81.0-1ubuntu1.15", To: "7.81.0-1ubuntu1.16"},
+			{Name: "curl", From: "7.81.0-1ubuntu1.15", To: "7.81.0-1ubuntu1.16"},
+		},
+		Install:  []PlannedPackage{{Name: "linux-image-6.8.0-49-generic", To: "6.8.0-49.49~22.04.1"}},
+		Remove:   []PlannedPackage{{Name: "python3-oldlib", From: "2.1-1"}},
+		KeptBack: []string{"linux-generic", "linux-headers-generic"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %+v\nwant %+v", got, want)
+	}
+}
+
+// A host with nothing to do yields an empty plan with non-nil lists, so the
+// JSON has [] rather than null.
+func TestParseSimulateOutput_NothingToDo(t *testing.T) {
+	got := ParseSimulateOutput("Reading package lists...\nCalculating upgrade...\n0 upgraded, 0 newly installed, 0 to remove and 0 not upgraded.\n")
+	want := SimulatePlan{Upgrade: []PlannedPackage{}, Install: []PlannedPackage{}, Remove: []PlannedPackage{}, KeptBack: []string{}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v", got)
+	}
+}
+
+// A real upgrade's output, as split after UpgradeMarker: the kept-back list
+// wraps over several lines and ends where the next section starts.
+func TestParseKeptBack(t *testing.T) {
+	out := "$ sudo -n DEBIAN_FRONTEND=noninteractive apt-get -y upgrade\n" +
+		"Reading package lists...\n" +
+		"Building dependency tree...\n" +
+		"Reading state information...\n" +
+		"Calculating upgrade...\n" +
+		"The following packages have been kept back:\r\n" +
+		"  linux-generic linux-headers-generic linux-image-generic\r\n" +
+		"  ubuntu-advantage-tools\n" +
+		"The following packages will be upgraded:\n" +
+		"  curl libcurl4\n" +
+		"2 upgraded, 0 newly installed, 0 to remove and 4 not upgraded.\n" +
+		"Setting up curl (7.81.0-1ubuntu1.16) ...\n"
+	want := []string{"linux-generic", "linux-headers-generic", "linux-image-generic", "ubuntu-advantage-tools"}
+	if got := ParseKeptBack(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got := ParseKeptBack("0 upgraded, 0 newly installed, 0 to remove and 0 not upgraded.\n"); got == nil || len(got) != 0 {
+		t.Errorf("nothing kept back: got %#v", got)
+	}
+}
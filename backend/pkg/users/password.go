@@ -0,0 +1,80 @@
+package users
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MinPasswordLength is the floor no policy can go below; HashPassword
+// enforces it even for callers that skip ValidatePassword.
+const MinPasswordLength = 12
+
+// maxPasswordBytes is bcrypt's input limit. Longer passwords would fail to
+// hash rather than be silently truncated, so they are refused up front.
+const maxPasswordBytes = 72
+
+// PasswordPolicy is what ValidatePassword checks. main builds it from
+// PASSWORD_MIN_LENGTH and REQUIRE_STRONG_PASSWORDS.
+type PasswordPolicy struct {
+	MinLength int // characters; raised to MinPasswordLength if lower
+	// RequireStrong additionally demands a lowercase letter, an uppercase
+	// letter, a digit and a symbol.
+	RequireStrong bool
+}
+
+// PasswordError lists every rule a password failed, so the user can fix
+// them all at once.
+type PasswordError struct {
+	Failed []string
+}
+
+func (e *PasswordError) Error() string {
+	return "password must contain " + strings.Join(e.Failed, ", ")
+}
+
+// ValidatePassword checks pw against p and returns a *PasswordError naming
+// the failed rules, or nil.
+func ValidatePassword(p PasswordPolicy, pw string) error {
+	minLen := max(p.MinLength, MinPasswordLength)
+	var failed []string
+	if utf8.RuneCountInString(pw) < minLen {
+		failed = append(failed, fmt.Sprintf("at least %d characters", minLen))
+	}
+	if len(pw) > maxPasswordBytes {
+		failed = append(failed, fmt.Sprintf("at most %d bytes", maxPasswordBytes))
+	}
+	if p.RequireStrong {
+		var lower, upper, digit, symbol bool
+		for _, r := range pw {
+			switch {
+			case unicode.IsLower(r):
+				lower = true
+			case unicode.IsUpper(r):
+				upper = true
+			case unicode.IsDigit(r):
+				digit = true
+			case unicode.IsPunct(r) || unicode.IsSymbol(r) || r == ' ':
+				symbol = true
+			}
+		}
+		for _, c := range []struct {
+			ok   bool
+			rule string
+		}{
+			{lower, "a lowercase letter"},
+			{upper, "an uppercase letter"},
+			{digit, "a digit"},
+			{symbol, "a symbol"},
+		} {
+			if !c.ok {
+				failed = append(failed, c.rule)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return &PasswordError{Failed: failed}
+	}
+	return nil
+}
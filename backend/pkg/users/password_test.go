@@ -0,0 +1,53 @@
+package users
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidatePassword(t *testing.T) {
+	strong := PasswordPolicy{MinLength: 14, RequireStrong: true}
+	tests := []struct {
+		name   string
+		policy PasswordPolicy
+		pw     string
+		failed []string // nil = accepted
+	}{
+		{"floor applies to a zero policy", PasswordPolicy{}, "elevenchars", []string{"at least 12 characters"}},
+		{"floor met", PasswordPolicy{}, "twelve chars", nil},
+		{"policy below floor is raised", PasswordPolicy{MinLength: 6}, "short-pass", []string{"at least 12 characters"}},
+		{"configured length", PasswordPolicy{MinLength: 16}, "fifteen-chars!!", []string{"at least 16 characters"}},
+		{"length counts characters, not bytes", PasswordPolicy{}, "ééééééééééé", []string{"at least 12 characters"}},
+		{"bcrypt limit", PasswordPolicy{}, strings.Repeat("a", 73), []string{"at most 72 bytes"}},
+		{"classes ignored unless strong", PasswordPolicy{}, "alllowercaseletters", nil},
+		{"strong: all classes", strong, "Correct-Horse-9", nil},
+		{"strong: missing lowercase", strong, "CORRECT-HORSE-9", []string{"a lowercase letter"}},
+		{"strong: missing uppercase", strong, "correct-horse-9", []string{"an uppercase letter"}},
+		{"strong: missing digit", strong, "Correct-Horse-X", []string{"a digit"}},
+		{"strong: missing symbol", strong, "CorrectHorse9xy", []string{"a symbol"}},
+		{"strong: space counts as a symbol", strong, "Correct Horse 9", nil},
+		{"strong: every rule listed", strong, "abc", []string{
+			"at least 14 characters", "an uppercase letter", "a digit", "a symbol",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidatePassword(tt.policy, tt.pw)
+			if tt.failed == nil {
+				if err != nil {
+					t.Errorf("rejected: %v", err)
+				}
+				return
+			}
+			var pe *PasswordError
+			if !errors.As(err, &pe) {
+				t.Fatalf("err = %v, want a *PasswordError", err)
+			}
+			if !reflect.DeepEqual(pe.Failed, tt.failed) {
+				t.Errorf("failed rules = %q, want %q", pe.Failed, tt.failed)
+			}
+		})
+	}
+}
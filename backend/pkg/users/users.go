@@ -133,6 +133,18 @@ func List(ctx context.Context, db db.DBTX) ([]User, error) {
 	return users, nil
 }
 
+// Get returns one user by ID, or pgx.ErrNoRows.
+func Get(ctx context.Context, db db.DBTX, id int32) (User, error) {
+	rows, err := db.Query(ctx, `
+		SELECT id, username, role, disabled_at, created_at, updated_at,
+		       last_login_at, failed_logins, locked_until
+		FROM users WHERE id = $1`, id)
+	if err != nil {
+		return User{}, err
+	}
+	return pgx.CollectExactlyOneRow(rows, pgx.RowToStructByPos[User])
+}
+
 // CountUsers reports the total number of rows. Used at boot to decide whether
 // to seed the bootstrap admin account.
 func CountUsers(ctx context.Context, db db.DBTX) (int, error) {
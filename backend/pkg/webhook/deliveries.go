@@ -0,0 +1,87 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"ubuntu-auto-update/backend/pkg/db"
+)
+
+// MaxSnippetBytes caps how much of a receiver's response body is kept in
+// webhook_deliveries.
+const MaxSnippetBytes = 1024
+
+// Delivery is one attempt to deliver an event to a webhook, as logged in
+// webhook_deliveries. Each retry is its own row with the next Attempt.
+type Delivery struct {
+	ID              int64     `json:"id"`
+	WebhookID       int32     `json:"webhook_id"`
+	URL             string    `json:"url"`
+	Event           string    `json:"event"`
+	Attempt         int       `json:"attempt"`
+	StatusCode      *int      `json:"status_code"` // nil when no response arrived
+	ResponseSnippet string    `json:"response_snippet"`
+	Error           string    `json:"error,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// RecordDelivery appends d to the delivery log. The snippet is capped again
+// here so callers other than send can't bypass MaxSnippetBytes.
+func RecordDelivery(ctx context.Context, dbx db.DBTX, d Delivery) error {
+	if len(d.ResponseSnippet) > MaxSnippetBytes {
+		d.ResponseSnippet = d.ResponseSnippet[:MaxSnippetBytes]
+	}
+	_, err := dbx.Exec(ctx, `
+		INSERT INTO webhook_deliveries
+		    (webhook_id, url, event, attempt, status_code, response_snippet, error)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''))`,
+		d.WebhookID, d.URL, d.Event, d.Attempt, d.StatusCode, d.ResponseSnippet, d.Error)
+	if err != nil {
+		return fmt.Errorf("record webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// DeliveryListOptions pages through one webhook's deliveries.
+type DeliveryListOptions struct {
+	Since  time.Time // zero = no lower bound
+	Limit  int
+	Offset int
+}
+
+// ListDeliveries returns a webhook's logged attempts, newest first.
+// Defaults: limit=100, and a larger limit than 1000 is clamped to 1000.
+func ListDeliveries(ctx context.Context, dbx db.DBTX, webhookID int32, opts DeliveryListOptions) ([]Delivery, error) {
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	limit = min(limit, 1000)
+	offset := max(opts.Offset, 0)
+	var since *time.Time
+	if !opts.Since.IsZero() {
+		since = &opts.Since
+	}
+	rows, err := dbx.Query(ctx, `
+		SELECT id, webhook_id, url, event, attempt, status_code,
+		       response_snippet, COALESCE(error, ''), created_at
+		FROM webhook_deliveries
+		WHERE webhook_id = $1 AND ($2::timestamptz IS NULL OR created_at >= $2)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3 OFFSET $4`, webhookID, since, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Delivery{}
+	for rows.Next() {
+		var d Delivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.URL, &d.Event, &d.Attempt, &d.StatusCode,
+			&d.ResponseSnippet, &d.Error, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
@@ -3,9 +3,13 @@ package webhook
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	"ubuntu-auto-update/backend/pkg/db"
+	"ubuntu-auto-update/backend/pkg/models"
 )
 
 // Dispatcher fans out webhook deliveries asynchronously with bounded retries
@@ -15,6 +19,10 @@ type Dispatcher struct {
 	maxAttempts int
 	baseBackoff time.Duration
 	wg          sync.WaitGroup
+	pending     atomic.Int64
+
+	// DB receives a webhook_deliveries row per attempt. Nil skips the log.
+	DB db.DBTX
 }
 
 func NewDispatcher() *Dispatcher {
@@ -24,17 +32,38 @@ func NewDispatcher() *Dispatcher {
 	}
 }
 
-// Deliver enqueues an asynchronous delivery to url with the given payload.
-// Failures are retried up to maxAttempts times with exponential backoff;
-// final failures are logged but not surfaced to the caller.
-func (d *Dispatcher) Deliver(ctx context.Context, url string, payload interface{}) {
+// Deliver enqueues an asynchronous delivery of payload to hook, rendered in
+// the hook's format. Failures are retried up to maxAttempts times with
+// exponential backoff; final failures are logged but not surfaced to the
+// caller.
+func (d *Dispatcher) Deliver(ctx context.Context, hook models.Webhook, payload interface{}) {
+	d.deliver(ctx, hook, payload, nil)
+}
+
+// DeliverEvent delivers an event db.EmitEvent queued in the outbox. One
+// that gets through is marked delivered there; one that fails every attempt
+// stays queued for RetryOutbox.
+func (d *Dispatcher) DeliverEvent(ctx context.Context, hook models.Webhook, eventID int64, payload interface{}) {
+	d.deliver(ctx, hook, payload, func() { d.markDelivered(eventID, hook.ID) })
+}
+
+// deliver is Deliver calling delivered, when set, after a success.
+func (d *Dispatcher) deliver(ctx context.Context, hook models.Webhook, payload interface{}, delivered func()) {
+	url := hook.URL
+	payload = Render(hook.Format, hook.Event, payload)
 	d.wg.Add(1)
+	d.pending.Add(1)
 	go func() {
 		defer d.wg.Done()
+		defer d.pending.Add(-1)
 		backoff := d.baseBackoff
 		for attempt := 1; attempt <= d.maxAttempts; attempt++ {
-			err := SendWithContext(ctx, url, payload)
+			resp, err := send(ctx, url, payload)
+			d.record(hook, attempt, resp, err)
 			if err == nil {
+				if delivered != nil {
+					delivered()
+				}
 				return
 			}
 			if attempt == d.maxAttempts {
@@ -52,6 +81,38 @@ func (d *Dispatcher) Deliver(ctx context.Context, url string, payload interface{
 	}()
 }
 
+// record logs one attempt. It runs on its own short deadline: ctx may be the
+// very thing that just ended the attempt.
+func (d *Dispatcher) record(hook models.Webhook, attempt int, resp response, sendErr error) {
+	if d.DB == nil {
+		return
+	}
+	del := Delivery{
+		WebhookID:       hook.ID,
+		URL:             hook.URL,
+		Event:           hook.Event,
+		Attempt:         attempt,
+		ResponseSnippet: resp.Snippet,
+	}
+	if resp.StatusCode != 0 {
+		del.StatusCode = &resp.StatusCode
+	}
+	if sendErr != nil {
+		del.Error = sendErr.Error()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := RecordDelivery(ctx, d.DB, del); err != nil {
+		log.Errorf("webhook %d: %v", hook.ID, err)
+	}
+}
+
+// Pending reports how many deliveries are in flight, including ones waiting
+// out a retry backoff. A steadily growing value means a receiver is down.
+func (d *Dispatcher) Pending() int64 {
+	return d.pending.Load()
+}
+
 // Wait blocks until all in-flight deliveries finish (or fail terminally).
 // Use during graceful shutdown.
 func (d *Dispatcher) Wait() {
@@ -0,0 +1,141 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Payload formats a webhook can be subscribed with. Raw posts the event map
+// as-is; Slack and Teams wrap a readable summary in the message schema their
+// incoming webhooks render.
+const (
+	FormatRaw   = "raw"
+	FormatSlack = "slack"
+	FormatTeams = "teams"
+)
+
+// ValidFormat reports whether f is a format Render understands. Empty is
+// accepted and means raw.
+func ValidFormat(f string) bool {
+	switch f {
+	case "", FormatRaw, FormatSlack, FormatTeams:
+		return true
+	}
+	return false
+}
+
+// eventTitles are the headlines for known events; anything else is shown by
+// its event name.
+var eventTitles = map[string]string{
+	"update_success":   "Update succeeded",
+	"update_failure":   "Update failed",
+	"preview_success":  "Update preview finished",
+	"preview_failure":  "Update preview failed",
+	"playbook_success": "Playbook succeeded",
+	"playbook_failure": "Playbook failed",
+	"reboot_success":   "Reboot succeeded",
+	"reboot_failure":   "Reboot failed",
+	"host_registered":  "Host registered",
+	"host_enrolled":    "Host enrolled",
+	"host_offline":     "Host went offline",
+	"reboot_required":  "Reboot required",
+}
+
+// Render turns an event payload into the body posted for format.
+func Render(format, event string, payload interface{}) interface{} {
+	if format != FormatSlack && format != FormatTeams {
+		return payload
+	}
+	title, facts := Summarize(event, payload)
+	if format == FormatSlack {
+		var b strings.Builder
+		fmt.Fprintf(&b, "*%s*", slackEscape(title))
+		for _, f := range facts {
+			fmt.Fprintf(&b, "\n• %s: %s", f.Name, slackEscape(f.Value))
+		}
+		return map[string]interface{}{"text": b.String()}
+	}
+	teamsFacts := make([]map[string]string, len(facts))
+	for i, f := range facts {
+		teamsFacts[i] = map[string]string{"name": f.Name, "value": f.Value}
+	}
+	return map[string]interface{}{
+		"@type":      "MessageCard",
+		"@context":   "https://schema.org/extensions",
+		"summary":    title,
+		"title":      title,
+		"themeColor": themeColor(event),
+		"sections":   []map[string]interface{}{{"facts": teamsFacts}},
+	}
+}
+
+// Fact is one payload field, rendered for people.
+type Fact struct{ Name, Value string }
+
+// Summarize builds "Update failed on web-1" plus the remaining payload
+// fields, sorted by key so messages read the same every time. Chat formats
+// and email notifications share it.
+func Summarize(event string, payload interface{}) (string, []Fact) {
+	title, ok := eventTitles[event]
+	if !ok {
+		title = event
+	}
+	fields, _ := payload.(map[string]interface{})
+	if fields == nil && payload != nil {
+		// Structs and other maps: go through JSON to get their field names.
+		if b, err := json.Marshal(payload); err == nil {
+			_ = json.Unmarshal(b, &fields)
+		}
+	}
+	if name, ok := fields["hostname"]; ok {
+		title += " on " + valueString(name)
+	} else if id, ok := fields["host_id"]; ok {
+		title += " on host " + valueString(id)
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		if k != "hostname" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	facts := make([]Fact, len(keys))
+	for i, k := range keys {
+		facts[i] = Fact{k, valueString(fields[k])}
+	}
+	return title, facts
+}
+
+func valueString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	case fmt.Stringer:
+		return v.String()
+	}
+	if b, err := json.Marshal(v); err == nil {
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
+
+// slackEscape escapes the three characters Slack's mrkdwn treats as markup.
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+func themeColor(event string) string {
+	switch {
+	case strings.HasSuffix(event, "_failure"), event == "host_offline":
+		return "D70000"
+	case strings.HasSuffix(event, "_success"):
+		return "2EB67D"
+	}
+	return "0076D7"
+}
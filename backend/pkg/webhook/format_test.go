@@ -0,0 +1,84 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+func TestRender_SlackUpdateFailure(t *testing.T) {
+	got := Render(FormatSlack, "update_failure", map[string]interface{}{
+		"host_id": int32(12), "run_id": int32(40), "error": "apt-get exited 100 <E: dpkg was interrupted>",
+	})
+	want := map[string]interface{}{
+		"text": "*Update failed on host 12*\n" +
+			"• error: apt-get exited 100 &lt;E: dpkg was interrupted&gt;\n" +
+			"• host_id: 12\n" +
+			"• run_id: 40",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v\nwant %#v", got, want)
+	}
+}
+
+func TestRender_SlackPrefersHostname(t *testing.T) {
+	got := Render(FormatSlack, "host_offline", map[string]interface{}{"host_id": 3, "hostname": "web-1"})
+	if text := got.(map[string]interface{})["text"]; text != "*Host went offline on web-1*\n• host_id: 3" {
+		t.Errorf("text = %q", text)
+	}
+}
+
+func TestRender_Teams(t *testing.T) {
+	got := Render(FormatTeams, "update_failure", map[string]interface{}{"host_id": 12, "error": "boom"})
+	b, _ := json.Marshal(got)
+	var card struct {
+		Type     string `json:"@type"`
+		Title    string `json:"title"`
+		Color    string `json:"themeColor"`
+		Sections []struct {
+			Facts []struct{ Name, Value string } `json:"facts"`
+		} `json:"sections"`
+	}
+	if err := json.Unmarshal(b, &card); err != nil {
+		t.Fatal(err)
+	}
+	if card.Type != "MessageCard" || card.Title != "Update failed on host 12" || card.Color != "D70000" {
+		t.Errorf("card = %+v", card)
+	}
+	if len(card.Sections) != 1 || len(card.Sections[0].Facts) != 2 || card.Sections[0].Facts[0].Name != "error" {
+		t.Errorf("facts = %+v", card.Sections)
+	}
+}
+
+func TestRender_RawIsUnchanged(t *testing.T) {
+	payload := map[string]interface{}{"host_id": 1}
+	for _, f := range []string{"", FormatRaw} {
+		if got := Render(f, "update_success", payload); !reflect.DeepEqual(got, payload) {
+			t.Errorf("format %q: got %#v", f, got)
+		}
+	}
+}
+
+func TestDispatcher_SendsFormattedPayload(t *testing.T) {
+	skipSSRFCheck = true
+	defer func() { skipSSRFCheck = false }()
+
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer server.Close()
+
+	d := NewDispatcher()
+	d.Deliver(context.Background(), models.Webhook{ID: 1, URL: server.URL, Event: "update_failure", Format: FormatSlack},
+		map[string]interface{}{"host_id": 12})
+	d.Wait()
+	if body["text"] != "*Update failed on host 12*\n• host_id: 12" {
+		t.Errorf("receiver got %v", body)
+	}
+}
@@ -0,0 +1,179 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"ubuntu-auto-update/backend/pkg/db"
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+// Outbox tuning. An event is tried a few times as soon as it is emitted
+// (Dispatcher.DeliverEvent); if those fail it waits OutboxRetryAfter, which
+// outlasts them, and then RetryOutbox tries once per pass with a backoff of
+// 5 minutes doubling to 6 hours, MaxOutboxAttempts times: about 16 hours
+// in all. Past that the row stays undelivered and only a replay sends it.
+const (
+	OutboxRetryAfter  = 2 * time.Minute
+	MaxOutboxAttempts = 8
+
+	// outboxBatch bounds one pass. Sends are sequential with a
+	// DefaultTimeout each, so a batch finishes inside the 5-minute lease.
+	outboxBatch = 20
+
+	// MaxReplayEvents bounds how many events one replay queues.
+	MaxReplayEvents = 1000
+)
+
+// markDelivered records that eventID got through to webhookID. It runs on
+// its own short deadline, like record.
+func (d *Dispatcher) markDelivered(eventID int64, webhookID int32) {
+	if d.DB == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := d.DB.Exec(ctx, `
+		UPDATE webhook_outbox SET delivered_at = NOW()
+		WHERE event_id = $1 AND webhook_id = $2`, eventID, webhookID); err != nil {
+		log.Errorf("webhook %d: mark event %d delivered: %v", webhookID, eventID, err)
+	}
+}
+
+// RetryOutbox makes one attempt at each queued delivery that is due, up to
+// a batch, and returns how many got through. Rows are claimed by pushing
+// their next attempt back before anything is sent, so replicas running this
+// side by side never send the same row twice, and a replica that dies mid-
+// batch leaves its rows to be picked up once the lease runs out.
+func (d *Dispatcher) RetryOutbox(ctx context.Context) (int, error) {
+	if d.DB == nil {
+		return 0, nil
+	}
+	rows, err := d.DB.Query(ctx, `
+		UPDATE webhook_outbox o
+		SET attempts = o.attempts + 1,
+		    next_attempt_at = NOW() + make_interval(mins => LEAST(5 * power(2, o.attempts)::int, 360))
+		FROM events e, webhooks w
+		WHERE e.id = o.event_id AND w.id = o.webhook_id
+		  AND (o.event_id, o.webhook_id) IN (
+		      SELECT event_id, webhook_id FROM webhook_outbox
+		      WHERE delivered_at IS NULL AND next_attempt_at <= NOW() AND attempts < $1
+		      ORDER BY next_attempt_at
+		      LIMIT $2
+		      FOR UPDATE SKIP LOCKED)
+		RETURNING o.event_id, o.attempts, e.payload, w.id, w.url, w.event, w.format, w.host_id, w.tag`,
+		MaxOutboxAttempts, outboxBatch)
+	if err != nil {
+		return 0, fmt.Errorf("claim outbox: %w", err)
+	}
+	type due struct {
+		eventID  int64
+		attempts int
+		payload  []byte
+		hook     models.Webhook
+	}
+	var batch []due
+	for rows.Next() {
+		var r due
+		if err := rows.Scan(&r.eventID, &r.attempts, &r.payload,
+			&r.hook.ID, &r.hook.URL, &r.hook.Event, &r.hook.Format, &r.hook.HostID, &r.hook.Tag); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("claim outbox: %w", err)
+		}
+		batch = append(batch, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("claim outbox: %w", err)
+	}
+
+	delivered := 0
+	for _, r := range batch {
+		if ctx.Err() != nil {
+			break
+		}
+		payload, err := decodePayload(r.payload)
+		if err != nil {
+			log.Errorf("webhook %d: event %d: %v", r.hook.ID, r.eventID, err)
+			continue
+		}
+		resp, err := send(ctx, r.hook.URL, Render(r.hook.Format, r.hook.Event, payload))
+		// Numbered on from the immediate attempts so the delivery log reads
+		// as one sequence.
+		d.record(r.hook, d.maxAttempts+r.attempts, resp, err)
+		if err != nil {
+			log.WithError(err).Warnf("webhook to %s: event %d retry %d/%d failed", r.hook.URL, r.eventID, r.attempts, MaxOutboxAttempts)
+			continue
+		}
+		d.markDelivered(r.eventID, r.hook.ID)
+		delivered++
+	}
+	return delivered, nil
+}
+
+// RunOutbox calls RetryOutbox every interval until ctx ends.
+func (d *Dispatcher) RunOutbox(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if n, err := d.RetryOutbox(ctx); err != nil {
+			log.Errorf("webhook outbox: %v", err)
+		} else if n > 0 {
+			log.Infof("webhook outbox: delivered %d queued events", n)
+		}
+	}
+}
+
+// decodePayload turns a stored payload back into what Render takes.
+// Numbers stay json.Number so IDs print as they were sent.
+func decodePayload(raw []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var payload interface{}
+	if err := dec.Decode(&payload); err != nil {
+		return nil, fmt.Errorf("decode stored payload: %w", err)
+	}
+	return payload, nil
+}
+
+// Replay queues hook's events since since for delivery again, delivered or
+// not, oldest first and at most MaxReplayEvents, and returns how many. They
+// go out on RetryOutbox's next pass. The hook's current host or tag filter
+// decides which events are its.
+func Replay(ctx context.Context, dbx db.DBTX, hook models.Webhook, since time.Time) (int64, error) {
+	tag, err := dbx.Exec(ctx, `
+		INSERT INTO webhook_outbox (event_id, webhook_id)
+		SELECT e.id, $1 FROM events e
+		WHERE e.event = $2 AND e.created_at >= $3
+		  AND ($4::integer IS NULL OR e.host_id = $4)
+		  AND ($5::text IS NULL OR EXISTS (SELECT 1 FROM hosts h WHERE h.id = e.host_id AND $5 = ANY(h.tags)))
+		ORDER BY e.id
+		LIMIT $6
+		ON CONFLICT (event_id, webhook_id) DO UPDATE
+		SET delivered_at = NULL, attempts = 0, next_attempt_at = NOW()`,
+		hook.ID, hook.Event, since, hook.HostID, hook.Tag, MaxReplayEvents)
+	if err != nil {
+		return 0, fmt.Errorf("queue replay: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// PruneEvents deletes events older than retentionDays, and with them their
+// outbox rows, and returns how many went.
+func PruneEvents(ctx context.Context, dbx db.DBTX, retentionDays int) (int64, error) {
+	tag, err := dbx.Exec(ctx, `DELETE FROM events WHERE created_at < NOW() - make_interval(days => $1)`, retentionDays)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,169 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock/v4"
+
+	"ubuntu-auto-update/backend/pkg/models"
+)
+
+var outboxCols = []string{"event_id", "attempts", "payload", "id", "url", "event", "format", "host_id", "tag"}
+
+// An event that reaches its receiver is marked delivered in the outbox, so
+// the retry worker leaves it alone.
+func TestDispatcher_DeliverEventMarksDelivered(t *testing.T) {
+	skipSSRFCheck = true
+	defer func() { skipSSRFCheck = false }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	mock.ExpectExec("INSERT INTO webhook_deliveries").
+		WithArgs(int32(7), server.URL, "update_success", 1, statusArg{http.StatusOK}, "", "").
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectExec(`UPDATE webhook_outbox SET delivered_at = NOW\(\)`).WithArgs(int64(41), int32(7)).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	d := NewDispatcher()
+	d.DB = mock
+	d.DeliverEvent(context.Background(), models.Webhook{ID: 7, URL: server.URL, Event: "update_success"}, 41, map[string]int{"run_id": 17})
+	d.Wait()
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// RetryOutbox sends each due row once, numbering the attempt on from the
+// immediate ones, and marks only the ones that got through.
+func TestDispatcher_RetryOutboxRetriesUndelivered(t *testing.T) {
+	skipSSRFCheck = true
+	defer func() { skipSSRFCheck = false }()
+
+	var (
+		mu   sync.Mutex
+		body string
+	)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		body = string(b)
+		mu.Unlock()
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	mock.ExpectQuery(`UPDATE webhook_outbox o`).WithArgs(MaxOutboxAttempts, outboxBatch).
+		WillReturnRows(mock.NewRows(outboxCols).
+			AddRow(int64(41), 2, []byte(`{"host_id":3,"run_id":17}`), int32(7), up.URL, "update_failure", "raw", nil, nil).
+			AddRow(int64(41), 1, []byte(`{"host_id":3,"run_id":17}`), int32(8), down.URL, "update_failure", "raw", nil, nil))
+	mock.ExpectExec("INSERT INTO webhook_deliveries").
+		WithArgs(int32(7), up.URL, "update_failure", 5, statusArg{http.StatusOK}, "", "").
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectExec(`UPDATE webhook_outbox SET delivered_at = NOW\(\)`).WithArgs(int64(41), int32(7)).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectExec("INSERT INTO webhook_deliveries").
+		WithArgs(int32(8), down.URL, "update_failure", 4, statusArg{http.StatusServiceUnavailable}, "", pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	d := NewDispatcher()
+	d.DB = mock
+	n, err := d.RetryOutbox(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("delivered %d, want 1", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if body != `{"host_id":3,"run_id":17}` {
+		t.Errorf("receiver got %q, want the stored payload", body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// A replay queues the hook's events with its own filter, and the next
+// outbox pass sends them again even though they were delivered before.
+func TestReplay_ResendsEvents(t *testing.T) {
+	skipSSRFCheck = true
+	defer func() { skipSSRFCheck = false }()
+
+	var (
+		mu    sync.Mutex
+		calls int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	tag := "web"
+	hook := models.Webhook{ID: 7, URL: server.URL, Event: "update_success", Format: "raw", Tag: &tag}
+	since := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectExec(`INSERT INTO webhook_outbox`).
+		WithArgs(int32(7), "update_success", since, hook.HostID, hook.Tag, MaxReplayEvents).
+		WillReturnResult(pgxmock.NewResult("INSERT", 2))
+	rows := mock.NewRows(outboxCols)
+	for _, id := range []int64{40, 41} {
+		rows.AddRow(id, 1, []byte(`{"run_id":17}`), int32(7), server.URL, "update_success", "raw", nil, &tag)
+	}
+	mock.ExpectQuery(`UPDATE webhook_outbox o`).WithArgs(MaxOutboxAttempts, outboxBatch).WillReturnRows(rows)
+	for _, id := range []int64{40, 41} {
+		mock.ExpectExec("INSERT INTO webhook_deliveries").
+			WithArgs(int32(7), server.URL, "update_success", 4, statusArg{http.StatusOK}, "", "").
+			WillReturnResult(pgxmock.NewResult("INSERT", 1))
+		mock.ExpectExec(`UPDATE webhook_outbox SET delivered_at = NOW\(\)`).WithArgs(id, int32(7)).
+			WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	}
+
+	queued, err := Replay(context.Background(), mock, hook, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued != 2 {
+		t.Errorf("queued %d, want 2", queued)
+	}
+	d := NewDispatcher()
+	d.DB = mock
+	if n, err := d.RetryOutbox(context.Background()); err != nil || n != 2 {
+		t.Fatalf("RetryOutbox = %d, %v; want 2 delivered", n, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 2 {
+		t.Errorf("receiver called %d times, want 2", calls)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -61,23 +63,35 @@ func IsSafeURL(target string) error {
 
 // SendWithContext delivers a webhook payload with context support for cancellation.
 func SendWithContext(ctx context.Context, url string, payload interface{}) error {
+	_, err := send(ctx, url, payload)
+	return err
+}
+
+// response is what a receiver sent back: its status code (0 when the
+// request never got one) and the start of its body, for the delivery log.
+type response struct {
+	StatusCode int
+	Snippet    string
+}
+
+func send(ctx context.Context, url string, payload interface{}) (response, error) {
 	if !skipSSRFCheck {
 		if err := IsSafeURL(url); err != nil {
 			log.Warnf("Refused to send webhook to %s: %v", url, err)
-			return fmt.Errorf("unsafe webhook URL: %w", err)
+			return response{}, fmt.Errorf("unsafe webhook URL: %w", err)
 		}
 	}
 
 	jsonPayload, err := json.Marshal(payload)
 	if err != nil {
 		log.Errorf("Failed to marshal webhook payload: %v", err)
-		return fmt.Errorf("failed to marshal webhook payload: %w", err)
+		return response{}, fmt.Errorf("failed to marshal webhook payload: %w", err)
 	}
 
 	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonPayload))
 	if err != nil {
 		log.Errorf("Failed to create webhook request: %v", err)
-		return fmt.Errorf("failed to create webhook request: %w", err)
+		return response{}, fmt.Errorf("failed to create webhook request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
@@ -90,15 +104,20 @@ func SendWithContext(ctx context.Context, url string, payload interface{}) error
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Errorf("Failed to send webhook to %s: %v", url, err)
-		return fmt.Errorf("failed to send webhook: %w", err)
+		return response{}, fmt.Errorf("failed to send webhook: %w", err)
 	}
 	defer resp.Body.Close()
 
+	// Only the first MaxSnippetBytes are kept; a receiver that answers with
+	// a whole HTML error page shouldn't grow the delivery log by megabytes.
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, MaxSnippetBytes))
+	out := response{StatusCode: resp.StatusCode, Snippet: strings.ToValidUTF8(string(body), "")}
+
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		log.Errorf("Webhook to %s returned non-success status code: %d", url, resp.StatusCode)
-		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+		return out, fmt.Errorf("webhook returned status %d", resp.StatusCode)
 	}
 
 	log.Debugf("Webhook delivered to %s successfully", url)
-	return nil
+	return out, nil
 }
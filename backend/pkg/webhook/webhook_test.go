@@ -4,8 +4,13 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/pashagolub/pgxmock/v4"
+
+	"ubuntu-auto-update/backend/pkg/models"
 )
 
 func TestSend_Success(t *testing.T) {
@@ -102,3 +107,123 @@ func TestIsSafeURL_BadScheme(t *testing.T) {
 		t.Error("expected error for non-http scheme")
 	}
 }
+
+func TestDispatcher_Pending(t *testing.T) {
+	skipSSRFCheck = true
+	defer func() { skipSSRFCheck = false }()
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	d := NewDispatcher()
+	hook := models.Webhook{ID: 1, URL: server.URL, Event: "update_success"}
+	d.Deliver(context.Background(), hook, map[string]string{"k": "v"})
+	d.Deliver(context.Background(), hook, map[string]string{"k": "v"})
+	if got := d.Pending(); got != 2 {
+		t.Errorf("Pending = %d while in flight, want 2", got)
+	}
+	close(release)
+	d.Wait()
+	if got := d.Pending(); got != 0 {
+		t.Errorf("Pending = %d after Wait, want 0", got)
+	}
+}
+
+// statusArg matches the *int status_code argument of a delivery insert.
+type statusArg struct{ want int }
+
+func (a statusArg) Match(v interface{}) bool {
+	p, ok := v.(*int)
+	if a.want == 0 {
+		return ok && p == nil
+	}
+	return ok && p != nil && *p == a.want
+}
+
+func TestDispatcher_LogsEachAttempt(t *testing.T) {
+	skipSSRFCheck = true
+	defer func() { skipSSRFCheck = false }()
+
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("upstream down"))
+			return
+		}
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer server.Close()
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	hook := models.Webhook{ID: 7, URL: server.URL, Event: "update_failure"}
+	mock.ExpectExec("INSERT INTO webhook_deliveries").
+		WithArgs(int32(7), server.URL, "update_failure", 1, statusArg{http.StatusBadGateway},
+			"upstream down", "webhook returned status 502").
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectExec("INSERT INTO webhook_deliveries").
+		WithArgs(int32(7), server.URL, "update_failure", 2, statusArg{http.StatusOK},
+			`{"ok":true}`, "").
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	d := NewDispatcher()
+	d.baseBackoff = time.Millisecond
+	d.DB = mock
+	d.Deliver(context.Background(), hook, map[string]string{"k": "v"})
+	d.Wait()
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDispatcher_LogsUnreachableWithoutStatus(t *testing.T) {
+	skipSSRFCheck = true
+	defer func() { skipSSRFCheck = false }()
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	mock.ExpectExec("INSERT INTO webhook_deliveries").
+		WithArgs(int32(3), "http://127.0.0.1:1", "host_offline", 1, statusArg{0}, "", pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+
+	d := NewDispatcher()
+	d.maxAttempts = 1
+	d.DB = mock
+	d.Deliver(context.Background(), models.Webhook{ID: 3, URL: "http://127.0.0.1:1", Event: "host_offline"}, nil)
+	d.Wait()
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSend_CapsResponseSnippet(t *testing.T) {
+	skipSSRFCheck = true
+	defer func() { skipSSRFCheck = false }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 10*MaxSnippetBytes)))
+	}))
+	defer server.Close()
+
+	resp, err := send(context.Background(), server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Snippet) != MaxSnippetBytes {
+		t.Errorf("snippet is %d bytes, want %d", len(resp.Snippet), MaxSnippetBytes)
+	}
+}
@@ -51,7 +51,9 @@ async function request<T>(endpoint: string, init: RequestInit, redirectOn401 = t
     let message = `API error: ${response.status} ${response.statusText}`;
     try {
       const body = await response.json();
-      if (body && typeof body.error === 'string') message = body.error;
+      // message is the human-readable text; older servers only sent error.
+      if (body && typeof body.message === 'string') message = body.message;
+      else if (body && typeof body.error === 'string') message = body.error;
     } catch { /* non-JSON body */ }
     throw new Error(message);
   }
@@ -102,7 +104,7 @@ export async function apiLogin(username: string, password: string): Promise<Logi
   // Auth model — why the token lives in localStorage (and not only the cookie):
   // the backend also sets an HttpOnly `auth_token` cookie at login, which is the
   // primary credential for HTTP requests. But the events WebSocket ignores
-  // cookies (a CSWSH defense) and authenticates via a `?token=` query param, so
+  // cookies (a CSWSH defense) and authenticates via a token in the handshake, so
   // the client needs the raw token in JS to open the socket. Exfiltrating it
   // requires an XSS, which the CSP already blocks (script-src 'self', no inline
   // scripts). Removing this would break live streaming — don't "harden" it to
@@ -151,8 +153,15 @@ export function canDoAdmin(): boolean {
   return currentRole() === 'admin';
 }
 
+// WS_TOKEN_PROTOCOL mirrors middleware.WSTokenProtocol on the backend. The
+// token rides in Sec-WebSocket-Protocol rather than `?token=` so it stays out
+// of URLs, and therefore out of proxy and access logs.
+const WS_TOKEN_PROTOCOL = 'uau.bearer';
+
 export function createWebSocket(endpoint: string): WebSocket {
   const token = localStorage.getItem('auth_token') || '';
-  const separator = endpoint.includes('?') ? '&' : '?';
-  return new WebSocket(`${getWsBaseUrl()}${endpoint}${separator}token=${encodeURIComponent(token)}`);
+  // An empty string is not a valid subprotocol and would throw; without a
+  // token the server answers 401 and the caller's onclose handles it.
+  const protocols = token ? [WS_TOKEN_PROTOCOL, token] : [];
+  return new WebSocket(`${getWsBaseUrl()}${endpoint}`, protocols);
 }
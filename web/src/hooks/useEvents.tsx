@@ -10,11 +10,14 @@ import { createWebSocket, isAuthenticated } from '../api';
 
 // Event mirrors backend pkg/events.Event. Component subscribers usually
 // only care about table/op/id; the WS payload is JSON-encoded directly so
-// the shape is the public contract.
+// the shape is the public contract. Rows of the "events" table are the
+// events webhooks get: `event` names them and `host_id` is their host.
 export interface ServerEvent {
   table: string;
   op: 'INSERT' | 'UPDATE' | 'DELETE' | 'snapshot';
   id: number;
+  event?: string;
+  host_id?: number;
 }
 
 // Filter is applied client-side: subscribers receive only events that match
@@ -25,6 +28,8 @@ export interface EventFilter {
   table?: string;
   op?: ServerEvent['op'];
   id?: number;
+  event?: string;
+  host_id?: number;
 }
 
 type Listener = (event: ServerEvent) => void;
@@ -132,6 +137,8 @@ class Manager {
       if (filter.table && filter.table !== event.table) continue;
       if (filter.op && filter.op !== event.op) continue;
       if (filter.id != null && filter.id !== event.id) continue;
+      if (filter.event && filter.event !== event.event) continue;
+      if (filter.host_id != null && filter.host_id !== event.host_id) continue;
       try {
         cb(event);
       } catch (err) {
@@ -190,5 +197,5 @@ export function useEvent(filter: EventFilter, cb: Listener) {
     const stable: Listener = ev => cbRef.current(ev);
     return ctx.subscribe(filter, stable);
     // eslint-disable-next-line react-hooks/exhaustive-deps
-  }, [ctx, filter.table, filter.op, filter.id]);
+  }, [ctx, filter.table, filter.op, filter.id, filter.event, filter.host_id]);
 }
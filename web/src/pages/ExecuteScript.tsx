@@ -18,6 +18,9 @@ export function ExecuteScript() {
     };
 
     ws.onmessage = (event) => {
+      // The closing {"type":"exit"} message is for API clients; the
+      // "[done: exit N]" line before it already shows the result.
+      if (typeof event.data === 'string' && event.data.startsWith('{"type":"exit"')) return;
       setOutput(prev => [...prev, event.data]);
     };
 
@@ -47,7 +50,7 @@ export function ExecuteScript() {
               <button type="button" aria-label="Close" rel="prev" onClick={() => setIsModalOpen(false)} />
               <strong>Script Output</strong>
             </header>
-            <pre><code>{output.join('\n')}</code></pre>
+            <pre><code>{output.join('')}</code></pre>
           </article>
         </dialog>
       )}
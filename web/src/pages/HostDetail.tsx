@@ -356,6 +356,7 @@ export function HostDetail() {
             <div style={{ display: 'flex', gap: '1.5rem', flexWrap: 'wrap', margin: '0 0 1rem', fontSize: '0.9rem' }}>
               {host.os_version && <span><strong>OS:</strong> {host.os_version}</span>}
               {host.kernel_version && <span><strong>Kernel:</strong> <code>{host.kernel_version}</code></span>}
+              {host.architecture && <span><strong>Arch:</strong> {host.architecture}</span>}
               {host.agent_version && <span><strong>Agent:</strong> {host.agent_version}</span>}
               <span><strong>Updates available:</strong> {host.packages_available}</span>
               {host.reboot_required && <span style={{ color: 'var(--bad)', fontWeight: 600 }}>⟳ Reboot required</span>}
@@ -368,11 +369,11 @@ export function HostDetail() {
             </article>
           )}
           <details open>
-            <summary>Latest upgrade output</summary>
+            <summary>Latest upgrade output{host.upgrade_output_truncated && ' (truncated, showing the end)'}</summary>
             <pre><code>{host.upgrade_output || 'No output captured.'}</code></pre>
           </details>
           <details>
-            <summary>Latest update output (apt-get update)</summary>
+            <summary>Latest update output (apt-get update){host.update_output_truncated && ' (truncated, showing the end)'}</summary>
             <pre><code>{host.update_output || 'No output captured.'}</code></pre>
           </details>
         </section>
@@ -13,21 +13,12 @@ import { RolloutModal, type RolloutOptions } from '../components/RolloutModal';
 
 type StatusFilter = 'all' | HostStatus;
 
-// hostStatus maps a raw host record to a StatusBadge state. Last-seen older
-// than OFFLINE_THRESHOLD_MS without an explicit error is "offline" — the agent
-// hasn't reported recently, but we don't have evidence of an actual failure.
-const OFFLINE_THRESHOLD_MS = 15 * 60 * 1000;
-
+// hostStatus maps a raw host record to a StatusBadge state. An explicit error
+// wins; otherwise the server's online/offline (derived from last_seen against
+// OFFLINE_AFTER_MINUTES) is used as-is so the UI and host_offline agree.
 function hostStatus(host: Host): HostStatus {
   if (host.error) return 'error';
-  // Server-side sweep is the source of truth; the client-side threshold
-  // below remains as a fallback for rows the sweep hasn't evaluated yet.
-  if (host.offline_since) return 'offline';
-  const lastSeen = new Date(host.last_seen).getTime();
-  if (Number.isFinite(lastSeen) && Date.now() - lastSeen > OFFLINE_THRESHOLD_MS) {
-    return 'offline';
-  }
-  return 'online';
+  return host.status;
 }
 
 export function HostList() {
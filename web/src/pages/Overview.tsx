@@ -7,8 +7,6 @@ import { StatusBadge } from '../components/StatusBadge';
 import { StatCard } from '../components/StatCard';
 import { useEvent } from '../hooks/useEvents';
 
-const OFFLINE_THRESHOLD_MS = 15 * 60 * 1000;
-
 // Fleet Overview: the landing dashboard. Stat cards from /overview, plus a
 // "needs attention" list (error/offline hosts) and upcoming schedules —
 // everything an operator wants before drilling into a host.
@@ -43,11 +41,7 @@ export function Overview() {
   useEvent({ table: 'hosts' }, refresh);
   useEvent({ table: 'update_runs' }, refresh);
 
-  const attention = hosts.filter(h => {
-    if (h.error) return true;
-    const seen = new Date(h.last_seen).getTime();
-    return Number.isFinite(seen) && Date.now() - seen > OFFLINE_THRESHOLD_MS;
-  });
+  const attention = hosts.filter(h => h.error || h.status === 'offline');
 
   const upcoming = schedules.filter(s => s.enabled).slice(0, 5);
 
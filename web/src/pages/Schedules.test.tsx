@@ -33,7 +33,7 @@ const HOSTS = [
     id: 1, hostname: 'web-1', ssh_user: 'root', created_at: '', updated_at: '',
     last_seen: '', update_output: '', upgrade_output: '', error: null, tags: [],
     reboot_required: false, packages_updated: 0, packages_available: 0,
-    os_version: '', kernel_version: '', agent_version: '', offline_since: null,
+    os_version: '', kernel_version: '', agent_version: '', architecture: '', offline_since: null, status: 'online', update_output_truncated: false, upgrade_output_truncated: false,
   },
 ];
 
@@ -1,6 +1,6 @@
 import { useCallback, useEffect, useState } from 'react';
 import { apiDelete, apiGet, apiPatch, apiPost, canDoAdmin } from '../api';
-import type { ApiToken, AuditRecord, Role, User, Webhook } from '../types';
+import type { ApiToken, AuditRecord, Role, User, Webhook, WebhookFormat } from '../types';
 import { RelativeTime } from '../components/RelativeTime';
 import { useToast } from '../components/Toast';
 import { useConfirm } from '../components/ConfirmDialog';
@@ -260,6 +260,8 @@ function WebhooksSection() {
   const [hooks, setHooks] = useState<Webhook[]>([]);
   const [url, setUrl] = useState('');
   const [event, setEvent] = useState('update_failure');
+  const [format, setFormat] = useState<WebhookFormat>('raw');
+  const [tag, setTag] = useState('');
   const [busy, setBusy] = useState(false);
   const toast = useToast();
 
@@ -274,9 +276,10 @@ function WebhooksSection() {
     e.preventDefault();
     setBusy(true);
     try {
-      await apiPost('/api/v1/webhooks', { url: url.trim(), event });
+      await apiPost('/api/v1/webhooks', { url: url.trim(), event, format, ...(tag.trim() ? { tag: tag.trim() } : {}) });
       toast.show('Webhook added.', 'success');
       setUrl('');
+      setTag('');
       refresh();
     } catch (err) {
       toast.show(err instanceof Error ? err.message : 'Failed to add webhook.', 'error');
@@ -298,7 +301,7 @@ function WebhooksSection() {
     <section style={{ marginBottom: '2rem' }}>
       <h3>Webhooks</h3>
       <p style={{ opacity: 0.7, marginTop: 0 }}>
-        POSTed a JSON payload when an event fires (e.g. an update fails). Point it at Slack, Discord, or your own endpoint.
+        POSTed a JSON payload when an event fires (e.g. an update fails). Pick the Slack or Teams format for an incoming-webhook URL; raw suits your own endpoint.
       </p>
       <form onSubmit={add} style={{ display: 'flex', gap: '0.5rem', flexWrap: 'wrap', alignItems: 'flex-end' }}>
         <label style={{ flex: '1 1 18rem', marginBottom: 0 }}>URL
@@ -311,6 +314,16 @@ function WebhooksSection() {
             <option value="preview_success">preview_success</option>
           </select>
         </label>
+        <label style={{ flex: '0 1 8rem', marginBottom: 0 }}>Format
+          <select value={format} onChange={e => setFormat(e.target.value as WebhookFormat)}>
+            <option value="raw">raw</option>
+            <option value="slack">slack</option>
+            <option value="teams">teams</option>
+          </select>
+        </label>
+        <label style={{ flex: '0 1 10rem', marginBottom: 0 }}>Only tag
+          <input value={tag} onChange={e => setTag(e.target.value)} placeholder="all hosts" />
+        </label>
         <button type="submit" disabled={busy} aria-busy={busy || undefined} style={{ width: 'auto' }}>Add webhook</button>
       </form>
 
@@ -318,12 +331,14 @@ function WebhooksSection() {
         <p style={{ marginTop: '1rem', opacity: 0.7 }}>No webhooks configured.</p>
       ) : (
         <table style={{ marginTop: '1rem' }}>
-          <thead><tr><th>URL</th><th>Event</th><th></th></tr></thead>
+          <thead><tr><th>URL</th><th>Event</th><th>Format</th><th>Hosts</th><th></th></tr></thead>
           <tbody>
             {hooks.map(h => (
               <tr key={h.id}>
                 <td style={{ wordBreak: 'break-all' }}>{h.url}</td>
                 <td><code>{h.event}</code></td>
+                <td>{h.format}</td>
+                <td>{h.host_id != null ? `host ${h.host_id}` : h.tag ? <code>{h.tag}</code> : 'all'}</td>
                 <td><button type="button" className="secondary" style={btnSm} onClick={() => remove(h)}>Delete</button></td>
               </tr>
             ))}
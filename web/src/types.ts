@@ -7,6 +7,8 @@ export interface Host {
   last_seen: string;
   update_output: string;
   upgrade_output: string;
+  update_output_truncated: boolean;
+  upgrade_output_truncated: boolean;
   error: string | null;
   tags: string[];
   reboot_required: boolean;
@@ -15,7 +17,9 @@ export interface Host {
   os_version: string;
   kernel_version: string;
   agent_version: string;
+  architecture: string;
   offline_since: string | null;
+  status: 'online' | 'offline';
 }
 
 export interface Schedule {
@@ -57,10 +61,15 @@ export interface ApiToken {
   last_used_at: string | null;
 }
 
+export type WebhookFormat = 'raw' | 'slack' | 'teams';
+
 export interface Webhook {
   id: number;
   url: string;
   event: string;
+  format: WebhookFormat;
+  host_id?: number;
+  tag?: string;
 }
 
 export type RunKind = 'preview' | 'update' | 'playbook' | 'reboot';
@@ -100,9 +109,11 @@ export interface BulkRunResult {
 
 export interface TestConnectionResult {
   ok: boolean;
+  reachable: boolean;
   latency_ms: number;
   sudo_state: 'root' | 'available' | 'unavailable' | 'n/a';
   greeting: string;
+  failure?: 'auth_failed' | 'host_unreachable' | 'host_key_mismatch' | 'ssh_error';
   error?: string;
 }
 